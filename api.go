@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The admin API lets tools such as web panels see our state and act like an
+// operator without an IRC connection. It's JSON over HTTP on a loopback
+// address (api-listen). Requests must have the token from the config (api-
+// token) in an Authorization: Bearer header.
+//
+// Read endpoints (GET):
+//
+// /api/users
+// /api/channels
+// /api/servers
+// /api/bans
+//
+// Actions (POST, with a JSON body):
+//
+// /api/kline {"mask": "user@host", "reason": "...", "minutes": 0}
+// /api/unkline {"mask": "user@host"}
+// /api/kill {"nick": "...", "reason": "..."}
+// /api/rehash
+// /api/squit {"server": "...", "reason": "..."}
+//
+// We tell operators about actions as we do when operators take them. The
+// source is "API".
+
+// apiSource is who we say API actions come from.
+const apiSource = "API"
+
+type apiUser struct {
+	Nick        string   `json:"nick"`
+	UID         string   `json:"uid"`
+	Username    string   `json:"username"`
+	Hostname    string   `json:"hostname"`
+	DisplayHost string   `json:"display_host"`
+	IP          string   `json:"ip"`
+	RealName    string   `json:"real_name"`
+	Server      string   `json:"server"`
+	Account     string   `json:"account"`
+	Modes       string   `json:"modes"`
+	Channels    []string `json:"channels"`
+}
+
+type apiChannel struct {
+	Name    string   `json:"name"`
+	TS      int64    `json:"ts"`
+	Topic   string   `json:"topic"`
+	Modes   string   `json:"modes"`
+	Members []string `json:"members"`
+}
+
+type apiServer struct {
+	Name        string `json:"name"`
+	SID         string `json:"sid"`
+	Description string `json:"description"`
+	HopCount    int    `json:"hop_count"`
+	LinkedTo    string `json:"linked_to"`
+}
+
+type apiKLine struct {
+	Mask    string `json:"mask"`
+	Reason  string `json:"reason"`
+	Expires int64  `json:"expires"`
+}
+
+// apiRequest holds the parameters actions may have.
+type apiRequest struct {
+	Mask    string `json:"mask"`
+	Reason  string `json:"reason"`
+	Minutes int64  `json:"minutes"`
+	Nick    string `json:"nick"`
+	Server  string `json:"server"`
+}
+
+// apiError is how we describe a failed request.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+// startAPIServer starts serving the API on the api-listen address.
+// shutdown() stops it.
+func (cb *Catbox) startAPIServer() error {
+	ln, err := net.Listen("tcp", cb.Config.APIListen)
+	if err != nil {
+		return fmt.Errorf("unable to listen (API): %s", err)
+	}
+
+	cb.APIToken.Store(cb.Config.APIToken)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/users", cb.apiHandler(http.MethodGet, cb.apiUsers))
+	mux.HandleFunc("/api/channels",
+		cb.apiHandler(http.MethodGet, cb.apiChannels))
+	mux.HandleFunc("/api/servers", cb.apiHandler(http.MethodGet, cb.apiServers))
+	mux.HandleFunc("/api/bans", cb.apiHandler(http.MethodGet, cb.apiBans))
+	mux.HandleFunc("/api/kline", cb.apiHandler(http.MethodPost, cb.apiKLine))
+	mux.HandleFunc("/api/unkline",
+		cb.apiHandler(http.MethodPost, cb.apiUnkline))
+	mux.HandleFunc("/api/kill", cb.apiHandler(http.MethodPost, cb.apiKill))
+	mux.HandleFunc("/api/rehash", cb.apiHandler(http.MethodPost, cb.apiRehash))
+	mux.HandleFunc("/api/squit", cb.apiHandler(http.MethodPost, cb.apiSquit))
+
+	cb.APIServer = &http.Server{Handler: mux}
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		if err := cb.APIServer.Serve(ln); err != http.ErrServerClosed {
+			coreLog.Errorf("API listener failed: %s", err)
+		}
+		coreLog.Debugf("API listener shutting down.")
+	}()
+
+	coreLog.Infof("Serving API on %s", ln.Addr())
+	return nil
+}
+
+// apiHandler makes an HTTP handler for an endpoint. It checks the request and
+// has the server goroutine run the endpoint's function, since that goroutine
+// owns our state. The function returns what to respond with.
+func (cb *Catbox) apiHandler(method string,
+	f func(apiRequest) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cb.apiAuthorized(r) {
+			writeAPIError(w, &apiError{http.StatusUnauthorized, "unauthorized"})
+			return
+		}
+
+		if r.Method != method {
+			writeAPIError(w, &apiError{http.StatusMethodNotAllowed,
+				fmt.Sprintf("use %s", method)})
+			return
+		}
+
+		var req apiRequest
+		if method == http.MethodPost {
+			decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+			decoder.DisallowUnknownFields()
+			// Some actions have no parameters, so the body may be empty.
+			if err := decoder.Decode(&req); err != nil && err != io.EOF {
+				writeAPIError(w, &apiError{http.StatusBadRequest,
+					fmt.Sprintf("invalid request: %s", err)})
+				return
+			}
+		}
+
+		var resp interface{}
+		var err error
+		done := make(chan struct{})
+		cb.newEvent(Event{Type: APIEvent, APIFunc: func() {
+			resp, err = f(req)
+			close(done)
+		}})
+
+		select {
+		case <-done:
+		case <-cb.ShutdownChan:
+			writeAPIError(w, &apiError{http.StatusServiceUnavailable,
+				"shutting down"})
+			return
+		}
+
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, resp)
+	}
+}
+
+// apiAuthorized checks the request has our token.
+func (cb *Catbox) apiAuthorized(r *http.Request) bool {
+	token, ok := cb.APIToken.Load().(string)
+	if !ok || token == "" {
+		return false
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return checkPassword(token, strings.TrimPrefix(header, "Bearer "))
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if apiErr, ok := err.(*apiError); ok {
+		status = apiErr.status
+	}
+	writeAPIResponse(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, resp interface{}) {
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(buf, '\n'))
+}
+
+// apiOK is what actions respond with when they succeed.
+var apiOK = map[string]bool{"ok": true}
+
+func (cb *Catbox) apiUsers(req apiRequest) (interface{}, error) {
+	users := []apiUser{}
+	for _, user := range cb.Users {
+		server := cb.Config.ServerName
+		if !user.isLocal() {
+			server = user.Server.Name
+		}
+
+		channels := []string{}
+		for _, channel := range user.Channels {
+			channels = append(channels, channel.Name)
+		}
+		sort.Strings(channels)
+
+		users = append(users, apiUser{
+			Nick:        user.DisplayNick,
+			UID:         string(user.UID),
+			Username:    user.Username,
+			Hostname:    user.Hostname,
+			DisplayHost: user.DisplayHost,
+			IP:          user.IP,
+			RealName:    user.RealName,
+			Server:      server,
+			Account:     user.Account,
+			Modes:       user.modesString(),
+			Channels:    channels,
+		})
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Nick < users[j].Nick })
+	return users, nil
+}
+
+func (cb *Catbox) apiChannels(req apiRequest) (interface{}, error) {
+	channels := []apiChannel{}
+	for _, channel := range cb.Channels {
+		members := []string{}
+		for uid := range channel.Members {
+			if user, exists := cb.Users[uid]; exists {
+				members = append(members, user.DisplayNick)
+			}
+		}
+		sort.Strings(members)
+
+		channels = append(channels, apiChannel{
+			Name:    channel.Name,
+			TS:      channel.TS,
+			Topic:   channel.Topic,
+			Modes:   channel.modesString(),
+			Members: members,
+		})
+	}
+
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels, nil
+}
+
+func (cb *Catbox) apiServers(req apiRequest) (interface{}, error) {
+	servers := []apiServer{{
+		Name:        cb.Config.ServerName,
+		SID:         string(cb.Config.TS6SID),
+		Description: cb.Config.ServerInfo,
+	}}
+
+	for _, server := range cb.Servers {
+		linkedTo := cb.Config.ServerName
+		if server.LinkedTo != nil {
+			linkedTo = server.LinkedTo.Name
+		}
+
+		servers = append(servers, apiServer{
+			Name:        server.Name,
+			SID:         string(server.SID),
+			Description: server.Description,
+			HopCount:    server.HopCount,
+			LinkedTo:    linkedTo,
+		})
+	}
+
+	sort.Slice(servers[1:], func(i, j int) bool {
+		return servers[i+1].Name < servers[j+1].Name
+	})
+	return servers, nil
+}
+
+func (cb *Catbox) apiBans(req apiRequest) (interface{}, error) {
+	klines := []apiKLine{}
+	for _, kline := range cb.KLines {
+		klines = append(klines, apiKLine{
+			Mask:    fmt.Sprintf("%s@%s", kline.UserMask, kline.HostMask),
+			Reason:  kline.Reason,
+			Expires: kline.Expires,
+		})
+	}
+	return klines, nil
+}
+
+// parseAPIMask checks and splits a user@host mask.
+func parseAPIMask(mask string) (string, string, error) {
+	pieces := strings.Split(mask, "@")
+	if len(pieces) != 2 || !isValidUserMask(pieces[0]) ||
+		!isValidHostMask(pieces[1]) {
+		return "", "", &apiError{http.StatusBadRequest,
+			fmt.Sprintf("invalid mask: %s", mask)}
+	}
+	return pieces[0], pieces[1], nil
+}
+
+func (cb *Catbox) apiKLine(req apiRequest) (interface{}, error) {
+	userMask, hostMask, err := parseAPIMask(req.Mask)
+	if err != nil {
+		return nil, err
+	}
+	if req.Reason == "" {
+		return nil, &apiError{http.StatusBadRequest, "you must give a reason"}
+	}
+	if req.Minutes < 0 {
+		return nil, &apiError{http.StatusBadRequest,
+			"minutes must not be negative"}
+	}
+
+	logEvent("oper", "%s used KLINE %d %s@%s %s", apiSource, req.Minutes,
+		userMask, hostMask, req.Reason)
+
+	cb.kline(string(cb.Config.TS6SID), apiSource,
+		fmt.Sprintf("%s{%s}", apiSource, cb.Config.ServerName), req.Minutes,
+		userMask, hostMask, req.Reason)
+	return apiOK, nil
+}
+
+func (cb *Catbox) apiUnkline(req apiRequest) (interface{}, error) {
+	userMask, hostMask, err := parseAPIMask(req.Mask)
+	if err != nil {
+		return nil, err
+	}
+
+	logEvent("oper", "%s used UNKLINE %s@%s", apiSource, userMask, hostMask)
+
+	cb.unkline(string(cb.Config.TS6SID), apiSource,
+		fmt.Sprintf("%s{%s}", apiSource, cb.Config.ServerName), userMask,
+		hostMask)
+	return apiOK, nil
+}
+
+func (cb *Catbox) apiKill(req apiRequest) (interface{}, error) {
+	uid, exists := cb.Nicks[canonicalizeNick(req.Nick)]
+	if !exists {
+		return nil, &apiError{http.StatusNotFound,
+			fmt.Sprintf("no such nick: %s", req.Nick)}
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "<No reason given>"
+	}
+
+	logEvent("oper", "%s used KILL %s %s", apiSource, req.Nick, reason)
+
+	// With no killer, the KILL is from us.
+	cb.issueKill(nil, cb.Users[uid], reason)
+	return apiOK, nil
+}
+
+func (cb *Catbox) apiRehash(req apiRequest) (interface{}, error) {
+	logEvent("oper", "%s used REHASH", apiSource)
+
+	cb.rehash(nil)
+	return apiOK, nil
+}
+
+func (cb *Catbox) apiSquit(req apiRequest) (interface{}, error) {
+	server := cb.getServerByName(req.Server)
+	if server == nil {
+		return nil, &apiError{http.StatusNotFound,
+			fmt.Sprintf("no such server: %s", req.Server)}
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "No reason given"
+	}
+
+	logEvent("oper", "%s used SQUIT %s %s", apiSource, req.Server, reason)
+
+	cb.squit(server, string(cb.Config.TS6SID), apiSource, reason)
+	return apiOK, nil
+}
@@ -11,12 +11,32 @@ import (
 type Args struct {
 	ConfigFile string
 	ListenFD   int
+
+	// State the process we upgraded from left for us. See upgrade().
+	UpgradeFile string
+
+	// File to write our process ID to. Blank if none.
+	PIDFile string
+
+	// Directory to change to. Blank to stay where we are.
+	Dir string
+
+	// File to log to. Blank to log to stdout.
+	LogFile string
 }
 
 func getArgs() *Args {
 	configFile := flag.String("conf", "", "Configuration file.")
 	fd := flag.Int("listen-fd", -1,
 		"File descriptor with listening port to use (optional).")
+	upgradeFile := flag.String("upgrade-state", "",
+		"State from the process we upgraded from (set by catbox).")
+	pidFile := flag.String("pid-file", "",
+		"File to write our process ID to (optional).")
+	dir := flag.String("dir", "",
+		"Directory to change to (optional).")
+	logFile := flag.String("log-file", "",
+		"File to log to instead of stdout. We reopen it when we rehash (optional).")
 
 	flag.Parse()
 
@@ -32,9 +52,31 @@ func getArgs() *Args {
 		return nil
 	}
 
+	// We change directory before we use the others, so make them absolute.
+	paths := map[string]*string{"pid file": pidFile, "directory": dir,
+		"log file": logFile}
+	for name, path := range paths {
+		if *path == "" {
+			continue
+		}
+		absPath, err := filepath.Abs(*path)
+		if err != nil {
+			printUsage(fmt.Errorf("unable to determine path to the %s: %s", name,
+				err))
+			return nil
+		}
+		*path = absPath
+	}
+
 	return &Args{
 		ConfigFile: configPath,
 		ListenFD:   *fd,
+
+		UpgradeFile: *upgradeFile,
+
+		PIDFile: *pidFile,
+		Dir:     *dir,
+		LogFile: *logFile,
 	}
 }
 
@@ -42,4 +84,6 @@ func printUsage(err error) {
 	_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)                           // nolint: gas
 	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s <arguments>\n", os.Args[0]) // nolint: gas
 	flag.PrintDefaults()
+	_, _ = fmt.Fprintf(os.Stderr, "Or: %s <version|genconfig|checkconfig|mkpasswd>\n", // nolint: gas
+		os.Args[0])
 }
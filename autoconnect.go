@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// LinkState tracks our attempts to connect out to a server in the servers
+// config. We keep it across rehashes.
+type LinkState struct {
+	// When we may next try to connect.
+	NextAttempt time.Time
+
+	// How many times in a row we tried to connect without linking.
+	Failures int
+
+	// An operator may turn autoconnect on or off (AUTOCONN). nil if they did
+	// not, in which case the servers config decides.
+	AutoConnect *bool
+}
+
+// linkState finds the state for the server. We make it if necessary.
+func (cb *Catbox) linkState(name string) *LinkState {
+	state, exists := cb.Links[name]
+	if !exists {
+		state = &LinkState{}
+		cb.Links[name] = state
+	}
+	return state
+}
+
+// autoConnects tells whether we connect to the server on our own.
+func (cb *Catbox) autoConnects(linkInfo *ServerDefinition) bool {
+	// Services connect to us.
+	if linkInfo.Services {
+		return false
+	}
+
+	state := cb.linkState(linkInfo.Name)
+	if state.AutoConnect != nil {
+		return *state.AutoConnect
+	}
+	return linkInfo.AutoConnect
+}
+
+// connectInterval is how long to wait before trying to connect to the server
+// again.
+//
+// It is the frequency of the server's connect class. If we keep failing, we
+// back off exponentially up to connect-max-backoff. We add jitter so that
+// servers which split together don't all try again together.
+func (cb *Catbox) connectInterval(linkInfo *ServerDefinition,
+	failures int) time.Duration {
+	interval := cb.Config.ConnectAttemptTime
+	if frequency, exists := cb.Config.ConnectClasses[linkInfo.Class]; exists {
+		interval = frequency
+	}
+
+	for i := 1; i < failures && interval < cb.Config.ConnectMaxBackoff; i++ {
+		interval *= 2
+	}
+	if interval > cb.Config.ConnectMaxBackoff {
+		interval = cb.Config.ConnectMaxBackoff
+	}
+
+	// Up to 10% either way.
+	if jitter := int64(interval) / 5; jitter > 0 {
+		interval += time.Duration(rand.Int63n(jitter) - jitter/2)
+	}
+
+	return interval
+}
+
+// connectToServers tries to connect outwards to any servers configured but not
+// currently connected to.
+//
+// Each server has its own schedule. See connectInterval(). As well, we wait
+// at least ConnectAttemptTime between any two attempts, whichever servers
+// they're to.
+//
+// Try to link to at most one server per call. This is to try to address the
+// race condition where we link with two servers in the same network at the
+// "same" time. Such a condition will lead to a split, but it can cause noise
+// and collisions. Note this is a best effort approach. There is no limit on
+// inbound linking. My intention is to reduce the likelihood of the race
+// happening rather than make it impossible. Mainly because I am not sure a
+// simple way to make it impossible.
+func (cb *Catbox) connectToServers() {
+	now := time.Now()
+
+	if now.Sub(cb.LastConnectAttempt) < cb.Config.ConnectAttemptTime {
+		return
+	}
+
+	// Pick the server that has been waiting longest so we give each a chance
+	// rather than favouring those that appear earlier in the config.
+	var next *ServerDefinition
+	for _, linkInfo := range cb.Config.Servers {
+		// It does not make sense to try to connect to ourself. Even if we're in
+		// the config.
+		if linkInfo.Name == cb.Config.ServerName {
+			continue
+		}
+
+		if !cb.autoConnects(linkInfo) {
+			continue
+		}
+
+		if cb.isLinkedToServer(linkInfo.Name) {
+			continue
+		}
+
+		state := cb.linkState(linkInfo.Name)
+		if now.Before(state.NextAttempt) {
+			continue
+		}
+
+		if next == nil ||
+			state.NextAttempt.Before(cb.Links[next.Name].NextAttempt) ||
+			(state.NextAttempt.Equal(cb.Links[next.Name].NextAttempt) &&
+				linkInfo.Name < next.Name) {
+			next = linkInfo
+		}
+	}
+
+	if next == nil {
+		return
+	}
+
+	// We count the attempt as a failure until we link. See linkEstablished().
+	state := cb.linkState(next.Name)
+	state.Failures++
+	state.NextAttempt = now.Add(cb.connectInterval(next, state.Failures))
+	cb.LastConnectAttempt = now
+
+	cb.connectToServer(next)
+}
+
+// linkEstablished records that we linked to the server. We stop backing off.
+func (cb *Catbox) linkEstablished(name string) {
+	state, exists := cb.Links[name]
+	if !exists {
+		return
+	}
+	state.Failures = 0
+
+	// If it splits, try again after its usual interval.
+	if linkInfo, exists := cb.Config.Servers[name]; exists {
+		state.NextAttempt = time.Now().Add(cb.connectInterval(linkInfo, 0))
+	}
+}
+
+// autoconnStatus describes the autoconnect settings of each server we may
+// connect to. One line per server.
+func (cb *Catbox) autoconnStatus() []string {
+	var names []string
+	for name, linkInfo := range cb.Config.Servers {
+		if name == cb.Config.ServerName || linkInfo.Services {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		linkInfo := cb.Config.Servers[name]
+		state := cb.linkState(name)
+
+		autoConnect := "off"
+		if cb.autoConnects(linkInfo) {
+			autoConnect = "on"
+		}
+		if state.AutoConnect != nil {
+			autoConnect += " (set by operator)"
+		}
+
+		class := linkInfo.Class
+		if class == "" {
+			class = "default"
+		}
+
+		status := "not linked"
+		if cb.isLinkedToServer(name) {
+			status = "linked"
+		} else if state.Failures > 0 {
+			status = fmt.Sprintf("%d failed attempts", state.Failures)
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: autoconnect %s, class %s, %s",
+			name, autoConnect, class, status))
+	}
+	return lines
+}
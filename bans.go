@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Bans holds the bans we keep across restarts. Add other ban types here as we
+// support them.
+type Bans struct {
+	KLines []KLine
+
+	PropagatedBans []PropagatedBan
+}
+
+// PropagatedBan is a ban set network wide with BAN. Unlike a K-Line in ENCAP
+// KLINE, it says when it was set so servers agree on which version of it wins,
+// and it has a lifetime. We remember it until its lifetime ends even if it
+// expired or someone removed it. That way an older version reaching us does
+// not bring it back.
+//
+// We support only K-Lines (type K).
+type PropagatedBan struct {
+	Type     string
+	UserMask string
+	HostMask string
+
+	// Unix time it was set or last changed.
+	Created int64
+
+	// Seconds after Created it expires. 0 if it was removed.
+	Duration int64
+
+	// Seconds after Created we forget it.
+	Lifetime int64
+
+	// Who set it. * if we don't know.
+	Oper string
+
+	Reason string
+}
+
+func (b PropagatedBan) key() string {
+	return b.Type + " " + klineKey(b.UserMask, b.HostMask)
+}
+
+// active tells whether the ban is in effect.
+func (b PropagatedBan) active(now int64) bool {
+	return b.Duration > 0 && now < b.Created+b.Duration
+}
+
+// message is the BAN command for the ban.
+//
+// Parameters: <type> <user mask> <host mask> <creation TS> <duration>
+// <lifetime> <oper> <reason>
+func (b PropagatedBan) message(sourceID string) irc.Message {
+	return irc.Message{
+		Prefix:  sourceID,
+		Command: "BAN",
+		Params: []string{
+			b.Type,
+			b.UserMask,
+			b.HostMask,
+			strconv.FormatInt(b.Created, 10),
+			strconv.FormatInt(b.Duration, 10),
+			strconv.FormatInt(b.Lifetime, 10),
+			b.Oper,
+			b.Reason,
+		},
+	}
+}
+
+// applyPropagatedBan records the ban and adds or removes its K-Line. We ignore
+// it if we know a version of it at least as new, or if its lifetime ended. It
+// returns whether we took it.
+func (cb *Catbox) applyPropagatedBan(ban PropagatedBan, source string) bool {
+	now := time.Now().Unix()
+	if now >= ban.Created+ban.Lifetime {
+		return false
+	}
+
+	if existing, exists := cb.PropagatedBans[ban.key()]; exists &&
+		existing.Created >= ban.Created {
+		return false
+	}
+	cb.PropagatedBans[ban.key()] = &ban
+
+	if ban.Type != "K" {
+		cb.saveBans()
+		return true
+	}
+
+	if !ban.active(now) {
+		if cb.KLineIndex.has(ban.UserMask, ban.HostMask) {
+			cb.removeKLine(ban.UserMask, ban.HostMask, source)
+			return true
+		}
+		cb.saveBans()
+		return true
+	}
+
+	// It may replace one we have. e.g., if they changed its duration.
+	if cb.KLineIndex.remove(ban.UserMask, ban.HostMask) {
+		cb.KLines = removeKLineFrom(cb.KLines,
+			klineKey(ban.UserMask, ban.HostMask))
+	}
+
+	cb.addAndApplyKLine(KLine{
+		UserMask: ban.UserMask,
+		HostMask: ban.HostMask,
+		Reason:   ban.Reason,
+		Expires:  ban.Created + ban.Duration,
+	}, source, ban.Reason)
+	return true
+}
+
+// propagateBan sends the ban to servers other than except (which may be nil)
+// that have the BAN capab.
+//
+// If legacy is true, servers without the capab get it as a K-Line in KLINE or
+// UNKLINE. We do this for bans we set. We don't for bans we relay as we can't
+// be sure the other servers heard of them the same way.
+func (cb *Catbox) propagateBan(except *LocalServer, sourceID string,
+	ban PropagatedBan, legacy bool) {
+	now := time.Now().Unix()
+	for _, server := range cb.LocalServers {
+		if server == except {
+			continue
+		}
+
+		if server.Server.hasCapability("BAN") {
+			server.maybeQueueMessage(ban.message(sourceID))
+			continue
+		}
+
+		if !legacy || ban.Type != "K" {
+			continue
+		}
+
+		if ban.active(now) {
+			server.maybeQueueMessage(klineMessage(server, sourceID, "*",
+				strconv.FormatInt(ban.Created+ban.Duration-now, 10), ban.UserMask,
+				ban.HostMask, ban.Reason))
+			continue
+		}
+
+		server.maybeQueueMessage(unklineMessage(server, sourceID, "*",
+			ban.UserMask, ban.HostMask))
+	}
+}
+
+// expireBans removes K-Lines that expired and forgets propagated bans whose
+// lifetimes ended.
+func (cb *Catbox) expireBans() {
+	now := time.Now().Unix()
+	changed := false
+
+	var expired []KLine
+	for _, kline := range cb.KLines {
+		if kline.Expires != 0 && now >= kline.Expires {
+			expired = append(expired, kline)
+		}
+	}
+
+	for _, kline := range expired {
+		cb.KLineIndex.remove(kline.UserMask, kline.HostMask)
+		cb.KLines = removeKLineFrom(cb.KLines,
+			klineKey(kline.UserMask, kline.HostMask))
+		changed = true
+
+		cb.noticeOpers(fmt.Sprintf("Temporary K-Line for [%s@%s] expired",
+			kline.UserMask, kline.HostMask))
+		logEvent("kill", "Temporary K-Line for [%s@%s] expired", kline.UserMask,
+			kline.HostMask)
+	}
+
+	for key, ban := range cb.PropagatedBans {
+		if now < ban.Created+ban.Lifetime {
+			continue
+		}
+		delete(cb.PropagatedBans, key)
+		changed = true
+	}
+
+	if changed {
+		cb.saveBans()
+	}
+}
+
+// loadBans reads bans we saved. If there are none, we start with none.
+func loadBans(store Store, name string) (*Bans, error) {
+	bans := &Bans{}
+
+	if name == "" {
+		return bans, nil
+	}
+
+	if _, err := store.Load(name, bans); err != nil {
+		return nil, fmt.Errorf("unable to load bans: %s", err)
+	}
+
+	return bans, nil
+}
+
+// save saves the bans under the name.
+func (b *Bans) save(store Store, name string) error {
+	return store.Save(name, b)
+}
+
+// saveBans saves our bans if we have a file to save them to. Call it whenever
+// they change.
+func (cb *Catbox) saveBans() {
+	if cb.Config.BansFile == "" {
+		return
+	}
+
+	bans := &Bans{KLines: cb.KLines}
+	for _, ban := range cb.PropagatedBans {
+		bans.PropagatedBans = append(bans.PropagatedBans, *ban)
+	}
+	if err := bans.save(cb.Store, cb.Config.BansFile); err != nil {
+		coreLog.Errorf("Unable to save bans: %s", err)
+		cb.noticeLocalOpers(fmt.Sprintf("Unable to save bans: %s", err))
+	}
+}
+
+// kline K-Lines the mask network wide and cuts off matching users. If
+// minutes is above 0 the K-Line is temporary. We set it with BAN so it
+// expires everywhere. See PropagatedBan.
+//
+// sourceID is who to say set it (a UID or our SID), sourceName what to call
+// them in notices, and oper how to identify them in BANs.
+func (cb *Catbox) kline(sourceID, sourceName, oper string, minutes int64,
+	userMask, hostMask, reason string) {
+	if minutes > 0 {
+		ban := PropagatedBan{
+			Type:     "K",
+			UserMask: userMask,
+			HostMask: hostMask,
+			Created:  time.Now().Unix(),
+			Duration: minutes * 60,
+			Lifetime: minutes * 60,
+			Oper:     oper,
+			Reason:   reason,
+		}
+
+		// As below, propagate first in case the user K-Lines himself.
+		cb.propagateBan(nil, sourceID, ban, true)
+		cb.applyPropagatedBan(ban, sourceName)
+		return
+	}
+
+	kline := KLine{
+		UserMask: userMask,
+		HostMask: hostMask,
+		Reason:   reason,
+	}
+
+	// Propagate.
+	// Do this before applying K-Line locally for the hopefully rare scenario
+	// that the user K-Lines himself.
+	cb.propagateKLine(nil, sourceID, "*", "0", userMask, hostMask, reason)
+
+	cb.addAndApplyKLine(kline, sourceName, reason)
+}
+
+// unkline removes a K-Line network wide. The parameters are as for kline().
+func (cb *Catbox) unkline(sourceID, sourceName, oper, userMask,
+	hostMask string) {
+	// If it is a network wide ban, remove it with BAN. We keep the record until
+	// its lifetime ends so older versions don't bring it back.
+	ban, exists := cb.PropagatedBans[PropagatedBan{Type: "K",
+		UserMask: userMask, HostMask: hostMask}.key()]
+	if now := time.Now().Unix(); exists && ban.active(now) {
+		removal := *ban
+		// It must be newer than the ban for servers to take it.
+		removal.Created = now
+		if removal.Created <= ban.Created {
+			removal.Created = ban.Created + 1
+		}
+		removal.Duration = 0
+		removal.Lifetime = ban.Created + ban.Lifetime - removal.Created
+		if removal.Lifetime < 1 {
+			removal.Lifetime = 1
+		}
+		removal.Oper = oper
+
+		cb.applyPropagatedBan(removal, sourceName)
+		cb.propagateBan(nil, sourceID, removal, true)
+		return
+	}
+
+	cb.removeKLine(userMask, hostMask, sourceName)
+
+	// Propagate.
+	cb.propagateUnkline(nil, sourceID, "*", userMask, hostMask)
+}
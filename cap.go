@@ -0,0 +1,323 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Client capabilities (IRCv3 CAP) we support.
+//
+// account-notify - Tell the client when users it shares a channel with log in
+// to or out of an account.
+// batch - Group history we send the client in a BATCH.
+// chghost - Tell the client about host changes with CHGHOST rather than
+// emulating them with QUIT and JOIN.
+// draft/chathistory - The client asks for channel history with CHATHISTORY
+// rather than us playing it back when it joins.
+// invite-notify - Tell channel operators when someone invites a user to their
+// channel.
+// sasl - Authenticate with SASL before registering. We offer this only while
+// services supporting SASL are linked.
+// server-time - Tell the client when we saw messages from history. We play
+// back history when the client joins a channel only if it has this.
+// setname - The client hears SETNAME when users it shares a channel with
+// change their real name rather than us emulating it with QUIT and JOIN.
+// tls - The client may upgrade to TLS with STARTTLS. We offer this only if we
+// have a certificate.
+//
+// We offer batch, draft/chathistory, and server-time only if we keep channel
+// history.
+var supportedClientCaps = map[string]struct{}{
+	"account-notify":    {},
+	"batch":             {},
+	"chghost":           {},
+	"draft/chathistory": {},
+	"invite-notify":     {},
+	"sasl":              {},
+	"server-time":       {},
+	"setname":           {},
+	"tls":               {},
+}
+
+// capAvailable tells whether we offer the capability right now.
+func (cb *Catbox) capAvailable(name string) bool {
+	if _, exists := supportedClientCaps[name]; !exists {
+		return false
+	}
+	if name == "sasl" {
+		return cb.saslServer() != nil
+	}
+	if name == "tls" {
+		return cb.TLSConfig != nil
+	}
+	if name == "batch" || name == "draft/chathistory" || name == "server-time" {
+		return cb.Config.ChannelHistoryLength > 0
+	}
+	return true
+}
+
+// hasCap tells whether the client negotiated the capability.
+//
+// Clients which never negotiated CAP have none. Check capabilities through
+// this function (or the notify functions below) rather than in each command
+// handler so that we treat legacy clients consistently.
+func (c *LocalClient) hasCap(name string) bool {
+	_, exists := c.Caps[name]
+	return exists
+}
+
+// CAP negotiates client capabilities.
+//
+// We support the subcommands LS, LIST, REQ, and END. CAP may happen both
+// before and after registration. If a client starts negotiating before
+// registering, we hold its registration until it sends CAP END.
+func (c *LocalClient) capCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.messageFromServer("461", []string{"CAP", "Not enough parameters"})
+		return
+	}
+
+	// Only clients still registering are in LocalClients.
+	_, registering := c.Catbox.LocalClients[c.ID]
+
+	subCommand := strings.ToUpper(m.Params[0])
+
+	if subCommand == "LS" {
+		if registering {
+			c.CapNegotiating = true
+		}
+
+		var caps []string
+		for name := range supportedClientCaps {
+			if c.Catbox.capAvailable(name) {
+				caps = append(caps, name)
+			}
+		}
+		sort.Strings(caps)
+
+		c.capReply("LS", strings.Join(caps, " "))
+		return
+	}
+
+	if subCommand == "LIST" {
+		var caps []string
+		for name := range c.Caps {
+			caps = append(caps, name)
+		}
+		sort.Strings(caps)
+
+		c.capReply("LIST", strings.Join(caps, " "))
+		return
+	}
+
+	if subCommand == "REQ" {
+		if len(m.Params) < 2 {
+			// 461 ERR_NEEDMOREPARAMS
+			c.messageFromServer("461", []string{"CAP", "Not enough parameters"})
+			return
+		}
+
+		if registering {
+			c.CapNegotiating = true
+		}
+
+		// We must accept all of the requested changes or none of them.
+		requested := strings.Fields(m.Params[1])
+		for _, name := range requested {
+			if !c.Catbox.capAvailable(strings.TrimPrefix(name, "-")) {
+				c.capReply("NAK", m.Params[1])
+				return
+			}
+		}
+
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(c.Caps, name[1:])
+				continue
+			}
+			c.Caps[name] = struct{}{}
+		}
+
+		c.capReply("ACK", m.Params[1])
+		return
+	}
+
+	if subCommand == "END" {
+		if !registering || !c.CapNegotiating {
+			return
+		}
+
+		c.CapNegotiating = false
+
+		// They're done waiting for SASL.
+		c.abortSASL()
+
+		if len(c.PreRegDisplayNick) > 0 && len(c.PreRegUser) > 0 {
+			c.registerUser()
+		}
+		return
+	}
+
+	// 410 ERR_INVALIDCAPCMD
+	c.messageFromServer("410", []string{m.Params[0], "Invalid CAP command"})
+}
+
+// Send a CAP reply. CAP replies include the client's nick, or * if it does not
+// have one yet.
+func (c *LocalClient) capReply(subCommand, caps string) {
+	nick := "*"
+	if len(c.PreRegDisplayNick) > 0 {
+		nick = c.PreRegDisplayNick
+	}
+
+	c.maybeQueueMessage(irc.Message{
+		Prefix:  c.Catbox.Config.ServerName,
+		Command: "CAP",
+		Params:  []string{nick, subCommand, caps},
+	})
+}
+
+// notifyHostChange tells local users sharing a channel with the user that the
+// user's username and/or hostname changed. Update the user before calling
+// this. oldUhost is their nick!user@host prior to the change.
+//
+// Clients with the chghost capability get CHGHOST. We emulate the change for
+// legacy clients. See notifyUserChange().
+func (cb *Catbox) notifyHostChange(user *User, oldUhost string) {
+	cb.notifyUserChange(user, oldUhost, "chghost", irc.Message{
+		Prefix:  oldUhost,
+		Command: "CHGHOST",
+		Params:  []string{user.Username, user.DisplayHost},
+	}, "Changing host")
+}
+
+// notifyRealNameChange tells local users sharing a channel with the user that
+// the user's real name changed. Update the user before calling this.
+//
+// Clients with the setname capability get SETNAME. We emulate the change for
+// legacy clients. See notifyUserChange().
+func (cb *Catbox) notifyRealNameChange(user *User) {
+	cb.notifyUserChange(user, user.nickUhost(), "setname", irc.Message{
+		Prefix:  user.nickUhost(),
+		Command: "SETNAME",
+		Params:  []string{user.RealName},
+	}, "Changing real name")
+}
+
+// notifyUserChange tells local users sharing a channel with the user about a
+// change to the user. Clients with the capability get the message. For legacy
+// clients we emulate the change: the user appears to quit and then rejoin
+// each channel they share (with their ops if they have them).
+//
+// oldUhost is the user's nick!user@host prior to the change.
+func (cb *Catbox) notifyUserChange(user *User, oldUhost, capName string,
+	m irc.Message, quitMessage string) {
+	// The channels each local user shares with the user.
+	shared := make(map[*LocalUser][]*Channel)
+	for _, channel := range user.Channels {
+		for memberUID := range channel.Members {
+			member := cb.Users[memberUID]
+			if !member.isLocal() {
+				continue
+			}
+			shared[member.LocalUser] = append(shared[member.LocalUser], channel)
+		}
+	}
+
+	// They may not be in any channels. They should still hear about it.
+	if user.isLocal() {
+		if _, exists := shared[user.LocalUser]; !exists {
+			shared[user.LocalUser] = nil
+		}
+	}
+
+	for lu, channels := range shared {
+		if lu.hasCap(capName) {
+			lu.maybeQueueMessage(m)
+			continue
+		}
+
+		// We can't emulate the change to the user themselves.
+		if lu.User == user {
+			continue
+		}
+
+		lu.maybeQueueMessage(irc.Message{
+			Prefix:  oldUhost,
+			Command: "QUIT",
+			Params:  []string{quitMessage},
+		})
+
+		for _, channel := range channels {
+			lu.maybeQueueMessage(irc.Message{
+				Prefix:  user.nickUhost(),
+				Command: "JOIN",
+				Params:  []string{channel.Name},
+			})
+
+			if channel.userHasOps(user) {
+				lu.maybeQueueMessage(irc.Message{
+					Prefix:  cb.Config.ServerName,
+					Command: "MODE",
+					Params:  []string{channel.Name, "+o", user.DisplayNick},
+				})
+			}
+		}
+	}
+}
+
+// notifyInvite tells local channel operators with the invite-notify capability
+// that a user was invited to their channel. Legacy clients hear nothing.
+//
+// We don't tell the inviter or invitee. They hear about it already.
+func (cb *Catbox) notifyInvite(channel *Channel, inviter, invitee *User) {
+	for memberUID := range channel.Members {
+		member := cb.Users[memberUID]
+		if !member.isLocal() || member == inviter || member == invitee {
+			continue
+		}
+
+		if !channel.userHasOps(member) || !member.LocalUser.hasCap("invite-notify") {
+			continue
+		}
+
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  inviter.nickUhost(),
+			Command: "INVITE",
+			Params:  []string{invitee.DisplayNick, channel.Name},
+		})
+	}
+}
+
+// notifyAccountChange tells local users with the account-notify capability
+// who share a channel with the user that the user logged in to or out of an
+// account. Update the user before calling this. Legacy clients hear nothing.
+func (cb *Catbox) notifyAccountChange(user *User) {
+	account := user.Account
+	if account == "" {
+		account = "*"
+	}
+
+	informed := map[*LocalUser]struct{}{}
+	for _, channel := range user.Channels {
+		for memberUID := range channel.Members {
+			member := cb.Users[memberUID]
+			if !member.isLocal() || !member.LocalUser.hasCap("account-notify") {
+				continue
+			}
+			if _, exists := informed[member.LocalUser]; exists {
+				continue
+			}
+			informed[member.LocalUser] = struct{}{}
+
+			member.LocalUser.maybeQueueMessage(irc.Message{
+				Prefix:  user.nickUhost(),
+				Command: "ACCOUNT",
+				Params:  []string{account},
+			})
+		}
+	}
+}
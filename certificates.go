@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// certificateFiles lists the certificate and key files in our config.
+func (cb *Catbox) certificateFiles() []string {
+	var files []string
+	if cb.Config.CertificateFile != "" && cb.Config.KeyFile != "" {
+		files = append(files, cb.Config.CertificateFile, cb.Config.KeyFile)
+	}
+	for _, cc := range cb.Config.CertificateConfigs {
+		files = append(files, cc.CertificateFile, cc.KeyFile)
+	}
+	return files
+}
+
+// certificateModTimes finds when each file was last modified. If we can't tell
+// for a file, it has the zero time.
+func certificateModTimes(files []string) map[string]time.Time {
+	modTimes := map[string]time.Time{}
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			modTimes[file] = time.Time{}
+			continue
+		}
+		modTimes[file] = fi.ModTime()
+	}
+	return modTimes
+}
+
+// checkCertificates reloads our certificates if their files changed since we
+// loaded them. This way renewing a certificate (e.g., with an ACME client such
+// as certbot) takes effect without a rehash or restart. Clients already
+// connected keep their connections.
+func (cb *Catbox) checkCertificates() {
+	if cb.Config.CertificateCheckTime <= 0 || cb.TLSConfig == nil {
+		return
+	}
+
+	if time.Since(cb.LastCertificateCheck) < cb.Config.CertificateCheckTime {
+		return
+	}
+	cb.LastCertificateCheck = time.Now()
+
+	changed := false
+	for file, modTime := range certificateModTimes(cb.certificateFiles()) {
+		if loaded, exists := cb.CertificateModTimes[file]; !exists ||
+			!loaded.Equal(modTime) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+
+	// A renewal may be part way through writing the files, so if loading fails
+	// we try again next time. We tell operators only once about each problem.
+	if err := cb.loadCertificate(); err != nil {
+		coreLog.Errorf("Unable to reload certificates: %s", err)
+		if err.Error() != cb.LastCertificateError {
+			cb.LastCertificateError = err.Error()
+			cb.noticeLocalOpers(fmt.Sprintf("Unable to reload certificates: %s",
+				err))
+		}
+		return
+	}
+
+	cb.LastCertificateError = ""
+	cb.noticeLocalOpers("Reloaded certificates as their files changed")
+}
@@ -1,6 +1,13 @@
 package main
 
-import "github.com/horgh/irc"
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
 
 // Channel holds everything to do with a channel.
 type Channel struct {
@@ -26,9 +33,90 @@ type Channel struct {
 	// Modes set on the channel.
 	Modes map[byte]struct{}
 
+	// Channel key (+k). If set, users must give it to join. Blank if not set.
+	Key string
+
+	// Member limit (+l). If set, local users may not join once the channel has
+	// this many members. 0 if not set.
+	Limit int
+
+	// Join throttle (+j). If set, at most JoinThrottleCount users may join
+	// within JoinThrottleTime seconds. 0 if not set.
+	JoinThrottleCount int
+	JoinThrottleTime  int
+
+	// When users recently joined. We use this to enforce the join throttle. We
+	// only track joins while the channel is +j.
+	RecentJoins []time.Time
+
+	// Forward channel (+f). If set, local users the join throttle refuses join
+	// this channel instead. Blank if not set.
+	Forward string
+
+	// Lists of masks set on the channel. Mode character (e.g., b for bans, e for
+	// ban exceptions) to the masks in that list.
+	Lists map[byte][]ChannelMask
+
 	// Channel TS. Changes on channel creation (or if another server tells us
 	// a different TS).
 	TS int64
+
+	// Users invited to the channel. An invite lets them join despite +i. We
+	// forget it once they join.
+	Invites map[TS6UID]ChannelInvite
+
+	// Moderation actions taken in the channel, oldest first. e.g., mode and
+	// topic changes. We keep at most maxModLogEntries.
+	ModLog []ModLogEntry
+}
+
+// ChannelInvite records an invite to a channel.
+type ChannelInvite struct {
+	// Who invited them. nick!user@host
+	Inviter string
+
+	// When.
+	TS int64
+}
+
+// ModLogEntry records a moderation action in a channel.
+type ModLogEntry struct {
+	// When it happened.
+	TS int64
+
+	// Who did it. nick!user@host or a server name.
+	Source string
+
+	// What they did. e.g., MODE +b *!*@example.com
+	Action string
+}
+
+// The most entries we keep in a channel's moderation log.
+const maxModLogEntries = 100
+
+// ChannelMask is an entry in one of a channel's lists. e.g., a ban.
+type ChannelMask struct {
+	// The mask in nick!user@host form.
+	Mask string
+
+	// Who set it. nick!user@host or a server name.
+	SetBy string
+
+	// When it was set.
+	SetTS int64
+}
+
+// NewChannel creates a Channel with no members.
+func NewChannel(name string, ts int64) *Channel {
+	return &Channel{
+		Name:    name,
+		Members: make(map[TS6UID]struct{}),
+		Ops:     make(map[TS6UID]*User),
+		Modes:   make(map[byte]struct{}),
+		Lists:   make(map[byte][]ChannelMask),
+		Invites: make(map[TS6UID]ChannelInvite),
+		TS:      ts,
+	}
 }
 
 // Check if a user has operator status in the channel.
@@ -90,6 +178,62 @@ func (c *Channel) clearModes(cb *Catbox) {
 		})
 	}
 
+	// Clear the key.
+
+	if c.Key != "" {
+		msgs = append(msgs, irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "MODE",
+			Params:  []string{c.Name, "-k", c.Key},
+		})
+		c.Key = ""
+	}
+
+	// Clear the limit.
+
+	if c.Limit > 0 {
+		msgs = append(msgs, irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "MODE",
+			Params:  []string{c.Name, "-l"},
+		})
+		c.Limit = 0
+	}
+
+	// Clear the forward channel.
+
+	if c.Forward != "" {
+		msgs = append(msgs, irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "MODE",
+			Params:  []string{c.Name, "-f"},
+		})
+		c.Forward = ""
+	}
+
+	// Clear the join throttle.
+
+	if c.JoinThrottleCount > 0 {
+		msgs = append(msgs, irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "MODE",
+			Params:  []string{c.Name, "-j"},
+		})
+		c.setJoinThrottle(0, 0)
+	}
+
+	// Clear lists such as bans.
+
+	for mode, entries := range c.Lists {
+		var masks []string
+		for _, entry := range entries {
+			masks = append(masks, entry.Mask)
+		}
+		delete(c.Lists, mode)
+		msgs = append(msgs, c.makeModeMessages(cb.Config.ServerName, '-', mode,
+			masks)...)
+	}
+
 	// Clear ops.
 
 	var ops []string
@@ -136,3 +280,296 @@ func (c *Channel) clearModes(cb *Catbox) {
 		cb.messageLocalUsersOnChannel(c, msg)
 	}
 }
+
+// isChannelListMode tells whether the channel mode is a list of masks.
+//
+// b - Bans
+// e - Ban exceptions
+// I - Invite exceptions
+// q - Quiets
+func isChannelListMode(mode byte) bool {
+	return mode == 'b' || mode == 'e' || mode == 'I' || mode == 'q'
+}
+
+// isChannelSimpleMode tells whether the channel mode is one that is only set or
+// unset. That is, it has no parameter.
+//
+// c - No colors or formatting
+// C - No CTCPs (other than ACTION)
+// i - Invite only
+// n - No external messages
+// N - No nick changes, except by channel operators
+// s - Secret
+// t - Only channel operators may change the topic
+func isChannelSimpleMode(mode byte) bool {
+	return mode == 'c' || mode == 'C' || mode == 'i' || mode == 'n' ||
+		mode == 'N' || mode == 's' || mode == 't'
+}
+
+// Count the entries in all of the channel's lists.
+func (c *Channel) listEntries() int {
+	count := 0
+	for _, entries := range c.Lists {
+		count += len(entries)
+	}
+	return count
+}
+
+// isLocal decides whether the channel is a local (&) channel. Local channels
+// exist only on this server.
+func (c *Channel) isLocal() bool {
+	return isLocalChannel(c.Name)
+}
+
+// Build the channel's modes as a mode string. e.g., +ns
+//
+// This includes modes with parameters (e.g., +k), but not their parameters.
+// See modeParams() for those.
+func (c *Channel) modesString() string {
+	var modes []string
+	for m := range c.Modes {
+		modes = append(modes, string(m))
+	}
+	sort.Strings(modes)
+
+	s := "+" + strings.Join(modes, "")
+	if c.Forward != "" {
+		s += "f"
+	}
+	if c.JoinThrottleCount > 0 {
+		s += "j"
+	}
+	if c.Key != "" {
+		s += "k"
+	}
+	if c.Limit > 0 {
+		s += "l"
+	}
+	return s
+}
+
+// Build the parameters for the modes in modesString(). e.g., the key.
+func (c *Channel) modeParams() []string {
+	var params []string
+	if c.Forward != "" {
+		params = append(params, c.Forward)
+	}
+	if c.JoinThrottleCount > 0 {
+		params = append(params, formatJoinThrottle(c.JoinThrottleCount,
+			c.JoinThrottleTime))
+	}
+	if c.Key != "" {
+		params = append(params, c.Key)
+	}
+	if c.Limit > 0 {
+		params = append(params, strconv.Itoa(c.Limit))
+	}
+	return params
+}
+
+// setJoinThrottle sets or (with a count of 0) unsets the join throttle (+j).
+//
+// We forget the joins we saw under the old setting.
+func (c *Channel) setJoinThrottle(count, seconds int) {
+	c.JoinThrottleCount = count
+	c.JoinThrottleTime = seconds
+	c.RecentJoins = nil
+}
+
+// expireJoins forgets joins that are outside the join throttle's window.
+func (c *Channel) expireJoins(now time.Time) {
+	window := time.Duration(c.JoinThrottleTime) * time.Second
+
+	i := 0
+	for i < len(c.RecentJoins) && now.Sub(c.RecentJoins[i]) >= window {
+		i++
+	}
+	c.RecentJoins = c.RecentJoins[i:]
+}
+
+// joinThrottled tells whether the channel's join throttle (+j) currently
+// refuses joins. It does once the channel has had as many joins within the
+// window as the throttle permits, and stays that way until enough of them fall
+// out of the window.
+func (c *Channel) joinThrottled(now time.Time) bool {
+	if c.JoinThrottleCount == 0 {
+		return false
+	}
+
+	c.expireJoins(now)
+	return len(c.RecentJoins) >= c.JoinThrottleCount
+}
+
+// joinForward tells where to send local users joining the channel instead. This
+// is the forward channel (+f) while the join throttle (+j) refuses joins.
+// Blank if we don't forward.
+//
+// We only forward to a channel that exists, so users don't end up creating
+// it. We don't forward to a channel that is itself refusing joins this way so
+// that forwards can't loop.
+func (cb *Catbox) joinForward(c *Channel) string {
+	if c.Forward == "" || !c.joinThrottled(time.Now()) {
+		return ""
+	}
+
+	forward, exists := cb.Channels[c.Forward]
+	if !exists || forward.joinThrottled(time.Now()) {
+		return ""
+	}
+	if _, reserved := cb.reservation(forward.Name); reserved {
+		return ""
+	}
+	return forward.Name
+}
+
+// recordJoin remembers that a user joined the channel. We do this for joins
+// from local and remote users so that the throttle applies to the channel as a
+// whole.
+func (c *Channel) recordJoin(now time.Time) {
+	if c.JoinThrottleCount == 0 {
+		return
+	}
+
+	c.expireJoins(now)
+	c.RecentJoins = append(c.RecentJoins, now)
+
+	// Joins from other servers may take us past the count. We only need to
+	// remember enough to tell we're throttled.
+	if len(c.RecentJoins) > c.JoinThrottleCount {
+		c.RecentJoins = c.RecentJoins[len(c.RecentJoins)-c.JoinThrottleCount:]
+	}
+}
+
+// Add a mask to one of the channel's lists.
+//
+// Returns false if the mask is already present.
+func (c *Channel) addMask(mode byte, mask, setBy string, setTS int64) bool {
+	if c.hasMask(mode, mask) {
+		return false
+	}
+
+	c.Lists[mode] = append(c.Lists[mode], ChannelMask{
+		Mask:  mask,
+		SetBy: setBy,
+		SetTS: setTS,
+	})
+	return true
+}
+
+// Remove a mask from one of the channel's lists.
+//
+// Returns false if the mask is not present.
+func (c *Channel) removeMask(mode byte, mask string) bool {
+	for i, entry := range c.Lists[mode] {
+		if !strings.EqualFold(entry.Mask, mask) {
+			continue
+		}
+
+		c.Lists[mode] = append(c.Lists[mode][:i], c.Lists[mode][i+1:]...)
+		if len(c.Lists[mode]) == 0 {
+			delete(c.Lists, mode)
+		}
+		return true
+	}
+	return false
+}
+
+// Check if the mask is in one of the channel's lists.
+func (c *Channel) hasMask(mode byte, mask string) bool {
+	for _, entry := range c.Lists[mode] {
+		if strings.EqualFold(entry.Mask, mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the user matches any mask in one of the channel's lists.
+func (c *Channel) userMatchesList(mode byte, u *User) bool {
+	for _, entry := range c.Lists[mode] {
+		if u.matchesChannelMask(entry.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the user is banned from the channel. They are if they match a ban
+// (+b) and no ban exception (+e).
+func (c *Channel) userIsBanned(u *User) bool {
+	if !c.userMatchesList('b', u) {
+		return false
+	}
+	return !c.userMatchesList('e', u)
+}
+
+// Check if the user is quieted in the channel. They are if they match a quiet
+// (+q) and no ban exception (+e). Like charybdis, ban exceptions apply to
+// quiets too.
+func (c *Channel) userIsQuieted(u *User) bool {
+	if !c.userMatchesList('q', u) {
+		return false
+	}
+	return !c.userMatchesList('e', u)
+}
+
+// Check whether the user may send messages to the channel based on its
+// membership. If the channel is +n (no external messages), only members may.
+func (c *Channel) canReceiveFrom(u *User) bool {
+	if _, noExternal := c.Modes['n']; !noExternal {
+		return true
+	}
+	return u.onChannel(c)
+}
+
+// Record that a user was invited to the channel.
+func (c *Channel) addInvite(invitee, inviter *User) {
+	c.Invites[invitee.UID] = ChannelInvite{
+		Inviter: inviter.nickUhost(),
+		TS:      time.Now().Unix(),
+	}
+}
+
+// Record a moderation action in the channel's log. If the log is full we drop
+// the oldest entry.
+func (c *Channel) logModeration(source, action string) {
+	c.ModLog = append(c.ModLog, ModLogEntry{
+		TS:     time.Now().Unix(),
+		Source: source,
+		Action: action,
+	})
+
+	if len(c.ModLog) > maxModLogEntries {
+		c.ModLog = c.ModLog[len(c.ModLog)-maxModLogEntries:]
+	}
+}
+
+// Build MODE messages to tell local users about mode changes that are all the
+// same mode and action. e.g., +bbb. We split them so no message has more than
+// ChanModesPerCommand modes.
+func (c *Channel) makeModeMessages(prefix string, action, mode byte,
+	params []string) []irc.Message {
+	var msgs []irc.Message
+
+	for len(params) > 0 {
+		count := len(params)
+		if count > ChanModesPerCommand {
+			count = ChanModesPerCommand
+		}
+
+		modeStr := string(action) + strings.Repeat(string(mode), count)
+
+		msgParams := []string{c.Name, modeStr}
+		msgParams = append(msgParams, params[:count]...)
+
+		msgs = append(msgs, irc.Message{
+			Prefix:  prefix,
+			Command: "MODE",
+			Params:  msgParams,
+		})
+
+		params = params[count:]
+	}
+
+	return msgs
+}
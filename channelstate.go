@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SavedChannel is the state of a channel we keep across restarts.
+//
+// A channel exists only while it has members, so we can't recreate channels
+// at startup. Instead, when someone creates a channel we have saved state for,
+// we give it back its TS, topic, and modes.
+type SavedChannel struct {
+	// Canonicalized name.
+	Name string
+
+	TS int64
+
+	Topic       string
+	TopicSetter string
+	TopicTS     int64
+
+	// Modes without parameters. e.g., nst
+	Modes string
+
+	Key               string
+	Limit             int
+	JoinThrottleCount int
+	JoinThrottleTime  int
+	Forward           string
+
+	// Mode character (e.g., b) to the masks in that list.
+	Lists map[string][]ChannelMask
+
+	// Unix time we last saw the channel exist.
+	Seen int64
+}
+
+// How often we save channels. We also save them at shutdown.
+const channelsSaveTime = 5 * time.Minute
+
+// How long we keep state for a channel after it stops existing.
+const savedChannelTime = 7 * 24 * time.Hour
+
+// loadSavedChannels reads the channels we saved. The map is canonical channel
+// name to its state. If there are none, we start with none.
+func loadSavedChannels(store Store, name string) (map[string]*SavedChannel,
+	error) {
+	channels := map[string]*SavedChannel{}
+
+	if name == "" {
+		return channels, nil
+	}
+
+	if _, err := store.Load(name, &channels); err != nil {
+		return nil, fmt.Errorf("unable to load channels: %s", err)
+	}
+
+	return channels, nil
+}
+
+// newSavedChannel records the channel's state.
+func newSavedChannel(c *Channel, now time.Time) *SavedChannel {
+	var modes []string
+	for m := range c.Modes {
+		modes = append(modes, string(m))
+	}
+	sort.Strings(modes)
+
+	lists := map[string][]ChannelMask{}
+	for m, entries := range c.Lists {
+		if len(entries) > 0 {
+			lists[string(m)] = entries
+		}
+	}
+
+	return &SavedChannel{
+		Name:              c.Name,
+		TS:                c.TS,
+		Topic:             c.Topic,
+		TopicSetter:       c.TopicSetter,
+		TopicTS:           c.TopicTS,
+		Modes:             strings.Join(modes, ""),
+		Key:               c.Key,
+		Limit:             c.Limit,
+		JoinThrottleCount: c.JoinThrottleCount,
+		JoinThrottleTime:  c.JoinThrottleTime,
+		Forward:           c.Forward,
+		Lists:             lists,
+		Seen:              now.Unix(),
+	}
+}
+
+// restore gives the channel the saved state. This replaces its TS and modes.
+func (s *SavedChannel) restore(c *Channel) {
+	c.TS = s.TS
+
+	c.Topic = s.Topic
+	c.TopicSetter = s.TopicSetter
+	c.TopicTS = s.TopicTS
+
+	c.Modes = make(map[byte]struct{})
+	for i := 0; i < len(s.Modes); i++ {
+		c.Modes[s.Modes[i]] = struct{}{}
+	}
+
+	c.Key = s.Key
+	c.Limit = s.Limit
+	c.setJoinThrottle(s.JoinThrottleCount, s.JoinThrottleTime)
+	c.Forward = s.Forward
+
+	c.Lists = make(map[byte][]ChannelMask)
+	for m, entries := range s.Lists {
+		if len(m) == 1 {
+			c.Lists[m[0]] = entries
+		}
+	}
+}
+
+// restoreSavedChannel gives a channel we're creating the state we saved for
+// it, if any. It tells whether there was any. Call it before anyone hears
+// about the channel.
+//
+// We keep the saved state until the channel exists. Whoever makes it may not
+// be able to join it. Once it exists, it's like any other channel. If it
+// empties, it's gone.
+func (cb *Catbox) restoreSavedChannel(channel *Channel) bool {
+	saved, exists := cb.SavedChannels[channel.Name]
+	if !exists {
+		return false
+	}
+
+	saved.restore(channel)
+	return true
+}
+
+// updateSavedChannels saves channels periodically.
+func (cb *Catbox) updateSavedChannels() {
+	if time.Since(cb.LastChannelsSave) >= channelsSaveTime {
+		cb.saveChannels()
+	}
+}
+
+// saveChannels saves the state of the channels that exist, along with state
+// we loaded that we haven't restored yet, if we have a file to save it to.
+func (cb *Catbox) saveChannels() {
+	now := time.Now()
+	cb.LastChannelsSave = now
+
+	if cb.Config.ChannelsFile == "" {
+		return
+	}
+
+	channels := map[string]*SavedChannel{}
+	for name, saved := range cb.SavedChannels {
+		if now.Sub(time.Unix(saved.Seen, 0)) > savedChannelTime {
+			delete(cb.SavedChannels, name)
+			continue
+		}
+		channels[name] = saved
+	}
+	for name, channel := range cb.Channels {
+		channels[name] = newSavedChannel(channel, now)
+	}
+
+	if err := cb.Store.Save(cb.Config.ChannelsFile, channels); err != nil {
+		coreLog.Errorf("Unable to save channels: %s", err)
+	}
+}
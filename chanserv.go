@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// ChanServ is our built in channel registration service. Like NickServ it is
+// for networks without services. We run it if there is a chanserv-file.
+//
+// Users logged in to an account (with NickServ or services) register channels
+// they have ops in. The founder's account and the accounts on the channel's op
+// list get ops when they join. We remember the channel's topic and set it again
+// when the channel is created.
+//
+// Each server keeps its own registrations and looks after only its own users.
+
+const chanServNick = "ChanServ"
+
+// ChannelRegistration is a channel registered with ChanServ.
+type ChannelRegistration struct {
+	Name string
+
+	// Account of the founder.
+	Founder string
+
+	// Accounts to give ops to on join (besides the founder).
+	Ops []string
+
+	Topic       string
+	TopicSetter string
+	TopicTS     int64
+
+	// The channel's moderation log. We keep it so it survives the channel
+	// emptying and restarts.
+	ModLog []ModLogEntry
+
+	// Unix time.
+	Registered int64
+}
+
+// hasAccess tells whether the account gets ops in the channel.
+func (r *ChannelRegistration) hasAccess(account string) bool {
+	if account == "" {
+		return false
+	}
+	if strings.EqualFold(r.Founder, account) {
+		return true
+	}
+	for _, op := range r.Ops {
+		if strings.EqualFold(op, account) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadChannelRegistrations reads the registrations we saved. The map is
+// canonical channel name to registration. If there are none, we start with
+// none.
+func loadChannelRegistrations(store Store,
+	name string) (map[string]*ChannelRegistration, error) {
+	registrations := map[string]*ChannelRegistration{}
+
+	if name == "" {
+		return registrations, nil
+	}
+
+	if _, err := store.Load(name, &registrations); err != nil {
+		return nil, fmt.Errorf("unable to load chanserv registrations: %s", err)
+	}
+
+	return registrations, nil
+}
+
+// saveChannelRegistrations saves the registrations. Call it whenever they
+// change.
+func (cb *Catbox) saveChannelRegistrations() {
+	if err := cb.Store.Save(cb.Config.ChanServFile,
+		cb.ChannelRegistrations); err != nil {
+		coreLog.Errorf("Unable to save chanserv registrations: %s", err)
+		cb.noticeLocalOpers(fmt.Sprintf("Unable to save chanserv registrations: %s",
+			err))
+	}
+}
+
+// isChanServ tells whether the nick is ChanServ's while we run it.
+func (cb *Catbox) isChanServ(nick string) bool {
+	return cb.Config.ChanServFile != "" &&
+		canonicalizeNick(nick) == canonicalizeNick(chanServNick)
+}
+
+// chanServNotice sends the user a notice from ChanServ.
+func (u *LocalUser) chanServNotice(s string) {
+	u.maybeQueueMessage(irc.Message{
+		Prefix: fmt.Sprintf("%s!%s@%s", chanServNick, chanServNick,
+			u.Catbox.Config.ServerName),
+		Command: "NOTICE",
+		Params:  []string{u.User.DisplayNick, s},
+	})
+}
+
+// chanServCommand handles a ChanServ command. Users send these with CS or by
+// messaging ChanServ.
+//
+// Parameters: <REGISTER|DROP|OP|HELP> <channel> [parameters]
+func (u *LocalUser) chanServCommand(params []string) {
+	if u.Catbox.Config.ChanServFile == "" {
+		// 421 ERR_UNKNOWNCOMMAND
+		u.messageFromServer("421", []string{"CS", "Unknown command"})
+		return
+	}
+
+	if len(params) == 0 {
+		u.chanServNotice("Commands: REGISTER <channel>, DROP <channel>, OP <channel> <ADD|DEL|LIST> [account]")
+		return
+	}
+
+	subCommand := strings.ToUpper(params[0])
+	params = params[1:]
+
+	if subCommand == "REGISTER" {
+		u.chanServRegister(params)
+		return
+	}
+
+	if subCommand == "DROP" {
+		u.chanServDrop(params)
+		return
+	}
+
+	if subCommand == "OP" {
+		u.chanServOp(params)
+		return
+	}
+
+	u.chanServNotice("Commands: REGISTER <channel>, DROP <channel>, OP <channel> <ADD|DEL|LIST> [account]")
+}
+
+func (u *LocalUser) chanServRegister(params []string) {
+	if len(params) != 1 {
+		u.chanServNotice("Syntax: REGISTER <channel>")
+		return
+	}
+
+	if u.User.Account == "" {
+		u.chanServNotice("You must be logged in to an account to register a channel.")
+		return
+	}
+
+	channelName := canonicalizeChannel(params[0])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists || !u.User.onChannel(channel) {
+		u.chanServNotice(fmt.Sprintf("You're not on %s.", params[0]))
+		return
+	}
+
+	if !channel.userHasOps(u.User) {
+		u.chanServNotice(fmt.Sprintf("You need ops in %s to register it.",
+			channel.Name))
+		return
+	}
+
+	if _, exists := u.Catbox.ChannelRegistrations[channelName]; exists {
+		u.chanServNotice(fmt.Sprintf("%s is already registered.", channel.Name))
+		return
+	}
+
+	u.Catbox.ChannelRegistrations[channelName] = &ChannelRegistration{
+		Name:        channel.Name,
+		Founder:     u.User.Account,
+		Topic:       channel.Topic,
+		TopicSetter: channel.TopicSetter,
+		TopicTS:     channel.TopicTS,
+		ModLog:      append([]ModLogEntry(nil), channel.ModLog...),
+		Registered:  time.Now().Unix(),
+	}
+	u.Catbox.saveChannelRegistrations()
+
+	u.chanServNotice(fmt.Sprintf("%s is now registered to %s.", channel.Name,
+		u.User.Account))
+}
+
+func (u *LocalUser) chanServDrop(params []string) {
+	if len(params) != 1 {
+		u.chanServNotice("Syntax: DROP <channel>")
+		return
+	}
+
+	reg, ok := u.chanServFounderRegistration(params[0])
+	if !ok {
+		return
+	}
+
+	delete(u.Catbox.ChannelRegistrations, canonicalizeChannel(reg.Name))
+	u.Catbox.saveChannelRegistrations()
+
+	u.chanServNotice(fmt.Sprintf("%s is no longer registered.", reg.Name))
+}
+
+func (u *LocalUser) chanServOp(params []string) {
+	if len(params) < 2 {
+		u.chanServNotice("Syntax: OP <channel> <ADD|DEL|LIST> [account]")
+		return
+	}
+
+	action := strings.ToUpper(params[1])
+
+	if action == "LIST" {
+		reg, exists := u.Catbox.ChannelRegistrations[canonicalizeChannel(params[0])]
+		if !exists {
+			u.chanServNotice(fmt.Sprintf("%s is not registered.", params[0]))
+			return
+		}
+		if !reg.hasAccess(u.User.Account) && !u.User.isOperator() {
+			u.chanServNotice("Permission denied.")
+			return
+		}
+		u.chanServNotice(fmt.Sprintf("%s founder: %s", reg.Name, reg.Founder))
+		for _, op := range reg.Ops {
+			u.chanServNotice(fmt.Sprintf("%s op: %s", reg.Name, op))
+		}
+		u.chanServNotice(fmt.Sprintf("End of %s op list.", reg.Name))
+		return
+	}
+
+	if (action != "ADD" && action != "DEL") || len(params) != 3 {
+		u.chanServNotice("Syntax: OP <channel> <ADD|DEL|LIST> [account]")
+		return
+	}
+
+	reg, ok := u.chanServFounderRegistration(params[0])
+	if !ok {
+		return
+	}
+	account := params[2]
+
+	if action == "ADD" {
+		if reg.hasAccess(account) {
+			u.chanServNotice(fmt.Sprintf("%s already has ops in %s.", account,
+				reg.Name))
+			return
+		}
+		reg.Ops = append(reg.Ops, account)
+		u.Catbox.saveChannelRegistrations()
+		u.chanServNotice(fmt.Sprintf("Added %s to the %s op list.", account,
+			reg.Name))
+		return
+	}
+
+	for i, op := range reg.Ops {
+		if strings.EqualFold(op, account) {
+			reg.Ops = append(reg.Ops[:i], reg.Ops[i+1:]...)
+			u.Catbox.saveChannelRegistrations()
+			u.chanServNotice(fmt.Sprintf("Removed %s from the %s op list.", account,
+				reg.Name))
+			return
+		}
+	}
+	u.chanServNotice(fmt.Sprintf("%s is not on the %s op list.", account,
+		reg.Name))
+}
+
+// chanServFounderRegistration finds the channel's registration if the user is
+// its founder. If not, we tell them why.
+func (u *LocalUser) chanServFounderRegistration(channelName string) (
+	*ChannelRegistration, bool) {
+	reg, exists := u.Catbox.ChannelRegistrations[canonicalizeChannel(channelName)]
+	if !exists {
+		u.chanServNotice(fmt.Sprintf("%s is not registered.", channelName))
+		return nil, false
+	}
+
+	if u.User.Account == "" || !strings.EqualFold(reg.Founder, u.User.Account) {
+		u.chanServNotice(fmt.Sprintf("You're not the founder of %s.", reg.Name))
+		return nil, false
+	}
+
+	return reg, true
+}
+
+// chanServRestoreChannel sets the topic and moderation log we remember for a
+// channel we're creating. Call it before anyone hears about the channel.
+func (cb *Catbox) chanServRestoreChannel(channel *Channel) {
+	if cb.Config.ChanServFile == "" {
+		return
+	}
+
+	reg, exists := cb.ChannelRegistrations[canonicalizeChannel(channel.Name)]
+	if !exists {
+		return
+	}
+
+	if len(reg.ModLog) > 0 {
+		channel.ModLog = append([]ModLogEntry(nil), reg.ModLog...)
+	}
+
+	if reg.Topic == "" {
+		return
+	}
+
+	channel.Topic = reg.Topic
+	channel.TopicSetter = reg.TopicSetter
+	channel.TopicTS = reg.TopicTS
+}
+
+// logModeration records a moderation action in the channel's log. If the
+// channel is registered we save the log with the registration.
+func (cb *Catbox) logModeration(channel *Channel, source, action string) {
+	channel.logModeration(source, action)
+
+	if cb.Config.ChanServFile == "" {
+		return
+	}
+
+	reg, exists := cb.ChannelRegistrations[canonicalizeChannel(channel.Name)]
+	if !exists {
+		return
+	}
+
+	reg.ModLog = append([]ModLogEntry(nil), channel.ModLog...)
+	cb.saveChannelRegistrations()
+}
+
+// chanServTopicChanged remembers the channel's new topic if it is registered.
+// Call it whenever a channel's topic changes.
+func (cb *Catbox) chanServTopicChanged(channel *Channel) {
+	if cb.Config.ChanServFile == "" {
+		return
+	}
+
+	reg, exists := cb.ChannelRegistrations[canonicalizeChannel(channel.Name)]
+	if !exists || reg.Topic == channel.Topic {
+		return
+	}
+
+	reg.Topic = channel.Topic
+	reg.TopicSetter = channel.TopicSetter
+	reg.TopicTS = channel.TopicTS
+	cb.saveChannelRegistrations()
+}
+
+// chanServJoined gives the local user ops if they joined a registered channel
+// and their account has access.
+func (cb *Catbox) chanServJoined(u *LocalUser, channel *Channel) {
+	if cb.Config.ChanServFile == "" || channel.userHasOps(u.User) {
+		return
+	}
+
+	reg, exists := cb.ChannelRegistrations[canonicalizeChannel(channel.Name)]
+	if !exists || !reg.hasAccess(u.User.Account) {
+		return
+	}
+
+	channel.grantOps(u.User)
+
+	// Tell local users in the channel.
+	for memberUID := range channel.Members {
+		member := cb.Users[memberUID]
+
+		if !member.isLocal() {
+			continue
+		}
+
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix: fmt.Sprintf("%s!%s@%s", chanServNick, chanServNick,
+				cb.Config.ServerName),
+			Command: "MODE",
+			Params:  []string{channel.Name, "+o", u.User.DisplayNick},
+		})
+	}
+
+	// Propagate to servers.
+	for _, ls := range cb.channelServers(channel) {
+		ls.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "TMODE",
+			Params: []string{
+				fmt.Sprintf("%d", channel.TS),
+				channel.Name,
+				"+o",
+				string(u.User.UID),
+			},
+		})
+	}
+}
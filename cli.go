@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Subcommands are for operators automating deployment. Running the server
+// doesn't use one (catbox -conf <file>).
+var subcommands = map[string]func([]string) int{
+	"version":     versionSubcommand,
+	"genconfig":   genconfigSubcommand,
+	"checkconfig": checkconfigSubcommand,
+	"mkpasswd":    mkpasswdSubcommand,
+}
+
+// isSubcommand tells whether the command line invokes a subcommand rather than
+// the server.
+func isSubcommand(args []string) bool {
+	return len(args) > 1 && !strings.HasPrefix(args[1], "-")
+}
+
+// runSubcommand runs the named subcommand and returns the exit status.
+func runSubcommand(name string, args []string) int {
+	fn, exists := subcommands[name]
+	if !exists {
+		_, _ = fmt.Fprintf(os.Stderr, "unknown subcommand: %s\n", name) // nolint: gas
+		_, _ = fmt.Fprintf(os.Stderr,
+			"Subcommands: version, genconfig, checkconfig, mkpasswd\n") // nolint: gas
+		return 1
+	}
+	return fn(args)
+}
+
+// version prints our version and build information.
+func versionSubcommand(args []string) int {
+	fmt.Printf("%s\n", Version)
+	fmt.Printf("Created: %s\n", CreatedDate)
+	fmt.Printf("Go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
+
+// genconfig prints an example config with every option documented.
+func genconfigSubcommand(args []string) int {
+	fmt.Print(exampleConfig)
+	return 0
+}
+
+// checkconfig validates a config (and the configs it references) without
+// starting the server.
+func checkconfigSubcommand(args []string) int {
+	fs := flag.NewFlagSet("checkconfig", flag.ContinueOnError)
+	configFile := fs.String("conf", "", "Configuration file.")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	if len(*configFile) == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "you must provide a configuration file\n") // nolint: gas
+		fs.PrintDefaults()
+		return 1
+	}
+
+	if _, err := checkAndParseConfig(*configFile); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "configuration problem: %s\n", err) // nolint: gas
+		return 1
+	}
+
+	fmt.Printf("Configuration OK\n")
+	return 0
+}
+
+// mkpasswd hashes a password for the opers config. We take the password as an
+// argument, or read it from stdin so it need not appear in the process list.
+func mkpasswdSubcommand(args []string) int {
+	var password string
+	if len(args) > 0 {
+		password = args[0]
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "unable to read password: %s\n", err) // nolint: gas
+			return 1
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if len(password) == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "password must not be blank\n") // nolint: gas
+		return 1
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err) // nolint: gas
+		return 1
+	}
+
+	fmt.Printf("%s\n", hash)
+	return 0
+}
+
+// exampleConfig is what genconfig prints. Keep it the same as
+// conf/catbox.conf.
+const exampleConfig = `# The main catbox config.
+#
+# The commented options are the defaults which are used if you do not specify
+# the option.
+
+# Host to listen on. This may be an IPv6 IP. For example, :: listens on all
+# IPv6 IPs, and on most systems all IPv4 IPs as well.
+#listen-host = 0.0.0.0
+
+# Port to listen on. Set -1 to not listen.
+#listen-port = 6667
+
+# Port to listen on (TLS). Set -1 to not listen.
+#listen-port-tls = -1
+
+# Port to listen on for clients connecting through a Tor hidden service. Point
+# the hidden service at it. We don't look up these clients' hostnames. They get
+# the host tor-host and no IP, and they can't see other users' real hosts or
+# IPs, even as operators. Set -1 to not listen.
+#listen-port-tor = -1
+
+# Host to listen on for the Tor listener. Usually Tor runs on the same machine.
+#listen-host-tor = 127.0.0.1
+
+# Port to listen on for servers only. Connections to it may only link as a
+# server. Anything registering as a user (NICK, USER) is disconnected. This
+# lets you firewall the port servers link to separately. Set -1 to not listen.
+#listen-port-servers = -1
+
+# Host to listen on for the servers only listener.
+#listen-host-servers = 0.0.0.0
+
+# Host clients on the Tor listener get.
+#tor-host = tor.hidden
+
+# What clients on the Tor listener must do before they may register. none,
+# password (send PASS with tor-password), or sasl (authenticate with SASL).
+#tor-auth = none
+
+# Password for tor-auth = password. It may be plaintext or a hash from catbox
+# mkpasswd.
+#tor-password =
+
+# File containing server certificate for TLS. PEM encoded.
+# Must be set if you have a TLS listen port. If set, clients on the plaintext
+# port may also upgrade to TLS with STARTTLS.
+#certificate-file =
+
+# File containing server key for TLS. PEM encoded.
+# Must be set if you have a TLS listen port.
+#key-file =
+
+# How often we check whether the certificate and key files (including those in
+# certificates-config) changed. If they did, we load them again. This way a
+# certificate an ACME client such as certbot renews takes effect without a
+# rehash. 0s disables this.
+#certificate-check-time = 1m
+
+# Name server goes by.
+#server-name = irc.example.com
+
+# Short info line (shown in WHOIS).
+#server-info = IRC
+
+# Name of the network. We tell clients this when they connect (RPL_ISUPPORT)
+# and in LUSERS. It may not contain spaces. Leave blank to not tell them. Every
+# server on the network should have the same network options.
+#network-name =
+
+# What the network is. We tell clients when they connect.
+#network-description =
+
+# Who runs the network and how to reach them (e.g., Network staff
+# <staff@example.com>). We tell clients when they connect. admin-email is this
+# server's admin.
+#network-admin =
+
+# Hide the network's layout from users who aren't operators. Operators still
+# see everything.
+#
+# hidden-server-name is what WHOIS and WHO show instead of the server a user
+# is on. WHOIS shows the network name as its info (or IRC if there is none),
+# as does LINKS for every server. Messages from other servers come from us.
+# Leave blank to show real server names. It may not contain spaces.
+#hidden-server-name =
+#
+# Whether LINKS and MAP show every server as linked directly to us.
+#flatten-links = false
+#
+# Whether users quitting in a netsplit quit with *.net *.split rather than the
+# names of the servers that split. This applies to operators too.
+#hide-split-servers = false
+
+# MOTD. Only one line at this time.
+#motd = Hello this is catbox
+
+# Secret key for cloaking users' hosts. If set, users get user mode +x when
+# they connect, which shows others a hash of their host instead of it. Users
+# may unset +x to show their host. Operators still see the real host. Servers
+# on the network should use the same key so the same host gets the same cloak.
+# Leave blank to not cloak.
+#cloak-key =
+
+# Maximum nick length. RFCs say 9, but longer is okay.
+#max-nick-length = 9
+
+# The longest channel names our users may create. They may join longer ones
+# that exist. At most 50.
+#max-channel-length = 50
+
+# The longest topics, kick comments, and away messages our users may set. We
+# truncate longer ones. At most 300 each.
+#max-topic-length = 300
+#max-kick-length = 300
+#max-away-length = 300
+
+# The most results WHO and LIST return to users who are not operators. We tell
+# them if we truncate the results. 0 for no limit.
+#max-who-results = 200
+#max-list-results = 200
+
+# The most nicks users who are not operators may WHOIS at once. 0 for no
+# limit.
+#max-whois-targets = 5
+
+# The most entries a query of a channel's bans, ban exceptions, invite
+# exceptions, or quiets (e.g., MODE #channel b) returns to users who are not
+# operators. Other servers may give a channel more entries than we permit
+# local users to add. 0 for no limit.
+#max-mode-list-results = 100
+
+# The most entries local users may add to a channel's bans, ban exceptions,
+# invite exceptions, and quiets combined. We advertise it as MAXLIST. Other
+# servers may give a channel more.
+#max-channel-list-entries = 50
+
+# The most targets a PRIVMSG or NOTICE may have. e.g., PRIVMSG a,b,c has 3.
+# Each target past the first also counts as a message for flood control. 0
+# for no limit.
+#max-targets = 4
+
+# The most channels a user may be in at once. We advertise it as CHANLIMIT.
+# Users config blocks may set their own. Operators have no limit. 0 for no
+# limit.
+#max-channels = 50
+
+# Join/part flood control. Users who are not exempt from flood control may
+# join and part channels at most this many times in this long. Once they
+# reach the limit, we refuse their joins until enough time passes and tell
+# operators. 0 for no limit.
+#join-part-count = 10
+#join-part-time = 1m
+
+# How many messages we queue to send to a user or server before we give up
+# and disconnect them (Max SendQ exceeded). Servers need a lot of room when
+# they link as we send them the whole network at once. Users config blocks
+# and connect classes may set their own. At most 32768.
+#user-sendq = 3000
+#server-sendq = 32768
+
+# What to do with messages containing colors or formatting sent to channels
+# with mode +c. strip removes the colors and formatting. reject refuses the
+# message.
+#no-colors-action = strip
+
+# What to do with messages from users that are not valid UTF-8 or that contain
+# control characters other than formatting. allow passes them on as they are.
+# sanitize replaces invalid UTF-8 with U+FFFD and removes the control
+# characters. reject refuses the message. If not allow, we advertise UTF8ONLY.
+#invalid-utf8-action = allow
+
+# Maximum period of time a client can be idle before we ping it.
+#ping-time = 30s
+
+# Maximum period of time a client can be idle before we consider it dead.
+#dead-time = 240s
+
+# Maximum period of time a server may take to burst when it links. If it is
+# still sending us data we give it longer, until it goes ping-time without
+# sending anything.
+#burst-timeout = 5m
+
+# Whether to let clients register before we finish looking up their hostname.
+# If we find it after they register, we change their host from their IP to it.
+# Note that connect policy and users config host rules see only the IP in that
+# case. We check K-Lines again once we have the hostname. Changing this
+# requires a restart.
+#async-hostname-lookup = false
+
+# How many hostname lookups we do at once. Clients connecting while all are
+# busy wait their turn. Changing this requires a restart.
+#dns-workers = 8
+
+# How long we wait for a client's hostname lookup before giving up. Changing
+# this requires a restart.
+#dns-timeout = 10s
+
+# How long we remember a hostname we looked up, and how long we remember that
+# we found none. 0s means we don't remember. Changing these requires a restart.
+#dns-cache-time = 1h
+#dns-negative-cache-time = 5m
+
+# Whether DIE, RESTART, and UPGRADE need this server's name as a parameter
+# (e.g., DIE irc.example.com). This guards against shutting down the wrong
+# server.
+#confirm-shutdown = false
+
+# What we tell clients and servers when we shut down (e.g., on SIGTERM or DIE).
+#shutdown-message = Server shutting down
+
+# How long we keep sending what's queued for clients and servers once we start
+# shutting down. After this we close their connections anyway.
+#shutdown-flush-time = 5s
+
+# The least important messages to log: debug, info, warn, or error. After the
+# level for everything you may give levels for subsystems: core, clients, s2s
+# (server links), dns, and flood. e.g., info s2s=debug. Operators can change
+# these until the next rehash with LOGLEVEL.
+#log-level = info
+
+# How to format logs: text or json (one object per line).
+#log-format = text
+
+# Rotate the log file (-log-file) once it reaches this many megabytes. 0 to
+# not rotate. We keep log-rotate-count old files. The newest is <file>.1.
+#log-rotate-size = 0
+#log-rotate-count = 5
+
+# Files to keep records of some events in, in addition to the main log. These
+# are logged regardless of log-level.
+#
+# oper: Operators opering up (and failing to) and the operator commands they
+# use.
+#oper-log-file = oper.log
+# kill: KILLs and K-Lines.
+#kill-log-file = kill.log
+# link: Servers linking and delinking.
+#link-log-file = link.log
+# connect: Clients we reject or that fail to connect.
+#connect-log-file = connect.log
+
+# Serve Go's profiler (net/http/pprof) and a JSON summary of our state over
+# HTTP, for diagnosing problems. The address must be a loopback address. The
+# paths are /debug/pprof/ and /debug/state. There is no authentication, so
+# anyone who can connect to the port can use them.
+#debug-listen = 127.0.0.1:6060
+
+# Serve an admin API over HTTP. Tools such as web panels can use it to list
+# users, channels, servers, and bans, and to K-Line, KILL, rehash, and SQUIT.
+# The address must be a loopback address. Requests must include the token in
+# an "Authorization: Bearer <token>" header. The token may be hashed with
+# catbox mkpasswd. Changing the token takes effect when we rehash.
+#api-listen = 127.0.0.1:6061
+#api-token = some long random string
+
+# Time to wait between attempts connecting to a server. This is for servers
+# without a connect class. We also wait this long between any two attempts,
+# even to different servers.
+#connect-attempt-time = 60s
+
+# The longest to wait between attempts connecting to a server. When we fail to
+# connect to a server repeatedly, we back off exponentially up to this.
+#connect-max-backoff = 30m
+
+# Local IP to connect to servers from. If blank, the system chooses. This is
+# for hosts with several IPs where other servers only accept links from one.
+# A server in the servers config may set its own.
+#link-bind-address =
+
+# Time between checks of our state for problems (desyncs). We tell operators
+# if we find any. Set 0s to disable.
+#consistency-check-time = 10m
+
+# TS6 SID. Must be unique in the network. Format: [0-9][A-Z0-9]{2}
+#ts6-sid = 000
+
+# Administrator's email. It gets displayed in some errors.
+#admin-email =
+
+# Path to opers configuration. This defines server operators.
+#opers-config =
+
+# Path to servers configuration. This defines servers to link with.
+#servers-config =
+
+# Path to the users configuration. This defines spoofs and whether users are
+# exempt from flood protection.
+#users-config =
+
+# Path to the vhosts configuration. This defines vhosts to give users by
+# services account or TLS client certificate.
+#vhosts-config =
+
+# Path to the exempts configuration. This defines users K-Lines do not apply
+# to.
+#exempts-config =
+
+# Path to the reserves configuration. This defines nicks and channels users
+# may not use.
+#reserves-config =
+
+# Path to the spamfilters configuration. This defines messages users may not
+# send.
+#spamfilters-config =
+
+# Path to the certificates configuration. This defines certificates to present
+# to clients asking for other hostnames (SNI).
+#certificates-config =
+
+# Path to the connect classes configuration. This defines how often we try to
+# connect to servers.
+#connect-classes-config =
+
+# Path to the connect policy configuration. This defines rules deciding whether
+# to accept users at registration time, and which user configuration to apply
+# to them.
+#policy-config =
+
+# File to keep network statistics in (peak users, connections, messages,
+# splits, and K-Lines for each day). We keep them across restarts this way.
+# Operators can see them with STATS n. If blank, we don't keep them across
+# restarts.
+#stats-file =
+
+# File to keep all of our state in: statistics, bans, channels, channel
+# history, and NickServ and ChanServ data. If set, the files set by
+# stats-file, bans-file, channels-file, channel-history-file, nickserv-file,
+# and chanserv-file are instead names in this file. Those options still say
+# which state we keep (and whether we run NickServ and ChanServ). If blank, we
+# keep each in its own file. This is a bbolt database. Only one process may
+# have it open. Changing this requires a restart.
+#state-db =
+
+# How many messages to each channel we remember. Clients that negotiate the
+# draft/chathistory capability can ask for them with CHATHISTORY. Clients with
+# server-time (but not draft/chathistory) get the latest when they join. If 0,
+# we don't remember messages.
+#channel-history-length = 0
+
+# How long we remember messages to channels.
+#channel-history-time = 24h
+
+# How many of a channel's messages we send clients when they join.
+#channel-history-playback = 10
+
+# File to keep channel history in. We load it at startup and save it
+# periodically. If blank, history lasts only until we restart.
+#channel-history-file =
+
+# File to keep bans (K-Lines) in. We load them at startup and save them when
+# they change. If blank, K-Lines last only until we restart.
+#bans-file =
+
+# File to keep channels' TS, topics, and modes (including bans) in. We save
+# them periodically and at shutdown. When a channel we have saved is created
+# again, it gets them back. If blank, channels start fresh after we restart.
+#channels-file =
+
+# File to keep accounts of the built in NickServ in. If set, we run NickServ:
+# users may register their nick with /NS REGISTER <password> (or by messaging
+# NickServ), and log in with /NS IDENTIFY. This is for networks without
+# services. Each server keeps its own accounts, so it suits a single server
+# best.
+#nickserv-file =
+
+# How long a user who takes a registered nick has to identify before NickServ
+# changes their nick.
+#nickserv-grace-time = 60s
+
+# File to keep channel registrations of the built in ChanServ in. If set, we
+# run ChanServ: users logged in to an account may register channels they have
+# ops in with /CS REGISTER <channel> (or by messaging ChanServ). The founder
+# and accounts on the channel's op list (/CS OP) get ops when they join, and we
+# keep the channel's topic. Like NickServ, each server keeps its own.
+#chanserv-file =
+`
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -11,42 +15,267 @@ import (
 
 // Config holds a server's configuration.
 type Config struct {
-	ListenHost      string
-	ListenPort      string
-	ListenPortTLS   string
+	ListenHost    string
+	ListenPort    string
+	ListenPortTLS string
+
+	// Listener for clients connecting through a Tor hidden service. See
+	// LocalClient.Tor.
+	ListenHostTor string
+	ListenPortTor string
+
+	// Listener for servers only. Clients connecting to it may only link as a
+	// server. See LocalClient.ServersOnly.
+	ListenHostServers string
+	ListenPortServers string
+
+	// The host clients on the Tor listener get.
+	TorHost string
+
+	// What clients on the Tor listener must do before they may register. none,
+	// password (PASS with TorPassword), or sasl.
+	TorAuth     string
+	TorPassword string
+
 	CertificateFile string
 	KeyFile         string
-	ServerName      string
+
+	// Additional certificates. We present one of these if the client asks for
+	// a name it is valid for (SNI).
+	CertificateConfigs []CertificateConfig
+
+	// Time between checks of whether our certificate files changed. If they
+	// did, we reload them. 0 to disable.
+	CertificateCheckTime time.Duration
+
+	ServerName string
 
 	// Description of server. This shows in WHOIS, etc.
 	ServerInfo string
 
+	// Name of the network. We tell clients in RPL_ISUPPORT. Blank to not.
+	NetworkName string
+
+	// What the network is, and who runs it. We tell clients when they connect.
+	// Blank to not.
+	NetworkDescription string
+	NetworkAdmin       string
+
+	// What users who aren't operators see instead of the names of the servers
+	// other users are on (WHOIS, WHO). Blank to show the real names.
+	HiddenServerName string
+
+	// Whether LINKS and MAP show users who aren't operators every server as
+	// linked to us.
+	FlattenLinks bool
+
+	// Whether netsplit QUIT messages say *.net *.split rather than naming the
+	// servers that split.
+	HideSplitServers bool
+
 	MOTD string
 
+	// Secret used to cloak users' hosts (user mode +x). Blank to not cloak.
+	CloakKey string
+
 	MaxNickLength int
 
+	// The longest channel names local users may create, and the longest
+	// topics, kick comments, and away messages we accept. We truncate the text
+	// ones.
+	MaxChannelLength int
+	MaxTopicLength   int
+	MaxKickLength    int
+	MaxAwayLength    int
+
+	// The most results/targets queries by non-operators may have. 0 for no
+	// limit.
+	MaxWHOResults      int
+	MaxLISTResults     int
+	MaxWHOISTargets    int
+	MaxModeListResults int
+
+	// The most targets a PRIVMSG or NOTICE may have. 0 for no limit.
+	MaxTargets int
+
+	// The most entries local users may add to a channel's lists (bans, ban
+	// exceptions, invite exceptions, and quiets) combined.
+	MaxChannelListEntries int
+
+	// The most channels a local user may be in at once. Users config blocks may
+	// set their own. Operators have no limit. 0 for no limit.
+	MaxChannels int
+
+	// Join/part flood control. Users who are not exempt from flood control may
+	// join and part channels at most JoinPartCount times within JoinPartTime.
+	// 0 for no limit.
+	JoinPartCount int
+	JoinPartTime  time.Duration
+
 	// Period of time a client can be idle before we send it a PING.
 	PingTime time.Duration
 
 	// Period of time a client can be idle before we consider it dead.
 	DeadTime time.Duration
 
-	// Time to wait between attempts connecting to servers (minimum).
+	// Period of time a server may take to burst. It may take longer as long as
+	// it keeps sending us data.
+	BurstTimeout time.Duration
+
+	// Time to wait between attempts connecting to servers (minimum). This is
+	// for servers without a connect class.
 	ConnectAttemptTime time.Duration
 
+	// Connect class name to the time to wait between attempts connecting to
+	// servers in the class.
+	ConnectClasses map[string]time.Duration
+
+	// Connect class name to how many messages we may queue to send to servers
+	// in the class. Classes without one use ServerSendQueue.
+	ConnectClassSendQueues map[string]int
+
+	// How many messages we may queue to send to a user or server before we
+	// disconnect them. Users config blocks and connect classes may set their
+	// own.
+	UserSendQueue   int
+	ServerSendQueue int
+
+	// The longest we wait between attempts connecting to a server when we
+	// back off after failures.
+	ConnectMaxBackoff time.Duration
+
+	// Local IP to connect to servers from. Blank to let the system choose. A
+	// server's link block may override it.
+	LinkBindAddress string
+
+	// Time between checks of our state for problems (desyncs). 0 to disable.
+	ConsistencyCheckTime time.Duration
+
 	// TS6 SID. Must be unique in the network. Format: [0-9][A-Z0-9]{2}
 	TS6SID TS6SID
 
 	AdminEmail string
 
-	// Oper name to password.
-	Opers map[string]string
+	// Oper name to its oper block.
+	Opers map[string]*OperConfig
 
 	// Server name to its link information.
 	Servers map[string]*ServerDefinition
 
 	// User configuration info.
 	UserConfigs []UserConfig
+
+	// Vhosts to give users by account or TLS client certificate.
+	VhostConfigs []VhostConfig
+
+	// Users K-Lines do not apply to.
+	ExemptConfigs []ExemptConfig
+
+	// Nicks and channels local users may not use.
+	ReserveConfigs []ReserveConfig
+
+	// Messages local users may not send.
+	SpamFilterConfigs []SpamFilterConfig
+
+	// Connect policy rules. We apply the first that matches a registering user.
+	PolicyRules []PolicyRule
+
+	// File to keep state in (see Store). If set, the files below are instead
+	// names in it. Blank to keep each in its own file.
+	StateDB string
+
+	// File to keep network statistics in across restarts. Blank to not keep
+	// them.
+	StatsFile string
+
+	// File to keep bans (K-Lines) in across restarts. Blank to not keep them.
+	BansFile string
+
+	// File to keep channels' TS, topics, and modes in across restarts. Blank to
+	// not keep them.
+	ChannelsFile string
+
+	// File to keep built in NickServ accounts in. Blank to not run NickServ.
+	NickServFile string
+
+	// How long users have to identify after taking a registered nick before
+	// NickServ changes it.
+	NickServGraceTime time.Duration
+
+	// File to keep built in ChanServ registrations in. Blank to not run
+	// ChanServ.
+	ChanServFile string
+
+	// Whether to let clients register before we finish looking up their
+	// hostname.
+	AsyncHostnameLookup bool
+
+	// How many hostname lookups we do at once.
+	DNSWorkers int
+
+	// How long we wait for a hostname lookup.
+	DNSTimeout time.Duration
+
+	// How long we remember a client's hostname, and how long we remember that
+	// we found none.
+	DNSCacheTime         time.Duration
+	DNSNegativeCacheTime time.Duration
+
+	// Whether DIE, RESTART, and UPGRADE need our server name as a parameter.
+	ConfirmShutdown bool
+
+	// What we tell clients and servers when we shut down.
+	ShutdownMessage string
+
+	// How long we keep sending what's queued for clients and servers once we
+	// start shutting down.
+	ShutdownFlushTime time.Duration
+
+	// The least important level we log for each subsystem.
+	LogLevels map[string]LogLevel
+
+	// How we format logs: text or json.
+	LogFormat string
+
+	// The size in bytes at which we rotate the log file. 0 if we don't. We keep
+	// LogRotateCount old files.
+	LogRotateSize  int64
+	LogRotateCount int
+
+	// Category (see logCategories) to the file we log its events to.
+	EventLogFiles map[string]string
+
+	// Loopback address (host:port) to serve pprof and a dump of our state on.
+	// Blank if we don't.
+	DebugListen string
+
+	// Loopback address (host:port) to serve the admin API on. Blank if we
+	// don't. Requests must have the token, which may be hashed (see
+	// hashPassword()).
+	APIListen string
+	APIToken  string
+
+	// What to do with messages with colors or formatting sent to +c channels:
+	// strip or reject.
+	NoColorsAction string
+
+	// What to do with messages from local users that are not valid UTF-8 or
+	// that contain control characters other than formatting: allow, sanitize,
+	// or reject. If not allow, we advertise UTF8ONLY.
+	InvalidUTF8Action string
+
+	// How many messages we remember for each channel. 0 if we don't keep
+	// history.
+	ChannelHistoryLength int
+
+	// How long we remember messages.
+	ChannelHistoryTime time.Duration
+
+	// How many messages we send clients (with server-time) when they join.
+	ChannelHistoryPlayback int
+
+	// File to keep history in across restarts. Blank to not keep it.
+	ChannelHistoryFile string
 }
 
 // ServerDefinition defines how to link to a server.
@@ -56,10 +285,47 @@ type ServerDefinition struct {
 	Port     int
 	Pass     string
 	TLS      bool
+
+	// Whether this is a services server. Services may manage users (e.g.,
+	// SVSNICK). We don't connect to services. They connect to us.
+	Services bool
+
+	// Local IP to connect to the server from. Blank to use the global
+	// link-bind-address.
+	BindAddress string
+
+	// Connect class. This decides how often we try to connect. Blank for the
+	// default (connect-attempt-time).
+	Class string
+
+	// Whether we try to connect to the server on our own.
+	AutoConnect bool
+}
+
+// OperConfig defines an operator. Users become the operator with OPER.
+type OperConfig struct {
+	Name string
+
+	// Plaintext or hashed (see mkpasswd). Blank if the operator authenticates
+	// only by certificate.
+	Password string
+
+	// user@host masks OPER may be used from. Empty means anywhere.
+	Masks []string
+
+	// Whether OPER must come over a TLS connection.
+	RequireTLS bool
+
+	// If set, the hex SHA-256 fingerprint (lowercase) of the TLS client
+	// certificate the user must present.
+	CertFP string
 }
 
 // UserConfig defines settings about users. Matched by usermask and hostmask.
 type UserConfig struct {
+	// Name from the users config.
+	Name string
+
 	// For this configuration to apply at registration time, the user must match
 	// the UserMask and HostMask.
 	UserMask string
@@ -70,6 +336,77 @@ type UserConfig struct {
 
 	// If non-blank, a spoof to set instead of their host.
 	Spoof string
+
+	// How many messages we may queue to send to the user. 0 to use
+	// user-sendq.
+	SendQueue int
+
+	// The most channels the user may be in at once. 0 to use max-channels.
+	MaxChannels int
+}
+
+// VhostConfig assigns a vhost to users logged in to an account or presenting a
+// TLS client certificate. Only one of Account and CertFP is set.
+type VhostConfig struct {
+	// Name from the vhosts config.
+	Name string
+
+	Account string
+
+	// Hex SHA-256 fingerprint. Lowercase.
+	CertFP string
+
+	Vhost string
+}
+
+// ExemptConfig protects local users from K-Lines. They match by user@host
+// mask or by TLS client certificate. Only one of the mask and CertFP is set.
+type ExemptConfig struct {
+	// Name from the exempts config.
+	Name string
+
+	// The host mask may be a CIDR.
+	UserMask string
+	HostMask string
+
+	// Hex SHA-256 fingerprint. Lowercase.
+	CertFP string
+}
+
+// ReserveConfig reserves nicks or channels matching a mask. Local users may
+// not take a reserved nick or join a reserved channel. Masks starting with #
+// or & are for channels. Others are for nicks.
+type ReserveConfig struct {
+	// Name from the reserves config.
+	Name string
+
+	// * and ? are wildcards.
+	Mask string
+
+	// What we tell users. May be blank.
+	Reason string
+}
+
+// SpamFilterConfig blocks PRIVMSGs and NOTICEs from local users with text
+// matching a mask.
+type SpamFilterConfig struct {
+	// Name from the spamfilters config.
+	Name string
+
+	// * and ? are wildcards. It must match the whole message.
+	Mask string
+
+	// What we tell users. May be blank.
+	Reason string
+}
+
+// CertificateConfig is a certificate and key from the certificates config.
+type CertificateConfig struct {
+	// Name from the certificates config.
+	Name string
+
+	CertificateFile string
+	KeyFile         string
 }
 
 // checkAndParseConfig checks configuration keys are present and in an
@@ -78,11 +415,25 @@ type UserConfig struct {
 // We parse some values into alternate representations.
 //
 // This function populates both the server.Config and server.Opers fields.
+//
+// The config may be in the flat key = value format or, if its name ends in
+// .yaml or .yml, in YAML. See checkAndParseYAMLConfig().
 func checkAndParseConfig(file string) (*Config, error) {
+	if isYAMLConfig(file) {
+		return checkAndParseYAMLConfig(file)
+	}
+
 	m, err := config.ReadStringMap(file)
 	if err != nil {
 		return nil, err
 	}
+	return parseConfig(m)
+}
+
+// parseConfig parses options from the flat format. The YAML format has these
+// options too.
+func parseConfig(m map[string]string) (*Config, error) {
+	var err error
 
 	c := &Config{}
 
@@ -101,10 +452,62 @@ func checkAndParseConfig(file string) (*Config, error) {
 		c.ListenPortTLS = m["listen-port-tls"]
 	}
 
+	c.ListenHostTor = "127.0.0.1"
+	if m["listen-host-tor"] != "" {
+		c.ListenHostTor = m["listen-host-tor"]
+	}
+
+	c.ListenPortTor = "-1"
+	if m["listen-port-tor"] != "" {
+		c.ListenPortTor = m["listen-port-tor"]
+	}
+
+	c.ListenHostServers = "0.0.0.0"
+	if m["listen-host-servers"] != "" {
+		c.ListenHostServers = m["listen-host-servers"]
+	}
+
+	c.ListenPortServers = "-1"
+	if m["listen-port-servers"] != "" {
+		c.ListenPortServers = m["listen-port-servers"]
+	}
+
+	c.TorHost = "tor.hidden"
+	if m["tor-host"] != "" {
+		c.TorHost = m["tor-host"]
+		if strings.ContainsAny(c.TorHost, " !@*?") {
+			return nil, fmt.Errorf("tor host is not valid: %s", c.TorHost)
+		}
+	}
+
+	c.TorAuth = "none"
+	if m["tor-auth"] != "" {
+		c.TorAuth = m["tor-auth"]
+		if c.TorAuth != "none" && c.TorAuth != "password" && c.TorAuth != "sasl" {
+			return nil, fmt.Errorf("tor auth must be none, password, or sasl: %s",
+				c.TorAuth)
+		}
+	}
+
+	c.TorPassword = m["tor-password"]
+	if c.TorAuth == "password" && c.TorPassword == "" {
+		return nil, fmt.Errorf("tor auth is password but there is no tor password")
+	}
+
 	if m["certificate-file"] != "" {
 		c.CertificateFile = m["certificate-file"]
 	}
 
+	c.CertificateCheckTime = time.Minute
+	if m["certificate-check-time"] != "" {
+		c.CertificateCheckTime, err = time.ParseDuration(
+			m["certificate-check-time"])
+		if err != nil {
+			return nil, fmt.Errorf(
+				"certificate check time is in invalid format: %s", err)
+		}
+	}
+
 	if m["key-file"] != "" {
 		c.KeyFile = m["key-file"]
 	}
@@ -119,11 +522,42 @@ func checkAndParseConfig(file string) (*Config, error) {
 		c.ServerInfo = m["server-info"]
 	}
 
+	c.NetworkName = m["network-name"]
+	if strings.ContainsAny(c.NetworkName, " ,=") {
+		return nil, fmt.Errorf("network name is not valid: %s", c.NetworkName)
+	}
+
+	c.NetworkDescription = m["network-description"]
+	c.NetworkAdmin = m["network-admin"]
+
+	c.HiddenServerName = m["hidden-server-name"]
+	if strings.ContainsAny(c.HiddenServerName, " ,=") {
+		return nil, fmt.Errorf("hidden server name is not valid: %s",
+			c.HiddenServerName)
+	}
+
+	if m["flatten-links"] != "" {
+		c.FlattenLinks, err = strconv.ParseBool(m["flatten-links"])
+		if err != nil {
+			return nil, fmt.Errorf("flatten links is in invalid format: %s", err)
+		}
+	}
+
+	if m["hide-split-servers"] != "" {
+		c.HideSplitServers, err = strconv.ParseBool(m["hide-split-servers"])
+		if err != nil {
+			return nil, fmt.Errorf("hide split servers is in invalid format: %s",
+				err)
+		}
+	}
+
 	c.MOTD = "Hello this is catbox"
 	if m["motd"] != "" {
 		c.MOTD = m["motd"]
 	}
 
+	c.CloakKey = m["cloak-key"]
+
 	c.MaxNickLength = 9
 	if m["max-nick-length"] != "" {
 		nickLen64, err := strconv.ParseInt(m["max-nick-length"], 10, 8)
@@ -133,6 +567,124 @@ func checkAndParseConfig(file string) (*Config, error) {
 		c.MaxNickLength = int(nickLen64)
 	}
 
+	lengths := []struct {
+		key   string
+		field *int
+		max   int
+	}{
+		{"max-channel-length", &c.MaxChannelLength, maxChannelLength},
+		{"max-topic-length", &c.MaxTopicLength, maxTopicLength},
+		{"max-kick-length", &c.MaxKickLength, maxKickLength},
+		{"max-away-length", &c.MaxAwayLength, maxAwayLength},
+	}
+	for _, length := range lengths {
+		*length.field = length.max
+		if m[length.key] == "" {
+			continue
+		}
+		*length.field, err = strconv.Atoi(m[length.key])
+		if err != nil || *length.field < 2 || *length.field > length.max {
+			return nil, fmt.Errorf("%s must be from 2 to %d: %s", length.key,
+				length.max, m[length.key])
+		}
+	}
+
+	c.MaxWHOResults = 200
+	if m["max-who-results"] != "" {
+		c.MaxWHOResults, err = strconv.Atoi(m["max-who-results"])
+		if err != nil || c.MaxWHOResults < 0 {
+			return nil, fmt.Errorf("max WHO results is not valid: %s",
+				m["max-who-results"])
+		}
+	}
+
+	c.MaxLISTResults = 200
+	if m["max-list-results"] != "" {
+		c.MaxLISTResults, err = strconv.Atoi(m["max-list-results"])
+		if err != nil || c.MaxLISTResults < 0 {
+			return nil, fmt.Errorf("max LIST results is not valid: %s",
+				m["max-list-results"])
+		}
+	}
+
+	c.MaxWHOISTargets = 5
+	if m["max-whois-targets"] != "" {
+		c.MaxWHOISTargets, err = strconv.Atoi(m["max-whois-targets"])
+		if err != nil || c.MaxWHOISTargets < 0 {
+			return nil, fmt.Errorf("max WHOIS targets is not valid: %s",
+				m["max-whois-targets"])
+		}
+	}
+
+	c.MaxModeListResults = 100
+	if m["max-mode-list-results"] != "" {
+		c.MaxModeListResults, err = strconv.Atoi(m["max-mode-list-results"])
+		if err != nil || c.MaxModeListResults < 0 {
+			return nil, fmt.Errorf("max mode list results is not valid: %s",
+				m["max-mode-list-results"])
+		}
+	}
+
+	c.MaxTargets = 4
+	if m["max-targets"] != "" {
+		c.MaxTargets, err = strconv.Atoi(m["max-targets"])
+		if err != nil || c.MaxTargets < 0 {
+			return nil, fmt.Errorf("max targets is not valid: %s", m["max-targets"])
+		}
+	}
+
+	c.MaxChannelListEntries = 50
+	if m["max-channel-list-entries"] != "" {
+		c.MaxChannelListEntries, err = strconv.Atoi(m["max-channel-list-entries"])
+		if err != nil || c.MaxChannelListEntries < 1 {
+			return nil, fmt.Errorf("max channel list entries is not valid: %s",
+				m["max-channel-list-entries"])
+		}
+	}
+
+	c.MaxChannels = 50
+	if m["max-channels"] != "" {
+		c.MaxChannels, err = strconv.Atoi(m["max-channels"])
+		if err != nil || c.MaxChannels < 0 {
+			return nil, fmt.Errorf("max channels is not valid: %s",
+				m["max-channels"])
+		}
+	}
+
+	c.UserSendQueue = 3000
+	if m["user-sendq"] != "" {
+		c.UserSendQueue, err = parseSendQueue(m["user-sendq"])
+		if err != nil {
+			return nil, fmt.Errorf("user-sendq: %s", err)
+		}
+	}
+
+	c.ServerSendQueue = MaxSendQueue
+	if m["server-sendq"] != "" {
+		c.ServerSendQueue, err = parseSendQueue(m["server-sendq"])
+		if err != nil {
+			return nil, fmt.Errorf("server-sendq: %s", err)
+		}
+	}
+
+	c.JoinPartCount = 10
+	if m["join-part-count"] != "" {
+		c.JoinPartCount, err = strconv.Atoi(m["join-part-count"])
+		if err != nil || c.JoinPartCount < 0 {
+			return nil, fmt.Errorf("join/part count is not valid: %s",
+				m["join-part-count"])
+		}
+	}
+
+	c.JoinPartTime = time.Minute
+	if m["join-part-time"] != "" {
+		c.JoinPartTime, err = time.ParseDuration(m["join-part-time"])
+		if err != nil || c.JoinPartTime <= 0 {
+			return nil, fmt.Errorf("join/part time is not valid: %s",
+				m["join-part-time"])
+		}
+	}
+
 	c.PingTime = 30 * time.Second
 	if m["ping-time"] != "" {
 		c.PingTime, err = time.ParseDuration(m["ping-time"])
@@ -149,6 +701,14 @@ func checkAndParseConfig(file string) (*Config, error) {
 		}
 	}
 
+	c.BurstTimeout = 5 * time.Minute
+	if m["burst-timeout"] != "" {
+		c.BurstTimeout, err = time.ParseDuration(m["burst-timeout"])
+		if err != nil {
+			return nil, fmt.Errorf("burst timeout is in invalid format: %s", err)
+		}
+	}
+
 	c.ConnectAttemptTime = 60 * time.Second
 	if m["connect-attempt-time"] != "" {
 		c.ConnectAttemptTime, err = time.ParseDuration(m["connect-attempt-time"])
@@ -158,6 +718,33 @@ func checkAndParseConfig(file string) (*Config, error) {
 		}
 	}
 
+	c.ConnectMaxBackoff = 30 * time.Minute
+	if m["connect-max-backoff"] != "" {
+		c.ConnectMaxBackoff, err = time.ParseDuration(m["connect-max-backoff"])
+		if err != nil {
+			return nil, fmt.Errorf("connect max backoff is in invalid format: %s",
+				err)
+		}
+	}
+
+	if m["link-bind-address"] != "" {
+		if net.ParseIP(m["link-bind-address"]) == nil {
+			return nil, fmt.Errorf("link bind address is not a valid IP: %s",
+				m["link-bind-address"])
+		}
+		c.LinkBindAddress = m["link-bind-address"]
+	}
+
+	c.ConsistencyCheckTime = 10 * time.Minute
+	if m["consistency-check-time"] != "" {
+		c.ConsistencyCheckTime, err = time.ParseDuration(
+			m["consistency-check-time"])
+		if err != nil {
+			return nil, fmt.Errorf(
+				"consistency check time is in invalid format: %s", err)
+		}
+	}
+
 	// opers.conf.
 
 	if m["opers-config"] != "" {
@@ -165,9 +752,42 @@ func checkAndParseConfig(file string) (*Config, error) {
 		if err != nil {
 			return nil, fmt.Errorf("unable to load opers config: %s", err)
 		}
-		c.Opers = opers
+
+		c.Opers = make(map[string]*OperConfig)
+		for name, value := range opers {
+			operConfig, err := parseOperConfig(value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse oper config %s: %s", name,
+					err)
+			}
+			operConfig.Name = name
+			c.Opers[name] = operConfig
+		}
 	} else {
-		c.Opers = map[string]string{}
+		c.Opers = map[string]*OperConfig{}
+	}
+
+	// connect-classes.conf.
+
+	c.ConnectClasses = make(map[string]time.Duration)
+	c.ConnectClassSendQueues = make(map[string]int)
+
+	if m["connect-classes-config"] != "" {
+		classes, err := config.ReadStringMap(m["connect-classes-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load connect classes config: %s", err)
+		}
+
+		for name, v := range classes {
+			frequency, sendQueue, err := parseConnectClass(v)
+			if err != nil {
+				return nil, fmt.Errorf("connect class %s: %s", name, err)
+			}
+			c.ConnectClasses[name] = frequency
+			if sendQueue > 0 {
+				c.ConnectClassSendQueues[name] = sendQueue
+			}
+		}
 	}
 
 	// servers.conf.
@@ -186,6 +806,11 @@ func checkAndParseConfig(file string) (*Config, error) {
 				return nil, fmt.Errorf("malformed server link information: %s: %s",
 					name, err)
 			}
+			if _, exists := c.ConnectClasses[link.Class]; link.Class != "" &&
+				!exists {
+				return nil, fmt.Errorf("server %s has unknown connect class: %s", name,
+					link.Class)
+			}
 			c.Servers[name] = link
 		}
 	}
@@ -204,10 +829,350 @@ func checkAndParseConfig(file string) (*Config, error) {
 				return nil, fmt.Errorf("unable to parse user config %s: %s: %s", name,
 					value, err)
 			}
+			userConfig.Name = name
 			c.UserConfigs = append(c.UserConfigs, userConfig)
 		}
 	}
 
+	// vhosts.conf.
+
+	if m["vhosts-config"] != "" {
+		vhostsConfig, err := config.ReadStringMap(m["vhosts-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load vhosts config: %s", err)
+		}
+
+		for name, value := range vhostsConfig {
+			vhostConfig, err := parseVhostConfig(value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse vhost config %s: %s: %s", name,
+					value, err)
+			}
+			vhostConfig.Name = name
+			c.VhostConfigs = append(c.VhostConfigs, vhostConfig)
+		}
+
+		// Check them in a stable order so a user matching several gets the same
+		// vhost each time.
+		sort.Slice(c.VhostConfigs, func(i, j int) bool {
+			return c.VhostConfigs[i].Name < c.VhostConfigs[j].Name
+		})
+	}
+
+	// exempts.conf.
+
+	if m["exempts-config"] != "" {
+		exemptsConfig, err := config.ReadStringMap(m["exempts-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load exempts config: %s", err)
+		}
+
+		for name, value := range exemptsConfig {
+			exemptConfig, err := parseExemptConfig(value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse exempt config %s: %s: %s",
+					name, value, err)
+			}
+			exemptConfig.Name = name
+			c.ExemptConfigs = append(c.ExemptConfigs, exemptConfig)
+		}
+	}
+
+	// reserves.conf.
+
+	if m["reserves-config"] != "" {
+		reservesConfig, err := config.ReadStringMap(m["reserves-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load reserves config: %s", err)
+		}
+
+		for name, value := range reservesConfig {
+			reserveConfig, err := parseReserveConfig(value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse reserve config %s: %s: %s",
+					name, value, err)
+			}
+			reserveConfig.Name = name
+			c.ReserveConfigs = append(c.ReserveConfigs, reserveConfig)
+		}
+
+		// Check them in a stable order so we give the same reason each time.
+		sort.Slice(c.ReserveConfigs, func(i, j int) bool {
+			return c.ReserveConfigs[i].Name < c.ReserveConfigs[j].Name
+		})
+	}
+
+	// spamfilters.conf.
+
+	if m["spamfilters-config"] != "" {
+		spamFiltersConfig, err := config.ReadStringMap(m["spamfilters-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load spamfilters config: %s", err)
+		}
+
+		for name, value := range spamFiltersConfig {
+			spamFilterConfig, err := parseSpamFilterConfig(value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse spamfilter config %s: %s: %s",
+					name, value, err)
+			}
+			spamFilterConfig.Name = name
+			c.SpamFilterConfigs = append(c.SpamFilterConfigs, spamFilterConfig)
+		}
+
+		sort.Slice(c.SpamFilterConfigs, func(i, j int) bool {
+			return c.SpamFilterConfigs[i].Name < c.SpamFilterConfigs[j].Name
+		})
+	}
+
+	// certificates.conf.
+
+	if m["certificates-config"] != "" {
+		certificatesConfig, err := config.ReadStringMap(m["certificates-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load certificates config: %s", err)
+		}
+
+		for name, value := range certificatesConfig {
+			certificateConfig, err := parseCertificateConfig(value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse certificate config %s: %s: %s",
+					name, value, err)
+			}
+			certificateConfig.Name = name
+			c.CertificateConfigs = append(c.CertificateConfigs, certificateConfig)
+		}
+
+		// Check them in a stable order in case more than one is valid for a name.
+		sort.Slice(c.CertificateConfigs, func(i, j int) bool {
+			return c.CertificateConfigs[i].Name < c.CertificateConfigs[j].Name
+		})
+	}
+
+	// policy.conf.
+
+	if m["policy-config"] != "" {
+		rules, err := parsePolicyConfig(m["policy-config"], c.UserConfigs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load policy config: %s", err)
+		}
+		c.PolicyRules = rules
+	}
+
+	c.StateDB = m["state-db"]
+
+	if m["stats-file"] != "" {
+		c.StatsFile = m["stats-file"]
+	}
+
+	if m["bans-file"] != "" {
+		c.BansFile = m["bans-file"]
+	}
+
+	if m["channels-file"] != "" {
+		c.ChannelsFile = m["channels-file"]
+	}
+
+	if m["nickserv-file"] != "" {
+		c.NickServFile = m["nickserv-file"]
+	}
+
+	c.NickServGraceTime = 60 * time.Second
+	if m["nickserv-grace-time"] != "" {
+		c.NickServGraceTime, err = time.ParseDuration(m["nickserv-grace-time"])
+		if err != nil {
+			return nil, fmt.Errorf("nickserv grace time is in invalid format: %s",
+				err)
+		}
+	}
+
+	if m["chanserv-file"] != "" {
+		c.ChanServFile = m["chanserv-file"]
+	}
+
+	c.NoColorsAction = "strip"
+	if m["no-colors-action"] != "" {
+		if m["no-colors-action"] != "strip" && m["no-colors-action"] != "reject" {
+			return nil, fmt.Errorf("no colors action must be strip or reject: %s",
+				m["no-colors-action"])
+		}
+		c.NoColorsAction = m["no-colors-action"]
+	}
+
+	c.InvalidUTF8Action = "allow"
+	if m["invalid-utf8-action"] != "" {
+		if m["invalid-utf8-action"] != "allow" &&
+			m["invalid-utf8-action"] != "sanitize" &&
+			m["invalid-utf8-action"] != "reject" {
+			return nil, fmt.Errorf(
+				"invalid UTF-8 action must be allow, sanitize, or reject: %s",
+				m["invalid-utf8-action"])
+		}
+		c.InvalidUTF8Action = m["invalid-utf8-action"]
+	}
+
+	if m["async-hostname-lookup"] != "" {
+		c.AsyncHostnameLookup, err = strconv.ParseBool(m["async-hostname-lookup"])
+		if err != nil {
+			return nil, fmt.Errorf("async hostname lookup is in invalid format: %s",
+				err)
+		}
+	}
+
+	c.DNSWorkers = 8
+	if m["dns-workers"] != "" {
+		c.DNSWorkers, err = strconv.Atoi(m["dns-workers"])
+		if err != nil {
+			return nil, fmt.Errorf("dns workers is not valid: %s", err)
+		}
+		if c.DNSWorkers < 1 {
+			return nil, fmt.Errorf("dns workers must be at least 1")
+		}
+	}
+
+	c.DNSTimeout = 10 * time.Second
+	if m["dns-timeout"] != "" {
+		c.DNSTimeout, err = time.ParseDuration(m["dns-timeout"])
+		if err != nil {
+			return nil, fmt.Errorf("dns timeout is in invalid format: %s", err)
+		}
+		if c.DNSTimeout <= 0 {
+			return nil, fmt.Errorf("dns timeout must be positive")
+		}
+	}
+
+	c.DNSCacheTime = time.Hour
+	if m["dns-cache-time"] != "" {
+		c.DNSCacheTime, err = time.ParseDuration(m["dns-cache-time"])
+		if err != nil {
+			return nil, fmt.Errorf("dns cache time is in invalid format: %s", err)
+		}
+	}
+
+	c.DNSNegativeCacheTime = 5 * time.Minute
+	if m["dns-negative-cache-time"] != "" {
+		c.DNSNegativeCacheTime, err = time.ParseDuration(
+			m["dns-negative-cache-time"])
+		if err != nil {
+			return nil, fmt.Errorf("dns negative cache time is in invalid format: %s",
+				err)
+		}
+	}
+
+	if m["confirm-shutdown"] != "" {
+		c.ConfirmShutdown, err = strconv.ParseBool(m["confirm-shutdown"])
+		if err != nil {
+			return nil, fmt.Errorf("confirm shutdown is in invalid format: %s", err)
+		}
+	}
+
+	c.ShutdownMessage = "Server shutting down"
+	if m["shutdown-message"] != "" {
+		c.ShutdownMessage = m["shutdown-message"]
+	}
+
+	c.ShutdownFlushTime = 5 * time.Second
+	if m["shutdown-flush-time"] != "" {
+		c.ShutdownFlushTime, err = time.ParseDuration(m["shutdown-flush-time"])
+		if err != nil {
+			return nil, fmt.Errorf("shutdown flush time is in invalid format: %s",
+				err)
+		}
+		if c.ShutdownFlushTime < 0 {
+			return nil, fmt.Errorf("shutdown flush time must not be negative")
+		}
+	}
+
+	c.LogLevels, err = parseLogLevels(m["log-level"])
+	if err != nil {
+		return nil, err
+	}
+
+	c.LogFormat = "text"
+	if m["log-format"] != "" {
+		if m["log-format"] != "text" && m["log-format"] != "json" {
+			return nil, fmt.Errorf("log format must be text or json: %s",
+				m["log-format"])
+		}
+		c.LogFormat = m["log-format"]
+	}
+
+	if m["log-rotate-size"] != "" {
+		megabytes, err := strconv.ParseInt(m["log-rotate-size"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("log rotate size is not valid: %s", err)
+		}
+		if megabytes < 0 {
+			return nil, fmt.Errorf("log rotate size must not be negative")
+		}
+		c.LogRotateSize = megabytes * 1024 * 1024
+	}
+
+	c.LogRotateCount = 5
+	if m["log-rotate-count"] != "" {
+		c.LogRotateCount, err = strconv.Atoi(m["log-rotate-count"])
+		if err != nil {
+			return nil, fmt.Errorf("log rotate count is not valid: %s", err)
+		}
+		if c.LogRotateCount < 1 {
+			return nil, fmt.Errorf("log rotate count must be at least 1")
+		}
+	}
+
+	c.EventLogFiles = map[string]string{}
+	for _, category := range logCategories {
+		if m[category+"-log-file"] != "" {
+			c.EventLogFiles[category] = m[category+"-log-file"]
+		}
+	}
+
+	if m["debug-listen"] != "" {
+		if err := checkLoopbackAddress(m["debug-listen"]); err != nil {
+			return nil, fmt.Errorf("debug listen %s", err)
+		}
+		c.DebugListen = m["debug-listen"]
+	}
+
+	if m["api-listen"] != "" {
+		if err := checkLoopbackAddress(m["api-listen"]); err != nil {
+			return nil, fmt.Errorf("API listen %s", err)
+		}
+		if m["api-token"] == "" {
+			return nil, fmt.Errorf("you must set api-token to use api-listen")
+		}
+		c.APIListen = m["api-listen"]
+		c.APIToken = m["api-token"]
+	}
+
+	if m["channel-history-length"] != "" {
+		c.ChannelHistoryLength, err = strconv.Atoi(m["channel-history-length"])
+		if err != nil || c.ChannelHistoryLength < 0 {
+			return nil, fmt.Errorf("channel history length is not valid: %s",
+				m["channel-history-length"])
+		}
+	}
+
+	c.ChannelHistoryTime = 24 * time.Hour
+	if m["channel-history-time"] != "" {
+		c.ChannelHistoryTime, err = time.ParseDuration(m["channel-history-time"])
+		if err != nil {
+			return nil, fmt.Errorf("channel history time is in invalid format: %s",
+				err)
+		}
+	}
+
+	c.ChannelHistoryPlayback = 10
+	if m["channel-history-playback"] != "" {
+		c.ChannelHistoryPlayback, err = strconv.Atoi(
+			m["channel-history-playback"])
+		if err != nil || c.ChannelHistoryPlayback < 0 {
+			return nil, fmt.Errorf("channel history playback is not valid: %s",
+				m["channel-history-playback"])
+		}
+	}
+
+	c.ChannelHistoryFile = m["channel-history-file"]
+
 	c.TS6SID = TS6SID("000")
 
 	if m["ts6-sid"] != "" {
@@ -224,18 +1189,14 @@ func checkAndParseConfig(file string) (*Config, error) {
 
 // Parse the value side of a server definition from the servers config.
 // Format:
-// <hostname>,<port>,<password>,<tls: 1 or 0>
+// <hostname>,<port>,<password>,<tls: 1 or 0>[,<services: 1 or 0>]
 func parseLink(name, s string) (*ServerDefinition, error) {
 	pieces := strings.Split(s, ",")
-	if len(pieces) != 4 {
+	if len(pieces) < 4 || len(pieces) > 8 {
 		return nil, fmt.Errorf("unexpected number of fields")
 	}
 
 	hostname := strings.TrimSpace(pieces[0])
-	if len(hostname) == 0 {
-		return nil, fmt.Errorf("you must specify a hostname")
-	}
-	// We could format check hostname. But when we try to listen we'll fail.
 
 	port, err := strconv.ParseInt(strings.TrimSpace(pieces[1]), 10, 32)
 	if err != nil {
@@ -243,23 +1204,104 @@ func parseLink(name, s string) (*ServerDefinition, error) {
 	}
 
 	pass := strings.TrimSpace(pieces[2])
-	if len(pass) == 0 {
-		return nil, fmt.Errorf("you must specify a password")
+
+	services := false
+	if len(pieces) >= 5 {
+		services = strings.TrimSpace(pieces[4]) == "1"
+	}
+
+	bindAddress := ""
+	if len(pieces) >= 6 {
+		bindAddress = strings.TrimSpace(pieces[5])
+	}
+
+	class := ""
+	if len(pieces) >= 7 {
+		class = strings.TrimSpace(pieces[6])
+	}
+
+	autoConnect := true
+	if len(pieces) == 8 {
+		autoConnect = strings.TrimSpace(pieces[7]) != "0"
+	}
+
+	link := &ServerDefinition{
+		Name:        name,
+		Hostname:    hostname,
+		Port:        int(port),
+		Pass:        pass,
+		TLS:         pieces[3] == "1",
+		Services:    services,
+		BindAddress: bindAddress,
+		Class:       class,
+		AutoConnect: autoConnect,
+	}
+	if err := checkLink(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// checkLink checks a server definition from either config format.
+func checkLink(link *ServerDefinition) error {
+	if len(link.Hostname) == 0 {
+		return fmt.Errorf("you must specify a hostname")
+	}
+	// We could format check hostname. But when we try to connect we'll fail.
+
+	if len(link.Pass) == 0 {
+		return fmt.Errorf("you must specify a password")
 	}
 
-	return &ServerDefinition{
-		Name:     name,
-		Hostname: hostname,
-		Port:     int(port),
-		Pass:     pass,
-		TLS:      pieces[3] == "1",
-	}, nil
+	if link.BindAddress != "" && net.ParseIP(link.BindAddress) == nil {
+		return fmt.Errorf("invalid bind address: %s", link.BindAddress)
+	}
+
+	return nil
+}
+
+// parseSendQueue parses a send queue limit from the config.
+func parseSendQueue(s string) (int, error) {
+	sendQueue, err := strconv.Atoi(s)
+	if err != nil || sendQueue < 1 || sendQueue > MaxSendQueue {
+		return 0, fmt.Errorf("invalid send queue: must be from 1 to %d: %s",
+			MaxSendQueue, s)
+	}
+	return sendQueue, nil
+}
+
+// parseConnectClass parses a connect class config value.
+//
+// Format: <frequency>[,<sendq>]
+//
+// The send queue is 0 if there is none.
+func parseConnectClass(s string) (time.Duration, int, error) {
+	pieces := strings.Split(s, ",")
+	if len(pieces) > 2 {
+		return 0, 0, fmt.Errorf("unexpected number of fields")
+	}
+
+	frequency, err := time.ParseDuration(strings.TrimSpace(pieces[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid frequency: %s", err)
+	}
+
+	sendQueue := 0
+	if len(pieces) == 2 {
+		sendQueue, err = parseSendQueue(strings.TrimSpace(pieces[1]))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return frequency, sendQueue, nil
 }
 
 // Parse the value part of a user config line.
 // This is a comma separated value.
 // A line looks like so:
-// <name> = <user mask>,<host mask>,<flood exempt = 1|0>,<spoof>
+// <name> = <user mask>,<host mask>,<flood exempt = 1|0>,<spoof>[,<sendq>
+// [,<max channels>]]
 //
 // This function takes the portion after the equals sign and parses it.
 //
@@ -270,9 +1312,14 @@ func parseLink(name, s string) (*ServerDefinition, error) {
 // host. If they both match, the user falls under this config.
 //
 // Spoof may be empty.
+//
+// Send queue is optional. Without it (or if it's blank), the user gets
+// user-sendq.
+//
+// Max channels is optional. Without it, the user gets max-channels.
 func parseUserConfig(s string) (UserConfig, error) {
 	piecesUntrimmed := strings.Split(s, ",")
-	if len(piecesUntrimmed) != 4 {
+	if len(piecesUntrimmed) < 4 || len(piecesUntrimmed) > 6 {
 		return UserConfig{}, fmt.Errorf("unexpected number of fields")
 	}
 
@@ -281,32 +1328,293 @@ func parseUserConfig(s string) (UserConfig, error) {
 		pieces = append(pieces, strings.TrimSpace(piece))
 	}
 
-	if !isValidUserMask(pieces[0]) {
-		return UserConfig{}, fmt.Errorf("invalid user mask")
+	if pieces[2] != "1" && pieces[2] != "0" {
+		return UserConfig{}, fmt.Errorf("flood exempt flag must be 1 or 0")
+	}
+
+	uc := UserConfig{
+		UserMask:    pieces[0],
+		HostMask:    pieces[1],
+		FloodExempt: pieces[2] == "1",
+		Spoof:       pieces[3],
+	}
+	if len(pieces) >= 5 && pieces[4] != "" {
+		sendQueue, err := parseSendQueue(pieces[4])
+		if err != nil {
+			return UserConfig{}, err
+		}
+		uc.SendQueue = sendQueue
+	}
+	if len(pieces) == 6 {
+		maxChannels, err := strconv.Atoi(pieces[5])
+		if err != nil || maxChannels < 1 {
+			return UserConfig{}, fmt.Errorf("invalid max channels: %s", pieces[5])
+		}
+		uc.MaxChannels = maxChannels
+	}
+	if err := checkUserConfig(uc); err != nil {
+		return UserConfig{}, err
+	}
+	return uc, nil
+}
+
+// checkUserConfig checks a user config from either config format.
+func checkUserConfig(uc UserConfig) error {
+	if !isValidUserMask(uc.UserMask) {
+		return fmt.Errorf("invalid user mask")
 	}
-	userMask := pieces[0]
 
-	if !isValidHostMask(pieces[1]) {
-		return UserConfig{}, fmt.Errorf("invalid host mask")
+	if !isValidHostMask(uc.HostMask) {
+		return fmt.Errorf("invalid host mask")
 	}
-	hostMask := pieces[1]
 
-	if pieces[2] != "1" && pieces[2] != "0" {
-		return UserConfig{}, fmt.Errorf("flood exempt flag must be 1 or 0")
+	if len(uc.Spoof) > 0 && !isValidHostname(uc.Spoof) {
+		return fmt.Errorf("invalid spoof hostname")
+	}
+
+	// 0 means to use user-sendq.
+	if uc.SendQueue < 0 || uc.SendQueue > MaxSendQueue {
+		return fmt.Errorf("invalid send queue: must be from 1 to %d",
+			MaxSendQueue)
+	}
+
+	// 0 means to use max-channels.
+	if uc.MaxChannels < 0 {
+		return fmt.Errorf("invalid max channels: %d", uc.MaxChannels)
 	}
-	floodExempt := pieces[2] == "1"
 
-	spoof := pieces[3]
-	if len(spoof) > 0 {
-		if !isValidHostname(spoof) {
-			return UserConfig{}, fmt.Errorf("invalid spoof hostname")
+	return nil
+}
+
+// Parse an oper config line.
+//
+// Format: <password>[,<user@host masks>[,<require TLS = 1|0>[,<certfp>]]]
+//
+// Masks are separated by spaces. If there are none, the operator may OPER from
+// anywhere.
+//
+// The password may be blank if there is a certificate fingerprint.
+//
+// We don't show the value in errors since it has the password.
+func parseOperConfig(s string) (*OperConfig, error) {
+	pieces := strings.Split(s, ",")
+	if len(pieces) > 4 {
+		return nil, fmt.Errorf("unexpected number of fields")
+	}
+
+	oc := &OperConfig{Password: strings.TrimSpace(pieces[0])}
+
+	if len(pieces) == 4 {
+		oc.CertFP = strings.ToLower(strings.TrimSpace(pieces[3]))
+	}
+
+	if len(pieces) >= 2 {
+		oc.Masks = append(oc.Masks, strings.Fields(pieces[1])...)
+	}
+
+	if len(pieces) >= 3 {
+		tls := strings.TrimSpace(pieces[2])
+		if tls != "1" && tls != "0" {
+			return nil, fmt.Errorf("require TLS flag must be 1 or 0")
+		}
+		oc.RequireTLS = tls == "1"
+	}
+
+	if err := checkOperConfig(oc); err != nil {
+		return nil, err
+	}
+	return oc, nil
+}
+
+// checkOperConfig checks an oper config from either config format.
+func checkOperConfig(oc *OperConfig) error {
+	if oc.CertFP != "" && !isValidCertFP(oc.CertFP) {
+		return fmt.Errorf("invalid certificate fingerprint: %s", oc.CertFP)
+	}
+
+	if len(oc.Password) == 0 && oc.CertFP == "" {
+		return fmt.Errorf("missing password")
+	}
+
+	for _, mask := range oc.Masks {
+		if !isValidUserHostMask(mask) {
+			return fmt.Errorf("invalid mask: %s", mask)
 		}
 	}
 
-	return UserConfig{
-		UserMask:    userMask,
-		HostMask:    hostMask,
-		FloodExempt: floodExempt,
-		Spoof:       spoof,
-	}, nil
+	return nil
+}
+
+// isValidCertFP checks a TLS client certificate fingerprint is a lowercase
+// hex SHA-256 one.
+func isValidCertFP(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha256.Size*2 && s == strings.ToLower(s)
+}
+
+// isValidUserHostMask checks a user@host mask.
+func isValidUserHostMask(s string) bool {
+	idx := strings.Index(s, "@")
+	return idx != -1 && isValidUserMask(s[:idx]) && isValidHostMask(s[idx+1:])
+}
+
+// Parse a vhost config line.
+//
+// Format: <account|certfp>,<account name or fingerprint>,<vhost>
+func parseVhostConfig(s string) (VhostConfig, error) {
+	piecesUntrimmed := strings.Split(s, ",")
+	if len(piecesUntrimmed) != 3 {
+		return VhostConfig{}, fmt.Errorf("unexpected number of fields")
+	}
+
+	pieces := []string{}
+	for _, piece := range piecesUntrimmed {
+		pieces = append(pieces, strings.TrimSpace(piece))
+	}
+
+	if len(pieces[1]) == 0 {
+		return VhostConfig{}, fmt.Errorf("missing %s", pieces[0])
+	}
+
+	vc := VhostConfig{Vhost: pieces[2]}
+	switch pieces[0] {
+	case "account":
+		vc.Account = pieces[1]
+	case "certfp":
+		vc.CertFP = strings.ToLower(pieces[1])
+	default:
+		return VhostConfig{}, fmt.Errorf("type must be account or certfp")
+	}
+
+	if err := checkVhostConfig(vc); err != nil {
+		return VhostConfig{}, err
+	}
+	return vc, nil
+}
+
+// checkVhostConfig checks a vhost config from either config format.
+func checkVhostConfig(vc VhostConfig) error {
+	if (vc.Account == "") == (vc.CertFP == "") {
+		return fmt.Errorf("you must specify one of account and certfp")
+	}
+
+	if !isValidVhost(vc.Vhost) {
+		return fmt.Errorf("invalid vhost")
+	}
+
+	return nil
+}
+
+// Parse a certificate config line.
+//
+// Format: <certificate file>,<key file>
+func parseCertificateConfig(s string) (CertificateConfig, error) {
+	pieces := strings.Split(s, ",")
+	if len(pieces) != 2 {
+		return CertificateConfig{}, fmt.Errorf("unexpected number of fields")
+	}
+
+	cc := CertificateConfig{
+		CertificateFile: strings.TrimSpace(pieces[0]),
+		KeyFile:         strings.TrimSpace(pieces[1]),
+	}
+	if err := checkCertificateConfig(cc); err != nil {
+		return CertificateConfig{}, err
+	}
+	return cc, nil
+}
+
+// checkCertificateConfig checks a certificate config from either config
+// format.
+func checkCertificateConfig(cc CertificateConfig) error {
+	if cc.CertificateFile == "" || cc.KeyFile == "" {
+		return fmt.Errorf("you must specify a certificate and a key")
+	}
+	return nil
+}
+
+// Parse an exempt config line.
+//
+// Format: <mask|certfp>,<user@host or fingerprint>
+func parseExemptConfig(s string) (ExemptConfig, error) {
+	pieces := strings.Split(s, ",")
+	if len(pieces) != 2 {
+		return ExemptConfig{}, fmt.Errorf("unexpected number of fields")
+	}
+
+	value := strings.TrimSpace(pieces[1])
+
+	switch strings.TrimSpace(pieces[0]) {
+	case "mask":
+		return parseExemptMask(value)
+	case "certfp":
+		certFP := strings.ToLower(value)
+		if !isValidCertFP(certFP) {
+			return ExemptConfig{}, fmt.Errorf(
+				"invalid certificate fingerprint: %s", certFP)
+		}
+		return ExemptConfig{CertFP: certFP}, nil
+	default:
+		return ExemptConfig{}, fmt.Errorf("type must be mask or certfp")
+	}
+}
+
+// parseExemptMask makes an exempt config from a user@host mask.
+func parseExemptMask(mask string) (ExemptConfig, error) {
+	if !isValidUserHostMask(mask) {
+		return ExemptConfig{}, fmt.Errorf("invalid mask: %s", mask)
+	}
+	idx := strings.Index(mask, "@")
+	return ExemptConfig{UserMask: mask[:idx], HostMask: mask[idx+1:]}, nil
+}
+
+// Parse a reserve config line.
+//
+// Format: <nick or channel mask>[,<reason>]
+func parseReserveConfig(s string) (ReserveConfig, error) {
+	pieces := strings.SplitN(s, ",", 2)
+
+	rc := ReserveConfig{Mask: strings.TrimSpace(pieces[0])}
+	if len(pieces) == 2 {
+		rc.Reason = strings.TrimSpace(pieces[1])
+	}
+
+	if err := checkReserveConfig(rc); err != nil {
+		return ReserveConfig{}, err
+	}
+	return rc, nil
+}
+
+// checkReserveConfig checks a reserve config from either config format.
+func checkReserveConfig(rc ReserveConfig) error {
+	if rc.Mask == "" || strings.ContainsAny(rc.Mask, " ,") {
+		return fmt.Errorf("invalid mask: %s", rc.Mask)
+	}
+	return nil
+}
+
+// Parse a spamfilter config line.
+//
+// Format: <text mask>[,<reason>]
+func parseSpamFilterConfig(s string) (SpamFilterConfig, error) {
+	pieces := strings.SplitN(s, ",", 2)
+
+	sc := SpamFilterConfig{Mask: strings.TrimSpace(pieces[0])}
+	if len(pieces) == 2 {
+		sc.Reason = strings.TrimSpace(pieces[1])
+	}
+
+	if err := checkSpamFilterConfig(sc); err != nil {
+		return SpamFilterConfig{}, err
+	}
+	return sc, nil
+}
+
+// checkSpamFilterConfig checks a spamfilter config from either config format.
+func checkSpamFilterConfig(sc SpamFilterConfig) error {
+	// A mask of only wildcards would block everything.
+	if strings.Trim(sc.Mask, "*? ") == "" || strings.Contains(sc.Mask, ",") {
+		return fmt.Errorf("invalid mask: %s", sc.Mask)
+	}
+	return nil
 }
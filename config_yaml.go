@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlConfig is the YAML config format.
+//
+// The blocks the flat format keeps in separate files (opers, servers, users,
+// and so on) are sections. Other options are at the top level with the same
+// names as in the flat format.
+type yamlConfig struct {
+	Listeners      *yamlListeners             `yaml:"listeners"`
+	Network        *yamlNetwork               `yaml:"network"`
+	Opers          map[string]yamlOper        `yaml:"opers"`
+	Classes        map[string]yamlClass       `yaml:"classes"`
+	ConnectClasses map[string]string          `yaml:"connect-classes"`
+	Links          map[string]yamlLink        `yaml:"links"`
+	Vhosts         map[string]yamlVhost       `yaml:"vhosts"`
+	Exempts        map[string]yamlExempt      `yaml:"exempts"`
+	Reserves       map[string]yamlReserve     `yaml:"reserves"`
+	SpamFilters    map[string]yamlSpamFilter  `yaml:"spamfilters"`
+	Certificates   map[string]yamlCertificate `yaml:"certificates"`
+
+	// Everything else. These are options from the flat format. We take values
+	// as written, e.g., 000 stays 000 rather than becoming 0.
+	Options map[string]string `yaml:",inline"`
+}
+
+type yamlListeners struct {
+	Host        string `yaml:"host"`
+	Port        string `yaml:"port"`
+	PortTLS     string `yaml:"port-tls"`
+	HostTor     string `yaml:"host-tor"`
+	PortTor     string `yaml:"port-tor"`
+	HostServers string `yaml:"host-servers"`
+	PortServers string `yaml:"port-servers"`
+}
+
+type yamlNetwork struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Admin       string `yaml:"admin"`
+}
+
+type yamlOper struct {
+	Password   string   `yaml:"password"`
+	Masks      []string `yaml:"masks"`
+	RequireTLS bool     `yaml:"require-tls"`
+	CertFP     string   `yaml:"certfp"`
+}
+
+// yamlClass is a block from the flat format's users config.
+type yamlClass struct {
+	UserMask    string `yaml:"user-mask"`
+	HostMask    string `yaml:"host-mask"`
+	FloodExempt bool   `yaml:"flood-exempt"`
+	Spoof       string `yaml:"spoof"`
+	SendQueue   int    `yaml:"sendq"`
+	MaxChannels int    `yaml:"max-channels"`
+}
+
+type yamlLink struct {
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	Password    string `yaml:"password"`
+	TLS         bool   `yaml:"tls"`
+	Services    bool   `yaml:"services"`
+	BindAddress string `yaml:"bind-address"`
+	Class       string `yaml:"class"`
+	AutoConnect *bool  `yaml:"auto-connect"`
+}
+
+type yamlVhost struct {
+	Account string `yaml:"account"`
+	CertFP  string `yaml:"certfp"`
+	Vhost   string `yaml:"vhost"`
+}
+
+type yamlExempt struct {
+	Mask   string `yaml:"mask"`
+	CertFP string `yaml:"certfp"`
+}
+
+type yamlReserve struct {
+	Mask   string `yaml:"mask"`
+	Reason string `yaml:"reason"`
+}
+
+type yamlSpamFilter struct {
+	Mask   string `yaml:"mask"`
+	Reason string `yaml:"reason"`
+}
+
+type yamlCertificate struct {
+	CertificateFile string `yaml:"certificate-file"`
+	KeyFile         string `yaml:"key-file"`
+}
+
+// yamlSectionOptions are the flat format's options for files holding blocks
+// the YAML format has sections for.
+var yamlSectionOptions = map[string]string{
+	"opers-config":           "opers",
+	"users-config":           "classes",
+	"connect-classes-config": "connect-classes",
+	"servers-config":         "links",
+	"vhosts-config":          "vhosts",
+	"exempts-config":         "exempts",
+	"reserves-config":        "reserves",
+	"spamfilters-config":     "spamfilters",
+	"certificates-config":    "certificates",
+}
+
+// yamlListenerOptions are the flat format's options the listeners section
+// has.
+var yamlListenerOptions = []string{"listen-host", "listen-port",
+	"listen-port-tls", "listen-host-tor", "listen-port-tor",
+	"listen-host-servers", "listen-port-servers"}
+
+// yamlNetworkOptions are the flat format's options the network section has.
+var yamlNetworkOptions = []string{"network-name", "network-description",
+	"network-admin"}
+
+// isYAMLConfig decides whether a config file is in the YAML format by its
+// name.
+func isYAMLConfig(file string) bool {
+	ext := filepath.Ext(file)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// configOptions finds the names of the flat format's options. The example
+// config documents all of them.
+func configOptions() map[string]struct{} {
+	options := map[string]struct{}{}
+	re := regexp.MustCompile(`(?m)^#?([a-z0-9-]+) =`)
+	for _, match := range re.FindAllStringSubmatch(exampleConfig, -1) {
+		options[match[1]] = struct{}{}
+	}
+	return options
+}
+
+// checkAndParseYAMLConfig parses a config in the YAML format.
+//
+// We parse the top level options the same way as the flat format. We then
+// fill in the sections.
+func checkAndParseYAMLConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var yc yamlConfig
+	if err := yaml.UnmarshalStrict(data, &yc); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	m, err := yamlOptions(yc)
+	if err != nil {
+		return nil, err
+	}
+
+	// The policy config refers to classes, so we parse it once we have them.
+	policyFile := m["policy-config"]
+	delete(m, "policy-config")
+
+	c, err := parseConfig(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yc.apply(c); err != nil {
+		return nil, err
+	}
+
+	if policyFile != "" {
+		rules, err := parsePolicyConfig(policyFile, c.UserConfigs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load policy config: %s", err)
+		}
+		c.PolicyRules = rules
+	}
+
+	return c, nil
+}
+
+// yamlOptions collects the top level options into the flat format's form.
+func yamlOptions(yc yamlConfig) (map[string]string, error) {
+	known := configOptions()
+
+	m := map[string]string{}
+	for name, value := range yc.Options {
+		if _, exists := known[name]; !exists {
+			return nil, fmt.Errorf("unknown option: %s", name)
+		}
+		if section, exists := yamlSectionOptions[name]; exists {
+			return nil, fmt.Errorf("%s: use the %s section instead", name, section)
+		}
+		m[name] = value
+	}
+
+	if yc.Listeners != nil {
+		for _, name := range yamlListenerOptions {
+			if _, exists := m[name]; exists {
+				return nil, fmt.Errorf("%s: use the listeners section instead", name)
+			}
+		}
+		l := yc.Listeners
+		for name, value := range map[string]string{
+			"listen-host":         l.Host,
+			"listen-port":         l.Port,
+			"listen-port-tls":     l.PortTLS,
+			"listen-host-tor":     l.HostTor,
+			"listen-port-tor":     l.PortTor,
+			"listen-host-servers": l.HostServers,
+			"listen-port-servers": l.PortServers,
+		} {
+			if value != "" {
+				m[name] = value
+			}
+		}
+	}
+
+	if yc.Network != nil {
+		for _, name := range yamlNetworkOptions {
+			if _, exists := m[name]; exists {
+				return nil, fmt.Errorf("%s: use the network section instead", name)
+			}
+		}
+		n := yc.Network
+		for name, value := range map[string]string{
+			"network-name":        n.Name,
+			"network-description": n.Description,
+			"network-admin":       n.Admin,
+		} {
+			if value != "" {
+				m[name] = value
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// apply fills in the config from the sections. It checks each block as the
+// flat format does.
+func (yc yamlConfig) apply(c *Config) error {
+	for _, name := range sortedKeys(yc.Opers) {
+		o := yc.Opers[name]
+		oc := &OperConfig{
+			Name:       name,
+			Password:   o.Password,
+			Masks:      o.Masks,
+			RequireTLS: o.RequireTLS,
+			CertFP:     strings.ToLower(o.CertFP),
+		}
+		if err := checkOperConfig(oc); err != nil {
+			return fmt.Errorf("opers: %s: %s", name, err)
+		}
+		c.Opers[name] = oc
+	}
+
+	for _, name := range sortedKeys(yc.ConnectClasses) {
+		frequency, sendQueue, err := parseConnectClass(yc.ConnectClasses[name])
+		if err != nil {
+			return fmt.Errorf("connect-classes: %s: %s", name, err)
+		}
+		c.ConnectClasses[name] = frequency
+		if sendQueue > 0 {
+			c.ConnectClassSendQueues[name] = sendQueue
+		}
+	}
+
+	for _, name := range sortedKeys(yc.Links) {
+		l := yc.Links[name]
+		link := &ServerDefinition{
+			Name:        name,
+			Hostname:    l.Host,
+			Port:        l.Port,
+			Pass:        l.Password,
+			TLS:         l.TLS,
+			Services:    l.Services,
+			BindAddress: l.BindAddress,
+			Class:       l.Class,
+			AutoConnect: l.AutoConnect == nil || *l.AutoConnect,
+		}
+		if err := checkLink(link); err != nil {
+			return fmt.Errorf("links: %s: %s", name, err)
+		}
+		if _, exists := c.ConnectClasses[link.Class]; link.Class != "" &&
+			!exists {
+			return fmt.Errorf("links: %s: unknown connect class: %s", name,
+				link.Class)
+		}
+		c.Servers[name] = link
+	}
+
+	// The first class a user matches applies, so the order matters. We go by
+	// name.
+	for _, name := range sortedKeys(yc.Classes) {
+		class := yc.Classes[name]
+		uc := UserConfig{
+			Name:        name,
+			UserMask:    class.UserMask,
+			HostMask:    class.HostMask,
+			FloodExempt: class.FloodExempt,
+			Spoof:       class.Spoof,
+			SendQueue:   class.SendQueue,
+			MaxChannels: class.MaxChannels,
+		}
+		if err := checkUserConfig(uc); err != nil {
+			return fmt.Errorf("classes: %s: %s", name, err)
+		}
+		c.UserConfigs = append(c.UserConfigs, uc)
+	}
+
+	for _, name := range sortedKeys(yc.Vhosts) {
+		v := yc.Vhosts[name]
+		vc := VhostConfig{
+			Name:    name,
+			Account: v.Account,
+			CertFP:  strings.ToLower(v.CertFP),
+			Vhost:   v.Vhost,
+		}
+		if err := checkVhostConfig(vc); err != nil {
+			return fmt.Errorf("vhosts: %s: %s", name, err)
+		}
+		if vc.CertFP != "" && !isValidCertFP(vc.CertFP) {
+			return fmt.Errorf("vhosts: %s: invalid certificate fingerprint: %s",
+				name, vc.CertFP)
+		}
+		c.VhostConfigs = append(c.VhostConfigs, vc)
+	}
+
+	for _, name := range sortedKeys(yc.Exempts) {
+		e := yc.Exempts[name]
+		var ec ExemptConfig
+		switch {
+		case e.Mask != "" && e.CertFP == "":
+			var err error
+			ec, err = parseExemptMask(e.Mask)
+			if err != nil {
+				return fmt.Errorf("exempts: %s: %s", name, err)
+			}
+		case e.Mask == "" && e.CertFP != "":
+			ec.CertFP = strings.ToLower(e.CertFP)
+			if !isValidCertFP(ec.CertFP) {
+				return fmt.Errorf("exempts: %s: invalid certificate fingerprint: %s",
+					name, e.CertFP)
+			}
+		default:
+			return fmt.Errorf("exempts: %s: you must specify one of mask and certfp",
+				name)
+		}
+		ec.Name = name
+		c.ExemptConfigs = append(c.ExemptConfigs, ec)
+	}
+
+	for _, name := range sortedKeys(yc.Reserves) {
+		r := yc.Reserves[name]
+		rc := ReserveConfig{Name: name, Mask: r.Mask, Reason: r.Reason}
+		if err := checkReserveConfig(rc); err != nil {
+			return fmt.Errorf("reserves: %s: %s", name, err)
+		}
+		c.ReserveConfigs = append(c.ReserveConfigs, rc)
+	}
+
+	for _, name := range sortedKeys(yc.SpamFilters) {
+		f := yc.SpamFilters[name]
+		sc := SpamFilterConfig{Name: name, Mask: f.Mask, Reason: f.Reason}
+		if err := checkSpamFilterConfig(sc); err != nil {
+			return fmt.Errorf("spamfilters: %s: %s", name, err)
+		}
+		c.SpamFilterConfigs = append(c.SpamFilterConfigs, sc)
+	}
+
+	for _, name := range sortedKeys(yc.Certificates) {
+		cert := yc.Certificates[name]
+		cc := CertificateConfig{
+			Name:            name,
+			CertificateFile: cert.CertificateFile,
+			KeyFile:         cert.KeyFile,
+		}
+		if err := checkCertificateConfig(cc); err != nil {
+			return fmt.Errorf("certificates: %s: %s", name, err)
+		}
+		c.CertificateConfigs = append(c.CertificateConfigs, cc)
+	}
+
+	return nil
+}
+
+// sortedKeys gives the keys of a section in order so we check (and report
+// problems with) blocks in a stable order.
+func sortedKeys(section interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(section).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Desync is a problem we found with our state. e.g., a channel member we don't
+// know about.
+//
+// Long lived networks accumulate problems like these, typically from bugs
+// (ours or other servers') in handling races.
+type Desync struct {
+	// Human readable description of the problem.
+	Description string
+
+	// Repair fixes the problem in our state. It only changes our records and
+	// tells our local users what they need to know. It does not tell other
+	// servers anything.
+	Repair func()
+}
+
+// checkConsistency cross-checks our state for problems. It checks that:
+//
+// - Every channel member exists, and knows it is on the channel.
+// - Every channel op is a member of the channel.
+// - Every channel has members.
+// - Every channel a user is on exists and has the user as a member.
+// - Every remote user's server exists. Every local user is registered locally.
+// - The Nicks map matches users' nicks.
+// - Every remote server's uplink exists.
+//
+// We return problems sorted by description so that reports are stable.
+func (cb *Catbox) checkConsistency() []Desync {
+	var problems []Desync
+
+	for _, channel := range cb.Channels {
+		channel := channel
+
+		for uid := range channel.Members {
+			uid := uid
+
+			user, exists := cb.Users[uid]
+			if !exists {
+				problems = append(problems, Desync{
+					Description: fmt.Sprintf("Channel %s has unknown member %s",
+						channel.Name, uid),
+					Repair: func() {
+						delete(channel.Members, uid)
+						delete(channel.Ops, uid)
+					},
+				})
+				continue
+			}
+
+			if _, exists := user.Channels[channel.Name]; !exists {
+				problems = append(problems, Desync{
+					Description: fmt.Sprintf(
+						"Channel %s has member %s but they don't know they're on it",
+						channel.Name, user.DisplayNick),
+					Repair: func() {
+						user.Channels[channel.Name] = channel
+					},
+				})
+			}
+		}
+
+		for uid := range channel.Ops {
+			uid := uid
+
+			if _, exists := channel.Members[uid]; !exists {
+				problems = append(problems, Desync{
+					Description: fmt.Sprintf("Channel %s has op %s who is not a member",
+						channel.Name, uid),
+					Repair: func() {
+						delete(channel.Ops, uid)
+					},
+				})
+			}
+		}
+
+		if len(channel.Members) == 0 {
+			problems = append(problems, Desync{
+				Description: fmt.Sprintf("Channel %s has no members", channel.Name),
+				Repair: func() {
+					if len(channel.Members) == 0 {
+						delete(cb.Channels, channel.Name)
+					}
+				},
+			})
+		}
+	}
+
+	for _, user := range cb.Users {
+		user := user
+
+		for name, channel := range user.Channels {
+			name := name
+
+			realChannel, exists := cb.Channels[name]
+			if !exists || realChannel != channel {
+				problems = append(problems, Desync{
+					Description: fmt.Sprintf("User %s is on unknown channel %s",
+						user.DisplayNick, name),
+					Repair: func() {
+						delete(user.Channels, name)
+					},
+				})
+				continue
+			}
+
+			if _, exists := channel.Members[user.UID]; !exists {
+				problems = append(problems, Desync{
+					Description: fmt.Sprintf(
+						"User %s thinks they're on channel %s but are not a member",
+						user.DisplayNick, name),
+					Repair: func() {
+						delete(user.Channels, name)
+					},
+				})
+			}
+		}
+
+		if user.isLocal() {
+			if _, exists := cb.LocalUsers[user.LocalUser.ID]; !exists {
+				problems = append(problems, Desync{
+					Description: fmt.Sprintf("Local user %s is not registered locally",
+						user.DisplayNick),
+					Repair: func() {
+						user.LocalUser.quit("Lost track of you", true)
+					},
+				})
+			}
+		} else {
+			if user.Server == nil || cb.Servers[user.Server.SID] != user.Server {
+				problems = append(problems, Desync{
+					Description: fmt.Sprintf("User %s is on an unknown server",
+						user.DisplayNick),
+					Repair: func() {
+						cb.quitRemoteUser(user, "*.net *.split")
+					},
+				})
+			}
+		}
+
+		uid, exists := cb.Nicks[canonicalizeNick(user.DisplayNick)]
+		if !exists {
+			problems = append(problems, Desync{
+				Description: fmt.Sprintf("User %s is missing from the nick map",
+					user.DisplayNick),
+				Repair: func() {
+					nick := canonicalizeNick(user.DisplayNick)
+					if _, exists := cb.Nicks[nick]; !exists {
+						cb.Nicks[nick] = user.UID
+					}
+				},
+			})
+		} else if uid != user.UID {
+			problems = append(problems, Desync{
+				Description: fmt.Sprintf(
+					"User %s (%s) has their nick mapped to a different user (%s)",
+					user.DisplayNick, user.UID, uid),
+				// This is a collision we can't decide on alone.
+				Repair: func() {},
+			})
+		}
+	}
+
+	for nick, uid := range cb.Nicks {
+		nick := nick
+
+		user, exists := cb.Users[uid]
+		if !exists {
+			problems = append(problems, Desync{
+				Description: fmt.Sprintf("Nick %s maps to unknown user %s", nick, uid),
+				Repair: func() {
+					delete(cb.Nicks, nick)
+				},
+			})
+			continue
+		}
+
+		if canonicalizeNick(user.DisplayNick) != nick {
+			problems = append(problems, Desync{
+				Description: fmt.Sprintf("Nick %s maps to user %s whose nick is %s",
+					nick, uid, user.DisplayNick),
+				Repair: func() {
+					delete(cb.Nicks, nick)
+				},
+			})
+		}
+	}
+
+	for _, server := range cb.Servers {
+		if server.isLocal() {
+			continue
+		}
+
+		if server.LinkedTo == nil || (server.LinkedTo.SID != cb.Config.TS6SID &&
+			cb.Servers[server.LinkedTo.SID] != server.LinkedTo) {
+			problems = append(problems, Desync{
+				Description: fmt.Sprintf("Server %s is linked to an unknown server",
+					server.Name),
+				// Resolving this needs a relink.
+				Repair: func() {},
+			})
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Description < problems[j].Description
+	})
+
+	return problems
+}
+
+// Periodically check our state for problems and tell operators about any.
+func (cb *Catbox) periodicConsistencyCheck() {
+	if cb.Config.ConsistencyCheckTime <= 0 {
+		return
+	}
+
+	if time.Since(cb.LastConsistencyCheck) < cb.Config.ConsistencyCheckTime {
+		return
+	}
+	cb.LastConsistencyCheck = time.Now()
+
+	problems := cb.checkConsistency()
+	if len(problems) == 0 {
+		return
+	}
+
+	cb.noticeLocalOpers(fmt.Sprintf(
+		"Consistency check found %d problem(s). Use RESYNC to see them.",
+		len(problems)))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writePIDFile records our process ID for init scripts.
+//
+// If the file names another process still running, we refuse to start. It's
+// likely another catbox using the same file. A stale file we overwrite.
+func writePIDFile(file string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err == nil && pid != os.Getpid() && processExists(pid) {
+			return fmt.Errorf("pid file %s names a running process: %d", file, pid)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error reading pid file: %s", err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(fmt.Sprintf("%d\n", os.Getpid())),
+		0644); err != nil {
+		return fmt.Errorf("error writing pid file: %s", err)
+	}
+	return nil
+}
+
+// processExists checks whether there is a process with the ID.
+func processExists(pid int) bool {
+	// Signal 0 checks the process exists without signalling it. EPERM means it
+	// exists but isn't ours.
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// removePIDFile removes our pid file when we exit. We leave it if it no
+// longer names us.
+func removePIDFile(file string) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		coreLog.Warnf("Error reading pid file: %s", err)
+		return
+	}
+	if strings.TrimSpace(string(buf)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(file); err != nil {
+		coreLog.Warnf("Error removing pid file: %s", err)
+	}
+}
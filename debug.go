@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// debugState summarizes our state for diagnosing problems such as leaks.
+type debugState struct {
+	LocalClients   int `json:"local_clients"`
+	LocalUsers     int `json:"local_users"`
+	LocalServers   int `json:"local_servers"`
+	Users          int `json:"users"`
+	Servers        int `json:"servers"`
+	Channels       int `json:"channels"`
+	Opers          int `json:"opers"`
+	KLines         int `json:"klines"`
+	PropagatedBans int `json:"propagated_bans"`
+
+	// Messages from users we're holding back for flood control.
+	QueuedMessages int `json:"queued_messages"`
+
+	Goroutines int `json:"goroutines"`
+}
+
+// checkLoopbackAddress checks an address to listen on (host:port) is a
+// loopback address. We don't want to serve things like the profiler to the
+// world.
+func checkLoopbackAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("address is invalid: %s", err)
+	}
+	if port == "" {
+		return fmt.Errorf("address is missing a port: %s", address)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("address must be a loopback address: %s", address)
+	}
+	return nil
+}
+
+// startDebugServer starts serving pprof and /debug/state on the debug-listen
+// address. shutdown() stops it.
+func (cb *Catbox) startDebugServer() error {
+	ln, err := net.Listen("tcp", cb.Config.DebugListen)
+	if err != nil {
+		return fmt.Errorf("unable to listen (debug): %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/state", cb.serveDebugState)
+
+	cb.DebugServer = &http.Server{Handler: mux}
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		if err := cb.DebugServer.Serve(ln); err != http.ErrServerClosed {
+			coreLog.Errorf("Debug listener failed: %s", err)
+		}
+		coreLog.Debugf("Debug listener shutting down.")
+	}()
+
+	coreLog.Infof("Serving debug information on %s", ln.Addr())
+	return nil
+}
+
+// serveDebugState responds with a JSON summary of our state.
+//
+// The server goroutine owns our state, so we ask it. If it doesn't answer
+// quickly we say so. That's worth knowing too: It may be stuck.
+func (cb *Catbox) serveDebugState(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan debugState, 1)
+	cb.newEvent(Event{Type: DebugStateEvent, DebugStateChan: ch})
+
+	var state debugState
+	select {
+	case state = <-ch:
+	case <-time.After(5 * time.Second):
+		http.Error(w, "server goroutine did not respond",
+			http.StatusServiceUnavailable)
+		return
+	case <-cb.ShutdownChan:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(buf, '\n'))
+}
+
+// debugState summarizes our state. Only the server goroutine may call this.
+func (cb *Catbox) debugState() debugState {
+	queued := 0
+	for _, lu := range cb.LocalUsers {
+		queued += len(lu.MessageQueue)
+	}
+
+	return debugState{
+		LocalClients:   len(cb.LocalClients),
+		LocalUsers:     len(cb.LocalUsers),
+		LocalServers:   len(cb.LocalServers),
+		Users:          len(cb.Users),
+		Servers:        len(cb.Servers),
+		Channels:       len(cb.Channels),
+		Opers:          len(cb.Opers),
+		KLines:         len(cb.KLines),
+		PropagatedBans: len(cb.PropagatedBans),
+		QueuedMessages: queued,
+		Goroutines:     runtime.NumGoroutine(),
+	}
+}
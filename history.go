@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// HistoryMessage is a PRIVMSG or NOTICE to a channel that we remember.
+type HistoryMessage struct {
+	Time time.Time
+
+	// nick!user@host or a server name.
+	Source string
+
+	// PRIVMSG or NOTICE.
+	Command string
+
+	Text string
+}
+
+// ChannelHistory holds recent messages to channels.
+//
+// We remember messages we deliver, whether they came from our users or from
+// other servers. Each server keeps its own history. Servers don't share it.
+type ChannelHistory struct {
+	// Canonical channel name to its messages. Oldest first.
+	Channels map[string][]HistoryMessage
+}
+
+// How often we expire old history and save it.
+const historySaveTime = 5 * time.Minute
+
+// How we show times in history (server-time and CHATHISTORY).
+const historyTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// loadChannelHistory reads history we saved. If there is none, we start fresh.
+func loadChannelHistory(store Store, name string) (*ChannelHistory, error) {
+	h := &ChannelHistory{Channels: map[string][]HistoryMessage{}}
+
+	if name == "" {
+		return h, nil
+	}
+
+	if _, err := store.Load(name, h); err != nil {
+		return nil, fmt.Errorf("unable to load channel history: %s", err)
+	}
+	if h.Channels == nil {
+		h.Channels = map[string][]HistoryMessage{}
+	}
+
+	return h, nil
+}
+
+// save saves the history under the name.
+func (h *ChannelHistory) save(store Store, name string) error {
+	return store.Save(name, h)
+}
+
+// add remembers a message to the channel. We keep at most max messages for
+// each channel.
+func (h *ChannelHistory) add(channel string, m HistoryMessage, max int) {
+	messages := append(h.Channels[channel], m)
+	if len(messages) > max {
+		messages = append([]HistoryMessage(nil), messages[len(messages)-max:]...)
+	}
+	h.Channels[channel] = messages
+}
+
+// expire forgets messages older than maxAge, and more than max messages for
+// any channel.
+func (h *ChannelHistory) expire(now time.Time, maxAge time.Duration,
+	max int) {
+	cutoff := now.Add(-maxAge)
+	for channel, messages := range h.Channels {
+		start := sort.Search(len(messages), func(i int) bool {
+			return messages[i].Time.After(cutoff)
+		})
+		if len(messages)-start > max {
+			start = len(messages) - max
+		}
+		if start == len(messages) {
+			delete(h.Channels, channel)
+			continue
+		}
+		if start > 0 {
+			h.Channels[channel] = append([]HistoryMessage(nil), messages[start:]...)
+		}
+	}
+}
+
+// channelHistory returns the messages to the channel that we may show. A
+// channel with the same name may have existed before, so we show only messages
+// from after this one's creation (its TS).
+func (cb *Catbox) channelHistory(channel *Channel) []HistoryMessage {
+	messages := cb.History.Channels[channel.Name]
+	return messages[historyAtOrAfter(messages, time.Unix(channel.TS, 0)):]
+}
+
+// historyAfter returns the index of the first message after t.
+func historyAfter(messages []HistoryMessage, t time.Time) int {
+	return sort.Search(len(messages), func(i int) bool {
+		return messages[i].Time.After(t)
+	})
+}
+
+// historyAtOrAfter returns the index of the first message at t or after it.
+func historyAtOrAfter(messages []HistoryMessage, t time.Time) int {
+	return sort.Search(len(messages), func(i int) bool {
+		return !messages[i].Time.Before(t)
+	})
+}
+
+// latestHistory returns the newest limit messages after t. If t is zero, it
+// returns the newest limit messages.
+func latestHistory(messages []HistoryMessage, t time.Time,
+	limit int) []HistoryMessage {
+	start := 0
+	if !t.IsZero() {
+		start = historyAfter(messages, t)
+	}
+	if len(messages)-start > limit {
+		start = len(messages) - limit
+	}
+	return messages[start:]
+}
+
+// historyBefore returns the limit messages closest to t that are before it.
+func historyBefore(messages []HistoryMessage, t time.Time,
+	limit int) []HistoryMessage {
+	end := historyAtOrAfter(messages, t)
+	start := 0
+	if end > limit {
+		start = end - limit
+	}
+	return messages[start:end]
+}
+
+// historySince returns the limit messages closest to t that are after it.
+func historySince(messages []HistoryMessage, t time.Time,
+	limit int) []HistoryMessage {
+	start := historyAfter(messages, t)
+	end := len(messages)
+	if end-start > limit {
+		end = start + limit
+	}
+	return messages[start:end]
+}
+
+// historyAround returns limit messages around t. Half are before it.
+func historyAround(messages []HistoryMessage, t time.Time,
+	limit int) []HistoryMessage {
+	before := historyBefore(messages, t, limit/2)
+	start := historyAtOrAfter(messages, t) - len(before)
+	end := start + limit
+	if end > len(messages) {
+		end = len(messages)
+	}
+	return messages[start:end]
+}
+
+// historyBetween returns up to limit messages between from and to. We start
+// from from, so if it is after to, these are the newest of them.
+func historyBetween(messages []HistoryMessage, from, to time.Time,
+	limit int) []HistoryMessage {
+	if from.After(to) {
+		return latestHistory(historyBefore(messages, from, len(messages)), to,
+			limit)
+	}
+	return historySince(historyBefore(messages, to, len(messages)), from, limit)
+}
+
+// historyRecordStage remembers messages to channels.
+func (cb *Catbox) historyRecordStage(d *Delivery) {
+	if d.Channel == nil || d.SkipLocal || cb.Config.ChannelHistoryLength == 0 {
+		return
+	}
+
+	cb.History.add(d.Channel.Name, HistoryMessage{
+		Time:    time.Now().UTC(),
+		Source:  d.SourceName,
+		Command: d.Command,
+		Text:    d.Text,
+	}, cb.Config.ChannelHistoryLength)
+}
+
+// updateChannelHistory expires old history and saves it periodically.
+func (cb *Catbox) updateChannelHistory() {
+	if time.Since(cb.LastHistorySave) < historySaveTime {
+		return
+	}
+
+	cb.History.expire(time.Now(), cb.Config.ChannelHistoryTime,
+		cb.Config.ChannelHistoryLength)
+	cb.saveChannelHistory()
+}
+
+// saveChannelHistory saves history if we have a file to save it to.
+func (cb *Catbox) saveChannelHistory() {
+	cb.LastHistorySave = time.Now()
+
+	if cb.Config.ChannelHistoryFile == "" {
+		return
+	}
+
+	if err := cb.History.save(cb.Store,
+		cb.Config.ChannelHistoryFile); err != nil {
+		coreLog.Errorf("Unable to save channel history: %s", err)
+	}
+}
+
+// newBatchRef returns a reference for a new BATCH.
+func (cb *Catbox) newBatchRef() string {
+	cb.BatchCounter++
+	return strconv.FormatUint(cb.BatchCounter, 36)
+}
+
+// sendHistory sends the user messages from a channel's history.
+//
+// If they have batch, we wrap them in a batch. If they have server-time, we
+// tell them when we saw each message.
+func (u *LocalUser) sendHistory(channel *Channel, messages []HistoryMessage) {
+	ref := ""
+	if u.hasCap("batch") {
+		ref = u.Catbox.newBatchRef()
+		u.messageFromServer("BATCH", []string{"+" + ref, "chathistory",
+			channel.Name})
+	}
+
+	for _, m := range messages {
+		var tags []MessageTag
+		if ref != "" {
+			tags = append(tags, MessageTag{Key: "batch", Value: ref})
+		}
+		if u.hasCap("server-time") {
+			tags = append(tags, MessageTag{Key: "time",
+				Value: m.Time.UTC().Format(historyTimeFormat)})
+		}
+
+		u.maybeQueueTaggedMessage(tags, irc.Message{
+			Prefix:  m.Source,
+			Command: m.Command,
+			Params:  []string{channel.Name, m.Text},
+		})
+	}
+
+	if ref != "" {
+		u.messageFromServer("BATCH", []string{"-" + ref})
+	}
+}
+
+// playBackHistory sends a user who joined a channel its latest messages.
+//
+// We do this only for clients that can tell these are old messages
+// (server-time). Clients with draft/chathistory ask for what they want.
+func (u *LocalUser) playBackHistory(channel *Channel) {
+	if !u.hasCap("server-time") || u.hasCap("draft/chathistory") {
+		return
+	}
+
+	messages := latestHistory(u.Catbox.channelHistory(channel), time.Time{},
+		u.Catbox.Config.ChannelHistoryPlayback)
+	if len(messages) == 0 {
+		return
+	}
+
+	u.sendHistory(channel, messages)
+}
+
+// chathistoryCommand handles the CHATHISTORY command (draft/chathistory).
+//
+// CHATHISTORY LATEST <target> <* | timestamp=...> <limit>
+// CHATHISTORY BEFORE <target> <timestamp=...> <limit>
+// CHATHISTORY AFTER <target> <timestamp=...> <limit>
+// CHATHISTORY AROUND <target> <timestamp=...> <limit>
+// CHATHISTORY BETWEEN <target> <timestamp=...> <timestamp=...> <limit>
+// CHATHISTORY TARGETS <timestamp=...> <timestamp=...> <limit>
+//
+// We only have history for channels, and only members may see it. We don't
+// have message IDs, so the only references we take are timestamps.
+func (u *LocalUser) chathistoryCommand(m irc.Message) {
+	if u.Catbox.Config.ChannelHistoryLength == 0 {
+		// 421 ERR_UNKNOWNCOMMAND
+		u.messageFromServer("421", []string{m.Command, "Unknown command"})
+		return
+	}
+
+	if len(m.Params) < 4 {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "NEED_MORE_PARAMS",
+			"Not enough parameters"})
+		return
+	}
+
+	subCommand := strings.ToUpper(m.Params[0])
+
+	if subCommand == "TARGETS" {
+		u.chathistoryTargets(m)
+		return
+	}
+
+	if subCommand != "LATEST" && subCommand != "BEFORE" &&
+		subCommand != "AFTER" && subCommand != "AROUND" &&
+		subCommand != "BETWEEN" {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "INVALID_PARAMS",
+			m.Params[0], "Unknown subcommand"})
+		return
+	}
+
+	if subCommand == "BETWEEN" && len(m.Params) < 5 {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "NEED_MORE_PARAMS",
+			"Not enough parameters"})
+		return
+	}
+
+	channel, exists := u.Catbox.Channels[canonicalizeChannel(m.Params[1])]
+	if !exists || !u.User.onChannel(channel) {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "INVALID_TARGET",
+			subCommand, m.Params[1], "Messages could not be retrieved"})
+		return
+	}
+
+	var t time.Time
+	if subCommand != "LATEST" || m.Params[2] != "*" {
+		var ok bool
+		t, ok = u.parseHistoryReference(subCommand, m.Params[2])
+		if !ok {
+			return
+		}
+	}
+
+	limit, ok := u.parseHistoryLimit(subCommand, m.Params[len(m.Params)-1])
+	if !ok {
+		return
+	}
+
+	messages := u.Catbox.channelHistory(channel)
+
+	switch subCommand {
+	case "LATEST":
+		messages = latestHistory(messages, t, limit)
+	case "BEFORE":
+		messages = historyBefore(messages, t, limit)
+	case "AFTER":
+		messages = historySince(messages, t, limit)
+	case "AROUND":
+		messages = historyAround(messages, t, limit)
+	case "BETWEEN":
+		to, ok := u.parseHistoryReference(subCommand, m.Params[3])
+		if !ok {
+			return
+		}
+		messages = historyBetween(messages, t, to, limit)
+	}
+
+	u.sendHistory(channel, messages)
+}
+
+// chathistoryTargets tells the user which of their channels had messages
+// between two times, and when the latest was.
+func (u *LocalUser) chathistoryTargets(m irc.Message) {
+	from, ok := u.parseHistoryReference("TARGETS", m.Params[1])
+	if !ok {
+		return
+	}
+	to, ok := u.parseHistoryReference("TARGETS", m.Params[2])
+	if !ok {
+		return
+	}
+	limit, ok := u.parseHistoryLimit("TARGETS", m.Params[3])
+	if !ok {
+		return
+	}
+
+	if from.After(to) {
+		from, to = to, from
+	}
+
+	type target struct {
+		name   string
+		latest time.Time
+	}
+	var targets []target
+	for _, channel := range u.User.Channels {
+		messages := u.Catbox.channelHistory(channel)
+		messages = historyBefore(messages, to, len(messages))
+		if len(messages) == 0 {
+			continue
+		}
+		latest := messages[len(messages)-1].Time
+		if !latest.After(from) {
+			continue
+		}
+		targets = append(targets, target{name: channel.Name, latest: latest})
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].latest.Before(targets[j].latest)
+	})
+	if len(targets) > limit {
+		targets = targets[:limit]
+	}
+
+	ref := ""
+	if u.hasCap("batch") {
+		ref = u.Catbox.newBatchRef()
+		u.messageFromServer("BATCH", []string{"+" + ref,
+			"draft/chathistory-targets"})
+	}
+
+	for _, target := range targets {
+		var tags []MessageTag
+		if ref != "" {
+			tags = append(tags, MessageTag{Key: "batch", Value: ref})
+		}
+		u.maybeQueueTaggedMessage(tags, irc.Message{
+			Prefix:  u.Catbox.Config.ServerName,
+			Command: "CHATHISTORY",
+			Params: []string{"TARGETS", target.name,
+				target.latest.Format(historyTimeFormat)},
+		})
+	}
+
+	if ref != "" {
+		u.messageFromServer("BATCH", []string{"-" + ref})
+	}
+}
+
+// parseHistoryReference parses a CHATHISTORY message reference. We only
+// support timestamps. If it's not valid, we tell the user.
+func (u *LocalUser) parseHistoryReference(subCommand,
+	ref string) (time.Time, bool) {
+	if !strings.HasPrefix(ref, "timestamp=") {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "INVALID_MSGREFTYPE",
+			subCommand, ref, "Unsupported message reference type"})
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(ref, "timestamp="))
+	if err != nil {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "INVALID_PARAMS",
+			subCommand, ref, "Invalid timestamp"})
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// parseHistoryLimit parses a CHATHISTORY limit. We permit up to as many
+// messages as we keep for a channel.
+func (u *LocalUser) parseHistoryLimit(subCommand, s string) (int, bool) {
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "INVALID_PARAMS",
+			subCommand, s, "Invalid limit"})
+		return 0, false
+	}
+
+	if limit > u.Catbox.Config.ChannelHistoryLength {
+		limit = u.Catbox.Config.ChannelHistoryLength
+	}
+
+	return limit, true
+}
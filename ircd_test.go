@@ -1,8 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/horgh/irc"
 )
 
 func TestCanonicalizeNick(t *testing.T) {
@@ -171,6 +190,130 @@ func TestUserMatchesMask(t *testing.T) {
 	}
 }
 
+func TestNormalizeChannelMask(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"nick", "nick!*@*"},
+		{"nick!user@host", "nick!user@host"},
+		{"user@host", "*!user@host"},
+		{"*.example.com", "*!*@*.example.com"},
+		{"127.0.0.1", "*!*@127.0.0.1"},
+		{"nick!user", "nick!user@*"},
+		{"!@", "*!*@*"},
+		{"", ""},
+		{":nick", ""},
+		{"a b", ""},
+		{"a,b", ""},
+		{"user@host!nick", ""},
+		{"a!b!c@d", ""},
+		{"$a", "$a"},
+		{"$a:horgh", "$a:horgh"},
+		{"$~z", "$~z"},
+		{"$x", ""},
+		{"$a:", ""},
+		{"$", ""},
+	}
+
+	for _, test := range tests {
+		output := normalizeChannelMask(test.input)
+		if output != test.output {
+			t.Errorf("normalizeChannelMask(%s) = %s, wanted %s", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestUserMatchesChannelMask(t *testing.T) {
+	user := User{
+		DisplayNick: "Nick",
+		Username:    "test",
+		Hostname:    "host.example.com",
+		DisplayHost: "host.example.com",
+		IP:          "127.0.0.1",
+	}
+
+	tests := []struct {
+		mask   string
+		output bool
+	}{
+		{"nick!*@*", true},
+		{"*!*@*.example.com", true},
+		{"*!*@127.0.0.*", true},
+		{"n?ck!test@host.example.com", true},
+		{"*!*@example.com", false},
+		{"other!*@*", false},
+		{"*!tes@*", false},
+	}
+
+	for _, test := range tests {
+		output := user.matchesChannelMask(test.mask)
+		if output != test.output {
+			t.Errorf("matchesChannelMask(%s) = %v, wanted %v", test.mask, output,
+				test.output)
+		}
+	}
+}
+
+func TestChannelUserIsBanned(t *testing.T) {
+	user := &User{
+		DisplayNick: "nick",
+		Username:    "test",
+		Hostname:    "host.example.com",
+		DisplayHost: "host.example.com",
+		IP:          "127.0.0.1",
+	}
+
+	channel := NewChannel("#test", 1)
+	if channel.userIsBanned(user) {
+		t.Errorf("user is banned with no bans")
+	}
+
+	channel.addMask('b', "*!*@*.example.com", "server", 1)
+	if !channel.userIsBanned(user) {
+		t.Errorf("user is not banned when matching a ban")
+	}
+
+	channel.addMask('e', "nick!*@*", "server", 1)
+	if channel.userIsBanned(user) {
+		t.Errorf("user is banned despite matching an exception")
+	}
+
+	channel.removeMask('e', "NICK!*@*")
+	if !channel.userIsBanned(user) {
+		t.Errorf("user is not banned after removing exception")
+	}
+}
+
+func TestChannelUserIsQuieted(t *testing.T) {
+	user := &User{
+		DisplayNick: "nick",
+		Username:    "test",
+		Hostname:    "host.example.com",
+		DisplayHost: "host.example.com",
+		IP:          "127.0.0.1",
+	}
+
+	channel := NewChannel("#test", 1)
+	if channel.userIsQuieted(user) {
+		t.Errorf("user is quieted with no quiets")
+	}
+
+	channel.addMask('q', "*!test@*", "server", 1)
+	if !channel.userIsQuieted(user) {
+		t.Errorf("user is not quieted when matching a quiet")
+	}
+	if channel.userIsBanned(user) {
+		t.Errorf("user is banned when matching only a quiet")
+	}
+
+	channel.addMask('e', "nick!*@*", "server", 1)
+	if channel.userIsQuieted(user) {
+		t.Errorf("user is quieted despite matching an exception")
+	}
+}
+
 func TestParseAndResolveUmodeChanges(t *testing.T) {
 	tests := []struct {
 		inputModes         string
@@ -228,6 +371,14 @@ func TestParseAndResolveUmodeChanges(t *testing.T) {
 			outputUnknownModes: map[byte]struct{}{},
 			success:            true,
 		},
+		{
+			inputCurrentModes:  map[byte]struct{}{'i': {}},
+			inputModes:         "+w",
+			outputSetModes:     map[byte]struct{}{'w': {}},
+			outputUnsetModes:   map[byte]struct{}{},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
 		{
 			inputCurrentModes:  map[byte]struct{}{'i': {}},
 			inputModes:         "+o",
@@ -415,12 +566,14 @@ func TestIssueKillToServer(t *testing.T) {
 				DisplayNick: "killer_",
 				Username:    "killer",
 				Hostname:    "example.com",
+				DisplayHost: "example.com",
 				UID:         TS6UID("000AAAAAA"),
 			},
 			&User{
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"go away",
@@ -433,6 +586,7 @@ func TestIssueKillToServer(t *testing.T) {
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"go away",
@@ -444,12 +598,14 @@ func TestIssueKillToServer(t *testing.T) {
 				DisplayNick: "killer_",
 				Username:    "killer",
 				Hostname:    "example.com",
+				DisplayHost: "example.com",
 				UID:         TS6UID("000AAAAAA"),
 			},
 			&User{
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"",
@@ -462,6 +618,7 @@ func TestIssueKillToServer(t *testing.T) {
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"",
@@ -577,12 +734,14 @@ func TestIssueKillToAllServers(t *testing.T) {
 				DisplayNick: "killer_",
 				Username:    "killer",
 				Hostname:    "example.com",
+				DisplayHost: "example.com",
 				UID:         TS6UID("000AAAAAA"),
 			},
 			&User{
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"go away",
@@ -596,6 +755,7 @@ func TestIssueKillToAllServers(t *testing.T) {
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"go away",
@@ -613,12 +773,14 @@ func TestIssueKillToAllServers(t *testing.T) {
 				DisplayNick: "killer_",
 				Username:    "killer",
 				Hostname:    "example.com",
+				DisplayHost: "example.com",
 				UID:         TS6UID("000AAAAAA"),
 			},
 			&User{
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"go away",
@@ -637,6 +799,7 @@ func TestIssueKillToAllServers(t *testing.T) {
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"go away",
@@ -658,12 +821,14 @@ func TestIssueKillToAllServers(t *testing.T) {
 				DisplayNick: "killer_",
 				Username:    "killer",
 				Hostname:    "example.com",
+				DisplayHost: "example.com",
 				UID:         TS6UID("000AAAAAA"),
 			},
 			&User{
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"go away",
@@ -686,6 +851,7 @@ func TestIssueKillToAllServers(t *testing.T) {
 				DisplayNick: "killee_",
 				Username:    "killee",
 				Hostname:    "example2.com",
+				DisplayHost: "example2.com",
 				UID:         TS6UID("000AAAAAB"),
 			},
 			"go away",
@@ -738,3 +904,3259 @@ func TestIssueKillToAllServers(t *testing.T) {
 		}
 	}
 }
+
+func TestEvaluatePolicy(t *testing.T) {
+	var rules []PolicyRule
+	for _, line := range []string{
+		"class trusted ip=127.0.0.0/8",
+		"class trusted ip=2001:db8::/32",
+		"deny ip=2001:db9::1 :Go away: now",
+		"allow tls=1",
+		"allow account=staff* sasl=1",
+		"deny rdns=0 :No reverse DNS",
+		"deny host=*.example.net user!=good",
+	} {
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			t.Fatalf("parsePolicyRule(%s) failed: %s", line, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	tests := []struct {
+		input  PolicyInput
+		action string
+		reason string
+	}{
+		{
+			input:  PolicyInput{IP: net.ParseIP("127.0.0.1")},
+			action: "class",
+		},
+		{
+			input:  PolicyInput{IP: net.ParseIP("2001:db8::1")},
+			action: "class",
+		},
+		{
+			input:  PolicyInput{IP: net.ParseIP("2001:db9::1")},
+			action: "deny",
+			reason: "Go away: now",
+		},
+		{
+			input:  PolicyInput{IP: net.ParseIP("10.0.0.1"), TLS: true},
+			action: "allow",
+		},
+		{
+			input:  PolicyInput{IP: net.ParseIP("10.0.0.1"), Account: "staff1"},
+			action: "allow",
+		},
+		{
+			input:  PolicyInput{IP: net.ParseIP("10.0.0.1")},
+			action: "deny",
+			reason: "No reverse DNS",
+		},
+		{
+			input: PolicyInput{IP: net.ParseIP("10.0.0.1"), Username: "bad",
+				Hostname: "host.example.net"},
+			action: "deny",
+			reason: "Connection denied by policy",
+		},
+		{
+			input: PolicyInput{IP: net.ParseIP("10.0.0.1"), Username: "good",
+				Hostname: "host.example.net"},
+		},
+	}
+
+	for _, test := range tests {
+		rule := evaluatePolicy(rules, test.input)
+		if rule == nil {
+			if test.action != "" {
+				t.Errorf("evaluatePolicy(%+v) = nil, wanted %s", test.input,
+					test.action)
+			}
+			continue
+		}
+
+		if rule.Action != test.action || rule.Reason != test.reason &&
+			test.reason != "" {
+			t.Errorf("evaluatePolicy(%+v) = %s (%s), wanted %s (%s)", test.input,
+				rule.Action, rule.Reason, test.action, test.reason)
+		}
+	}
+}
+
+func TestParsePolicyRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"permit",
+		"class",
+		"allow country=nz",
+		"allow ident=1",
+		"allow dnsbl=1",
+		"allow tls=yes",
+		"allow sasl=yes",
+		"allow =1",
+		"allow ip=10.0.0.0/99",
+		"allow host=",
+	} {
+		if _, err := parsePolicyRule(line); err == nil {
+			t.Errorf("parsePolicyRule(%s) succeeded, wanted error", line)
+		}
+	}
+}
+
+func TestChannelModesString(t *testing.T) {
+	channel := NewChannel("#test", 1)
+	if channel.modesString() != "+" {
+		t.Errorf("modesString() = %s, wanted +", channel.modesString())
+	}
+
+	channel.Modes['s'] = struct{}{}
+	channel.Modes['n'] = struct{}{}
+	channel.Modes['i'] = struct{}{}
+	if channel.modesString() != "+ins" {
+		t.Errorf("modesString() = %s, wanted +ins", channel.modesString())
+	}
+
+	channel.Key = "secret"
+	if channel.modesString() != "+insk" {
+		t.Errorf("modesString() = %s, wanted +insk", channel.modesString())
+	}
+	if len(channel.modeParams()) != 1 || channel.modeParams()[0] != "secret" {
+		t.Errorf("modeParams() = %v, wanted [secret]", channel.modeParams())
+	}
+
+	channel.Limit = 10
+	if channel.modesString() != "+inskl" {
+		t.Errorf("modesString() = %s, wanted +inskl", channel.modesString())
+	}
+	if len(channel.modeParams()) != 2 || channel.modeParams()[1] != "10" {
+		t.Errorf("modeParams() = %v, wanted [secret 10]", channel.modeParams())
+	}
+
+	channel.setJoinThrottle(5, 10)
+	if channel.modesString() != "+insjkl" {
+		t.Errorf("modesString() = %s, wanted +insjkl", channel.modesString())
+	}
+	if len(channel.modeParams()) != 3 || channel.modeParams()[0] != "5:10" {
+		t.Errorf("modeParams() = %v, wanted [5:10 secret 10]", channel.modeParams())
+	}
+}
+
+func TestUserMatchesExtban(t *testing.T) {
+	tests := []struct {
+		user   User
+		mask   string
+		output bool
+	}{
+		{User{Account: "horgh"}, "$a", true},
+		{User{}, "$a", false},
+		{User{}, "$~a", true},
+		{User{Account: "horgh"}, "$a:horgh", true},
+		{User{Account: "horgh"}, "$a:h*", true},
+		{User{Account: "other"}, "$a:horgh", false},
+		{User{Account: "horgh"}, "$~a:horgh", false},
+		{User{CertFP: "abcdef"}, "$z", true},
+		{User{}, "$z", false},
+		{User{CertFP: "abcdef"}, "$z:abcdef", true},
+		{User{CertFP: "abcdef"}, "$z:123456", false},
+		{User{}, "$x", false},
+	}
+
+	for _, test := range tests {
+		output := test.user.matchesChannelMask(test.mask)
+		if output != test.output {
+			t.Errorf("matchesChannelMask(%s) = %v, wanted %v", test.mask, output,
+				test.output)
+		}
+	}
+}
+
+func TestCleanChannelKey(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"secret", "secret"},
+		{"sec ret", "secret"},
+		{"a,b:c", "abc"},
+		{"", ""},
+		{" ", ""},
+		{"abcdefghijklmnopqrstuvwxyz", "abcdefghijklmnopqrstuvw"},
+	}
+
+	for _, test := range tests {
+		output := cleanChannelKey(test.input)
+		if output != test.output {
+			t.Errorf("cleanChannelKey(%s) = %s, wanted %s", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	server := &Server{SID: "001", Name: "irc2.example.com"}
+
+	user := &User{
+		DisplayNick: "user",
+		UID:         "001AAAAAA",
+		Channels:    make(map[string]*Channel),
+		Server:      server,
+	}
+
+	channel := NewChannel("#test", 1)
+	channel.Members[user.UID] = struct{}{}
+	// A member we don't know about.
+	channel.Members["001AAAAAB"] = struct{}{}
+	channel.Ops["001AAAAAB"] = nil
+
+	cb := &Catbox{
+		Config:     &Config{TS6SID: "000"},
+		LocalUsers: map[uint64]*LocalUser{},
+		Users:      map[TS6UID]*User{user.UID: user},
+		Servers:    map[TS6SID]*Server{server.SID: server},
+		Channels:   map[string]*Channel{channel.Name: channel},
+		// A stale nick. And user is missing.
+		Nicks: map[string]TS6UID{"gone": "001AAAAAC"},
+	}
+	server.LinkedTo = &Server{SID: "000"}
+
+	problems := cb.checkConsistency()
+	// Unknown member, user does not know they're on channel, user missing from
+	// nick map, stale nick.
+	if len(problems) != 4 {
+		for _, problem := range problems {
+			t.Logf("%s", problem.Description)
+		}
+		t.Fatalf("checkConsistency() found %d problems, wanted 4", len(problems))
+	}
+
+	for _, problem := range problems {
+		problem.Repair()
+	}
+
+	problems = cb.checkConsistency()
+	if len(problems) != 0 {
+		for _, problem := range problems {
+			t.Logf("%s", problem.Description)
+		}
+		t.Fatalf("checkConsistency() found %d problems after repair, wanted 0",
+			len(problems))
+	}
+}
+
+// A remote user's invites go away when they quit.
+func TestQuitRemoteUserForgetsInvites(t *testing.T) {
+	server := &Server{SID: "001", Name: "irc2.example.com"}
+	user := &User{
+		DisplayNick: "user",
+		UID:         "001AAAAAA",
+		Channels:    make(map[string]*Channel),
+		Server:      server,
+	}
+
+	channel := NewChannel("#test", 1)
+	channel.addInvite(user, user)
+
+	cb := &Catbox{
+		Config:   &Config{TS6SID: "000"},
+		Users:    map[TS6UID]*User{user.UID: user},
+		Opers:    map[TS6UID]*User{},
+		Channels: map[string]*Channel{channel.Name: channel},
+		Nicks:    map[string]TS6UID{"user": user.UID},
+	}
+
+	cb.quitRemoteUser(user, "Bye")
+
+	if len(channel.Invites) != 0 {
+		t.Errorf("quitRemoteUser() left %d invites, wanted 0",
+			len(channel.Invites))
+	}
+}
+
+// A channel may list a member we don't know if we're desynced. Quitting a user
+// on it must not crash.
+func TestQuitRemoteUserUnknownMember(t *testing.T) {
+	server := &Server{SID: "001", Name: "irc2.example.com"}
+	user := &User{
+		DisplayNick: "user",
+		UID:         "001AAAAAA",
+		Channels:    make(map[string]*Channel),
+		Server:      server,
+	}
+
+	channel := NewChannel("#test", 1)
+	channel.Members[user.UID] = struct{}{}
+	channel.Members["001AAAAAB"] = struct{}{}
+	user.Channels[channel.Name] = channel
+
+	cb := &Catbox{
+		Config:   &Config{TS6SID: "000"},
+		Users:    map[TS6UID]*User{user.UID: user},
+		Opers:    map[TS6UID]*User{},
+		Channels: map[string]*Channel{channel.Name: channel},
+		Nicks:    map[string]TS6UID{"user": user.UID},
+	}
+
+	cb.quitRemoteUser(user, "Bye")
+
+	if _, exists := cb.Users[user.UID]; exists {
+		t.Errorf("quitRemoteUser() left the user")
+	}
+	if _, exists := channel.Members[user.UID]; exists {
+		t.Errorf("quitRemoteUser() left the user on the channel")
+	}
+}
+
+func TestChannelLogModeration(t *testing.T) {
+	channel := NewChannel("#test", 1)
+
+	for i := 0; i < maxModLogEntries+10; i++ {
+		channel.logModeration("nick!user@host", fmt.Sprintf("MODE +l %d", i+1))
+	}
+
+	if len(channel.ModLog) != maxModLogEntries {
+		t.Fatalf("log has %d entries, wanted %d", len(channel.ModLog),
+			maxModLogEntries)
+	}
+
+	if channel.ModLog[0].Action != "MODE +l 11" {
+		t.Errorf("oldest entry is %s, wanted MODE +l 11", channel.ModLog[0].Action)
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		output     string
+	}{
+		{"passwd", "salt", 1,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"password", "salt", 4096,
+			"c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, test := range tests {
+		output := fmt.Sprintf("%x", pbkdf2SHA256([]byte(test.password),
+			[]byte(test.salt), test.iterations))
+		if output != test.output {
+			t.Errorf("pbkdf2SHA256(%s, %s, %d) = %s, wanted %s", test.password,
+				test.salt, test.iterations, output, test.output)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("testing")
+	if err != nil {
+		t.Fatalf("hashPassword() failed: %s", err)
+	}
+
+	tests := []struct {
+		stored   string
+		password string
+		output   bool
+	}{
+		{hash, "testing", true},
+		{hash, "Testing", false},
+		{hash, "", false},
+		{hash, hash, false},
+		{"testing", "testing", true},
+		{"testing", "testin", false},
+		{"$pbkdf2-sha256$x$abc$def", "testing", false},
+		{"$pbkdf2-sha256$1$abc", "testing", false},
+	}
+
+	for _, test := range tests {
+		output := checkPassword(test.stored, test.password)
+		if output != test.output {
+			t.Errorf("checkPassword(%s, %s) = %v, wanted %v", test.stored,
+				test.password, output, test.output)
+		}
+	}
+}
+
+func TestConnRead(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	longLine := strings.Repeat("a", 600) + "\r\n"
+	tooLongLine := strings.Repeat("a", maxReadSize+10) + "\r\n"
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		_, _ = conn.Write([]byte("PING a\r\n" + longLine + longLine + tooLongLine))
+	}()
+
+	netConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing: %s", err)
+	}
+	conn := NewConn(netConn, 10*time.Second)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	line, err := conn.Read()
+	if err != nil || line != "PING a\r\n" {
+		t.Fatalf("Read() = %q, %v, wanted PING a", line, err)
+	}
+
+	// Client lines get truncated.
+	line, err = conn.Read()
+	if err != nil || line != strings.Repeat("a", maxClientLineLength-2)+"\r\n" {
+		t.Fatalf("Read() = %q, %v, wanted truncated line", line, err)
+	}
+
+	// Server lines may be longer.
+	conn.setMaxLineLength(maxServerLineLength)
+	line, err = conn.Read()
+	if err != nil || line != longLine {
+		t.Fatalf("Read() = %q, %v, wanted full line", line, err)
+	}
+
+	if _, err := conn.Read(); err == nil {
+		t.Fatalf("Read() of a line larger than maxReadSize succeeded")
+	}
+}
+
+// testCertificate makes a self signed certificate valid for the names.
+func testCertificate(t *testing.T, names ...string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     names,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestHandshakeTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	// The client sends its handshake right after STARTTLS without waiting for
+	// 670. We should find it in our read buffer.
+	clientDone := make(chan error, 1)
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			clientDone <- err
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		if _, err := conn.Write([]byte("STARTTLS\r\n")); err != nil {
+			clientDone <- err
+			return
+		}
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		buf := make([]byte, 64)
+		n, err := tlsConn.Read(buf)
+		if err == nil && string(buf[:n]) != "PING a\r\n" {
+			err = fmt.Errorf("read %q", buf[:n])
+		}
+		clientDone <- err
+	}()
+
+	netConn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %s", err)
+	}
+	c := &LocalClient{
+		Conn: NewConn(netConn, 10*time.Second),
+		Catbox: &Catbox{TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{*testCertificate(t)},
+		}},
+	}
+	defer func() {
+		_ = c.Conn.Close()
+	}()
+
+	line, err := c.Conn.Read()
+	if err != nil || line != "STARTTLS\r\n" {
+		t.Fatalf("Read() = %q, %v, wanted STARTTLS", line, err)
+	}
+
+	conn, err := c.handshakeTLS()
+	if err != nil {
+		t.Fatalf("handshakeTLS() failed: %s", err)
+	}
+	c.Conn = c.Conn.withConn(conn)
+	if !c.isTLS() {
+		t.Errorf("client is not using TLS after handshake")
+	}
+
+	if err := c.Conn.Write("PING a\r\n"); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	if err := <-clientDone; err != nil {
+		t.Fatalf("client failed: %s", err)
+	}
+}
+
+func TestMessagePipeline(t *testing.T) {
+	cb := &Catbox{}
+
+	var ran []string
+	stage := func(name string, reject bool) func(*Delivery) {
+		return func(d *Delivery) {
+			ran = append(ran, name)
+			if reject {
+				d.Rejected = true
+			}
+		}
+	}
+
+	cb.registerMessageStage(MessageStage{Name: "deliver",
+		Order: messageStageOrderDeliver, Run: stage("deliver", false)})
+	cb.registerMessageStage(MessageStage{Name: "checks",
+		Order: messageStageOrderChecks, Run: stage("checks", false)})
+	cb.registerMessageStage(MessageStage{Name: "ratelimit",
+		Order: messageStageOrderRateLimit, Run: stage("ratelimit", false)})
+	cb.registerMessageStage(MessageStage{Name: "checks2",
+		Order: messageStageOrderChecks, Run: stage("checks2", true)})
+
+	cb.runMessagePipeline(&Delivery{})
+
+	wanted := []string{"ratelimit", "checks", "checks2"}
+	if fmt.Sprintf("%v", ran) != fmt.Sprintf("%v", wanted) {
+		t.Errorf("stages ran: %v, wanted %v", ran, wanted)
+	}
+}
+
+func TestNetStatsRollover(t *testing.T) {
+	stats := &NetStats{}
+
+	day1 := time.Date(2019, 7, 8, 23, 59, 0, 0, time.Local)
+	day2 := day1.Add(2 * time.Minute)
+
+	stats.current(day1).Messages += 5
+	if ended := stats.rollover(day1, 3); ended != nil {
+		t.Fatalf("rollover() on the same day = %v, wanted nil", ended)
+	}
+
+	ended := stats.rollover(day2, 3)
+	if ended == nil || ended.Date != "2019-07-08" || ended.Messages != 5 {
+		t.Fatalf("rollover() = %v, wanted 2019-07-08 with 5 messages", ended)
+	}
+
+	today := stats.current(day2)
+	if today.Date != "2019-07-09" || today.PeakUsers != 3 || today.Messages != 0 {
+		t.Errorf("current() = %v, wanted fresh 2019-07-09 with 3 users", today)
+	}
+
+	for i := 0; i < maxStatsDays+5; i++ {
+		stats.rollover(day2.AddDate(0, 0, i+1), 0)
+	}
+	if len(stats.Days) != maxStatsDays {
+		t.Errorf("have %d days, wanted %d", len(stats.Days), maxStatsDays)
+	}
+}
+
+func TestNetStatsSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-stats")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "stats.json")
+
+	stats, err := loadNetStats(fileStore{}, file)
+	if err != nil || len(stats.Days) != 0 {
+		t.Fatalf("loadNetStats() of missing file = %v, %v, wanted no days", stats,
+			err)
+	}
+
+	stats.Days = []DayStats{{Date: "2019-07-08", PeakUsers: 10, KLines: 2}}
+	if err := stats.save(fileStore{}, file); err != nil {
+		t.Fatalf("save() failed: %s", err)
+	}
+
+	loaded, err := loadNetStats(fileStore{}, file)
+	if err != nil {
+		t.Fatalf("loadNetStats() failed: %s", err)
+	}
+	if len(loaded.Days) != 1 || loaded.Days[0] != stats.Days[0] {
+		t.Errorf("loaded %v, wanted %v", loaded.Days, stats.Days)
+	}
+}
+
+func TestBansSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-bans")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "bans.json")
+
+	bans, err := loadBans(fileStore{}, file)
+	if err != nil || len(bans.KLines) != 0 {
+		t.Fatalf("loadBans() of missing file = %v, %v, wanted no bans", bans, err)
+	}
+
+	bans.KLines = []KLine{
+		{UserMask: "*", HostMask: "127.0.0.1", Reason: "bye"},
+		{UserMask: "bad", HostMask: "*.example.com", Reason: "spam"},
+	}
+	if err := bans.save(fileStore{}, file); err != nil {
+		t.Fatalf("save() failed: %s", err)
+	}
+
+	loaded, err := loadBans(fileStore{}, file)
+	if err != nil {
+		t.Fatalf("loadBans() failed: %s", err)
+	}
+	if !reflect.DeepEqual(loaded.KLines, bans.KLines) {
+		t.Errorf("loaded %v, wanted %v", loaded.KLines, bans.KLines)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("{"), 0600); err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+	if _, err := loadBans(fileStore{}, file); err == nil {
+		t.Errorf("loadBans() of invalid file succeeded")
+	}
+}
+
+func TestExpireBans(t *testing.T) {
+	now := time.Now().Unix()
+
+	klines := []KLine{
+		{UserMask: "*", HostMask: "192.0.2.1", Reason: "permanent"},
+		{UserMask: "*", HostMask: "192.0.2.2", Reason: "expired",
+			Expires: now - 1},
+		{UserMask: "*", HostMask: "192.0.2.3", Reason: "temporary",
+			Expires: now + 60},
+	}
+
+	removed := PropagatedBan{Type: "K", UserMask: "*", HostMask: "192.0.2.4",
+		Created: now - 10, Lifetime: 60}
+	forgotten := PropagatedBan{Type: "K", UserMask: "*", HostMask: "192.0.2.5",
+		Created: now - 100, Duration: 10, Lifetime: 60}
+
+	cb := &Catbox{
+		Config:     &Config{},
+		KLines:     klines,
+		KLineIndex: newKLineIndex(klines),
+		PropagatedBans: map[string]*PropagatedBan{
+			removed.key():   &removed,
+			forgotten.key(): &forgotten,
+		},
+	}
+
+	cb.expireBans()
+
+	var hosts []string
+	for _, kline := range cb.KLines {
+		hosts = append(hosts, kline.HostMask)
+	}
+	if !reflect.DeepEqual(hosts, []string{"192.0.2.1", "192.0.2.3"}) {
+		t.Errorf("K-Lines after expiry = %v", hosts)
+	}
+	if cb.KLineIndex.has("*", "192.0.2.2") {
+		t.Errorf("expired K-Line is still indexed")
+	}
+
+	if _, exists := cb.PropagatedBans[removed.key()]; !exists {
+		t.Errorf("forgot removed ban before its lifetime ended")
+	}
+	if _, exists := cb.PropagatedBans[forgotten.key()]; exists {
+		t.Errorf("remembered ban after its lifetime ended")
+	}
+}
+
+func TestServerInfoEncoding(t *testing.T) {
+	info := map[string]string{
+		"version":  "catbox-1.14.0",
+		"features": "kick,list",
+		"nicklen":  "9",
+	}
+
+	encoded := encodeServerInfo(info)
+	if encoded != "features=kick,list nicklen=9 version=catbox-1.14.0" {
+		t.Errorf("encodeServerInfo() = %s", encoded)
+	}
+
+	parsed := parseServerInfo(encoded + " bogus =x")
+	if len(parsed) != len(info) {
+		t.Fatalf("parseServerInfo() = %v, wanted %v", parsed, info)
+	}
+	for k, v := range info {
+		if parsed[k] != v {
+			t.Errorf("parseServerInfo()[%s] = %s, wanted %s", k, parsed[k], v)
+		}
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"hello", "hello"},
+		{"\x02bold\x02 text", "bold text"},
+		{"\x0304red\x03 text", "red text"},
+		{"\x0304,12red on blue\x0f", "red on blue"},
+		{"\x034,text", ",text"},
+		{"\x03,5text", ",5text"},
+		{"\x03123", "3"},
+		{"\x04ff0000red", "red"},
+		{"\x04ff0000,00ff00both", "both"},
+		{"\x1d\x1f\x16\x11\x1eall", "all"},
+		{"\x01ACTION waves\x01", "\x01ACTION waves\x01"},
+		{"trailing\x03", "trailing"},
+	}
+
+	for _, test := range tests {
+		output := stripFormatting(test.input)
+		if output != test.output {
+			t.Errorf("stripFormatting(%q) = %q, wanted %q", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestIsCTCPAction(t *testing.T) {
+	tests := []struct {
+		input  string
+		ctcp   bool
+		action bool
+	}{
+		{"hi", false, false},
+		{"\x01VERSION\x01", true, false},
+		{"\x01ACTION waves\x01", true, true},
+		{"\x01action waves\x01", true, true},
+		{"\x01ACTION\x01", true, true},
+		{"\x01ACTIONS\x01", true, false},
+	}
+
+	for _, test := range tests {
+		if isCTCP(test.input) != test.ctcp {
+			t.Errorf("isCTCP(%q) = %v, wanted %v", test.input, !test.ctcp, test.ctcp)
+		}
+		if isCTCPAction(test.input) != test.action {
+			t.Errorf("isCTCPAction(%q) = %v, wanted %v", test.input, !test.action,
+				test.action)
+		}
+	}
+}
+
+func TestJoinForward(t *testing.T) {
+	channel := NewChannel("#test", 1)
+	overflow := NewChannel("#overflow", 1)
+	cb := &Catbox{
+		Config: &Config{},
+		Channels: map[string]*Channel{
+			channel.Name:  channel,
+			overflow.Name: overflow,
+		},
+	}
+	now := time.Now()
+
+	channel.setJoinThrottle(1, 60)
+	channel.Forward = overflow.Name
+	if forward := cb.joinForward(channel); forward != "" {
+		t.Errorf("joinForward() = %s before throttled, wanted none", forward)
+	}
+
+	channel.recordJoin(now)
+	if forward := cb.joinForward(channel); forward != overflow.Name {
+		t.Errorf("joinForward() = %q when throttled, wanted %s", forward,
+			overflow.Name)
+	}
+
+	// We don't forward to a channel that is also throttled.
+	overflow.setJoinThrottle(1, 60)
+	overflow.recordJoin(now)
+	if forward := cb.joinForward(channel); forward != "" {
+		t.Errorf("joinForward() = %s to throttled channel, wanted none", forward)
+	}
+
+	// Or to one that doesn't exist.
+	overflow.setJoinThrottle(0, 0)
+	delete(cb.Channels, overflow.Name)
+	if forward := cb.joinForward(channel); forward != "" {
+		t.Errorf("joinForward() = %s to missing channel, wanted none", forward)
+	}
+}
+
+func TestParseJoinThrottle(t *testing.T) {
+	tests := []struct {
+		input   string
+		count   int
+		seconds int
+		ok      bool
+	}{
+		{"5:10", 5, 10, true},
+		{"1:1", 1, 1, true},
+		{"5", 0, 0, false},
+		{"5:", 0, 0, false},
+		{":10", 0, 0, false},
+		{"0:10", 0, 0, false},
+		{"5:0", 0, 0, false},
+		{"-1:10", 0, 0, false},
+		{"a:b", 0, 0, false},
+		{"1000:10", 0, 0, false},
+		{"5:100000", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		count, seconds, ok := parseJoinThrottle(test.input)
+		if count != test.count || seconds != test.seconds || ok != test.ok {
+			t.Errorf("parseJoinThrottle(%q) = %d, %d, %v, wanted %d, %d, %v",
+				test.input, count, seconds, ok, test.count, test.seconds, test.ok)
+		}
+	}
+}
+
+func TestChannelJoinThrottle(t *testing.T) {
+	channel := NewChannel("#test", 1)
+	now := time.Now()
+
+	// No throttle. We don't track joins.
+	for i := 0; i < 5; i++ {
+		channel.recordJoin(now)
+	}
+	if channel.joinThrottled(now) {
+		t.Errorf("channel without +j is throttled")
+	}
+
+	channel.setJoinThrottle(3, 10)
+
+	channel.recordJoin(now)
+	channel.recordJoin(now.Add(time.Second))
+	if channel.joinThrottled(now.Add(2 * time.Second)) {
+		t.Errorf("throttled after 2 joins, wanted not throttled")
+	}
+
+	channel.recordJoin(now.Add(2 * time.Second))
+	if !channel.joinThrottled(now.Add(3 * time.Second)) {
+		t.Errorf("not throttled after 3 joins, wanted throttled")
+	}
+
+	// The first join falls out of the window.
+	if channel.joinThrottled(now.Add(10 * time.Second)) {
+		t.Errorf("throttled after window passed, wanted not throttled")
+	}
+
+	// Remote joins can take us past the count. We still become unthrottled once
+	// enough of them expire.
+	for i := 0; i < 10; i++ {
+		channel.recordJoin(now.Add(20 * time.Second))
+	}
+	if !channel.joinThrottled(now.Add(20 * time.Second)) {
+		t.Errorf("not throttled after many joins, wanted throttled")
+	}
+	if channel.joinThrottled(now.Add(30 * time.Second)) {
+		t.Errorf("throttled after window passed, wanted not throttled")
+	}
+
+	channel.setJoinThrottle(0, 0)
+	if channel.joinThrottled(now.Add(20 * time.Second)) {
+		t.Errorf("throttled after -j, wanted not throttled")
+	}
+}
+
+func TestSJOINTS(t *testing.T) {
+	tests := []struct {
+		name          string
+		ourTS         int64
+		theirTS       int64
+		wantTS        int64
+		wantOps       bool
+		wantBan       bool
+		wantModes     string
+		wantPropagate []string
+	}{
+		{
+			name:          "theirs is newer",
+			ourTS:         100,
+			theirTS:       200,
+			wantTS:        100,
+			wantOps:       false,
+			wantBan:       true,
+			wantModes:     "+n",
+			wantPropagate: []string{"100", "#test", "+", "001AAAAAA"},
+		},
+		{
+			name:          "theirs is older",
+			ourTS:         200,
+			theirTS:       100,
+			wantTS:        100,
+			wantOps:       true,
+			wantBan:       false,
+			wantModes:     "+t",
+			wantPropagate: []string{"100", "#test", "+t", "@001AAAAAA"},
+		},
+		{
+			name:          "same",
+			ourTS:         100,
+			theirTS:       100,
+			wantTS:        100,
+			wantOps:       true,
+			wantBan:       true,
+			wantModes:     "+nt",
+			wantPropagate: []string{"100", "#test", "+t", "@001AAAAAA"},
+		},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config:       &Config{ServerName: "irc.example.com", TS6SID: "000"},
+			LocalServers: make(map[uint64]*LocalServer),
+			Users:        make(map[TS6UID]*User),
+			Servers:      make(map[TS6SID]*Server),
+			Channels:     make(map[string]*Channel),
+		}
+
+		from := &LocalServer{
+			LocalClient: &LocalClient{ID: 1, Catbox: cb,
+				WriteChan: make(chan irc.Message, 10)},
+			Server: &Server{SID: "001", Name: "irc1.example.com"},
+		}
+		other := &LocalServer{
+			LocalClient: &LocalClient{ID: 2, Catbox: cb,
+				WriteChan: make(chan irc.Message, 10)},
+			Server: &Server{SID: "002", Name: "irc2.example.com"},
+		}
+		cb.LocalServers[1] = from
+		cb.LocalServers[2] = other
+		cb.Servers["001"] = from.Server
+		cb.Servers["002"] = other.Server
+
+		user := &User{
+			DisplayNick:   "nick",
+			UID:           "001AAAAAA",
+			Channels:      make(map[string]*Channel),
+			ClosestServer: from,
+		}
+		cb.Users[user.UID] = user
+
+		channel := NewChannel("#test", test.ourTS)
+		channel.Modes['n'] = struct{}{}
+		channel.addMask('b', "*!*@example.com", "irc.example.com", 1)
+		cb.Channels[channel.Name] = channel
+
+		from.sjoinCommand(irc.Message{
+			Prefix:  "001",
+			Command: "SJOIN",
+			Params: []string{fmt.Sprintf("%d", test.theirTS), "#test", "+t",
+				"@001AAAAAA"},
+		})
+
+		if channel.TS != test.wantTS {
+			t.Errorf("%s: TS = %d, wanted %d", test.name, channel.TS, test.wantTS)
+		}
+		if channel.userHasOps(user) != test.wantOps {
+			t.Errorf("%s: ops = %v, wanted %v", test.name, !test.wantOps,
+				test.wantOps)
+		}
+		if channel.hasMask('b', "*!*@example.com") != test.wantBan {
+			t.Errorf("%s: ban = %v, wanted %v", test.name, !test.wantBan,
+				test.wantBan)
+		}
+		if channel.modesString() != test.wantModes {
+			t.Errorf("%s: modes = %s, wanted %s", test.name, channel.modesString(),
+				test.wantModes)
+		}
+
+		if len(from.WriteChan) != 0 {
+			t.Errorf("%s: SJOIN sent back to its source", test.name)
+		}
+		if len(other.WriteChan) != 1 {
+			t.Errorf("%s: propagated %d messages, wanted 1", test.name,
+				len(other.WriteChan))
+			continue
+		}
+		m := <-other.WriteChan
+		if !reflect.DeepEqual(m.Params, test.wantPropagate) {
+			t.Errorf("%s: propagated %v, wanted %v", test.name, m.Params,
+				test.wantPropagate)
+		}
+	}
+}
+
+func TestSetNickAtServerTarget(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			ServerName:    "irc.example.com",
+			MaxNickLength: 9,
+		},
+		Nicks:   make(map[string]TS6UID),
+		Users:   make(map[TS6UID]*User),
+		Servers: make(map[TS6SID]*Server),
+	}
+
+	local := &User{DisplayNick: "Local", UID: "000AAAAAA",
+		LocalUser: &LocalUser{}}
+	remote := &User{DisplayNick: "Remote", UID: "001AAAAAA"}
+	for _, u := range []*User{local, remote} {
+		cb.Users[u.UID] = u
+		cb.Nicks[canonicalizeNick(u.DisplayNick)] = u.UID
+	}
+	services := &Server{SID: "001", Name: "services.example.com"}
+	cb.Servers[services.SID] = services
+
+	tests := []struct {
+		target     string
+		ok         bool
+		user       *User
+		server     *Server
+		targetNick string
+	}{
+		{"local@irc.example.com", true, local, nil, ""},
+		{"remote@irc.example.com", false, nil, nil, ""},
+		{"nobody@irc.example.com", false, nil, nil, ""},
+		{"NickServ@services.example.com", true, nil, services, "NickServ"},
+		{"NickServ@unknown.example.com", false, nil, nil, ""},
+		{"#chan@services.example.com", false, nil, nil, ""},
+		{"local", false, nil, nil, ""},
+	}
+
+	for _, test := range tests {
+		d := &Delivery{}
+		ok := cb.setNickAtServerTarget(d, test.target)
+		if ok != test.ok {
+			t.Errorf("setNickAtServerTarget(%s) = %v, wanted %v", test.target, ok,
+				test.ok)
+			continue
+		}
+		if d.Target != test.user || d.TargetServer != test.server ||
+			d.TargetNick != test.targetNick {
+			t.Errorf("setNickAtServerTarget(%s) set %v %v %s, wanted %v %v %s",
+				test.target, d.Target, d.TargetServer, d.TargetNick, test.user,
+				test.server, test.targetNick)
+		}
+	}
+}
+
+// Only a user's own server may tell others their real host. When we change a
+// remote user's host, servers hear only CHGHOST.
+func TestSetHostRemoteUser(t *testing.T) {
+	cb := &Catbox{
+		Config:       &Config{ServerName: "irc.example.com", TS6SID: "000"},
+		LocalServers: make(map[uint64]*LocalServer),
+	}
+
+	from := &LocalServer{
+		LocalClient: &LocalClient{ID: 1, Catbox: cb,
+			WriteChan: make(chan irc.Message, 10)},
+		Server: &Server{SID: "001", Name: "irc1.example.com"},
+	}
+	other := &LocalServer{
+		LocalClient: &LocalClient{ID: 2, Catbox: cb,
+			WriteChan: make(chan irc.Message, 10)},
+		Server: &Server{SID: "002", Name: "irc2.example.com"},
+	}
+	cb.LocalServers[1] = from
+	cb.LocalServers[2] = other
+
+	user := &User{
+		DisplayNick:   "nick",
+		UID:           "001AAAAAA",
+		Hostname:      "example.com",
+		DisplayHost:   "example.com",
+		Channels:      make(map[string]*Channel),
+		ClosestServer: from,
+	}
+
+	cb.setHost(user, user.Hostname, "vhost.example.com")
+
+	for _, server := range []*LocalServer{from, other} {
+		if len(server.WriteChan) != 1 {
+			t.Fatalf("%s got %d messages, wanted 1", server.Server.Name,
+				len(server.WriteChan))
+		}
+		m := <-server.WriteChan
+		if m.Prefix != "000" || m.Params[1] != "CHGHOST" {
+			t.Errorf("%s got %s, wanted ENCAP CHGHOST from us", server.Server.Name,
+				m)
+		}
+	}
+}
+
+// Another server may not log users in to accounts our NickServ keeps.
+func TestSUNickServAccount(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{ServerName: "irc.example.com", TS6SID: "000",
+			NickServFile: "nickserv"},
+		LocalServers: make(map[uint64]*LocalServer),
+		Servers:      make(map[TS6SID]*Server),
+		Users:        make(map[TS6UID]*User),
+		NickAccounts: map[string]*NickAccount{"horgh": {Name: "horgh"}},
+	}
+
+	ls := &LocalServer{
+		LocalClient: &LocalClient{ID: 1, Catbox: cb,
+			WriteChan: make(chan irc.Message, 10)},
+	}
+	ls.Server = &Server{SID: "001", Name: "irc1.example.com", LocalServer: ls}
+	cb.LocalServers[1] = ls
+	cb.Servers["001"] = ls.Server
+
+	user := &User{
+		DisplayNick:   "nick",
+		UID:           "001AAAAAA",
+		Channels:      make(map[string]*Channel),
+		ClosestServer: ls,
+		Server:        ls.Server,
+	}
+	cb.Users[user.UID] = user
+
+	ls.suCommand(irc.Message{Prefix: "001", Command: "SU",
+		Params: []string{"001AAAAAA", "Horgh"}})
+	if user.Account != "" {
+		t.Errorf("account = %s, wanted none", user.Account)
+	}
+
+	ls.suCommand(irc.Message{Prefix: "001", Command: "SU",
+		Params: []string{"001AAAAAA", "other"}})
+	if user.Account != "other" {
+		t.Errorf("account = %s, wanted other", user.Account)
+	}
+}
+
+// Lengths from the config apply only to our users. Other servers may have
+// different limits.
+func TestServerAwayLength(t *testing.T) {
+	cb := &Catbox{
+		Config:       &Config{MaxAwayLength: 5},
+		LocalServers: make(map[uint64]*LocalServer),
+		Users:        make(map[TS6UID]*User),
+	}
+
+	ls := &LocalServer{
+		LocalClient: &LocalClient{ID: 1, Catbox: cb,
+			WriteChan: make(chan irc.Message, 10)},
+	}
+	cb.LocalServers[1] = ls
+
+	user := &User{DisplayNick: "nick", UID: "001AAAAAA"}
+	cb.Users[user.UID] = user
+
+	ls.awayCommand(irc.Message{Prefix: "001AAAAAA", Command: "AWAY",
+		Params: []string{"gone fishing"}})
+	if user.AwayMessage != "gone fishing" {
+		t.Errorf("away message = %s, wanted gone fishing", user.AwayMessage)
+	}
+
+	ls.awayCommand(irc.Message{Prefix: "001AAAAAA", Command: "AWAY",
+		Params: []string{strings.Repeat("a", maxAwayLength+1)}})
+	if len(user.AwayMessage) != maxAwayLength {
+		t.Errorf("away message length = %d, wanted %d", len(user.AwayMessage),
+			maxAwayLength)
+	}
+}
+
+func TestTargetPenalty(t *testing.T) {
+	u := &LocalUser{
+		User:           &User{Modes: make(map[byte]struct{})},
+		MessageCounter: 2,
+	}
+
+	u.targetPenalty(1)
+	if u.MessageCounter != 2 {
+		t.Errorf("counter = %d after 1 target, wanted 2", u.MessageCounter)
+	}
+
+	u.targetPenalty(4)
+	if u.MessageCounter != -1 {
+		t.Errorf("counter = %d after 4 targets, wanted -1", u.MessageCounter)
+	}
+
+	u.User.FloodExempt = true
+	u.targetPenalty(4)
+	if u.MessageCounter != -1 {
+		t.Errorf("counter = %d for exempt user, wanted -1", u.MessageCounter)
+	}
+}
+
+func TestFloodPenalty(t *testing.T) {
+	tests := []struct {
+		input  irc.Message
+		output int
+	}{
+		{irc.Message{Command: "PING"}, 1},
+		{irc.Message{Command: "PRIVMSG", Params: []string{"#test", "hi"}}, 1},
+		{irc.Message{Command: "PRIVMSG",
+			Params: []string{"#test", strings.Repeat("a", 242)}}, 1},
+		{irc.Message{Command: "PRIVMSG",
+			Params: []string{"#test", strings.Repeat("a", 243)}}, 2},
+		{irc.Message{Command: "PRIVMSG",
+			Params: []string{"#test", strings.Repeat("a", 495)}}, 2},
+	}
+
+	for _, test := range tests {
+		output := floodPenalty(test.input)
+		if output != test.output {
+			t.Errorf("floodPenalty(%+v) = %d, wanted %d", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestISupportChanges(t *testing.T) {
+	tests := []struct {
+		old    []string
+		new    []string
+		output []string
+	}{
+		{[]string{"EXCEPTS", "NICKLEN=9"}, []string{"EXCEPTS", "NICKLEN=9"}, nil},
+		{
+			[]string{"EXCEPTS", "MAXTARGETS=4"},
+			[]string{"EXCEPTS", "MAXTARGETS=5"},
+			[]string{"MAXTARGETS=5"},
+		},
+		{
+			[]string{"EXCEPTS", "MAXTARGETS=4"},
+			[]string{"EXCEPTS", "NETWORK=Test"},
+			[]string{"NETWORK=Test", "-MAXTARGETS"},
+		},
+	}
+
+	for _, test := range tests {
+		output := isupportChanges(test.old, test.new)
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("isupportChanges(%v, %v) = %v, wanted %v", test.old, test.new,
+				output, test.output)
+		}
+	}
+}
+
+func TestRateLimitStage(t *testing.T) {
+	u := &User{Modes: make(map[byte]struct{})}
+	u.LocalUser = &LocalUser{User: u, MessageCounter: 2}
+
+	cb := &Catbox{}
+	cb.rateLimitStage(&Delivery{Source: u, LocalSource: u.LocalUser})
+	if u.LocalUser.MessageCounter != 2 {
+		t.Errorf("counter = %d after first target, wanted 2",
+			u.LocalUser.MessageCounter)
+	}
+
+	for i := 0; i < 3; i++ {
+		cb.rateLimitStage(&Delivery{Source: u, LocalSource: u.LocalUser,
+			ExtraTarget: true})
+	}
+	if u.LocalUser.MessageCounter != -1 {
+		t.Errorf("counter = %d after 3 more targets, wanted -1",
+			u.LocalUser.MessageCounter)
+	}
+
+	u.FloodExempt = true
+	cb.rateLimitStage(&Delivery{Source: u, LocalSource: u.LocalUser,
+		ExtraTarget: true})
+	if u.LocalUser.MessageCounter != -1 {
+		t.Errorf("counter = %d for exempt user, wanted -1",
+			u.LocalUser.MessageCounter)
+	}
+}
+
+func TestSpamFilterStage(t *testing.T) {
+	cb := &Catbox{Config: &Config{
+		ServerName: "irc.example.com",
+		SpamFilterConfigs: []SpamFilterConfig{
+			{Name: "spam", Mask: "*buy cheap*", Reason: "No advertising"},
+		},
+	}}
+
+	u := &User{DisplayNick: "source", Modes: make(map[byte]struct{})}
+	u.LocalUser = &LocalUser{
+		LocalClient: &LocalClient{Catbox: cb,
+			WriteChan: make(chan irc.Message, 10)},
+		User: u,
+	}
+	channel := NewChannel("#test", 1)
+
+	tests := []struct {
+		text     string
+		oper     bool
+		rejected bool
+	}{
+		{"hello", false, false},
+		{"BUY CHEAP watches", false, true},
+		{"buy \x02cheap\x02 watches", false, true},
+		{"buy cheap watches", true, false},
+	}
+
+	for _, test := range tests {
+		delete(u.Modes, 'o')
+		if test.oper {
+			u.Modes['o'] = struct{}{}
+		}
+
+		d := &Delivery{Command: "PRIVMSG", Source: u, LocalSource: u.LocalUser,
+			Channel: channel, Text: test.text}
+		cb.spamFilterStage(d)
+		if d.Rejected != test.rejected {
+			t.Errorf("spamFilterStage(%q) rejected = %v, wanted %v", test.text,
+				d.Rejected, test.rejected)
+		}
+	}
+
+	// Messages from servers go through.
+	d := &Delivery{Command: "PRIVMSG", Channel: channel,
+		Text: "buy cheap watches"}
+	cb.spamFilterStage(d)
+	if d.Rejected || d.SkipLocal {
+		t.Errorf("spamFilterStage() blocked a message from a server")
+	}
+}
+
+func TestCallerIDStage(t *testing.T) {
+	cb := &Catbox{Config: &Config{ServerName: "irc.example.com"}}
+
+	newLocalUser := func(nick, uid string) *User {
+		u := &User{
+			DisplayNick: nick,
+			Username:    nick,
+			Hostname:    "example.com",
+			DisplayHost: "example.com",
+			UID:         TS6UID(uid),
+			Modes:       make(map[byte]struct{}),
+		}
+		u.LocalUser = &LocalUser{
+			LocalClient: &LocalClient{Catbox: cb,
+				WriteChan: make(chan irc.Message, 10)},
+			User:    u,
+			Accepts: make(map[TS6UID]struct{}),
+		}
+		return u
+	}
+
+	target := newLocalUser("target", "000AAAAAA")
+	source := newLocalUser("source", "000AAAAAB")
+
+	d := &Delivery{Command: "PRIVMSG", Source: source,
+		LocalSource: source.LocalUser, Target: target}
+	cb.callerIDStage(d)
+	if d.Rejected {
+		t.Errorf("message to -g user rejected")
+	}
+
+	target.Modes['g'] = struct{}{}
+	d = &Delivery{Command: "PRIVMSG", Source: source,
+		LocalSource: source.LocalUser, Target: target}
+	cb.callerIDStage(d)
+	if !d.Rejected {
+		t.Errorf("message to +g user from user not accepted was not rejected")
+	}
+	// 716 and 717 to the source, 718 to the target.
+	if len(source.LocalUser.WriteChan) != 2 {
+		t.Errorf("source got %d messages, wanted 2",
+			len(source.LocalUser.WriteChan))
+	}
+	if len(target.LocalUser.WriteChan) != 1 {
+		t.Errorf("target got %d messages, wanted 1",
+			len(target.LocalUser.WriteChan))
+	}
+
+	// We don't tell the target again right away.
+	d = &Delivery{Command: "PRIVMSG", Source: source,
+		LocalSource: source.LocalUser, Target: target}
+	cb.callerIDStage(d)
+	if len(target.LocalUser.WriteChan) != 1 {
+		t.Errorf("target got %d messages, wanted 1",
+			len(target.LocalUser.WriteChan))
+	}
+
+	target.LocalUser.Accepts[source.UID] = struct{}{}
+	d = &Delivery{Command: "PRIVMSG", Source: source,
+		LocalSource: source.LocalUser, Target: target}
+	cb.callerIDStage(d)
+	if d.Rejected {
+		t.Errorf("message to +g user from accepted user rejected")
+	}
+}
+
+func TestCloakHost(t *testing.T) {
+	tests := []struct {
+		host   string
+		suffix string
+	}{
+		{"dsl-1-2-3-4.example.com", ".example.com"},
+		{"127.0.0.1", ".ip"},
+		{"0::1", ".ip"},
+		{"localhost", ""},
+	}
+
+	for _, test := range tests {
+		cloak := cloakHost("secret", test.host)
+		if cloak == test.host || !strings.HasSuffix(cloak, test.suffix) {
+			t.Errorf("cloakHost(%s) = %s, wanted suffix %s", test.host, cloak,
+				test.suffix)
+		}
+		if strings.Contains(cloak, strings.TrimSuffix(test.host, test.suffix)) {
+			t.Errorf("cloakHost(%s) = %s, reveals host", test.host, cloak)
+		}
+		if !isValidHostname(cloak) {
+			t.Errorf("cloakHost(%s) = %s, not a valid hostname", test.host, cloak)
+		}
+		if cloakHost("secret", test.host) != cloak {
+			t.Errorf("cloakHost(%s) is not stable", test.host)
+		}
+		if cloakHost("other", test.host) == cloak {
+			t.Errorf("cloakHost(%s) does not depend on the key", test.host)
+		}
+	}
+
+	// Bans match the real host of cloaked users as well as their cloak.
+	user := User{
+		DisplayNick: "nick",
+		Username:    "test",
+		Hostname:    "dsl-1-2-3-4.example.com",
+		DisplayHost: cloakHost("secret", "dsl-1-2-3-4.example.com"),
+		IP:          "127.0.0.1",
+	}
+	if !user.matchesChannelMask("*!*@dsl-*.example.com") {
+		t.Errorf("cloaked user does not match ban on real host")
+	}
+	if !user.matchesChannelMask("*!*@" + user.DisplayHost) {
+		t.Errorf("cloaked user does not match ban on cloak")
+	}
+}
+
+func TestTorAuthenticated(t *testing.T) {
+	tests := []struct {
+		auth    string
+		pass    string
+		account string
+		output  bool
+	}{
+		{"none", "", "", true},
+		{"password", "secret", "", true},
+		{"password", "wrong", "", false},
+		{"password", "", "", false},
+		{"sasl", "", "account", true},
+		{"sasl", "secret", "", false},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config: &Config{
+				ServerName:  "irc.example.org",
+				TorAuth:     test.auth,
+				TorPassword: "secret",
+			},
+			LocalClients: map[uint64]*LocalClient{},
+			ToServerChan: make(chan Event, 1),
+		}
+		// They're negotiating capabilities so we don't try to register them
+		// once we check their password.
+		c := &LocalClient{
+			ID:             1,
+			Catbox:         cb,
+			WriteChan:      make(chan irc.Message, 10),
+			Tor:            true,
+			PreRegPass:     test.pass,
+			SASLAccount:    test.account,
+			CapNegotiating: true,
+		}
+		cb.LocalClients[c.ID] = c
+
+		got := c.torAuthenticated()
+		if test.auth == "password" {
+			// We check passwords outside the server goroutine. They're not
+			// authenticated until we're done.
+			if got {
+				t.Errorf("torAuthenticated() with %s, %q = true before checking",
+					test.auth, test.pass)
+			}
+			cb.WG.Wait()
+			(<-cb.ToServerChan).PasswordFunc()
+			got = c.TorPasswordOK
+		}
+
+		if got != test.output {
+			t.Errorf("torAuthenticated() with %s, %q, %q = %v, wanted %v",
+				test.auth, test.pass, test.account, got, test.output)
+		}
+		if _, exists := cb.LocalClients[c.ID]; exists != test.output {
+			t.Errorf("torAuthenticated() with %s, %q, %q, client kept = %v",
+				test.auth, test.pass, test.account, exists)
+		}
+	}
+}
+
+// Operators connected through Tor don't see real hosts in notices.
+func TestNoticeLocalOpersRealHost(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{ServerName: "irc.example.org"},
+		Opers:  make(map[TS6UID]*User),
+	}
+
+	newOper := func(uid TS6UID, tor bool) *User {
+		u := &User{
+			DisplayNick: string(uid),
+			UID:         uid,
+			Modes:       map[byte]struct{}{'o': {}},
+		}
+		u.LocalUser = &LocalUser{
+			LocalClient: &LocalClient{Catbox: cb,
+				WriteChan: make(chan irc.Message, 10), Tor: tor},
+			User: u,
+		}
+		cb.Opers[uid] = u
+		return u
+	}
+	oper := newOper("000AAAAAA", false)
+	torOper := newOper("000AAAAAB", true)
+
+	cb.noticeLocalOpersRealHost("real", "hidden")
+
+	for _, test := range []struct {
+		user *User
+		text string
+	}{
+		{oper, "*** Notice --- real"},
+		{torOper, "*** Notice --- hidden"},
+	} {
+		m := <-test.user.LocalUser.WriteChan
+		if m.Params[1] != test.text {
+			t.Errorf("%s got %q, wanted %q", test.user.DisplayNick, m.Params[1],
+				test.text)
+		}
+	}
+}
+
+func TestParseVhostConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		output  VhostConfig
+		success bool
+	}{
+		{"account, horgh, horgh.users.example.com",
+			VhostConfig{Account: "horgh", Vhost: "horgh.users.example.com"}, true},
+		{"certfp,ABCDEF,cert.example.com",
+			VhostConfig{CertFP: "abcdef", Vhost: "cert.example.com"}, true},
+		{"account,horgh", VhostConfig{}, false},
+		{"nick,horgh,horgh.example.com", VhostConfig{}, false},
+		{"account,,horgh.example.com", VhostConfig{}, false},
+		{"account,horgh,bad host", VhostConfig{}, false},
+		{"account,horgh,-horgh.example.com", VhostConfig{}, false},
+		{"account,horgh," + strings.Repeat("a", 64), VhostConfig{}, false},
+	}
+
+	for _, test := range tests {
+		output, err := parseVhostConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseVhostConfig(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseVhostConfig(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+		if output != test.output {
+			t.Errorf("parseVhostConfig(%s) = %+v, wanted %+v", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestParseUserConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		output  UserConfig
+		success bool
+	}{
+		{"*,localhost,1,horgh.", UserConfig{UserMask: "*", HostMask: "localhost",
+			FloodExempt: true, Spoof: "horgh."}, true},
+		{"*,localhost,0,,100", UserConfig{UserMask: "*", HostMask: "localhost",
+			SendQueue: 100}, true},
+		{"*,localhost,0", UserConfig{}, false},
+		{"*,localhost,0,,0", UserConfig{}, false},
+		{"*,localhost,0,,32769", UserConfig{}, false},
+		{"*,localhost,0,,lots", UserConfig{}, false},
+		{"*,localhost,0,,,20", UserConfig{UserMask: "*", HostMask: "localhost",
+			MaxChannels: 20}, true},
+		{"*,localhost,0,,100,20", UserConfig{UserMask: "*", HostMask: "localhost",
+			SendQueue: 100, MaxChannels: 20}, true},
+		{"*,localhost,0,,,0", UserConfig{}, false},
+		{"*,localhost,0,,,many", UserConfig{}, false},
+	}
+
+	for _, test := range tests {
+		output, err := parseUserConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseUserConfig(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseUserConfig(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+		if output != test.output {
+			t.Errorf("parseUserConfig(%s) = %+v, wanted %+v", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestParseConnectClass(t *testing.T) {
+	tests := []struct {
+		input     string
+		frequency time.Duration
+		sendQueue int
+		success   bool
+	}{
+		{"30s", 30 * time.Second, 0, true},
+		{"5m, 20000", 5 * time.Minute, 20000, true},
+		{"often", 0, 0, false},
+		{"30s,0", 0, 0, false},
+		{"30s,1,2", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		frequency, sendQueue, err := parseConnectClass(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseConnectClass(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseConnectClass(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+		if frequency != test.frequency || sendQueue != test.sendQueue {
+			t.Errorf("parseConnectClass(%s) = %s, %d, wanted %s, %d", test.input,
+				frequency, sendQueue, test.frequency, test.sendQueue)
+		}
+	}
+}
+
+func TestConfiguredVhost(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			VhostConfigs: []VhostConfig{
+				{Account: "horgh", Vhost: "horgh.example.com"},
+				{CertFP: "abcdef", Vhost: "cert.example.com"},
+			},
+		},
+	}
+
+	tests := []struct {
+		user   User
+		output string
+	}{
+		{User{Account: "Horgh"}, "horgh.example.com"},
+		{User{CertFP: "abcdef"}, "cert.example.com"},
+		{User{Account: "other", CertFP: "123456"}, ""},
+		{User{}, ""},
+	}
+
+	for _, test := range tests {
+		output := cb.configuredVhost(&test.user)
+		if output != test.output {
+			t.Errorf("configuredVhost(%+v) = %s, wanted %s", test.user, output,
+				test.output)
+		}
+	}
+}
+
+// When several vhosts match a user, the first by name wins. Reading the
+// config must not depend on map order.
+func TestParseConfigVhostOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-vhosts")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "vhosts.conf")
+	if err := ioutil.WriteFile(file, []byte(`c = account,horgh,c.example.com
+a = account,horgh,a.example.com
+b = account,horgh,b.example.com
+`), 0600); err != nil {
+		t.Fatalf("error writing config: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		c, err := parseConfig(map[string]string{
+			"server-name":   "irc.example.com",
+			"ts6-sid":       "000",
+			"vhosts-config": file,
+		})
+		if err != nil {
+			t.Fatalf("parseConfig() failed: %s", err)
+		}
+
+		cb := &Catbox{Config: c}
+		if vhost := cb.configuredVhost(&User{Account: "horgh"}); vhost !=
+			"a.example.com" {
+			t.Fatalf("configuredVhost() = %s, wanted a.example.com", vhost)
+		}
+	}
+}
+
+func TestParseOperConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		output  *OperConfig
+		success bool
+	}{
+		{"testing", &OperConfig{Password: "testing"}, true},
+		{"testing, *@localhost *@127.0.0.*",
+			&OperConfig{Password: "testing",
+				Masks: []string{"*@localhost", "*@127.0.0.*"}}, true},
+		{"testing,,1", &OperConfig{Password: "testing", RequireTLS: true}, true},
+		{"", nil, false},
+		{"testing,localhost", nil, false},
+		{"testing,*@localhost,yes", nil, false},
+		{"testing,*@localhost,1,extra", nil, false},
+		{",,1," + strings.Repeat("AB", 32),
+			&OperConfig{RequireTLS: true, CertFP: strings.Repeat("ab", 32)}, true},
+		{"testing,,0," + strings.Repeat("ab", 32),
+			&OperConfig{Password: "testing", CertFP: strings.Repeat("ab", 32)},
+			true},
+		{",,1,", nil, false},
+		{"testing,,1,abcd", nil, false},
+		{"testing,,1," + strings.Repeat("zz", 32), nil, false},
+		{"testing,,1," + strings.Repeat("ab", 32) + ",extra", nil, false},
+	}
+
+	for _, test := range tests {
+		output, err := parseOperConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseOperConfig(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseOperConfig(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("parseOperConfig(%s) = %+v, wanted %+v", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestCanOper(t *testing.T) {
+	u := &LocalUser{
+		LocalClient: &LocalClient{Conn: Conn{}},
+		User: &User{
+			Username: "oper",
+			Hostname: "host.example.com",
+			IP:       "192.168.1.2",
+		},
+	}
+
+	tests := []struct {
+		oper   *OperConfig
+		output bool
+	}{
+		{&OperConfig{}, true},
+		{&OperConfig{Masks: []string{"*@*.example.com"}}, true},
+		{&OperConfig{Masks: []string{"*@127.0.0.1", "oper@192.168.*"}}, true},
+		{&OperConfig{Masks: []string{"other@*"}}, false},
+		{&OperConfig{Masks: []string{"*@*.example.net"}}, false},
+		{&OperConfig{Masks: []string{"*@192.168.0.0/16"}}, true},
+		{&OperConfig{Masks: []string{"*@10.0.0.0/8"}}, false},
+		{&OperConfig{RequireTLS: true}, false},
+	}
+
+	for _, test := range tests {
+		output := u.canOper(test.oper)
+		if output != test.output {
+			t.Errorf("canOper(%+v) = %v, wanted %v", test.oper, output, test.output)
+		}
+	}
+}
+
+func TestKLineIndex(t *testing.T) {
+	idx := newKLineIndex([]KLine{
+		{UserMask: "*", HostMask: "bad.example.com", Reason: "exact"},
+		{UserMask: "evil", HostMask: "192.168.0.0/16", Reason: "cidr"},
+		{UserMask: "*", HostMask: "2001:db8::/32", Reason: "cidr6"},
+		{UserMask: "*", HostMask: "*.example.net", Reason: "wildcard"},
+	})
+
+	tests := []struct {
+		user   User
+		reason string
+	}{
+		{User{Username: "a", Hostname: "bad.example.com", IP: "10.0.0.1"}, "exact"},
+		{User{Username: "a", Hostname: "BAD.Example.COM", IP: "10.0.0.1"}, "exact"},
+		{User{Username: "a", Hostname: "notbad.example.com", IP: "10.0.0.1"}, ""},
+		{User{Username: "evil", Hostname: "host", IP: "192.168.4.5"}, "cidr"},
+		{User{Username: "good", Hostname: "host", IP: "192.168.4.5"}, ""},
+		{User{Username: "evil", Hostname: "host", IP: "192.169.4.5"}, ""},
+		{User{Username: "a", Hostname: "host", IP: "2001:db8::1"}, "cidr6"},
+		{User{Username: "a", Hostname: "host", IP: "2001:db9::1"}, ""},
+		{User{Username: "a", Hostname: "x.example.net", IP: "10.0.0.1"}, "wildcard"},
+		{User{Username: "a", Hostname: "x.example.network", IP: "10.0.0.1"}, ""},
+	}
+
+	for _, test := range tests {
+		kline, matched := idx.match(&test.user)
+		if matched != (test.reason != "") || kline.Reason != test.reason {
+			t.Errorf("match(%+v) = %v, %v, wanted %s", test.user, kline, matched,
+				test.reason)
+		}
+	}
+
+	if !idx.has("EVIL", "192.168.0.0/16") {
+		t.Errorf("has() did not find the CIDR K-Line")
+	}
+	if !idx.remove("evil", "192.168.0.0/16") {
+		t.Errorf("remove() did not find the CIDR K-Line")
+	}
+	if _, matched := idx.match(&User{Username: "evil", IP: "192.168.4.5"}); matched {
+		t.Errorf("removed K-Line still matches")
+	}
+	if idx.remove("evil", "10.0.0.0/8") {
+		t.Errorf("remove() found a K-Line that does not exist")
+	}
+}
+
+func TestParseExemptConfig(t *testing.T) {
+	fp := strings.Repeat("AB", 32)
+
+	tests := []struct {
+		input   string
+		output  ExemptConfig
+		success bool
+	}{
+		{"mask, *@127.0.0.1", ExemptConfig{UserMask: "*", HostMask: "127.0.0.1"},
+			true},
+		{"mask,user@192.0.2.0/24",
+			ExemptConfig{UserMask: "user", HostMask: "192.0.2.0/24"}, true},
+		{"certfp," + fp, ExemptConfig{CertFP: strings.ToLower(fp)}, true},
+		{"mask,127.0.0.1", ExemptConfig{}, false},
+		{"mask,*@bad host", ExemptConfig{}, false},
+		{"certfp,abcdef", ExemptConfig{}, false},
+		{"account,horgh", ExemptConfig{}, false},
+		{"mask", ExemptConfig{}, false},
+	}
+
+	for _, test := range tests {
+		output, err := parseExemptConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseExemptConfig(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseExemptConfig(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+		if output != test.output {
+			t.Errorf("parseExemptConfig(%s) = %+v, wanted %+v", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestParseCertificateConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		output  CertificateConfig
+		success bool
+	}{
+		{"a.crt, a.key",
+			CertificateConfig{CertificateFile: "a.crt", KeyFile: "a.key"}, true},
+		{"a.crt,", CertificateConfig{}, false},
+		{"a.crt", CertificateConfig{}, false},
+		{"a.crt,a.key,b", CertificateConfig{}, false},
+	}
+
+	for _, test := range tests {
+		output, err := parseCertificateConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseCertificateConfig(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseCertificateConfig(%s) succeeded, wanted failure",
+				test.input)
+			continue
+		}
+		if output != test.output {
+			t.Errorf("parseCertificateConfig(%s) = %+v, wanted %+v", test.input,
+				output, test.output)
+		}
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	main := testCertificate(t, "irc.example.org")
+	a := testCertificate(t, "a.example.com")
+	b := testCertificate(t, "*.b.example.com")
+
+	cb := &Catbox{}
+	if _, err := cb.getCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Errorf("getCertificate() with no certificates succeeded")
+	}
+
+	cb.SNICertificates.Store([]*tls.Certificate{a, b})
+	if cert, err := cb.getCertificate(&tls.ClientHelloInfo{}); err != nil ||
+		cert != a {
+		t.Errorf("getCertificate() with no main certificate = %v, %v, wanted first",
+			cert, err)
+	}
+
+	cb.Certificate.Store(main)
+
+	tests := []struct {
+		name   string
+		output *tls.Certificate
+	}{
+		{"", main},
+		{"irc.example.org", main},
+		{"a.example.com", a},
+		{"A.EXAMPLE.COM", a},
+		{"irc.b.example.com", b},
+		{"b.example.com", main},
+		{"unknown.example.com", main},
+	}
+
+	for _, test := range tests {
+		cert, err := cb.getCertificate(&tls.ClientHelloInfo{ServerName: test.name})
+		if err != nil {
+			t.Errorf("getCertificate(%s) failed: %s", test.name, err)
+			continue
+		}
+		if cert != test.output {
+			t.Errorf("getCertificate(%s) = %v, wanted %v", test.name,
+				cert.Leaf.DNSNames, test.output.Leaf.DNSNames)
+		}
+	}
+}
+
+func TestCheckCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-certificates")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeCertificate := func(cert *tls.Certificate, modTime time.Time) {
+		key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		if err != nil {
+			t.Fatalf("error encoding key: %s", err)
+		}
+		if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+			t.Fatalf("error writing certificate: %s", err)
+		}
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+			Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+			t.Fatalf("error writing key: %s", err)
+		}
+		for _, file := range []string{certFile, keyFile} {
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatalf("error setting modification time: %s", err)
+			}
+		}
+	}
+
+	loaded := func(cb *Catbox) []byte {
+		cert, err := cb.getCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("getCertificate() failed: %s", err)
+		}
+		return cert.Certificate[0]
+	}
+
+	old := testCertificate(t, "irc.example.org")
+	writeCertificate(old, time.Now().Add(-time.Hour))
+
+	cb := &Catbox{
+		Config: &Config{
+			CertificateFile:      certFile,
+			KeyFile:              keyFile,
+			CertificateCheckTime: time.Minute,
+		},
+		TLSConfig: &tls.Config{},
+	}
+	if err := cb.loadCertificate(); err != nil {
+		t.Fatalf("loadCertificate() failed: %s", err)
+	}
+
+	renewed := testCertificate(t, "irc.example.org")
+	writeCertificate(renewed, time.Now())
+
+	// We checked recently.
+	cb.LastCertificateCheck = time.Now()
+	cb.checkCertificates()
+	if !reflect.DeepEqual(loaded(cb), old.Certificate[0]) {
+		t.Errorf("reloaded certificate before the check time")
+	}
+
+	cb.LastCertificateCheck = time.Time{}
+	cb.checkCertificates()
+	if !reflect.DeepEqual(loaded(cb), renewed.Certificate[0]) {
+		t.Errorf("did not reload changed certificate")
+	}
+
+	// A half written renewal. We keep what we have and try again.
+	if err := ioutil.WriteFile(keyFile, []byte("bad"), 0600); err != nil {
+		t.Fatalf("error writing key: %s", err)
+	}
+	cb.LastCertificateCheck = time.Time{}
+	cb.checkCertificates()
+	if !reflect.DeepEqual(loaded(cb), renewed.Certificate[0]) {
+		t.Errorf("lost certificate after failed reload")
+	}
+	if cb.LastCertificateError == "" {
+		t.Errorf("failed reload not recorded")
+	}
+}
+
+func TestMatchingKLine(t *testing.T) {
+	fp := strings.Repeat("ab", 32)
+
+	cb := &Catbox{
+		Config: &Config{
+			ExemptConfigs: []ExemptConfig{
+				{Name: "office", UserMask: "*", HostMask: "192.0.2.0/24"},
+				{Name: "cert", CertFP: fp},
+			},
+		},
+		KLineIndex: newKLineIndex([]KLine{
+			{UserMask: "*", HostMask: "*.example.com", Reason: "banned"},
+		}),
+	}
+
+	tests := []struct {
+		user   User
+		output bool
+	}{
+		{User{Username: "a", Hostname: "host.example.com", IP: "198.51.100.1"}, true},
+		{User{Username: "a", Hostname: "host.example.com", IP: "192.0.2.1"}, false},
+		{User{Username: "a", Hostname: "host.example.com", IP: "198.51.100.1",
+			CertFP: fp}, false},
+		{User{Username: "a", Hostname: "host.example.net", IP: "198.51.100.1"}, false},
+	}
+
+	for _, test := range tests {
+		_, output := cb.matchingKLine(&test.user)
+		if output != test.output {
+			t.Errorf("matchingKLine(%+v) = %v, wanted %v", test.user, output,
+				test.output)
+		}
+	}
+}
+
+func TestChannelRegistrationHasAccess(t *testing.T) {
+	reg := &ChannelRegistration{
+		Name:    "#test",
+		Founder: "horgh",
+		Ops:     []string{"will"},
+	}
+
+	tests := []struct {
+		account string
+		output  bool
+	}{
+		{"horgh", true},
+		{"HORGH", true},
+		{"will", true},
+		{"bob", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		output := reg.hasAccess(test.account)
+		if output != test.output {
+			t.Errorf("hasAccess(%s) = %v, wanted %v", test.account, output,
+				test.output)
+		}
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		input   string
+		output  ServerDefinition
+		success bool
+	}{
+		{"127.0.0.1,6697,testing,1",
+			ServerDefinition{Name: "irc", Hostname: "127.0.0.1", Port: 6697,
+				Pass: "testing", TLS: true, AutoConnect: true}, true},
+		{"127.0.0.1,0,testing,0,1",
+			ServerDefinition{Name: "irc", Hostname: "127.0.0.1", Pass: "testing",
+				Services: true, AutoConnect: true}, true},
+		{"192.0.2.1,6697,testing,1,0,192.0.2.10",
+			ServerDefinition{Name: "irc", Hostname: "192.0.2.1", Port: 6697,
+				Pass: "testing", TLS: true, BindAddress: "192.0.2.10",
+				AutoConnect: true}, true},
+		{"192.0.2.1,6697,testing,1,0,",
+			ServerDefinition{Name: "irc", Hostname: "192.0.2.1", Port: 6697,
+				Pass: "testing", TLS: true, AutoConnect: true}, true},
+		{"192.0.2.1,6697,testing,1,0,,leaf,0",
+			ServerDefinition{Name: "irc", Hostname: "192.0.2.1", Port: 6697,
+				Pass: "testing", TLS: true, Class: "leaf"}, true},
+		{"192.0.2.1,6697,testing,1,0,example.com", ServerDefinition{}, false},
+		{"192.0.2.1,6697,testing", ServerDefinition{}, false},
+	}
+
+	for _, test := range tests {
+		output, err := parseLink("irc", test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseLink(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseLink(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+		if *output != test.output {
+			t.Errorf("parseLink(%s) = %+v, wanted %+v", test.input, *output,
+				test.output)
+		}
+	}
+}
+
+func TestConnectInterval(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			ConnectAttemptTime: time.Minute,
+			ConnectClasses:     map[string]time.Duration{"hub": 10 * time.Second},
+			ConnectMaxBackoff:  time.Hour,
+		},
+	}
+
+	tests := []struct {
+		class    string
+		failures int
+		interval time.Duration
+	}{
+		{"", 0, time.Minute},
+		{"", 1, time.Minute},
+		{"", 3, 4 * time.Minute},
+		{"", 20, time.Hour},
+		{"hub", 1, 10 * time.Second},
+		{"hub", 2, 20 * time.Second},
+	}
+
+	for _, test := range tests {
+		interval := cb.connectInterval(&ServerDefinition{Class: test.class},
+			test.failures)
+		jitter := test.interval / 10
+		if interval < test.interval-jitter || interval > test.interval+jitter {
+			t.Errorf("connectInterval(%s, %d) = %s, wanted %s (+/- 10%%)",
+				test.class, test.failures, interval, test.interval)
+		}
+	}
+}
+
+func TestHostResolver(t *testing.T) {
+	shutdownChan := make(chan struct{})
+	r := newHostResolver(time.Second, time.Hour, time.Minute, shutdownChan)
+
+	var mutex sync.Mutex
+	lookups := map[string]int{}
+	release := make(chan struct{})
+	r.lookupFunc = func(ctx context.Context, ip net.IP) string {
+		<-release
+		mutex.Lock()
+		lookups[ip.String()]++
+		mutex.Unlock()
+		if ip.Equal(net.ParseIP("192.0.2.1")) {
+			return "irc.example.org"
+		}
+		return ""
+	}
+
+	var wg sync.WaitGroup
+	r.start(1, &wg)
+	defer func() {
+		close(shutdownChan)
+		wg.Wait()
+	}()
+
+	found := net.ParseIP("192.0.2.1")
+	notFound := net.ParseIP("192.0.2.2")
+
+	// Lookups of the same IP in progress at once share one lookup.
+	a := r.lookup(found)
+	b := r.lookup(found)
+	c := r.lookup(notFound)
+	close(release)
+
+	if got := <-a; got != "irc.example.org" {
+		t.Errorf("lookup = %s, wanted irc.example.org", got)
+	}
+	if got := <-b; got != "irc.example.org" {
+		t.Errorf("lookup = %s, wanted irc.example.org", got)
+	}
+	if got := <-c; got != "" {
+		t.Errorf("lookup = %s, wanted none", got)
+	}
+
+	// We remember both what we found and that we found nothing.
+	if got := <-r.lookup(found); got != "irc.example.org" {
+		t.Errorf("cached lookup = %s, wanted irc.example.org", got)
+	}
+	if got := <-r.lookup(notFound); got != "" {
+		t.Errorf("cached lookup = %s, wanted none", got)
+	}
+
+	mutex.Lock()
+	if lookups[found.String()] != 1 || lookups[notFound.String()] != 1 {
+		t.Errorf("lookups = %v, wanted one of each", lookups)
+	}
+	mutex.Unlock()
+
+	// Once it expires we look it up again.
+	r.mutex.Lock()
+	r.cache[notFound.String()] = resolverCacheEntry{expires: time.Now()}
+	r.mutex.Unlock()
+	<-r.lookup(notFound)
+	mutex.Lock()
+	if lookups[notFound.String()] != 2 {
+		t.Errorf("expired entry not looked up again")
+	}
+	mutex.Unlock()
+}
+
+func TestHostResolverBusy(t *testing.T) {
+	r := newHostResolver(time.Second, time.Hour, time.Minute, nil)
+
+	// With no workers the queue fills. We answer right away then.
+	for i := 0; i < resolverQueueSize; i++ {
+		r.lookup(net.IPv4(10, 0, byte(i/256), byte(i%256)))
+	}
+
+	select {
+	case got := <-r.lookup(net.ParseIP("192.0.2.1")):
+		if got != "" {
+			t.Errorf("lookup = %s, wanted none", got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("lookup blocked when busy")
+	}
+}
+
+func TestTS6IP(t *testing.T) {
+	tests := []struct {
+		ip    string
+		ts6IP string
+	}{
+		{"127.0.0.1", "127.0.0.1"},
+		{"::1", "0::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		ip := ts6IP(net.ParseIP(test.ip))
+		if ip != test.ts6IP {
+			t.Errorf("ts6IP(%s) = %s, wanted %s", test.ip, ip, test.ts6IP)
+		}
+		if !isValidTS6IP(ip) {
+			t.Errorf("isValidTS6IP(%s) = false, wanted true", ip)
+		}
+	}
+
+	invalid := []string{"", "::1", ":1", "1.2.3", "host.example.com"}
+	for _, ip := range invalid {
+		if isValidTS6IP(ip) {
+			t.Errorf("isValidTS6IP(%s) = true, wanted false", ip)
+		}
+	}
+	if !isValidTS6IP("0") {
+		t.Errorf("isValidTS6IP(0) = false, wanted true")
+	}
+}
+
+func TestIsValidHostMask(t *testing.T) {
+	tests := []struct {
+		mask  string
+		valid bool
+	}{
+		{"*.example.com", true},
+		{"192.168.0.0/16", true},
+		{"2001:db8::/32", true},
+		{"2001:db8::1", true},
+		{"2001:db8:*", true},
+		{"0::1", true},
+		{"::1", false},
+		{"::1/128", false},
+		{"", false},
+		{"bad host", false},
+	}
+
+	for _, test := range tests {
+		if valid := isValidHostMask(test.mask); valid != test.valid {
+			t.Errorf("isValidHostMask(%s) = %v, wanted %v", test.mask, valid,
+				test.valid)
+		}
+	}
+}
+
+func TestCloakHostIPv6(t *testing.T) {
+	a := cloakHost("secret", "2001:db8:1:2::1")
+	b := cloakHost("secret", "2001:db8:1:2:ffff::9")
+	c := cloakHost("secret", "2001:db8:1:3::1")
+
+	if a == b {
+		t.Errorf("different IPs have the same cloak: %s", a)
+	}
+
+	// The same /64 has the same suffix so a ban can cover it.
+	suffix := func(cloak string) string {
+		return cloak[strings.Index(cloak, "."):]
+	}
+	if suffix(a) != suffix(b) {
+		t.Errorf("same /64 has different cloak suffixes: %s, %s", a, b)
+	}
+	if suffix(a) == suffix(c) {
+		t.Errorf("different /64s have the same cloak suffix: %s, %s", a, c)
+	}
+
+	user := User{
+		DisplayNick: "nick",
+		Username:    "test",
+		Hostname:    "2001:db8:1:2::1",
+		DisplayHost: a,
+		IP:          "2001:db8:1:2::1",
+	}
+	if !user.matchesChannelMask("*!*@*" + suffix(b)) {
+		t.Errorf("user does not match ban on their /64's cloak")
+	}
+	if !user.matchesUserHostMask("*", "2001:db8:1:2::/64") {
+		t.Errorf("user does not match their /64")
+	}
+	if !user.matchesUserHostMask("*", "2001:db8:1:2:*") {
+		t.Errorf("user does not match mask of their IP")
+	}
+}
+
+func TestWHOISCertFP(t *testing.T) {
+	cb := &Catbox{Config: &Config{ServerName: "irc.example.org"}}
+
+	certFP := strings.Repeat("ab", 32)
+	user := &User{
+		DisplayNick: "user1",
+		Modes:       map[byte]struct{}{},
+		CertFP:      certFP,
+	}
+	other := &User{DisplayNick: "user2", Modes: map[byte]struct{}{}}
+	oper := &User{DisplayNick: "oper1", Modes: map[byte]struct{}{'o': {}}}
+
+	tests := []struct {
+		replyUser *User
+		shown     bool
+	}{
+		{user, true},
+		{other, false},
+		{oper, true},
+	}
+
+	for _, test := range tests {
+		shown := false
+		for _, m := range cb.createWHOISResponse(user, test.replyUser, false) {
+			if m.Command != "276" {
+				continue
+			}
+			shown = true
+			if !strings.HasSuffix(m.Params[2], certFP) {
+				t.Errorf("276 to %s = %v, wanted fingerprint", test.replyUser.DisplayNick,
+					m.Params)
+			}
+		}
+		if shown != test.shown {
+			t.Errorf("276 shown to %s = %v, wanted %v", test.replyUser.DisplayNick,
+				shown, test.shown)
+		}
+	}
+}
+
+func TestChangedConfigSections(t *testing.T) {
+	// Every field is in a section so we don't forget to tell operators about
+	// it.
+	sectioned := map[string]struct{}{}
+	for _, section := range configSections {
+		for _, field := range section.fields {
+			if _, exists := reflect.TypeOf(Config{}).FieldByName(field); !exists {
+				t.Errorf("section %s has unknown field %s", section.name, field)
+			}
+			sectioned[field] = struct{}{}
+		}
+	}
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		if _, exists := sectioned[configType.Field(i).Name]; !exists {
+			t.Errorf("field %s is in no section", configType.Field(i).Name)
+		}
+	}
+
+	oldConfig := &Config{
+		ListenPort: "6667",
+		MOTD:       "hi",
+		ServerName: "irc.example.org",
+		Opers:      map[string]*OperConfig{"oper": {Name: "oper"}},
+	}
+	newConfig := &Config{
+		ListenPort: "6668",
+		MOTD:       "hi",
+		ServerName: "irc2.example.org",
+		Opers:      map[string]*OperConfig{"oper": {Name: "oper"}},
+	}
+
+	live, restart := changedConfigSections(oldConfig, newConfig)
+	if !reflect.DeepEqual(live, []string{"listeners"}) {
+		t.Errorf("live changes = %v, wanted listeners", live)
+	}
+	if !reflect.DeepEqual(restart, []string{"server-name"}) {
+		t.Errorf("restart changes = %v, wanted server-name", restart)
+	}
+
+	live, restart = changedConfigSections(oldConfig, oldConfig)
+	if len(live) != 0 || len(restart) != 0 {
+		t.Errorf("changes = %v, %v, wanted none", live, restart)
+	}
+	if describeConfigChanges(live, restart) != "Nothing changed." {
+		t.Errorf("describeConfigChanges() = %s", describeConfigChanges(live,
+			restart))
+	}
+}
+
+func TestCheckAndParseYAMLConfig(t *testing.T) {
+	c, err := checkAndParseConfig(filepath.Join("conf", "catbox.yaml"))
+	if err != nil {
+		t.Fatalf("unable to parse example YAML config: %s", err)
+	}
+
+	if c.ServerName != "irc.example.com" || c.TS6SID != "000" ||
+		c.PingTime != 30*time.Second || c.ListenPort != "6667" ||
+		c.ListenPortTLS != "-1" {
+		t.Errorf("options parsed wrong: %+v", c)
+	}
+	if c.NetworkName != "ExampleNet" ||
+		c.NetworkDescription != "An example network" ||
+		c.NetworkAdmin != "Network staff <staff@example.com>" {
+		t.Errorf("network parsed wrong: %+v", c)
+	}
+	// Defaults apply to options not in the config.
+	if c.DeadTime != 240*time.Second {
+		t.Errorf("dead time = %s, wanted default", c.DeadTime)
+	}
+
+	wantOper := &OperConfig{
+		Name:     "oper1",
+		Password: "password",
+		Masks:    []string{"*@127.0.0.1"},
+	}
+	if !reflect.DeepEqual(c.Opers, map[string]*OperConfig{"oper1": wantOper}) {
+		t.Errorf("opers = %+v, wanted %+v", c.Opers, wantOper)
+	}
+
+	wantLink := &ServerDefinition{
+		Name:        "irc2.example.com",
+		Hostname:    "127.0.0.1",
+		Port:        7000,
+		Pass:        "password",
+		Class:       "hubs",
+		AutoConnect: true,
+	}
+	if !reflect.DeepEqual(c.Servers,
+		map[string]*ServerDefinition{"irc2.example.com": wantLink}) {
+		t.Errorf("links = %+v, wanted %+v", c.Servers, wantLink)
+	}
+	if c.ConnectClasses["hubs"] != 5*time.Second {
+		t.Errorf("connect classes = %v", c.ConnectClasses)
+	}
+
+	wantUsers := []UserConfig{{Name: "local", UserMask: "*",
+		HostMask: "127.0.0.1", FloodExempt: true}}
+	if !reflect.DeepEqual(c.UserConfigs, wantUsers) {
+		t.Errorf("classes = %+v, wanted %+v", c.UserConfigs, wantUsers)
+	}
+
+	wantVhosts := []VhostConfig{{Name: "admin", Account: "admin",
+		Vhost: "admin.example.com"}}
+	if !reflect.DeepEqual(c.VhostConfigs, wantVhosts) {
+		t.Errorf("vhosts = %+v, wanted %+v", c.VhostConfigs, wantVhosts)
+	}
+
+	wantExempts := []ExemptConfig{{Name: "local", UserMask: "*",
+		HostMask: "127.0.0.1"}}
+	if !reflect.DeepEqual(c.ExemptConfigs, wantExempts) {
+		t.Errorf("exempts = %+v, wanted %+v", c.ExemptConfigs, wantExempts)
+	}
+}
+
+func TestCheckAndParseYAMLConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-config")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	tests := []struct {
+		input string
+		error string
+	}{
+		{"server-name: irc.example.com\nbogus: 1\n", "unknown option: bogus"},
+		{"opers-config: opers.conf\n", "opers-config: use the opers section"},
+		{"listen-port: 6667\nlisteners:\n  port: 6668\n",
+			"listen-port: use the listeners section"},
+		{"listeners:\n  prot: 6668\n", "line 2: field prot not found"},
+		{"motd:\n  - a\n", "line 2: cannot unmarshal"},
+		{"ping-time: soon\n", "ping time is in invalid format"},
+		{"opers:\n  oper1:\n    masks: [\"bad\"]\n    password: x\n",
+			"opers: oper1: invalid mask: bad"},
+		{"opers:\n  oper1:\n    masks: []\n", "opers: oper1: missing password"},
+		{"links:\n  irc2:\n    host: a\n    password: b\n    class: c\n",
+			"links: irc2: unknown connect class: c"},
+		{"classes:\n  a:\n    user-mask: \"*\"\n    host-mask: \"bad host\"\n",
+			"classes: a: invalid host mask"},
+		{"vhosts:\n  a:\n    vhost: a.example.com\n",
+			"vhosts: a: you must specify one of account and certfp"},
+		{"exempts:\n  a:\n    certfp: abc\n",
+			"exempts: a: invalid certificate fingerprint"},
+		{"connect-classes:\n  a: often\n", "connect-classes: a: invalid frequency"},
+		{"debug-listen: 0.0.0.0:6060\n",
+			"debug listen address must be a loopback address"},
+		{"api-listen: 127.0.0.1:6061\n", "you must set api-token to use api-listen"},
+	}
+
+	for _, test := range tests {
+		file := filepath.Join(dir, "catbox.yml")
+		if err := ioutil.WriteFile(file, []byte(test.input), 0600); err != nil {
+			t.Fatalf("error writing config: %s", err)
+		}
+
+		_, err := checkAndParseConfig(file)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("checkAndParseConfig(%q) = %v, wanted error %q", test.input,
+				err, test.error)
+		}
+	}
+}
+
+func TestPIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-pid")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "catbox.pid")
+	ourPID := fmt.Sprintf("%d\n", os.Getpid())
+
+	// A stale file we replace. No process has the largest possible ID.
+	if err := ioutil.WriteFile(file, []byte("2147483647\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+	if err := writePIDFile(file); err != nil {
+		t.Fatalf("writePIDFile() with stale file failed: %s", err)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil || string(buf) != ourPID {
+		t.Fatalf("pid file = %q, %v, wanted %q", buf, err, ourPID)
+	}
+
+	// We may write it again, e.g., after we restart.
+	if err := writePIDFile(file); err != nil {
+		t.Fatalf("writePIDFile() with our own file failed: %s", err)
+	}
+
+	// Another running process has it.
+	if err := ioutil.WriteFile(file, []byte("1\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+	if err := writePIDFile(file); err == nil {
+		t.Fatalf("writePIDFile() with a running process's file succeeded")
+	}
+
+	// We leave a file that isn't ours.
+	removePIDFile(file)
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("removePIDFile() removed another process's file: %s", err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(ourPID), 0644); err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+	removePIDFile(file)
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("removePIDFile() left our file: %v", err)
+	}
+}
+
+func TestSystemdNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-systemd")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	n := newSystemdNotifier(socket, "2000000", "")
+	if n.watchdogInterval != time.Second {
+		t.Errorf("watchdog interval = %s, wanted 1s", n.watchdogInterval)
+	}
+
+	// We skip repeated statuses and watchdog notifications that are too soon,
+	// so we should receive only these.
+	n.ready("1 users")
+	n.status("1 users")
+	n.status("2 users")
+	n.watchdog()
+	n.watchdog()
+	n.stopping()
+
+	wanted := []string{"READY=1\nSTATUS=1 users", "STATUS=2 users",
+		"WATCHDOG=1", "STOPPING=1"}
+	buf := make([]byte, 1024)
+	for _, want := range wanted {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("unable to set deadline: %s", err)
+		}
+		sz, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("unable to read: %s", err)
+		}
+		if string(buf[:sz]) != want {
+			t.Errorf("received %q, wanted %q", buf[:sz], want)
+		}
+	}
+
+	// The watchdog is for another process.
+	n = newSystemdNotifier(socket, "2000000", "1")
+	if n.watchdogInterval != 0 {
+		t.Errorf("watchdog interval = %s, wanted 0", n.watchdogInterval)
+	}
+
+	// Without a socket we do nothing.
+	n = newSystemdNotifier("", "", "")
+	n.ready("1 users")
+	n.watchdog()
+}
+
+func TestParseLogLevels(t *testing.T) {
+	tests := []struct {
+		input  string
+		output map[string]LogLevel
+		error  string
+	}{
+		{"info", map[string]LogLevel{"core": LogInfo, "clients": LogInfo,
+			"s2s": LogInfo, "dns": LogInfo, "flood": LogInfo}, ""},
+		{"warn s2s=debug dns=ERROR", map[string]LogLevel{"core": LogWarn,
+			"clients": LogWarn, "s2s": LogDebug, "dns": LogError, "flood": LogWarn},
+			""},
+		{"flood=debug", map[string]LogLevel{"core": LogInfo, "clients": LogInfo,
+			"s2s": LogInfo, "dns": LogInfo, "flood": LogDebug}, ""},
+		{"loud", nil, "invalid log level: loud"},
+		{"s2s=debug info", nil, "must be first"},
+		{"info bogus=debug", nil, "unknown log subsystem: bogus"},
+		{"info s2s=loud", nil, "invalid log level: loud"},
+	}
+
+	for _, test := range tests {
+		levels, err := parseLogLevels(test.input)
+		if test.error != "" {
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("parseLogLevels(%q) = %v, wanted error %q", test.input, err,
+					test.error)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLogLevels(%q) failed: %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(levels, test.output) {
+			t.Errorf("parseLogLevels(%q) = %v, wanted %v", test.input, levels,
+				test.output)
+		}
+	}
+}
+
+func TestLogSinkWrite(t *testing.T) {
+	buf := &strings.Builder{}
+	s := &logSink{out: buf, levels: defaultLogLevels()}
+
+	s.write("s2s", LogDebug, "hidden")
+	s.write("s2s", LogInfo, "Connected to irc2")
+	if !strings.HasSuffix(buf.String(), " INFO s2s: Connected to irc2\n") ||
+		strings.Contains(buf.String(), "hidden") {
+		t.Fatalf("text log = %q", buf.String())
+	}
+
+	buf.Reset()
+	s.json = true
+	s.levels["dns"] = LogDebug
+	s.write("dns", LogDebug, "Found \"host\"")
+	if !strings.Contains(buf.String(),
+		`"level":"debug","subsystem":"dns","message":"Found \"host\""}`) {
+		t.Fatalf("JSON log = %q", buf.String())
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-log")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "catbox.log")
+	s := &logSink{levels: defaultLogLevels(), rotateSize: 100, rotateCount: 2}
+	if err := s.openFile(file); err != nil {
+		t.Fatalf("openFile() failed: %s", err)
+	}
+	defer func() {
+		_ = s.file.Close()
+	}()
+
+	// Each line is over half the limit so each goes in its own file.
+	msg := strings.Repeat("x", 60)
+	for i := 0; i < 4; i++ {
+		s.write("core", LogInfo, fmt.Sprintf("%d %s", i, msg))
+	}
+
+	for i, suffix := range []string{"", ".1", ".2"} {
+		buf, err := ioutil.ReadFile(file + suffix)
+		if err != nil {
+			t.Fatalf("unable to read %s: %s", file+suffix, err)
+		}
+		want := fmt.Sprintf("INFO core: %d %s\n", 3-i, msg)
+		if !strings.HasSuffix(string(buf), want) ||
+			strings.Count(string(buf), "\n") != 1 {
+			t.Errorf("%s = %q, wanted one line ending %q", file+suffix, buf, want)
+		}
+	}
+
+	// We keep only rotateCount old files.
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists: %v", file, err)
+	}
+}
+
+func TestConfigureEventLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-log")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	defer func() {
+		_ = configureEventLogs(&Config{})
+	}()
+
+	file := filepath.Join(dir, "oper.log")
+	if err := configureEventLogs(&Config{
+		EventLogFiles: map[string]string{"oper": file},
+	}); err != nil {
+		t.Fatalf("configureEventLogs() failed: %s", err)
+	}
+
+	logEvent("oper", "oper1 used %s", "DIE")
+	logEvent("kill", "not logged")
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unable to read log: %s", err)
+	}
+	if !strings.HasSuffix(string(buf), " INFO oper: oper1 used DIE\n") ||
+		strings.Count(string(buf), "\n") != 1 {
+		t.Fatalf("oper log = %q", buf)
+	}
+
+	// We stop logging categories no longer configured.
+	if err := configureEventLogs(&Config{}); err != nil {
+		t.Fatalf("configureEventLogs() failed: %s", err)
+	}
+	logEvent("oper", "oper1 used RESTART")
+	buf, err = ioutil.ReadFile(file)
+	if err != nil || strings.Contains(string(buf), "RESTART") {
+		t.Fatalf("oper log = %q, %v", buf, err)
+	}
+
+	err = configureEventLogs(&Config{
+		EventLogFiles: map[string]string{
+			"kill": filepath.Join(dir, "missing", "kill.log"),
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "unable to open kill log file") {
+		t.Fatalf("configureEventLogs() with bad file = %v", err)
+	}
+}
+
+func TestCheckLoopbackAddress(t *testing.T) {
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"127.0.0.1:6060", true},
+		{"[::1]:6060", true},
+		{"localhost:6060", true},
+		{"0.0.0.0:6060", false},
+		{"192.0.2.1:6060", false},
+		{":6060", false},
+		{"127.0.0.1", false},
+		{"127.0.0.1:", false},
+	}
+
+	for _, test := range tests {
+		err := checkLoopbackAddress(test.input)
+		if test.ok && err != nil {
+			t.Errorf("checkLoopbackAddress(%q) = %s, wanted success", test.input,
+				err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("checkLoopbackAddress(%q) succeeded, wanted error", test.input)
+		}
+	}
+}
+
+func TestEncodeTags(t *testing.T) {
+	tests := []struct {
+		input  []MessageTag
+		output string
+	}{
+		{nil, ""},
+		{[]MessageTag{{Key: "batch", Value: "1"}}, "batch=1"},
+		{
+			[]MessageTag{
+				{Key: "a", Value: "x;y z\\"},
+				{Key: "b"},
+				{Key: "c", Value: "1\r\n"},
+			},
+			`a=x\:y\sz\\;b;c=1\r\n`,
+		},
+	}
+
+	for _, test := range tests {
+		output := encodeTags(test.input)
+		if output != test.output {
+			t.Errorf("encodeTags(%v) = %s, wanted %s", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestChannelHistory(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(i int) time.Time {
+		return start.Add(time.Duration(i) * time.Minute)
+	}
+
+	h := &ChannelHistory{Channels: map[string][]HistoryMessage{}}
+	for i := 0; i < 12; i++ {
+		h.add("#test", HistoryMessage{Time: at(i), Text: fmt.Sprintf("%d", i)},
+			10)
+	}
+	messages := h.Channels["#test"]
+
+	texts := func(messages []HistoryMessage) string {
+		var s []string
+		for _, m := range messages {
+			s = append(s, m.Text)
+		}
+		return strings.Join(s, " ")
+	}
+
+	if texts(messages) != "2 3 4 5 6 7 8 9 10 11" {
+		t.Fatalf("history is %s, wanted the latest 10", texts(messages))
+	}
+
+	tests := []struct {
+		name   string
+		result []HistoryMessage
+		want   string
+	}{
+		{"latest", latestHistory(messages, time.Time{}, 3), "9 10 11"},
+		{"latest after", latestHistory(messages, at(8), 5), "9 10 11"},
+		{"before", historyBefore(messages, at(5), 2), "3 4"},
+		{"before start", historyBefore(messages, at(3), 5), "2"},
+		{"after", historySince(messages, at(5), 2), "6 7"},
+		{"after end", historySince(messages, at(11), 2), ""},
+		{"around", historyAround(messages, at(6), 4), "4 5 6 7"},
+		{"between", historyBetween(messages, at(3), at(9), 3), "4 5 6"},
+		{"between backwards", historyBetween(messages, at(9), at(3), 3),
+			"6 7 8"},
+	}
+
+	for _, test := range tests {
+		if texts(test.result) != test.want {
+			t.Errorf("%s: got %q, wanted %q", test.name, texts(test.result),
+				test.want)
+		}
+	}
+
+	h.add("#old", HistoryMessage{Time: at(0)}, 10)
+	h.expire(at(12), 5*time.Minute, 3)
+	if _, exists := h.Channels["#old"]; exists {
+		t.Errorf("#old has history after expiring")
+	}
+	if texts(h.Channels["#test"]) != "9 10 11" {
+		t.Errorf("after expiring, history is %s, wanted 9 10 11",
+			texts(h.Channels["#test"]))
+	}
+
+	// A channel made after some of the messages doesn't show them.
+	cb := &Catbox{History: h}
+	channel := NewChannel("#test", at(10).Unix())
+	if texts(cb.channelHistory(channel)) != "10 11" {
+		t.Errorf("channel history is %s, wanted 10 11",
+			texts(cb.channelHistory(channel)))
+	}
+}
+
+func TestSavedChannel(t *testing.T) {
+	c := NewChannel("#test", 1000)
+	c.Topic = "topic"
+	c.TopicSetter = "nick!user@host"
+	c.TopicTS = 1001
+	c.Modes['n'] = struct{}{}
+	c.Modes['t'] = struct{}{}
+	c.Key = "key"
+	c.Limit = 5
+	c.setJoinThrottle(3, 10)
+	c.Lists['b'] = []ChannelMask{{Mask: "bad!*@*", SetBy: "nick", SetTS: 1002}}
+
+	buf, err := json.Marshal(newSavedChannel(c, time.Now()))
+	if err != nil {
+		t.Fatalf("unable to encode: %s", err)
+	}
+	saved := &SavedChannel{}
+	if err := json.Unmarshal(buf, saved); err != nil {
+		t.Fatalf("unable to decode: %s", err)
+	}
+
+	restored := NewChannel("#test", 2000)
+	restored.Modes['s'] = struct{}{}
+	saved.restore(restored)
+
+	if restored.TS != c.TS || restored.Topic != c.Topic ||
+		restored.TopicSetter != c.TopicSetter || restored.TopicTS != c.TopicTS {
+		t.Errorf("restored TS and topic %d %s %s %d, wanted %d %s %s %d",
+			restored.TS, restored.Topic, restored.TopicSetter, restored.TopicTS,
+			c.TS, c.Topic, c.TopicSetter, c.TopicTS)
+	}
+	if restored.modesString() != c.modesString() ||
+		!reflect.DeepEqual(restored.modeParams(), c.modeParams()) {
+		t.Errorf("restored modes %s %v, wanted %s %v", restored.modesString(),
+			restored.modeParams(), c.modesString(), c.modeParams())
+	}
+	if !reflect.DeepEqual(restored.Lists, c.Lists) {
+		t.Errorf("restored lists %v, wanted %v", restored.Lists, c.Lists)
+	}
+}
+
+func TestStateDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-state")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "state.db")
+
+	db, err := openStateDB(file)
+	if err != nil {
+		t.Fatalf("openStateDB() of missing file failed: %s", err)
+	}
+
+	stats := &NetStats{Days: []DayStats{{Date: "2019-07-08", PeakUsers: 10}}}
+	if err := stats.save(db, "stats"); err != nil {
+		t.Fatalf("save() failed: %s", err)
+	}
+	bans := &Bans{KLines: []KLine{{UserMask: "*", HostMask: "127.0.0.1",
+		Reason: "bye"}}}
+	if err := bans.save(db, "bans"); err != nil {
+		t.Fatalf("save() failed: %s", err)
+	}
+
+	// We see what we saved before it's written.
+	loadedStats, err := loadNetStats(db, "stats")
+	if err != nil || !reflect.DeepEqual(loadedStats, stats) {
+		t.Errorf("loadNetStats() = %v, %v, wanted %v", loadedStats, err, stats)
+	}
+
+	// Another process can't open the database while we have it open.
+	if _, err := openStateDB(file); err == nil {
+		t.Errorf("openStateDB() of open database succeeded")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() failed: %s", err)
+	}
+	if err := stats.save(db, "stats"); err == nil {
+		t.Errorf("save() after Close() succeeded")
+	}
+
+	db, err = openStateDB(file)
+	if err != nil {
+		t.Fatalf("openStateDB() failed: %s", err)
+	}
+
+	loadedStats, err = loadNetStats(db, "stats")
+	if err != nil || !reflect.DeepEqual(loadedStats, stats) {
+		t.Errorf("loadNetStats() = %v, %v, wanted %v", loadedStats, err, stats)
+	}
+	loadedBans, err := loadBans(db, "bans")
+	if err != nil || !reflect.DeepEqual(loadedBans, bans) {
+		t.Errorf("loadBans() = %v, %v, wanted %v", loadedBans, err, bans)
+	}
+
+	accounts, err := loadNickAccounts(db, "nickserv")
+	if err != nil || len(accounts) != 0 {
+		t.Errorf("loadNickAccounts() of missing state = %v, %v, wanted none",
+			accounts, err)
+	}
+
+	// Saving replaces what we had.
+	stats.Days[0].PeakUsers = 20
+	if err := stats.save(db, "stats"); err != nil {
+		t.Fatalf("save() failed: %s", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() failed: %s", err)
+	}
+	db, err = openStateDB(file)
+	if err != nil {
+		t.Fatalf("openStateDB() failed: %s", err)
+	}
+	loadedStats, err = loadNetStats(db, "stats")
+	if err != nil || loadedStats.Days[0].PeakUsers != 20 {
+		t.Errorf("loadNetStats() = %v, %v, wanted the latest", loadedStats, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() failed: %s", err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("{}"), 0600); err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+	if _, err := openStateDB(file); err == nil {
+		t.Errorf("openStateDB() of invalid file succeeded")
+	}
+}
+
+func TestOperFailuresWait(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		count  int
+		last   time.Time
+		output time.Duration
+	}{
+		{0, time.Time{}, 0},
+		{operFailuresAllowed, now, 0},
+		{operFailuresAllowed + 1, now, operFailureDelay},
+		{operFailuresAllowed + 2, now, 2 * operFailureDelay},
+		{operFailuresAllowed + 1, now.Add(-operFailureDelay), 0},
+		{operFailuresAllowed + 100, now, operFailureMaxDelay},
+	}
+
+	for _, test := range tests {
+		f := OperFailures{Count: test.count, Last: test.last}
+		output := f.wait(now)
+		if output != test.output {
+			t.Errorf("OperFailures{%d, %s}.wait() = %s, wanted %s", test.count,
+				test.last, output, test.output)
+		}
+	}
+}
+
+func TestParseReserveConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		output  ReserveConfig
+		success bool
+	}{
+		{"*Serv", ReserveConfig{Mask: "*Serv"}, true},
+		{" #opers , Operators only, sorry",
+			ReserveConfig{Mask: "#opers", Reason: "Operators only, sorry"}, true},
+		{"", ReserveConfig{}, false},
+		{"bad mask,reason", ReserveConfig{}, false},
+	}
+
+	for _, test := range tests {
+		output, err := parseReserveConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseReserveConfig(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseReserveConfig(%s) succeeded, wanted failure", test.input)
+			continue
+		}
+		if output != test.output {
+			t.Errorf("parseReserveConfig(%s) = %+v, wanted %+v", test.input, output,
+				test.output)
+		}
+	}
+}
+
+func TestParseSpamFilterConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		output  SpamFilterConfig
+		success bool
+	}{
+		{"*buy cheap*", SpamFilterConfig{Mask: "*buy cheap*"}, true},
+		{" *spam* , No spam, please",
+			SpamFilterConfig{Mask: "*spam*", Reason: "No spam, please"}, true},
+		{"", SpamFilterConfig{}, false},
+		{"**,Everything", SpamFilterConfig{}, false},
+	}
+
+	for _, test := range tests {
+		output, err := parseSpamFilterConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseSpamFilterConfig(%s) failed: %s", test.input, err)
+			}
+			continue
+		}
+		if !test.success {
+			t.Errorf("parseSpamFilterConfig(%s) succeeded, wanted failure",
+				test.input)
+			continue
+		}
+		if output != test.output {
+			t.Errorf("parseSpamFilterConfig(%s) = %+v, wanted %+v", test.input,
+				output, test.output)
+		}
+	}
+}
+
+func TestReservation(t *testing.T) {
+	cb := &Catbox{Config: &Config{ReserveConfigs: []ReserveConfig{
+		{Name: "services", Mask: "*serv"},
+		{Name: "opers", Mask: "#opers*", Reason: "Operators only"},
+		{Name: "away", Mask: "*[away]"},
+	}}}
+
+	tests := []struct {
+		input    string
+		reserved bool
+		name     string
+	}{
+		{"NickServ", true, "services"},
+		{"nick", false, ""},
+		{"nick[away]", true, "away"},
+		{"Nick{AWAY}", true, "away"},
+		{"#opers", true, "opers"},
+		{"#Opers-Chat", true, "opers"},
+		{"#serv", false, ""},
+		{"#users", false, ""},
+	}
+
+	for _, test := range tests {
+		rc, reserved := cb.reservation(test.input)
+		if reserved != test.reserved || rc.Name != test.name {
+			t.Errorf("reservation(%s) = %s, %v, wanted %s, %v", test.input, rc.Name,
+				reserved, test.name, test.reserved)
+		}
+	}
+}
+
+func TestCleanText(t *testing.T) {
+	tests := []struct {
+		input  string
+		clean  bool
+		output string
+	}{
+		{"hello", true, "hello"},
+		{"h\u00e9llo \x02bold\x02 \x0304red\x03 \x01ACTION hi\x01", true,
+			"h\u00e9llo \x02bold\x02 \x0304red\x03 \x01ACTION hi\x01"},
+		{"a\tb", true, "a\tb"},
+		{"h\xe9llo", false, "h\ufffdllo"},
+		{"bell\x07", false, "bell"},
+		{"\x1b[31mred\x7f", false, "[31mred"},
+	}
+
+	for _, test := range tests {
+		if clean := isCleanText(test.input); clean != test.clean {
+			t.Errorf("isCleanText(%q) = %v, wanted %v", test.input, clean,
+				test.clean)
+		}
+		if output := cleanText(test.input); output != test.output {
+			t.Errorf("cleanText(%q) = %q, wanted %q", test.input, output,
+				test.output)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// KLineIndex lets us find the K-Lines matching a user without checking each
+// one. Servers may carry tens of thousands of them.
+//
+// We sort K-Lines by their host mask:
+//
+// - Those without wildcards go in a map by host.
+// - CIDRs go in a trie by network.
+// - The rest (which we hope are few) we check one by one.
+//
+// Matching is case insensitive and the masks must match the entire
+// username/hostname.
+type KLineIndex struct {
+	// user@host -> K-Line. To find duplicates and remove K-Lines.
+	masks map[string]KLine
+
+	// Lowercase host -> K-Lines with that host mask.
+	hosts map[string][]KLine
+
+	cidrs *cidrNode
+
+	wildcards []KLine
+}
+
+// cidrNode is a node in a binary trie of networks. Each level is a bit of the
+// address. IPv4 networks are stored as IPv4-mapped IPv6 networks.
+type cidrNode struct {
+	children [2]*cidrNode
+	klines   []KLine
+}
+
+func newKLineIndex(klines []KLine) *KLineIndex {
+	idx := &KLineIndex{
+		masks: map[string]KLine{},
+		hosts: map[string][]KLine{},
+		cidrs: &cidrNode{},
+	}
+	for _, kline := range klines {
+		idx.add(kline)
+	}
+	return idx
+}
+
+func klineKey(userMask, hostMask string) string {
+	return strings.ToLower(userMask) + "@" + strings.ToLower(hostMask)
+}
+
+// has tells whether we have a K-Line with the given masks.
+func (idx *KLineIndex) has(userMask, hostMask string) bool {
+	_, exists := idx.masks[klineKey(userMask, hostMask)]
+	return exists
+}
+
+// add adds the K-Line. It should not be a duplicate.
+func (idx *KLineIndex) add(kline KLine) {
+	idx.masks[klineKey(kline.UserMask, kline.HostMask)] = kline
+
+	if node, ok := idx.cidrNode(kline.HostMask, true); ok {
+		node.klines = append(node.klines, kline)
+		return
+	}
+
+	if !strings.ContainsAny(kline.HostMask, "*?") {
+		host := strings.ToLower(kline.HostMask)
+		idx.hosts[host] = append(idx.hosts[host], kline)
+		return
+	}
+
+	idx.wildcards = append(idx.wildcards, kline)
+}
+
+// remove removes the K-Line with the given masks. It returns false if there
+// is no such K-Line.
+func (idx *KLineIndex) remove(userMask, hostMask string) bool {
+	key := klineKey(userMask, hostMask)
+	if _, exists := idx.masks[key]; !exists {
+		return false
+	}
+	delete(idx.masks, key)
+
+	if node, ok := idx.cidrNode(hostMask, false); ok {
+		if node != nil {
+			node.klines = removeKLineFrom(node.klines, key)
+		}
+		return true
+	}
+
+	if !strings.ContainsAny(hostMask, "*?") {
+		host := strings.ToLower(hostMask)
+		idx.hosts[host] = removeKLineFrom(idx.hosts[host], key)
+		if len(idx.hosts[host]) == 0 {
+			delete(idx.hosts, host)
+		}
+		return true
+	}
+
+	idx.wildcards = removeKLineFrom(idx.wildcards, key)
+	return true
+}
+
+func removeKLineFrom(klines []KLine, key string) []KLine {
+	for i, kline := range klines {
+		if klineKey(kline.UserMask, kline.HostMask) == key {
+			return append(klines[:i], klines[i+1:]...)
+		}
+	}
+	return klines
+}
+
+// cidrNode finds the trie node for the host mask if it is a CIDR. ok is false
+// if it is not one. If create is true we add missing nodes. Otherwise the node
+// may be nil if it is not present.
+func (idx *KLineIndex) cidrNode(hostMask string, create bool) (*cidrNode,
+	bool) {
+	if !strings.Contains(hostMask, "/") {
+		return nil, false
+	}
+	_, network, err := net.ParseCIDR(hostMask)
+	if err != nil {
+		return nil, false
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	ip := network.IP.To16()
+
+	node := idx.cidrs
+	for i := 0; i < ones; i++ {
+		bit := (ip[i/8] >> uint(7-i%8)) & 1
+		if node.children[bit] == nil {
+			if !create {
+				return nil, true
+			}
+			node.children[bit] = &cidrNode{}
+		}
+		node = node.children[bit]
+	}
+	return node, true
+}
+
+// match finds a K-Line matching the user. We match the host mask against
+// their hostname, or, if it is a CIDR, their IP.
+func (idx *KLineIndex) match(u *User) (KLine, bool) {
+	for _, kline := range idx.hosts[strings.ToLower(u.Hostname)] {
+		if matchMask(kline.UserMask, u.Username) {
+			return kline, true
+		}
+	}
+
+	if ip := net.ParseIP(u.IP).To16(); ip != nil {
+		node := idx.cidrs
+		for i := 0; node != nil; i++ {
+			for _, kline := range node.klines {
+				if matchMask(kline.UserMask, u.Username) {
+					return kline, true
+				}
+			}
+			if i == len(ip)*8 {
+				break
+			}
+			node = node.children[(ip[i/8]>>uint(7-i%8))&1]
+		}
+	}
+
+	for _, kline := range idx.wildcards {
+		if u.matchesMask(kline.UserMask, kline.HostMask) {
+			return kline, true
+		}
+	}
+
+	return KLine{}, false
+}
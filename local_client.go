@@ -1,9 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -37,6 +38,25 @@ type LocalClient struct { // nolint: maligned
 	// Track if we overflow our send queue. If we do, we'll kill the client.
 	SendQueueExceeded bool
 
+	// How many messages we may queue to send to the client before their send
+	// queue is exceeded. This depends on their class, so we set it when they
+	// register. Until then it is 0, and only the size of WriteChan limits it.
+	SendQueueLimit int
+
+	// After the client sends STARTTLS, its reader and writer wait to hear from
+	// the server goroutine on these whether to carry on. See starttls.go.
+	StartTLSReadChan  chan bool
+	StartTLSWriteChan chan bool
+
+	// Whether they connected to the Tor listener. We don't know where such
+	// clients really come from, so they get the Tor host and no IP. They don't
+	// see other users' real hosts or IPs.
+	Tor bool
+
+	// Whether they connected to the servers listener. They may only register
+	// as a server.
+	ServersOnly bool
+
 	// Track how many messages we receive in a pre-registered state.
 	// If we hit a defined threshold, kill the connection.
 	PreRegisterMessageCount int
@@ -62,6 +82,35 @@ type LocalClient struct { // nolint: maligned
 	// CAPAB arguments.
 	PreRegCapabs map[string]struct{}
 
+	// Client capabilities (CAP) the client negotiated. These persist after
+	// registration.
+	Caps map[string]struct{}
+
+	// Whether the client is negotiating capabilities prior to registering. We
+	// don't complete registration until it finishes.
+	CapNegotiating bool
+
+	// Whether we're still looking up their hostname (async-hostname-lookup),
+	// and whether they're waiting on it to register. They wait if the connect
+	// policy tests their hostname.
+	LookingUpHostname  bool
+	WaitingForHostname bool
+
+	// Whether we're checking the password a client on the Tor listener gave
+	// (see tor-auth), and whether it was right. We check it outside the server
+	// goroutine. See checkPasswordAsync().
+	CheckingTorPassword bool
+	TorPasswordOK       bool
+
+	// Whether we're relaying a SASL exchange for the client to services.
+	SASLInProgress bool
+
+	// UID of the services agent handling the exchange. Blank until they reply.
+	SASLAgent string
+
+	// The account services logged the client in to with SASL.
+	SASLAccount string
+
 	// SERVER arguments.
 	PreRegServerName string
 	PreRegServerDesc string
@@ -90,11 +139,14 @@ func NewLocalClient(cb *Catbox, id uint64, conn net.Conn) *LocalClient {
 		// Buffered channel. We don't want to block sending to the client from the
 		// server. The client may be stuck. Make the buffer large enough that it
 		// should only max out in case of connection issues.
-		WriteChan: make(chan irc.Message, 32768),
+		WriteChan: make(chan irc.Message, MaxSendQueue),
 
 		ConnectionStartTime: time.Now(),
 		Catbox:              cb,
 		PreRegCapabs:        make(map[string]struct{}),
+		Caps:                make(map[string]struct{}),
+		StartTLSReadChan:    make(chan bool, 1),
+		StartTLSWriteChan:   make(chan bool, 1),
 	}
 }
 
@@ -133,6 +185,25 @@ func (c *LocalClient) getTLSState() (string, string, error) {
 		cipherSuiteToString(state.CipherSuite), nil
 }
 
+// If the client is using a TLS connection and presented a client certificate,
+// this function gets the certificate's SHA-256 fingerprint in hex.
+//
+// Returns blank if there is no certificate.
+func (c *LocalClient) certFP() string {
+	tlsConn, ok := c.Conn.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
 // Send a message to the client. We send it to its write channel, which in turn
 // leads to writing it to its TCP socket.
 //
@@ -146,6 +217,11 @@ func (c *LocalClient) maybeQueueMessage(m irc.Message) {
 		return
 	}
 
+	if c.SendQueueLimit > 0 && len(c.WriteChan) >= c.SendQueueLimit {
+		c.SendQueueExceeded = true
+		return
+	}
+
 	select {
 	case c.WriteChan <- m:
 	default:
@@ -166,7 +242,17 @@ func (c *LocalClient) readLoop() {
 
 		buf, err := c.Conn.Read()
 		if err != nil {
-			log.Printf("Client %s: Read problem: %s", c, err)
+			// We're upgrading. Pass on what we read but didn't process.
+			if c.Conn.readingStopped() {
+				c.Catbox.newEvent(Event{
+					Type:   ReaderStoppedEvent,
+					Client: c,
+					Unread: c.Conn.unread(buf),
+				})
+				break
+			}
+
+			clientsLog.Infof("Client %s: Read problem: %s", c, err)
 			// Debug concerns with missing quit messages.
 			if buf != "" {
 				c.Catbox.noticeOpers(fmt.Sprintf("Read error but have [%s]",
@@ -193,9 +279,14 @@ func (c *LocalClient) readLoop() {
 			Client:  c,
 			Message: message,
 		})
+
+		// We may be about to switch to TLS. Don't read until we know.
+		if message.Command == "STARTTLS" && !c.waitForStartTLS(c.StartTLSReadChan) {
+			break
+		}
 	}
 
-	log.Printf("Client %s: Reader shutting down.", c)
+	clientsLog.Debugf("Client %s: Reader shutting down.", c)
 }
 
 // writeLoop endlessly reads from the client's channel, encodes each message,
@@ -218,10 +309,11 @@ func (c *LocalClient) writeLoop() {
 	// example using 'for message := range c.WriteChan', as it would block
 	// forever).
 	//
-	// A problem with this is we are not guaranteed to process any remaining
-	// messages on the write channel (and so inform the client about shutdown)
-	// when we are shutting down. But it is an improvement on leaking the
-	// goroutine.
+	// Once we see we're shutting down, we send what's left on the write channel
+	// until the shutdown deadline. This way the client hears why we're closing
+	// its connection, but we don't wait forever on a client that isn't reading.
+	tags := ""
+	handedOver := false
 Loop:
 	for {
 		select {
@@ -230,7 +322,35 @@ Loop:
 				break Loop
 			}
 
-			buf, err := message.Encode()
+			// We're upgrading. We wrote everything before this. The new process
+			// takes over the connection so we leave it open.
+			if message.Command == upgradeMarker.Command {
+				c.Catbox.newEvent(Event{Type: WriterStoppedEvent, Client: c})
+				handedOver = true
+				break Loop
+			}
+
+			if message.Command == startTLSMarker.Command {
+				conn, err := c.handshakeTLS()
+				c.Catbox.newEvent(Event{
+					Type:    StartTLSEvent,
+					Client:  c,
+					TLSConn: conn,
+					Error:   err,
+				})
+				if !c.waitForStartTLS(c.StartTLSWriteChan) {
+					break Loop
+				}
+				continue
+			}
+
+			if message.Command == tagsMarker.Command {
+				tags = message.Params[0]
+				continue
+			}
+
+			buf, err := encodeMessage(tags, message)
+			tags = ""
 			if err != nil {
 				c.Catbox.noticeOpers(fmt.Sprintf(
 					"Trying to send invalid message to client %s: %s", c, err))
@@ -240,7 +360,7 @@ Loop:
 			}
 
 			if err := c.Conn.Write(buf); err != nil {
-				log.Printf("Client %s: Write problem: %s: %s", c, buf, err)
+				clientsLog.Infof("Client %s: Write problem: %s: %s", c, buf, err)
 				// Don't kill the client immediately. Give a chance for us to read
 				// anything from it.
 				time.Sleep(5 * time.Second)
@@ -248,15 +368,64 @@ Loop:
 				break Loop
 			}
 		case <-c.Catbox.ShutdownChan:
+			c.flushWrites()
 			break Loop
 		}
 	}
 
-	if err := c.Conn.Close(); err != nil {
-		log.Printf("Client %s: Problem closing connection: %s", c, err)
+	if !handedOver {
+		if err := c.Conn.Close(); err != nil {
+			clientsLog.Warnf("Client %s: Problem closing connection: %s", c, err)
+		}
 	}
 
-	log.Printf("Client %s: Writer shutting down.", c)
+	clientsLog.Debugf("Client %s: Writer shutting down.", c)
+}
+
+// flushWrites sends what's left on the write channel when we're shutting down.
+//
+// We give up at the shutdown deadline. The client may not be reading, or the
+// server goroutine may never close the channel (e.g., if it never heard about
+// the client).
+func (c *LocalClient) flushWrites() {
+	deadline := c.Catbox.ShutdownDeadline
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	tags := ""
+	for {
+		select {
+		case message, ok := <-c.WriteChan:
+			if !ok {
+				return
+			}
+
+			// It's too late to start TLS or upgrade.
+			if message.Command == startTLSMarker.Command ||
+				message.Command == upgradeMarker.Command {
+				continue
+			}
+
+			if message.Command == tagsMarker.Command {
+				tags = message.Params[0]
+				continue
+			}
+
+			buf, err := encodeMessage(tags, message)
+			tags = ""
+			if err != nil && err != irc.ErrTruncated {
+				continue
+			}
+
+			if err := c.Conn.writeBefore(buf, deadline); err != nil {
+				clientsLog.Infof("Client %s: Write problem: %s: %s", c, buf, err)
+				return
+			}
+		case <-timer.C:
+			clientsLog.Infof("Client %s: Gave up sending queued messages", c)
+			return
+		}
+	}
 }
 
 // quit means the client is quitting. Tell it why and clean up.
@@ -267,8 +436,16 @@ func (c *LocalClient) quit(msg string) {
 		return
 	}
 
+	c.abortSASL()
+
+	// Its reader or writer may be waiting on STARTTLS.
+	c.finishStartTLS(false)
+
 	c.messageFromServer("ERROR", []string{msg})
 
+	logEvent("connect", "Closed connection from unregistered client %s: %s", c,
+		msg)
+
 	close(c.WriteChan)
 
 	delete(c.Catbox.LocalClients, c.ID)
@@ -288,17 +465,29 @@ func (c *LocalClient) registerUser() {
 		return
 	}
 
+	if c.Tor && !c.torAuthenticated() {
+		return
+	}
+
+	// The connect policy can't tell whether they have reverse DNS until we're
+	// done looking.
+	if c.LookingUpHostname &&
+		policyNeedsHostname(c.Catbox.Config.PolicyRules) {
+		c.WaitingForHostname = true
+		return
+	}
+
 	lu := NewLocalUser(c)
 
 	// This IP field is not always actually an IP. It can be "0" in the case of a
 	// user with a spoof (this is specified in TS6). It also gets sent in a UID
-	// command, and not as the last parameter . Because of that, we must make
-	// sure it does not start with ":" as that cannot be encoded. Consider IPv6
-	// IPs such as "::1". TS6 specifies that with these we prepend a "0". e.g.,
-	// "0::1".
-	ip := c.Conn.IP.String()
-	if ip[0] == ':' {
-		ip = "0" + ip
+	// command, and not as the last parameter, so IPv6 IPs such as "::1" become
+	// "0::1". See ts6IP().
+	ip := ts6IP(c.Conn.IP)
+	// The IP of a client on the Tor listener is the Tor daemon's. Hide it like
+	// a spoof.
+	if c.Tor {
+		ip = "0"
 	}
 
 	hostname := ip
@@ -313,55 +502,99 @@ func (c *LocalClient) registerUser() {
 		Modes:       make(map[byte]struct{}),
 		Username:    c.PreRegUser,
 		Hostname:    hostname,
+		DisplayHost: hostname,
 		IP:          ip,
 		RealName:    c.PreRegRealName,
 		Channels:    make(map[string]*Channel),
 		LocalUser:   lu,
+		CertFP:      c.certFP(),
+		Account:     c.SASLAccount,
 	}
 
 	lu.User = u
 
+	// Check the connect policy. It may deny them, or choose the user
+	// configuration to apply to them.
+	rule := evaluatePolicy(c.Catbox.Config.PolicyRules, PolicyInput{
+		Nick:     u.DisplayNick,
+		Username: u.Username,
+		Hostname: c.Hostname,
+		IP:       c.Conn.IP,
+		TLS:      c.isTLS(),
+		Account:  c.SASLAccount,
+	})
+	if rule != nil && rule.Action == "deny" {
+		c.quit(fmt.Sprintf("Connection closed: %s", rule.Reason))
+
+		c.Catbox.noticeLocalOpersRealHost(fmt.Sprintf(
+			"Rejecting user registration for %s!%s@%s. Denied by policy: %s",
+			u.DisplayNick, u.Username, u.Hostname, rule.Reason), fmt.Sprintf(
+			"Rejecting user registration for %s!%s@%s. Denied by policy: %s",
+			u.DisplayNick, u.Username, u.DisplayHost, rule.Reason))
+		return
+	}
+
 	// Apply any user configuration that matches them.
 	// This may flag the user flood exempt.
 	// This may give the user a spoof.
-	for _, userConfig := range c.Catbox.Config.UserConfigs {
-		if !u.matchesMask(userConfig.UserMask, userConfig.HostMask) {
+	var matchedConfig *UserConfig
+	for i, userConfig := range c.Catbox.Config.UserConfigs {
+		if rule != nil && rule.Action == "class" {
+			if userConfig.Name != rule.Class {
+				continue
+			}
+		} else if !u.matchesMask(userConfig.UserMask, userConfig.HostMask) {
 			continue
 		}
 
-		u.FloodExempt = userConfig.FloodExempt
+		// Match the first only.
+		matchedConfig = &c.Catbox.Config.UserConfigs[i]
+		break
+	}
+
+	if matchedConfig != nil {
+		lu.UserConfigName = matchedConfig.Name
+		u.FloodExempt = matchedConfig.FloodExempt
 		if u.FloodExempt {
 			lu.serverNotice("Congratulations. You're exempt from flood protection.")
 		}
 
-		if len(userConfig.Spoof) > 0 {
-			u.Hostname = userConfig.Spoof
+		if len(matchedConfig.Spoof) > 0 {
+			u.Hostname = matchedConfig.Spoof
+			u.DisplayHost = matchedConfig.Spoof
 			lu.serverNotice(fmt.Sprintf("Spoofing your hostname as %s", u.Hostname))
 		}
+	}
+	lu.SendQueueLimit = c.Catbox.userSendQueue(lu.UserConfigName)
 
-		// Match the first only.
-		break
+	// Cloak their host unless they have a spoof. A spoof hides it already. If
+	// the vhosts config gives them a vhost (by their certificate, since they
+	// can't be logged in yet), they show that instead.
+	if c.Catbox.Config.CloakKey != "" &&
+		(matchedConfig == nil || len(matchedConfig.Spoof) == 0) {
+		u.Modes['x'] = struct{}{}
 	}
+	lu.Vhost = c.Catbox.configuredVhost(u)
+	u.DisplayHost = lu.displayHost(u.Hostname)
 
 	// Check if they're klined. Don't accept further if so.
-	for _, kline := range c.Catbox.KLines {
-		if !u.matchesMask(kline.UserMask, kline.HostMask) {
-			continue
-		}
+	if kline, matched := c.Catbox.matchingKLine(u); matched {
 		// 465 ERR_YOUREBANNEDCREEP
 		lu.messageFromServer("465", []string{"You are banned from this server"})
 
 		c.quit(fmt.Sprintf("Connection closed: %s", kline.Reason))
 
-		c.Catbox.noticeLocalOpers(fmt.Sprintf(
+		c.Catbox.noticeLocalOpersRealHost(fmt.Sprintf(
+			"Rejecting user registration for %s!%s@%s. KLined: %s",
+			u.DisplayNick, u.Username, u.Hostname, kline.Reason), fmt.Sprintf(
 			"Rejecting user registration for %s!%s@%s. KLined: %s",
-			u.DisplayNick, u.Username, u.Hostname, kline.Reason))
+			u.DisplayNick, u.Username, u.DisplayHost, kline.Reason))
 		return
 	}
 
 	uid, err := lu.makeTS6UID(lu.ID)
 	if err != nil {
-		log.Fatal(err)
+		coreLog.Fatalf("%s", err)
 	}
 	u.UID = uid
 
@@ -369,6 +602,7 @@ func (c *LocalClient) registerUser() {
 	c.Catbox.LocalUsers[lu.ID] = lu
 	c.Catbox.Nicks[canonicalizeNick(u.DisplayNick)] = u.UID
 	c.Catbox.Users[u.UID] = u
+	c.Catbox.recordUserCount()
 
 	// 001 RPL_WELCOME
 	lu.messageFromServer("001", []string{
@@ -394,20 +628,27 @@ func (c *LocalClient) registerUser() {
 		// It seems ambiguous if these are to be separate parameters.
 		lu.Catbox.Config.ServerName,
 		lu.Catbox.version(),
-		// User modes we support.
-		"ioC",
-		// Channel modes we support.
-		"nos",
+		supportedUserModes,
+		supportedChannelModes,
 	})
 
+	lu.sendISupport(lu.Catbox.isupportTokens())
+
 	c.Catbox.updateCounters()
 	c.Catbox.ConnectionCount++
 
 	lu.lusersCommand()
 	lu.motdCommand()
 
-	// Set user mode +i automatically.
-	lu.messageUser(u, "MODE", []string{u.DisplayNick, "+i"})
+	// Set user mode +i automatically. We set +x above if we cloaked them.
+	modeStr := "+i"
+	if _, exists := u.Modes['x']; exists {
+		modeStr += "x"
+	}
+	if u.DisplayHost != u.Hostname {
+		lu.sendHostHidden()
+	}
+	lu.messageUser(u, "MODE", []string{u.DisplayNick, modeStr})
 	u.Modes['i'] = struct{}{}
 
 	// Tell linked servers about this new client.
@@ -422,13 +663,42 @@ func (c *LocalClient) registerUser() {
 				fmt.Sprintf("%d", u.NickTS),
 				u.modesString(),
 				u.Username,
-				u.Hostname,
+				u.DisplayHost,
 				u.IP,
 				string(u.UID),
 				u.RealName,
 			},
 		})
 
+		// UID has the host we show. If it differs, tell it the real one. charybdis
+		// does this with ENCAP REALHOST.
+		if u.Hostname != u.DisplayHost {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "REALHOST", u.Hostname},
+			})
+		}
+
+		// Tell it about their certificate fingerprint if they have one. charybdis
+		// does this with ENCAP CERTFP.
+		if u.CertFP != "" {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "CERTFP", u.CertFP},
+			})
+		}
+
+		// Tell it about the account they logged in to with SASL.
+		if u.Account != "" {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "LOGIN", u.Account},
+			})
+		}
+
 		// Send a CLICONN message. This is a custom command I built into ratbox
 		// so that local opers can know about remote connections. For catbox we
 		// don't need to handle this to know about remote connections as I inform
@@ -455,10 +725,16 @@ func (c *LocalClient) registerUser() {
 		if !exists {
 			continue
 		}
+		host, ip := u.Hostname, u.IP
+		if !oper.seesRealHosts() {
+			host, ip = u.DisplayHost, "0"
+		}
 		oper.LocalUser.serverNotice(fmt.Sprintf("CLICONN %s %s %s %s %s (%s)",
-			u.DisplayNick, u.Username, u.Hostname, u.IP, u.RealName,
+			u.DisplayNick, u.Username, host, ip, u.RealName,
 			c.Catbox.Config.ServerName))
 	}
+
+	c.Catbox.checkNickOwnership(lu)
 }
 
 // Send an IRC message to a client. Appears to be from the server.
@@ -486,6 +762,15 @@ func (c *LocalClient) messageFromServer(command string, params []string) {
 	})
 }
 
+// Send a NOTICE AUTH to a client. Unlike sendAuthNotice(), this is for the
+// server goroutine.
+func (c *LocalClient) authNotice(s string) {
+	c.maybeQueueMessage(irc.Message{
+		Command: "NOTICE",
+		Params:  []string{"AUTH", s},
+	})
+}
+
 func (c *LocalClient) sendSVINFO() {
 	// SVINFO <TS version> <min TS version> 0 <current time>
 	epoch := time.Now().Unix()
@@ -503,6 +788,8 @@ func (c *LocalClient) sendSVINFO() {
 func (c *LocalClient) registerServer() {
 	newLS := NewLocalServer(c)
 
+	c.Conn.setMaxLineLength(maxServerLineLength)
+
 	newServer := &Server{
 		SID:         TS6SID(c.PreRegTS6SID),
 		Name:        c.PreRegServerName,
@@ -513,6 +800,7 @@ func (c *LocalClient) registerServer() {
 	}
 
 	newLS.Server = newServer
+	newLS.SendQueueLimit = c.Catbox.serverSendQueue(newServer.Name)
 
 	delete(c.Catbox.LocalClients, c.ID)
 	c.Catbox.LocalServers[newLS.ID] = newLS
@@ -534,8 +822,10 @@ func (c *LocalClient) registerServer() {
 	}
 
 	c.Catbox.ConnectionCount++
+	c.Catbox.linkEstablished(newServer.Name)
 
 	newLS.Catbox.noticeOpers(linkNotice)
+	logEvent("link", "%s", linkNotice)
 
 	newLS.sendBurst()
 
@@ -593,7 +883,16 @@ func (c *LocalClient) sendServerIntro(pass string) {
 		// http://www.leeh.co.uk/ircd/encap.txt
 		// TB means support for topic burst. We send/receive TB commands during
 		// burst which tells the topics in channels.
-		Params: []string{"QS ENCAP TB"},
+		// EX means support for ban exceptions (channel mode +e). We send them in
+		// BMASK commands during burst.
+		// IE means support for invite exceptions (channel mode +I). Like ban
+		// exceptions, we send them in BMASK commands.
+		// SAVE means support for the SAVE command. In a nick collision we may
+		// change a user's nick to their UID rather than killing them.
+		// KLN and UNKLN mean support for KLINE and UNKLINE outside of ENCAP.
+		// BAN means support for network wide bans with lifetimes in BAN.
+		// TBURST is like TB, but includes the channel TS.
+		Params: []string{"QS ENCAP EX IE TB TBURST SAVE KLN UNKLN BAN"},
 	})
 
 	// SERVER <name> <hopcount> <description>
@@ -624,9 +923,21 @@ func (c *LocalClient) handleMessage(m irc.Message) {
 		return
 	}
 
-	// Non-RFC command that appears to be widely supported. Just ignore it for
-	// now.
+	// Only servers may register on the servers listener. Drop anything that
+	// looks like a user straight away.
+	if c.ServersOnly && (m.Command == "NICK" || m.Command == "USER" ||
+		m.Command == "CAP" || m.Command == "AUTHENTICATE") {
+		c.quit("Only servers may connect to this port")
+		return
+	}
+
 	if m.Command == "CAP" {
+		c.capCommand(m)
+		return
+	}
+
+	if m.Command == "AUTHENTICATE" {
+		c.authenticateCommand(m)
 		return
 	}
 
@@ -734,12 +1045,20 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 		nick = nick[0:c.Catbox.Config.MaxNickLength]
 	}
 
-	if !isValidNick(c.Catbox.Config.MaxNickLength, nick) {
+	if !isValidNick(c.Catbox.Config.MaxNickLength, nick) ||
+		c.Catbox.isNickServ(nick) || c.Catbox.isChanServ(nick) {
 		// 432 ERR_ERRONEUSNICKNAME
 		c.messageFromServer("432", []string{nick, "Erroneous nickname"})
 		return
 	}
 
+	if rc, reserved := c.Catbox.reservation(nick); reserved {
+		// 432 ERR_ERRONEUSNICKNAME
+		c.messageFromServer("432", []string{nick,
+			reservedMessage("Nickname is reserved", rc)})
+		return
+	}
+
 	nickCanon := canonicalizeNick(nick)
 
 	// Nick must be unique.
@@ -758,8 +1077,9 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 	// We don't reply during registration (we don't have enough info, no uhost
 	// anyway).
 
-	// If we have USER done already, then we're done registration.
-	if len(c.PreRegUser) > 0 {
+	// If we have USER done already, then we're done registration. Unless they're
+	// negotiating capabilities. Then we wait for CAP END.
+	if len(c.PreRegUser) > 0 && !c.CapNegotiating {
 		c.registerUser()
 	}
 }
@@ -799,19 +1119,76 @@ func (c *LocalClient) userCommand(m irc.Message) {
 		realName = realName[:maxRealNameLength]
 	}
 
+	// We sanitize rather than reject it even if invalid-utf8-action says to
+	// reject. They couldn't register otherwise.
+	if c.Catbox.Config.InvalidUTF8Action != "allow" {
+		realName = cleanText(realName)
+	}
+
 	if !isValidRealName(realName) {
 		c.messageFromServer("ERROR", []string{"Invalid realname"})
 		return
 	}
 	c.PreRegRealName = realName
 
-	// If we have a nick, then we're done registration.
-	if len(c.PreRegDisplayNick) > 0 {
+	// If we have a nick, then we're done registration. Unless they're
+	// negotiating capabilities. Then we wait for CAP END.
+	if len(c.PreRegDisplayNick) > 0 && !c.CapNegotiating {
 		c.registerUser()
 	}
 }
 
+// torAuthenticated checks the client on the Tor listener did what tor-auth
+// requires. If not, we cut them off.
+//
+// Checking a password takes a while. Until we're done, it says they're not
+// authenticated, and we try to register them again after.
+func (c *LocalClient) torAuthenticated() bool {
+	if c.Catbox.Config.TorAuth == "password" && !c.TorPasswordOK {
+		if c.CheckingTorPassword {
+			return false
+		}
+		c.CheckingTorPassword = true
+
+		c.Catbox.checkPasswordAsync(c.Catbox.Config.TorPassword, c.PreRegPass,
+			func(ok bool) {
+				// They may have gone.
+				if c.Catbox.LocalClients[c.ID] != c {
+					return
+				}
+				c.CheckingTorPassword = false
+
+				if !ok {
+					// 464 ERR_PASSWDMISMATCH
+					c.messageFromServer("464", []string{"Password incorrect"})
+					c.quit("Bad password")
+					return
+				}
+				c.TorPasswordOK = true
+
+				if !c.CapNegotiating {
+					c.registerUser()
+				}
+			})
+		return false
+	}
+
+	if c.Catbox.Config.TorAuth == "sasl" && c.SASLAccount == "" {
+		c.quit("You must authenticate with SASL to connect through Tor")
+		return false
+	}
+
+	return true
+}
+
 func (c *LocalClient) passCommand(m irc.Message) {
+	// Clients on the Tor listener may need a password. See tor-auth.
+	// PASS <password>
+	if c.Tor && len(m.Params) == 1 {
+		c.PreRegPass = m.Params[0]
+		return
+	}
+
 	// For server registration:
 	// PASS <password>, TS, <ts version>, <SID>
 	if len(m.Params) < 4 {
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -93,6 +94,7 @@ func (s *LocalServer) quit(msg string) {
 
 	s.Catbox.noticeLocalOpers(fmt.Sprintf("Server %s delinked: %s",
 		s.Server.Name, msg))
+	logEvent("link", "Server %s delinked: %s", s.Server.Name, msg)
 }
 
 // lostServer is departing the network.
@@ -117,6 +119,10 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 	// Include the one we're losing with its links.
 	lostServers = append(lostServers, lostServer)
 
+	if !s.Catbox.isShuttingDown() {
+		s.Catbox.statsToday().Splits++
+	}
+
 	// Look for users we are losing.
 	for _, user := range s.Catbox.Users {
 		if user.isLocal() {
@@ -137,7 +143,7 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 			continue
 		}
 
-		log.Printf("Losing user %s", user)
+		s2sLog.Debugf("Losing user %s", user)
 
 		// This user is gone.
 
@@ -147,7 +153,9 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 		// Quit message format is important. It tells that there was a netsplit,
 		// and between which two servers.
 		var quitMessage string
-		if lostServer.isLocal() {
+		if s.Catbox.Config.HideSplitServers {
+			quitMessage = "*.net *.split"
+		} else if lostServer.isLocal() {
 			quitMessage = fmt.Sprintf("%s %s", s.Catbox.Config.ServerName,
 				lostServer.Name)
 		} else {
@@ -160,7 +168,7 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 
 	// Forget all lost servers.
 	for _, server := range lostServers {
-		log.Printf("Losing server %s", server)
+		s2sLog.Infof("Losing server %s", server)
 		if server.isLocal() {
 			delete(s.Catbox.LocalServers, server.LocalServer.ID)
 		}
@@ -227,6 +235,9 @@ func (s *LocalServer) sendBurst() {
 		})
 	}
 
+	// Tell it what we know about the catbox servers on our side.
+	s.sendServerInfo()
+
 	// Tell it about all users we know about. Use the UID command.
 	// Ensure we set the prefix/source to the server it is on.
 	// Parameters: <nick> <hopcount> <nick TS> <umodes> <username> <hostname> <IP> <UID> :<real name>
@@ -248,13 +259,36 @@ func (s *LocalServer) sendBurst() {
 				fmt.Sprintf("%d", user.NickTS),
 				user.modesString(),
 				user.Username,
-				user.Hostname,
+				user.DisplayHost,
 				user.IP,
 				string(user.UID),
 				user.RealName,
 			},
 		})
 
+		// Tell it about their real host, certificate fingerprint, and account.
+		if user.Hostname != user.DisplayHost {
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(user.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "REALHOST", user.Hostname},
+			})
+		}
+		if user.CertFP != "" {
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(user.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "CERTFP", user.CertFP},
+			})
+		}
+		if user.Account != "" {
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(onServer),
+				Command: "ENCAP",
+				Params:  []string{"*", "SU", string(user.UID), user.Account},
+			})
+		}
+
 		// Send AWAY if they are away.
 		if len(user.AwayMessage) == 0 {
 			continue
@@ -272,22 +306,30 @@ func (s *LocalServer) sendBurst() {
 	// Each UID may be prefixed with @ and/or + if voiced/opped.
 
 	for _, channel := range s.Catbox.Channels {
+		// Other servers don't know about our local channels.
+		if channel.isLocal() {
+			continue
+		}
+
 		// We want to combine as many UIDs into a single SJOIN message as possible.
 
 		// First make a message with what is common to all messages so that we can
 		// determine the base length.
+		sjoinParams := []string{
+			fmt.Sprintf("%d", channel.TS),
+			channel.Name,
+			channel.modesString(),
+		}
+		sjoinParams = append(sjoinParams, channel.modeParams()...)
+		// UIDs go in the last parameter. As it is blank, encoding will turn it
+		// into " :" for us. This is acceptable.
+		sjoinParams = append(sjoinParams, "")
+		uidsIndex := len(sjoinParams) - 1
+
 		sjoinMessage := irc.Message{
 			Prefix:  string(s.Catbox.Config.TS6SID),
 			Command: "SJOIN",
-			Params: []string{
-				fmt.Sprintf("%d", channel.TS),
-				channel.Name,
-				// Currently we only support +ns.
-				"+ns",
-				// UIDs go in the last parameter. As it is blank, encoding will turn it
-				// into " :" for us. This is acceptable.
-				"",
-			},
+			Params:  sjoinParams,
 		}
 
 		// If encoding the prefix truncates then we have a big problem. We won't be
@@ -322,7 +364,7 @@ func (s *LocalServer) sendBurst() {
 			// start a new list.
 			// +1 to account for a space.
 			if baseSize+len(uids)+1+len(uidStr) > irc.MaxLineLength {
-				sjoinMessage.Params[3] = uids
+				sjoinMessage.Params[uidsIndex] = uids
 				s.maybeQueueMessage(sjoinMessage)
 				uids = "" + uidStr
 				continue
@@ -333,23 +375,170 @@ func (s *LocalServer) sendBurst() {
 		}
 
 		if len(uids) > 0 {
-			sjoinMessage.Params[3] = uids
+			sjoinMessage.Params[uidsIndex] = uids
 			s.maybeQueueMessage(sjoinMessage)
 		}
 
-		// If they support the TB capab then send them TB commands. This tells them
-		// the topic for each channel.
-		if s.Server.hasCapability("TB") && len(channel.Topic) > 0 {
-			s.maybeQueueMessage(irc.Message{
-				Prefix:  string(s.Catbox.Config.TS6SID),
-				Command: "TB",
-				Params: []string{
-					channel.Name,
-					fmt.Sprintf("%d", channel.TopicTS),
-					channel.TopicSetter,
-					channel.Topic,
-				},
-			})
+		// Tell them about the channel's bans and ban exceptions.
+		s.sendBMASK(channel)
+
+		// If they support the TBURST or TB capab then tell them the topic.
+		if m, ok := s.topicBurstMessage(string(s.Catbox.Config.TS6SID),
+			channel); ok {
+			s.maybeQueueMessage(m)
+		}
+	}
+
+	// Tell it about our bans so they converge after a split.
+	s.sendBanBurst()
+}
+
+// sendBanBurst tells the server about our bans during burst.
+//
+// If it has the BAN capab, we send every network wide ban we remember in BAN,
+// including those removed or expired. This way it learns about removals too.
+// If it has the KLN capab, we send our other K-Lines in KLINE. If a server has
+// neither, we send it nothing. We don't have D-Lines or X-Lines.
+func (s *LocalServer) sendBanBurst() {
+	sid := string(s.Catbox.Config.TS6SID)
+	now := time.Now().Unix()
+
+	sentAsBAN := map[string]struct{}{}
+	if s.Server.hasCapability("BAN") {
+		for _, ban := range s.Catbox.PropagatedBans {
+			s.maybeQueueMessage(ban.message(sid))
+			if ban.Type == "K" && ban.active(now) {
+				sentAsBAN[klineKey(ban.UserMask, ban.HostMask)] = struct{}{}
+			}
+		}
+	}
+
+	if !s.Server.hasCapability("KLN") {
+		return
+	}
+
+	for _, kline := range s.Catbox.KLines {
+		if _, exists := sentAsBAN[klineKey(kline.UserMask, kline.HostMask)]; exists {
+			continue
+		}
+
+		duration := "0"
+		if kline.Expires != 0 {
+			if kline.Expires <= now {
+				continue
+			}
+			duration = fmt.Sprintf("%d", kline.Expires-now)
+		}
+
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  sid,
+			Command: "KLINE",
+			Params: []string{"*", duration, kline.UserMask, kline.HostMask,
+				kline.Reason},
+		})
+	}
+}
+
+// topicBurstMessage makes the message telling the server about the channel's
+// topic. We prefer TBURST if it has that capab, otherwise TB. ok is false if it
+// has neither or there is no topic.
+//
+// TBURST: <channel TS> <channel> <topic TS> <setter> <topic>
+// TB: <channel> <topic TS> <setter> <topic>
+func (s *LocalServer) topicBurstMessage(sourceID string,
+	channel *Channel) (irc.Message, bool) {
+	if len(channel.Topic) == 0 {
+		return irc.Message{}, false
+	}
+
+	if s.Server.hasCapability("TBURST") {
+		return irc.Message{
+			Prefix:  sourceID,
+			Command: "TBURST",
+			Params: []string{
+				fmt.Sprintf("%d", channel.TS),
+				channel.Name,
+				fmt.Sprintf("%d", channel.TopicTS),
+				channel.TopicSetter,
+				channel.Topic,
+			},
+		}, true
+	}
+
+	if s.Server.hasCapability("TB") {
+		return irc.Message{
+			Prefix:  sourceID,
+			Command: "TB",
+			Params: []string{
+				channel.Name,
+				fmt.Sprintf("%d", channel.TopicTS),
+				channel.TopicSetter,
+				channel.Topic,
+			},
+		}, true
+	}
+
+	return irc.Message{}, false
+}
+
+// Send a channel's mask lists with BMASK commands.
+//
+// Parameters: <channel TS> <channel name> <type> :<masks>
+// e.g., :8ZZ BMASK 1475187553 #test b :*!*@example.com bad!*@*
+//
+// We only send ban exceptions if the server supports the EX capab, and invite
+// exceptions if it supports the IE capab. There is no capab for quiets. Like
+// charybdis we always send them. Servers that don't know them ignore them.
+func (s *LocalServer) sendBMASK(channel *Channel) {
+	for _, mode := range []byte{'b', 'e', 'I', 'q'} {
+		if mode == 'e' && !s.Server.hasCapability("EX") {
+			continue
+		}
+		if mode == 'I' && !s.Server.hasCapability("IE") {
+			continue
+		}
+
+		bmaskMessage := irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "BMASK",
+			Params: []string{
+				fmt.Sprintf("%d", channel.TS),
+				channel.Name,
+				string(mode),
+				// Masks go in the last parameter.
+				"",
+			},
+		}
+
+		bmaskEncoded, err := bmaskMessage.Encode()
+		if err != nil {
+			s2sLog.Errorf("Unable to create BMASK message: %s", err)
+			return
+		}
+
+		baseSize := len(bmaskEncoded)
+
+		masks := ""
+		for _, entry := range channel.Lists[mode] {
+			if len(masks) == 0 {
+				masks = entry.Mask
+				continue
+			}
+
+			// +1 to account for a space.
+			if baseSize+len(masks)+1+len(entry.Mask) > irc.MaxLineLength {
+				bmaskMessage.Params[3] = masks
+				s.maybeQueueMessage(bmaskMessage)
+				masks = entry.Mask
+				continue
+			}
+
+			masks += " " + entry.Mask
+		}
+
+		if len(masks) > 0 {
+			bmaskMessage.Params[3] = masks
+			s.maybeQueueMessage(bmaskMessage)
 		}
 	}
 }
@@ -434,6 +623,16 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "TBURST" {
+		s.tburstCommand(m)
+		return
+	}
+
+	if m.Command == "BMASK" {
+		s.bmaskCommand(m)
+		return
+	}
+
 	if m.Command == "JOIN" {
 		s.joinCommand(m)
 		return
@@ -444,6 +643,11 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "SAVE" {
+		s.saveCommand(m)
+		return
+	}
+
 	if m.Command == "PART" {
 		s.partCommand(m)
 		return
@@ -470,11 +674,21 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "KICK" {
+		s.kickCommand(m)
+		return
+	}
+
 	if m.Command == "SQUIT" {
 		s.squitCommand(m)
 		return
 	}
 
+	if m.Command == "CONNECT" {
+		s.connectCommand(m)
+		return
+	}
+
 	if m.Command == "KILL" {
 		s.killCommand(m)
 		return
@@ -485,6 +699,21 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "KLINE" {
+		s.nativeKlineCommand(m)
+		return
+	}
+
+	if m.Command == "UNKLINE" {
+		s.nativeUnklineCommand(m)
+		return
+	}
+
+	if m.Command == "BAN" {
+		s.banCommand(m)
+		return
+	}
+
 	if m.Command == "WHOIS" {
 		s.whoisCommand(m)
 		return
@@ -701,7 +930,7 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 	}
 
 	if !isValidNick(s.Catbox.Config.MaxNickLength, m.Params[0]) {
-		log.Printf("Invalid nick (%s)", m.Params[0])
+		s2sLog.Warnf("Invalid nick (%s)", m.Params[0])
 		s.quit(fmt.Sprintf("Invalid NICK! (%s)", m.Params[0]))
 		return
 	}
@@ -716,12 +945,20 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 	// We could validate hostname
 	hostname := m.Params[5]
 
-	// Is there a nick collision? If there is, and we're colliding this user, then
-	// don't continue.
-	if !s.Catbox.handleCollision(s, uid, displayNick, username, hostname, nickTS,
-		"UID") {
+	// Is there a nick collision? If there is, and we're killing this user, then
+	// don't continue. If we saved them, they get their UID as their nick. We
+	// tell our other servers about them that way.
+	collision := s.Catbox.handleCollision(s, uid, displayNick, username,
+		hostname, nickTS, "UID")
+	if collision == collisionReject {
 		return
 	}
+	if collision == collisionAcceptSaved {
+		displayNick = string(uid)
+		nickTS = saveNickTS
+		m.Params[0] = displayNick
+		m.Params[2] = fmt.Sprintf("%d", nickTS)
+	}
 
 	hopCount, err := strconv.ParseInt(m.Params[1], 10, 8)
 	if err != nil {
@@ -741,14 +978,20 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 			continue
 		}
 
-		if umode == 'i' || umode == 'o' || umode == 'C' {
+		if isUserMode(byte(umode)) {
 			umodes[byte(umode)] = struct{}{}
 			continue
 		}
 	}
 
-	// We could validate IP
+	// An IP we can't make sense of we treat as unknown rather than drop the
+	// server over it.
 	ip := m.Params[6]
+	if !isValidTS6IP(ip) {
+		s2sLog.Warnf("UID from %s has invalid IP for %s: %s", s.Server.Name, uid, ip)
+		ip = "0"
+		m.Params[6] = ip
+	}
 
 	// I get UID ahead of time, above.
 
@@ -767,6 +1010,7 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 		Modes:         umodes,
 		Username:      username,
 		Hostname:      hostname,
+		DisplayHost:   hostname,
 		IP:            ip,
 		UID:           uid,
 		RealName:      realName,
@@ -780,6 +1024,7 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 	}
 	s.Catbox.Nicks[canonicalizeNick(displayNick)] = u.UID
 	s.Catbox.Users[u.UID] = u
+	s.Catbox.recordUserCount()
 
 	// No reply needed I think.
 
@@ -806,8 +1051,12 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 			if !exists {
 				continue
 			}
+			host, ip := u.Hostname, u.IP
+			if !oper.seesRealHosts() {
+				host, ip = u.DisplayHost, "0"
+			}
 			oper.LocalUser.serverNotice(fmt.Sprintf("CLICONN %s %s %s %s %s (%s)",
-				u.DisplayNick, u.Username, u.Hostname, u.IP, u.RealName, u.Server.Name))
+				u.DisplayNick, u.Username, host, ip, u.RealName, u.Server.Name))
 		}
 	}
 
@@ -829,91 +1078,69 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 		return
 	}
 
+	d := &Delivery{
+		Command:  m.Command,
+		From:     s,
+		SourceID: m.Prefix,
+		Text:     m.Params[1],
+	}
+
 	// Determine the source.
 	// We can receive NOTICE from servers.
 	// Otherwise it must be a user.
-	source := ""
 	if m.Command == "NOTICE" {
 		sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
 		if exists {
-			source = sourceServer.Name
+			d.SourceName = sourceServer.Name
 		}
 	}
 
 	// If we don't know source yet, then it must be a user.
-	if source == "" {
-		sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if d.SourceName == "" {
+		user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
 		if exists {
-			source = sourceUser.nickUhost()
+			d.Source = user
+			d.SourceName = user.nickUhost()
 		}
 	}
 
-	if source == "" {
+	if d.SourceName == "" {
 		s.quit(fmt.Sprintf("Unknown source (%s)", m.Command))
+		return
 	}
 
 	// Is target a user?
 	if isValidUID(m.Params[0]) {
-		targetUID := TS6UID(m.Params[0])
-
-		targetUser, exists := s.Catbox.Users[targetUID]
+		targetUser, exists := s.Catbox.Users[TS6UID(m.Params[0])]
 		if exists {
-			// We either deliver it to a local user, and done, or we need to propagate
-			// it to another server.
-			if targetUser.isLocal() {
-				// Source and target were UIDs. Translate to uhost and nick
-				// respectively.
-				m.Params[0] = targetUser.DisplayNick
-				targetUser.LocalUser.maybeQueueMessage(irc.Message{
-					Prefix:  source,
-					Command: m.Command,
-					Params:  m.Params,
-				})
-			} else {
-				// Propagate to the server we know the target user through.
-				targetUser.ClosestServer.maybeQueueMessage(m)
-			}
-
+			d.Target = targetUser
+			s.Catbox.runMessagePipeline(d)
 			return
 		}
 
 		// Fall through. Treat it as a channel name.
 	}
 
-	// See if it's a channel.
-
-	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]
-	if !exists {
-		log.Printf("PRIVMSG to unknown target %s", m.Params[0])
+	// A nick on a particular server. e.g., NickServ@services.example.com.
+	if strings.Contains(m.Params[0], "@") {
+		if !s.Catbox.setNickAtServerTarget(d, m.Params[0]) {
+			s2sLog.Debugf("%s to unknown target %s", m.Command, m.Params[0])
+			return
+		}
+		s.Catbox.runMessagePipeline(d)
 		return
 	}
 
-	// Inform all members of the channel.
-	// Message local users directly.
-	// If a user is remote, then we record the server to send the message towards.
-	toServers := make(map[*LocalServer]struct{})
-	for memberUID := range channel.Members {
-		member := s.Catbox.Users[memberUID]
-
-		if member.isLocal() {
-			member.LocalUser.maybeQueueMessage(irc.Message{
-				Prefix:  source,
-				Command: m.Command,
-				Params:  m.Params,
-			})
-			continue
-		}
+	// See if it's a channel.
 
-		// Remote user. We need to propagate it towards them.
-		if member.ClosestServer != s {
-			toServers[member.ClosestServer] = struct{}{}
-		}
+	channel, exists := s.channel(m.Params[0])
+	if !exists {
+		s2sLog.Debugf("PRIVMSG to unknown target %s", m.Params[0])
+		return
 	}
 
-	// Propagate message to any servers that need it.
-	for server := range toServers {
-		server.maybeQueueMessage(m)
-	}
+	d.Channel = channel
+	s.Catbox.runMessagePipeline(d)
 }
 
 // SID tells us about a new server.
@@ -994,6 +1221,8 @@ func (s *LocalServer) sidCommand(m irc.Message) {
 
 	s.Catbox.noticeLocalOpers(fmt.Sprintf("%s is introducing server %s",
 		s.Server.Name, newServer.Name))
+	logEvent("link", "%s is introducing server %s", s.Server.Name,
+		newServer.Name)
 }
 
 // SJOIN occurs in two contexts:
@@ -1024,41 +1253,30 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 	}
 
 	chanName := canonicalizeChannel(m.Params[1])
-	if !isValidChannel(chanName) {
+	if !isValidChannel(chanName) || isLocalChannel(chanName) {
 		// Be lenient about what channel names may be on other servers.
 		// 403 ERR_NOSUCHCHANNEL
 		s.messageFromServer("403", []string{chanName, "Invalid channel name"})
 		return
 	}
 
-	// Currently I ignore modes. All channels have the same mode, or we pretend so
-	// anyway.
-
 	channel, channelExists := s.Catbox.Channels[canonicalizeChannel(chanName)]
 	if !channelExists {
-		channel = &Channel{
-			Name:    canonicalizeChannel(chanName),
-			Members: make(map[TS6UID]struct{}),
-			Ops:     make(map[TS6UID]*User),
-			Modes:   make(map[byte]struct{}),
-			TS:      channelTS,
-		}
+		channel = NewChannel(canonicalizeChannel(chanName), channelTS)
 		s.Catbox.Channels[channel.Name] = channel
 		// No modes set yet.
 	}
 
 	// Depending on the channel TS, we behave differently.
 	// If the TS indicates their side is newer, we accept their users but ignore
-	// their modes.
-	// If the TS indicates our side is newer, we clear our modes. We update our TS
-	// to match theirs.
+	// their modes and statuses (ops).
+	// If the TS indicates our side is newer, we clear our modes, statuses, and
+	// lists such as bans, and tell our local users. We update our TS to match
+	// theirs.
+	// If the TS are the same, we merge.
 	// Differences from the TS6 spec:
 	// - The spec says to kick users if they key differs or there is +i. Currently
 	//   we don't do this. This does not seem critical to me right now.
-	// - The spec says to update the message with the newer TS (presumably if we
-	//   decide it is newer) and to send modes/statuses only if we apply them. We
-	//   currently don't modify the message prior to propagating it. I expect
-	//   other servers in the network will be able to apply the same logic we do.
 
 	acceptModes := true
 	clearModes := false
@@ -1069,6 +1287,18 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 
 	if channelTS < channel.TS {
 		clearModes = true
+
+		// Like ratbox, tell local users the TS changed.
+		if channelExists {
+			s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+				Prefix:  s.Catbox.Config.ServerName,
+				Command: "NOTICE",
+				Params: []string{channel.Name, fmt.Sprintf(
+					"*** Notice -- TS for %s changed from %d to %d", channel.Name,
+					channel.TS, channelTS)},
+			})
+		}
+
 		channel.TS = channelTS
 	}
 
@@ -1076,15 +1306,107 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		// Improvement: Only clear modes the other side does not have.
 		// e.g., if both sides have +n, leave it.
 		channel.clearModes(s.Catbox)
+
+		// Invites came from the channel operators we just deopped.
+		channel.Invites = make(map[TS6UID]ChannelInvite)
 	}
 
 	modes := m.Params[2]
 
 	// Apply the simple (+ntski type) modes now.
+	//
+	// Modes with parameters have them after the mode string. The user list is
+	// always the last parameter.
 	if acceptModes {
 		modeStr := ""
+		modeParams := []string{}
+		paramIndex := 3
+
 		for _, mode := range modes {
-			if mode != 'n' && mode != 's' {
+			if mode == 'k' {
+				if paramIndex >= len(m.Params)-1 {
+					continue
+				}
+				key := m.Params[paramIndex]
+				paramIndex++
+
+				// If both sides have a key, like ratbox we keep the greater one.
+				if channel.Key != "" && channel.Key >= key {
+					continue
+				}
+
+				channel.Key = key
+				modeStr += string(mode)
+				modeParams = append(modeParams, key)
+				continue
+			}
+
+			if mode == 'f' {
+				if paramIndex >= len(m.Params)-1 {
+					continue
+				}
+				forward := canonicalizeChannel(m.Params[paramIndex])
+				paramIndex++
+				if !isValidForward(channel, forward) {
+					continue
+				}
+
+				// If both sides have a forward, like keys we keep the greater one.
+				if channel.Forward != "" && channel.Forward >= forward {
+					continue
+				}
+
+				channel.Forward = forward
+				modeStr += string(mode)
+				modeParams = append(modeParams, forward)
+				continue
+			}
+
+			if mode == 'j' {
+				if paramIndex >= len(m.Params)-1 {
+					continue
+				}
+				count, seconds, ok := parseJoinThrottle(m.Params[paramIndex])
+				paramIndex++
+				if !ok {
+					continue
+				}
+
+				// If both sides have a throttle, keep the greater one.
+				if channel.JoinThrottleCount > count ||
+					(channel.JoinThrottleCount == count &&
+						channel.JoinThrottleTime >= seconds) {
+					continue
+				}
+
+				channel.setJoinThrottle(count, seconds)
+				modeStr += string(mode)
+				modeParams = append(modeParams, formatJoinThrottle(count, seconds))
+				continue
+			}
+
+			if mode == 'l' {
+				if paramIndex >= len(m.Params)-1 {
+					continue
+				}
+				limit, err := strconv.Atoi(m.Params[paramIndex])
+				paramIndex++
+				if err != nil || limit <= 0 {
+					continue
+				}
+
+				// If both sides have a limit, like ratbox we keep the greater one.
+				if channel.Limit >= limit {
+					continue
+				}
+
+				channel.Limit = limit
+				modeStr += string(mode)
+				modeParams = append(modeParams, strconv.Itoa(limit))
+				continue
+			}
+
+			if !isChannelSimpleMode(byte(mode)) {
 				continue
 			}
 
@@ -1097,10 +1419,12 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		}
 
 		if len(modeStr) > 0 {
+			params := []string{channel.Name, "+" + modeStr}
+			params = append(params, modeParams...)
 			s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
 				Prefix:  sourceServer.Name,
 				Command: "MODE",
-				Params:  []string{channel.Name, "+" + modeStr},
+				Params:  params,
 			})
 		}
 	}
@@ -1109,9 +1433,11 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 	// more mode parameters.
 	userList := m.Params[len(m.Params)-1]
 
+	// The members we accept and pass on, with the statuses we accept.
+	var propagateUIDs []string
+
 	// Look at each of the members we were told about.
-	uidsRaw := strings.Split(userList, " ")
-	for _, uidRaw := range uidsRaw {
+	for _, uidRaw := range strings.Fields(userList) {
 		// May have op/voice prefix.
 		opped := false
 		//voiced := false
@@ -1135,18 +1461,25 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		if !exists {
 			// We may not know the user in case of nick collision where we killed.
 			// them and forgot them. Allow this.
-			log.Printf("SJOIN for unknown user %s, ignoring", uidRaw)
-			if !channelExists {
-				delete(s.Catbox.Channels, channel.Name)
-			}
-			return
+			s2sLog.Warnf("SJOIN for unknown user %s, ignoring", uidRaw)
+			continue
+		}
+
+		if opped {
+			propagateUIDs = append(propagateUIDs, "@"+string(user.UID))
+		} else {
+			propagateUIDs = append(propagateUIDs, string(user.UID))
 		}
 
-		// We could check if we already have them flagged as in the channel.
+		// Like JOIN, their join counts towards our join throttle.
+		if _, member := channel.Members[user.UID]; !member {
+			channel.recordJoin(time.Now())
+		}
 
 		// Flag them as being in the channel.
 		channel.Members[user.UID] = struct{}{}
 		user.Channels[channel.Name] = channel
+		delete(channel.Invites, user.UID)
 
 		if opped {
 			channel.grantOps(user)
@@ -1175,14 +1508,38 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		}
 	}
 
-	// Propagate.
+	if len(channel.Members) == 0 {
+		delete(s.Catbox.Channels, channel.Name)
+	}
+
+	if len(propagateUIDs) == 0 {
+		return
+	}
+
+	// Propagate. As the TS6 spec says, we send the TS we ended up with, and their
+	// modes and statuses only if we accepted them. Otherwise a server that
+	// doesn't have the channel would accept them.
+	params := []string{fmt.Sprintf("%d", channel.TS), channel.Name}
+	if acceptModes {
+		params = append(params, m.Params[2:len(m.Params)-1]...)
+	} else {
+		params = append(params, "+")
+	}
+	params = append(params, strings.Join(propagateUIDs, " "))
+
+	propagateMessage := irc.Message{
+		Prefix:  m.Prefix,
+		Command: "SJOIN",
+		Params:  params,
+	}
+
 	for _, server := range s.Catbox.LocalServers {
 		// Don't send it to the server we just heard it from.
 		if server == s {
 			continue
 		}
 
-		server.maybeQueueMessage(m)
+		server.maybeQueueMessage(propagateMessage)
 	}
 }
 
@@ -1208,7 +1565,7 @@ func (s *LocalServer) tbCommand(m irc.Message) {
 	}
 
 	// Look up the channel. We must know about it already.
-	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	channel, exists := s.channel(m.Params[0])
 	if !exists {
 		s.quit("Unknown channel (TB)")
 		return
@@ -1264,46 +1621,126 @@ func (s *LocalServer) tbCommand(m irc.Message) {
 	// We either have no topic, or our topic is set but we're receiving an older
 	// one.
 
-	// Update our records.
-	channel.Topic = topic
-	channel.TopicSetter = setter
-	channel.TopicTS = topicTS
-
-	// Tell our local clients about the topic change.
-	for memberUID := range channel.Members {
-		member := s.Catbox.Users[memberUID]
-		if !member.isLocal() {
-			continue
-		}
-
-		member.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  server.Name,
-			Command: "TOPIC",
-			Params:  []string{channel.Name, channel.Topic},
-		})
-	}
-
-	// Propagate to other servers.
-	for _, ls := range s.Catbox.LocalServers {
-		if ls == s {
-			continue
-		}
-		ls.maybeQueueMessage(m)
-	}
+	s.burstTopic(server, channel, topic, setter, topicTS)
 }
 
-func (s *LocalServer) joinCommand(m irc.Message) {
-	// Parameters: <channel TS> <channel> +
-	//   OR: 0 (to part all channels)
-
-	if len(m.Params) < 1 {
+// We receive TBURST commands during burst if the other side supports the
+// TBURST capability. Like TB they tell us about the topic of a channel, but
+// they include the channel TS.
+//
+// Parameters: <channel TS> <channel> <topic TS> <setter> <topic>
+//
+// If their channel is older than ours, their topic wins. If it is newer, ours
+// does. If the channels are the same age, the newer topic wins. This is what
+// hybrid and ratbox do.
+func (s *LocalServer) tburstCommand(m irc.Message) {
+	if len(m.Params) < 5 {
 		// 461 ERR_NEEDMOREPARAMS
-		s.messageFromServer("461", []string{"JOIN", "Not enough parameters"})
+		s.messageFromServer("461", []string{"TBURST", "Not enough parameters"})
 		return
 	}
 
-	// Do we know the user?
-	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		s.quit("Unknown server (TBURST)")
+		return
+	}
+
+	// We may not know the channel. e.g., if it has no members.
+	channel, exists := s.channel(m.Params[1])
+	if !exists {
+		return
+	}
+
+	channelTS, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil {
+		s.quit("Invalid channel TS (TBURST)")
+		return
+	}
+
+	topicTS, err := strconv.ParseInt(m.Params[2], 10, 64)
+	if err != nil {
+		s.quit("Invalid topic TS (TBURST)")
+		return
+	}
+
+	setter := m.Params[3]
+
+	topic := m.Params[4]
+	if len(topic) > maxTopicLength {
+		topic = topic[:maxTopicLength]
+	}
+
+	if channelTS > channel.TS {
+		return
+	}
+
+	if channelTS == channel.TS && len(channel.Topic) > 0 &&
+		topicTS <= channel.TopicTS {
+		return
+	}
+
+	if topic == channel.Topic && setter == channel.TopicSetter &&
+		topicTS == channel.TopicTS {
+		return
+	}
+
+	s.burstTopic(server, channel, topic, setter, topicTS)
+}
+
+// burstTopic sets a channel's topic we accepted from TB or TBURST. We tell our
+// local users and the other servers.
+func (s *LocalServer) burstTopic(server *Server, channel *Channel, topic,
+	setter string, topicTS int64) {
+	topicChanged := topic != channel.Topic
+
+	// Update our records.
+	channel.Topic = topic
+	channel.TopicSetter = setter
+	channel.TopicTS = topicTS
+	s.Catbox.chanServTopicChanged(channel)
+
+	// Propagate to other servers. Each gets the form it supports.
+	for _, ls := range s.Catbox.LocalServers {
+		if ls == s {
+			continue
+		}
+		if m, ok := ls.topicBurstMessage(string(server.SID), channel); ok {
+			ls.maybeQueueMessage(m)
+		}
+	}
+
+	if !topicChanged {
+		return
+	}
+
+	// Tell our local clients about the topic change.
+	for memberUID := range channel.Members {
+		member := s.Catbox.Users[memberUID]
+		if !member.isLocal() {
+			continue
+		}
+
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  server.Name,
+			Command: "TOPIC",
+			Params:  []string{channel.Name, channel.Topic},
+		})
+	}
+}
+
+func (s *LocalServer) joinCommand(m irc.Message) {
+	// Parameters: <channel TS> <channel> +
+	//   OR: 0 (to part all channels)
+
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"JOIN", "Not enough parameters"})
+		return
+	}
+
+	// Do we know the user?
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
 	if !exists {
 		s.quit("Unknown UID (JOIN)")
 		return
@@ -1341,7 +1778,7 @@ func (s *LocalServer) joinCommand(m irc.Message) {
 	}
 
 	chanName := canonicalizeChannel(m.Params[1])
-	if !isValidChannel(chanName) {
+	if !isValidChannel(chanName) || isLocalChannel(chanName) {
 		// Be lenient about what channel names may be on other servers.
 		// 403 ERR_NOSUCHCHANNEL
 		s.messageFromServer("403", []string{chanName, "Invalid channel name"})
@@ -1356,13 +1793,7 @@ func (s *LocalServer) joinCommand(m irc.Message) {
 	// Create the channel if necessary.
 	channel, channelExists := s.Catbox.Channels[chanName]
 	if !channelExists {
-		channel = &Channel{
-			Name:    chanName,
-			Members: make(map[TS6UID]struct{}),
-			Ops:     make(map[TS6UID]*User),
-			Modes:   make(map[byte]struct{}),
-			TS:      channelTS,
-		}
+		channel = NewChannel(chanName, channelTS)
 		s.Catbox.Channels[channel.Name] = channel
 		// No modes set yet.
 	}
@@ -1379,6 +1810,11 @@ func (s *LocalServer) joinCommand(m irc.Message) {
 	// Put the user in it.
 	channel.Members[user.UID] = struct{}{}
 	user.Channels[channel.Name] = channel
+	delete(channel.Invites, user.UID)
+
+	// Their server decided whether they could join, but their join still counts
+	// towards our join throttle.
+	channel.recordJoin(time.Now())
 
 	// Tell our local users who are in the channel about the new member.
 	msg := irc.Message{
@@ -1435,45 +1871,18 @@ func (s *LocalServer) nickCommand(m irc.Message) {
 	// "user" to "User". Check who we collided with that it is a different user.
 
 	if canonicalizeNick(nick) != canonicalizeNick(user.DisplayNick) {
-		if !s.Catbox.handleCollision(s, user.UID, nick, user.Username,
-			user.Hostname, nickTS, "NICK") {
+		if s.Catbox.handleCollision(s, user.UID, nick, user.Username,
+			user.DisplayHost, nickTS, "NICK") == collisionReject {
 			return
 		}
 	}
 
-	// Tell our local clients who are in a channel with this user.
-	// Tell each user only once.
-	// Do this prior to updating the user record as it needs to come from the
-	// old nick!user@host.
-	toldUsers := make(map[TS6UID]struct{})
-	for _, channel := range user.Channels {
-		for memberUID := range channel.Members {
-			member := s.Catbox.Users[memberUID]
-			if !member.isLocal() {
-				continue
-			}
-
-			_, exists := toldUsers[member.UID]
-			if exists {
-				continue
-			}
-			toldUsers[member.UID] = struct{}{}
-
-			member.LocalUser.maybeQueueMessage(irc.Message{
-				Prefix:  user.nickUhost(),
-				Command: "NICK",
-				Params:  []string{nick},
-			})
-		}
-	}
-
-	// Update our records, their nick, and their nick TS.
+	// We don't check +N (no nick changes) here. The user's server decides
+	// whether they may change their nick, and if we refused we'd desync. This
+	// means users on servers that don't support +N may change their nick on a
+	// +N channel.
 
-	delete(s.Catbox.Nicks, canonicalizeNick(user.DisplayNick))
-	s.Catbox.Nicks[canonicalizeNick(nick)] = user.UID
-
-	user.DisplayNick = nick
-	user.NickTS = nickTS
+	s.Catbox.renameUser(user, nick, nickTS)
 
 	// Propagate to other servers.
 	for _, server := range s.Catbox.LocalServers {
@@ -1484,6 +1893,37 @@ func (s *LocalServer) nickCommand(m irc.Message) {
 	}
 }
 
+// SAVE tells us a server resolved a nick collision by changing a user's nick
+// to their UID.
+//
+// Parameters: <UID> <nick TS>
+// If the nick TS is not the user's, the user changed nick since. We ignore it.
+func (s *LocalServer) saveCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SAVE", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		// The user may have quit while this was in flight.
+		return
+	}
+
+	nickTS, err := strconv.ParseInt(m.Params[1], 10, 64)
+	if err != nil {
+		s.quit("Invalid TS (SAVE)")
+		return
+	}
+
+	if nickTS != user.NickTS || user.DisplayNick == string(user.UID) {
+		return
+	}
+
+	s.Catbox.saveUser(s, user)
+}
+
 func (s *LocalServer) partCommand(m irc.Message) {
 	// Params: <comma separated list of channels> <message>
 
@@ -1511,7 +1951,7 @@ func (s *LocalServer) partCommand(m irc.Message) {
 
 	// Part each.
 	for _, channelName := range channelNames {
-		channel, exists := s.Catbox.Channels[channelName]
+		channel, exists := s.channel(channelName)
 		if !exists {
 			s.quit("Unknown channel (PART)")
 			return
@@ -1564,17 +2004,7 @@ func (s *LocalServer) wallopsCommand(m irc.Message) {
 		return
 	}
 
-	// Send WALLOPS to all our local opers.
-	for _, oper := range s.Catbox.Opers {
-		if !oper.isLocal() {
-			continue
-		}
-		oper.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  origin,
-			Command: "WALLOPS",
-			Params:  []string{text},
-		})
-	}
+	s.Catbox.wallopsLocalUsers(origin, text, m.Command == "OPERWALL")
 
 	// Propagate to other servers.
 	for _, ls := range s.Catbox.LocalServers {
@@ -1585,6 +2015,35 @@ func (s *LocalServer) wallopsCommand(m irc.Message) {
 	}
 }
 
+// The GLOBOPS command comes only in ENCAP messages. It is a notice for all
+// operators. Show it to ours. ENCAP passes it on.
+//
+// Parameters: <text to send>
+func (s *LocalServer) globopsCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"GLOBOPS", "Not enough parameters"})
+		return
+	}
+
+	// Origin is either a user or a server. We may not know it if it quit while
+	// this was in flight.
+	origin := ""
+	if user, exists := s.Catbox.Users[TS6UID(m.Prefix)]; exists {
+		origin = user.DisplayNick
+	}
+	if origin == "" {
+		if server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]; exists {
+			origin = server.Name
+		}
+	}
+	if origin == "" {
+		return
+	}
+
+	s.Catbox.globopsLocalOpers(origin, m.Params[0])
+}
+
 // QUIT tells us a remote client is gone.
 func (s *LocalServer) quitCommand(m irc.Message) {
 	// Parameters: <quit comment>
@@ -1648,7 +2107,7 @@ func (s *LocalServer) modeCommand(m irc.Message) {
 			continue
 		}
 
-		if c == 'i' || c == 'o' || c == 'C' {
+		if isUserMode(byte(c)) {
 			if motion == '+' {
 				user.Modes[byte(c)] = struct{}{}
 				if c == 'o' {
@@ -1697,7 +2156,7 @@ func (s *LocalServer) topicCommand(m irc.Message) {
 	}
 
 	chanName := canonicalizeChannel(m.Params[0])
-	channel, exists := s.Catbox.Channels[chanName]
+	channel, exists := s.channel(chanName)
 	if !exists {
 		// 403 ERR_NOSUCHCHANNEL
 		s.messageFromServer("403", []string{chanName, "No such channel"})
@@ -1722,6 +2181,10 @@ func (s *LocalServer) topicCommand(m irc.Message) {
 	channel.TopicTS = time.Now().Unix()
 	channel.TopicSetter = sourceUser.nickUhost()
 
+	s.Catbox.logModeration(channel, channel.TopicSetter,
+		"TOPIC "+channel.Topic)
+	s.Catbox.chanServTopicChanged(channel)
+
 	// Tell local clients who are in the channel about the topic change.
 
 	params := []string{channel.Name}
@@ -1752,6 +2215,73 @@ func (s *LocalServer) topicCommand(m irc.Message) {
 	}
 }
 
+// KICK tells us a user removed another from a channel. The source may be a
+// user or a server.
+func (s *LocalServer) kickCommand(m irc.Message) {
+	// Parameters: <channel> <target UID> [comment]
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"KICK", "Not enough parameters"})
+		return
+	}
+
+	origin := ""
+	if sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]; exists {
+		origin = sourceUser.nickUhost()
+	} else if sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]; exists {
+		origin = sourceServer.Name
+	} else {
+		s.quit("Unknown source (KICK)")
+		return
+	}
+
+	targetUser, exists := s.Catbox.Users[TS6UID(m.Params[1])]
+	if !exists {
+		s.quit("Unknown target user (KICK)")
+		return
+	}
+
+	// The target may have parted already (and the channel may be gone). If so
+	// there's nothing to do.
+	channel, exists := s.channel(m.Params[0])
+	if !exists || !targetUser.onChannel(channel) {
+		return
+	}
+
+	reason := targetUser.DisplayNick
+	if len(m.Params) >= 3 && len(m.Params[2]) > 0 {
+		reason = m.Params[2]
+	}
+	if len(reason) > maxKickLength {
+		reason = reason[:maxKickLength]
+	}
+
+	// We could check the source user has ops.
+
+	s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+		Prefix:  origin,
+		Command: "KICK",
+		Params:  []string{channel.Name, targetUser.DisplayNick, reason},
+	})
+
+	s.Catbox.logModeration(channel, origin,
+		fmt.Sprintf("KICK %s %s", targetUser.DisplayNick, reason))
+
+	channel.removeUser(targetUser)
+
+	if len(channel.Members) == 0 {
+		delete(s.Catbox.Channels, channel.Name)
+	}
+
+	// Propagate to other servers.
+	for _, server := range s.Catbox.LocalServers {
+		if server == s {
+			continue
+		}
+		server.maybeQueueMessage(m)
+	}
+}
+
 // SQUIT tells us there is a server departing.
 func (s *LocalServer) squitCommand(m irc.Message) {
 	// Parameters: <target server SID> <comment/reason>
@@ -1791,6 +2321,8 @@ func (s *LocalServer) squitCommand(m irc.Message) {
 		// delinking.
 
 		if targetServer.isLocal() {
+			s.Catbox.noticeOpers(fmt.Sprintf("Received SQUIT %s from %s (%s)",
+				targetServer.Name, sourceUser.DisplayNick, m.Params[1]))
 			targetServer.LocalServer.quit(fmt.Sprintf("%s issued SQUIT: %s",
 				sourceUser.DisplayNick, m.Params[1]))
 			return
@@ -1828,6 +2360,8 @@ func (s *LocalServer) squitCommand(m irc.Message) {
 
 	s.Catbox.noticeLocalOpers(fmt.Sprintf("%s delinked from %s: %s",
 		targetServer.Name, targetServer.LinkedTo.Name, m.Params[1]))
+	logEvent("link", "%s delinked from %s: %s", targetServer.Name,
+		targetServer.LinkedTo.Name, m.Params[1])
 }
 
 // KILL tells us about a client getting disconnected forcefully.
@@ -1904,6 +2438,8 @@ func (s *LocalServer) killCommand(m irc.Message) {
 	s.Catbox.noticeLocalOpers(
 		fmt.Sprintf("Received KILL message for %s. From %s Path: %s (%s)",
 			targetUser.DisplayNick, source, sourceInfo, reason))
+	logEvent("kill", "%s (%s@%s) was killed by %s (%s)", targetUser.DisplayNick,
+		targetUser.Username, targetUser.Hostname, source, reason)
 
 	// TODO: Combine following logic with cleanupKilledUser()?
 
@@ -1991,502 +2527,1680 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 			Params:  subParams,
 		})
 	}
-
-	// Propagate everywhere.
-	for _, server := range s.Catbox.LocalServers {
-		if server == s {
-			continue
-		}
-		server.maybeQueueMessage(m)
+	if subCommand == "LOGIN" {
+		s.loginCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-}
-
-// The KLINE command comes only in ENCAP messages.
-//
-// Apply a ban on user@host.
-//
-// Currently this is persistent only for the runtime.
-//
-// Parameters: <duration> <user mask> <host mask> [<reason>]
-// Example (with ENCAP portion dropped):
-// :1SNAAAAAF KLINE 0 * 127.5.5.5 :bye bye
-//
-// At this time we treat all KLINEs as "permanent" for the duration of our run.
-// i.e., we ignore duration.
-func (s *LocalServer) klineCommand(m irc.Message) {
-	if len(m.Params) < 3 {
-		// 461 ERR_NEEDMOREPARAMS
-		s.messageFromServer("461", []string{"KLINE", "Not enough parameters"})
-		return
+	if subCommand == "SU" {
+		s.suCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-
-	source := ""
-	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
-	if exists {
-		source = user.DisplayNick
+	if subCommand == "CERTFP" {
+		s.certfpCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-	if source == "" {
-		// I'm unsure if we can get klines this way (servers as source).
-		server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
-		if exists {
-			source = server.Name
-		}
+	if subCommand == "SETNAME" {
+		s.setnameCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-	if source == "" {
-		log.Printf("Unknown source for KLINE command")
-		return
+	if subCommand == "CHGHOST" {
+		s.chghostCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-
-	// I ignore duration at this time. It's permanent.
-
-	reason := "<No reason given>"
-	if len(m.Params) > 3 {
-		reason = m.Params[3]
+	if subCommand == "SAJOIN" {
+		s.sajoinCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-
-	kline := KLine{
-		UserMask: m.Params[1],
-		HostMask: m.Params[2],
-		Reason:   reason,
+	if subCommand == "SAPART" {
+		s.sapartCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-
-	s.Catbox.addAndApplyKLine(kline, source, reason)
-
-	// We don't need to propagate. Since KLINE comes in through an ENCAP command,
-	// it was propagated there.
-}
-
-// UNKLINE <user mask> <host mask>
-func (s *LocalServer) unklineCommand(m irc.Message) {
-	if len(m.Params) < 2 {
-		// 461 ERR_NEEDMOREPARAMS
-		s.messageFromServer("461", []string{"UNKLINE", "Not enough parameters"})
-		return
+	if subCommand == "SAMODE" {
+		s.samodeCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-
-	source := ""
-	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
-	if exists {
-		source = user.DisplayNick
+	if subCommand == "SVSNICK" {
+		s.svsnickCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-	if source == "" {
-		// I'm unsure if we can get klines this way (servers as source).
-		server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
-		if exists {
-			source = server.Name
-		}
+	if subCommand == "SVSMODE" {
+		s.svsmodeCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
-	if source == "" {
-		log.Printf("Unknown source for UNKLINE command")
-		return
+	if subCommand == "SVSHOST" {
+		s.svshostCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "SVSJOIN" {
+		s.svsjoinCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "SVSPART" {
+		s.svspartCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "REALHOST" {
+		s.realhostCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "SASL" {
+		s.saslCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "SVSLOGIN" {
+		s.svsloginCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "MECHLIST" {
+		s.mechlistCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "GLOBOPS" {
+		s.globopsCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
+	}
+	if subCommand == "CATBOXINFO" {
+		s.catboxInfoCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: subCommand,
+			Params:  subParams,
+		})
 	}
 
-	userMask := m.Params[0]
-	hostMask := m.Params[1]
+	// Propagate everywhere.
+	for _, server := range s.Catbox.LocalServers {
+		if server == s {
+			continue
+		}
+		server.maybeQueueMessage(m)
+	}
+}
 
-	// Find it.
-	s.Catbox.removeKLine(userMask, hostMask, source)
+// The LOGIN command comes only in ENCAP messages. A user's server uses it to
+// tell us the account the user is logged in to. It is like SU except the user
+// is the source.
+//
+// Parameters: <account>
+func (s *LocalServer) loginCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"LOGIN", "Not enough parameters"})
+		return
+	}
 
-	// We don't need to propagate as UNKLINE comes inside ENCAP.
+	s.suCommand(irc.Message{
+		Prefix:  m.Prefix,
+		Command: "SU",
+		Params:  []string{m.Prefix, m.Params[0]},
+	})
 }
 
-// Upon link to a server, it tells us about the capabilities of all servers
-// it introduces to us. This comes in this form:
-// :3SN ENCAP * GCAP :QS EX CHW IE GLN KNOCK TB ENCAP SAVE SAVETS_100
-// Where 3SN is the server with these capabilities.
-// We remember this information so we can tell servers we link to in the future.
-func (s *LocalServer) gcapCommand(m irc.Message) {
-	if len(m.Params) == 0 {
-		// We're TS6 only. Servers must have at least QS and ENCAP to be TS6.
-		s.quit(fmt.Sprintf("GCAP from %s with no capabs", m.Prefix))
+// The SU command comes only in ENCAP messages. Services use it to tell us a
+// user logged in to or out of an account. The user's own server may too, such
+// as in its burst.
+//
+// Parameters: <UID> [account]
+// If account is missing or blank, the user logged out.
+func (s *LocalServer) suCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SU", "Not enough parameters"})
 		return
 	}
 
-	// Ensure we know the server.
-	server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
 	if !exists {
-		s.quit(fmt.Sprintf("Unknown server (GCAP): %s", m.Prefix))
+		// The user may have quit while this was in flight.
 		return
 	}
 
-	capabs := parseCapabsString(m.Params[0])
-
-	// For TS6 we must have QS and ENCAP.
-
-	_, exists = capabs["QS"]
-	if !exists {
-		s.quit(fmt.Sprintf("%s is missing capab QS", server.Name))
+	if !s.accountSource(m.Prefix, user) {
+		s2sLog.Warnf("Ignoring %s from %s for %s. It's not services or their server.",
+			m.Command, m.Prefix, user)
 		return
 	}
 
-	_, exists = capabs["ENCAP"]
-	if !exists {
-		s.quit(fmt.Sprintf("%s is missing capab ENCAP", server.Name))
+	account := ""
+	if len(m.Params) >= 2 {
+		account = m.Params[1]
+	}
+	if account == user.Account {
 		return
 	}
 
-	if server.Capabs != nil {
-		s.quit(fmt.Sprintf("Already received GCAP from %s!", server.Name))
+	// Our NickServ's accounts are ours. Another server can't log users in to
+	// them, or log our users out of them.
+	if s.Catbox.isNickServAccount(account) ||
+		(user.isLocal() && s.Catbox.isNickServAccount(user.Account)) {
+		s2sLog.Warnf("Ignoring %s from %s for %s. Our NickServ keeps the account.",
+			m.Command, m.Prefix, user)
 		return
 	}
+	user.Account = account
+	s.Catbox.notifyAccountChange(user)
 
-	server.Capabs = capabs
-
-	// We don't need to propagate. GCAP comes inside ENCAP. Already propagated.
+	s.Catbox.applyAccountVhost(user)
 }
 
-// Params: <uid> <nick>
-// e.g. :1SNAAAAAB WHOIS 000AAAAAA :horgh
-func (s *LocalServer) whoisCommand(m irc.Message) {
-	if len(m.Params) < 2 {
+// The CERTFP command comes only in ENCAP messages. It tells us the TLS client
+// certificate fingerprint of the user sending it.
+//
+// Parameters: <fingerprint>
+func (s *LocalServer) certfpCommand(m irc.Message) {
+	if len(m.Params) < 1 {
 		// 461 ERR_NEEDMOREPARAMS
-		s.messageFromServer("461", []string{"WHOIS", "Not enough parameters"})
+		s.messageFromServer("461", []string{"CERTFP", "Not enough parameters"})
 		return
 	}
 
-	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
 	if !exists {
-		log.Printf("WHOIS from unknown user %s", m.Prefix)
 		return
 	}
 
-	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
-	if !exists {
-		// 401 ERR_NOSUCHNICK
-		sourceUser.ClosestServer.maybeQueueMessage(irc.Message{
-			Prefix:  s.Catbox.Config.ServerName,
-			Command: "401",
-			Params: []string{sourceUser.DisplayNick, m.Params[0],
-				"No such nick/channel"},
-		})
+	// We match fingerprints against SHA-256 ones from our config. Ignore any
+	// other kind.
+	certFP := strings.ToLower(m.Params[0])
+	if _, err := hex.DecodeString(certFP); err != nil ||
+		len(certFP) != sha256.Size*2 {
+		s2sLog.Warnf("Ignoring invalid CERTFP for %s from %s: %s", user.DisplayNick,
+			s.Server.Name, m.Params[0])
 		return
 	}
+	user.CertFP = certFP
+}
 
-	// If it's a local user, reply back to the server.
-	if user.isLocal() {
-		msgs := s.Catbox.createWHOISResponse(user, sourceUser, true)
-		for _, msg := range msgs {
-			sourceUser.ClosestServer.maybeQueueMessage(msg)
-		}
+// The SETNAME command comes only in ENCAP messages. It tells us the real name
+// of the user sending it changed.
+//
+// Parameters: <real name>
+func (s *LocalServer) setnameCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SETNAME", "Not enough parameters"})
 		return
 	}
 
-	// If remote user, propagate to the closest server
-	user.ClosestServer.maybeQueueMessage(m)
-}
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists || user.isLocal() {
+		return
+	}
 
-// We've got a numeric command.
-// For example, a reply to a remote WHOIS.
-//
-// Look up where it's going and if it's local, send it to the local client.
-// If it's remote, propagate it on.
-func (s *LocalServer) numericCommand(m irc.Message) {
-	// Only servers should be sending numerics.
-	sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
-	if !exists {
-		log.Printf("Numeric from unknown server %s", m.Prefix)
+	realName := m.Params[0]
+	if len(realName) > maxRealNameLength {
+		realName = realName[:maxRealNameLength]
+	}
+	if realName == user.RealName {
 		return
 	}
+	user.RealName = realName
+	s.Catbox.notifyRealNameChange(user)
+}
 
-	if len(m.Params) == 0 {
-		log.Printf("Numeric with no parameters")
+// The CHGHOST command comes only in ENCAP messages. It tells us the hostname
+// a user shows changed. Their real hostname changes too if it was the same as
+// the one they showed. If it wasn't, we hear it with REALHOST.
+//
+// Parameters: <UID> <hostname>
+func (s *LocalServer) chghostCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"CHGHOST", "Not enough parameters"})
 		return
 	}
 
-	// Find the target.
 	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
 	if !exists {
-		log.Printf("Numeric %s for unknown user %s", m.Command, m.Params[0])
+		// The user may have quit while this was in flight.
 		return
 	}
 
-	// If it's for a local client, then send it to them, and done.
-	if user.isLocal() {
-		// First parameter is the target user. We get it as UID. Turn into NICK.
-		params := []string{user.DisplayNick}
-		if len(m.Params) > 1 {
-			params = append(params, m.Params[1:]...)
-		}
-		user.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  sourceServer.Name,
-			Command: m.Command,
-			Params:  params,
-		})
+	if user.DisplayHost == m.Params[1] {
 		return
 	}
 
-	// It's destined somewhere remote. Pass it on its way.
-	user.ClosestServer.maybeQueueMessage(m)
-}
+	// If it's our user, an operator elsewhere gave them a vhost. We know their
+	// real hostname, so it stays.
+	oldUhost := user.nickUhost()
+	if user.Hostname == user.DisplayHost && user.isRemote() {
+		user.Hostname = m.Params[1]
+	}
+	user.DisplayHost = m.Params[1]
+	s.Catbox.notifyHostChange(user, oldUhost)
 
-// This is a custom command I built into ratbox.
-// For more information, refer to where I generate it in registerUser().
-// Do nothing but propagate.
-func (s *LocalServer) cliconnCommand(m irc.Message) {
-	for _, server := range s.Catbox.LocalServers {
-		if server == s {
-			continue
-		}
-		server.maybeQueueMessage(m)
+	if user.isLocal() {
+		user.LocalUser.Vhost = m.Params[1]
+		user.LocalUser.sendHostHidden()
 	}
 }
 
-// A user is either set AWAY or set UNAWAY.
-// Parameters: [away reason]
-func (s *LocalServer) awayCommand(m irc.Message) {
-	reason := ""
-	if len(m.Params) > 0 {
-		reason = m.Params[0]
+// The REALHOST command comes only in ENCAP messages. The user sends it to tell
+// us their real hostname when it differs from the one they show (e.g., they
+// are cloaked). Operators see it and we match bans against it.
+//
+// Parameters: <hostname>
+func (s *LocalServer) realhostCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"REALHOST", "Not enough parameters"})
+		return
 	}
 
-	// Find the user.
 	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
 	if !exists {
-		s.quit("Unknown user (AWAY)")
 		return
 	}
 
-	// Flag the user away or not.
+	user.Hostname = m.Params[0]
+}
 
-	if len(reason) > 0 {
-		user.AwayMessage = reason
-	} else {
-		// If they're not away and this is telling us to set unaway, just ignore it.
-		// Something is wrong.
-		if len(user.AwayMessage) == 0 {
-			return
+// The KLINE command comes only in ENCAP messages.
+//
+// Apply a ban on user@host.
+//
+// We keep it across restarts if we have a bans file (bans-file).
+//
+// Parameters: <duration> <user mask> <host mask> [<reason>]
+// Example (with ENCAP portion dropped):
+// :1SNAAAAAF KLINE 0 * 127.5.5.5 :bye bye
+//
+// Duration is in seconds. 0 means it is permanent.
+func (s *LocalServer) klineCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"KLINE", "Not enough parameters"})
+		return
+	}
+
+	source := ""
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if exists {
+		source = user.DisplayNick
+	}
+	if source == "" {
+		// I'm unsure if we can get klines this way (servers as source).
+		server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+		if exists {
+			source = server.Name
+		}
+	}
+	if source == "" {
+		s2sLog.Warnf("Unknown source for KLINE command")
+		return
+	}
+
+	duration, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil || duration < 0 {
+		s2sLog.Warnf("Invalid KLINE duration: %s", m.Params[0])
+		return
+	}
+
+	reason := "<No reason given>"
+	if len(m.Params) > 3 {
+		reason = m.Params[3]
+	}
+
+	kline := KLine{
+		UserMask: m.Params[1],
+		HostMask: m.Params[2],
+		Reason:   reason,
+	}
+	if duration > 0 {
+		kline.Expires = time.Now().Unix() + duration
+	}
+
+	s.Catbox.addAndApplyKLine(kline, source, reason)
+
+	// We don't need to propagate. Since KLINE comes in through an ENCAP command,
+	// it was propagated there.
+}
+
+// KLINE not in ENCAP. Servers with the KLN capab send this.
+//
+// Parameters: <target server mask> <duration> <user mask> <host mask> <reason>
+func (s *LocalServer) nativeKlineCommand(m irc.Message) {
+	if len(m.Params) < 4 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"KLINE", "Not enough parameters"})
+		return
+	}
+
+	// Servers burst their K-Lines. We likely have most of them already. Don't
+	// tell opers about each or send them on.
+	if s.Bursting && s.Catbox.KLineIndex.has(m.Params[2], m.Params[3]) {
+		return
+	}
+
+	if matchMask(m.Params[0], s.Catbox.Config.ServerName) {
+		s.klineCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: m.Command,
+			Params:  m.Params[1:],
+		})
+	}
+
+	reason := "<No reason given>"
+	if len(m.Params) > 4 {
+		reason = m.Params[4]
+	}
+
+	s.Catbox.propagateKLine(s, m.Prefix, m.Params[0], m.Params[1], m.Params[2],
+		m.Params[3], reason)
+}
+
+// UNKLINE not in ENCAP. Servers with the UNKLN capab send this.
+//
+// Parameters: <target server mask> <user mask> <host mask>
+func (s *LocalServer) nativeUnklineCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"UNKLINE", "Not enough parameters"})
+		return
+	}
+
+	if matchMask(m.Params[0], s.Catbox.Config.ServerName) {
+		s.unklineCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: m.Command,
+			Params:  m.Params[1:],
+		})
+	}
+
+	s.Catbox.propagateUnkline(s, m.Prefix, m.Params[0], m.Params[1],
+		m.Params[2])
+}
+
+// BAN sets, changes, or removes a network wide ban. Servers with the BAN capab
+// send this. See PropagatedBan.
+//
+// Parameters: <type> <user mask> <host mask> <creation TS> <duration>
+// <lifetime> <oper> <reason>
+//
+// A duration of 0 means the ban was removed. We apply only K-Lines (type K)
+// but relay other types too.
+func (s *LocalServer) banCommand(m irc.Message) {
+	if len(m.Params) < 8 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"BAN", "Not enough parameters"})
+		return
+	}
+
+	source := ""
+	if user, exists := s.Catbox.Users[TS6UID(m.Prefix)]; exists {
+		source = user.DisplayNick
+	} else if server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]; exists {
+		source = server.Name
+	}
+	if source == "" {
+		s2sLog.Warnf("Unknown source for BAN command")
+		return
+	}
+
+	created, err := strconv.ParseInt(m.Params[3], 10, 64)
+	if err != nil {
+		s2sLog.Warnf("Invalid BAN creation TS: %s", m.Params[3])
+		return
+	}
+	duration, err := strconv.ParseInt(m.Params[4], 10, 64)
+	if err != nil || duration < 0 {
+		s2sLog.Warnf("Invalid BAN duration: %s", m.Params[4])
+		return
+	}
+	lifetime, err := strconv.ParseInt(m.Params[5], 10, 64)
+	if err != nil || lifetime < duration {
+		s2sLog.Warnf("Invalid BAN lifetime: %s", m.Params[5])
+		return
+	}
+
+	ban := PropagatedBan{
+		Type:     m.Params[0],
+		UserMask: m.Params[1],
+		HostMask: m.Params[2],
+		Created:  created,
+		Duration: duration,
+		Lifetime: lifetime,
+		Oper:     m.Params[6],
+		Reason:   m.Params[7],
+	}
+
+	// If we knew a newer version we don't relay this one. The servers we'd
+	// relay to should know the newer version already.
+	if !s.Catbox.applyPropagatedBan(ban, source) {
+		return
+	}
+
+	s.Catbox.propagateBan(s, m.Prefix, ban, false)
+}
+
+// UNKLINE <user mask> <host mask>
+func (s *LocalServer) unklineCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"UNKLINE", "Not enough parameters"})
+		return
+	}
+
+	source := ""
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if exists {
+		source = user.DisplayNick
+	}
+	if source == "" {
+		// I'm unsure if we can get klines this way (servers as source).
+		server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+		if exists {
+			source = server.Name
+		}
+	}
+	if source == "" {
+		s2sLog.Warnf("Unknown source for UNKLINE command")
+		return
+	}
+
+	userMask := m.Params[0]
+	hostMask := m.Params[1]
+
+	// Find it.
+	s.Catbox.removeKLine(userMask, hostMask, source)
+
+	// We don't need to propagate as UNKLINE comes inside ENCAP.
+}
+
+// Upon link to a server, it tells us about the capabilities of all servers
+// it introduces to us. This comes in this form:
+// :3SN ENCAP * GCAP :QS EX CHW IE GLN KNOCK TB ENCAP SAVE SAVETS_100
+// Where 3SN is the server with these capabilities.
+// We remember this information so we can tell servers we link to in the future.
+func (s *LocalServer) gcapCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// We're TS6 only. Servers must have at least QS and ENCAP to be TS6.
+		s.quit(fmt.Sprintf("GCAP from %s with no capabs", m.Prefix))
+		return
+	}
+
+	// Ensure we know the server.
+	server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		s.quit(fmt.Sprintf("Unknown server (GCAP): %s", m.Prefix))
+		return
+	}
+
+	capabs := parseCapabsString(m.Params[0])
+
+	// For TS6 we must have QS and ENCAP.
+
+	_, exists = capabs["QS"]
+	if !exists {
+		s.quit(fmt.Sprintf("%s is missing capab QS", server.Name))
+		return
+	}
+
+	_, exists = capabs["ENCAP"]
+	if !exists {
+		s.quit(fmt.Sprintf("%s is missing capab ENCAP", server.Name))
+		return
+	}
+
+	if server.Capabs != nil {
+		s.quit(fmt.Sprintf("Already received GCAP from %s!", server.Name))
+		return
+	}
+
+	server.Capabs = capabs
+
+	// We don't need to propagate. GCAP comes inside ENCAP. Already propagated.
+}
+
+// Params: <uid> <nick>
+// e.g. :1SNAAAAAB WHOIS 000AAAAAA :horgh
+//
+// Or the target may be a server (<sid> <nick>) if the user asked a particular
+// server. e.g. :1SNAAAAAB WHOIS 000 :horgh
+func (s *LocalServer) whoisCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"WHOIS", "Not enough parameters"})
+		return
+	}
+
+	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		s2sLog.Debugf("WHOIS from unknown user %s", m.Prefix)
+		return
+	}
+
+	if isValidSID(m.Params[0]) {
+		s.whoisServerCommand(m, sourceUser)
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		// 401 ERR_NOSUCHNICK
+		sourceUser.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  s.Catbox.Config.ServerName,
+			Command: "401",
+			Params: []string{sourceUser.DisplayNick, m.Params[0],
+				"No such nick/channel"},
+		})
+		return
+	}
+
+	// If it's a local user, reply back to the server.
+	if user.isLocal() {
+		msgs := s.Catbox.createWHOISResponse(user, sourceUser, true)
+		for _, msg := range msgs {
+			sourceUser.ClosestServer.maybeQueueMessage(msg)
+		}
+		s.Catbox.whoisNotice(user, sourceUser)
+		return
+	}
+
+	// If remote user, propagate to the closest server
+	user.ClosestServer.maybeQueueMessage(m)
+}
+
+// whoisServerCommand handles a WHOIS for a nick asked of a particular server.
+//
+// If it's for us and the user is ours, we reply. If the user is elsewhere, we
+// ask their server. We can only tell everything about our own users.
+func (s *LocalServer) whoisServerCommand(m irc.Message, sourceUser *User) {
+	if TS6SID(m.Params[0]) != s.Catbox.Config.TS6SID {
+		server, exists := s.Catbox.Servers[TS6SID(m.Params[0])]
+		if !exists {
+			s2sLog.Debugf("WHOIS for unknown server %s", m.Params[0])
+			return
+		}
+		// Don't send it back where it came from.
+		if server.route() == s {
+			s2sLog.Warnf("WHOIS for %s would go back where it came from",
+				server.Name)
+			return
+		}
+		server.route().maybeQueueMessage(m)
+		return
+	}
+
+	uid, exists := s.Catbox.Nicks[canonicalizeNick(m.Params[1])]
+	if !exists {
+		// 401 ERR_NOSUCHNICK
+		sourceUser.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  string(s.Catbox.Config.TS6SID),
+			Command: "401",
+			Params: []string{string(sourceUser.UID), m.Params[1],
+				"No such nick/channel"},
+		})
+		return
+	}
+	user := s.Catbox.Users[uid]
+
+	if user.isLocal() {
+		msgs := s.Catbox.createWHOISResponse(user, sourceUser, true)
+		for _, msg := range msgs {
+			sourceUser.ClosestServer.maybeQueueMessage(msg)
+		}
+		s.Catbox.whoisNotice(user, sourceUser)
+		return
+	}
+
+	user.ClosestServer.maybeQueueMessage(irc.Message{
+		Prefix:  m.Prefix,
+		Command: "WHOIS",
+		Params:  []string{string(user.UID), m.Params[1]},
+	})
+}
+
+// We've got a numeric command.
+// For example, a reply to a remote WHOIS.
+//
+// Look up where it's going and if it's local, send it to the local client.
+// If it's remote, propagate it on.
+func (s *LocalServer) numericCommand(m irc.Message) {
+	// Only servers should be sending numerics.
+	sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		s2sLog.Debugf("Numeric from unknown server %s", m.Prefix)
+		return
+	}
+
+	if len(m.Params) == 0 {
+		s2sLog.Debugf("Numeric with no parameters")
+		return
+	}
+
+	// Find the target.
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		s2sLog.Debugf("Numeric %s for unknown user %s", m.Command, m.Params[0])
+		return
+	}
+
+	// If it's for a local client, then send it to them, and done.
+	if user.isLocal() {
+		// First parameter is the target user. We get it as UID. Turn into NICK.
+		params := []string{user.DisplayNick}
+		if len(m.Params) > 1 {
+			params = append(params, m.Params[1:]...)
+		}
+		// The other server may not hide servers. We do.
+		// 312 RPL_WHOISSERVER: <nick> <target> <server> :<server info>
+		if m.Command == "312" && len(params) >= 4 && s.Catbox.hidesServers(user) {
+			params[2], params[3] = s.Catbox.hiddenServer()
+		}
+		user.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  sourceServer.Name,
+			Command: m.Command,
+			Params:  params,
+		})
+		return
+	}
+
+	// It's destined somewhere remote. Pass it on its way.
+	user.ClosestServer.maybeQueueMessage(m)
+}
+
+// This is a custom command I built into ratbox.
+// For more information, refer to where I generate it in registerUser().
+// Do nothing but propagate.
+func (s *LocalServer) cliconnCommand(m irc.Message) {
+	for _, server := range s.Catbox.LocalServers {
+		if server == s {
+			continue
+		}
+		server.maybeQueueMessage(m)
+	}
+}
+
+// A user is either set AWAY or set UNAWAY.
+// Parameters: [away reason]
+func (s *LocalServer) awayCommand(m irc.Message) {
+	reason := ""
+	if len(m.Params) > 0 {
+		reason = m.Params[0]
+	}
+	if len(reason) > maxAwayLength {
+		reason = reason[:maxAwayLength]
+	}
+
+	// Find the user.
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		s.quit("Unknown user (AWAY)")
+		return
+	}
+
+	// Flag the user away or not.
+
+	if len(reason) > 0 {
+		user.AwayMessage = reason
+	} else {
+		// If they're not away and this is telling us to set unaway, just ignore it.
+		// Something is wrong.
+		if len(user.AwayMessage) == 0 {
+			return
 		}
 		user.AwayMessage = ""
 	}
 
-	// Propagate.
-	for _, server := range s.Catbox.LocalServers {
-		if server == s {
-			continue
-		}
-		server.maybeQueueMessage(m)
+	// Propagate.
+	for _, server := range s.Catbox.LocalServers {
+		if server == s {
+			continue
+		}
+		server.maybeQueueMessage(m)
+	}
+}
+
+// An INVITE command.
+// Source: <user UID>
+// Parameters: <target user UID> <channel> [channel TS]
+// Apparently channel TS is optional, but deprecated to be. However ratbox does
+// not send it, so allow it to not be present.
+// If channel TS indicates newer, ignore it.
+// Propagate it towards the target user if it's not a local user. Otherwise
+// if it's a local user, tell the user.
+func (s *LocalServer) inviteCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"INVITE", "Not enough parameters"})
+		return
+	}
+
+	// Find source user.
+	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		s.quit("Unknown source user (INVITE)")
+		return
+	}
+
+	// Find the target user.
+	targetUser, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		s.quit("Unknown target user (INVITE)")
+		return
+	}
+
+	// Find the channel.
+	channel, exists := s.channel(m.Params[1])
+	if !exists {
+		s.quit("Unknown channel (INVITE)")
+		return
+	}
+
+	// Assume the other side checked the invite was valid to proceed.
+
+	// Check channel TS if it's given.
+	if len(m.Params) >= 3 {
+		channelTS, err := strconv.ParseInt(m.Params[2], 10, 64)
+		if err != nil {
+			s.quit(fmt.Sprintf("Invalid channel TS: %s: %s", m.Params[2], err))
+			return
+		}
+
+		// If channel TS indicates the channel is newer than what we know, ignore.
+		if channelTS > channel.TS {
+			s.Catbox.noticeOpers(fmt.Sprintf("INVITE from %s to %s for %s has newer TS",
+				sourceUser.DisplayNick, targetUser.DisplayNick, channel.Name))
+			return
+		}
+	}
+
+	channel.addInvite(targetUser, sourceUser)
+	s.Catbox.notifyInvite(channel, sourceUser, targetUser)
+
+	// If it's a local user, tell the user, and that's it.
+	if targetUser.isLocal() {
+		targetUser.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  sourceUser.nickUhost(),
+			Command: "INVITE",
+			Params:  []string{targetUser.DisplayNick, channel.Name},
+		})
+		return
+	}
+
+	// If it's a remote user, propagate the message on its way.
+	targetUser.ClosestServer.maybeQueueMessage(m)
+}
+
+// TMODE propagates a channel mode change.
+// Source: user or server
+// Parameters: <channel TS> <channel> <mode changes> [parameters]
+func (s *LocalServer) tmodeCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"TMODE", "Not enough parameters"})
+		return
+	}
+
+	origin := ""
+	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if exists {
+		origin = sourceUser.nickUhost()
+	}
+	if origin == "" {
+		sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+		if exists {
+			origin = sourceServer.Name
+		}
+	}
+
+	if origin == "" {
+		s.quit("Unknown origin (TMODE)")
+		return
+	}
+
+	channelTS, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil {
+		s.quit(fmt.Sprintf("Invalid channel TS: %s: %s", m.Params[0], err))
+		return
+	}
+
+	channel, exists := s.channel(m.Params[1])
+	if !exists {
+		s.quit("Unknown channel (TMODE)")
+		return
+	}
+
+	// Ignore if the TS is newer
+	if channelTS > channel.TS {
+		s2sLog.Debugf("TMODE for channel %s has newer TS, ignoring", channel.Name)
+		return
+	}
+
+	// We expect the remote server checked whether applying the mode is valid.
+	// (i.e., that source user is allowed to make the change). We only do minimal
+	// checks in that regard.
+
+	// Look at the modes and apply each of them that we understand.
+	// At the same time, generate what we need to tell our local clients.
+
+	// Point to where we expect parameters for modes to start.
+	paramIndex := 3
+
+	// Track modes we apply so we can tell our local users.
+	appliedModes := ""
+	appliedModesAction := ' '
+	appliedModesParams := []string{}
+
+	action := '+'
+
+	for _, char := range m.Params[2] {
+		if char == '+' || char == '-' {
+			action = char
+			continue
+		}
+
+		if isChannelListMode(byte(char)) {
+			// Must have a parameter. A mask.
+			if paramIndex >= len(m.Params) {
+				break
+			}
+
+			mask := m.Params[paramIndex]
+			paramIndex++
+
+			if action == '+' {
+				if !channel.addMask(byte(char), mask, origin, time.Now().Unix()) {
+					continue
+				}
+			} else {
+				if !channel.removeMask(byte(char), mask) {
+					continue
+				}
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+			appliedModesParams = append(appliedModesParams, mask)
+			continue
+		}
+
+		if isChannelSimpleMode(byte(char)) {
+			_, isSet := channel.Modes[byte(char)]
+			if action == '+' {
+				if isSet {
+					continue
+				}
+				channel.Modes[byte(char)] = struct{}{}
+			} else {
+				if !isSet {
+					continue
+				}
+				delete(channel.Modes, byte(char))
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+			continue
+		}
+
+		if char == 'k' {
+			if action == '+' {
+				// Must have a parameter. The key.
+				if paramIndex >= len(m.Params) {
+					break
+				}
+
+				key := m.Params[paramIndex]
+				paramIndex++
+				if key == channel.Key {
+					continue
+				}
+				channel.Key = key
+			} else {
+				// The parameter is optional when unsetting.
+				if paramIndex < len(m.Params) {
+					paramIndex++
+				}
+				if channel.Key == "" {
+					continue
+				}
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+			appliedModesParams = append(appliedModesParams, channel.Key)
+			if action == '-' {
+				channel.Key = ""
+			}
+			continue
+		}
+
+		if char == 'f' {
+			if action == '+' {
+				// Must have a parameter. The channel.
+				if paramIndex >= len(m.Params) {
+					break
+				}
+
+				forward := canonicalizeChannel(m.Params[paramIndex])
+				paramIndex++
+				if !isValidForward(channel, forward) || forward == channel.Forward {
+					continue
+				}
+				channel.Forward = forward
+				appliedModesParams = append(appliedModesParams, forward)
+			} else {
+				if channel.Forward == "" {
+					continue
+				}
+				channel.Forward = ""
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+			continue
+		}
+
+		if char == 'j' {
+			if action == '+' {
+				// Must have a parameter. n:t
+				if paramIndex >= len(m.Params) {
+					break
+				}
+
+				count, seconds, ok := parseJoinThrottle(m.Params[paramIndex])
+				paramIndex++
+				if !ok || (count == channel.JoinThrottleCount &&
+					seconds == channel.JoinThrottleTime) {
+					continue
+				}
+				channel.setJoinThrottle(count, seconds)
+				appliedModesParams = append(appliedModesParams,
+					formatJoinThrottle(count, seconds))
+			} else {
+				if channel.JoinThrottleCount == 0 {
+					continue
+				}
+				channel.setJoinThrottle(0, 0)
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+			continue
+		}
+
+		if char == 'l' {
+			if action == '+' {
+				// Must have a parameter. The limit.
+				if paramIndex >= len(m.Params) {
+					break
+				}
+
+				limit, err := strconv.Atoi(m.Params[paramIndex])
+				paramIndex++
+				if err != nil || limit <= 0 || limit == channel.Limit {
+					continue
+				}
+				channel.Limit = limit
+				appliedModesParams = append(appliedModesParams, strconv.Itoa(limit))
+			} else {
+				if channel.Limit == 0 {
+					continue
+				}
+				channel.Limit = 0
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+			continue
+		}
+
+		if char != 'o' {
+			continue
+		}
+
+		// +o/-o
+
+		// Must have a parameter.
+
+		if paramIndex >= len(m.Params) {
+			break
+		}
+
+		// Consume the parameter.
+		uidRaw := m.Params[paramIndex]
+		paramIndex++
+
+		// Look the user up.
+		targetUser, exists := s.Catbox.Users[TS6UID(uidRaw)]
+		if !exists {
+			break
+		}
+
+		if !targetUser.onChannel(channel) {
+			break
+		}
+
+		if action == '+' {
+			if channel.userHasOps(targetUser) {
+				continue
+			}
+			channel.grantOps(targetUser)
+		} else {
+			if !channel.userHasOps(targetUser) {
+				continue
+			}
+			channel.removeOps(targetUser)
+		}
+
+		if appliedModesAction != action {
+			appliedModesAction = action
+			appliedModes += string(appliedModesAction)
+		}
+
+		appliedModes += string(char)
+		appliedModesParams = append(appliedModesParams, targetUser.DisplayNick)
+	}
+
+	// It's possible we have more than ChanModesPerCommand to send to the client
+	// now (as TMODE can exceed the limit). We could break it up into separate
+	// MODE commands.
+
+	// Tell our local users who are in the channel.
+
+	// But only if there is something to tell.
+
+	if len(appliedModes) > 0 {
+		userModeParams := []string{channel.Name, appliedModes}
+		userModeParams = append(userModeParams, appliedModesParams...)
+		s2sLog.Debugf("%v %v", appliedModes, appliedModesParams)
+
+		s.Catbox.logModeration(channel, origin,
+			"MODE "+strings.Join(userModeParams[1:], " "))
+
+		for memberUID := range channel.Members {
+			member := s.Catbox.Users[memberUID]
+
+			if !member.isLocal() {
+				continue
+			}
+
+			member.LocalUser.maybeQueueMessage(irc.Message{
+				Prefix:  origin,
+				Command: "MODE",
+				Params:  userModeParams,
+			})
+		}
+	}
+
+	// Propagate
+	for _, ls := range s.Catbox.LocalServers {
+		if ls == s {
+			continue
+		}
+		ls.maybeQueueMessage(m)
+	}
+}
+
+// BMASK tells us about masks in a channel's lists, such as bans. Servers send
+// it during burst.
+//
+// Parameters: <channel TS> <channel name> <type> :<masks>
+func (s *LocalServer) bmaskCommand(m irc.Message) {
+	if len(m.Params) < 4 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"BMASK", "Not enough parameters"})
+		return
+	}
+
+	sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		s.quit("Unknown origin (BMASK)")
+		return
+	}
+
+	channelTS, err := strconv.ParseInt(m.Params[0], 10, 64)
+	if err != nil {
+		s.quit(fmt.Sprintf("Invalid channel TS: %s: %s", m.Params[0], err))
+		return
+	}
+
+	channel, exists := s.channel(m.Params[1])
+	if !exists {
+		// It may have been destroyed while this was in flight. Ignore it.
+		return
+	}
+
+	// Ignore if the TS is newer. Their modes lose.
+	if channelTS > channel.TS {
+		return
+	}
+
+	if len(m.Params[2]) != 1 || !isChannelListMode(m.Params[2][0]) {
+		// Unknown list type. Ignore it.
+		return
+	}
+	mode := m.Params[2][0]
+
+	var applied []string
+	for _, mask := range strings.Fields(m.Params[3]) {
+		if channel.addMask(mode, mask, sourceServer.Name, time.Now().Unix()) {
+			applied = append(applied, mask)
+		}
+	}
+
+	// Tell our local users in the channel.
+	for _, msg := range channel.makeModeMessages(sourceServer.Name, '+', mode,
+		applied) {
+		s.Catbox.messageLocalUsersOnChannel(channel, msg)
+	}
+
+	// Propagate. Only servers supporting EX get ban exceptions, and only servers
+	// supporting IE get invite exceptions.
+	for _, ls := range s.Catbox.LocalServers {
+		if ls == s {
+			continue
+		}
+		if mode == 'e' && !ls.Server.hasCapability("EX") {
+			continue
+		}
+		if mode == 'I' && !ls.Server.hasCapability("IE") {
+			continue
+		}
+		ls.maybeQueueMessage(m)
+	}
+}
+
+// An operator on another server wants a server to link to a server.
+//
+// Parameters: <server name> <port> <server to connect from (name or SID)>
+// Example: :1SNAAAAAB CONNECT irc3.example.com 0 :2SN
+//
+// If we're the server to connect from, we connect. Otherwise we pass it on.
+func (s *LocalServer) connectCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"CONNECT", "Not enough parameters"})
+		return
+	}
+
+	source, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists || !source.isOperator() {
+		return
+	}
+
+	port, err := strconv.Atoi(m.Params[1])
+	if err != nil || port < 0 || port > 65535 {
+		s.Catbox.noticeToUser(source, fmt.Sprintf("Invalid port: %s", m.Params[1]))
+		return
+	}
+
+	if m.Params[2] == s.Catbox.Config.ServerName ||
+		m.Params[2] == string(s.Catbox.Config.TS6SID) {
+		s.Catbox.connect(source, m.Params[0], port)
+		return
+	}
+
+	server, exists := s.Catbox.Servers[TS6SID(m.Params[2])]
+	if !exists {
+		server = s.Catbox.getServerByName(m.Params[2])
+	}
+	if server == nil {
+		// 402 ERR_NOSUCHSERVER
+		s.Catbox.numericToUser(source, "402", []string{m.Params[2],
+			"No such server"})
+		return
+	}
+
+	route := server.route()
+	if route == s {
+		return
+	}
+	route.maybeQueueMessage(m)
+}
+
+// The SAJOIN command comes only in ENCAP messages. An operator or services
+// wants a user to join a channel. If the user is ours, we make them join.
+//
+// Parameters: <UID> <channel>
+func (s *LocalServer) sajoinCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SAJOIN", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists || !user.isLocal() {
+		return
+	}
+
+	source, ok := s.privilegedSource(m.Prefix)
+	if !ok {
+		return
+	}
+
+	channelName := canonicalizeChannel(m.Params[1])
+	if !isValidChannel(channelName) || user.onChannel(&Channel{Name: channelName}) {
+		return
+	}
+
+	// An operator's server tells operators. Services don't.
+	if _, isServer := s.Catbox.Servers[TS6SID(m.Prefix)]; isServer {
+		s.Catbox.noticeOpers(fmt.Sprintf("%s used SAJOIN to make %s join %s",
+			source, user.DisplayNick, channelName))
 	}
+
+	user.LocalUser.join(channelName, "", true)
 }
 
-// An INVITE command.
-// Source: <user UID>
-// Parameters: <target user UID> <channel> [channel TS]
-// Apparently channel TS is optional, but deprecated to be. However ratbox does
-// not send it, so allow it to not be present.
-// If channel TS indicates newer, ignore it.
-// Propagate it towards the target user if it's not a local user. Otherwise
-// if it's a local user, tell the user.
-func (s *LocalServer) inviteCommand(m irc.Message) {
+// The SAPART command comes only in ENCAP messages. An operator or services
+// wants a user to part a channel. If the user is ours, we make them part.
+//
+// Parameters: <UID> <channel> [reason]
+func (s *LocalServer) sapartCommand(m irc.Message) {
 	if len(m.Params) < 2 {
 		// 461 ERR_NEEDMOREPARAMS
-		s.messageFromServer("461", []string{"INVITE", "Not enough parameters"})
+		s.messageFromServer("461", []string{"SAPART", "Not enough parameters"})
 		return
 	}
 
-	// Find source user.
-	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
-	if !exists {
-		s.quit("Unknown source user (INVITE)")
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists || !user.isLocal() {
 		return
 	}
 
-	// Find the target user.
-	targetUser, exists := s.Catbox.Users[TS6UID(m.Params[0])]
-	if !exists {
-		s.quit("Unknown target user (INVITE)")
+	source, ok := s.privilegedSource(m.Prefix)
+	if !ok {
 		return
 	}
 
-	// Find the channel.
 	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[1])]
-	if !exists {
-		s.quit("Unknown channel (INVITE)")
+	if !exists || !user.onChannel(channel) {
 		return
 	}
 
-	// Assume the other side checked the invite was valid to proceed.
-
-	// Check channel TS if it's given.
+	reason := ""
 	if len(m.Params) >= 3 {
-		channelTS, err := strconv.ParseInt(m.Params[2], 10, 64)
-		if err != nil {
-			s.quit(fmt.Sprintf("Invalid channel TS: %s: %s", m.Params[2], err))
-			return
-		}
+		reason = m.Params[2]
+	}
 
-		// If channel TS indicates the channel is newer than what we know, ignore.
-		if channelTS > channel.TS {
-			s.Catbox.noticeOpers(fmt.Sprintf("INVITE from %s to %s for %s has newer TS",
-				sourceUser.DisplayNick, targetUser.DisplayNick, channel.Name))
-			return
-		}
+	// An operator's server tells operators. Services don't.
+	if _, isServer := s.Catbox.Servers[TS6SID(m.Prefix)]; isServer {
+		s.Catbox.noticeOpers(fmt.Sprintf("%s used SAPART to make %s part %s",
+			source, user.DisplayNick, channel.Name))
 	}
 
-	// TODO(horgh): If we had +i we'd have to record the invited user may join
-	// the channel.
+	user.LocalUser.part(channel.Name, reason)
+}
 
-	// If it's a local user, tell the user, and that's it.
-	if targetUser.isLocal() {
-		targetUser.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  sourceUser.nickUhost(),
-			Command: "INVITE",
-			Params:  []string{targetUser.DisplayNick, channel.Name},
-		})
+// The SAMODE command comes only in ENCAP messages. An operator or services
+// wants to change a user's modes. If the user is ours, we change them.
+//
+// Parameters: <UID> <modes>
+func (s *LocalServer) samodeCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SAMODE", "Not enough parameters"})
 		return
 	}
 
-	// If it's a remote user, propagate the message on its way.
-	targetUser.ClosestServer.maybeQueueMessage(m)
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists || !user.isLocal() {
+		return
+	}
+
+	source, ok := s.privilegedSource(m.Prefix)
+	if !ok {
+		return
+	}
+
+	// An operator's server tells operators. Services don't.
+	if _, isServer := s.Catbox.Servers[TS6SID(m.Prefix)]; isServer {
+		s.Catbox.noticeOpers(fmt.Sprintf("%s used SAMODE: %s %s", source,
+			user.DisplayNick, m.Params[1]))
+	}
+
+	_ = user.LocalUser.changeUserModes(m.Params[1])
 }
 
-// TMODE propagates a channel mode change.
-// Source: user or server
-// Parameters: <channel TS> <channel> <mode changes> [parameters]
-func (s *LocalServer) tmodeCommand(m irc.Message) {
-	if len(m.Params) < 3 {
+// servicesSource checks the source of a command is services. It may be a
+// services server or one of its users (e.g., NickServ).
+func (s *LocalServer) servicesSource(prefix string) bool {
+	if user, exists := s.Catbox.Users[TS6UID(prefix)]; exists {
+		return s.Catbox.isServices(user.Server)
+	}
+	if server, exists := s.Catbox.Servers[TS6SID(prefix)]; exists {
+		return s.Catbox.isServices(server)
+	}
+	return false
+}
+
+// accountSource checks the source of a command setting a user's account. It
+// must be services or the user's own server (or the user), and it must come
+// from that source's direction.
+func (s *LocalServer) accountSource(prefix string, user *User) bool {
+	var server *Server
+	if u, exists := s.Catbox.Users[TS6UID(prefix)]; exists {
+		server = u.Server
+	} else if sv, exists := s.Catbox.Servers[TS6SID(prefix)]; exists {
+		server = sv
+	} else {
+		return false
+	}
+
+	if server.route() != s {
+		return false
+	}
+
+	return s.Catbox.isServices(server) || server == user.Server
+}
+
+// servicesTarget finds the local user a services command is for. The target
+// is the first parameter. We ignore the command if the user is not ours or it
+// is not from services.
+func (s *LocalServer) servicesTarget(m irc.Message, minParams int) *User {
+	if len(m.Params) < minParams {
 		// 461 ERR_NEEDMOREPARAMS
-		s.messageFromServer("461", []string{"TMODE", "Not enough parameters"})
-		return
+		s.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return nil
 	}
 
-	origin := ""
-	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
-	if exists {
-		origin = sourceUser.nickUhost()
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists || !user.isLocal() {
+		return nil
 	}
-	if origin == "" {
-		sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
-		if exists {
-			origin = sourceServer.Name
-		}
+
+	if !s.servicesSource(m.Prefix) {
+		s2sLog.Warnf("Ignoring %s from %s. It's not services.", m.Command, m.Prefix)
+		return nil
 	}
 
-	if origin == "" {
-		s.quit("Unknown origin (TMODE)")
+	return user
+}
+
+// The SVSNICK command comes only in ENCAP messages. Services want to change a
+// user's nick (e.g., they didn't identify to a registered nick). If the user
+// is ours, we change it.
+//
+// Parameters: <UID> <new nick> [nick TS]
+func (s *LocalServer) svsnickCommand(m irc.Message) {
+	user := s.servicesTarget(m, 2)
+	if user == nil {
 		return
 	}
 
-	channelTS, err := strconv.ParseInt(m.Params[0], 10, 64)
-	if err != nil {
-		s.quit(fmt.Sprintf("Invalid channel TS: %s: %s", m.Params[0], err))
+	nick := m.Params[1]
+	if !isValidNick(s.Catbox.Config.MaxNickLength, nick) ||
+		nick == user.DisplayNick {
 		return
 	}
 
-	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[1])]
-	if !exists {
-		s.quit("Unknown channel (TMODE)")
+	// If someone else has the nick, services must deal with them first.
+	if uid, exists := s.Catbox.Nicks[canonicalizeNick(nick)]; exists &&
+		uid != user.UID {
 		return
 	}
 
-	// Ignore if the TS is newer
-	if channelTS > channel.TS {
-		log.Printf("TMODE for channel %s has newer TS, ignoring", channel.Name)
+	user.LocalUser.changeNick(nick)
+}
+
+// The SVSMODE command comes only in ENCAP messages. Services want to change a
+// user's modes. If the user is ours, we change them.
+//
+// Parameters: <UID> <modes>
+func (s *LocalServer) svsmodeCommand(m irc.Message) {
+	user := s.servicesTarget(m, 2)
+	if user == nil {
 		return
 	}
 
-	// We expect the remote server checked whether applying the mode is valid.
-	// (i.e., that source user is allowed to make the change). We only do minimal
-	// checks in that regard.
+	_ = user.LocalUser.changeUserModes(m.Params[1])
+}
 
-	// Look at the modes and apply each of them that we understand.
-	// At the same time, generate what we need to tell our local clients.
+// The SVSHOST command comes only in ENCAP messages. Services want to give a
+// user a vhost. If the user is ours, we set it and tell the network with
+// CHGHOST.
+//
+// Parameters: <UID> <vhost>
+func (s *LocalServer) svshostCommand(m irc.Message) {
+	user := s.servicesTarget(m, 2)
+	if user == nil {
+		return
+	}
 
-	// Point to where we expect parameters for modes to start.
-	paramIndex := 3
+	vhost := m.Params[1]
+	if !isValidVhost(vhost) {
+		return
+	}
 
-	// Track modes we apply so we can tell our local users.
-	appliedModes := ""
-	appliedModesAction := ' '
-	appliedModesParams := []string{}
+	user.LocalUser.Vhost = vhost
+	if user.DisplayHost == vhost {
+		return
+	}
+	s.Catbox.setHost(user, user.Hostname, vhost)
+	user.LocalUser.sendHostHidden()
+}
 
-	action := '+'
+// The SVSJOIN command comes only in ENCAP messages. Services want a user to
+// join a channel. If the user is ours, we make them join. The channel's modes
+// don't stop them.
+//
+// Parameters: <UID> <channel>
+func (s *LocalServer) svsjoinCommand(m irc.Message) {
+	user := s.servicesTarget(m, 2)
+	if user == nil {
+		return
+	}
 
-	for _, char := range m.Params[2] {
-		if char == '+' || char == '-' {
-			action = char
-			continue
-		}
+	channelName := canonicalizeChannel(m.Params[1])
+	if !isValidChannel(channelName) || user.onChannel(&Channel{Name: channelName}) {
+		return
+	}
 
-		if char != 'o' {
-			continue
-		}
+	user.LocalUser.join(channelName, "", true)
+}
 
-		// +o/-o
+// The SVSPART command comes only in ENCAP messages. Services want a user to
+// part a channel. If the user is ours, we make them part.
+//
+// Parameters: <UID> <channel> [reason]
+func (s *LocalServer) svspartCommand(m irc.Message) {
+	user := s.servicesTarget(m, 2)
+	if user == nil {
+		return
+	}
 
-		// Must have a parameter.
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[1])]
+	if !exists || !user.onChannel(channel) {
+		return
+	}
 
-		if paramIndex >= len(m.Params) {
-			break
-		}
+	reason := ""
+	if len(m.Params) >= 3 {
+		reason = m.Params[2]
+	}
 
-		// Consume the parameter.
-		uidRaw := m.Params[paramIndex]
-		paramIndex++
+	user.LocalUser.part(channel.Name, reason)
+}
 
-		// Look the user up.
-		targetUser, exists := s.Catbox.Users[TS6UID(uidRaw)]
-		if !exists {
-			break
-		}
+// The SASL command comes only in ENCAP messages. Services use it to reply
+// during a SASL exchange we relay for a client of ours (see sasl.go). If the
+// client is not ours, we only propagate it.
+//
+// Parameters: <agent UID> <client UID> <mode> [data]
+func (s *LocalServer) saslCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SASL", "Not enough parameters"})
+		return
+	}
 
-		if !targetUser.onChannel(channel) {
-			break
-		}
+	client := s.Catbox.saslClient(TS6UID(m.Params[1]))
+	if client == nil {
+		return
+	}
 
-		if action == '+' {
-			if channel.userHasOps(targetUser) {
-				continue
-			}
-			channel.grantOps(targetUser)
-		} else {
-			if !channel.userHasOps(targetUser) {
-				continue
-			}
-			channel.removeOps(targetUser)
-		}
+	if !s.servicesSource(m.Prefix) {
+		s2sLog.Warnf("Ignoring SASL from %s. It's not services.", m.Prefix)
+		return
+	}
 
-		if appliedModesAction != action {
-			appliedModesAction = action
-			appliedModes += string(appliedModesAction)
-		}
+	data := ""
+	if len(m.Params) >= 4 {
+		data = m.Params[3]
+	}
+	client.saslReply(m.Params[0], m.Params[2], data)
+}
 
-		appliedModes += string(char)
-		appliedModesParams = append(appliedModesParams, targetUser.DisplayNick)
+// The SVSLOGIN command comes only in ENCAP messages. Services use it to log a
+// client in to an account, usually during SASL. The nick, username, and host
+// may be * to leave them alone. We don't change them.
+//
+// Parameters: <client UID> <nick> <username> <host> <account>
+func (s *LocalServer) svsloginCommand(m irc.Message) {
+	if len(m.Params) < 5 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SVSLOGIN", "Not enough parameters"})
+		return
 	}
 
-	// It's possible we have more than ChanModesPerCommand to send to the client
-	// now (as TMODE can exceed the limit). We could break it up into separate
-	// MODE commands.
+	if !s.servicesSource(m.Prefix) {
+		s2sLog.Warnf("Ignoring SVSLOGIN from %s. It's not services.", m.Prefix)
+		return
+	}
 
-	// Tell our local users who are in the channel.
+	if client := s.Catbox.saslClient(TS6UID(m.Params[0])); client != nil {
+		client.saslLoggedIn(m.Params[4])
+		return
+	}
 
-	// But only if there is something to tell.
+	// They may have registered already. Treat it like SU.
+	if user := s.servicesTarget(m, 5); user != nil {
+		s.suCommand(irc.Message{
+			Prefix:  m.Prefix,
+			Command: "SU",
+			Params:  []string{m.Params[0], m.Params[4]},
+		})
+	}
+}
 
-	if len(appliedModes) > 0 {
-		userModeParams := []string{channel.Name, appliedModes}
-		userModeParams = append(userModeParams, appliedModesParams...)
-		log.Printf("%v %v", appliedModes, appliedModesParams)
+// The MECHLIST command comes only in ENCAP messages. Services tell us the SASL
+// mechanisms they support. We relay SASL to them after this.
+//
+// Parameters: <comma separated mechanisms>
+func (s *LocalServer) mechlistCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"MECHLIST", "Not enough parameters"})
+		return
+	}
 
-		for memberUID := range channel.Members {
-			member := s.Catbox.Users[memberUID]
+	server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+		if !exists {
+			return
+		}
+		server = user.Server
+	}
 
-			if !member.isLocal() {
-				continue
-			}
+	if !s.Catbox.isServices(server) {
+		s2sLog.Warnf("Ignoring MECHLIST from %s. It's not services.", m.Prefix)
+		return
+	}
 
-			member.LocalUser.maybeQueueMessage(irc.Message{
-				Prefix:  origin,
-				Command: "MODE",
-				Params:  userModeParams,
-			})
-		}
+	server.SASLMechanisms = m.Params[0]
+}
+
+// privilegedSource checks the source of a command that only operators and
+// servers (e.g., services) may send. If it may send it, we return its name.
+func (s *LocalServer) privilegedSource(prefix string) (string, bool) {
+	if user, exists := s.Catbox.Users[TS6UID(prefix)]; exists {
+		return user.DisplayNick, user.isOperator()
 	}
+	if server, exists := s.Catbox.Servers[TS6SID(prefix)]; exists {
+		return server.Name, true
+	}
+	return "", false
+}
 
-	// Propagate
-	for _, ls := range s.Catbox.LocalServers {
-		if ls == s {
-			continue
-		}
-		ls.maybeQueueMessage(m)
+// channel looks up a channel a server refers to. Servers don't know about our
+// local (&) channels, so we never find those.
+func (s *LocalServer) channel(name string) (*Channel, bool) {
+	name = canonicalizeChannel(name)
+	if isLocalChannel(name) {
+		return nil, false
 	}
+	channel, exists := s.Catbox.Channels[name]
+	return channel, exists
 }
@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,12 +31,71 @@ type LocalUser struct {
 	LastMessageTime time.Time
 
 	// MessageCounter is part of flood control. It tells us how many messages we
-	// have remaining before flood control kicks in. If it's 0, a message gets
-	// queued.
+	// have remaining before flood control kicks in. If it's 0 or less, a message
+	// gets queued. It goes below 0 if a command with several targets costs more
+	// than they had remaining.
 	MessageCounter int
 
 	// MessageQueue holds queued messages from the client.
 	MessageQueue []irc.Message
+
+	// Accepts holds the users who may send private messages to the user while
+	// they are +g (caller ID). See ACCEPT.
+	Accepts map[TS6UID]struct{}
+
+	// The last time we told the user someone tried to message them while they
+	// were +g.
+	LastCallerIDNotice time.Time
+
+	// Vhost is the host an operator or the vhosts config gave the user. Blank
+	// if none. It takes precedence over cloaking.
+	Vhost string
+
+	// When NickServ will change their nick if they don't identify. Zero if it
+	// won't.
+	NickServDeadline time.Time
+
+	// Name of the users config block they matched when they registered. Blank
+	// if none.
+	UserConfigName string
+
+	// When the user recently joined or parted channels. This is for join/part
+	// flood control.
+	RecentJoinParts []time.Time
+
+	// The last time we told operators the user was join/part flooding.
+	LastJoinPartNotice time.Time
+
+	// The LIST we're sending them, if any.
+	List *ListState
+
+	// The last time they listed all channels.
+	LastFullList time.Time
+
+	// Their failed OPER attempts.
+	OperFailures OperFailures
+
+	// Their failed NickServ passwords.
+	NickServFailures OperFailures
+
+	// Whether we're checking a password they gave us. We do this outside the
+	// server goroutine (see checkPasswordAsync()). They can't give another
+	// until we're done.
+	CheckingPassword bool
+}
+
+// ListState is a LIST we're part way through sending a user. We send large
+// LISTs in parts so they don't fill the user's send queue all at once.
+type ListState struct {
+	// Canonical names of the channels we have yet to send.
+	Channels []string
+
+	// Whether to show secret channels (operspy).
+	Spy bool
+
+	// How many channels we've sent, and the most we may. 0 for no limit.
+	Count int
+	Limit int
 }
 
 // NewLocalUser makes a LocalUser from a LocalClient.
@@ -49,6 +109,7 @@ func NewLocalUser(c *LocalClient) *LocalUser {
 		LastMessageTime:  now,
 		MessageCounter:   UserMessageLimit,
 		MessageQueue:     []irc.Message{},
+		Accepts:          make(map[TS6UID]struct{}),
 	}
 
 	return u
@@ -93,6 +154,18 @@ func (u *LocalUser) makeTS6UID(id uint64) (TS6UID, error) {
 	return TS6UID(string(u.Catbox.Config.TS6SID) + string(ts6id)), nil
 }
 
+// maybeQueueMessage queues a message to the user.
+//
+// If we hide servers from them, messages from other servers (e.g., their
+// MODEs and numerics) come from us instead.
+func (u *LocalUser) maybeQueueMessage(m irc.Message) {
+	if u.Catbox.hidesServers(u.User) && isServerPrefix(m.Prefix) &&
+		m.Prefix != u.Catbox.Config.ServerName {
+		m.Prefix = u.Catbox.Config.ServerName
+	}
+	u.LocalClient.maybeQueueMessage(m)
+}
+
 // Send an IRC message to a client. Appears to be from the server.
 // This works by writing to a client's channel.
 //
@@ -115,31 +188,59 @@ func (u *LocalUser) messageFromServer(command string, params []string) {
 // join tries to join the client to a channel.
 //
 // We've validated the name is valid and have canonicalized it.
-func (u *LocalUser) join(channelName string) {
+//
+// key is the channel key they gave, if any.
+//
+// If force is true, they join even if the channel's modes would stop them
+// (e.g., SAJOIN).
+//
+// We return the channel they joined. This may be a different channel if the
+// join was forwarded (+f). It is nil if they did not join one.
+func (u *LocalUser) join(channelName, key string, force bool) *Channel {
 	// Is the client in the channel already? Ignore it if so.
 	if u.User.onChannel(&Channel{Name: channelName}) {
-		return
+		return nil
 	}
 
 	// Look up the channel. Create it if necessary.
 	channel, channelExists := u.Catbox.Channels[channelName]
 	if !channelExists {
-		channel = &Channel{
-			Name:    channelName,
-			Members: make(map[TS6UID]struct{}),
-			Ops:     make(map[TS6UID]*User),
-			Modes:   make(map[byte]struct{}),
-			TS:      time.Now().Unix(),
+		channel = NewChannel(channelName, time.Now().Unix())
+		channel.Modes['n'] = struct{}{}
+		channel.Modes['s'] = struct{}{}
+
+		// A channel we restored has its bans and modes. They apply to whoever
+		// makes it again, before we give them ops.
+		if u.Catbox.restoreSavedChannel(channel) && !force &&
+			!u.canJoin(channel, key) {
+			return nil
 		}
+		delete(u.Catbox.SavedChannels, channelName)
+
 		u.Catbox.Channels[channelName] = channel
 		channel.grantOps(u.User)
-		channel.Modes['n'] = struct{}{}
-		channel.Modes['s'] = struct{}{}
+		u.Catbox.chanServRestoreChannel(channel)
+	}
+
+	if channelExists && !force {
+		// If the join throttle (+j) refuses them, they may go elsewhere (+f).
+		if forward := u.Catbox.joinForward(channel); forward != "" {
+			// 470 ERR_LINKCHANNEL. Not standard. charybdis uses it.
+			u.messageFromServer("470", []string{channel.Name, forward,
+				"Forwarding to another channel"})
+			return u.join(forward, "", false)
+		}
+
+		if !u.canJoin(channel, key) {
+			return nil
+		}
 	}
+	delete(channel.Invites, u.User.UID)
 
 	// Add them to the channel.
 	channel.Members[u.User.UID] = struct{}{}
 	u.User.Channels[channelName] = channel
+	channel.recordJoin(time.Now())
 
 	// Tell the client about the join.
 	// This is what RFC says to send: JOIN, RPL_TOPIC, and RPL_NAMREPLY.
@@ -149,7 +250,7 @@ func (u *LocalUser) join(channelName string) {
 
 	// If this is a new channel, send them the modes we set by default.
 	if !channelExists {
-		u.messageFromServer("MODE", []string{channel.Name, "+ns"})
+		u.messageFromServer("MODE", []string{channel.Name, channel.modesString()})
 	}
 
 	// It appears RPL_TOPIC is optional, at least ircd-ratbox does always send it.
@@ -166,6 +267,69 @@ func (u *LocalUser) join(channelName string) {
 		})
 	}
 
+	u.sendNames(channel, true)
+
+	u.playBackHistory(channel)
+
+	// Tell each member in the channel about the client.
+	// Only local clients. Servers will tell their own clients.
+	for memberUID := range channel.Members {
+		member := u.Catbox.Users[memberUID]
+		if !member.isLocal() {
+			continue
+		}
+
+		// Don't tell the client. We already did (above).
+		if member.UID == u.User.UID {
+			continue
+		}
+
+		// From the client to each member.
+		u.messageUser(member, "JOIN", []string{channel.Name})
+	}
+
+	// Tell servers about this.
+	// If it's a new channel, then use SJOIN. Otherwise JOIN.
+	for _, server := range u.Catbox.channelServers(channel) {
+		if !channelExists {
+			params := []string{fmt.Sprintf("%d", channel.TS), channel.Name,
+				channel.modesString()}
+			params = append(params, channel.modeParams()...)
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.Catbox.Config.TS6SID),
+				Command: "SJOIN",
+				Params:  append(params, "@"+string(u.User.UID)),
+			})
+			// A channel we restored may have bans and such.
+			server.sendBMASK(channel)
+		} else {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.User.UID),
+				Command: "JOIN",
+				Params: []string{
+					fmt.Sprintf("%d", channel.TS),
+					channel.Name,
+					"+",
+				},
+			})
+		}
+
+		// A new channel may have a topic ChanServ remembered.
+		if !channelExists {
+			if m, ok := server.topicBurstMessage(string(u.Catbox.Config.TS6SID),
+				channel); ok {
+				server.maybeQueueMessage(m)
+			}
+		}
+	}
+
+	u.Catbox.chanServJoined(u, channel)
+	return channel
+}
+
+// sendNames tells the user who is on the channel. Unless showInvisible is
+// set, we leave out invisible (+i) members.
+func (u *LocalUser) sendNames(channel *Channel, showInvisible bool) {
 	// 353 RPL_NAMREPLY: This tells the client about who is in the channel
 	// (including itself).
 	// Format: :<server> 353 <targetNick> <channel flag> <#channel> :<nicks>
@@ -173,8 +337,10 @@ func (u *LocalUser) join(channelName string) {
 	// or + to indicate opped/voiced). Apparently only one or the other.
 
 	// Channel flag: = (public), * (private), @ (secret)
-	// When we have more chan modes (-s / +p) this needs to vary
-	channelFlag := "@"
+	channelFlag := "="
+	if _, secret := channel.Modes['s']; secret {
+		channelFlag = "@"
+	}
 
 	// We put as many nicks per line as possible.
 
@@ -192,7 +358,7 @@ func (u *LocalUser) join(channelName string) {
 	// point continuing.
 	messageBuf, err := namMessage.Encode()
 	if err != nil {
-		log.Printf("Unable to generate RPL_NAMREPLY: %s", err)
+		clientsLog.Errorf("Unable to generate RPL_NAMREPLY: %s", err)
 		return
 	}
 
@@ -201,6 +367,9 @@ func (u *LocalUser) join(channelName string) {
 	nicks := ""
 	for memberUID := range channel.Members {
 		member := u.Catbox.Users[memberUID]
+		if !showInvisible && member.isInvisible() {
+			continue
+		}
 
 		// We send the nick with its mode prefix.
 		sendNick := member.DisplayNick
@@ -234,50 +403,54 @@ func (u *LocalUser) join(channelName string) {
 
 	// 366 RPL_ENDOFNAMES: Ends NAMES list.
 	u.messageFromServer("366", []string{channel.Name, "End of NAMES list"})
+}
 
-	// Tell each member in the channel about the client.
-	// Only local clients. Servers will tell their own clients.
-	for memberUID := range channel.Members {
-		member := u.Catbox.Users[memberUID]
-		if !member.isLocal() {
-			continue
-		}
-
-		// Don't tell the client. We already did (above).
-		if member.UID == u.User.UID {
-			continue
+// canJoin checks whether the user may join the existing channel. It checks
+// bans, the key, the limit, the join throttle, and whether it is invite only.
+// If they may not, we tell them why.
+func (u *LocalUser) canJoin(channel *Channel, key string) bool {
+	if channel.userIsBanned(u.User) {
+		// 474 ERR_BANNEDFROMCHAN
+		u.messageFromServer("474", []string{channel.Name,
+			"Cannot join channel (+b)"})
+		return false
+	}
+
+	if channel.Key != "" && key != channel.Key {
+		// 475 ERR_BADCHANNELKEY
+		u.messageFromServer("475", []string{channel.Name,
+			"Cannot join channel (+k)"})
+		return false
+	}
+
+	if channel.Limit > 0 && len(channel.Members) >= channel.Limit {
+		// 471 ERR_CHANNELISFULL
+		u.messageFromServer("471", []string{channel.Name,
+			"Cannot join channel (+l)"})
+		return false
+	}
+
+	// If too many users joined recently (+j), refuse until things calm down.
+	if channel.joinThrottled(time.Now()) {
+		// 480 ERR_THROTTLE. Not standard. charybdis uses it.
+		u.messageFromServer("480", []string{channel.Name,
+			"Cannot join channel (+j) - throttle exceeded, try again later"})
+		return false
+	}
+
+	// If the channel is invite only (+i), they need an invite or to match an
+	// invite exception (+I).
+	if _, inviteOnly := channel.Modes['i']; inviteOnly {
+		_, invited := channel.Invites[u.User.UID]
+		if !invited && !channel.userMatchesList('I', u.User) {
+			// 473 ERR_INVITEONLYCHAN
+			u.messageFromServer("473", []string{channel.Name,
+				"Cannot join channel (+i)"})
+			return false
 		}
-
-		// From the client to each member.
-		u.messageUser(member, "JOIN", []string{channel.Name})
 	}
 
-	// Tell servers about this.
-	// If it's a new channel, then use SJOIN. Otherwise JOIN.
-	for _, server := range u.Catbox.LocalServers {
-		if !channelExists {
-			server.maybeQueueMessage(irc.Message{
-				Prefix:  string(u.Catbox.Config.TS6SID),
-				Command: "SJOIN",
-				Params: []string{
-					fmt.Sprintf("%d", channel.TS),
-					channel.Name,
-					"+ns",
-					"@" + string(u.User.UID),
-				},
-			})
-		} else {
-			server.maybeQueueMessage(irc.Message{
-				Prefix:  string(u.User.UID),
-				Command: "JOIN",
-				Params: []string{
-					fmt.Sprintf("%d", channel.TS),
-					channel.Name,
-					"+",
-				},
-			})
-		}
-	}
+	return true
 }
 
 // part tries to remove the client from the channel.
@@ -332,7 +505,7 @@ func (u *LocalUser) part(channelName, message string) {
 
 	// Tell all servers. Looks like for TS6, or ratbox at least, channel
 	// membership is known globally, even if no clients present in the channel.
-	for _, server := range u.Catbox.LocalServers {
+	for _, server := range u.Catbox.channelServers(channel) {
 		server.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
 			Command: "PART",
@@ -362,7 +535,7 @@ func (u *LocalUser) quit(msg string, propagate bool) {
 	if _, exists := u.Catbox.LocalUsers[u.ID]; !exists {
 		return
 	}
-	log.Printf("Losing user %s", u)
+	clientsLog.Infof("Losing user %s", u)
 
 	// Tell all clients the client is in the channel with, and remove the client
 	// from each channel it is in.
@@ -425,6 +598,14 @@ func (u *LocalUser) quit(msg string, propagate bool) {
 		delete(u.Catbox.Opers, u.User.UID)
 	}
 	delete(u.Catbox.Users, u.User.UID)
+	u.Catbox.forgetInvites(u.User)
+}
+
+// isConnected tells whether the user is still connected. Check it when coming
+// back to a user after doing something outside the server goroutine.
+func (u *LocalUser) isConnected() bool {
+	lu, exists := u.Catbox.LocalUsers[u.ID]
+	return exists && lu == u
 }
 
 // Set the user away. We've been given a non-blank message.
@@ -481,6 +662,56 @@ func (u *LocalUser) setUnaway() {
 	}
 }
 
+// operCommands are the commands only operators may use. We log when they use
+// them (see logCategories).
+var operCommands = map[string]bool{
+	"AUTOCONN": true,
+	"CHGHOST":  true,
+	"CONNECT":  true,
+	"DIE":      true,
+	"GLOBOPS":  true,
+	"KILL":     true,
+	"KLINE":    true,
+	"LOGLEVEL": true,
+	"OPERWALL": true,
+	"OPME":     true,
+	"REHASH":   true,
+	"RESTART":  true,
+	"RESYNC":   true,
+	"SAJOIN":   true,
+	"SAMODE":   true,
+	"SAPART":   true,
+	"SQUIT":    true,
+	"UNKLINE":  true,
+	"UPGRADE":  true,
+	"WALLOPS":  true,
+}
+
+// checkText applies invalid-utf8-action to the message's parameters. It may
+// change them. It returns false if we reject the message.
+func (u *LocalUser) checkText(m *irc.Message) bool {
+	if u.Catbox.Config.InvalidUTF8Action == "allow" {
+		return true
+	}
+
+	for i, param := range m.Params {
+		if isCleanText(param) {
+			continue
+		}
+
+		if u.Catbox.Config.InvalidUTF8Action == "reject" {
+			u.messageFromServer("FAIL", []string{m.Command, "INVALID_UTF8",
+				"Message rejected, your IRC software MUST use UTF-8 encoding on " +
+					"this network"})
+			return false
+		}
+
+		m.Params[i] = cleanText(param)
+	}
+
+	return true
+}
+
 // The user sent us a message. Deal with it.
 func (u *LocalUser) handleMessage(m irc.Message) {
 	// Record that client said something to us just now.
@@ -496,24 +727,35 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 	// Flood protection. If we've used all our available message space for now,
 	// queue it.
 	if !u.User.isFloodExempt() {
-		if u.MessageCounter == 0 {
-			log.Printf("%s is flooding. Queueing their message.", u.User.DisplayNick)
+		if u.MessageCounter <= 0 {
+			floodLog.Infof("%s is flooding. Queueing their message.", u.User.DisplayNick)
 			u.MessageQueue = append(u.MessageQueue, m)
 
 			// Check for overwhelming their queue and disconnect them if so.
 			if len(u.MessageQueue) >= ExcessFloodThreshold {
+				floodLog.Infof("%s has too many queued messages. Disconnecting them.",
+					u.User.DisplayNick)
 				u.quit("Excess flood", true)
 				return
 			}
 
 			return
 		}
-		u.MessageCounter--
+		u.MessageCounter -= floodPenalty(m)
+	}
+
+	if !u.checkText(&m) {
+		return
+	}
+
+	if operCommands[m.Command] && u.User.isOperator() {
+		logEvent("oper", "%s (%s@%s) used %s", u.User.DisplayNick,
+			u.User.Username, u.User.Hostname,
+			strings.Join(append([]string{m.Command}, m.Params...), " "))
 	}
 
-	// Non-RFC command that appears to be widely supported. Just ignore it for
-	// now.
 	if m.Command == "CAP" {
+		u.capCommand(m)
 		return
 	}
 
@@ -578,6 +820,11 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "UPGRADE" {
+		u.upgradeCommand(m)
+		return
+	}
+
 	if m.Command == "WHOIS" {
 		u.whoisCommand(m)
 		return
@@ -598,31 +845,81 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "LIST" {
+		u.listCommand(m)
+		return
+	}
+
+	if m.Command == "NAMES" {
+		u.namesCommand(m)
+		return
+	}
+
 	if m.Command == "TOPIC" {
 		u.topicCommand(m)
 		return
 	}
 
+	if m.Command == "KICK" {
+		u.kickCommand(m)
+		return
+	}
+
+	if m.Command == "REMOVE" {
+		u.removeCommand(m)
+		return
+	}
+
 	if m.Command == "CONNECT" {
 		u.connectCommand(m)
 		return
 	}
 
+	if m.Command == "AUTOCONN" {
+		u.autoconnCommand(m)
+		return
+	}
+
 	if m.Command == "LINKS" {
 		u.linksCommand(m)
 		return
 	}
 
-	if m.Command == "WALLOPS" {
+	if m.Command == "WALLOPS" || m.Command == "OPERWALL" {
 		u.wallopsCommand(m)
 		return
 	}
 
+	if m.Command == "GLOBOPS" {
+		u.globopsCommand(m)
+		return
+	}
+
 	if m.Command == "KILL" {
 		u.killCommand(m)
 		return
 	}
 
+	if m.Command == "CHGHOST" {
+		u.chghostCommand(m)
+		return
+	}
+
+	if m.Command == "SAJOIN" {
+		u.sajoinCommand(m)
+		return
+	}
+
+	if m.Command == "SAPART" {
+		u.sapartCommand(m)
+		return
+	}
+
+	if m.Command == "SAMODE" {
+		u.samodeCommand(m)
+		return
+	}
+
 	if m.Command == "KLINE" {
 		u.klineCommand(m)
 		return
@@ -643,6 +940,31 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "INVITELIST" {
+		u.invitelistCommand(m)
+		return
+	}
+
+	if m.Command == "MODLOG" {
+		u.modlogCommand(m)
+		return
+	}
+
+	if m.Command == "SERVERINFO" {
+		u.serverInfoCommand(m)
+		return
+	}
+
+	if m.Command == "RESYNC" {
+		u.resyncCommand(m)
+		return
+	}
+
+	if m.Command == "LOGLEVEL" {
+		u.loglevelCommand(m)
+		return
+	}
+
 	if m.Command == "MAP" {
 		u.mapCommand(m)
 		return
@@ -663,11 +985,41 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "CHATHISTORY" {
+		u.chathistoryCommand(m)
+		return
+	}
+
 	if m.Command == "AWAY" {
 		u.awayCommand(m)
 		return
 	}
 
+	if m.Command == "ISON" {
+		u.isonCommand(m)
+		return
+	}
+
+	if m.Command == "SETNAME" {
+		u.setnameCommand(m)
+		return
+	}
+
+	if m.Command == "NS" || m.Command == "NICKSERV" {
+		u.nickServCommand(strings.Fields(strings.Join(m.Params, " ")))
+		return
+	}
+
+	if m.Command == "CS" || m.Command == "CHANSERV" {
+		u.chanServCommand(strings.Fields(strings.Join(m.Params, " ")))
+		return
+	}
+
+	if m.Command == "ACCEPT" {
+		u.acceptCommand(m)
+		return
+	}
+
 	if m.Command == "INVITE" {
 		u.inviteCommand(m)
 		return
@@ -705,18 +1057,42 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 		nick = nick[0:u.Catbox.Config.MaxNickLength]
 	}
 
-	if !isValidNick(u.Catbox.Config.MaxNickLength, nick) {
+	if !isValidNick(u.Catbox.Config.MaxNickLength, nick) ||
+		u.Catbox.isNickServ(nick) || u.Catbox.isChanServ(nick) {
 		// 432 ERR_ERRONEUSNICKNAME
 		u.messageFromServer("432", []string{nick, "Erroneous nickname"})
 		return
 	}
 
+	if rc, reserved := u.Catbox.reservation(nick); reserved {
+		// 432 ERR_ERRONEUSNICKNAME
+		u.messageFromServer("432", []string{nick,
+			reservedMessage("Nickname is reserved", rc)})
+		return
+	}
+
 	// Ignore the command if it's the exact same as the current nick.
 	// This is a case sensitive comparison.
 	if nick == u.User.DisplayNick {
 		return
 	}
 
+	// They can't change their nick while on a +N channel unless they have ops
+	// there.
+	for _, channel := range u.User.Channels {
+		if _, noNickChange := channel.Modes['N']; !noNickChange {
+			continue
+		}
+		if channel.userHasOps(u.User) {
+			continue
+		}
+		// 447 ERR_NONICKCHANGE. Not standard. charybdis uses it.
+		u.messageFromServer("447", []string{
+			fmt.Sprintf("Cannot change nickname while on %s (+N is set)",
+				channel.Name)})
+		return
+	}
+
 	newNickCanon := canonicalizeNick(nick)
 	oldNickCanon := canonicalizeNick(u.User.DisplayNick)
 
@@ -731,6 +1107,15 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 		}
 	}
 
+	u.changeNick(nick)
+}
+
+// changeNick changes the user's nick and tells everyone who needs to know.
+// Callers check the nick is valid and that no one else has it.
+func (u *LocalUser) changeNick(nick string) {
+	newNickCanon := canonicalizeNick(nick)
+	oldNickCanon := canonicalizeNick(u.User.DisplayNick)
+
 	// Free the old nick.
 	delete(u.Catbox.Nicks, oldNickCanon)
 
@@ -782,6 +1167,8 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 			Params:  []string{u.User.DisplayNick, fmt.Sprintf("%d", u.User.NickTS)},
 		})
 	}
+
+	u.Catbox.checkNickOwnership(u)
 }
 
 // The USER command only occurs during connection registration.
@@ -810,11 +1197,59 @@ func (u *LocalUser) joinCommand(m irc.Message) {
 	// May have multiple channels in a single command.
 	channels := commaChannelsToChannelNames(m.Params[0])
 
-	// We could support keys.
+	// May have keys. They match up with the channels by position.
+	var keys []string
+	if len(m.Params) >= 2 {
+		keys = strings.Split(m.Params[1], ",")
+	}
 
 	// Try to join the client to the channels.
-	for _, channelName := range channels {
-		u.join(channelName)
+	for i, channelName := range channels {
+		key := ""
+		if i < len(keys) {
+			key = keys[i]
+		}
+
+		// Channels longer than our limit may exist, such as if another server has
+		// a longer limit. Our users may join them but not create them.
+		_, exists := u.Catbox.Channels[channelName]
+		if !exists && len(channelName) > u.Catbox.Config.MaxChannelLength {
+			// 479 ERR_BADCHANNAME. Not standard. ratbox uses it.
+			u.messageFromServer("479", []string{channelName,
+				"Illegal channel name"})
+			continue
+		}
+
+		if _, onChannel := u.User.Channels[channelName]; onChannel {
+			continue
+		}
+
+		if maxChannels := u.maxChannels(); maxChannels > 0 &&
+			len(u.User.Channels) >= maxChannels {
+			// 405 ERR_TOOMANYCHANNELS
+			u.messageFromServer("405", []string{channelName,
+				"You have joined too many channels"})
+			return
+		}
+
+		if rc, reserved := u.Catbox.reservation(channelName); reserved {
+			// 479 ERR_BADCHANNAME
+			u.messageFromServer("479", []string{channelName,
+				reservedMessage("Channel is reserved", rc)})
+			continue
+		}
+
+		if u.joinPartFlooding() {
+			// 263 RPL_TRYAGAIN
+			u.messageFromServer("263", []string{"JOIN",
+				"Too many joins and parts. Please wait a while and try again."})
+			return
+		}
+
+		// A forwarded join counts too.
+		if u.join(channelName, key, false) != nil {
+			u.recordJoinPart()
+		}
 	}
 }
 
@@ -836,18 +1271,88 @@ func (u *LocalUser) partCommand(m irc.Message) {
 	channels := commaChannelsToChannelNames(m.Params[0])
 
 	for _, channel := range channels {
+		if _, onChannel := u.User.Channels[channel]; onChannel {
+			u.recordJoinPart()
+		}
 		u.part(channel, partMessage)
 	}
 }
 
-// Per RFC 2812, PRIVMSG and NOTICE are essentially the same, so both PRIVMSG
-// and NOTICE use this command function.
-func (u *LocalUser) privmsgCommand(m irc.Message) {
-	// Parameters: <msgtarget> <text to be sent>
+// maxChannels decides the most channels the user may be in at once. Their
+// users config block may set it. Operators have no limit. 0 for no limit.
+func (u *LocalUser) maxChannels() int {
+	if u.User.isOperator() {
+		return 0
+	}
 
-	if len(m.Params) == 0 {
-		// 411 ERR_NORECIPIENT
-		u.messageFromServer("411", []string{"No recipient given (PRIVMSG)"})
+	for _, userConfig := range u.Catbox.Config.UserConfigs {
+		if userConfig.Name == u.UserConfigName && userConfig.MaxChannels > 0 {
+			return userConfig.MaxChannels
+		}
+	}
+
+	return u.Catbox.Config.MaxChannels
+}
+
+// joinPartFlooding decides whether the user has joined and parted channels
+// too often recently. If so, we refuse to let them join more until some time
+// passes, and let operators know.
+//
+// We don't refuse parts. Users may always leave channels.
+func (u *LocalUser) joinPartFlooding() bool {
+	if u.Catbox.Config.JoinPartCount == 0 || u.User.isFloodExempt() {
+		return false
+	}
+
+	u.expireJoinParts(time.Now())
+	if len(u.RecentJoinParts) < u.Catbox.Config.JoinPartCount {
+		return false
+	}
+
+	floodLog.Infof("%s is join/part flooding. Refusing their join.",
+		u.User.DisplayNick)
+
+	if time.Since(u.LastJoinPartNotice) >= joinPartNoticeTime {
+		u.Catbox.noticeLocalOpersRealHost(fmt.Sprintf(
+			"%s (%s@%s) is join/part flooding", u.User.DisplayNick,
+			u.User.Username, u.User.Hostname), fmt.Sprintf(
+			"%s (%s@%s) is join/part flooding", u.User.DisplayNick,
+			u.User.Username, u.User.DisplayHost))
+		u.LastJoinPartNotice = time.Now()
+	}
+
+	return true
+}
+
+// recordJoinPart remembers that the user joined or parted a channel.
+func (u *LocalUser) recordJoinPart() {
+	if u.Catbox.Config.JoinPartCount == 0 || u.User.isFloodExempt() {
+		return
+	}
+
+	now := time.Now()
+	u.expireJoinParts(now)
+	u.RecentJoinParts = append(u.RecentJoinParts, now)
+}
+
+// expireJoinParts forgets joins and parts too old to count.
+func (u *LocalUser) expireJoinParts(now time.Time) {
+	i := 0
+	for i < len(u.RecentJoinParts) &&
+		now.Sub(u.RecentJoinParts[i]) >= u.Catbox.Config.JoinPartTime {
+		i++
+	}
+	u.RecentJoinParts = u.RecentJoinParts[i:]
+}
+
+// Per RFC 2812, PRIVMSG and NOTICE are essentially the same, so both PRIVMSG
+// and NOTICE use this command function.
+func (u *LocalUser) privmsgCommand(m irc.Message) {
+	// Parameters: <msgtarget> <text to be sent>
+
+	if len(m.Params) == 0 {
+		// 411 ERR_NORECIPIENT
+		u.messageFromServer("411", []string{"No recipient given (PRIVMSG)"})
 		return
 	}
 
@@ -859,12 +1364,46 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 
 	// I don't check if there are too many parameters. They get ignored anyway.
 
-	target := m.Params[0]
+	// There may be several comma separated targets. Like ratbox, we skip
+	// duplicates.
+	var targets []string
+	seen := make(map[string]struct{})
+	for _, target := range strings.Split(m.Params[0], ",") {
+		if target == "" {
+			continue
+		}
+		if _, ok := seen[strings.ToLower(target)]; ok {
+			continue
+		}
+		seen[strings.ToLower(target)] = struct{}{}
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		// 411 ERR_NORECIPIENT
+		u.messageFromServer("411", []string{"No recipient given (PRIVMSG)"})
+		return
+	}
+
+	maxTargets := u.Catbox.Config.MaxTargets
+	if maxTargets > 0 && len(targets) > maxTargets {
+		// 407 ERR_TOOMANYTARGETS
+		u.messageFromServer("407", []string{targets[maxTargets],
+			fmt.Sprintf("Too many recipients. Only %d processed", maxTargets)})
+		targets = targets[:maxTargets]
+	}
 
-	msg := m.Params[1]
+	for i, target := range targets {
+		u.privmsgTarget(m.Command, target, m.Params[1], i > 0)
+	}
+}
 
-	// Are we messaging a channel? Note I only support # channels right now.
-	if target[0] == '#' {
+// privmsgTarget sends a PRIVMSG or NOTICE to a single target. extraTarget
+// says whether the command had targets before this one. See rateLimitStage().
+func (u *LocalUser) privmsgTarget(command, target, msg string,
+	extraTarget bool) {
+	// Are we messaging a channel?
+	if target[0] == '#' || target[0] == '&' {
 		channelName := canonicalizeChannel(target)
 		if !isValidChannel(channelName) {
 			// 404 ERR_CANNOTSENDTOCHAN
@@ -879,51 +1418,51 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 			return
 		}
 
-		// Are they on it?
-		// Technically we should allow messaging if they aren't on it
-		// depending on the mode.
-		if !u.User.onChannel(channel) {
-			// 404 ERR_CANNOTSENDTOCHAN
-			u.messageFromServer("404", []string{channelName, "Cannot send to channel"})
-			return
-		}
-
-		u.LastMessageTime = time.Now()
-
-		// Send to all members of the channel. Except the client itself it seems.
-		// Tell local users directly.
-		// If a user is remote, record the server we should propagate the message
-		// towards. Tell each server only once.
-		toServers := make(map[*LocalServer]struct{})
-		for memberUID := range channel.Members {
-			member := u.Catbox.Users[memberUID]
-			if member.UID == u.User.UID {
-				continue
-			}
-
-			if member.isLocal() {
-				// From the client to each member.
-				u.messageUser(member, m.Command, []string{channel.Name, msg})
-				continue
-			}
+		u.Catbox.runMessagePipeline(&Delivery{
+			Command:     command,
+			Source:      u.User,
+			LocalSource: u,
+			SourceName:  u.User.nickUhost(),
+			SourceID:    string(u.User.UID),
+			Channel:     channel,
+			Text:        msg,
+			ExtraTarget: extraTarget,
+		})
+		return
+	}
 
-			toServers[member.ClosestServer] = struct{}{}
+	// We're messaging a nick on a particular server.
+	if strings.Contains(target, "@") {
+		d := &Delivery{
+			Command:     command,
+			Source:      u.User,
+			LocalSource: u,
+			SourceName:  u.User.nickUhost(),
+			SourceID:    string(u.User.UID),
+			Text:        msg,
+			ExtraTarget: extraTarget,
 		}
-
-		// Propagate message to any servers that need it.
-		for server := range toServers {
-			server.maybeQueueMessage(irc.Message{
-				Prefix:  string(u.User.UID),
-				Command: m.Command,
-				Params:  []string{channel.Name, msg},
-			})
+		if !u.Catbox.setNickAtServerTarget(d, target) {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{target, "No such nick/channel"})
+			return
 		}
-
+		u.Catbox.runMessagePipeline(d)
 		return
 	}
 
 	// We're messaging a nick directly.
 
+	if command == "PRIVMSG" && u.Catbox.isNickServ(target) {
+		u.nickServCommand(strings.Fields(msg))
+		return
+	}
+
+	if command == "PRIVMSG" && u.Catbox.isChanServ(target) {
+		u.chanServCommand(strings.Fields(msg))
+		return
+	}
+
 	nickName := canonicalizeNick(target)
 	if !isValidNick(u.Catbox.Config.MaxNickLength, nickName) {
 		// 401 ERR_NOSUCHNICK
@@ -937,29 +1476,17 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 		u.messageFromServer("401", []string{nickName, "No such nick/channel"})
 		return
 	}
-	targetUser := u.Catbox.Users[targetUID]
-
-	u.LastMessageTime = time.Now()
-
-	if targetUser.isLocal() {
-		u.messageUser(targetUser, m.Command, []string{nickName, msg})
-	} else {
-		u.messageUser(targetUser, m.Command, []string{string(targetUser.UID),
-			msg})
-	}
 
-	// Reply with 301 RPL_AWAY if they're away.
-	if len(targetUser.AwayMessage) > 0 {
-		u.maybeQueueMessage(irc.Message{
-			Prefix:  u.Catbox.Config.ServerName,
-			Command: "301",
-			Params: []string{
-				u.User.DisplayNick,
-				targetUser.DisplayNick,
-				targetUser.AwayMessage,
-			},
-		})
-	}
+	u.Catbox.runMessagePipeline(&Delivery{
+		Command:     command,
+		Source:      u.User,
+		LocalSource: u,
+		SourceName:  u.User.nickUhost(),
+		SourceID:    string(u.User.UID),
+		Target:      u.Catbox.Users[targetUID],
+		Text:        msg,
+		ExtraTarget: extraTarget,
+	})
 }
 
 func (u *LocalUser) lusersCommand() {
@@ -967,12 +1494,17 @@ func (u *LocalUser) lusersCommand() {
 	// The others only need be sent if the counts are non-zero.
 
 	// 251 RPL_LUSERCLIENT
+	network := ""
+	if u.Catbox.Config.NetworkName != "" {
+		network = " of " + u.Catbox.Config.NetworkName
+	}
 	u.messageFromServer("251", []string{
-		fmt.Sprintf("There are %d users and %d services on %d servers.",
+		fmt.Sprintf("There are %d users and %d services on %d servers%s.",
 			len(u.Catbox.Users),
 			0,
 			// +1 to count ourself.
-			len(u.Catbox.Servers)+1),
+			len(u.Catbox.Servers)+1,
+			network),
 	})
 
 	// 252 RPL_LUSEROP
@@ -1098,6 +1630,13 @@ func (u *LocalUser) dieCommand(m irc.Message) {
 		return
 	}
 
+	// DIE [server name]
+	if !u.confirmedShutdown(m) {
+		return
+	}
+
+	u.Catbox.noticeOpers(fmt.Sprintf("%s issued die.", u.User.DisplayNick))
+
 	// die is not an RFC command. I use it to shut down the server.
 	u.Catbox.shutdown()
 }
@@ -1109,20 +1648,141 @@ func (u *LocalUser) restartCommand(m irc.Message) {
 		return
 	}
 
+	// RESTART [server name]
+	if !u.confirmedShutdown(m) {
+		return
+	}
+
 	u.Catbox.restart(u.User)
 }
 
+func (u *LocalUser) upgradeCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	// UPGRADE [server name]
+	if !u.confirmedShutdown(m) {
+		return
+	}
+
+	u.Catbox.upgrade(u.User)
+}
+
+// confirmedShutdown checks a DIE, RESTART, or UPGRADE has our server name if we require
+// confirmation. This is so operators don't shut down the wrong server by
+// accident.
+func (u *LocalUser) confirmedShutdown(m irc.Message) bool {
+	if !u.Catbox.Config.ConfirmShutdown {
+		return true
+	}
+
+	if len(m.Params) > 0 && m.Params[0] == u.Catbox.Config.ServerName {
+		return true
+	}
+
+	u.serverNotice(fmt.Sprintf("Need server name: %s %s", m.Command,
+		u.Catbox.Config.ServerName))
+	return false
+}
+
 func (u *LocalUser) whoisCommand(m irc.Message) {
-	// Difference from RFC: I support only a single nickname (no mask), and no
-	// server target.
+	// Difference from RFC: I support only nicknames (no masks).
 	if len(m.Params) == 0 {
 		// 431 ERR_NONICKNAMEGIVEN
 		u.messageFromServer("431", []string{"No nickname given"})
 		return
 	}
 
-	nick := m.Params[0]
+	// Parameters: [<server or nick>] <nick>[,<nick>...]
+	//
+	// We always ask a remote user's server, so we show everything (such as
+	// idle time) either way. With a target, we ask that server instead. This
+	// is the same as ratbox's WHOIS <nick> <nick>.
+	var target *Server
+	nickParam := m.Params[0]
+	if len(m.Params) > 1 {
+		nickParam = m.Params[1]
+
+		var ok bool
+		target, ok = u.whoisTarget(m.Params[0])
+		if !ok {
+			// 402 ERR_NOSUCHSERVER
+			u.messageFromServer("402", []string{m.Params[0], "No such server"})
+			return
+		}
+	}
+
+	nicks := strings.Split(nickParam, ",")
+
+	limit := u.resultLimit(u.Catbox.Config.MaxWHOISTargets)
+	if limit > 0 && len(nicks) > limit {
+		u.serverNotice(fmt.Sprintf("WHOIS limited to %d targets.", limit))
+		nicks = nicks[:limit]
+	}
 
+	u.targetPenalty(len(nicks))
+
+	for _, nick := range nicks {
+		if target != nil {
+			target.route().maybeQueueMessage(irc.Message{
+				Prefix:  string(u.User.UID),
+				Command: "WHOIS",
+				Params:  []string{string(target.SID), nick},
+			})
+			continue
+		}
+		u.whois(nick)
+	}
+}
+
+// whoisTarget finds the server a WHOIS with a target goes to. The target is a
+// server name or a nick. The server is nil if it is us.
+func (u *LocalUser) whoisTarget(name string) (*Server, bool) {
+	if name == u.Catbox.Config.ServerName {
+		return nil, true
+	}
+
+	if server := u.Catbox.getServerByName(name); server != nil {
+		return server, true
+	}
+
+	uid, exists := u.Catbox.Nicks[canonicalizeNick(name)]
+	if !exists {
+		return nil, false
+	}
+	user := u.Catbox.Users[uid]
+	if user.isLocal() {
+		return nil, true
+	}
+	return user.Server, true
+}
+
+// floodPenalty is how much a message from a user costs for flood control. It
+// depends on the message's length. See FloodPenaltyBytes.
+func floodPenalty(m irc.Message) int {
+	// The length of the message as sent, less the CRLF and any colon.
+	size := len(m.Command)
+	for _, param := range m.Params {
+		size += 1 + len(param)
+	}
+
+	return (size + FloodPenaltyBytes - 1) / FloodPenaltyBytes
+}
+
+// targetPenalty charges the user's flood control counter for a command with
+// several targets. handleMessage already charged them for the first.
+func (u *LocalUser) targetPenalty(targets int) {
+	if u.User.isFloodExempt() || targets <= 1 {
+		return
+	}
+	u.MessageCounter -= targets - 1
+}
+
+// whois responds to a WHOIS for a single nick.
+func (u *LocalUser) whois(nick string) {
 	uid, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
 	if !exists {
 		// 401 ERR_NOSUCHNICK
@@ -1152,11 +1812,13 @@ func (u *LocalUser) whoisCommand(m irc.Message) {
 	for _, msg := range msgs {
 		u.maybeQueueMessage(msg)
 	}
+	u.Catbox.whoisNotice(user, u.User)
 }
 
 func (u *LocalUser) operCommand(m irc.Message) {
 	// Parameters: <name> <password>
-	if len(m.Params) < 2 {
+	// The password may be missing if the oper block has only a certificate.
+	if len(m.Params) < 1 {
 		// 461 ERR_NEEDMOREPARAMS
 		u.messageFromServer("461", []string{"OPER", "Not enough parameters"})
 		return
@@ -1168,23 +1830,96 @@ func (u *LocalUser) operCommand(m irc.Message) {
 		return
 	}
 
-	// We could require particular user/hostmask per oper.
+	// After failing, they must wait before trying again.
+	if wait := u.operWait(); wait > 0 {
+		// 263 RPL_TRYAGAIN
+		u.messageFromServer("263", []string{"OPER", fmt.Sprintf(
+			"Too many failed attempts. Please wait %s and try again.",
+			wait.Round(time.Second))})
+		return
+	}
 
 	// Check if they gave acceptable permissions.
-	pass, exists := u.Catbox.Config.Opers[m.Params[0]]
-	if !exists || pass != m.Params[1] {
-		// 464 ERR_PASSWDMISMATCH
-		u.messageFromServer("464", []string{"Password incorrect"})
+	oper, exists := u.Catbox.Config.Opers[m.Params[0]]
+	if !exists {
+		// 491 ERR_NOOPERHOST
+		u.messageFromServer("491", []string{"No O-lines for your host"})
+		u.operFailed(m.Params[0], "no oper block")
+		return
+	}
+
+	if !u.canOper(oper) {
+		// 491 ERR_NOOPERHOST
+		u.messageFromServer("491", []string{"No O-lines for your host"})
+		u.operFailed(m.Params[0], "host mismatch")
+		return
+	}
+
+	if oper.CertFP != "" && oper.CertFP != u.User.CertFP {
+		// 491 ERR_NOOPERHOST
+		u.messageFromServer("491", []string{"No O-lines for your host"})
+		u.operFailed(m.Params[0], "certificate mismatch")
+		return
+	}
+
+	if oper.Password != "" && len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"OPER", "Not enough parameters"})
+		return
+	}
+
+	if oper.Password == "" {
+		u.becomeOper(m.Params[0])
+		return
+	}
+
+	if u.CheckingPassword {
+		// 263 RPL_TRYAGAIN
+		u.messageFromServer("263", []string{"OPER",
+			"Still checking your last password. Please try again."})
 		return
 	}
 
-	// Give them oper status.
+	u.CheckingPassword = true
+	name := m.Params[0]
+	u.Catbox.checkPasswordAsync(oper.Password, m.Params[1], func(ok bool) {
+		if !u.isConnected() {
+			return
+		}
+		u.CheckingPassword = false
+
+		if u.User.isOperator() {
+			return
+		}
+
+		if !ok {
+			// 464 ERR_PASSWDMISMATCH
+			u.messageFromServer("464", []string{"Password incorrect"})
+			u.operFailed(name, "password mismatch")
+			return
+		}
+
+		u.becomeOper(name)
+	})
+}
+
+// becomeOper makes the user an operator. They passed the checks for the named
+// oper block.
+func (u *LocalUser) becomeOper(name string) {
+	u.operSucceeded()
+
+	// Give them oper status. Like ratbox, operators see WALLOPS by default.
+	modes := "+o"
 	u.User.Modes['o'] = struct{}{}
+	if _, wallops := u.User.Modes['w']; !wallops {
+		u.User.Modes['w'] = struct{}{}
+		modes += "w"
+	}
 
 	u.Catbox.Opers[u.User.UID] = u.User
 
 	// From themselves to themselves.
-	u.messageUser(u.User, "MODE", []string{u.User.DisplayNick, "+o"})
+	u.messageUser(u.User, "MODE", []string{u.User.DisplayNick, modes})
 
 	// 381 RPL_YOUREOPER
 	u.messageFromServer("381", []string{"You are now an IRC operator"})
@@ -1194,12 +1929,34 @@ func (u *LocalUser) operCommand(m irc.Message) {
 		server.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
 			Command: "MODE",
-			Params:  []string{string(u.User.UID), "+o"},
+			Params:  []string{string(u.User.UID), modes},
 		})
 	}
 
 	u.Catbox.noticeLocalOpers(fmt.Sprintf("%s@%s became an operator.",
 		u.User.DisplayNick, u.Catbox.Config.ServerName))
+	logEvent("oper", "%s (%s@%s) became an operator using oper block %s",
+		u.User.DisplayNick, u.User.Username, u.User.Hostname, name)
+}
+
+// canOper decides whether the user may use the oper block from where they
+// are connected.
+func (u *LocalUser) canOper(oper *OperConfig) bool {
+	if oper.RequireTLS && !u.isTLS() {
+		return false
+	}
+
+	if len(oper.Masks) == 0 {
+		return true
+	}
+
+	for _, mask := range oper.Masks {
+		idx := strings.Index(mask, "@")
+		if u.User.matchesUserHostMask(mask[:idx], mask[idx+1:]) {
+			return true
+		}
+	}
+	return false
 }
 
 // MODE command applies either to nicknames or to channels.
@@ -1232,6 +1989,22 @@ func (u *LocalUser) modeCommand(m irc.Message) {
 		return
 	}
 
+	// Operspy: MODE !#channel shows the channel's modes, including its key, and
+	// MODE !#channel b (or e, I, q) its lists. It can't change them.
+	if strings.HasPrefix(target, "!") {
+		if !u.operspy(m) {
+			return
+		}
+		targetChannel, exists := u.Catbox.Channels[canonicalizeChannel(target[1:])]
+		if !exists {
+			// 403 ERR_NOSUCHCHANNEL
+			u.messageFromServer("403", []string{target[1:], "No such channel"})
+			return
+		}
+		u.operspyChannelModeCommand(targetChannel, modes)
+		return
+	}
+
 	// Is it a channel?
 	targetChannel, exists := u.Catbox.Channels[canonicalizeChannel(target)]
 	if exists {
@@ -1253,6 +2026,7 @@ func (u *LocalUser) modeCommand(m irc.Message) {
 // +i/-i (invisible, actually doesn't change anything for this server, but)
 // +o/-o (operator)
 // +C/-C (must be +o to alter) (client connection notices)
+// +x/-x (cloak hostname. Only if we have a cloak key)
 func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
 	// They can only change their own mode.
 	if targetUser.LocalUser != u {
@@ -1268,12 +2042,27 @@ func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
 		return
 	}
 
+	if !u.changeUserModes(modes) {
+		// 501 ERR_UMODEUNKNOWNFLAG
+		u.messageFromServer("501", []string{"Unknown MODE flag"})
+	}
+}
+
+// changeUserModes applies user mode changes to the user and tells them and
+// the network about them.
+//
+// It returns false if any of the modes are unknown.
+func (u *LocalUser) changeUserModes(modes string) bool {
 	setModes, unsetModes, unknownModes, err := parseAndResolveUmodeChanges(modes,
 		u.User.Modes)
 	if err != nil {
-		// 501 ERR_UMODEUNKNOWNFLAG
-		u.messageFromServer("501", []string{"Unknown MODE flag"})
-		return
+		return false
+	}
+
+	// We can't cloak without a key.
+	if _, exists := setModes['x']; exists && u.Catbox.Config.CloakKey == "" {
+		delete(setModes, 'x')
+		delete(u.User.Modes, 'x')
 	}
 
 	// Apply changes and build the mode string.
@@ -1322,38 +2111,63 @@ func (u *LocalUser) userModeCommand(targetUser *User, modes string) {
 		}
 	}
 
-	if len(unknownModes) > 0 {
-		// 501 ERR_UMODEUNKNOWNFLAG
-		u.messageFromServer("501", []string{"Unknown MODE flag"})
+	_, cloak := setModes['x']
+	_, uncloak := unsetModes['x']
+	if (cloak || uncloak) &&
+		u.User.DisplayHost != u.displayHost(u.User.Hostname) {
+		u.Catbox.setHost(u.User, u.User.Hostname, u.displayHost(u.User.Hostname))
+		u.sendHostHidden()
 	}
+
+	return len(unknownModes) == 0
 }
 
 // We've found a MODE message is about a channel.
 func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	params []string) {
-	if !u.User.onChannel(channel) {
-		// 442 ERR_NOTONCHANNEL
-		u.messageFromServer("442", []string{channel.Name,
-			"You're not on that channel"})
-		return
-	}
+	onChannel := u.User.onChannel(channel)
 
 	// No modes? Send back the channel's modes.
-	// Always send back +ns. That's only I support right now.
-	if len(modes) == 0 {
+	//
+	// Like ratbox, users not on the channel may see its modes, but not their
+	// parameters (e.g., the key). Secret channels we don't reveal.
+	_, secret := channel.Modes['s']
+	if len(modes) == 0 && (onChannel || !secret) {
 		// 324 RPL_CHANNELMODEIS
-		u.messageFromServer("324", []string{channel.Name, "+ns"})
+		params := []string{channel.Name, channel.modesString()}
+		if onChannel {
+			params = append(params, channel.modeParams()...)
+		}
+		u.messageFromServer("324", params)
 		// 329 RPL_CREATIONTIME. Not standard but oft used.
 		u.messageFromServer("329", []string{channel.Name,
 			fmt.Sprintf("%d", channel.TS)})
 		return
 	}
 
-	// Listing bans. I don't support bans at this time. Say that there are none.
-	if modes == "b" || modes == "+b" {
-		// 368 RPL_ENDOFBANLIST
-		u.messageFromServer("368", []string{channel.Name,
-			"End of channel ban list"})
+	if !onChannel {
+		// 442 ERR_NOTONCHANNEL
+		u.messageFromServer("442", []string{channel.Name,
+			"You're not on that channel"})
+		return
+	}
+
+	// Listing bans and quiets.
+	if modes == "b" || modes == "+b" || modes == "q" || modes == "+q" {
+		u.sendChannelList(channel, modes[len(modes)-1])
+		return
+	}
+
+	// Listing ban exceptions and invite exceptions. Like ratbox, only channel
+	// operators may see these.
+	if modes == "e" || modes == "+e" || modes == "I" || modes == "+I" {
+		if !channel.userHasOps(u.User) {
+			// 482 ERR_CHANOPRIVSNEEDED
+			u.messageFromServer("482", []string{channel.Name,
+				"You're not channel operator"})
+			return
+		}
+		u.sendChannelList(channel, modes[len(modes)-1])
 		return
 	}
 
@@ -1366,9 +2180,48 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 		return
 	}
 
+	u.changeChannelModes(channel, modes, params)
+}
+
+// operspyChannelModeCommand shows an operator a channel's modes or one of its
+// lists whether or not they are on it.
+func (u *LocalUser) operspyChannelModeCommand(channel *Channel, modes string) {
+	list := strings.TrimPrefix(modes, "+")
+	if list == "b" || list == "e" || list == "I" || list == "q" {
+		u.sendChannelList(channel, list[0])
+		return
+	}
+
+	// 324 RPL_CHANNELMODEIS
+	u.messageFromServer("324", append([]string{channel.Name,
+		channel.modesString()}, channel.modeParams()...))
+	// 329 RPL_CREATIONTIME
+	u.messageFromServer("329", []string{channel.Name,
+		fmt.Sprintf("%d", channel.TS)})
+}
+
+// changeChannelModes applies channel mode changes from the user and tells the
+// channel and the network about them. Callers check the user may make them.
+func (u *LocalUser) changeChannelModes(channel *Channel, modes string,
+	params []string) {
 	// Apply mode changes we support.
 	// Currently I support:
 	// - +o/-o
+	// - +b/-b
+	// - +e/-e
+	// - +I/-I
+	// - +q/-q
+	// - +i/-i
+	// - +n/-n
+	// - +s/-s
+	// - +t/-t
+	// - +k/-k
+	// - +l/-l
+	// - +j/-j
+	// - +f/-f
+	// - +c/-c
+	// - +C/-C
+	// - +N/-N
 	// Also generate the information we need to send to our local users and to
 	// servers.
 
@@ -1404,11 +2257,233 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 			continue
 		}
 
-		if char != 'o' {
-			continue
-		}
+		if isChannelListMode(byte(char)) {
+			// Must have a parameter. A mask.
+			if paramIndex >= len(params) {
+				break
+			}
 
-		// +o/-o
+			mask := normalizeChannelMask(params[paramIndex])
+			paramIndex++
+			if mask == "" {
+				break
+			}
+
+			if action == '+' {
+				if channel.listEntries() >=
+					u.Catbox.Config.MaxChannelListEntries {
+					// 478 ERR_BANLISTFULL
+					u.messageFromServer("478", []string{channel.Name, mask,
+						"Channel ban list is full"})
+					break
+				}
+				if !channel.addMask(byte(char), mask, u.User.nickUhost(),
+					time.Now().Unix()) {
+					break
+				}
+			} else {
+				if !channel.removeMask(byte(char), mask) {
+					break
+				}
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+			appliedParamsUser = append(appliedParamsUser, mask)
+			appliedParamsServer = append(appliedParamsServer, mask)
+
+			modesApplied++
+			continue
+		}
+
+		if isChannelSimpleMode(byte(char)) {
+			_, isSet := channel.Modes[byte(char)]
+			if action == '+' {
+				if isSet {
+					continue
+				}
+				channel.Modes[byte(char)] = struct{}{}
+			} else {
+				if !isSet {
+					continue
+				}
+				delete(channel.Modes, byte(char))
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+
+			modesApplied++
+			continue
+		}
+
+		if char == 'k' {
+			if action == '+' {
+				// Must have a parameter. The key.
+				if paramIndex >= len(params) {
+					break
+				}
+
+				key := cleanChannelKey(params[paramIndex])
+				paramIndex++
+				if key == "" || key == channel.Key {
+					break
+				}
+				channel.Key = key
+			} else {
+				// The parameter is optional when unsetting. We ignore it.
+				if paramIndex < len(params) {
+					paramIndex++
+				}
+				if channel.Key == "" {
+					break
+				}
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+			appliedParamsUser = append(appliedParamsUser, channel.Key)
+			appliedParamsServer = append(appliedParamsServer, channel.Key)
+			if action == '-' {
+				channel.Key = ""
+			}
+
+			modesApplied++
+			continue
+		}
+
+		if char == 'f' {
+			if action == '+' {
+				// Must have a parameter. The channel.
+				if paramIndex >= len(params) {
+					break
+				}
+
+				forward := canonicalizeChannel(params[paramIndex])
+				paramIndex++
+				if !isValidForward(channel, forward) || forward == channel.Forward {
+					break
+				}
+
+				// They must have ops in the channel they forward to. Otherwise they
+				// could send a flood of users anywhere.
+				target, exists := u.Catbox.Channels[forward]
+				if !exists || !target.userHasOps(u.User) {
+					// 482 ERR_CHANOPRIVSNEEDED
+					u.messageFromServer("482", []string{forward,
+						"You're not channel operator"})
+					break
+				}
+				channel.Forward = forward
+
+				appliedParamsUser = append(appliedParamsUser, forward)
+				appliedParamsServer = append(appliedParamsServer, forward)
+			} else {
+				if channel.Forward == "" {
+					break
+				}
+				channel.Forward = ""
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+
+			modesApplied++
+			continue
+		}
+
+		if char == 'j' {
+			if action == '+' {
+				// Must have a parameter. n:t
+				if paramIndex >= len(params) {
+					break
+				}
+
+				count, seconds, ok := parseJoinThrottle(params[paramIndex])
+				paramIndex++
+				if !ok || (count == channel.JoinThrottleCount &&
+					seconds == channel.JoinThrottleTime) {
+					break
+				}
+				channel.setJoinThrottle(count, seconds)
+
+				throttle := formatJoinThrottle(count, seconds)
+				appliedParamsUser = append(appliedParamsUser, throttle)
+				appliedParamsServer = append(appliedParamsServer, throttle)
+			} else {
+				if channel.JoinThrottleCount == 0 {
+					break
+				}
+				channel.setJoinThrottle(0, 0)
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+
+			modesApplied++
+			continue
+		}
+
+		if char == 'l' {
+			if action == '+' {
+				// Must have a parameter. The limit.
+				if paramIndex >= len(params) {
+					break
+				}
+
+				limit, err := strconv.Atoi(params[paramIndex])
+				paramIndex++
+				if err != nil || limit <= 0 || limit == channel.Limit {
+					break
+				}
+				channel.Limit = limit
+
+				appliedParamsUser = append(appliedParamsUser, strconv.Itoa(limit))
+				appliedParamsServer = append(appliedParamsServer,
+					strconv.Itoa(limit))
+			} else {
+				if channel.Limit == 0 {
+					break
+				}
+				channel.Limit = 0
+			}
+
+			if appliedModesAction != action {
+				appliedModesAction = action
+				appliedModes += string(appliedModesAction)
+			}
+
+			appliedModes += string(char)
+
+			modesApplied++
+			continue
+		}
+
+		if char != 'o' {
+			continue
+		}
+
+		// +o/-o
 
 		// Must have a parameter. A nick.
 		if paramIndex >= len(params) {
@@ -1466,6 +2541,9 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	userModeParams := []string{channel.Name, appliedModes}
 	userModeParams = append(userModeParams, appliedParamsUser...)
 
+	u.Catbox.logModeration(channel, u.User.nickUhost(),
+		"MODE "+strings.Join(userModeParams[1:], " "))
+
 	for memberUID := range channel.Members {
 		member := u.Catbox.Users[memberUID]
 
@@ -1489,7 +2567,7 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	}
 	serverModeParams = append(serverModeParams, appliedParamsServer...)
 
-	for _, ls := range u.Catbox.LocalServers {
+	for _, ls := range u.Catbox.channelServers(channel) {
 		ls.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
 			Command: "TMODE",
@@ -1498,6 +2576,53 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	}
 }
 
+// Send the entries in one of a channel's lists. e.g., bans.
+func (u *LocalUser) sendChannelList(channel *Channel, mode byte) {
+	// 367 RPL_BANLIST / 368 RPL_ENDOFBANLIST
+	entryNumeric, endNumeric, endText := "367", "368", "End of channel ban list"
+	if mode == 'e' {
+		// 348 RPL_EXCEPTLIST / 349 RPL_ENDOFEXCEPTLIST
+		entryNumeric, endNumeric, endText = "348", "349",
+			"End of channel exception list"
+	}
+	if mode == 'I' {
+		// 346 RPL_INVITELIST / 347 RPL_ENDOFINVITELIST
+		entryNumeric, endNumeric, endText = "346", "347",
+			"End of channel invite list"
+	}
+	if mode == 'q' {
+		// 728 RPL_QUIETLIST / 729 RPL_ENDOFQUIETLIST. Not standard. charybdis uses
+		// them.
+		entryNumeric, endNumeric, endText = "728", "729",
+			"End of Channel Quiet List"
+	}
+
+	limit := u.resultLimit(u.Catbox.Config.MaxModeListResults)
+
+	for i, entry := range channel.Lists[mode] {
+		if limit > 0 && i == limit {
+			u.serverNotice(fmt.Sprintf("%s list output truncated to %d results.",
+				string(mode), limit))
+			break
+		}
+
+		// charybdis includes the mode in quiet list replies.
+		params := []string{channel.Name}
+		if mode == 'q' {
+			params = append(params, "q")
+		}
+		params = append(params, entry.Mask, entry.SetBy,
+			fmt.Sprintf("%d", entry.SetTS))
+		u.messageFromServer(entryNumeric, params)
+	}
+
+	params := []string{channel.Name}
+	if mode == 'q' {
+		params = append(params, "q")
+	}
+	u.messageFromServer(endNumeric, append(params, endText))
+}
+
 func (u *LocalUser) whoCommand(m irc.Message) {
 	if len(m.Params) < 1 {
 		// 461 ERR_NEEDMOREPARAMS
@@ -1505,13 +2630,22 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 		return
 	}
 
-	// Special case: OPERSPY of a kind. This will let the oper see all users.
-	if m.Params[0] == "!*" {
-		u.operspyWhoCommand(m)
-		return
+	// Operspy: WHO !#channel shows the members of a channel the oper is not
+	// on. WHO !* shows all users.
+	target := m.Params[0]
+	spy := strings.HasPrefix(target, "!")
+	if spy {
+		if !u.operspy(m) {
+			return
+		}
+		target = target[1:]
+		if target == "*" {
+			u.operspyWhoCommand()
+			return
+		}
 	}
 
-	channel, exists := u.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	channel, exists := u.Catbox.Channels[canonicalizeChannel(target)]
 	if !exists {
 		// We only support WHO on channels. It might be a nick or a pattern or "0".
 		// Just act like there's no match. It might be a nick or a pattern. Don't
@@ -1524,13 +2658,22 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 	}
 
 	// Only works if they are on the channel.
-	if !u.User.onChannel(channel) {
+	if !spy && !u.User.onChannel(channel) {
 		// 442 ERR_NOTONCHANNEL
 		u.messageFromServer("442", []string{channel.Name, "You're not on that channel"})
 		return
 	}
 
+	limit := u.resultLimit(u.Catbox.Config.MaxWHOResults)
+	count := 0
+
 	for memberUID := range channel.Members {
+		if limit > 0 && count == limit {
+			u.serverNotice(fmt.Sprintf("WHO output truncated to %d results.", limit))
+			break
+		}
+		count++
+
 		member := u.Catbox.Users[memberUID]
 
 		// 352 RPL_WHOREPLY
@@ -1558,11 +2701,14 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 		if member.isRemote() {
 			serverName = member.Server.Name
 		}
+		if u.Catbox.hidesServers(u.User) {
+			serverName, _ = u.Catbox.hiddenServer()
+		}
 
 		u.messageFromServer("352", []string{
 			channel.Name,
 			member.Username,
-			member.Hostname,
+			member.DisplayHost,
 			serverName,
 			member.DisplayNick,
 			mode,
@@ -1574,18 +2720,171 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 	u.messageFromServer("315", []string{channel.Name, "End of /WHO list"})
 }
 
+// LIST shows channels, their member counts, and their topics. We don't show
+// secret channels (+s) unless the user is on them.
+//
+// Operspy: LIST ! shows all channels, including secret ones. LIST !<channels>
+// shows those channels.
+//
+// Params: [<channel> *( "," <channel> )]
+func (u *LocalUser) listCommand(m irc.Message) {
+	target := ""
+	if len(m.Params) > 0 {
+		target = m.Params[0]
+	}
+
+	spy := strings.HasPrefix(target, "!")
+	if spy {
+		if !u.operspy(m) {
+			return
+		}
+		target = target[1:]
+	}
+
+	// Listing all channels is costly. Users who are not operators may do it only
+	// so often.
+	if len(target) == 0 && !u.User.isOperator() {
+		if time.Since(u.LastFullList) < listWaitTime {
+			// 263 RPL_TRYAGAIN
+			u.messageFromServer("263", []string{"LIST",
+				"Please wait a while and try again."})
+			// 323 RPL_LISTEND
+			u.messageFromServer("323", []string{"End of /LIST"})
+			return
+		}
+		u.LastFullList = time.Now()
+	}
+
+	var channels []string
+	if len(target) > 0 {
+		for _, channelName := range commaChannelsToChannelNames(target) {
+			if _, exists := u.Catbox.Channels[channelName]; exists {
+				channels = append(channels, channelName)
+			}
+		}
+	} else {
+		for channelName := range u.Catbox.Channels {
+			channels = append(channels, channelName)
+		}
+	}
+
+	sort.Strings(channels)
+
+	// 321 RPL_LISTSTART
+	u.messageFromServer("321", []string{"Channel", "Users  Name"})
+
+	// If they were part way through another LIST, this replaces it.
+	u.List = &ListState{
+		Channels: channels,
+		Spy:      spy,
+		Limit:    u.resultLimit(u.Catbox.Config.MaxLISTResults),
+	}
+	u.sendListChunk()
+}
+
+// sendListChunk sends the next part of the user's LIST. We send the rest each
+// second (see floodControl). Once we've sent it all, we end it.
+//
+// We look up each channel as we send it since channels may come and go
+// between parts.
+func (u *LocalUser) sendListChunk() {
+	list := u.List
+	sent := 0
+
+	for len(list.Channels) > 0 && sent < listChunkSize {
+		channel, exists := u.Catbox.Channels[list.Channels[0]]
+		list.Channels = list.Channels[1:]
+		if !exists {
+			continue
+		}
+
+		if _, secret := channel.Modes['s']; secret && !list.Spy &&
+			!u.User.onChannel(channel) {
+			continue
+		}
+
+		if list.Limit > 0 && list.Count == list.Limit {
+			u.serverNotice(fmt.Sprintf("LIST output truncated to %d results.",
+				list.Limit))
+			list.Channels = nil
+			break
+		}
+		list.Count++
+		sent++
+
+		// 322 RPL_LIST
+		u.messageFromServer("322", []string{
+			channel.Name,
+			fmt.Sprintf("%d", len(channel.Members)),
+			channel.Topic,
+		})
+	}
+
+	if len(list.Channels) > 0 {
+		return
+	}
+
+	// 323 RPL_LISTEND
+	u.messageFromServer("323", []string{"End of /LIST"})
+	u.List = nil
+}
+
+// NAMES shows who is on channels. Like LIST, we don't show secret channels
+// (+s) unless the user is on them. We only support NAMES with channels.
+//
+// Operspy: NAMES !<channels> shows those channels, secret or not.
+//
+// Params: [<channel> *( "," <channel> )]
+func (u *LocalUser) namesCommand(m irc.Message) {
+	if len(m.Params) == 0 || len(m.Params[0]) == 0 {
+		// 366 RPL_ENDOFNAMES
+		u.messageFromServer("366", []string{"*", "End of NAMES list"})
+		return
+	}
+
+	target := m.Params[0]
+	spy := strings.HasPrefix(target, "!")
+	if spy {
+		if !u.operspy(m) {
+			return
+		}
+		target = target[1:]
+	}
+
+	for _, channelName := range commaChannelsToChannelNames(target) {
+		channel, exists := u.Catbox.Channels[channelName]
+		if !exists {
+			// 366 RPL_ENDOFNAMES
+			u.messageFromServer("366", []string{channelName, "End of NAMES list"})
+			continue
+		}
+
+		// Only members and operspy see secret channels and invisible members.
+		showAll := spy || u.User.onChannel(channel)
+		if _, secret := channel.Modes['s']; secret && !showAll {
+			// 366 RPL_ENDOFNAMES
+			u.messageFromServer("366", []string{channel.Name, "End of NAMES list"})
+			continue
+		}
+
+		u.sendNames(channel, showAll)
+	}
+}
+
+// resultLimit tells how many results a query may return to the user. 0 means
+// there is no limit. Operators have no limit.
+func (u *LocalUser) resultLimit(limit int) int {
+	if u.User.isOperator() {
+		return 0
+	}
+	return limit
+}
+
 // This is only available to opers.
 // It is to partially support something like ratbox's WHO !<param> command
 // that lets opers see things regular users cannot.
 // In this case, I want to send the WHO result of all users to the oper.
-func (u *LocalUser) operspyWhoCommand(m irc.Message) {
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{
-			"Permission Denied- You're not an IRC operator"})
-		return
-	}
-
+func (u *LocalUser) operspyWhoCommand() {
 	// Tell them every user.
 	for _, user := range u.Catbox.Users {
 		// 352 RPL_WHOREPLY
@@ -1607,12 +2906,15 @@ func (u *LocalUser) operspyWhoCommand(m irc.Message) {
 		if user.isRemote() {
 			serverName = user.Server.Name
 		}
+		if u.Catbox.hidesServers(u.User) {
+			serverName, _ = u.Catbox.hiddenServer()
+		}
 
 		u.messageFromServer("352", []string{
 			// * for name.
 			"*",
 			user.Username,
-			user.Hostname,
+			user.DisplayHost,
 			serverName,
 			user.DisplayNick,
 			mode,
@@ -1622,9 +2924,26 @@ func (u *LocalUser) operspyWhoCommand(m irc.Message) {
 
 	// 315 RPL_ENDOFWHO
 	u.messageFromServer("315", []string{"*", "End of WHO list"})
+}
+
+// operspy checks the user may use operspy: commands that let operators see
+// what regular users cannot, such as secret channels. We tell the other
+// operators about each use and log it.
+func (u *LocalUser) operspy(m irc.Message) bool {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{
+			"Permission Denied- You're not an IRC operator"})
+		return false
+	}
+
+	command := strings.Join(append([]string{m.Command}, m.Params...), " ")
 
-	u.Catbox.noticeOpers(fmt.Sprintf("%s used OPERSPY WHO !*",
-		u.User.DisplayNick))
+	u.Catbox.noticeOpers(fmt.Sprintf("OPERSPY %s (%s@%s) used %s",
+		u.User.DisplayNick, u.User.Username, u.User.DisplayHost, command))
+	logEvent("oper", "OPERSPY %s (%s@%s) used %s", u.User.DisplayNick,
+		u.User.Username, u.User.Hostname, command)
+	return true
 }
 
 func (u *LocalUser) topicCommand(m irc.Message) {
@@ -1670,11 +2989,18 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 	}
 
 	topic := m.Params[1]
-	if len(topic) > maxTopicLength {
-		topic = topic[:maxTopicLength]
+	if len(topic) > u.Catbox.Config.MaxTopicLength {
+		topic = topic[:u.Catbox.Config.MaxTopicLength]
 	}
 
-	// TODO: When we support channel mode +t we will need additional logic.
+	// If the topic is locked (+t), only channel operators may change it.
+	if _, topicLocked := channel.Modes['t']; topicLocked &&
+		!channel.userHasOps(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
 
 	// Set new topic.
 
@@ -1682,6 +3008,10 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 	channel.TopicTS = time.Now().Unix()
 	channel.TopicSetter = u.User.nickUhost()
 
+	u.Catbox.logModeration(channel, channel.TopicSetter,
+		"TOPIC "+channel.Topic)
+	u.Catbox.chanServTopicChanged(channel)
+
 	// Tell all members of the channel, including the client.
 	// Only local clients. We tell remote users by telling all servers.
 	for memberUID := range channel.Members {
@@ -1694,7 +3024,7 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 	}
 
 	// Topic appears to propagate globally no matter what.
-	for _, server := range u.Catbox.LocalServers {
+	for _, server := range u.Catbox.channelServers(channel) {
 		server.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
 			Command: "TOPIC",
@@ -1703,106 +3033,411 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 	}
 }
 
-// Initiate a connection to a server.
-//
-// I implement CONNECT differently than RFC 2812. Only a single parameter.
-func (u *LocalUser) connectCommand(m irc.Message) {
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+// KICK removes users from a channel. Only channel operators may do this.
+func (u *LocalUser) kickCommand(m irc.Message) {
+	// Params: <channel> <user> *( "," <user> ) [<comment>]
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"KICK", "Not enough parameters"})
 		return
 	}
 
-	// CONNECT <server name>
-	if len(m.Params) < 1 {
-		// 461 ERR_NEEDMOREPARAMS
-		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+	channelName := canonicalizeChannel(m.Params[0])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[0], "No such channel"})
 		return
 	}
 
-	serverName := m.Params[0]
-
-	// Is it a server we know about?
-	linkInfo, exists := u.Catbox.Config.Servers[serverName]
-	if !exists {
-		// 402 ERR_NOSUCHSERVER
-		u.messageFromServer("402", []string{serverName, "No such server"})
+	if !u.User.onChannel(channel) {
+		// 442 ERR_NOTONCHANNEL
+		u.messageFromServer("442", []string{channel.Name,
+			"You're not on that channel"})
 		return
 	}
 
-	// Are we already linked to it?
-	if u.Catbox.isLinkedToServer(serverName) {
-		// No great error code.
-		u.serverNotice(fmt.Sprintf("I am already linked to %s.", serverName))
+	if !channel.userHasOps(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
 		return
 	}
 
-	// We could check if we're already trying to link to it. But the result should
-	// be the same.
-	u.Catbox.connectToServer(linkInfo)
-}
+	comment := ""
+	if len(m.Params) >= 3 {
+		comment = m.Params[2]
+	}
+	if len(comment) > u.Catbox.Config.MaxKickLength {
+		comment = comment[:u.Catbox.Config.MaxKickLength]
+	}
 
-func (u *LocalUser) linksCommand(m irc.Message) {
-	// Difference from RFC: No parameters respected.
+	for _, nick := range strings.Split(m.Params[1], ",") {
+		targetUID, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{nick, "No such nick/channel"})
+			continue
+		}
+		targetUser := u.Catbox.Users[targetUID]
 
-	// Ourself.
-	// 364 RPL_LINKS
-	// <mask> <server> :<hopcount> <server info>
-	u.messageFromServer("364", []string{
-		u.Catbox.Config.ServerName,
-		u.Catbox.Config.ServerName,
-		fmt.Sprintf("%d %s", 0, u.Catbox.Config.ServerInfo),
-	})
+		if !targetUser.onChannel(channel) {
+			// 441 ERR_USERNOTINCHANNEL
+			u.messageFromServer("441", []string{targetUser.DisplayNick, channel.Name,
+				"They aren't on that channel"})
+			continue
+		}
 
-	for _, s := range u.Catbox.Servers {
-		// 364 RPL_LINKS
-		// <mask> <server> :<hopcount> <server info>
-		u.messageFromServer("364", []string{
-			"*",
-			s.Name,
-			fmt.Sprintf("%d %s", s.HopCount, s.Description),
+		// Like ratbox, the comment defaults to the target's nick.
+		reason := comment
+		if len(reason) == 0 {
+			reason = targetUser.DisplayNick
+		}
+
+		// Tell local members, including the user and the target.
+		u.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+			Prefix:  u.User.nickUhost(),
+			Command: "KICK",
+			Params:  []string{channel.Name, targetUser.DisplayNick, reason},
 		})
-	}
 
-	// 365 RPL_ENDOFLINKS
-	// <mask> :End of LINKS list
-	u.messageFromServer("365", []string{"*", "End of LINKS list"})
+		// Like PART, KICK propagates globally.
+		for _, server := range u.Catbox.channelServers(channel) {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.User.UID),
+				Command: "KICK",
+				Params:  []string{channel.Name, string(targetUser.UID), reason},
+			})
+		}
+
+		u.Catbox.logModeration(channel, u.User.nickUhost(),
+			fmt.Sprintf("KICK %s %s", targetUser.DisplayNick, reason))
+
+		channel.removeUser(targetUser)
+
+		if len(channel.Members) == 0 {
+			delete(u.Catbox.Channels, channel.Name)
+			return
+		}
+	}
 }
 
-// WALLOPS command causes us to send the text to all local operators as a
-// WALLOPS command. We also send it on to each remote server so it can do the
-// same and show its operators.
-func (u *LocalUser) wallopsCommand(m irc.Message) {
-	// Params: <text>
-	if len(m.Params) == 0 {
+// REMOVE forces users to part a channel. It is like KICK, but as the users
+// part rather than get kicked, clients that rejoin when kicked don't.
+//
+// This is from ratbox.
+func (u *LocalUser) removeCommand(m irc.Message) {
+	// Params: <channel> <user> *( "," <user> ) [<comment>]
+	if len(m.Params) < 2 {
 		// 461 ERR_NEEDMOREPARAMS
-		u.messageFromServer("461", []string{"WALLOPS", "Not enough parameters"})
+		u.messageFromServer("461", []string{"REMOVE", "Not enough parameters"})
 		return
 	}
 
-	if !u.User.isOperator() {
-		// 481 ERR_NOPRIVILEGES
-		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
-		return
-	}
+	channelName := canonicalizeChannel(m.Params[0])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[0], "No such channel"})
+		return
+	}
 
-	text := m.Params[0]
+	if !u.User.onChannel(channel) {
+		// 442 ERR_NOTONCHANNEL
+		u.messageFromServer("442", []string{channel.Name,
+			"You're not on that channel"})
+		return
+	}
 
-	for _, user := range u.Catbox.Opers {
-		if !user.isLocal() {
+	if !channel.userHasOps(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
+
+	comment := u.User.DisplayNick
+	if len(m.Params) >= 3 && len(m.Params[2]) > 0 {
+		comment = m.Params[2]
+	}
+	if len(comment) > u.Catbox.Config.MaxKickLength {
+		comment = comment[:u.Catbox.Config.MaxKickLength]
+	}
+	partMessage := fmt.Sprintf("requested by %s (%s)", u.User.DisplayNick,
+		comment)
+
+	for _, nick := range strings.Split(m.Params[1], ",") {
+		targetUID, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{nick, "No such nick/channel"})
 			continue
 		}
-		user.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  user.nickUhost(),
-			Command: "WALLOPS",
-			Params:  []string{text},
+		targetUser := u.Catbox.Users[targetUID]
+
+		if !targetUser.onChannel(channel) {
+			// 441 ERR_USERNOTINCHANNEL
+			u.messageFromServer("441", []string{targetUser.DisplayNick, channel.Name,
+				"They aren't on that channel"})
+			continue
+		}
+
+		// Tell local members, including the user and the target.
+		u.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+			Prefix:  targetUser.nickUhost(),
+			Command: "PART",
+			Params:  []string{channel.Name, partMessage},
 		})
+
+		// Servers hear about it as a PART from the target. This way every server
+		// understands it, even those that don't know REMOVE. The exception is
+		// the direction of a remote target. A PART from them coming from us would
+		// be from the wrong direction there, so that way it is a KICK from the
+		// user.
+		for _, server := range u.Catbox.channelServers(channel) {
+			if targetUser.isRemote() && server == targetUser.ClosestServer {
+				server.maybeQueueMessage(irc.Message{
+					Prefix:  string(u.User.UID),
+					Command: "KICK",
+					Params: []string{channel.Name, string(targetUser.UID),
+						partMessage},
+				})
+				continue
+			}
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(targetUser.UID),
+				Command: "PART",
+				Params:  []string{channel.Name, partMessage},
+			})
+		}
+
+		u.Catbox.logModeration(channel, u.User.nickUhost(),
+			fmt.Sprintf("REMOVE %s %s", targetUser.DisplayNick, comment))
+
+		channel.removeUser(targetUser)
+
+		if len(channel.Members) == 0 {
+			delete(u.Catbox.Channels, channel.Name)
+			return
+		}
 	}
+}
+
+// Initiate a connection to a server.
+//
+// I implement CONNECT differently than RFC 2812. Only a single parameter.
+func (u *LocalUser) connectCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	// CONNECT <server name> [port [remote server]]
+	//
+	// Port 0 means the port in the servers config. If there is a remote server,
+	// it makes the connection rather than us.
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	serverName := m.Params[0]
+
+	port := 0
+	if len(m.Params) >= 2 {
+		p, err := strconv.Atoi(m.Params[1])
+		if err != nil || p < 0 || p > 65535 {
+			u.serverNotice(fmt.Sprintf("Invalid port: %s", m.Params[1]))
+			return
+		}
+		port = p
+	}
+
+	if len(m.Params) >= 3 && m.Params[2] != u.Catbox.Config.ServerName {
+		remoteServer := u.Catbox.getServerByName(m.Params[2])
+		if remoteServer == nil {
+			// 402 ERR_NOSUCHSERVER
+			u.messageFromServer("402", []string{m.Params[2], "No such server"})
+			return
+		}
+
+		remoteServer.route().maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "CONNECT",
+			Params: []string{serverName, strconv.Itoa(port),
+				string(remoteServer.SID)},
+		})
+		return
+	}
+
+	u.Catbox.connect(u.User, serverName, port)
+}
+
+// AUTOCONN turns autoconnect to a server on or off until we restart. With no
+// parameters it shows each server's autoconnect settings.
+//
+// Parameters: [<server name> <ON|OFF>]
+func (u *LocalUser) autoconnCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if len(m.Params) == 0 {
+		for _, line := range u.Catbox.autoconnStatus() {
+			u.serverNotice(line)
+		}
+		u.serverNotice("End of AUTOCONN")
+		return
+	}
+
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	linkInfo, exists := u.Catbox.Config.Servers[m.Params[0]]
+	if !exists || linkInfo.Name == u.Catbox.Config.ServerName ||
+		linkInfo.Services {
+		// 402 ERR_NOSUCHSERVER
+		u.messageFromServer("402", []string{m.Params[0], "No such server"})
+		return
+	}
+
+	setting := strings.ToUpper(m.Params[1])
+	if setting != "ON" && setting != "OFF" {
+		u.serverNotice(fmt.Sprintf("Invalid setting: %s. Use ON or OFF.",
+			m.Params[1]))
+		return
+	}
+
+	autoConnect := setting == "ON"
+	state := u.Catbox.linkState(linkInfo.Name)
+	state.AutoConnect = &autoConnect
+
+	// Try soon if they turned it on.
+	if autoConnect {
+		state.Failures = 0
+		state.NextAttempt = time.Time{}
+	}
+
+	u.Catbox.noticeOpers(fmt.Sprintf("%s turned autoconnect to %s %s",
+		u.User.DisplayNick, linkInfo.Name, strings.ToLower(setting)))
+}
+
+func (u *LocalUser) linksCommand(m irc.Message) {
+	// Difference from RFC: No parameters respected.
+
+	// If we hide servers from the user, they don't see server descriptions.
+	hide := u.Catbox.hidesServers(u.User)
+	_, hiddenInfo := u.Catbox.hiddenServer()
+
+	// Ourself.
+	info := u.Catbox.Config.ServerInfo
+	if hide {
+		info = hiddenInfo
+	}
+	// 364 RPL_LINKS
+	// <mask> <server> :<hopcount> <server info>
+	u.messageFromServer("364", []string{
+		u.Catbox.Config.ServerName,
+		u.Catbox.Config.ServerName,
+		fmt.Sprintf("%d %s", 0, info),
+	})
+
+	// With flatten-links, users who aren't operators see every server as linked
+	// to us.
+	flatten := u.flattensLinks()
+
+	for _, s := range u.Catbox.Servers {
+		hopCount := s.HopCount
+		if flatten {
+			hopCount = 1
+		}
+		info := s.Description
+		if hide {
+			info = hiddenInfo
+		}
+		// 364 RPL_LINKS
+		// <mask> <server> :<hopcount> <server info>
+		u.messageFromServer("364", []string{
+			"*",
+			s.Name,
+			fmt.Sprintf("%d %s", hopCount, info),
+		})
+	}
+
+	// 365 RPL_ENDOFLINKS
+	// <mask> :End of LINKS list
+	u.messageFromServer("365", []string{"*", "End of LINKS list"})
+}
+
+// flattensLinks tells whether LINKS and MAP show the user every server as
+// linked to us. See flatten-links.
+func (u *LocalUser) flattensLinks() bool {
+	return u.Catbox.Config.FlattenLinks && !u.User.isOperator()
+}
+
+// GLOBOPS command sends a notice to all operators on the network. Unlike
+// WALLOPS, users who are +w do not see it.
+func (u *LocalUser) globopsCommand(m irc.Message) {
+	// Params: <text>
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"GLOBOPS", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	text := m.Params[0]
+
+	u.Catbox.globopsLocalOpers(u.User.DisplayNick, text)
 
 	for _, server := range u.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
-			Command: "WALLOPS",
+			Command: "ENCAP",
+			Params:  []string{"*", "GLOBOPS", text},
+		})
+	}
+}
+
+// WALLOPS command causes us to send the text to all local operators as a
+// WALLOPS command. We also send it on to each remote server so it can do the
+// same and show its operators.
+// WALLOPS goes to all users who are +w. OPERWALL goes only to operators.
+// Either may only come from operators.
+func (u *LocalUser) wallopsCommand(m irc.Message) {
+	// Params: <text>
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	text := m.Params[0]
+
+	u.Catbox.wallopsLocalUsers(u.User.nickUhost(), text, m.Command == "OPERWALL")
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: m.Command,
 			Params:  []string{text},
 		})
 	}
@@ -1844,7 +3479,9 @@ func (u *LocalUser) killCommand(m irc.Message) {
 //
 // Propagate it to all servers.
 //
-// At this time we support only permanent (locally anyway) klines.
+// A K-Line with a duration (in minutes) is temporary. We set it network wide
+// with BAN so it expires everywhere. See PropagatedBan. Other K-Lines are
+// permanent.
 func (u *LocalUser) klineCommand(m irc.Message) {
 	// Parameters: [duration] <user@host> <reason>
 	if len(m.Params) < 2 {
@@ -1865,7 +3502,7 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 
 	match, err := regexp.MatchString("^[0-9]+$", m.Params[0])
 	if err != nil {
-		log.Fatalf("KLine duration regex: %s", err)
+		coreLog.Fatalf("KLine duration regex: %s", err)
 	}
 	if match {
 		duration = m.Params[0]
@@ -1900,32 +3537,16 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 	userMask := pieces[0]
 	hostMask := pieces[1]
 
-	kline := KLine{
-		UserMask: userMask,
-		HostMask: hostMask,
-		Reason:   reason,
-	}
-
-	// Propagate.
-	// In TS6 this must be in ENCAP.
-	// Do this before applying K-Line locally for the hopefully rare scenario
-	// that the user K-Lines himself.
-	for _, server := range u.Catbox.LocalServers {
-		server.maybeQueueMessage(irc.Message{
-			Prefix:  string(u.User.UID),
-			Command: "ENCAP",
-			Params: []string{
-				"*",
-				"KLINE",
-				duration,
-				userMask,
-				hostMask,
-				reason,
-			},
-		})
+	minutes, err := strconv.ParseInt(duration, 10, 64)
+	if err != nil {
+		// 415 ERR_BADMASK
+		u.messageFromServer("415", []string{duration, "Bad duration"})
+		return
 	}
 
-	u.Catbox.addAndApplyKLine(kline, u.User.DisplayNick, reason)
+	u.Catbox.kline(string(u.User.UID), u.User.DisplayNick,
+		fmt.Sprintf("%s{%s}", u.User.nickUhost(), u.Catbox.Config.ServerName),
+		minutes, userMask, hostMask, reason)
 }
 
 func (u *LocalUser) unklineCommand(m irc.Message) {
@@ -1948,24 +3569,9 @@ func (u *LocalUser) unklineCommand(m irc.Message) {
 		u.messageFromServer("415", []string{m.Params[0], "Bad Server/host mask"})
 		return
 	}
-	userMask := pieces[0]
-	hostMask := pieces[1]
-
-	u.Catbox.removeKLine(userMask, hostMask, u.User.DisplayNick)
-
-	// Propagate.
-	for _, server := range u.Catbox.LocalServers {
-		server.maybeQueueMessage(irc.Message{
-			Prefix:  string(u.User.UID),
-			Command: "ENCAP",
-			Params: []string{
-				"*",
-				"UNKLINE",
-				userMask,
-				hostMask,
-			},
-		})
-	}
+	u.Catbox.unkline(string(u.User.UID), u.User.DisplayNick,
+		fmt.Sprintf("%s{%s}", u.User.nickUhost(), u.Catbox.Config.ServerName),
+		pieces[0], pieces[1])
 }
 
 // I support the following queries right now:
@@ -1979,7 +3585,7 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 	}
 
 	query := m.Params[0]
-	if query != "k" && query != "K" {
+	if query != "k" && query != "K" && query != "n" && query != "l" {
 		u.messageFromServer("NOTICE", []string{"Unknown stats query"})
 		return
 	}
@@ -1990,6 +3596,20 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 		return
 	}
 
+	if query == "n" {
+		u.statsNetworkQuery()
+		return
+	}
+
+	if query == "l" {
+		nick := ""
+		if len(m.Params) > 1 {
+			nick = m.Params[1]
+		}
+		u.statsLinksQuery(nick)
+		return
+	}
+
 	// We could sort the KLines.
 
 	for _, kline := range u.Catbox.KLines {
@@ -2013,6 +3633,76 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 	u.messageFromServer("219", []string{"K", "End of /STATS report"})
 }
 
+// STATS n shows network statistics for recent days, most recent first. This
+// is not standard.
+func (u *LocalUser) statsNetworkQuery() {
+	// Make sure today is in there even if nothing has happened yet.
+	u.Catbox.statsToday()
+
+	days := u.Catbox.Stats.Days
+	for i := len(days) - 1; i >= 0 && i >= len(days)-statsDaysShown; i-- {
+		// 249 RPL_STATSDEBUG
+		u.messageFromServer("249", []string{"n", days[i].String()})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"n", "End of /STATS report"})
+}
+
+// STATS l shows our server links: how many messages we have queued to send
+// each (their send queue), the most we'll queue, and how long they've been
+// connected. With a nick, it shows that local user instead.
+//
+// ratbox's reply also counts messages and bytes sent and received. We don't
+// track those.
+func (u *LocalUser) statsLinksQuery(nick string) {
+	if nick != "" {
+		uid, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if exists && u.Catbox.Users[uid].isLocal() {
+			user := u.Catbox.Users[uid]
+			host := user.Hostname
+			if !u.User.seesRealHosts() && user != u.User {
+				host = user.DisplayHost
+			}
+			u.statsLink(fmt.Sprintf("%s[%s@%s]", user.DisplayNick, user.Username,
+				host), user.LocalUser.LocalClient)
+		}
+		// 219 RPL_ENDOFSTATS
+		u.messageFromServer("219", []string{"l", "End of /STATS report"})
+		return
+	}
+
+	var servers []*LocalServer
+	for _, server := range u.Catbox.LocalServers {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Server.Name < servers[j].Server.Name
+	})
+
+	for _, server := range servers {
+		u.statsLink(server.Server.Name, server.LocalClient)
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"l", "End of /STATS report"})
+}
+
+func (u *LocalUser) statsLink(name string, c *LocalClient) {
+	limit := c.SendQueueLimit
+	if limit == 0 {
+		limit = cap(c.WriteChan)
+	}
+
+	// 211 RPL_STATSLINKINFO
+	u.messageFromServer("211", []string{
+		name,
+		fmt.Sprintf("%d", len(c.WriteChan)),
+		fmt.Sprintf("%d", limit),
+		fmt.Sprintf("%d", int64(time.Since(c.ConnectionStartTime).Seconds())),
+	})
+}
+
 // Reload config.
 // No parameters.
 func (u *LocalUser) rehashCommand(m irc.Message) {
@@ -2025,6 +3715,207 @@ func (u *LocalUser) rehashCommand(m irc.Message) {
 	u.Catbox.rehash(u.User)
 }
 
+// RESYNC is a non standard command. It checks our state for problems
+// (desyncs) and reports them. If told to, it repairs them as well as it can.
+//
+// Parameters: [REPAIR]
+func (u *LocalUser) resyncCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	repair := len(m.Params) > 0 && strings.ToUpper(m.Params[0]) == "REPAIR"
+
+	problems := u.Catbox.checkConsistency()
+	if len(problems) == 0 {
+		u.serverNotice("No problems found.")
+		return
+	}
+
+	for _, problem := range problems {
+		u.serverNotice(problem.Description)
+		if repair {
+			problem.Repair()
+		}
+	}
+
+	if !repair {
+		u.serverNotice(fmt.Sprintf(
+			"Found %d problem(s). Use RESYNC REPAIR to repair them.",
+			len(problems)))
+		return
+	}
+
+	u.Catbox.noticeOpers(fmt.Sprintf("%s repaired %d problem(s).",
+		u.User.DisplayNick, len(problems)))
+}
+
+// LOGLEVEL is a non standard command. It shows or changes how much we log.
+// Without parameters it shows each subsystem's level. With only a level it
+// changes all subsystems.
+//
+// The levels last until the next rehash, which sets them from the config.
+//
+// Parameters: [<subsystem>] [<level>]
+func (u *LocalUser) loglevelCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if len(m.Params) == 0 {
+		u.serverNotice(fmt.Sprintf("Log levels: %s", describeLogLevels()))
+		return
+	}
+
+	subsystems := logSubsystems
+	levelName := m.Params[0]
+	if len(m.Params) > 1 {
+		subsystems = nil
+		for _, subsystem := range logSubsystems {
+			if subsystem == strings.ToLower(m.Params[0]) {
+				subsystems = []string{subsystem}
+			}
+		}
+		if subsystems == nil {
+			u.serverNotice(fmt.Sprintf("Unknown log subsystem: %s. Subsystems: %s",
+				m.Params[0], strings.Join(logSubsystems, ", ")))
+			return
+		}
+		levelName = m.Params[1]
+	}
+
+	level, err := parseLogLevel(levelName)
+	if err != nil {
+		u.serverNotice(fmt.Sprintf("Unknown log level: %s. Levels: %s", levelName,
+			strings.Join(logLevelNames, ", ")))
+		return
+	}
+
+	for _, subsystem := range subsystems {
+		setLogLevel(subsystem, level)
+	}
+
+	u.Catbox.noticeOpers(fmt.Sprintf("%s set the log level of %s to %s.",
+		u.User.DisplayNick, strings.Join(subsystems, ", "), level))
+}
+
+// INVITELIST is a non standard command. It shows a channel's pending invites:
+// who was invited, by whom, and when. Only channel operators and IRC operators
+// may see it.
+//
+// The channel's invite exceptions (+I) are available with MODE +I.
+//
+// Parameters: <channel>
+func (u *LocalUser) invitelistCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"INVITELIST", "Not enough parameters"})
+		return
+	}
+
+	channel, exists := u.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[0], "No such channel"})
+		return
+	}
+
+	if !channel.userHasOps(u.User) && !u.User.isOperator() {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
+
+	var invitees []*User
+	for uid := range channel.Invites {
+		invitee, exists := u.Catbox.Users[uid]
+		if !exists {
+			// They're gone. Forget the invite.
+			delete(channel.Invites, uid)
+			continue
+		}
+		invitees = append(invitees, invitee)
+	}
+
+	// Show the oldest invites first.
+	sort.Slice(invitees, func(i, j int) bool {
+		a := channel.Invites[invitees[i].UID]
+		b := channel.Invites[invitees[j].UID]
+		if a.TS != b.TS {
+			return a.TS < b.TS
+		}
+		return invitees[i].DisplayNick < invitees[j].DisplayNick
+	})
+
+	for _, invitee := range invitees {
+		invite := channel.Invites[invitee.UID]
+
+		// 336 RPL_INVITELIST. Non standard.
+		u.messageFromServer("336", []string{
+			channel.Name,
+			invitee.DisplayNick,
+			invite.Inviter,
+			fmt.Sprintf("%d", invite.TS),
+		})
+	}
+
+	// 337 RPL_ENDOFINVITELIST. Non standard.
+	u.messageFromServer("337", []string{channel.Name, "End of invite list"})
+}
+
+// MODLOG is a non standard command. It shows a channel's moderation log: who
+// changed its modes and topic, and when. Only channel operators and IRC
+// operators may see it.
+//
+// Parameters: <channel> [count]
+// count limits the output to the most recent entries.
+func (u *LocalUser) modlogCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"MODLOG", "Not enough parameters"})
+		return
+	}
+
+	channel, exists := u.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[0], "No such channel"})
+		return
+	}
+
+	if !channel.userHasOps(u.User) && !u.User.isOperator() {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
+
+	entries := channel.ModLog
+	if len(m.Params) > 1 {
+		count, err := strconv.Atoi(m.Params[1])
+		if err != nil || count <= 0 {
+			u.serverNotice("Invalid count.")
+			return
+		}
+		if count < len(entries) {
+			entries = entries[len(entries)-count:]
+		}
+	}
+
+	for _, entry := range entries {
+		u.serverNotice(fmt.Sprintf("%s: [%s] %s: %s", channel.Name,
+			time.Unix(entry.TS, 0).UTC().Format(time.RFC3339), entry.Source,
+			entry.Action))
+	}
+
+	u.serverNotice(fmt.Sprintf("%s: End of moderation log", channel.Name))
+}
+
 // Map is a non standard command. It shows linked servers, and in an ASCII way,
 // which is linked to which. Like a server map. We also show the server SIDs
 // and how many users (and what % of the global count) each has.
@@ -2051,17 +3942,33 @@ func (u *LocalUser) mapCommand(m irc.Message) {
 	lines = append(lines, serverToMapLine(u.Catbox.Config.ServerName,
 		u.Catbox.Config.TS6SID, len(u.Catbox.LocalUsers), globalUserCount, 0))
 
-	for _, ls := range u.Catbox.LocalServers {
-		// The local server.
-		lines = append(lines, serverToMapLine(ls.Server.Name, ls.Server.SID,
-			ls.Server.getLocalUserCount(u.Catbox.Users), globalUserCount,
-			ls.Server.HopCount))
-
-		// And all servers it is linked to.
-		linkedServers := ls.Server.getLinkedServers(u.Catbox.Servers)
-		for _, s := range linkedServers {
+	// With flatten-links, every server looks like it links to us. We list them
+	// by name so their order doesn't give away their uplinks.
+	if u.flattensLinks() {
+		servers := []*Server{}
+		for _, s := range u.Catbox.Servers {
+			servers = append(servers, s)
+		}
+		sort.Slice(servers, func(i, j int) bool {
+			return servers[i].Name < servers[j].Name
+		})
+		for _, s := range servers {
 			lines = append(lines, serverToMapLine(s.Name, s.SID,
-				s.getLocalUserCount(u.Catbox.Users), globalUserCount, s.HopCount))
+				s.getLocalUserCount(u.Catbox.Users), globalUserCount, 1))
+		}
+	} else {
+		for _, ls := range u.Catbox.LocalServers {
+			// The local server.
+			lines = append(lines, serverToMapLine(ls.Server.Name, ls.Server.SID,
+				ls.Server.getLocalUserCount(u.Catbox.Users), globalUserCount,
+				ls.Server.HopCount))
+
+			// And all servers it is linked to.
+			linkedServers := ls.Server.getLinkedServers(u.Catbox.Servers)
+			for _, s := range linkedServers {
+				lines = append(lines, serverToMapLine(s.Name, s.SID,
+					s.getLocalUserCount(u.Catbox.Users), globalUserCount, s.HopCount))
+			}
 		}
 	}
 
@@ -2150,6 +4057,154 @@ func (u *LocalUser) whowasCommand(m irc.Message) {
 	})
 }
 
+// ISON tells which of the given nicks are on the network. Clients use it to
+// poll for nicks in their notify lists.
+//
+// Parameters: <nick> *( " " <nick> )
+//
+// Clients may put the nicks in separate parameters or all in one.
+func (u *LocalUser) isonCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"ISON", "Not enough parameters"})
+		return
+	}
+
+	// 303 RPL_ISON
+	reply := irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: "303",
+		Params:  []string{u.User.DisplayNick, ""},
+	}
+
+	buf, err := reply.Encode()
+	if err != nil {
+		clientsLog.Errorf("Unable to generate RPL_ISON: %s", err)
+		return
+	}
+	baseSize := len(buf)
+
+	nicks := ""
+	for _, param := range m.Params {
+		for _, nick := range strings.Fields(param) {
+			uid, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+			if !exists {
+				continue
+			}
+			displayNick := u.Catbox.Users[uid].DisplayNick
+
+			// We leave out nicks that don't fit.
+			if baseSize+len(nicks)+1+len(displayNick) > irc.MaxLineLength {
+				continue
+			}
+
+			if nicks != "" {
+				nicks += " "
+			}
+			nicks += displayNick
+		}
+	}
+
+	reply.Params[1] = nicks
+	u.maybeQueueMessage(reply)
+}
+
+// ACCEPT manages the users who may send private messages to the user while
+// they are +g (caller ID).
+//
+// Parameters: <nick>[,-<nick>...] or *
+//
+// * lists the users. -nick removes a user.
+func (u *LocalUser) acceptCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"ACCEPT", "Not enough parameters"})
+		return
+	}
+
+	if m.Params[0] == "*" {
+		u.listAccepts()
+		return
+	}
+
+	for _, nick := range strings.Split(m.Params[0], ",") {
+		remove := false
+		if strings.HasPrefix(nick, "-") {
+			remove = true
+			nick = nick[1:]
+		}
+		if nick == "" {
+			continue
+		}
+
+		uid, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{nick, "No such nick/channel"})
+			continue
+		}
+		user := u.Catbox.Users[uid]
+
+		_, accepted := u.Accepts[uid]
+
+		if remove {
+			if !accepted {
+				// 458 ERR_ACCEPTNOT
+				u.messageFromServer("458", []string{user.DisplayNick,
+					"is not on your accept list"})
+				continue
+			}
+			delete(u.Accepts, uid)
+			continue
+		}
+
+		if accepted {
+			// 457 ERR_ACCEPTEXIST
+			u.messageFromServer("457", []string{user.DisplayNick,
+				"is already on your accept list"})
+			continue
+		}
+
+		if len(u.Accepts) >= maxAccepts {
+			// 456 ERR_ACCEPTFULL
+			u.messageFromServer("456", []string{"Accept list is full"})
+			return
+		}
+
+		u.Accepts[uid] = struct{}{}
+	}
+}
+
+// listAccepts sends the user their accept list.
+func (u *LocalUser) listAccepts() {
+	var nicks []string
+	for uid := range u.Accepts {
+		user, exists := u.Catbox.Users[uid]
+		if !exists {
+			// They left the network.
+			delete(u.Accepts, uid)
+			continue
+		}
+		nicks = append(nicks, user.DisplayNick)
+	}
+	sort.Strings(nicks)
+
+	for _, nick := range nicks {
+		// 281 RPL_ACCEPTLIST
+		u.messageFromServer("281", []string{nick})
+	}
+
+	// 282 RPL_ENDOFACCEPT
+	u.messageFromServer("282", []string{"End of /ACCEPT list."})
+}
+
+// accepts tells whether the user accepts private messages from the other user
+// despite being +g (caller ID).
+func (u *LocalUser) accepts(other *User) bool {
+	_, exists := u.Accepts[other.UID]
+	return exists
+}
+
 // Set yourself away by including a message.
 // Set yourself not away by not including a message, or having a blank message.
 // Parameters: [message]
@@ -2159,7 +4214,44 @@ func (u *LocalUser) awayCommand(m irc.Message) {
 		return
 	}
 
-	u.setAway(m.Params[0])
+	message := m.Params[0]
+	if len(message) > u.Catbox.Config.MaxAwayLength {
+		message = message[:u.Catbox.Config.MaxAwayLength]
+	}
+
+	u.setAway(message)
+}
+
+// SETNAME changes the user's real name (IRCv3 setname).
+//
+// Parameters: <real name>
+func (u *LocalUser) setnameCommand(m irc.Message) {
+	if len(m.Params) == 0 || len(m.Params[0]) == 0 {
+		u.messageFromServer("FAIL", []string{"SETNAME", "INVALID_REALNAME",
+			"Real name is not valid"})
+		return
+	}
+
+	realName := m.Params[0]
+	if !isValidRealName(realName) {
+		u.messageFromServer("FAIL", []string{"SETNAME", "INVALID_REALNAME",
+			"Real name is not valid"})
+		return
+	}
+
+	if realName == u.User.RealName {
+		return
+	}
+	u.User.RealName = realName
+	u.Catbox.notifyRealNameChange(u.User)
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params:  []string{"*", "SETNAME", realName},
+		})
+	}
 }
 
 // Invite a user to a channel.
@@ -2217,6 +4309,15 @@ func (u *LocalUser) inviteCommand(m irc.Message) {
 		return
 	}
 
+	// Users on other servers can't join our local channels. Like ratbox, we say
+	// they aren't on it.
+	if channel.isLocal() && !targetUser.isLocal() {
+		// 441 ERR_USERNOTINCHANNEL
+		u.messageFromServer("441", []string{targetUser.DisplayNick, channel.Name,
+			"They aren't on that channel"})
+		return
+	}
+
 	// We may try to invite.
 
 	// They must have ops to do this.
@@ -2227,6 +4328,9 @@ func (u *LocalUser) inviteCommand(m irc.Message) {
 		return
 	}
 
+	channel.addInvite(targetUser, u.User)
+	u.Catbox.notifyInvite(channel, u.User, targetUser)
+
 	// Send an invite message.
 	if targetUser.isLocal() {
 		targetUser.LocalUser.maybeQueueMessage(irc.Message{
@@ -2310,7 +4414,7 @@ func (u *LocalUser) opmeCommand(m irc.Message) {
 	}
 
 	// Propagate to servers.
-	for _, ls := range u.Catbox.LocalServers {
+	for _, ls := range u.Catbox.channelServers(channel) {
 		ls.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.Catbox.Config.TS6SID),
 			Command: "TMODE",
@@ -2347,29 +4451,261 @@ func (u *LocalUser) squitCommand(m irc.Message) {
 		return
 	}
 
-	var server *Server
-	for _, s := range u.Catbox.Servers {
-		if s.Name == serverName {
-			server = s
-			break
-		}
-	}
-
+	server := u.Catbox.getServerByName(serverName)
 	if server == nil {
 		// 402 ERR_NOSUCHSERVER
 		u.messageFromServer("402", []string{serverName, "No such server"})
 		return
 	}
 
-	if server.isLocal() {
-		server.LocalServer.quit(fmt.Sprintf("%s issued SQUIT: %s",
-			u.User.DisplayNick, reason))
+	u.Catbox.squit(server, string(u.User.UID), u.User.DisplayNick, reason)
+}
+
+// displayHost decides the host the user should show given their real
+// hostname: their vhost if they have one, else a cloak if they are +x.
+func (u *LocalUser) displayHost(hostname string) string {
+	if u.Vhost != "" {
+		return u.Vhost
+	}
+	if _, exists := u.User.Modes['x']; exists {
+		return cloakHost(u.Catbox.Config.CloakKey, hostname)
+	}
+	return hostname
+}
+
+// sendHostHidden tells the user the host they show.
+func (u *LocalUser) sendHostHidden() {
+	// 396 RPL_HOSTHIDDEN
+	if u.User.DisplayHost == u.User.Hostname {
+		u.messageFromServer("396", []string{u.User.DisplayHost,
+			"is now your displayed host"})
+		return
+	}
+	u.messageFromServer("396", []string{u.User.DisplayHost,
+		"is now your hidden host"})
+}
+
+// chghostCommand lets an operator give a user a vhost.
+//
+// Parameters: <nick> <host>
+func (u *LocalUser) chghostCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"CHGHOST", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	targetUID, exists := u.Catbox.Nicks[canonicalizeNick(m.Params[0])]
+	if !exists {
+		// 401 ERR_NOSUCHNICK
+		u.messageFromServer("401", []string{m.Params[0], "No such nick/channel"})
+		return
+	}
+	targetUser := u.Catbox.Users[targetUID]
+
+	vhost := m.Params[1]
+	if !isValidVhost(vhost) {
+		u.serverNotice(fmt.Sprintf("Invalid hostname: %s", vhost))
+		return
+	}
+
+	// Their server remembers the vhost when it hears the CHGHOST.
+	if targetUser.isLocal() {
+		targetUser.LocalUser.Vhost = vhost
+	}
+
+	u.Catbox.noticeOpers(fmt.Sprintf("%s changed the host of %s to %s",
+		u.User.DisplayNick, targetUser.DisplayNick, vhost))
+
+	if targetUser.DisplayHost == vhost {
+		return
+	}
+	u.Catbox.setHost(targetUser, targetUser.Hostname, vhost)
+
+	if targetUser.isLocal() {
+		targetUser.LocalUser.sendHostHidden()
+	}
+}
+
+// sajoinCommand lets an operator make a user join a channel. The channel's
+// modes don't stop them.
+//
+// If the user is remote, we tell their server to do it with ENCAP SAJOIN.
+func (u *LocalUser) sajoinCommand(m irc.Message) {
+	// Parameters: <nick> <channel>
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"SAJOIN", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	targetUID, exists := u.Catbox.Nicks[canonicalizeNick(m.Params[0])]
+	if !exists {
+		// 401 ERR_NOSUCHNICK
+		u.messageFromServer("401", []string{m.Params[0], "No such nick/channel"})
+		return
+	}
+	targetUser := u.Catbox.Users[targetUID]
+
+	channelName := canonicalizeChannel(m.Params[1])
+	if !isValidChannel(channelName) {
+		// 403 ERR_NOSUCHCHANNEL. Used to indicate channel name is invalid.
+		u.messageFromServer("403", []string{m.Params[1], "Invalid channel name"})
+		return
+	}
+
+	if targetUser.onChannel(&Channel{Name: channelName}) {
+		// 443 ERR_USERONCHANNEL
+		u.messageFromServer("443", []string{targetUser.DisplayNick, channelName,
+			"is already on channel"})
+		return
+	}
+
+	u.Catbox.noticeOpers(fmt.Sprintf("%s used SAJOIN to make %s join %s",
+		u.User.DisplayNick, targetUser.DisplayNick, channelName))
+
+	if targetUser.isLocal() {
+		targetUser.LocalUser.join(channelName, "", true)
+		return
+	}
+
+	targetUser.ClosestServer.maybeQueueMessage(irc.Message{
+		Prefix:  string(u.User.UID),
+		Command: "ENCAP",
+		Params: []string{targetUser.Server.Name, "SAJOIN", string(targetUser.UID),
+			channelName},
+	})
+}
+
+// sapartCommand lets an operator make a user part a channel.
+//
+// If the user is remote, we tell their server to do it with ENCAP SAPART.
+func (u *LocalUser) sapartCommand(m irc.Message) {
+	// Parameters: <nick> <channel> [reason]
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"SAPART", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	targetUID, exists := u.Catbox.Nicks[canonicalizeNick(m.Params[0])]
+	if !exists {
+		// 401 ERR_NOSUCHNICK
+		u.messageFromServer("401", []string{m.Params[0], "No such nick/channel"})
+		return
+	}
+	targetUser := u.Catbox.Users[targetUID]
+
+	channelName := canonicalizeChannel(m.Params[1])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[1], "No such channel"})
+		return
+	}
+
+	if !targetUser.onChannel(channel) {
+		// 441 ERR_USERNOTINCHANNEL
+		u.messageFromServer("441", []string{targetUser.DisplayNick, channel.Name,
+			"They aren't on that channel"})
+		return
+	}
+
+	reason := ""
+	if len(m.Params) >= 3 {
+		reason = m.Params[2]
+	}
+
+	u.Catbox.noticeOpers(fmt.Sprintf("%s used SAPART to make %s part %s",
+		u.User.DisplayNick, targetUser.DisplayNick, channel.Name))
+
+	if targetUser.isLocal() {
+		targetUser.LocalUser.part(channel.Name, reason)
+		return
+	}
+
+	params := []string{targetUser.Server.Name, "SAPART", string(targetUser.UID),
+		channel.Name}
+	if reason != "" {
+		params = append(params, reason)
+	}
+	targetUser.ClosestServer.maybeQueueMessage(irc.Message{
+		Prefix:  string(u.User.UID),
+		Command: "ENCAP",
+		Params:  params,
+	})
+}
+
+// samodeCommand lets an operator change a channel's modes without being a
+// channel operator, or change another user's modes.
+//
+// If the user is remote, we tell their server to do it with ENCAP SAMODE.
+// Channel mode changes go out as TMODE like any other.
+func (u *LocalUser) samodeCommand(m irc.Message) {
+	// Parameters: <channel|nick> <modes> [mode parameters]
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"SAMODE", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	target := m.Params[0]
+	modes := m.Params[1]
+
+	if channel, exists := u.Catbox.Channels[canonicalizeChannel(target)]; exists {
+		u.Catbox.noticeOpers(fmt.Sprintf("%s used SAMODE: %s %s",
+			u.User.DisplayNick, channel.Name, strings.Join(m.Params[1:], " ")))
+		u.changeChannelModes(channel, modes, m.Params[2:])
+		return
+	}
+
+	targetUID, exists := u.Catbox.Nicks[canonicalizeNick(target)]
+	if !exists {
+		// 401 ERR_NOSUCHNICK
+		u.messageFromServer("401", []string{target, "No such nick/channel"})
+		return
+	}
+	targetUser := u.Catbox.Users[targetUID]
+
+	u.Catbox.noticeOpers(fmt.Sprintf("%s used SAMODE: %s %s",
+		u.User.DisplayNick, targetUser.DisplayNick, modes))
+
+	if targetUser.isLocal() {
+		if !targetUser.LocalUser.changeUserModes(modes) {
+			// 501 ERR_UMODEUNKNOWNFLAG
+			u.messageFromServer("501", []string{"Unknown MODE flag"})
+		}
 		return
 	}
 
-	server.ClosestServer.maybeQueueMessage(irc.Message{
+	targetUser.ClosestServer.maybeQueueMessage(irc.Message{
 		Prefix:  string(u.User.UID),
-		Command: "SQUIT",
-		Params:  []string{string(server.SID), reason},
+		Command: "ENCAP",
+		Params: []string{targetUser.Server.Name, "SAMODE", string(targetUser.UID),
+			modes},
 	})
 }
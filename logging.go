@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is how important a log message is.
+type LogLevel int
+
+// The levels we log at, least important first.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel parses a level's name. e.g., info.
+func parseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LogInfo, fmt.Errorf("invalid log level: %s", s)
+}
+
+// logSubsystems are the parts of catbox with their own loggers. Each logs at
+// its own level.
+var logSubsystems = []string{"core", "clients", "s2s", "dns", "flood"}
+
+// Loggers for each subsystem. Like the standard log package's logger, these
+// are global so anything may log.
+var (
+	coreLog    = Logger{subsystem: "core"}
+	clientsLog = Logger{subsystem: "clients"}
+	s2sLog     = Logger{subsystem: "s2s"}
+	dnsLog     = Logger{subsystem: "dns"}
+	floodLog   = Logger{subsystem: "flood"}
+)
+
+// logCategories are kinds of events we may log to files of their own as well
+// as to our main log. Networks often must keep records of these.
+//
+// oper: Becoming an operator and what operators do.
+// kill: KILLs and K-Lines.
+// link: Servers linking and delinking.
+// connect: Clients we reject or that fail to connect.
+var logCategories = []string{"oper", "kill", "link", "connect"}
+
+// eventLogs holds the file for each category we log to its own file.
+var eventLogs = struct {
+	mutex sync.Mutex
+	sinks map[string]*logSink
+}{sinks: map[string]*logSink{}}
+
+// logEvent logs an event to its category's file, if it has one.
+//
+// Call this in addition to logging to a subsystem's logger. This is for
+// events we want a record of regardless of log levels.
+func logEvent(category, format string, args ...interface{}) {
+	eventLogs.mutex.Lock()
+	sink, exists := eventLogs.sinks[category]
+	eventLogs.mutex.Unlock()
+	if !exists {
+		return
+	}
+	sink.write(category, LogInfo, fmt.Sprintf(format, args...))
+}
+
+// Logger logs messages for a subsystem.
+type Logger struct {
+	subsystem string
+}
+
+// Debugf logs a message useful only when tracking down a problem.
+func (l Logger) Debugf(format string, args ...interface{}) {
+	logs.write(l.subsystem, LogDebug, fmt.Sprintf(format, args...))
+}
+
+// Infof logs a message about normal operation.
+func (l Logger) Infof(format string, args ...interface{}) {
+	logs.write(l.subsystem, LogInfo, fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a message about something unexpected we can carry on from.
+func (l Logger) Warnf(format string, args ...interface{}) {
+	logs.write(l.subsystem, LogWarn, fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a message about something failing.
+func (l Logger) Errorf(format string, args ...interface{}) {
+	logs.write(l.subsystem, LogError, fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs an error and exits.
+func (l Logger) Fatalf(format string, args ...interface{}) {
+	logs.write(l.subsystem, LogError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// logSink is where all loggers write. Any goroutine may log, so we guard it
+// with a mutex.
+type logSink struct {
+	mutex sync.Mutex
+
+	out io.Writer
+
+	// The file we log to, if any. We rotate it once we've written rotateSize
+	// bytes to it, keeping rotateCount old files. 0 means we don't rotate.
+	file        *os.File
+	size        int64
+	rotateSize  int64
+	rotateCount int
+
+	json bool
+
+	// Subsystem to the least important level we log for it.
+	levels map[string]LogLevel
+}
+
+var logs = &logSink{
+	out:    os.Stdout,
+	levels: defaultLogLevels(),
+}
+
+func defaultLogLevels() map[string]LogLevel {
+	levels := map[string]LogLevel{}
+	for _, subsystem := range logSubsystems {
+		levels[subsystem] = LogInfo
+	}
+	return levels
+}
+
+// parseLogLevels parses a level for all subsystems followed by levels for
+// particular ones. e.g., info s2s=debug.
+func parseLogLevels(s string) (map[string]LogLevel, error) {
+	levels := defaultLogLevels()
+	for i, field := range strings.Fields(s) {
+		pieces := strings.SplitN(field, "=", 2)
+		if len(pieces) == 1 {
+			if i != 0 {
+				return nil, fmt.Errorf("the level for all subsystems must be first: %s",
+					field)
+			}
+			level, err := parseLogLevel(field)
+			if err != nil {
+				return nil, err
+			}
+			for subsystem := range levels {
+				levels[subsystem] = level
+			}
+			continue
+		}
+
+		if _, exists := levels[pieces[0]]; !exists {
+			return nil, fmt.Errorf("unknown log subsystem: %s", pieces[0])
+		}
+		level, err := parseLogLevel(pieces[1])
+		if err != nil {
+			return nil, err
+		}
+		levels[pieces[0]] = level
+	}
+	return levels, nil
+}
+
+func (s *logSink) write(subsystem string, level LogLevel, msg string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if level < s.levels[subsystem] {
+		return
+	}
+
+	now := time.Now()
+	var line []byte
+	if s.json {
+		buf, err := json.Marshal(struct {
+			Time      string `json:"time"`
+			Level     string `json:"level"`
+			Subsystem string `json:"subsystem"`
+			Message   string `json:"message"`
+		}{now.Format(time.RFC3339Nano), level.String(), subsystem, msg})
+		if err != nil {
+			buf = []byte(fmt.Sprintf(`{"message":"unable to encode log: %s"}`, err))
+		}
+		line = append(buf, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s %s %s: %s\n", now.Format("2006/01/02 15:04:05"),
+			strings.ToUpper(level.String()), subsystem, msg))
+	}
+
+	if s.file != nil && s.rotateSize > 0 && s.size > 0 &&
+		s.size+int64(len(line)) > s.rotateSize {
+		if err := s.rotate(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Unable to rotate log file: %s\n", err)
+		}
+	}
+
+	n, err := s.out.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Unable to write log: %s\n", err)
+	}
+}
+
+// rotate moves the log file aside and starts a new one. The newest old file
+// is file.1. Call with the mutex held.
+func (s *logSink) rotate() error {
+	name := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	for i := s.rotateCount - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", name, i)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", name, i+1)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(name, name+".1"); err != nil {
+		return err
+	}
+
+	return s.openFile(name)
+}
+
+// openFile starts logging to a file. We append to it. Call with the mutex
+// held.
+func (s *logSink) openFile(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		// Keep logging somewhere.
+		s.file = nil
+		s.out = os.Stderr
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		s.file = nil
+		s.out = os.Stderr
+		return err
+	}
+
+	s.file = f
+	s.out = f
+	s.size = fi.Size()
+	return nil
+}
+
+// setLogFile starts logging to a file rather than stdout.
+func setLogFile(name string) error {
+	logs.mutex.Lock()
+	defer logs.mutex.Unlock()
+	return logs.openFile(name)
+}
+
+// reopenFile opens the sink's file again, if it has one.
+func (s *logSink) reopenFile() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	name := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	return s.openFile(name)
+}
+
+// reopenLogFiles opens our log files again. This lets tools like logrotate
+// move the files and have us start new ones.
+func reopenLogFiles() error {
+	if err := logs.reopenFile(); err != nil {
+		return err
+	}
+
+	eventLogs.mutex.Lock()
+	defer eventLogs.mutex.Unlock()
+
+	for _, sink := range eventLogs.sinks {
+		if err := sink.reopenFile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureLogging applies the logging options from the config.
+func configureLogging(c *Config) error {
+	logs.mutex.Lock()
+	logs.levels = map[string]LogLevel{}
+	for subsystem, level := range c.LogLevels {
+		logs.levels[subsystem] = level
+	}
+	logs.json = c.LogFormat == "json"
+	logs.rotateSize = c.LogRotateSize
+	logs.rotateCount = c.LogRotateCount
+	logs.mutex.Unlock()
+
+	return configureEventLogs(c)
+}
+
+// setLogLevel changes the level of one subsystem.
+func setLogLevel(subsystem string, level LogLevel) {
+	logs.mutex.Lock()
+	defer logs.mutex.Unlock()
+	logs.levels[subsystem] = level
+}
+
+// describeLogLevels lists each subsystem's level. e.g., clients=info
+// core=debug.
+func describeLogLevels() string {
+	logs.mutex.Lock()
+	defer logs.mutex.Unlock()
+
+	var levels []string
+	for subsystem, level := range logs.levels {
+		levels = append(levels, fmt.Sprintf("%s=%s", subsystem, level))
+	}
+	sort.Strings(levels)
+	return strings.Join(levels, " ")
+}
+
+// configureEventLogs opens the files for each category of event from the
+// config. We close the files of categories we no longer log.
+func configureEventLogs(c *Config) error {
+	eventLogs.mutex.Lock()
+	defer eventLogs.mutex.Unlock()
+
+	for category, sink := range eventLogs.sinks {
+		file := c.EventLogFiles[category]
+		if file != "" && sink.file != nil && sink.file.Name() == file {
+			continue
+		}
+		if sink.file != nil {
+			if err := sink.file.Close(); err != nil {
+				coreLog.Warnf("Error closing %s log file: %s", category, err)
+			}
+		}
+		delete(eventLogs.sinks, category)
+	}
+
+	var errors []string
+	for category, file := range c.EventLogFiles {
+		sink, exists := eventLogs.sinks[category]
+		if !exists {
+			sink = &logSink{levels: map[string]LogLevel{}}
+			if err := sink.openFile(file); err != nil {
+				errors = append(errors, fmt.Sprintf(
+					"unable to open %s log file: %s", category, err))
+				continue
+			}
+			eventLogs.sinks[category] = sink
+		}
+
+		sink.mutex.Lock()
+		sink.json = c.LogFormat == "json"
+		sink.rotateSize = c.LogRotateSize
+		sink.rotateCount = c.LogRotateCount
+		sink.mutex.Unlock()
+	}
+
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		return fmt.Errorf("%s", strings.Join(errors, ", "))
+	}
+	return nil
+}
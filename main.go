@@ -1,17 +1,19 @@
 package main
 
 import (
-	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -64,10 +66,29 @@ type Catbox struct {
 	// Active K:Lines (bans).
 	KLines []KLine
 
+	// Accounts registered with our built in NickServ. Canonical nick to
+	// account.
+	NickAccounts map[string]*NickAccount
+
+	// Channels registered with our built in ChanServ. Canonical channel name to
+	// registration.
+	ChannelRegistrations map[string]*ChannelRegistration
+
+	// Bans set network wide with BAN. Type and mask to the ban. This includes
+	// bans which expired or were removed until their lifetime ends.
+	PropagatedBans map[string]*PropagatedBan
+
+	// The same K:Lines indexed so we can match users against them quickly.
+	KLineIndex *KLineIndex
+
 	// When we close this channel, this indicates that we're shutting down.
 	// Other goroutines can check if this channel is closed.
 	ShutdownChan chan struct{}
 
+	// When clients' writers give up sending what's queued after we start
+	// shutting down. We set it before we close ShutdownChan.
+	ShutdownDeadline time.Time
+
 	// Tell the server something on this channel.
 	ToServerChan chan Event
 
@@ -87,14 +108,48 @@ type Catbox struct {
 	ConnectionCount int
 
 	// Our TLS configuration.
-	TLSConfig        *tls.Config
-	Certificate      *tls.Certificate
-	CertificateMutex *sync.RWMutex
+	TLSConfig *tls.Config
+
+	// Our current certificate (*tls.Certificate). We swap it atomically on
+	// rehash so handshakes in progress always see either the old or the new
+	// one, never a partial update, and never block on a rehash.
+	Certificate atomic.Value
+
+	// Certificates from the certificates config ([]*tls.Certificate). We choose
+	// from these by the name the client asks for. We swap them like
+	// Certificate.
+	SNICertificates atomic.Value
 
 	// TCP plaintext and TLS listeners.
 	Listener    net.Listener
 	TLSListener net.Listener
 
+	// Plaintext listener from the descriptor we were given (-listen-fd), if
+	// any. It doesn't change on rehash.
+	FDListener net.Listener
+
+	// Plaintext listener for clients connecting through Tor.
+	TorListener net.Listener
+
+	// Plaintext listener only servers may register on.
+	ServersListener net.Listener
+
+	// Serves pprof and a summary of our state (debug-listen), if we do.
+	DebugServer *http.Server
+
+	// Serves the admin API (api-listen), if we do. See api.go.
+	APIServer *http.Server
+
+	// The token API requests must have. A string. We keep it here rather than
+	// only in the config so the API's goroutines can read it.
+	APIToken atomic.Value
+
+	// Looks up clients' hostnames.
+	Resolver *HostResolver
+
+	// Tells systemd about our state.
+	Systemd *systemdNotifier
+
 	// WaitGroup to ensure all goroutines clean up before we end.
 	WG sync.WaitGroup
 
@@ -102,13 +157,71 @@ type Catbox struct {
 	// This will always be false unless someone triggered a restart.
 	Restart bool
 
+	// The file with state for the process we start when we restart, if we're
+	// upgrading. See upgrade().
+	UpgradeFile string
+
+	// Non-nil while we wait for users' readers and writers to stop so we can
+	// upgrade. See upgrade().
+	Upgrade *upgradeProgress
+
+	// The file for the listening socket we were given (-listen-fd), if any. We
+	// hold on to it so its descriptor stays open for the process we start when
+	// we restart.
+	ListenFile *os.File
+
 	// Track the time we last tried to connect to any server.
 	LastConnectAttempt time.Time
 
-	// Track what servers to try to connect to in a queue. This is because we try
-	// one at a time, and we don't want to favour those that happen to be appear
-	// first in the config.
-	LinkQueue []*ServerDefinition
+	// Track the time we last checked our state for problems.
+	LastConsistencyCheck time.Time
+
+	// Track the time we last checked whether our certificate files changed, and
+	// when the files we loaded were modified.
+	LastCertificateCheck time.Time
+	CertificateModTimes  map[string]time.Time
+
+	// The last problem reloading changed certificates. We tell operators about
+	// each problem once.
+	LastCertificateError string
+
+	// Our attempts to connect to each server in the servers config. Server name
+	// to its state.
+	Links map[string]*LinkState
+
+	// The stages each PRIVMSG/NOTICE goes through, in order. See pipeline.go.
+	MessageStages []MessageStage
+
+	// Where we keep state across restarts.
+	Store Store
+
+	// Network statistics by day.
+	Stats *NetStats
+
+	// Track the time we last saved statistics.
+	LastStatsSave time.Time
+
+	// Recent messages to channels.
+	History *ChannelHistory
+
+	// Track the time we last saved history.
+	LastHistorySave time.Time
+
+	// The last BATCH reference we handed out.
+	BatchCounter uint64
+
+	// State of channels we saved and haven't restored yet. Canonical channel
+	// name to its state.
+	SavedChannels map[string]*SavedChannel
+
+	// Track the time we last saved channels.
+	LastChannelsSave time.Time
+
+	// Failed OPER attempts by IP.
+	OperFailures map[string]*OperFailures
+
+	// Failed NickServ passwords by IP.
+	NickServFailures map[string]*OperFailures
 }
 
 // KLine holds a kline (a ban).
@@ -118,6 +231,9 @@ type KLine struct {
 	HostMask string
 
 	Reason string
+
+	// Unix time the K-Line expires. 0 if it is permanent.
+	Expires int64
 }
 
 // Message tells us the message and its destination. It primarily exists so that
@@ -148,6 +264,25 @@ type Event struct {
 	// If we have an error associated with the event, such as in the case of
 	// some DeadClientEvents, populate it here.
 	Error error
+
+	// For HostnameLookupEvents, the hostname we found. Blank if we found none.
+	Hostname string
+
+	// For StartTLSEvents, the connection after the handshake. nil if it failed.
+	TLSConn *tls.Conn
+
+	// For DebugStateEvents, where to send our state.
+	DebugStateChan chan<- debugState
+
+	// For APIEvents, what to do for the request.
+	APIFunc func()
+
+	// For PasswordEvents, what to do with the result.
+	PasswordFunc func()
+
+	// For ReaderStoppedEvents, what the client sent that we read but didn't
+	// process.
+	Unread []byte
 }
 
 // EventType is a type of event we can tell the server about.
@@ -176,31 +311,82 @@ const ( // nolint: deadcode
 
 	// RestartEvent tells the server to restart.
 	RestartEvent
+
+	// UpgradeEvent tells the server to upgrade. See upgrade().
+	UpgradeEvent
+
+	// ShutdownEvent tells the server to shut down.
+	ShutdownEvent
+
+	// HostnameLookupEvent tells the server we finished looking up a client's
+	// hostname. We only use this if we look up hostnames asynchronously.
+	HostnameLookupEvent
+
+	// StartTLSEvent tells the server a client's writer finished the TLS
+	// handshake after STARTTLS.
+	StartTLSEvent
+
+	// DebugStateEvent asks the server for a summary of its state. See
+	// debug.go.
+	DebugStateEvent
+
+	// APIEvent tells the server to act on an API request. See api.go.
+	APIEvent
+
+	// PasswordEvent tells the server we finished checking or hashing a
+	// password. See checkPasswordAsync().
+	PasswordEvent
+
+	// ReaderStoppedEvent tells the server a client's reader stopped because we
+	// are upgrading. See upgrade().
+	ReaderStoppedEvent
+
+	// WriterStoppedEvent tells the server a client's writer wrote everything
+	// queued before we upgrade. See upgrade().
+	WriterStoppedEvent
 )
 
 // UserMessageLimit defines a cap on how many messages a user may send at once.
 //
 // As part of flood control, each user has a counter that maxes out at this
-// number. Each message we process from them decrements their counter by one.
-// If their counter reaches 0, we queue their message and process it once their
-// counter becomes positive.
+// number. Each message we process from them decrements their counter by one,
+// or more if it is long (see FloodPenaltyBytes). If their counter reaches 0,
+// we queue their message and process it once their counter becomes positive.
+//
+// Commands with several targets (e.g., PRIVMSG a,b,c) decrement the counter
+// once for each target. Like long messages, this may take the counter below
+// 0.
 //
 // Each second we raise each user's counter by one (to this maximum).
 //
 // This is similar to ircd-ratbox's flood control. See its packet.c.
 const UserMessageLimit = 10
 
+// FloodPenaltyBytes is how long a message may be before it costs more for
+// flood control. A message costs one for each FloodPenaltyBytes bytes or part
+// thereof. A message of the longest length costs two.
+//
+// Without this, a user sending the longest messages could send far more data
+// than one sending short ones.
+const FloodPenaltyBytes = 256
+
 // ExcessFloodThreshold defines the number of messages a user may have queued
 // before they get disconnected for flooding.
 const ExcessFloodThreshold = 50
 
+// MaxSendQueue is the most messages we queue to send to a client. Each
+// client's write channel is this large. The send queue limits in the config
+// (user-sendq and such) may not be larger.
+const MaxSendQueue = 32768
+
 // ChanModesPerCommand tells how many channel modes we accept per MODE command
 // from a user.
 const ChanModesPerCommand = 4
 
 func main() {
-	log.SetFlags(log.Ldate | log.Ltime)
-	log.SetOutput(os.Stdout)
+	if isSubcommand(os.Args) {
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
 
 	args := getArgs()
 	if args == nil {
@@ -209,38 +395,82 @@ func main() {
 
 	binPath, err := filepath.Abs(os.Args[0])
 	if err != nil {
-		log.Fatalf("Unable to determine absolute path to binary: %s: %s",
+		coreLog.Fatalf("Unable to determine absolute path to binary: %s: %s",
 			os.Args[0], err)
 	}
 
+	if args.LogFile != "" {
+		if err := setLogFile(args.LogFile); err != nil {
+			coreLog.Fatalf("Unable to open log file: %s", err)
+		}
+	}
+
+	if args.Dir != "" {
+		if err := os.Chdir(args.Dir); err != nil {
+			coreLog.Fatalf("Unable to change directory: %s", err)
+		}
+	}
+
+	if args.PIDFile != "" {
+		if err := writePIDFile(args.PIDFile); err != nil {
+			coreLog.Fatalf("%s", err)
+		}
+	}
+
 	cb, err := newCatbox(args.ConfigFile)
 	if err != nil {
-		log.Fatal(err)
+		coreLog.Fatalf("%s", err)
+	}
+
+	if args.UpgradeFile != "" {
+		if err := cb.restoreUpgrade(args.UpgradeFile); err != nil {
+			coreLog.Fatalf("%s", err)
+		}
 	}
 
 	if err := cb.start(args.ListenFD); err != nil {
-		log.Fatal(err)
+		coreLog.Fatalf("%s", err)
 	}
 
 	if cb.Restart {
-		log.Printf("Shutdown completed. Restarting...")
+		coreLog.Infof("Shutdown completed. Restarting...")
+
+		// Start with the same arguments. The config path is absolute so the
+		// working directory doesn't matter.
+		restartArgs := []string{binPath, "-conf", cb.ConfigFile}
+		if args.ListenFD != -1 {
+			restartArgs = append(restartArgs, "-listen-fd",
+				fmt.Sprintf("%d", args.ListenFD))
+		}
+		if cb.UpgradeFile != "" {
+			restartArgs = append(restartArgs, "-upgrade-state", cb.UpgradeFile)
+		}
+		if args.PIDFile != "" {
+			restartArgs = append(restartArgs, "-pid-file", args.PIDFile)
+		}
+		if args.Dir != "" {
+			restartArgs = append(restartArgs, "-dir", args.Dir)
+		}
+		if args.LogFile != "" {
+			restartArgs = append(restartArgs, "-log-file", args.LogFile)
+		}
 
 		if err := syscall.Exec( // nolint: gas
 			binPath,
-			[]string{
-				binPath,
-				"-conf",
-				cb.ConfigFile,
-			},
-			nil,
+			restartArgs,
+			os.Environ(),
 		); err != nil {
-			log.Fatalf("Restart failed: %s", err)
+			coreLog.Fatalf("Restart failed: %s", err)
 		}
 
-		log.Fatalf("not reached")
+		coreLog.Fatalf("not reached")
+	}
+
+	if args.PIDFile != "" {
+		removePIDFile(args.PIDFile)
 	}
 
-	log.Printf("Server shutdown cleanly.")
+	coreLog.Infof("Server shutdown cleanly.")
 }
 
 func newCatbox(configFile string) (*Catbox, error) {
@@ -255,6 +485,12 @@ func newCatbox(configFile string) (*Catbox, error) {
 		Servers:      make(map[TS6SID]*Server),
 		Channels:     make(map[string]*Channel),
 		KLines:       []KLine{},
+		KLineIndex:   newKLineIndex(nil),
+		Links:        make(map[string]*LinkState),
+
+		PropagatedBans:   make(map[string]*PropagatedBan),
+		OperFailures:     make(map[string]*OperFailures),
+		NickServFailures: make(map[string]*OperFailures),
 
 		// shutdown() closes this channel.
 		ShutdownChan: make(chan struct{}),
@@ -268,14 +504,110 @@ func newCatbox(configFile string) (*Catbox, error) {
 		return nil, fmt.Errorf("configuration problem: %s", err)
 	}
 	cb.Config = cfg
+	if err := configureLogging(cb.Config); err != nil {
+		return nil, err
+	}
+
+	cb.registerDefaultMessageStages()
+
+	cb.Resolver = newHostResolver(cb.Config.DNSTimeout, cb.Config.DNSCacheTime,
+		cb.Config.DNSNegativeCacheTime, cb.ShutdownChan)
+
+	cb.Systemd = newSystemdNotifier(os.Getenv("NOTIFY_SOCKET"),
+		os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID"))
+
+	store, err := newStore(cb.Config)
+	if err != nil {
+		return nil, err
+	}
+	cb.Store = store
+
+	stats, err := loadNetStats(cb.Store, cb.Config.StatsFile)
+	if err != nil {
+		return nil, err
+	}
+	cb.Stats = stats
+
+	history, err := loadChannelHistory(cb.Store,
+		cb.Config.ChannelHistoryFile)
+	if err != nil {
+		return nil, err
+	}
+	cb.History = history
+
+	savedChannels, err := loadSavedChannels(cb.Store,
+		cb.Config.ChannelsFile)
+	if err != nil {
+		return nil, err
+	}
+	cb.SavedChannels = savedChannels
+
+	bans, err := loadBans(cb.Store, cb.Config.BansFile)
+	if err != nil {
+		return nil, err
+	}
+	if bans.KLines != nil {
+		cb.KLines = bans.KLines
+		cb.KLineIndex = newKLineIndex(cb.KLines)
+	}
+	for _, ban := range bans.PropagatedBans {
+		ban := ban
+		cb.PropagatedBans[ban.key()] = &ban
+	}
+
+	nickAccounts, err := loadNickAccounts(cb.Store,
+		cb.Config.NickServFile)
+	if err != nil {
+		return nil, err
+	}
+	cb.NickAccounts = nickAccounts
+
+	channelRegistrations, err := loadChannelRegistrations(cb.Store,
+		cb.Config.ChanServFile)
+	if err != nil {
+		return nil, err
+	}
+	cb.ChannelRegistrations = channelRegistrations
+
+	if err := cb.setupTLS(cb.Config); err != nil {
+		return nil, err
+	}
+
+	return &cb, nil
+}
+
+// listen opens a listener on the host and port. If useTLS is true, clients
+// must connect with TLS.
+func (cb *Catbox) listen(host, port string, useTLS bool) (net.Listener,
+	error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil || !useTLS {
+		return ln, err
+	}
+	return tlsListener{
+		Listener: tls.NewListener(ln, cb.TLSConfig),
+		tcp:      ln.(*net.TCPListener),
+	}, nil
+}
 
-	if cb.Config.ListenPortTLS != "-1" || cb.Config.CertificateFile != "" ||
-		cb.Config.KeyFile != "" {
-		cb.CertificateMutex = &sync.RWMutex{}
+// setupTLS creates our TLS configuration and loads our certificates if the
+// config says to use TLS and we haven't yet.
+func (cb *Catbox) setupTLS(cfg *Config) error {
+	if cb.TLSConfig != nil {
+		return nil
+	}
+
+	if cfg.ListenPortTLS != "-1" || cfg.CertificateFile != "" ||
+		cfg.KeyFile != "" || len(cfg.CertificateConfigs) > 0 {
 		tlsConfig := &tls.Config{
-			GetCertificate:           cb.getCertificate,
+			GetCertificate: cb.getCertificate,
+			// We present the same certificate when we link to servers.
+			GetClientCertificate:     cb.getClientCertificate,
 			PreferServerCipherSuites: true,
 			SessionTicketsDisabled:   true,
+			// Ask clients for a certificate so we can know their fingerprint. We
+			// don't verify it. We use it only for matching (e.g., $z extbans).
+			ClientAuth: tls.RequestClientCert,
 			// It would be nice to be able to be more restrictive on ciphers, but in
 			// practice many clients do not support the strictest.
 			//CipherSuites: []uint16{
@@ -283,44 +615,97 @@ func newCatbox(configFile string) (*Catbox, error) {
 			//	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 			//},
 		}
-		cb.TLSConfig = tlsConfig
 		if err := cb.loadCertificate(); err != nil {
-			return nil, err
+			return err
 		}
+		cb.TLSConfig = tlsConfig
 	}
 
-	return &cb, nil
+	return nil
 }
 
 // Return the current certificate.
 //
 // We use tls.Config's GetCertificate so that we can swap out the certificate
 // while running without having to recreate the net.Listener.
+//
+// If the client asks for a name (SNI) and one of the certificates from the
+// certificates config is valid for it, we use that one. Otherwise we use the
+// main certificate. If there is no main certificate, we use the first from
+// the certificates config.
 func (cb *Catbox) getCertificate(
 	hello *tls.ClientHelloInfo,
 ) (*tls.Certificate, error) {
-	cb.CertificateMutex.RLock()
-	defer cb.CertificateMutex.RUnlock()
-	if cb.Certificate == nil {
-		return nil, errors.New("certificate not set")
+	sniCerts, _ := cb.SNICertificates.Load().([]*tls.Certificate)
+	if hello.ServerName != "" {
+		for _, cert := range sniCerts {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+
+	cert, ok := cb.Certificate.Load().(*tls.Certificate)
+	if ok && cert != nil {
+		return cert, nil
+	}
+	if len(sniCerts) > 0 {
+		return sniCerts[0], nil
+	}
+	return nil, errors.New("certificate not set")
+}
+
+// Return the current certificate for when we are the client side of a TLS
+// connection, i.e., when we link to a server.
+//
+// If we don't have a certificate, we send none. The server may not require
+// one.
+func (cb *Catbox) getClientCertificate(
+	req *tls.CertificateRequestInfo,
+) (*tls.Certificate, error) {
+	cert, ok := cb.Certificate.Load().(*tls.Certificate)
+	if !ok || cert == nil {
+		return &tls.Certificate{}, nil
 	}
-	return cb.Certificate, nil
+	return cert, nil
 }
 
-// Load the certificate and key from files.
+// Load the certificates and keys from files.
+//
+// We load all of them before we swap any so a problem with one leaves us with
+// what we had.
 func (cb *Catbox) loadCertificate() error {
-	if cb.Config.CertificateFile == "" || cb.Config.KeyFile == "" {
-		return nil
+	// Note the times before we read so if a file changes while we read it we
+	// load it again.
+	modTimes := certificateModTimes(cb.certificateFiles())
+
+	var sniCerts []*tls.Certificate
+	for _, cc := range cb.Config.CertificateConfigs {
+		cert, err := tls.LoadX509KeyPair(cc.CertificateFile, cc.KeyFile)
+		if err != nil {
+			return errors.Wrapf(err, "error loading certificate/key %s", cc.Name)
+		}
+
+		// We need it parsed to know what names it is valid for.
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.Wrapf(err, "error parsing certificate %s", cc.Name)
+		}
+
+		sniCerts = append(sniCerts, &cert)
 	}
 
-	cert, err := tls.LoadX509KeyPair(cb.Config.CertificateFile, cb.Config.KeyFile)
-	if err != nil {
-		return errors.Wrap(err, "error loading certificate/key")
+	if cb.Config.CertificateFile != "" && cb.Config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cb.Config.CertificateFile,
+			cb.Config.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "error loading certificate/key")
+		}
+		cb.Certificate.Store(&cert)
 	}
 
-	cb.CertificateMutex.Lock()
-	defer cb.CertificateMutex.Unlock()
-	cb.Certificate = &cert
+	cb.SNICertificates.Store(sniCerts)
+	cb.CertificateModTimes = modTimes
 	return nil
 }
 
@@ -330,8 +715,9 @@ func (cb *Catbox) loadCertificate() error {
 // channels.
 func (cb *Catbox) start(listenFD int) error {
 	if listenFD == -1 && cb.Config.ListenPort == "-1" &&
-		cb.Config.ListenPortTLS == "-1" {
-		log.Fatalf("You must set a listen port.")
+		cb.Config.ListenPortTLS == "-1" && cb.Config.ListenPortTor == "-1" &&
+		cb.Config.ListenPortServers == "-1" {
+		coreLog.Fatalf("You must set a listen port.")
 	}
 
 	// Plaintext listener.
@@ -342,35 +728,80 @@ func (cb *Catbox) start(listenFD int) error {
 		if err != nil {
 			return fmt.Errorf("unable to listen: %s", err)
 		}
-		cb.Listener = ln
+		cb.FDListener = ln
+		cb.ListenFile = f
 
 		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+		go cb.acceptConnections(cb.FDListener, listenerClients)
 	}
 
-	if cb.Config.ListenPort != "-1" {
-		ln, err := net.Listen("tcp", fmt.Sprintf("%s:%s", cb.Config.ListenHost,
-			cb.Config.ListenPort))
+	// We already have listeners if we upgraded.
+
+	if cb.Listener == nil && cb.Config.ListenPort != "-1" {
+		ln, err := cb.listen(cb.Config.ListenHost, cb.Config.ListenPort, false)
 		if err != nil {
 			return fmt.Errorf("unable to listen: %s", err)
 		}
 		cb.Listener = ln
-
+	}
+	if cb.Listener != nil {
 		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+		go cb.acceptConnections(cb.Listener, listenerClients)
 	}
 
 	// TLS listener.
-	if cb.Config.ListenPortTLS != "-1" {
-		tlsLN, err := tls.Listen("tcp", fmt.Sprintf("%s:%s", cb.Config.ListenHost,
-			cb.Config.ListenPortTLS), cb.TLSConfig)
+	if cb.TLSListener == nil && cb.Config.ListenPortTLS != "-1" {
+		tlsLN, err := cb.listen(cb.Config.ListenHost, cb.Config.ListenPortTLS, true)
 		if err != nil {
 			return fmt.Errorf("unable to listen (TLS): %s", err)
 		}
 		cb.TLSListener = tlsLN
+	}
+	if cb.TLSListener != nil {
+		cb.WG.Add(1)
+		go cb.acceptConnections(cb.TLSListener, listenerClients)
+	}
+
+	// Tor listener.
+	if cb.TorListener == nil && cb.Config.ListenPortTor != "-1" {
+		ln, err := cb.listen(cb.Config.ListenHostTor, cb.Config.ListenPortTor,
+			false)
+		if err != nil {
+			return fmt.Errorf("unable to listen (Tor): %s", err)
+		}
+		cb.TorListener = ln
+	}
+	if cb.TorListener != nil {
+		cb.WG.Add(1)
+		go cb.acceptConnections(cb.TorListener, listenerTor)
+	}
 
+	// Servers listener.
+	if cb.ServersListener == nil && cb.Config.ListenPortServers != "-1" {
+		ln, err := cb.listen(cb.Config.ListenHostServers,
+			cb.Config.ListenPortServers, false)
+		if err != nil {
+			return fmt.Errorf("unable to listen (servers): %s", err)
+		}
+		cb.ServersListener = ln
+	}
+	if cb.ServersListener != nil {
 		cb.WG.Add(1)
-		go cb.acceptConnections(cb.TLSListener)
+		go cb.acceptConnections(cb.ServersListener, listenerServers)
+	}
+
+	cb.Resolver.start(cb.Config.DNSWorkers, &cb.WG)
+
+	if cb.Config.DebugListen != "" {
+		if err := cb.startDebugServer(); err != nil {
+			return err
+		}
+	}
+
+	if cb.Config.APIListen != "" {
+		if err := cb.startAPIServer(); err != nil {
+			return err
+		}
 	}
 
 	// Alarm is a goroutine to wake up this one periodically so we can do things
@@ -380,9 +811,14 @@ func (cb *Catbox) start(listenFD int) error {
 
 	// Catch SIGHUP and rehash.
 	// Catch SIGUSR1 and restart.
-	signalChan := make(chan os.Signal)
+	// Catch SIGUSR2 and upgrade.
+	// Catch SIGTERM and SIGINT and shut down.
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGHUP)
 	signal.Notify(signalChan, syscall.SIGUSR1)
+	signal.Notify(signalChan, syscall.SIGUSR2)
+	signal.Notify(signalChan, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT)
 
 	cb.WG.Add(1)
 	go func() {
@@ -391,16 +827,26 @@ func (cb *Catbox) start(listenFD int) error {
 			select {
 			case sig := <-signalChan:
 				if sig == syscall.SIGHUP {
-					log.Printf("Received SIGHUP signal, rehashing")
+					coreLog.Infof("Received SIGHUP signal, rehashing")
 					cb.newEvent(Event{Type: RehashEvent})
 					break
 				}
 				if sig == syscall.SIGUSR1 {
-					log.Printf("Received SIGUSR1 signal, restarting")
+					coreLog.Infof("Received SIGUSR1 signal, restarting")
 					cb.newEvent(Event{Type: RestartEvent})
 					break
 				}
-				log.Printf("Received unknown signal!")
+				if sig == syscall.SIGUSR2 {
+					coreLog.Infof("Received SIGUSR2 signal, upgrading")
+					cb.newEvent(Event{Type: UpgradeEvent})
+					break
+				}
+				if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+					coreLog.Infof("Received %s signal, shutting down", sig)
+					cb.newEvent(Event{Type: ShutdownEvent})
+					break
+				}
+				coreLog.Infof("Received unknown signal!")
 			case <-cb.ShutdownChan:
 				signal.Stop(signalChan)
 				// After Stop() we're guaranteed we will receive no more on the channel,
@@ -408,13 +854,15 @@ func (cb *Catbox) start(listenFD int) error {
 				close(signalChan)
 				for range signalChan {
 				}
-				log.Printf("Signal listener shutting down.")
+				coreLog.Debugf("Signal listener shutting down.")
 				return
 			}
 		}
 	}()
 
-	log.Printf("catbox started")
+	cb.Systemd.ready(cb.systemdStatus())
+
+	coreLog.Infof("catbox started")
 	cb.eventLoop()
 
 	// We don't need to drain any channels. None close that will have any
@@ -422,6 +870,10 @@ func (cb *Catbox) start(listenFD int) error {
 
 	cb.WG.Wait()
 
+	if err := cb.Store.Close(); err != nil {
+		coreLog.Errorf("Error closing store: %s", err)
+	}
+
 	return nil
 }
 
@@ -435,8 +887,13 @@ func (cb *Catbox) eventLoop() {
 		// promoted to a different client type (LocalUser, LocalServer).
 		case evt := <-cb.ToServerChan:
 			if evt.Type == NewClientEvent {
-				log.Printf("New client connection: %s", evt.Client)
+				clientsLog.Infof("New client connection: %s", evt.Client)
 				cb.LocalClients[evt.Client.ID] = evt.Client
+				cb.statsToday().Connections++
+				// We only hand over users we had when we started upgrading.
+				if cb.Upgrade != nil {
+					evt.Client.quit("Server upgrading")
+				}
 				continue
 			}
 
@@ -460,6 +917,13 @@ func (cb *Catbox) eventLoop() {
 			}
 
 			if evt.Type == MessageFromClientEvent {
+				// The client's reader waits for us after STARTTLS, whatever state the
+				// client is in.
+				if evt.Message.Command == "STARTTLS" {
+					cb.startTLSCommand(evt.Client)
+					continue
+				}
+
 				lc, exists := cb.LocalClients[evt.Client.ID]
 				if exists {
 					lc.handleMessage(evt.Message)
@@ -479,9 +943,24 @@ func (cb *Catbox) eventLoop() {
 			}
 
 			if evt.Type == WakeUpEvent {
+				// While upgrading we leave users be. Their readers and writers are
+				// stopping or stopped.
+				if cb.Upgrade != nil {
+					cb.checkUpgrade()
+					continue
+				}
 				cb.checkAndPingClients()
 				cb.connectToServers()
 				cb.floodControl()
+				cb.periodicConsistencyCheck()
+				cb.checkCertificates()
+				cb.updateNetStats()
+				cb.updateChannelHistory()
+				cb.updateSavedChannels()
+				cb.enforceNickOwnership()
+				cb.expireBans()
+				cb.expireOperFailures()
+				cb.updateSystemd()
 				continue
 			}
 
@@ -495,7 +974,53 @@ func (cb *Catbox) eventLoop() {
 				continue
 			}
 
-			log.Fatalf("Unexpected event: %d", evt.Type)
+			if evt.Type == UpgradeEvent {
+				cb.upgrade(nil)
+				continue
+			}
+
+			if evt.Type == ShutdownEvent {
+				cb.noticeOpers("Shutting down.")
+				cb.shutdown()
+				continue
+			}
+
+			if evt.Type == HostnameLookupEvent {
+				cb.hostnameLookupDone(evt.Client.ID, evt.Hostname)
+				continue
+			}
+
+			if evt.Type == StartTLSEvent {
+				cb.startTLSDone(evt.Client, evt.TLSConn, evt.Error)
+				continue
+			}
+
+			if evt.Type == DebugStateEvent {
+				evt.DebugStateChan <- cb.debugState()
+				continue
+			}
+
+			if evt.Type == APIEvent {
+				evt.APIFunc()
+				continue
+			}
+
+			if evt.Type == PasswordEvent {
+				evt.PasswordFunc()
+				continue
+			}
+
+			if evt.Type == ReaderStoppedEvent {
+				cb.upgradeReaderStopped(evt.Client, evt.Unread)
+				continue
+			}
+
+			if evt.Type == WriterStoppedEvent {
+				cb.upgradeWriterStopped(evt.Client)
+				continue
+			}
+
+			coreLog.Fatalf("Unexpected event: %d", evt.Type)
 		case <-cb.ShutdownChan:
 			return
 		}
@@ -548,34 +1073,79 @@ func (cb *Catbox) errorToQuitMessage(err error) string {
 
 // shutdown starts server shutdown.
 func (cb *Catbox) shutdown() {
-	log.Printf("Server shutdown initiated.")
+	coreLog.Infof("Server shutdown initiated.")
+
+	// If we're restarting, the same process carries on.
+	if cb.Restart {
+		cb.Systemd.reloading()
+	} else {
+		cb.Systemd.stopping()
+	}
+
+	cb.ShutdownDeadline = time.Now().Add(cb.Config.ShutdownFlushTime)
 
 	// Closing ShutdownChan indicates to other goroutines that we're shutting
 	// down.
 	close(cb.ShutdownChan)
 
+	if cb.FDListener != nil {
+		if err := cb.FDListener.Close(); err != nil {
+			coreLog.Warnf("Error closing plaintext listener: %s", err)
+		}
+	}
+
 	if cb.Listener != nil {
 		if err := cb.Listener.Close(); err != nil {
-			log.Printf("Error closing plaintext listener: %s", err)
+			coreLog.Warnf("Error closing plaintext listener: %s", err)
 		}
 	}
 
 	if cb.TLSListener != nil {
 		if err := cb.TLSListener.Close(); err != nil {
-			log.Printf("Error closing TLS listener: %s", err)
+			coreLog.Warnf("Error closing TLS listener: %s", err)
+		}
+	}
+
+	if cb.TorListener != nil {
+		if err := cb.TorListener.Close(); err != nil {
+			coreLog.Warnf("Error closing Tor listener: %s", err)
+		}
+	}
+
+	if cb.ServersListener != nil {
+		if err := cb.ServersListener.Close(); err != nil {
+			coreLog.Warnf("Error closing servers listener: %s", err)
+		}
+	}
+
+	if cb.DebugServer != nil {
+		if err := cb.DebugServer.Close(); err != nil {
+			coreLog.Warnf("Error closing debug listener: %s", err)
 		}
 	}
 
+	if cb.APIServer != nil {
+		if err := cb.APIServer.Close(); err != nil {
+			coreLog.Warnf("Error closing API listener: %s", err)
+		}
+	}
+
+	// Save channels while they still have their members.
+	cb.saveChannels()
+
 	// All clients need to be told. This also closes their write channels.
 	for _, client := range cb.LocalClients {
-		client.quit("Server shutting down")
+		client.quit(cb.Config.ShutdownMessage)
 	}
 	for _, client := range cb.LocalServers {
-		client.quit("Server shutting down")
+		client.quit(cb.Config.ShutdownMessage)
 	}
 	for _, client := range cb.LocalUsers {
-		client.quit("Server shutting down", false)
+		client.quit(cb.Config.ShutdownMessage, false)
 	}
+
+	cb.saveNetStats()
+	cb.saveChannelHistory()
 }
 
 // getClientID generates a new client ID. Each client that connects to us (or
@@ -590,17 +1160,31 @@ func (cb *Catbox) getClientID() uint64 {
 	id := cb.NextClientID
 
 	if cb.NextClientID+1 == 0 {
-		log.Fatalf("Client id overflow")
+		coreLog.Fatalf("Client id overflow")
 	}
 	cb.NextClientID++
 
 	return id
 }
 
+// listenerKind says who connects to a listener.
+type listenerKind int
+
+const (
+	// Users and servers.
+	listenerClients listenerKind = iota
+
+	// Users connecting through Tor. See LocalClient.Tor.
+	listenerTor
+
+	// Servers only. See LocalClient.ServersOnly.
+	listenerServers
+)
+
 // acceptConnections accepts TCP connections and tells the main server loop
 // through a channel. It sets up separate goroutines for reading/writing to
 // and from the client.
-func (cb *Catbox) acceptConnections(listener net.Listener) {
+func (cb *Catbox) acceptConnections(listener net.Listener, kind listenerKind) {
 	defer cb.WG.Done()
 
 	for {
@@ -610,21 +1194,45 @@ func (cb *Catbox) acceptConnections(listener net.Listener) {
 
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %s", err)
-			continue
+			clientsLog.Warnf("Failed to accept connection: %s", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			// The listener closed. We're shutting down or a rehash replaced it.
+			break
 		}
 
-		cb.introduceClient(conn)
+		cb.introduceClient(conn, kind)
 	}
 
-	log.Printf("Connection accepter shutting down.")
+	coreLog.Debugf("Connection accepter shutting down.")
+}
+
+// sendNetworkNotices tells a client we just accepted about the network we're
+// part of, if we're configured to.
+func (cb *Catbox) sendNetworkNotices(client *LocalClient) {
+	if cb.Config.NetworkName != "" {
+		notice := fmt.Sprintf("*** %s is part of %s", cb.Config.ServerName,
+			cb.Config.NetworkName)
+		if cb.Config.NetworkDescription != "" {
+			notice += ": " + cb.Config.NetworkDescription
+		}
+		sendAuthNotice(client, notice)
+	}
+	if cb.Config.NetworkAdmin != "" {
+		sendAuthNotice(client, "*** Network admin: "+cb.Config.NetworkAdmin)
+	}
 }
 
 // introduceClient sets up a client we just accepted.
 //
 // It creates a Client struct, and sends initial NOTICEs to the client. It also
 // attempts to look up the client's hostname.
-func (cb *Catbox) introduceClient(conn net.Conn) {
+//
+// We don't look up the hostname of clients connecting through Tor. All we'd
+// find is the Tor daemon's.
+func (cb *Catbox) introduceClient(conn net.Conn, kind listenerKind) {
 	cb.WG.Add(1)
 
 	go func() {
@@ -633,6 +1241,8 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 		id := cb.getClientID()
 
 		client := NewLocalClient(cb, id, conn)
+		client.Tor = kind == listenerTor
+		client.ServersOnly = kind == listenerServers
 
 		cb.WG.Add(1)
 		go client.writeLoop()
@@ -641,18 +1251,33 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 			client,
 			"*** Processing your connection to "+cb.Config.ServerName,
 		)
+		cb.sendNetworkNotices(client)
+
+		if client.Tor {
+			sendAuthNotice(client, "*** Connected through Tor")
+			client.Hostname = cb.Config.TorHost
+
+			cb.newEvent(Event{Type: NewClientEvent, Client: client})
+
+			cb.WG.Add(1)
+			go client.readLoop()
+			return
+		}
 
 		if client.isTLS() {
 			tlsVersion, tlsCipherSuite, err := client.getTLSState()
 			if err != nil {
-				log.Printf("Client %s: %s", client, err)
+				clientsLog.Infof("Client %s: %s", client, err)
+				logEvent("connect", "Client %s: %s", client, err)
 				close(client.WriteChan)
 				return
 			}
 
 			if tlsVersion != "TLS 1.2" && tlsVersion != "TLS 1.3" {
-				cb.noticeOpers(fmt.Sprintf("Rejecting client %s using %s",
-					client.Conn.IP, tlsVersion))
+				cb.noticeOpersRealHost(fmt.Sprintf("Rejecting client %s using %s",
+					client.Conn.IP, tlsVersion),
+					fmt.Sprintf("Rejecting a client using %s", tlsVersion))
+				logEvent("connect", "Rejecting client %s using %s", client, tlsVersion)
 				// Send ERROR and start up the writer to try to let them get it. Don't
 				// bother recording the client or starting the reader. We don't care.
 				client.messageFromServer("ERROR",
@@ -671,7 +1296,24 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 
 		sendAuthNotice(client, "*** Looking up your hostname...")
 
-		hostname := lookupHostname(context.TODO(), client.Conn.IP)
+		if cb.Config.AsyncHostnameLookup {
+			// Let the client register while we look up their hostname. We tell the
+			// server goroutine what we find.
+			client.LookingUpHostname = true
+			cb.newEvent(Event{Type: NewClientEvent, Client: client})
+
+			cb.WG.Add(1)
+			go client.readLoop()
+
+			cb.newEvent(Event{
+				Type:     HostnameLookupEvent,
+				Client:   client,
+				Hostname: cb.waitForHostname(client.Conn.IP),
+			})
+			return
+		}
+
+		hostname := cb.waitForHostname(client.Conn.IP)
 		if len(hostname) > 0 {
 			sendAuthNotice(client, "*** Found your hostname")
 			client.Hostname = hostname
@@ -691,11 +1333,155 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 	}()
 }
 
-func sendAuthNotice(c *LocalClient, m string) {
-	c.WriteChan <- irc.Message{
-		Command: "NOTICE",
-		Params:  []string{"AUTH", m},
-	}
+// waitForHostname looks up the IP's hostname and waits for the answer. We give
+// up if we're shutting down.
+func (cb *Catbox) waitForHostname(ip net.IP) string {
+	select {
+	case hostname := <-cb.Resolver.lookup(ip):
+		return hostname
+	case <-cb.ShutdownChan:
+		return ""
+	}
+}
+
+// hostnameLookupDone records a client's hostname when we looked it up
+// asynchronously.
+//
+// If the client registered already, they have their IP as their hostname. We
+// change it to the hostname (unless they have a spoof) and tell everyone who
+// needs to know. We check K-Lines again as they may match the hostname.
+func (cb *Catbox) hostnameLookupDone(id uint64, hostname string) {
+	if lc, exists := cb.LocalClients[id]; exists {
+		lc.LookingUpHostname = false
+		if len(hostname) == 0 {
+			lc.authNotice("*** Couldn't look up your hostname")
+		} else {
+			lc.authNotice("*** Found your hostname")
+			lc.Hostname = hostname
+		}
+		if lc.WaitingForHostname {
+			lc.WaitingForHostname = false
+			lc.registerUser()
+		}
+		return
+	}
+
+	lu, exists := cb.LocalUsers[id]
+	if !exists {
+		// They're gone.
+		return
+	}
+
+	if len(hostname) == 0 {
+		lu.serverNotice("Couldn't look up your hostname")
+		return
+	}
+
+	lu.Hostname = hostname
+
+	// If they have a spoof, they keep it.
+	if lu.User.Hostname != lu.User.IP {
+		return
+	}
+
+	lu.serverNotice(fmt.Sprintf("Found your hostname: %s", hostname))
+
+	cb.setHost(lu.User, hostname, lu.displayHost(hostname))
+
+	if kline, matched := cb.matchingKLine(lu.User); matched {
+		// 465 ERR_YOUREBANNEDCREEP
+		lu.messageFromServer("465", []string{"You are banned from this server"})
+
+		lu.quit(fmt.Sprintf("Connection closed: %s", kline.Reason), true)
+
+		cb.noticeOpers(fmt.Sprintf("User disconnected due to K-Line: %s",
+			lu.User.DisplayNick))
+		logEvent("kill", "User disconnected due to K-Line: %s (%s@%s)",
+			lu.User.DisplayNick, lu.User.Username, lu.User.Hostname)
+	}
+}
+
+// setHost changes a user's real hostname and the hostname they show. We tell
+// everyone who needs to know. The user may be remote if an operator gave them
+// a vhost.
+//
+// Other servers hear about the hostname they show with ENCAP CHGHOST. If that
+// is not their real hostname and they're our user, we tell them it with ENCAP
+// REALHOST too. REALHOST comes from the user, so only their own server may
+// send it. Other servers already know a remote user's real hostname.
+func (cb *Catbox) setHost(user *User, hostname, displayHost string) {
+	realChanged := user.Hostname != hostname
+	displayChanged := user.DisplayHost != displayHost
+
+	oldUhost := user.nickUhost()
+	user.Hostname = hostname
+	user.DisplayHost = displayHost
+	if displayChanged {
+		cb.notifyHostChange(user, oldUhost)
+	}
+
+	for _, server := range cb.LocalServers {
+		if displayChanged {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(cb.Config.TS6SID),
+				Command: "ENCAP",
+				Params:  []string{"*", "CHGHOST", string(user.UID), displayHost},
+			})
+		}
+		if user.isLocal() &&
+			(realChanged || (displayChanged && hostname != displayHost)) {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(user.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "REALHOST", hostname},
+			})
+		}
+	}
+}
+
+// configuredVhost finds the vhost the vhosts config gives the user. Blank if
+// there is none. If several match, the first by name wins. The configs are in
+// that order.
+func (cb *Catbox) configuredVhost(user *User) string {
+	for _, vc := range cb.Config.VhostConfigs {
+		if vc.Account != "" && user.Account != "" &&
+			strings.EqualFold(vc.Account, user.Account) {
+			return vc.Vhost
+		}
+		if vc.CertFP != "" && vc.CertFP == user.CertFP {
+			return vc.Vhost
+		}
+	}
+	return ""
+}
+
+// applyAccountVhost gives the user the vhost the vhosts config has for their
+// account if they're our user. They keep a vhost they have if they log out.
+func (cb *Catbox) applyAccountVhost(user *User) {
+	if !user.isLocal() {
+		return
+	}
+	vhost := cb.configuredVhost(user)
+	if vhost == "" || vhost == user.DisplayHost {
+		return
+	}
+	user.LocalUser.Vhost = vhost
+	cb.setHost(user, user.Hostname, vhost)
+	user.LocalUser.sendHostHidden()
+}
+
+// isServices tells whether the server is a services server. Our servers config
+// flags them. They need not link to us directly.
+func (cb *Catbox) isServices(server *Server) bool {
+	linkInfo, exists := cb.Config.Servers[server.Name]
+	return exists && linkInfo.Services
+}
+
+func sendAuthNotice(c *LocalClient, m string) {
+	c.WriteChan <- irc.Message{
+		Command: "NOTICE",
+		Params:  []string{"AUTH", m},
+	}
 }
 
 // Return true if the server is shutting down.
@@ -733,7 +1519,7 @@ func (cb *Catbox) alarm() {
 		cb.newEvent(Event{Type: WakeUpEvent})
 	}
 
-	log.Printf("Alarm shutting down.")
+	coreLog.Debugf("Alarm shutting down.")
 }
 
 // checkAndPingClients looks at each connected client.
@@ -813,11 +1599,14 @@ func (cb *Catbox) checkAndPingClients() {
 		}
 
 		// If it is bursting then we want to check it doesn't go on too long. Drop
-		// it if it does.
+		// it if it does. A large burst may take a while, so we give it more time
+		// as long as it keeps sending us data.
 		if server.Bursting {
 			timeConnected := now.Sub(server.ConnectionStartTime)
+			timeIdle := now.Sub(server.LastActivityTime)
 
-			if timeConnected > cb.Config.PingTime {
+			if timeConnected > cb.Config.BurstTimeout &&
+				timeIdle > cb.Config.PingTime {
 				server.quit("Bursting too long")
 			}
 			continue
@@ -855,82 +1644,6 @@ func (cb *Catbox) checkAndPingClients() {
 	}
 }
 
-// connectToServers tries to connect outwards to any servers configured but not
-// currently connected to.
-//
-// We delay a connection attempt to a server until at least ConnectAttemptTime
-// elapsed.
-//
-// Try to link to at most one server per call. Use a queue so we give each
-// server a chance rather than favouring those that appear earlier in the
-// config. This is also to try to address the race condition where we link with
-// two servers in the same network at the "same" time. Such a condition will
-// lead to a split, but it can cause noise and collisions. Note this is a best
-// effort approach. It is still possible for us to connect out to multiple
-// servers through repeated calls to this function. As well, there is no limit
-// on inbound linking. My intention is to reduce the likelihood of the race
-// happening rather than make it impossible. Mainly because I am not sure a
-// simple way to make it impossible.
-func (cb *Catbox) connectToServers() {
-	now := time.Now()
-
-	// Delay between any connection attempt. This means we try to connect to at
-	// most one server, and then wait ConnectAttemptTime before trying any others.
-	timeSinceLastAttempt := now.Sub(cb.LastConnectAttempt)
-	if timeSinceLastAttempt < cb.Config.ConnectAttemptTime {
-		return
-	}
-
-	// Queue up servers to try to connect to if there are any we're not connected
-	// to.
-	if len(cb.LinkQueue) == 0 {
-		for _, linkInfo := range cb.Config.Servers {
-			// It does not make sense to try to connect to ourself. Even if we're in
-			// the config.
-			if linkInfo.Name == cb.Config.ServerName {
-				continue
-			}
-
-			if cb.isLinkedToServer(linkInfo.Name) {
-				continue
-			}
-
-			cb.LinkQueue = append(cb.LinkQueue, linkInfo)
-		}
-	}
-
-	if len(cb.LinkQueue) == 0 {
-		// We're connected to all servers.
-		return
-	}
-
-	// Try to connect to one.
-	for {
-		if len(cb.LinkQueue) == 0 {
-			// None left to try.
-			break
-		}
-
-		// Take first server we're not connected to, and try it.
-		linkInfo := cb.LinkQueue[0]
-		if len(cb.LinkQueue) == 1 {
-			cb.LinkQueue = []*ServerDefinition{}
-		} else {
-			cb.LinkQueue = cb.LinkQueue[1:]
-		}
-
-		// Did we link to it since we queued it for an attempt? If so, pick another.
-		if cb.isLinkedToServer(linkInfo.Name) {
-			continue
-		}
-
-		// Try to link to it.
-		cb.connectToServer(linkInfo)
-		cb.LastConnectAttempt = now
-		break
-	}
-}
-
 // floodControl updates the message counters for all users, and potentially
 // processes queued messages for any that hit their limit.
 //
@@ -966,6 +1679,11 @@ func (cb *Catbox) floodControl() {
 			// handleMessage decrements our message counter.
 			user.handleMessage(msg)
 		}
+
+		// Send more of their LIST, if any. handleMessage might have quit them.
+		if _, exists := cb.LocalUsers[user.ID]; exists && user.List != nil {
+			user.sendListChunk()
+		}
 	}
 }
 
@@ -990,31 +1708,43 @@ func (cb *Catbox) isLinkedToServer(name string) bool {
 func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 	cb.WG.Add(1)
 
+	dialer := &net.Dialer{
+		Timeout: cb.Config.DeadTime,
+	}
+
+	// We may need to connect from a particular IP. e.g., if the other side
+	// firewalls by source address and we have several.
+	bindAddress := linkInfo.BindAddress
+	if bindAddress == "" {
+		bindAddress = cb.Config.LinkBindAddress
+	}
+	if bindAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(bindAddress)}
+	}
+
 	go func() {
 		defer cb.WG.Done()
 
 		var conn net.Conn
 		var err error
 
+		address := net.JoinHostPort(linkInfo.Hostname,
+			strconv.Itoa(linkInfo.Port))
+
 		if linkInfo.TLS {
 			cb.noticeOpers(fmt.Sprintf("Connecting to %s with TLS...", linkInfo.Name))
-
-			dialer := &net.Dialer{
-				Timeout: cb.Config.DeadTime,
-			}
-			conn, err = tls.DialWithDialer(dialer, "tcp",
-				fmt.Sprintf("%s:%d", linkInfo.Hostname, linkInfo.Port), cb.TLSConfig)
+			conn, err = tls.DialWithDialer(dialer, "tcp", address, cb.TLSConfig)
 		} else {
 			cb.noticeOpers(fmt.Sprintf("Connecting to %s without TLS...",
 				linkInfo.Name))
-			conn, err = net.DialTimeout("tcp",
-				fmt.Sprintf("%s:%d", linkInfo.Hostname, linkInfo.Port),
-				cb.Config.DeadTime)
+			conn, err = dialer.Dial("tcp", address)
 		}
 
 		if err != nil {
 			cb.noticeOpers(fmt.Sprintf("Unable to connect to server [%s]: %s",
 				linkInfo.Name, err))
+			logEvent("link", "Unable to connect to server [%s]: %s", linkInfo.Name,
+				err)
 			return
 		}
 
@@ -1022,10 +1752,13 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 
 		client := NewLocalClient(cb, id, conn)
 
+		// We know this is a server.
+		client.Conn.setMaxLineLength(maxServerLineLength)
+
 		if linkInfo.TLS {
 			tlsVersion, tlsCipherSuite, err := client.getTLSState()
 			if err != nil {
-				log.Printf("Disconnecting from server %s: %s", linkInfo.Name, err)
+				s2sLog.Warnf("Disconnecting from server %s: %s", linkInfo.Name, err)
 				_ = conn.Close() // nolint: gosec
 				return
 			}
@@ -1038,7 +1771,7 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 				return
 			}
 
-			log.Printf("Connected to %s with %s (%s)", linkInfo.Name, tlsVersion,
+			s2sLog.Infof("Connected to %s with %s (%s)", linkInfo.Name, tlsVersion,
 				tlsCipherSuite)
 		}
 
@@ -1078,11 +1811,22 @@ func (cb *Catbox) newEvent(evt Event) {
 
 // Send a message to all operator users.
 func (cb *Catbox) noticeOpers(msg string) {
-	log.Printf("Global oper notice: %s", msg)
+	cb.noticeOpersRealHost(msg, msg)
+}
+
+// noticeOpersRealHost is like noticeOpers() for a notice showing a user's real
+// host or IP. Our operators who may not see those (see seesRealHosts()) get
+// hiddenMsg instead.
+func (cb *Catbox) noticeOpersRealHost(msg, hiddenMsg string) {
+	coreLog.Infof("Global oper notice: %s", msg)
 
 	for _, user := range cb.Opers {
 		if user.isLocal() {
-			user.LocalUser.serverNotice(msg)
+			if user.seesRealHosts() {
+				user.LocalUser.serverNotice(msg)
+			} else {
+				user.LocalUser.serverNotice(hiddenMsg)
+			}
 			continue
 		}
 
@@ -1099,13 +1843,66 @@ func (cb *Catbox) noticeOpers(msg string) {
 
 // Send a message to all local operator users.
 func (cb *Catbox) noticeLocalOpers(msg string) {
-	log.Printf("Local oper notice: %s", msg)
+	cb.noticeLocalOpersRealHost(msg, msg)
+}
+
+// noticeLocalOpersRealHost is like noticeLocalOpers() for a notice showing a
+// user's real host or IP. See noticeOpersRealHost().
+func (cb *Catbox) noticeLocalOpersRealHost(msg, hiddenMsg string) {
+	coreLog.Infof("Local oper notice: %s", msg)
 
 	for _, user := range cb.Opers {
-		if user.isLocal() {
+		if !user.isLocal() {
+			continue
+		}
+		if user.seesRealHosts() {
 			user.LocalUser.serverNotice(msg)
+		} else {
+			user.LocalUser.serverNotice(hiddenMsg)
+		}
+	}
+}
+
+// Send a WALLOPS to local users who want to see them (+w).
+//
+// If it is an OPERWALL, we send it only to local operators. Like ratbox, we
+// send it to them as a WALLOPS.
+func (cb *Catbox) wallopsLocalUsers(origin, text string, operwall bool) {
+	if operwall {
+		for _, oper := range cb.Opers {
+			if !oper.isLocal() {
+				continue
+			}
+			oper.LocalUser.maybeQueueMessage(irc.Message{
+				Prefix:  origin,
+				Command: "WALLOPS",
+				Params:  []string{"OPERWALL - " + text},
+			})
+		}
+		return
+	}
+
+	for _, user := range cb.LocalUsers {
+		if _, wallops := user.User.Modes['w']; !wallops {
+			continue
+		}
+		user.maybeQueueMessage(irc.Message{
+			Prefix:  origin,
+			Command: "WALLOPS",
+			Params:  []string{text},
+		})
+	}
+}
+
+// Send a GLOBOPS to local operators. They see it as a server notice. Being
+// +w does not matter.
+func (cb *Catbox) globopsLocalOpers(origin, text string) {
+	for _, oper := range cb.Opers {
+		if !oper.isLocal() {
 			continue
 		}
+		oper.LocalUser.messageFromServer("NOTICE", []string{oper.DisplayNick,
+			fmt.Sprintf("*** Global -- from %s: %s", origin, text)})
 	}
 }
 
@@ -1114,32 +1911,34 @@ func (cb *Catbox) noticeLocalOpers(msg string) {
 //
 // This function does not propagate to any other servers.
 //
-// KLines are currently always permanent locally.
+// K-Lines are permanent unless they have an expiry time. We keep them across
+// restarts if we have a bans file.
 func (cb *Catbox) addAndApplyKLine(kline KLine, source, reason string) {
 	// If it's a duplicate KLINE, ignore it.
-	for _, k := range cb.KLines {
-		if k.UserMask != kline.UserMask {
-			continue
-		}
-		if k.HostMask != kline.HostMask {
-			continue
-		}
+	if cb.KLineIndex.has(kline.UserMask, kline.HostMask) {
 		cb.noticeOpers(fmt.Sprintf("Ignoring duplicate K-Line for [%s@%s] from %s",
-			k.UserMask, k.HostMask, source))
+			kline.UserMask, kline.HostMask, source))
 		return
 	}
 
 	cb.KLines = append(cb.KLines, kline)
+	cb.KLineIndex.add(kline)
+	cb.statsToday().KLines++
+	cb.saveBans()
 
 	cb.noticeOpers(fmt.Sprintf("%s added K-Line for [%s@%s] [%s]",
 		source, kline.UserMask, kline.HostMask, reason))
+	logEvent("kill", "%s added K-Line for [%s@%s] [%s]", source,
+		kline.UserMask, kline.HostMask, reason)
 
 	// Do we have any matching users connected? Cut them off if so.
 
 	quitReason := fmt.Sprintf("Connection closed: %s", reason)
 
+	match := newKLineIndex([]KLine{kline})
 	for _, user := range cb.LocalUsers {
-		if !user.User.matchesMask(kline.UserMask, kline.HostMask) {
+		if _, matched := match.match(user.User); !matched ||
+			cb.exemptFromKLine(user.User, kline) {
 			continue
 		}
 
@@ -1147,33 +1946,191 @@ func (cb *Catbox) addAndApplyKLine(kline KLine, source, reason string) {
 
 		cb.noticeOpers(fmt.Sprintf("User disconnected due to K-Line: %s",
 			user.User.DisplayNick))
+		logEvent("kill", "User disconnected due to K-Line: %s (%s@%s)",
+			user.User.DisplayNick, user.User.Username, user.User.Hostname)
 	}
 }
 
-func (cb *Catbox) removeKLine(userMask, hostMask, source string) bool {
-	idx := -1
-	for i, kline := range cb.KLines {
-		if kline.UserMask != userMask || kline.HostMask != hostMask {
+// matchingKLine finds a K-Line matching the local user. If an exemption
+// protects them, there is no match.
+func (cb *Catbox) matchingKLine(user *User) (KLine, bool) {
+	kline, matched := cb.KLineIndex.match(user)
+	if !matched {
+		return KLine{}, false
+	}
+	return kline, !cb.exemptFromKLine(user, kline)
+}
+
+// exemptFromKLine checks whether the exempts config protects the local user
+// from the K-Line. If it does, we tell operators.
+func (cb *Catbox) exemptFromKLine(user *User, kline KLine) bool {
+	for _, ec := range cb.Config.ExemptConfigs {
+		if ec.CertFP != "" && ec.CertFP != user.CertFP {
 			continue
 		}
-		idx = i
-		break
+		if ec.CertFP == "" && !user.matchesUserHostMask(ec.UserMask, ec.HostMask) {
+			continue
+		}
+
+		cb.noticeLocalOpersRealHost(fmt.Sprintf(
+			"Not applying K-Line for [%s@%s] to %s!%s@%s. Exempt: %s",
+			kline.UserMask, kline.HostMask, user.DisplayNick, user.Username,
+			user.Hostname, ec.Name), fmt.Sprintf(
+			"Not applying K-Line for [%s@%s] to %s!%s@%s. Exempt: %s",
+			kline.UserMask, kline.HostMask, user.DisplayNick, user.Username,
+			user.DisplayHost, ec.Name))
+		return true
 	}
+	return false
+}
 
-	if idx == -1 {
+// channelServers gives the servers to tell about something happening in a
+// channel. This is every server we link with, except for local channels. We
+// tell no servers about those.
+func (cb *Catbox) channelServers(channel *Channel) map[uint64]*LocalServer {
+	if channel.isLocal() {
+		return nil
+	}
+	return cb.LocalServers
+}
+
+// reservation finds the reserve config reserving a nick or channel, if any.
+//
+// We compare canonical forms, so a mask reserving nick[away] reserves
+// Nick{away} too.
+func (cb *Catbox) reservation(name string) (ReserveConfig, bool) {
+	isChannel := name[0] == '#' || name[0] == '&'
+	canonicalize := canonicalizeNick
+	if isChannel {
+		canonicalize = canonicalizeChannel
+	}
+	for _, rc := range cb.Config.ReserveConfigs {
+		if (rc.Mask[0] == '#' || rc.Mask[0] == '&') != isChannel {
+			continue
+		}
+		if matchMask(canonicalize(rc.Mask), canonicalize(name)) {
+			return rc, true
+		}
+	}
+	return ReserveConfig{}, false
+}
+
+// reservedMessage is what we tell a user trying to use a reserved nick or
+// channel.
+func reservedMessage(prefix string, rc ReserveConfig) string {
+	if rc.Reason == "" {
+		return prefix
+	}
+	return prefix + ": " + rc.Reason
+}
+
+// propagateKLine tells servers other than except (which may be nil) about a
+// K-Line. Servers with the KLN capab get KLINE. The rest get it in ENCAP.
+//
+// sourceID is the UID/SID setting it. target is a mask of the servers the
+// K-Line is for.
+func (cb *Catbox) propagateKLine(except *LocalServer, sourceID, target,
+	duration, userMask, hostMask, reason string) {
+	for _, server := range cb.LocalServers {
+		if server == except {
+			continue
+		}
+
+		server.maybeQueueMessage(klineMessage(server, sourceID, target, duration,
+			userMask, hostMask, reason))
+	}
+}
+
+// klineMessage is how we tell the server about a K-Line. KLINE if it has the
+// KLN capab, otherwise ENCAP KLINE.
+func klineMessage(server *LocalServer, sourceID, target, duration, userMask,
+	hostMask, reason string) irc.Message {
+	if server.Server.hasCapability("KLN") {
+		return irc.Message{
+			Prefix:  sourceID,
+			Command: "KLINE",
+			Params:  []string{target, duration, userMask, hostMask, reason},
+		}
+	}
+
+	return irc.Message{
+		Prefix:  sourceID,
+		Command: "ENCAP",
+		Params:  []string{target, "KLINE", duration, userMask, hostMask, reason},
+	}
+}
+
+// propagateUnkline tells servers other than except (which may be nil) about
+// a K-Line's removal. Servers with the UNKLN capab get UNKLINE. The rest get it
+// in ENCAP.
+func (cb *Catbox) propagateUnkline(except *LocalServer, sourceID, target,
+	userMask, hostMask string) {
+	for _, server := range cb.LocalServers {
+		if server == except {
+			continue
+		}
+
+		server.maybeQueueMessage(unklineMessage(server, sourceID, target, userMask,
+			hostMask))
+	}
+}
+
+// unklineMessage is how we tell the server about a K-Line's removal. UNKLINE
+// if it has the UNKLN capab, otherwise ENCAP UNKLINE.
+func unklineMessage(server *LocalServer, sourceID, target, userMask,
+	hostMask string) irc.Message {
+	if server.Server.hasCapability("UNKLN") {
+		return irc.Message{
+			Prefix:  sourceID,
+			Command: "UNKLINE",
+			Params:  []string{target, userMask, hostMask},
+		}
+	}
+
+	return irc.Message{
+		Prefix:  sourceID,
+		Command: "ENCAP",
+		Params:  []string{target, "UNKLINE", userMask, hostMask},
+	}
+}
+
+func (cb *Catbox) removeKLine(userMask, hostMask, source string) bool {
+	if !cb.KLineIndex.remove(userMask, hostMask) {
 		cb.noticeOpers(fmt.Sprintf("Not removing K-Line for [%s@%s] (not found)",
 			userMask, hostMask))
 		return false
 	}
 
-	cb.KLines = append(cb.KLines[:idx], cb.KLines[idx+1:]...)
+	cb.KLines = removeKLineFrom(cb.KLines, klineKey(userMask, hostMask))
+	cb.saveBans()
 
 	cb.noticeOpers(fmt.Sprintf("%s removed K-Line for [%s@%s]",
 		source, userMask, hostMask))
+	logEvent("kill", "%s removed K-Line for [%s@%s]", source, userMask,
+		hostMask)
 
 	return true
 }
 
+// squit delinks the server. sourceID is who to say asked for it (a UID or
+// our SID) and sourceName what to call them in notices.
+func (cb *Catbox) squit(server *Server, sourceID, sourceName, reason string) {
+	// If it's remote, the server linked to it tells operators when it delinks.
+	if server.isLocal() {
+		cb.noticeOpers(fmt.Sprintf("Received SQUIT %s from %s (%s)",
+			server.Name, sourceName, reason))
+		server.LocalServer.quit(fmt.Sprintf("%s issued SQUIT: %s", sourceName,
+			reason))
+		return
+	}
+
+	server.ClosestServer.maybeQueueMessage(irc.Message{
+		Prefix:  sourceID,
+		Command: "SQUIT",
+		Params:  []string{string(server.SID), reason},
+	})
+}
+
 // Issue a KILL from this server.
 //
 // We send a KILL message to each server.
@@ -1228,7 +2185,7 @@ func (cb *Catbox) issueKillToServer(ls *LocalServer, killer, killee *User,
 		sourceID = string(cb.Config.TS6SID)
 	} else {
 		reason = fmt.Sprintf("%s!%s!%s!%s (%s)", cb.Config.ServerName,
-			killer.Hostname, killer.Username, killer.DisplayNick, message)
+			killer.DisplayHost, killer.Username, killer.DisplayNick, message)
 		killerName = killer.DisplayNick
 		sourceID = string(killer.UID)
 	}
@@ -1262,6 +2219,9 @@ func (cb *Catbox) cleanupKilledUser(killer, killee *User, message string) {
 
 	quitReason := fmt.Sprintf("Killed (%s (%s))", killerName, message)
 
+	logEvent("kill", "%s (%s@%s) was killed by %s (%s)", killee.DisplayNick,
+		killee.Username, killee.Hostname, killerName, message)
+
 	// If it's a local user, drop it.
 	if killee.isLocal() {
 		// We don't need to propagate a QUIT. We propagated KILL.
@@ -1274,6 +2234,40 @@ func (cb *Catbox) cleanupKilledUser(killer, killee *User, message string) {
 	cb.quitRemoteUser(killee, quitReason)
 }
 
+// whoisNotice tells our user that someone WHOISed them, if they want to know
+// (+y).
+func (cb *Catbox) whoisNotice(user, source *User) {
+	if !user.isLocal() || user == source {
+		return
+	}
+	if _, exists := user.Modes['y']; !exists {
+		return
+	}
+
+	serverName := cb.Config.ServerName
+	if source.isRemote() {
+		serverName = source.Server.Name
+	}
+
+	user.LocalUser.serverNotice(fmt.Sprintf(
+		"%s (%s@%s) [%s] is doing a WHOIS on you", source.DisplayNick,
+		source.Username, source.DisplayHost, serverName))
+}
+
+// hidesServers tells whether we hide which servers users are on from the user.
+// See hidden-server-name.
+func (cb *Catbox) hidesServers(user *User) bool {
+	return cb.Config.HiddenServerName != "" && !user.isOperator()
+}
+
+// hiddenServer is the name and info we show in place of a server's.
+func (cb *Catbox) hiddenServer() (string, string) {
+	if cb.Config.NetworkName != "" {
+		return cb.Config.HiddenServerName, cb.Config.NetworkName
+	}
+	return cb.Config.HiddenServerName, "IRC"
+}
+
 // Build irc.Messages that make up a WHOIS response. You can then send them to
 // where they need to go.
 //
@@ -1305,7 +2299,7 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 			to,
 			user.DisplayNick,
 			user.Username,
-			user.Hostname,
+			user.DisplayHost,
 			"*",
 			user.RealName,
 		},
@@ -1315,14 +2309,18 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 	// I choose to not show any.
 
 	// 312 RPL_WHOISSERVER
+	serverName, serverInfo := cb.Config.ServerName, cb.Config.ServerInfo
+	if cb.hidesServers(replyUser) {
+		serverName, serverInfo = cb.hiddenServer()
+	}
 	msgs = append(msgs, irc.Message{
 		Prefix:  from,
 		Command: "312",
 		Params: []string{
 			to,
 			user.DisplayNick,
-			cb.Config.ServerName,
-			cb.Config.ServerInfo,
+			serverName,
+			serverInfo,
 		},
 	})
 
@@ -1339,6 +2337,20 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 		})
 	}
 
+	// 330 RPL_WHOISLOGGEDIN. Non standard. charybdis uses it.
+	if user.Account != "" {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "330",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				user.Account,
+				"is logged in as",
+			},
+		})
+	}
+
 	// 313 RPL_WHOISOPERATOR
 	if user.isOperator() {
 		msgs = append(msgs, irc.Message{
@@ -1352,11 +2364,27 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 		})
 	}
 
+	// 378 RPL_WHOISHOST. Non standard. charybdis uses it. Show the real host of
+	// cloaked users to operators and to themselves. Not to operators connected
+	// through Tor.
+	if user.Hostname != user.DisplayHost &&
+		(replyUser.seesRealHosts() || replyUser == user) {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "378",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				fmt.Sprintf("is connecting from *@%s %s", user.Hostname, user.IP),
+			},
+		})
+	}
+
 	// 671. Non standard. Ratbox uses it.
 	if user.isLocal() && user.LocalUser.isTLS() {
 		tlsVersion, tlsCipherSuite, err := user.LocalUser.getTLSState()
 		if err != nil {
-			log.Printf("Client %s: Unable to determine TLS state: %s", user.LocalUser,
+			clientsLog.Warnf("Client %s: Unable to determine TLS state: %s", user.LocalUser,
 				err)
 		} else {
 			msgs = append(msgs, irc.Message{
@@ -1372,6 +2400,20 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 		}
 	}
 
+	// 276 RPL_WHOISCERTFP. Non standard. charybdis uses it. Show the TLS client
+	// certificate fingerprint to operators and to the user themselves.
+	if user.CertFP != "" && (replyUser.isOperator() || replyUser == user) {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "276",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				fmt.Sprintf("has client certificate fingerprint %s", user.CertFP),
+			},
+		})
+	}
+
 	// 317 RPL_WHOISIDLE. Only if local.
 	if user.isLocal() {
 		idleDuration := time.Since(user.LocalUser.LastMessageTime)
@@ -1448,12 +2490,14 @@ func (cb *Catbox) quitRemoteUser(u *User, message string) {
 
 	for _, channel := range u.Channels {
 		for memberUID := range channel.Members {
-			member := cb.Users[memberUID]
-			if !member.isLocal() {
+			// The channel may list a user we don't know if we're desynced. See
+			// checkConsistency().
+			member, exists := cb.Users[memberUID]
+			if !exists || !member.isLocal() {
 				continue
 			}
 
-			_, exists := informedUsers[member.UID]
+			_, exists = informedUsers[member.UID]
 			if exists {
 				continue
 			}
@@ -1478,45 +2522,113 @@ func (cb *Catbox) quitRemoteUser(u *User, message string) {
 		delete(cb.Opers, u.UID)
 	}
 	delete(cb.Nicks, canonicalizeNick(u.DisplayNick))
+	cb.forgetInvites(u)
+}
+
+// forgetInvites removes any invites the user has. Call it when they leave the
+// network.
+func (cb *Catbox) forgetInvites(u *User) {
+	for _, channel := range cb.Channels {
+		delete(channel.Invites, u.UID)
+	}
 }
 
 // Rehash reloads our config.
 //
-// Only certain config options can change during rehash.
-//
-// We could close listeners and open new ones. But nah.
+// Only certain config options can change during rehash. We tell operators
+// which changed.
 func (cb *Catbox) rehash(byUser *User) {
+	cb.Systemd.reloading()
+	defer cb.Systemd.ready(cb.systemdStatus())
+
+	// We do this even if the config has a problem so rotating logs works.
+	if err := reopenLogFiles(); err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to reopen log file: %s", err))
+	}
+
 	cfg, err := checkAndParseConfig(cb.ConfigFile)
 	if err != nil {
 		cb.noticeOpers(fmt.Sprintf("Rehash: Configuration problem: %s", err))
 		return
 	}
 
-	// Changing these requires closing/reopening listeners:
-	// ListenHost
-	// ListenPort
-	// ListenPortTLS
+	live, restart := changedConfigSections(cb.Config, cfg)
+
+	// Clients already on the Tor listener keep their host.
+	cb.Config.TorHost = cfg.TorHost
+	cb.Config.TorAuth = cfg.TorAuth
+	cb.Config.TorPassword = cfg.TorPassword
 
 	cb.Config.CertificateFile = cfg.CertificateFile
 	cb.Config.KeyFile = cfg.KeyFile
-	if err := cb.loadCertificate(); err != nil {
+	cb.Config.CertificateConfigs = cfg.CertificateConfigs
+	cb.Config.CertificateCheckTime = cfg.CertificateCheckTime
+	if cb.TLSConfig != nil {
+		if err := cb.loadCertificate(); err != nil {
+			cb.noticeOpers(fmt.Sprintf("Error loading certificate/key: %s", err))
+			coreLog.Errorf("%+v", err)
+		}
+	}
+
+	// We may not have used TLS before.
+	if err := cb.setupTLS(cfg); err != nil {
 		cb.noticeOpers(fmt.Sprintf("Error loading certificate/key: %s", err))
-		log.Printf("%+v", err)
 	}
 
+	// Without a certificate we can't open a TLS listener.
+	if cb.TLSConfig == nil {
+		cfg.ListenPortTLS = cb.Config.ListenPortTLS
+	}
+	cb.rehashListeners(cfg)
+
 	// Changing these may require relinking servers as they are part of the
 	// link handshake:
 	// ServerName
 	// ServerInfo
 
+	// We tell users about RPL_ISUPPORT tokens that changed.
+	oldISupport := cb.isupportTokens()
+
+	cb.Config.NetworkName = cfg.NetworkName
+	cb.Config.NetworkDescription = cfg.NetworkDescription
+	cb.Config.NetworkAdmin = cfg.NetworkAdmin
+	cb.Config.HiddenServerName = cfg.HiddenServerName
+	cb.Config.FlattenLinks = cfg.FlattenLinks
+	cb.Config.HideSplitServers = cfg.HideSplitServers
+
 	cb.Config.MOTD = cfg.MOTD
 
+	// Users already cloaked keep their cloak until they change it.
+	cb.Config.CloakKey = cfg.CloakKey
+
 	// MaxNickLength: I think this is not acceptable to change live. Live clients
 	// might turn out to be invalid, plus there is the issue of remote clients.
 
+	// Channels, topics, and such that exist keep their lengths.
+	cb.Config.MaxChannelLength = cfg.MaxChannelLength
+	cb.Config.MaxTopicLength = cfg.MaxTopicLength
+	cb.Config.MaxKickLength = cfg.MaxKickLength
+	cb.Config.MaxAwayLength = cfg.MaxAwayLength
+
+	cb.Config.MaxWHOResults = cfg.MaxWHOResults
+	cb.Config.MaxLISTResults = cfg.MaxLISTResults
+	cb.Config.MaxWHOISTargets = cfg.MaxWHOISTargets
+	cb.Config.MaxModeListResults = cfg.MaxModeListResults
+	cb.Config.MaxTargets = cfg.MaxTargets
+	cb.Config.MaxChannels = cfg.MaxChannels
+	// Channels already over the limit keep their entries.
+	cb.Config.MaxChannelListEntries = cfg.MaxChannelListEntries
+	cb.Config.JoinPartCount = cfg.JoinPartCount
+	cb.Config.JoinPartTime = cfg.JoinPartTime
+
 	cb.Config.PingTime = cfg.PingTime
 	cb.Config.DeadTime = cfg.DeadTime
+	cb.Config.BurstTimeout = cfg.BurstTimeout
 	cb.Config.ConnectAttemptTime = cfg.ConnectAttemptTime
+	cb.Config.ConnectClasses = cfg.ConnectClasses
+	cb.Config.ConnectMaxBackoff = cfg.ConnectMaxBackoff
+	cb.Config.LinkBindAddress = cfg.LinkBindAddress
+	cb.Config.ConsistencyCheckTime = cfg.ConsistencyCheckTime
 
 	// TS6SID: Changing this requires relinking. It is part of link handshake.
 
@@ -1525,12 +2637,90 @@ func (cb *Catbox) rehash(byUser *User) {
 	cb.Config.Opers = cfg.Opers
 	cb.Config.Servers = cfg.Servers
 	cb.Config.UserConfigs = cfg.UserConfigs
+	cb.rehashUserConfigs()
+	cb.Config.UserSendQueue = cfg.UserSendQueue
+	cb.Config.ServerSendQueue = cfg.ServerSendQueue
+	cb.Config.ConnectClassSendQueues = cfg.ConnectClassSendQueues
+	cb.rehashSendQueues()
+	// Users keep vhosts they have until they log in again or reconnect.
+	cb.Config.VhostConfigs = cfg.VhostConfigs
+	cb.Config.ExemptConfigs = cfg.ExemptConfigs
+	// Users keep reserved nicks and stay in reserved channels they already
+	// have.
+	cb.Config.ReserveConfigs = cfg.ReserveConfigs
+	cb.Config.SpamFilterConfigs = cfg.SpamFilterConfigs
+	cb.Config.PolicyRules = cfg.PolicyRules
+	cb.Config.StatsFile = cfg.StatsFile
+	cb.Config.ChannelsFile = cfg.ChannelsFile
+
+	// We save history to the new file next time. We don't load it.
+	cb.Config.ChannelHistoryLength = cfg.ChannelHistoryLength
+	cb.Config.ChannelHistoryTime = cfg.ChannelHistoryTime
+	cb.Config.ChannelHistoryPlayback = cfg.ChannelHistoryPlayback
+	cb.Config.ChannelHistoryFile = cfg.ChannelHistoryFile
+
+	// We save bans to the new file the next time they change. We don't load it.
+	cb.Config.BansFile = cfg.BansFile
+
+	// The API keeps listening where it was until we restart.
+	if cb.Config.APIListen != "" && cfg.APIListen != "" {
+		cb.Config.APIToken = cfg.APIToken
+		cb.APIToken.Store(cfg.APIToken)
+	}
+
+	cb.Config.LogLevels = cfg.LogLevels
+	cb.Config.LogFormat = cfg.LogFormat
+	cb.Config.LogRotateSize = cfg.LogRotateSize
+	cb.Config.LogRotateCount = cfg.LogRotateCount
+	cb.Config.EventLogFiles = cfg.EventLogFiles
+	if err := configureLogging(cb.Config); err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: %s", err))
+	}
+
+	cb.Config.ConfirmShutdown = cfg.ConfirmShutdown
+	cb.Config.ShutdownMessage = cfg.ShutdownMessage
+	cb.Config.ShutdownFlushTime = cfg.ShutdownFlushTime
+
+	// If the NickServ file changes, we use the accounts in the new one.
+	if cfg.NickServFile != cb.Config.NickServFile {
+		nickAccounts, err := loadNickAccounts(cb.Store, cfg.NickServFile)
+		if err != nil {
+			cb.noticeOpers(fmt.Sprintf("Rehash: %s", err))
+		} else {
+			cb.Config.NickServFile = cfg.NickServFile
+			cb.NickAccounts = nickAccounts
+		}
+	}
+	cb.Config.NickServGraceTime = cfg.NickServGraceTime
+
+	// Likewise for ChanServ.
+	if cfg.ChanServFile != cb.Config.ChanServFile {
+		channelRegistrations, err := loadChannelRegistrations(cb.Store,
+			cfg.ChanServFile)
+		if err != nil {
+			cb.noticeOpers(fmt.Sprintf("Rehash: %s", err))
+		} else {
+			cb.Config.ChanServFile = cfg.ChanServFile
+			cb.ChannelRegistrations = channelRegistrations
+		}
+	}
+	cb.Config.NoColorsAction = cfg.NoColorsAction
+	cb.Config.InvalidUTF8Action = cfg.InvalidUTF8Action
+
+	// AsyncHostnameLookup: Goroutines other than the server goroutine read this,
+	// so we don't change it live.
+
+	// DNSWorkers, DNSTimeout, DNSCacheTime, DNSNegativeCacheTime: The resolver
+	// took these when we started. We don't change them live.
+
+	cb.sendISupportChanges(oldISupport)
 
 	if byUser != nil {
-		cb.noticeOpers(fmt.Sprintf("%s rehashed configuration.",
-			byUser.DisplayNick))
+		cb.noticeOpers(fmt.Sprintf("%s rehashed configuration. %s",
+			byUser.DisplayNick, describeConfigChanges(live, restart)))
 	} else {
-		cb.noticeOpers("Rehashed configuration.")
+		cb.noticeOpers(fmt.Sprintf("Rehashed configuration. %s",
+			describeConfigChanges(live, restart)))
 	}
 }
 
@@ -1542,10 +2732,44 @@ func (cb *Catbox) restart(byUser *User) {
 		cb.noticeOpers("Restarting.")
 	}
 
-	// We shutdown everything, then flag to restart. This means when we exit our
-	// main loop we'll start a new process.
-	cb.shutdown()
+	// We flag to restart, then shutdown everything. This means when we exit
+	// our main loop we'll start a new process.
 	cb.Restart = true
+	cb.shutdown()
+}
+
+// connect starts linking to a server because an operator asked. The operator
+// may be on another server. If port is 0, we use the port in the servers
+// config.
+func (cb *Catbox) connect(oper *User, serverName string, port int) {
+	// Is it a server we know about?
+	linkInfo, exists := cb.Config.Servers[serverName]
+	if !exists {
+		// 402 ERR_NOSUCHSERVER
+		cb.numericToUser(oper, "402", []string{serverName, "No such server"})
+		return
+	}
+
+	// Are we already linked to it?
+	if cb.isLinkedToServer(serverName) {
+		// No great error code.
+		cb.noticeToUser(oper, fmt.Sprintf("I am already linked to %s.",
+			serverName))
+		return
+	}
+
+	if port != 0 {
+		li := *linkInfo
+		li.Port = port
+		linkInfo = &li
+	}
+
+	cb.noticeOpers(fmt.Sprintf("%s requested CONNECT to %s:%d", oper.DisplayNick,
+		serverName, linkInfo.Port))
+
+	// We could check if we're already trying to link to it. But the result should
+	// be the same.
+	cb.connectToServer(linkInfo)
 }
 
 // Look up a server by its name. e.g., irc.example.com
@@ -1561,9 +2785,8 @@ func (cb *Catbox) getServerByName(name string) *Server {
 // Send a message to all local users in a channel.
 func (cb *Catbox) messageLocalUsersOnChannel(channel *Channel, m irc.Message) {
 	for memberUID := range channel.Members {
-		member := cb.Users[memberUID]
-
-		if !member.isLocal() {
+		member, exists := cb.Users[memberUID]
+		if !exists || !member.isLocal() {
 			continue
 		}
 
@@ -1571,134 +2794,280 @@ func (cb *Catbox) messageLocalUsersOnChannel(channel *Channel, m irc.Message) {
 	}
 }
 
+// Send a numeric reply to a user. If they are remote, we send it towards their
+// server.
+func (cb *Catbox) numericToUser(u *User, numeric string, params []string) {
+	if u.isLocal() {
+		u.LocalUser.messageFromServer(numeric, params)
+		return
+	}
+
+	u.ClosestServer.maybeQueueMessage(irc.Message{
+		Prefix:  string(cb.Config.TS6SID),
+		Command: numeric,
+		Params:  append([]string{string(u.UID)}, params...),
+	})
+}
+
+// Send a server notice to a user. If they are remote, we send it towards their
+// server.
+func (cb *Catbox) noticeToUser(u *User, s string) {
+	if u.isLocal() {
+		u.LocalUser.serverNotice(s)
+		return
+	}
+
+	u.ClosestServer.maybeQueueMessage(irc.Message{
+		Prefix:  string(cb.Config.TS6SID),
+		Command: "NOTICE",
+		Params:  []string{string(u.UID), fmt.Sprintf("*** Notice --- %s", s)},
+	})
+}
+
+// Nick TS of a user we saved from a nick collision by changing their nick to
+// their UID. TS6 specifies this.
+const saveNickTS = 100
+
+// collisionResult tells what handleCollision decided about the new user (or
+// nick change).
+type collisionResult int
+
+const (
+	// There was no collision, or we dealt with it by colliding the existing
+	// user. Accept the new user/change.
+	collisionAccept collisionResult = iota
+
+	// We collided the new user. Do not accept the new user/change.
+	collisionReject
+
+	// We saved the new user. Accept the new user, but with their UID as their
+	// nick and saveNickTS as their nick TS. Only for UID.
+	collisionAcceptSaved
+)
+
 // Determine if there is a collision for the given nick.
 //
-// If there is, issue the appropriate kills.
+// If there is, collide the appropriate users.
 //
 // When will this happen? If we're told by a server about a new user (UID
 // command), or if we're told by a server about a user changing nick (NICK
 // command).
 //
-// The command causing the collision changes behaviour slightly. If it is UID,
-// then other servers have not heard of the new client, so when we kill the
-// new user, we can follow the TS6 collision rules and only send a KILL for the
-// new user to the server that sent us UID. If it is a NICK however, then we
-// need to tell all servers about the KILL of the "new" user, because they know
-// about this user.
+// We follow the TS6 rules to decide who loses the nick. If the nick TSes are
+// equal, both lose. If the user@hosts differ, the user with the newer (higher)
+// TS loses since the older user had the nick first. If the user@hosts are the
+// same, the user with the older (lower) TS loses. This is likely the same
+// person reconnecting, so we keep the newer connection.
 //
-// Return true if we accept the user/change. This means there either was no
-// collision, or there was and we dealt with it by only killing a different
-// user. If we killed a different (existing) user, then we accept the new
-// user/its change. If we return true, such as when processing a UID command,
-// then we should accept the user and propagate the message. If we return false,
-// do not accept the user and do not propagate.
+// If the server that sent us the command supports SAVE, we save a losing user
+// rather than killing them: we change their nick to their UID. Otherwise we
+// kill them.
+//
+// The command causing the collision changes how far a KILL or SAVE of the new
+// user goes. If it is UID, then other servers have not heard of the new
+// client, so we tell only the server that sent us UID. If it is a NICK, then
+// we need to tell all servers, because they know about this user.
 func (cb *Catbox) handleCollision(fromServer *LocalServer, newUID TS6UID,
 	newNick, newUsername, newHostname string, newNickTS int64,
-	command string) bool {
+	command string) collisionResult {
 	// There is a collision if the nick is taken already.
 	existingUID, exists := cb.Nicks[canonicalizeNick(newNick)]
 	if !exists {
-		return true
+		return collisionAccept
 	}
 
 	// Collision.
 	cb.noticeOpers(fmt.Sprintf("Collision for nick %s (%s and %s)",
 		canonicalizeNick(newNick), existingUID, newUID))
 
-	// The TS6 protocol defines the rules, including when we issue two KILLs
-	// (existing user and new user), and to what servers we send the KILL message.
-
-	// Note the nick collision rules state that when we collide only the existing
-	// user we should issue a KILL to all except the one sending us data. It goes
-	// on to say that if the sender supports TS6, also send a KILL to it. Since I
-	// only support TS6 connections, this means we can send KILL to all servers in
-	// this case.
-
 	// Note it's possible to have two KILL messages. One generated by us, and one
 	// from the other side. We'll see an unknown user message for the second
 	// processed.
 
 	existingUser, exists := cb.Users[existingUID]
 	if !exists {
-		log.Printf("User not found with UID %s. But UID has a nick! (%s)",
+		coreLog.Errorf("User not found with UID %s. But UID has a nick! (%s)",
 			existingUID, canonicalizeNick(newNick))
-		// TODO(horgh): Should we abort?
+		// There is no one to collide. Let the new user have the nick.
+		delete(cb.Nicks, canonicalizeNick(newNick))
+		return collisionAccept
 	}
 
-	// If this is a UID command then we do not yet have a User record yet for the
-	// new user. We're in the process of creating it.
-	var newUser *User
-	if command == "UID" {
-		newUser = &User{DisplayNick: newNick, UID: newUID}
-	} else {
-		newUser = cb.Users[newUID]
-	}
+	useSave := fromServer.Server.hasCapability("SAVE")
 
-	// Is the received TS is lower than that of the existing user?
-	if newNickTS < existingUser.NickTS {
-		// Two cases. If the user@host differs, collide the existing user. If they
-		// are the same, collide the new user.
+	if newNickTS == existingUser.NickTS {
+		message := "Nick collision, both killed"
+		cb.collideExistingUser(existingUser, message, useSave)
+		return cb.collideNewUser(fromServer, newUID, newNick, newNickTS, message,
+			command, useSave)
+	}
 
-		if newUsername != existingUser.Username ||
-			newHostname != existingUser.Hostname {
-			// Since we require TS6, send to all servers.
-			message := "Nick collision, newer killed (received TS is lower)"
-			sendMessages(cb.issueKillToAllServers(nil, existingUser, message))
-			cb.cleanupKilledUser(nil, existingUser, message)
-			return true
-		}
+	sameUser := newUsername == existingUser.Username &&
+		newHostname == existingUser.DisplayHost
 
+	if sameUser && newNickTS < existingUser.NickTS {
 		message := "Nick collision, older killed (received TS is lower)"
-		if command == "UID" {
-			sendMessages(cb.issueKillToServer(fromServer, nil, newUser, message))
-		} else {
-			sendMessages(cb.issueKillToAllServers(nil, newUser, message))
-			cb.cleanupKilledUser(nil, newUser, message)
+		return cb.collideNewUser(fromServer, newUID, newNick, newNickTS, message,
+			command, useSave)
+	}
+
+	if !sameUser && newNickTS > existingUser.NickTS {
+		message := "Nick collision, newer killed (received TS is higher)"
+		return cb.collideNewUser(fromServer, newUID, newNick, newNickTS, message,
+			command, useSave)
+	}
+
+	message := "Nick collision, newer killed (received TS is lower)"
+	if sameUser {
+		message = "Nick collision, older killed (received TS is higher)"
+	}
+	cb.collideExistingUser(existingUser, message, useSave)
+	return collisionAccept
+}
+
+// collideExistingUser saves or kills the user we knew about before a
+// collision. Every server knows about them, so we tell every server.
+//
+// We can't save a remote user if the server we reach them through doesn't
+// support SAVE.
+func (cb *Catbox) collideExistingUser(user *User, message string,
+	useSave bool) {
+	if useSave &&
+		(user.isLocal() || user.ClosestServer.Server.hasCapability("SAVE")) {
+		cb.saveUser(nil, user)
+		return
+	}
+
+	sendMessages(cb.issueKillToAllServers(nil, user, message))
+	cb.cleanupKilledUser(nil, user, message)
+}
+
+// collideNewUser saves or kills the user the server told us about with UID or
+// NICK.
+func (cb *Catbox) collideNewUser(fromServer *LocalServer, newUID TS6UID,
+	newNick string, newNickTS int64, message, command string,
+	useSave bool) collisionResult {
+	// A new user. We don't have a User record yet. Only the server that sent
+	// us UID knows about them.
+	if command == "UID" {
+		if useSave {
+			fromServer.maybeQueueMessage(irc.Message{
+				Prefix:  string(cb.Config.TS6SID),
+				Command: "SAVE",
+				Params:  []string{string(newUID), fmt.Sprintf("%d", newNickTS)},
+			})
+			return collisionAcceptSaved
 		}
-		return false
+
+		newUser := &User{DisplayNick: newNick, UID: newUID}
+		sendMessages(cb.issueKillToServer(fromServer, nil, newUser, message))
+		return collisionReject
 	}
 
-	// Is the received TS the same as that of the existing user?
-	if newNickTS == existingUser.NickTS {
-		// Both collide. Issue KILL to all servers for the existing user. Issue KILL
-		// to server who sent us the new user (unless it's NICK, then to all).
-		message := "Nick collision, both killed"
+	newUser := cb.Users[newUID]
 
-		sendMessages(cb.issueKillToAllServers(nil, existingUser, message))
-		cb.cleanupKilledUser(nil, existingUser, message)
+	// The server that sent us the NICK has already changed their nick. Other
+	// servers have not, so they know them with their current nick TS.
+	if useSave {
+		fromServer.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "SAVE",
+			Params:  []string{string(newUID), fmt.Sprintf("%d", newNickTS)},
+		})
+		cb.saveUser(fromServer, newUser)
+		return collisionReject
+	}
 
-		if command == "UID" {
-			sendMessages(cb.issueKillToServer(fromServer, nil, newUser, message))
-		} else {
-			sendMessages(cb.issueKillToAllServers(nil, newUser, message))
-			cb.cleanupKilledUser(nil, newUser, message)
+	sendMessages(cb.issueKillToAllServers(nil, newUser, message))
+	cb.cleanupKilledUser(nil, newUser, message)
+	return collisionReject
+}
+
+// saveUser changes the user's nick to their UID to resolve a nick collision.
+// We tell servers other than from (which may be nil): those supporting SAVE
+// with SAVE, and the rest with NICK.
+func (cb *Catbox) saveUser(from *LocalServer, user *User) {
+	cb.noticeOpers(fmt.Sprintf("Saving %s from a nick collision. Changing their nick to %s",
+		user.DisplayNick, user.UID))
+
+	for _, ls := range cb.LocalServers {
+		if ls == from {
+			continue
 		}
 
-		return false
+		if ls.Server.hasCapability("SAVE") {
+			ls.maybeQueueMessage(irc.Message{
+				Prefix:  string(cb.Config.TS6SID),
+				Command: "SAVE",
+				Params:  []string{string(user.UID), fmt.Sprintf("%d", user.NickTS)},
+			})
+			continue
+		}
+
+		ls.maybeQueueMessage(irc.Message{
+			Prefix:  string(user.UID),
+			Command: "NICK",
+			Params:  []string{string(user.UID), fmt.Sprintf("%d", saveNickTS)},
+		})
 	}
 
-	// The received TS is higher than that of the existing user.
+	if user.isLocal() {
+		// 043 ERR_NICKCOLLISION
+		user.LocalUser.messageFromServer("043", []string{string(user.UID),
+			"Nick collision, forcing nick change to your unique ID"})
+	}
 
-	// Two cases again. If the user@hosts are identical, collide the existing
-	// user. If they are different, collide the new user.
+	cb.renameUser(user, string(user.UID), saveNickTS)
+}
 
-	if newUsername == existingUser.Username &&
-		newHostname == existingUser.Hostname {
-		// Since we require TS6, send to all servers.
-		message := "Nick collision, older killed (received TS is higher)"
-		sendMessages(cb.issueKillToAllServers(nil, existingUser, message))
-		cb.cleanupKilledUser(nil, existingUser, message)
-		return true
+// renameUser changes the user's nick and nick TS and tells local users who
+// need to know. It does not tell servers.
+func (cb *Catbox) renameUser(user *User, nick string, nickTS int64) {
+	// Tell our local clients who are in a channel with this user, and the user
+	// if they're ours. Tell each user only once.
+	// Do this prior to updating the user record as it needs to come from the
+	// old nick!user@host.
+	toldUsers := make(map[TS6UID]struct{})
+	if user.isLocal() {
+		toldUsers[user.UID] = struct{}{}
+		user.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  user.nickUhost(),
+			Command: "NICK",
+			Params:  []string{nick},
+		})
 	}
+	for _, channel := range user.Channels {
+		for memberUID := range channel.Members {
+			member, exists := cb.Users[memberUID]
+			if !exists || !member.isLocal() {
+				continue
+			}
 
-	message := "Nick collision, newer killed (received TS is higher)"
-	if command == "UID" {
-		sendMessages(cb.issueKillToServer(fromServer, nil, newUser, message))
-	} else {
-		sendMessages(cb.issueKillToAllServers(nil, newUser, message))
-		cb.cleanupKilledUser(nil, newUser, message)
+			_, exists = toldUsers[member.UID]
+			if exists {
+				continue
+			}
+			toldUsers[member.UID] = struct{}{}
+
+			member.LocalUser.maybeQueueMessage(irc.Message{
+				Prefix:  user.nickUhost(),
+				Command: "NICK",
+				Params:  []string{nick},
+			})
+		}
+	}
+
+	// Update our records, their nick, and their nick TS.
+
+	delete(cb.Nicks, canonicalizeNick(user.DisplayNick))
+	cb.Nicks[canonicalizeNick(nick)] = user.UID
+
+	user.DisplayNick = nick
+	user.NickTS = nickTS
+
+	if user.isLocal() {
+		cb.checkNickOwnership(user.LocalUser)
 	}
-	return false
 }
 
 func sendMessages(messages []Message) {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"testing"
 	"time"
 )
@@ -70,3 +71,14 @@ func TestErrorToQuitMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestExampleConfig(t *testing.T) {
+	buf, err := ioutil.ReadFile("conf/catbox.conf")
+	if err != nil {
+		t.Fatalf("unable to read example config: %s", err)
+	}
+
+	if string(buf) != exampleConfig {
+		t.Errorf("exampleConfig differs from conf/catbox.conf")
+	}
+}
@@ -2,38 +2,125 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
+	"github.com/horgh/irc"
 	"github.com/pkg/errors"
 )
 
+// maxClientLineLength is the longest line we accept from a client. This is the
+// protocol's limit. We discard anything past it.
+const maxClientLineLength = irc.MaxLineLength
+
+// maxServerLineLength is the longest line we accept from a server. We are more
+// lenient with servers as we trust them more, and other implementations may
+// send longer lines.
+const maxServerLineLength = 8192
+
+// maxReadSize is the most we read looking for the end of a single line. If a
+// peer sends more than this without a newline, we give up on it. This stops a
+// peer from making us read endlessly.
+const maxReadSize = 65536
+
 // Conn is a connection to a client/server
 type Conn struct {
 	conn   net.Conn
 	rw     *bufio.ReadWriter
 	ioWait time.Duration
 	IP     net.IP
+
+	// The longest line we accept. The reader goroutine reads this while the
+	// server goroutine may change it (when a client registers as a server), so
+	// access it atomically.
+	maxLineLength *int32
+
+	// 1 once the server goroutine tells the reader to stop (see stopReading()).
+	// Access it atomically.
+	stopped *int32
 }
 
+// errReadStopped means we stopped reading because the server goroutine told
+// us to.
+var errReadStopped = errors.New("reading stopped")
+
 // NewConn initializes a Conn struct
 func NewConn(conn net.Conn, ioWait time.Duration) Conn {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", conn.RemoteAddr().String())
 	// This shouldn't happen.
 	if err != nil {
-		log.Fatalf("Unable to resolve TCP address: %s", err)
+		coreLog.Fatalf("Unable to resolve TCP address: %s", err)
 	}
 
+	maxLineLength := int32(maxClientLineLength)
+	stopped := int32(0)
+
 	return Conn{
 		conn:   conn,
 		rw:     bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
 		ioWait: ioWait,
 		IP:     tcpAddr.IP,
+
+		maxLineLength: &maxLineLength,
+		stopped:       &stopped,
+	}
+}
+
+// withConn makes a Conn using a different underlying connection to the same
+// peer. e.g., after STARTTLS.
+func (c Conn) withConn(conn net.Conn) Conn {
+	return Conn{
+		conn:   conn,
+		rw:     bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		ioWait: c.ioWait,
+		IP:     c.IP,
+
+		maxLineLength: c.maxLineLength,
+		stopped:       c.stopped,
+	}
+}
+
+// setMaxLineLength changes the longest line we accept.
+func (c Conn) setMaxLineLength(n int) {
+	atomic.StoreInt32(c.maxLineLength, int32(n))
+}
+
+// stopReading makes the reader stop. Its current or next Read returns
+// errReadStopped or, if it was part way through a line, the partial line and
+// a timeout. Only the server goroutine should call this.
+func (c Conn) stopReading() {
+	atomic.StoreInt32(c.stopped, 1)
+	// Read sets its deadline before checking whether we stopped it. Whether it
+	// sees the flag or not, this deadline comes after its own.
+	if err := c.conn.SetReadDeadline(time.Now()); err != nil {
+		clientsLog.Warnf("Error setting read deadline: %s", err)
 	}
 }
 
+// readingStopped tells whether the server goroutine stopped the reader.
+func (c Conn) readingStopped() bool {
+	return atomic.LoadInt32(c.stopped) == 1
+}
+
+// unread gives what we read but didn't process: the partial line Read
+// returned along with what's left in our buffer. Only the reader should call
+// this, and only after it stops.
+func (c Conn) unread(partial string) []byte {
+	buf := []byte(partial)
+	peeked, _ := c.rw.Reader.Peek(c.rw.Reader.Buffered())
+	return append(buf, peeked...)
+}
+
+// prependRead makes us read buf before anything else from the connection.
+// e.g., what another process read from it but didn't process.
+func (c Conn) prependRead(buf []byte) {
+	c.rw.Reader = bufio.NewReader(io.MultiReader(bytes.NewReader(buf), c.conn))
+}
+
 // Close closes the underlying connection
 func (c Conn) Close() error {
 	return c.conn.Close()
@@ -45,25 +132,69 @@ func (c Conn) RemoteAddr() net.Addr {
 }
 
 // Read reads a line from the connection.
+//
+// If the line is longer than we accept, we truncate it (keeping its line
+// ending) and discard the rest. If the line is longer than maxReadSize, we
+// return an error.
 func (c Conn) Read() (string, error) {
 	if err := c.conn.SetReadDeadline(time.Now().Add(c.ioWait)); err != nil {
 		// Do not treat this as fatal. There can be something available to read in
 		// the buffer which we want to see.
-		log.Printf("Error setting read deadline: %s", err)
+		clientsLog.Warnf("Error setting read deadline: %s", err)
 	}
 
-	line, err := c.rw.ReadString('\n')
-	if err != nil {
-		// There may be something read even with error.
-		return line, errors.Wrap(err, "error reading")
+	if c.readingStopped() {
+		return "", errReadStopped
 	}
 
-	return line, nil
+	maxLineLength := int(atomic.LoadInt32(c.maxLineLength))
+
+	var line []byte
+	truncated := false
+	readSize := 0
+
+	for {
+		// ReadSlice gives us at most a buffer's worth at a time, so we never hold
+		// more than the limit plus one buffer.
+		chunk, err := c.rw.ReadSlice('\n')
+		readSize += len(chunk)
+		if readSize > maxReadSize {
+			return "", fmt.Errorf("line too long (read %d bytes)", readSize)
+		}
+
+		if len(line)+len(chunk) > maxLineLength {
+			chunk = chunk[:maxLineLength-len(line)]
+			truncated = true
+		}
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != nil {
+			// There may be something read even with error.
+			return string(line), errors.Wrap(err, "error reading")
+		}
+
+		break
+	}
+
+	if truncated {
+		return string(line[:len(line)-2]) + "\r\n", nil
+	}
+
+	return string(line), nil
 }
 
 // Write writes a string to the connection
 func (c Conn) Write(s string) error {
-	if err := c.conn.SetWriteDeadline(time.Now().Add(c.ioWait)); err != nil {
+	return c.writeBefore(s, time.Now().Add(c.ioWait))
+}
+
+// writeBefore writes a string to the connection. We give up at the deadline.
+func (c Conn) writeBefore(s string, deadline time.Time) error {
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
 		return fmt.Errorf("error setting write deadline: %s", err)
 	}
 
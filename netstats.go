@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// DayStats holds statistics about the network for one day, as seen from our
+// server.
+type DayStats struct {
+	// YYYY-MM-DD in local time.
+	Date string
+
+	// The most users on the network at once.
+	PeakUsers int
+
+	// Connections we accepted.
+	Connections int
+
+	// PRIVMSGs and NOTICEs we delivered.
+	Messages int
+
+	// Servers splitting from the network.
+	Splits int
+
+	// K-Lines added.
+	KLines int
+}
+
+// NetStats holds statistics for the days we remember.
+type NetStats struct {
+	// Oldest first. The last day is the current one.
+	Days []DayStats
+}
+
+// How many days of statistics we remember.
+const maxStatsDays = 90
+
+// How many days STATS n shows.
+const statsDaysShown = 7
+
+// How often we save statistics. We also save them when the day changes and at
+// shutdown.
+const statsSaveTime = time.Hour
+
+// loadNetStats reads statistics we saved. If there are none, we start fresh.
+func loadNetStats(store Store, name string) (*NetStats, error) {
+	stats := &NetStats{}
+
+	if name == "" {
+		return stats, nil
+	}
+
+	if _, err := store.Load(name, stats); err != nil {
+		return nil, fmt.Errorf("unable to load statistics: %s", err)
+	}
+
+	return stats, nil
+}
+
+// save saves the statistics under the name.
+func (ns *NetStats) save(store Store, name string) error {
+	return store.Save(name, ns)
+}
+
+// current returns the statistics we're currently accumulating into.
+//
+// We don't change days here. That happens in rollover(), so that we can tell
+// operators about the day that ended.
+func (ns *NetStats) current(now time.Time) *DayStats {
+	if len(ns.Days) == 0 {
+		ns.Days = append(ns.Days, DayStats{Date: now.Format("2006-01-02")})
+	}
+	return &ns.Days[len(ns.Days)-1]
+}
+
+// rollover starts a new day if the date changed. If it did, it returns the
+// statistics for the day that ended.
+func (ns *NetStats) rollover(now time.Time, userCount int) *DayStats {
+	date := now.Format("2006-01-02")
+
+	day := ns.current(now)
+	if day.Date == date {
+		return nil
+	}
+
+	ended := *day
+
+	ns.Days = append(ns.Days, DayStats{Date: date, PeakUsers: userCount})
+	if len(ns.Days) > maxStatsDays {
+		ns.Days = ns.Days[len(ns.Days)-maxStatsDays:]
+	}
+
+	return &ended
+}
+
+func (d DayStats) String() string {
+	return fmt.Sprintf(
+		"%s: Peak users: %d, Connections: %d, Messages: %d, Splits: %d, K-Lines: %d",
+		d.Date, d.PeakUsers, d.Connections, d.Messages, d.Splits, d.KLines)
+}
+
+// statsToday returns the statistics we're currently accumulating into.
+func (cb *Catbox) statsToday() *DayStats {
+	return cb.Stats.current(time.Now())
+}
+
+// recordUserCount updates the peak user count. Call it whenever a user joins
+// the network.
+func (cb *Catbox) recordUserCount() {
+	day := cb.statsToday()
+	if len(cb.Users) > day.PeakUsers {
+		day.PeakUsers = len(cb.Users)
+	}
+}
+
+// updateNetStats starts a new day of statistics when the date changes, telling
+// operators how the last day went. It also saves the statistics periodically.
+func (cb *Catbox) updateNetStats() {
+	if ended := cb.Stats.rollover(time.Now(), len(cb.Users)); ended != nil {
+		cb.noticeLocalOpers(fmt.Sprintf("Daily statistics for %s", ended))
+		cb.saveNetStats()
+		return
+	}
+
+	if time.Since(cb.LastStatsSave) >= statsSaveTime {
+		cb.saveNetStats()
+	}
+}
+
+// saveNetStats saves statistics if we have a file to save them to.
+func (cb *Catbox) saveNetStats() {
+	cb.LastStatsSave = time.Now()
+
+	if cb.Config.StatsFile == "" {
+		return
+	}
+
+	if err := cb.Stats.save(cb.Store, cb.Config.StatsFile); err != nil {
+		coreLog.Errorf("Unable to save statistics: %s", err)
+	}
+}
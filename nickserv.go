@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// NickServ is our built in nick registration service. It is for networks
+// without services. We run it if there is a nickserv-file.
+//
+// Users register their nick with a password and log in to it later. Logging
+// in sets their account like services would (and we tell the network with
+// ENCAP SU). If someone takes a registered nick and does not identify within
+// the grace time, we change their nick.
+//
+// Each server keeps its own accounts and looks after only its own users.
+
+const nickServNick = "NickServ"
+
+// NickAccount is an account registered with NickServ.
+type NickAccount struct {
+	// The nick as it was registered. This is the account name.
+	Name string
+
+	// Hashed (see hashPassword()).
+	Password string
+
+	// Unix time.
+	Registered int64
+}
+
+// loadNickAccounts reads the accounts we saved. The map is canonical nick to
+// account. If there are none, we start with none.
+func loadNickAccounts(store Store, name string) (map[string]*NickAccount,
+	error) {
+	accounts := map[string]*NickAccount{}
+
+	if name == "" {
+		return accounts, nil
+	}
+
+	if _, err := store.Load(name, &accounts); err != nil {
+		return nil, fmt.Errorf("unable to load nickserv accounts: %s", err)
+	}
+
+	return accounts, nil
+}
+
+// saveNickAccounts saves the accounts. Call it whenever they change.
+func (cb *Catbox) saveNickAccounts() {
+	if err := cb.Store.Save(cb.Config.NickServFile,
+		cb.NickAccounts); err != nil {
+		coreLog.Errorf("Unable to save nickserv accounts: %s", err)
+		cb.noticeLocalOpers(fmt.Sprintf("Unable to save nickserv accounts: %s",
+			err))
+	}
+}
+
+// isNickServ tells whether the nick is NickServ's while we run it.
+func (cb *Catbox) isNickServ(nick string) bool {
+	return cb.Config.NickServFile != "" &&
+		canonicalizeNick(nick) == canonicalizeNick(nickServNick)
+}
+
+// nickServNotice sends the user a notice from NickServ.
+func (u *LocalUser) nickServNotice(s string) {
+	u.maybeQueueMessage(irc.Message{
+		Prefix: fmt.Sprintf("%s!%s@%s", nickServNick, nickServNick,
+			u.Catbox.Config.ServerName),
+		Command: "NOTICE",
+		Params:  []string{u.User.DisplayNick, s},
+	})
+}
+
+// nickServCommand handles a NickServ command. Users send these with NS or by
+// messaging NickServ.
+//
+// Parameters: <REGISTER|IDENTIFY|DROP|HELP> [parameters]
+func (u *LocalUser) nickServCommand(params []string) {
+	if u.Catbox.Config.NickServFile == "" {
+		// 421 ERR_UNKNOWNCOMMAND
+		u.messageFromServer("421", []string{"NS", "Unknown command"})
+		return
+	}
+
+	if len(params) == 0 {
+		u.nickServNotice("Commands: REGISTER <password>, IDENTIFY [nick] <password>, DROP <password>")
+		return
+	}
+
+	subCommand := strings.ToUpper(params[0])
+	params = params[1:]
+
+	if subCommand == "REGISTER" {
+		u.nickServRegister(params)
+		return
+	}
+
+	if subCommand == "IDENTIFY" {
+		u.nickServIdentify(params)
+		return
+	}
+
+	if subCommand == "DROP" {
+		u.nickServDrop(params)
+		return
+	}
+
+	u.nickServNotice("Commands: REGISTER <password>, IDENTIFY [nick] <password>, DROP <password>")
+}
+
+func (u *LocalUser) nickServRegister(params []string) {
+	if len(params) != 1 {
+		u.nickServNotice("Syntax: REGISTER <password>")
+		return
+	}
+
+	if !u.nickServCanRegister() {
+		return
+	}
+
+	if u.CheckingPassword {
+		u.nickServNotice("Still checking your last password. Please try again.")
+		return
+	}
+
+	// Hashing is slow on purpose, so we do it outside the server goroutine.
+	// Things may have changed by the time it's done.
+	u.CheckingPassword = true
+	nick := u.User.DisplayNick
+	u.Catbox.hashPasswordAsync(params[0], func(hash string, err error) {
+		if !u.isConnected() {
+			return
+		}
+		u.CheckingPassword = false
+
+		if err != nil {
+			coreLog.Errorf("Unable to hash password: %s", err)
+			u.nickServNotice("Unable to register right now.")
+			return
+		}
+
+		if u.User.DisplayNick != nick {
+			u.nickServNotice("Your nick changed. Please try again.")
+			return
+		}
+
+		if !u.nickServCanRegister() {
+			return
+		}
+
+		account := &NickAccount{
+			Name:       u.User.DisplayNick,
+			Password:   hash,
+			Registered: time.Now().Unix(),
+		}
+		u.Catbox.NickAccounts[canonicalizeNick(u.User.DisplayNick)] = account
+		u.Catbox.saveNickAccounts()
+
+		u.nickServNotice(fmt.Sprintf("%s is now registered to you.", account.Name))
+		u.Catbox.nickServLogin(u, account.Name)
+	})
+}
+
+// nickServCanRegister checks the user may register their nick. If not, we
+// tell them why.
+func (u *LocalUser) nickServCanRegister() bool {
+	if u.User.Account != "" {
+		u.nickServNotice(fmt.Sprintf("You are already logged in as %s.",
+			u.User.Account))
+		return false
+	}
+
+	if _, exists := u.Catbox.NickAccounts[canonicalizeNick(
+		u.User.DisplayNick)]; exists {
+		u.nickServNotice(fmt.Sprintf("%s is already registered.",
+			u.User.DisplayNick))
+		return false
+	}
+
+	return true
+}
+
+func (u *LocalUser) nickServIdentify(params []string) {
+	if len(params) != 1 && len(params) != 2 {
+		u.nickServNotice("Syntax: IDENTIFY [nick] <password>")
+		return
+	}
+
+	nick := u.User.DisplayNick
+	password := params[0]
+	if len(params) == 2 {
+		nick = params[0]
+		password = params[1]
+	}
+
+	if !u.nickServMayTry() {
+		return
+	}
+
+	nickCanon := canonicalizeNick(nick)
+	account, exists := u.Catbox.NickAccounts[nickCanon]
+	if !exists {
+		u.nickServNotice(fmt.Sprintf("%s is not registered.", nick))
+		return
+	}
+
+	u.CheckingPassword = true
+	u.Catbox.checkPasswordAsync(account.Password, password, func(ok bool) {
+		if !u.isConnected() {
+			return
+		}
+		u.CheckingPassword = false
+
+		// It may have been dropped (and maybe registered again) while we
+		// checked.
+		if u.Catbox.NickAccounts[nickCanon] != account {
+			u.nickServNotice(fmt.Sprintf("%s is not registered.", nick))
+			return
+		}
+
+		if !ok {
+			u.nickServFailed(account.Name, "IDENTIFY")
+			return
+		}
+		u.nickServSucceeded()
+
+		u.Catbox.nickServLogin(u, account.Name)
+	})
+}
+
+func (u *LocalUser) nickServDrop(params []string) {
+	if len(params) != 1 {
+		u.nickServNotice("Syntax: DROP <password>")
+		return
+	}
+
+	if u.User.Account == "" {
+		u.nickServNotice("You are not logged in.")
+		return
+	}
+
+	nickCanon := canonicalizeNick(u.User.Account)
+	account, exists := u.Catbox.NickAccounts[nickCanon]
+	if !exists {
+		u.nickServNotice(fmt.Sprintf("%s is not registered here.",
+			u.User.Account))
+		return
+	}
+
+	if !u.nickServMayTry() {
+		return
+	}
+
+	u.CheckingPassword = true
+	u.Catbox.checkPasswordAsync(account.Password, params[0], func(ok bool) {
+		if !u.isConnected() {
+			return
+		}
+		u.CheckingPassword = false
+
+		if u.Catbox.NickAccounts[nickCanon] != account ||
+			canonicalizeNick(u.User.Account) != nickCanon {
+			u.nickServNotice("Your account changed. Please try again.")
+			return
+		}
+
+		if !ok {
+			u.nickServFailed(account.Name, "DROP")
+			return
+		}
+		u.nickServSucceeded()
+
+		delete(u.Catbox.NickAccounts, nickCanon)
+		u.Catbox.saveNickAccounts()
+
+		u.nickServNotice(fmt.Sprintf("%s is no longer registered.", account.Name))
+		u.Catbox.nickServLogin(u, "")
+	})
+}
+
+// nickServMayTry checks whether the user may give NickServ a password now.
+// After failing, they must wait before trying again, as with OPER. If they
+// may not, we tell them why.
+func (u *LocalUser) nickServMayTry() bool {
+	if wait := u.failureWait(u.NickServFailures,
+		u.Catbox.NickServFailures); wait > 0 {
+		u.nickServNotice(fmt.Sprintf(
+			"Too many failed attempts. Please wait %s and try again.",
+			wait.Round(time.Second)))
+		return false
+	}
+
+	if u.CheckingPassword {
+		u.nickServNotice("Still checking your last password. Please try again.")
+		return false
+	}
+
+	return true
+}
+
+// nickServFailed records that the user gave the wrong password for the
+// account.
+func (u *LocalUser) nickServFailed(account, command string) {
+	count := u.recordFailure(&u.NickServFailures, u.Catbox.NickServFailures)
+	coreLog.Infof("Failed NickServ %s as %s by %s (%s@%s) [%s] (failure %d)",
+		command, account, u.User.DisplayNick, u.User.Username, u.User.Hostname,
+		u.Conn.IP.String(), count)
+	u.nickServNotice("Invalid password.")
+}
+
+// nickServSucceeded forgets the user's failures and those from their IP.
+func (u *LocalUser) nickServSucceeded() {
+	u.NickServFailures = OperFailures{}
+	delete(u.Catbox.NickServFailures, u.Conn.IP.String())
+}
+
+// isNickServAccount tells whether the account is one our NickServ keeps. Only
+// we may log users in to these.
+func (cb *Catbox) isNickServAccount(account string) bool {
+	if cb.Config.NickServFile == "" || account == "" {
+		return false
+	}
+	_, exists := cb.NickAccounts[canonicalizeNick(account)]
+	return exists
+}
+
+// nickServLogin logs the user in to the account (or out if it is blank) and
+// tells the network.
+func (cb *Catbox) nickServLogin(u *LocalUser, account string) {
+	u.User.Account = account
+	cb.notifyAccountChange(u.User)
+
+	params := []string{"*", "SU", string(u.User.UID)}
+	if account != "" {
+		params = append(params, account)
+	}
+	for _, server := range cb.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "ENCAP",
+			Params:  params,
+		})
+	}
+
+	if account == "" {
+		u.nickServNotice("You are now logged out.")
+	} else {
+		u.nickServNotice(fmt.Sprintf("You are now logged in as %s.", account))
+		cb.applyAccountVhost(u.User)
+	}
+
+	// They may be on a nick registered to another account.
+	cb.checkNickOwnership(u)
+}
+
+// checkNickOwnership looks at whether the local user's nick is registered to
+// an account they're not logged in to. If it is, they have the grace time to
+// identify before we change it. Call it when a user takes a nick.
+func (cb *Catbox) checkNickOwnership(u *LocalUser) {
+	u.NickServDeadline = time.Time{}
+
+	if cb.Config.NickServFile == "" {
+		return
+	}
+
+	account, exists := cb.NickAccounts[canonicalizeNick(u.User.DisplayNick)]
+	if !exists || strings.EqualFold(account.Name, u.User.Account) {
+		return
+	}
+
+	u.NickServDeadline = time.Now().Add(cb.Config.NickServGraceTime)
+	u.nickServNotice(fmt.Sprintf(
+		"%s is registered. If it's yours, identify with /NS IDENTIFY <password> within %s. Otherwise we'll change your nick.",
+		u.User.DisplayNick, cb.Config.NickServGraceTime))
+}
+
+// enforceNickOwnership changes the nicks of users who took registered nicks
+// and didn't identify in time.
+func (cb *Catbox) enforceNickOwnership() {
+	now := time.Now()
+
+	for _, u := range cb.LocalUsers {
+		if u.NickServDeadline.IsZero() || now.Before(u.NickServDeadline) {
+			continue
+		}
+		u.NickServDeadline = time.Time{}
+
+		nick := ""
+		for i := 0; i < 10; i++ {
+			guest := fmt.Sprintf("Guest%d", rand.Intn(10000))
+			if _, exists := cb.Nicks[canonicalizeNick(guest)]; exists ||
+				!isValidNick(cb.Config.MaxNickLength, guest) {
+				continue
+			}
+			nick = guest
+			break
+		}
+		if nick == "" {
+			u.quit("Nick is registered", true)
+			continue
+		}
+
+		u.nickServNotice(fmt.Sprintf("You didn't identify. Changing your nick to %s.",
+			nick))
+		u.changeNick(nick)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// OperFailures tracks failed OPER attempts, either by a connection or from an
+// IP. We track failed NickServ passwords the same way.
+//
+// Each failure makes whoever failed wait longer before they may try again.
+// This makes guessing passwords slow.
+type OperFailures struct {
+	Count int
+	Last  time.Time
+}
+
+// How many failures someone may have before they must wait. This lets people
+// make a typo or two.
+const operFailuresAllowed = 2
+
+// How long someone must wait to try OPER again once they've used up their
+// allowed failures. Each further failure doubles it, up to
+// operFailureMaxDelay.
+const operFailureDelay = 5 * time.Second
+
+// The longest someone must wait to try OPER again.
+const operFailureMaxDelay = 10 * time.Minute
+
+// How long we remember failures from an IP after the last one.
+const operFailureTime = time.Hour
+
+// wait says how long until whoever failed may try OPER again. It is 0 if they
+// may try now.
+func (f OperFailures) wait(now time.Time) time.Duration {
+	if f.Count <= operFailuresAllowed {
+		return 0
+	}
+
+	delay := operFailureDelay
+	for i := operFailuresAllowed + 1; i < f.Count && delay < operFailureMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > operFailureMaxDelay {
+		delay = operFailureMaxDelay
+	}
+
+	if wait := f.Last.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// operWait says how long until the user may try OPER again. We go by both
+// their own failures and those from their IP.
+func (u *LocalUser) operWait() time.Duration {
+	return u.failureWait(u.OperFailures, u.Catbox.OperFailures)
+}
+
+// failureWait says how long until the user may try again given their own
+// failures and the failures by IP.
+func (u *LocalUser) failureWait(failures OperFailures,
+	ipFailures map[string]*OperFailures) time.Duration {
+	now := time.Now()
+
+	wait := failures.wait(now)
+	if f, exists := ipFailures[u.Conn.IP.String()]; exists {
+		if ipWait := f.wait(now); ipWait > wait {
+			wait = ipWait
+		}
+	}
+	return wait
+}
+
+// operFailed records that the user failed to OPER as the named oper block,
+// and tells operators about it.
+func (u *LocalUser) operFailed(name, reason string) {
+	count := u.recordFailure(&u.OperFailures, u.Catbox.OperFailures)
+
+	msg := fmt.Sprintf("Failed OPER attempt as %s by %s (%s@%s) [%s]: %s "+
+		"(failure %d)", name, u.User.DisplayNick, u.User.Username,
+		u.User.Hostname, u.Conn.IP.String(), reason, count)
+	u.Catbox.noticeOpersRealHost(msg, fmt.Sprintf(
+		"Failed OPER attempt as %s by %s (%s@%s): %s (failure %d)", name,
+		u.User.DisplayNick, u.User.Username, u.User.DisplayHost, reason, count))
+	logEvent("oper", "%s", msg)
+}
+
+// recordFailure counts a failure by the user and one from their IP. It returns
+// whichever count is higher.
+func (u *LocalUser) recordFailure(failures *OperFailures,
+	ipFailures map[string]*OperFailures) int {
+	now := time.Now()
+	ip := u.Conn.IP.String()
+
+	failures.Count++
+	failures.Last = now
+
+	f, exists := ipFailures[ip]
+	if !exists {
+		f = &OperFailures{}
+		ipFailures[ip] = f
+	}
+	f.Count++
+	f.Last = now
+
+	if f.Count > failures.Count {
+		return f.Count
+	}
+	return failures.Count
+}
+
+// operSucceeded forgets the user's failures and those from their IP.
+func (u *LocalUser) operSucceeded() {
+	u.OperFailures = OperFailures{}
+	delete(u.Catbox.OperFailures, u.Conn.IP.String())
+}
+
+// expireOperFailures forgets failures from IPs that haven't failed in a while.
+// This includes NickServ failures.
+func (cb *Catbox) expireOperFailures() {
+	for _, ipFailures := range []map[string]*OperFailures{cb.OperFailures,
+		cb.NickServFailures} {
+		for ip, failures := range ipFailures {
+			if time.Since(failures.Last) >= operFailureTime {
+				delete(ipFailures, ip)
+			}
+		}
+	}
+}
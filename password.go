@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Passwords we hash start with this. Those that don't we treat as plaintext.
+const passwordHashPrefix = "$pbkdf2-sha256$"
+
+// How many PBKDF2 iterations we use when hashing a new password.
+const passwordHashIterations = 100000
+
+// Length of the salt we generate when hashing a new password, in bytes.
+const passwordSaltLength = 16
+
+// hashPassword hashes a password for storing in a config, such as the opers
+// config. The hash looks like this:
+//
+// $pbkdf2-sha256$<iterations>$<salt>$<hash>
+//
+// Salt and hash are base64 encoded (unpadded).
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %s", err)
+	}
+
+	hash := pbkdf2SHA256([]byte(password), salt, passwordHashIterations)
+
+	return fmt.Sprintf("%s%d$%s$%s", passwordHashPrefix, passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// checkPassword checks a password against one from a config. The config's may
+// be hashed (see hashPassword()) or plaintext.
+func checkPassword(stored, password string) bool {
+	if !strings.HasPrefix(stored, passwordHashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+
+	pieces := strings.Split(strings.TrimPrefix(stored, passwordHashPrefix), "$")
+	if len(pieces) != 3 {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(pieces[0])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(pieces[1])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(pieces[2])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(
+		pbkdf2SHA256([]byte(password), salt, iterations), hash) == 1
+}
+
+// checkPasswordAsync checks a password like checkPassword() but in its own
+// goroutine. Hashed passwords are slow to check on purpose, and we don't want
+// to hold up the server while we do it. We call done with the result from the
+// server goroutine.
+func (cb *Catbox) checkPasswordAsync(stored, password string,
+	done func(ok bool)) {
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		ok := checkPassword(stored, password)
+		cb.newEvent(Event{
+			Type:         PasswordEvent,
+			PasswordFunc: func() { done(ok) },
+		})
+	}()
+}
+
+// hashPasswordAsync hashes a password like hashPassword() but in its own
+// goroutine. See checkPasswordAsync().
+func (cb *Catbox) hashPasswordAsync(password string,
+	done func(hash string, err error)) {
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		hash, err := hashPassword(password)
+		cb.newEvent(Event{
+			Type:         PasswordEvent,
+			PasswordFunc: func() { done(hash, err) },
+		})
+	}()
+}
+
+// pbkdf2SHA256 derives a key from a password per PBKDF2 (RFC 8018) using
+// HMAC-SHA256. We only ever need a single block (32 bytes) of output.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	// U1 = PRF(password, salt || INT(1))
+	_, _ = prf.Write(salt)
+	_, _ = prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		_, _ = prf.Write(u)
+		u = prf.Sum(u[:0])
+
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Delivery is a PRIVMSG or NOTICE making its way through the message pipeline.
+//
+// Messages come from local users (privmsgCommand in LocalUser) and from
+// servers (privmsgCommand in LocalServer). Both build a Delivery and run it
+// through the same stages so that checks apply the same way no matter where
+// the message came from.
+type Delivery struct {
+	// PRIVMSG or NOTICE.
+	Command string
+
+	// The user sending the message. This is nil if a server sent it.
+	Source *User
+
+	// The local user sending the message. This is nil if the message came from
+	// a server.
+	LocalSource *LocalUser
+
+	// The server we received the message from. This is nil if the message came
+	// from a local user.
+	From *LocalServer
+
+	// How we show the source to local users. nick!user@host or a server name.
+	SourceName string
+
+	// How we show the source to servers. A UID or SID.
+	SourceID string
+
+	// The target is either a channel or a user.
+	Channel *Channel
+	Target  *User
+
+	// If the target was given as nick@server and the server is not us, these
+	// are the server and the nick. We pass the message towards the server and
+	// it finds the user. Target is nil in this case.
+	TargetServer *Server
+	TargetNick   string
+
+	Text string
+
+	// ExtraTarget means a local user's command had targets before this one.
+	// e.g., PRIVMSG a,b,c. See rateLimitStage().
+	ExtraTarget bool
+
+	// Rejected means a stage decided not to deliver the message at all.
+	Rejected bool
+
+	// SkipLocal means we deliver the message to no local users but still pass it
+	// on to servers. Other servers can decide for themselves.
+	SkipLocal bool
+}
+
+// MessageStage is one step of the message pipeline.
+type MessageStage struct {
+	// Name identifies the stage.
+	Name string
+
+	// Stages run in ascending order. See the messageStageOrder constants.
+	Order int
+
+	// Run looks at (and possibly changes) the delivery. To stop the message, it
+	// calls reject() on it.
+	Run func(*Delivery)
+}
+
+// Where stages go in the pipeline. Add stages relative to these.
+const (
+	messageStageOrderRateLimit  = 100
+	messageStageOrderSpamFilter = 200
+	messageStageOrderChecks     = 300
+	messageStageOrderDeliver    = 1000
+	messageStageOrderHistory    = 1100
+)
+
+// registerMessageStage adds a stage to the pipeline. Stages with the same order
+// run in the order they were registered.
+func (cb *Catbox) registerMessageStage(stage MessageStage) {
+	cb.MessageStages = append(cb.MessageStages, stage)
+	sort.SliceStable(cb.MessageStages, func(i, j int) bool {
+		return cb.MessageStages[i].Order < cb.MessageStages[j].Order
+	})
+}
+
+// registerDefaultMessageStages sets up the stages we always have.
+func (cb *Catbox) registerDefaultMessageStages() {
+	cb.registerMessageStage(MessageStage{
+		Name:  "rate-limit",
+		Order: messageStageOrderRateLimit,
+		Run:   cb.rateLimitStage,
+	})
+
+	cb.registerMessageStage(MessageStage{
+		Name:  "spamfilter",
+		Order: messageStageOrderSpamFilter,
+		Run:   cb.spamFilterStage,
+	})
+
+	cb.registerMessageStage(MessageStage{
+		Name:  "channel-checks",
+		Order: messageStageOrderChecks,
+		Run:   cb.channelChecksStage,
+	})
+
+	cb.registerMessageStage(MessageStage{
+		Name:  "channel-colors",
+		Order: messageStageOrderChecks,
+		Run:   cb.channelColorsStage,
+	})
+
+	cb.registerMessageStage(MessageStage{
+		Name:  "channel-ctcp",
+		Order: messageStageOrderChecks,
+		Run:   cb.channelCTCPStage,
+	})
+
+	cb.registerMessageStage(MessageStage{
+		Name:  "caller-id",
+		Order: messageStageOrderChecks,
+		Run:   cb.callerIDStage,
+	})
+
+	cb.registerMessageStage(MessageStage{
+		Name:  "deliver",
+		Order: messageStageOrderDeliver,
+		Run:   cb.deliverStage,
+	})
+
+	cb.registerMessageStage(MessageStage{
+		Name:  "history",
+		Order: messageStageOrderHistory,
+		Run:   cb.historyRecordStage,
+	})
+}
+
+// runMessagePipeline runs the delivery through each stage in order. It stops if
+// a stage rejects the message.
+func (cb *Catbox) runMessagePipeline(d *Delivery) {
+	for _, stage := range cb.MessageStages {
+		stage.Run(d)
+		if d.Rejected {
+			return
+		}
+	}
+}
+
+// reject stops the message. If a local user sent it, we tell them why with the
+// given numeric reply.
+//
+// If the message came from a server, we don't reject it outright. Instead we
+// don't deliver it to local users but still pass it on to other servers.
+func (d *Delivery) reject(numeric string, params []string) {
+	if d.LocalSource == nil {
+		d.SkipLocal = true
+		return
+	}
+
+	d.LocalSource.messageFromServer(numeric, params)
+	d.Rejected = true
+}
+
+// rateLimitStage charges local users' flood control counters for messages to
+// several targets. handleMessage already charged them for the first target.
+// This way they can't message more targets than they could with one target at
+// a time.
+func (cb *Catbox) rateLimitStage(d *Delivery) {
+	if d.LocalSource == nil || !d.ExtraTarget || d.Source.isFloodExempt() {
+		return
+	}
+	d.LocalSource.MessageCounter--
+}
+
+// spamFilterStage blocks messages from local users matching a spamfilter
+// config. Operators are exempt. Other servers decide for their own users.
+func (cb *Catbox) spamFilterStage(d *Delivery) {
+	if d.LocalSource == nil || d.Source.isOperator() {
+		return
+	}
+
+	text := stripFormatting(d.Text)
+	for _, sc := range cb.Config.SpamFilterConfigs {
+		if !matchMask(sc.Mask, text) {
+			continue
+		}
+
+		msg := "Cannot send message (blocked by spam filter)"
+		if sc.Reason != "" {
+			msg += ": " + sc.Reason
+		}
+
+		// 404 ERR_CANNOTSENDTOCHAN
+		d.reject("404", []string{d.targetName(), msg})
+		return
+	}
+}
+
+// targetName is how we show the delivery's target to its source.
+func (d *Delivery) targetName() string {
+	if d.Channel != nil {
+		return d.Channel.Name
+	}
+	if d.TargetServer != nil {
+		return d.TargetNick + "@" + d.TargetServer.Name
+	}
+	return d.Target.DisplayNick
+}
+
+// channelChecksStage applies the channel's restrictions to the sender.
+func (cb *Catbox) channelChecksStage(d *Delivery) {
+	if d.Channel == nil || d.Source == nil {
+		return
+	}
+
+	// Are they on it? If the channel is +n (no external messages), they must
+	// be.
+	if !d.Channel.canReceiveFrom(d.Source) {
+		// 404 ERR_CANNOTSENDTOCHAN
+		d.reject("404", []string{d.Channel.Name, "Cannot send to channel"})
+		return
+	}
+
+	// Banned and quieted users may not speak unless they have ops.
+	if !d.Channel.userHasOps(d.Source) &&
+		(d.Channel.userIsBanned(d.Source) || d.Channel.userIsQuieted(d.Source)) {
+		// 404 ERR_CANNOTSENDTOCHAN
+		d.reject("404", []string{d.Channel.Name, "Cannot send to channel"})
+		return
+	}
+}
+
+// channelColorsStage strips colors and formatting from messages to +c
+// channels, or rejects such messages, depending on configuration.
+func (cb *Catbox) channelColorsStage(d *Delivery) {
+	if d.Channel == nil {
+		return
+	}
+
+	if _, noColors := d.Channel.Modes['c']; !noColors {
+		return
+	}
+
+	stripped := stripFormatting(d.Text)
+	if stripped == d.Text {
+		return
+	}
+
+	if cb.Config.NoColorsAction == "reject" {
+		// 404 ERR_CANNOTSENDTOCHAN
+		d.reject("404", []string{d.Channel.Name,
+			"Cannot send to channel (colors are not permitted)"})
+		return
+	}
+
+	d.Text = stripped
+}
+
+// channelCTCPStage blocks CTCPs to +C channels. We permit ACTION (/me).
+func (cb *Catbox) channelCTCPStage(d *Delivery) {
+	if d.Channel == nil {
+		return
+	}
+
+	if _, noCTCP := d.Channel.Modes['C']; !noCTCP {
+		return
+	}
+
+	if !isCTCP(d.Text) || isCTCPAction(d.Text) {
+		return
+	}
+
+	// 404 ERR_CANNOTSENDTOCHAN
+	d.reject("404", []string{d.Channel.Name,
+		"Cannot send to channel (CTCPs are not permitted)"})
+}
+
+// callerIDStage blocks private messages to our +g (caller ID) users from users
+// they have not accepted. Operators may message them regardless.
+//
+// We check this only for our own users. Their accept lists are only known to
+// us. This applies whether the sender is local or remote.
+func (cb *Catbox) callerIDStage(d *Delivery) {
+	if d.Target == nil || d.Source == nil || !d.Target.isLocal() {
+		return
+	}
+
+	if _, callerID := d.Target.Modes['g']; !callerID {
+		return
+	}
+
+	target := d.Target.LocalUser
+	if d.Source == d.Target || d.Source.isOperator() || target.accepts(d.Source) {
+		return
+	}
+
+	// Like ratbox, we don't reply to NOTICEs.
+	if d.Command != "NOTICE" {
+		// 716 ERR_TARGUMODEG
+		cb.numericToUser(d.Source, "716", []string{d.Target.DisplayNick,
+			"is in +g mode (server side ignore)"})
+	}
+
+	if time.Since(target.LastCallerIDNotice) >= callerIDNoticeTime {
+		if d.Command != "NOTICE" {
+			// 717 RPL_TARGNOTIFY
+			cb.numericToUser(d.Source, "717", []string{d.Target.DisplayNick,
+				"has been informed that you messaged them."})
+		}
+
+		// 718 RPL_UMODEGMSG
+		target.messageFromServer("718", []string{d.Source.DisplayNick,
+			d.Source.Username + "@" + d.Source.DisplayHost,
+			"is messaging you, and you have umode +g."})
+		target.LastCallerIDNotice = time.Now()
+	}
+
+	// The target is ours, so there is nowhere else to deliver it.
+	d.Rejected = true
+}
+
+// deliverStage sends the message to local users and on to servers.
+func (cb *Catbox) deliverStage(d *Delivery) {
+	if d.LocalSource != nil {
+		d.LocalSource.LastMessageTime = time.Now()
+	}
+
+	cb.statsToday().Messages++
+
+	if d.Channel != nil {
+		cb.deliverToChannel(d)
+		return
+	}
+
+	if d.TargetServer != nil {
+		cb.deliverToServer(d)
+		return
+	}
+
+	cb.deliverToUser(d)
+}
+
+func (cb *Catbox) deliverToChannel(d *Delivery) {
+	// Send to all members of the channel. Except the source it seems.
+	// Tell local users directly.
+	// If a user is remote, record the server we should propagate the message
+	// towards. Tell each server only once.
+	toServers := make(map[*LocalServer]struct{})
+	for memberUID := range d.Channel.Members {
+		member := cb.Users[memberUID]
+		if member == d.Source {
+			continue
+		}
+
+		if member.isLocal() {
+			if d.SkipLocal {
+				continue
+			}
+			member.LocalUser.maybeQueueMessage(irc.Message{
+				Prefix:  d.SourceName,
+				Command: d.Command,
+				Params:  []string{d.Channel.Name, d.Text},
+			})
+			continue
+		}
+
+		// Don't send it back where it came from.
+		if member.ClosestServer != d.From {
+			toServers[member.ClosestServer] = struct{}{}
+		}
+	}
+
+	// Propagate message to any servers that need it.
+	for server := range toServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  d.SourceID,
+			Command: d.Command,
+			Params:  []string{d.Channel.Name, d.Text},
+		})
+	}
+}
+
+// deliverToServer passes a nick@server message towards the server.
+func (cb *Catbox) deliverToServer(d *Delivery) {
+	route := d.TargetServer.route()
+
+	// Don't send it back where it came from.
+	if route == d.From {
+		s2sLog.Warnf("%s for %s@%s would go back where it came from", d.Command,
+			d.TargetNick, d.TargetServer.Name)
+		return
+	}
+
+	route.maybeQueueMessage(irc.Message{
+		Prefix:  d.SourceID,
+		Command: d.Command,
+		Params:  []string{d.TargetNick + "@" + d.TargetServer.Name, d.Text},
+	})
+}
+
+func (cb *Catbox) deliverToUser(d *Delivery) {
+	// We either deliver it to a local user, and done, or we need to propagate
+	// it to another server.
+	if d.Target.isLocal() {
+		if !d.SkipLocal {
+			d.Target.LocalUser.maybeQueueMessage(irc.Message{
+				Prefix:  d.SourceName,
+				Command: d.Command,
+				Params:  []string{d.Target.DisplayNick, d.Text},
+			})
+		}
+	} else {
+		// Propagate to the server we know the target user through.
+		d.Target.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  d.SourceID,
+			Command: d.Command,
+			Params:  []string{string(d.Target.UID), d.Text},
+		})
+	}
+
+	// Reply with 301 RPL_AWAY if they're away.
+	if d.LocalSource != nil && len(d.Target.AwayMessage) > 0 {
+		d.LocalSource.messageFromServer("301", []string{
+			d.Target.DisplayNick,
+			d.Target.AwayMessage,
+		})
+	}
+}
+
+// setNickAtServerTarget sets the delivery's target from a nick@server target.
+// This lets a message go to a user on a particular server. e.g.,
+// NickServ@services.example.com. If the server is us, the user must be one of
+// ours. Otherwise we leave it to the server to find the user.
+//
+// Returns false if there is no such user or server.
+func (cb *Catbox) setNickAtServerTarget(d *Delivery, target string) bool {
+	idx := strings.Index(target, "@")
+	if idx == -1 {
+		return false
+	}
+	nick, serverName := target[:idx], target[idx+1:]
+
+	if !isValidNick(cb.Config.MaxNickLength, nick) {
+		return false
+	}
+
+	if serverName == cb.Config.ServerName {
+		uid, exists := cb.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			return false
+		}
+		user := cb.Users[uid]
+		if !user.isLocal() {
+			return false
+		}
+		d.Target = user
+		return true
+	}
+
+	server := cb.getServerByName(serverName)
+	if server == nil {
+		return false
+	}
+	d.TargetServer = server
+	d.TargetNick = nick
+	return true
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// PolicyRule is one rule from the connect policy config. When a registering
+// user matches all of a rule's conditions, we apply its action.
+type PolicyRule struct {
+	// allow, deny, or class.
+	Action string
+
+	// For the class action, the name of the user config (from the users config)
+	// to apply to the user.
+	Class string
+
+	// All must match for the rule to apply.
+	Conditions []PolicyCondition
+
+	// Shown to the user if we deny them.
+	Reason string
+}
+
+// PolicyCondition tests one signal about a registering user.
+type PolicyCondition struct {
+	// What we test. e.g., tls, host.
+	Signal string
+
+	// Whether the condition is negated (written with !=).
+	Negate bool
+
+	Value string
+}
+
+// PolicyInput holds the signals we know about a user at registration time.
+type PolicyInput struct {
+	Nick     string
+	Username string
+
+	// Resolved hostname. Blank if the reverse lookup failed.
+	Hostname string
+
+	IP  net.IP
+	TLS bool
+
+	// The account they logged in to with SASL. Blank if they didn't.
+	Account string
+}
+
+// Signals a condition may test. Each is compared against the value given in
+// the rule.
+//
+// tls: 1 or 0. Whether the user connected with TLS.
+// rdns: 1 or 0. Whether we resolved a hostname for the user.
+// sasl: 1 or 0. Whether the user logged in with SASL.
+// nick, user, host: Glob style masks.
+// account: Glob style mask of the account the user logged in to with SASL.
+// ip: A glob style mask or a CIDR.
+var policySignals = map[string]struct{}{
+	"tls":     {},
+	"rdns":    {},
+	"sasl":    {},
+	"nick":    {},
+	"user":    {},
+	"host":    {},
+	"account": {},
+	"ip":      {},
+}
+
+// policyUnsupportedSignals are signals we know of but can't test yet. We have
+// no ident lookups, DNSBL lookups, or GeoIP database to tell us these. We
+// refuse rules using them rather than let them never (or always) match.
+var policyUnsupportedSignals = map[string]string{
+	"ident":   "we don't do ident lookups",
+	"dnsbl":   "we don't do DNSBL lookups",
+	"country": "we have no GeoIP database",
+}
+
+// policyConditionRE matches a condition. Values may contain = and : (e.g.,
+// IPv6 IPs), so we take the signal from the front only.
+var policyConditionRE = regexp.MustCompile(`^([a-z]+)(!?=)(.*)$`)
+
+// parsePolicyConfig reads the connect policy config. Unlike our other configs,
+// order is significant: we apply the first rule that matches.
+//
+// Each line looks like this:
+// <action> [condition ...] [:<reason>]
+//
+// <action> is allow, deny, or class <name>. The reason starts at the first
+// word starting with a colon.
+//
+// Conditions look like <signal>=<value> or <signal>!=<value>.
+//
+// Lines that are blank or start with # are ignored.
+func parsePolicyConfig(file string, userConfigs []UserConfig) ([]PolicyRule,
+	error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open: %s", err)
+	}
+
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	var rules []PolicyRule
+
+	scanner := bufio.NewScanner(fh)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+
+		if rule.Action == "class" && !hasUserConfig(userConfigs, rule.Class) {
+			return nil, fmt.Errorf("line %d: unknown class: %s", lineNumber,
+				rule.Class)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading: %s", err)
+	}
+
+	return rules, nil
+}
+
+// parsePolicyRule parses a single rule line.
+func parsePolicyRule(line string) (PolicyRule, error) {
+	rule := PolicyRule{}
+
+	// Conditions may contain colons (e.g., ip=::1), so the reason starts only
+	// at a word starting with one.
+	if idx := strings.Index(line, " :"); idx != -1 {
+		rule.Reason = strings.TrimSpace(line[idx+2:])
+		line = line[:idx]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return PolicyRule{}, fmt.Errorf("no action")
+	}
+
+	rule.Action = fields[0]
+	fields = fields[1:]
+
+	switch rule.Action {
+	case "allow", "deny":
+	case "class":
+		if len(fields) == 0 {
+			return PolicyRule{}, fmt.Errorf("class action requires a name")
+		}
+		rule.Class = fields[0]
+		fields = fields[1:]
+	default:
+		return PolicyRule{}, fmt.Errorf("unknown action: %s", rule.Action)
+	}
+
+	for _, field := range fields {
+		condition, err := parsePolicyCondition(field)
+		if err != nil {
+			return PolicyRule{}, err
+		}
+		rule.Conditions = append(rule.Conditions, condition)
+	}
+
+	if rule.Reason == "" {
+		rule.Reason = "Connection denied by policy"
+	}
+
+	return rule, nil
+}
+
+func parsePolicyCondition(s string) (PolicyCondition, error) {
+	matches := policyConditionRE.FindStringSubmatch(s)
+	if matches == nil {
+		return PolicyCondition{}, fmt.Errorf("malformed condition: %s", s)
+	}
+
+	condition := PolicyCondition{
+		Signal: matches[1],
+		Negate: matches[2] == "!=",
+		Value:  matches[3],
+	}
+
+	if reason, exists := policyUnsupportedSignals[condition.Signal]; exists {
+		return PolicyCondition{}, fmt.Errorf("signal %s is not supported: %s",
+			condition.Signal, reason)
+	}
+
+	if _, exists := policySignals[condition.Signal]; !exists {
+		return PolicyCondition{}, fmt.Errorf("unknown signal: %s",
+			condition.Signal)
+	}
+
+	if len(condition.Value) == 0 {
+		return PolicyCondition{}, fmt.Errorf("condition has no value: %s", s)
+	}
+
+	if (condition.Signal == "tls" || condition.Signal == "rdns" ||
+		condition.Signal == "sasl") &&
+		condition.Value != "1" && condition.Value != "0" {
+		return PolicyCondition{}, fmt.Errorf("%s must be 1 or 0",
+			condition.Signal)
+	}
+
+	if condition.Signal == "ip" && strings.Contains(condition.Value, "/") {
+		if _, _, err := net.ParseCIDR(condition.Value); err != nil {
+			return PolicyCondition{}, fmt.Errorf("invalid CIDR: %s: %s",
+				condition.Value, err)
+		}
+	}
+
+	return condition, nil
+}
+
+// Check whether the condition holds for the user.
+func (c PolicyCondition) matches(input PolicyInput) bool {
+	matched := false
+
+	switch c.Signal {
+	case "tls":
+		matched = input.TLS == (c.Value == "1")
+	case "rdns":
+		matched = (input.Hostname != "") == (c.Value == "1")
+	case "sasl":
+		matched = (input.Account != "") == (c.Value == "1")
+	case "nick":
+		matched = matchMask(c.Value, input.Nick)
+	case "user":
+		matched = matchMask(c.Value, input.Username)
+	case "host":
+		matched = input.Hostname != "" && matchMask(c.Value, input.Hostname)
+	case "account":
+		matched = input.Account != "" && matchMask(c.Value, input.Account)
+	case "ip":
+		if strings.Contains(c.Value, "/") {
+			_, network, err := net.ParseCIDR(c.Value)
+			matched = err == nil && network.Contains(input.IP)
+		} else {
+			matched = matchMask(c.Value, input.IP.String())
+		}
+	}
+
+	if c.Negate {
+		return !matched
+	}
+	return matched
+}
+
+// Check whether all of the rule's conditions hold for the user.
+func (r PolicyRule) matches(input PolicyInput) bool {
+	for _, condition := range r.Conditions {
+		if !condition.matches(input) {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluatePolicy finds the first rule matching the user. If none match, it
+// returns nil. We allow users no rule matches.
+func evaluatePolicy(rules []PolicyRule, input PolicyInput) *PolicyRule {
+	for i := range rules {
+		if rules[i].matches(input) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// policyNeedsHostname tells whether any rule tests the user's hostname. If
+// so, we wait for the hostname lookup before evaluating them.
+func policyNeedsHostname(rules []PolicyRule) bool {
+	for _, rule := range rules {
+		for _, condition := range rule.Conditions {
+			if condition.Signal == "rdns" || condition.Signal == "host" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasUserConfig(userConfigs []UserConfig, name string) bool {
+	for _, userConfig := range userConfigs {
+		if userConfig.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// configSections groups Config's fields for telling operators what a rehash
+// changed. Sections not live take effect only on restart (or for some, only
+// when we relink).
+var configSections = []struct {
+	name   string
+	fields []string
+	live   bool
+}{
+	{"listeners", []string{"ListenHost", "ListenPort", "ListenPortTLS",
+		"ListenHostTor", "ListenPortTor", "ListenHostServers",
+		"ListenPortServers"}, true},
+	{"tor", []string{"TorHost", "TorAuth", "TorPassword"}, true},
+	{"certificates", []string{"CertificateFile", "KeyFile", "CertificateConfigs",
+		"CertificateCheckTime"}, true},
+	{"server-name", []string{"ServerName"}, false},
+	{"server-info", []string{"ServerInfo"}, false},
+	{"network", []string{"NetworkName", "NetworkDescription", "NetworkAdmin"},
+		true},
+	{"topology", []string{"HiddenServerName", "FlattenLinks",
+		"HideSplitServers"}, true},
+	{"motd", []string{"MOTD"}, true},
+	{"cloak-key", []string{"CloakKey"}, true},
+	{"max-nick-length", []string{"MaxNickLength"}, false},
+	{"lengths", []string{"MaxChannelLength", "MaxTopicLength", "MaxKickLength",
+		"MaxAwayLength"}, true},
+	{"limits", []string{"MaxWHOResults", "MaxLISTResults", "MaxWHOISTargets",
+		"MaxModeListResults", "MaxTargets", "MaxChannels",
+		"MaxChannelListEntries"}, true},
+	{"join-part", []string{"JoinPartCount", "JoinPartTime"}, true},
+	{"timeouts", []string{"PingTime", "DeadTime", "BurstTimeout",
+		"ConsistencyCheckTime"}, true},
+	{"connect-classes", []string{"ConnectAttemptTime", "ConnectClasses",
+		"ConnectClassSendQueues", "ConnectMaxBackoff", "LinkBindAddress"}, true},
+	{"sendq", []string{"UserSendQueue", "ServerSendQueue"}, true},
+	{"ts6-sid", []string{"TS6SID"}, false},
+	{"admin-email", []string{"AdminEmail"}, true},
+	{"opers", []string{"Opers"}, true},
+	{"servers", []string{"Servers"}, true},
+	{"users", []string{"UserConfigs"}, true},
+	{"vhosts", []string{"VhostConfigs"}, true},
+	{"exempts", []string{"ExemptConfigs"}, true},
+	{"reserves", []string{"ReserveConfigs"}, true},
+	{"spamfilters", []string{"SpamFilterConfigs"}, true},
+	{"policy", []string{"PolicyRules"}, true},
+	{"state-db", []string{"StateDB"}, false},
+	{"files", []string{"StatsFile", "BansFile", "ChannelsFile", "NickServFile",
+		"ChanServFile"}, true},
+	{"nickserv-grace-time", []string{"NickServGraceTime"}, true},
+	{"async-hostname-lookup", []string{"AsyncHostnameLookup"}, false},
+	{"dns", []string{"DNSWorkers", "DNSTimeout", "DNSCacheTime",
+		"DNSNegativeCacheTime"}, false},
+	{"confirm-shutdown", []string{"ConfirmShutdown"}, true},
+	{"shutdown", []string{"ShutdownMessage", "ShutdownFlushTime"}, true},
+	{"logging", []string{"LogLevels", "LogFormat", "LogRotateSize",
+		"LogRotateCount", "EventLogFiles"}, true},
+	{"debug-listen", []string{"DebugListen"}, false},
+	{"api", []string{"APIListen"}, false},
+	{"api-token", []string{"APIToken"}, true},
+	{"no-colors-action", []string{"NoColorsAction"}, true},
+	{"invalid-utf8-action", []string{"InvalidUTF8Action"}, true},
+	{"channel-history", []string{"ChannelHistoryLength", "ChannelHistoryTime",
+		"ChannelHistoryPlayback", "ChannelHistoryFile"}, true},
+}
+
+// changedConfigSections compares two configs. It returns the names of the
+// sections that differ, split by whether the change takes effect live.
+func changedConfigSections(oldConfig, newConfig *Config) ([]string,
+	[]string) {
+	oldValue := reflect.ValueOf(oldConfig).Elem()
+	newValue := reflect.ValueOf(newConfig).Elem()
+
+	var live, restart []string
+	for _, section := range configSections {
+		for _, field := range section.fields {
+			if reflect.DeepEqual(oldValue.FieldByName(field).Interface(),
+				newValue.FieldByName(field).Interface()) {
+				continue
+			}
+			if section.live {
+				live = append(live, section.name)
+			} else {
+				restart = append(restart, section.name)
+			}
+			break
+		}
+	}
+	return live, restart
+}
+
+// describeConfigChanges tells operators what changedConfigSections() found.
+func describeConfigChanges(live, restart []string) string {
+	if len(live) == 0 && len(restart) == 0 {
+		return "Nothing changed."
+	}
+	var parts []string
+	if len(live) > 0 {
+		parts = append(parts, fmt.Sprintf("Changed: %s.", strings.Join(live, ", ")))
+	}
+	if len(restart) > 0 {
+		parts = append(parts, fmt.Sprintf("Changed but needs a restart: %s.",
+			strings.Join(restart, ", ")))
+	}
+	return strings.Join(parts, " ")
+}
+
+// rehashListeners opens and closes listeners to match the new config.
+//
+// If we can't open a listener, we keep its old config so the next rehash
+// tries again.
+func (cb *Catbox) rehashListeners(cfg *Config) {
+	plaintextOK := cb.rehashListener("plaintext", &cb.Listener,
+		cb.Config.ListenHost, cb.Config.ListenPort, cfg.ListenHost,
+		cfg.ListenPort, false, listenerClients)
+	if plaintextOK {
+		cb.Config.ListenPort = cfg.ListenPort
+	}
+
+	tlsOK := cb.rehashListener("TLS", &cb.TLSListener, cb.Config.ListenHost,
+		cb.Config.ListenPortTLS, cfg.ListenHost, cfg.ListenPortTLS, true,
+		listenerClients)
+	if tlsOK {
+		cb.Config.ListenPortTLS = cfg.ListenPortTLS
+	}
+
+	// The plaintext and TLS listeners share a host.
+	if plaintextOK && tlsOK {
+		cb.Config.ListenHost = cfg.ListenHost
+	}
+
+	if cb.rehashListener("Tor", &cb.TorListener, cb.Config.ListenHostTor,
+		cb.Config.ListenPortTor, cfg.ListenHostTor, cfg.ListenPortTor, false,
+		listenerTor) {
+		cb.Config.ListenHostTor = cfg.ListenHostTor
+		cb.Config.ListenPortTor = cfg.ListenPortTor
+	}
+
+	if cb.rehashListener("servers", &cb.ServersListener,
+		cb.Config.ListenHostServers, cb.Config.ListenPortServers,
+		cfg.ListenHostServers, cfg.ListenPortServers, false, listenerServers) {
+		cb.Config.ListenHostServers = cfg.ListenHostServers
+		cb.Config.ListenPortServers = cfg.ListenPortServers
+	}
+}
+
+// rehashListener moves a listener from the old host and port to the new. Port
+// -1 means not to listen. It tells whether the listener now matches the new
+// host and port.
+//
+// Clients connected through the old listener stay connected.
+func (cb *Catbox) rehashListener(name string, listener *net.Listener,
+	oldHost, oldPort, host, port string, useTLS bool, kind listenerKind) bool {
+	if host == oldHost && port == oldPort {
+		return true
+	}
+
+	// Close the old one first. The new one may overlap it, e.g., the same port
+	// on a different host.
+	if *listener != nil {
+		if err := (*listener).Close(); err != nil {
+			coreLog.Warnf("Error closing %s listener: %s", name, err)
+		}
+		*listener = nil
+	}
+
+	if port == "-1" {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Stopped listening (%s)", name))
+		return true
+	}
+
+	ln, err := cb.listen(host, port, useTLS)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to listen (%s) on %s: %s",
+			name, net.JoinHostPort(host, port), err))
+
+		// Go back to how we were.
+		if oldPort == "-1" {
+			return false
+		}
+		ln, err := cb.listen(oldHost, oldPort, useTLS)
+		if err != nil {
+			cb.noticeOpers(fmt.Sprintf("Rehash: Unable to listen (%s) on %s: %s",
+				name, net.JoinHostPort(oldHost, oldPort), err))
+			return false
+		}
+		*listener = ln
+		cb.WG.Add(1)
+		go cb.acceptConnections(ln, kind)
+		return false
+	}
+
+	*listener = ln
+	cb.WG.Add(1)
+	go cb.acceptConnections(ln, kind)
+
+	cb.noticeOpers(fmt.Sprintf("Rehash: Listening (%s) on %s", name,
+		net.JoinHostPort(host, port)))
+	return true
+}
+
+// rehashUserConfigs applies the users config to local users again. Users
+// keep the block they matched when they registered. We update whether it
+// makes them flood exempt. Spoofs don't change until they reconnect.
+func (cb *Catbox) rehashUserConfigs() {
+	for _, lu := range cb.LocalUsers {
+		if lu.UserConfigName == "" {
+			continue
+		}
+
+		floodExempt := false
+		for _, userConfig := range cb.Config.UserConfigs {
+			if userConfig.Name == lu.UserConfigName {
+				floodExempt = userConfig.FloodExempt
+				break
+			}
+		}
+
+		if lu.User.FloodExempt == floodExempt {
+			continue
+		}
+		lu.User.FloodExempt = floodExempt
+		if floodExempt {
+			lu.serverNotice("Congratulations. You're exempt from flood protection.")
+		} else {
+			lu.serverNotice("You're no longer exempt from flood protection.")
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// HostResolver looks up clients' hostnames.
+//
+// A fixed number of workers do the lookups so a flood of connections can't
+// start any number of them. We remember what we found (or that we found
+// nothing) for a while so clients reconnecting don't cause new lookups. If
+// several clients from the same IP connect while we're looking it up, they
+// share the lookup.
+type HostResolver struct {
+	// How long we wait for a lookup before giving up.
+	timeout time.Duration
+
+	// How long we remember a hostname we found.
+	cacheTime time.Duration
+
+	// How long we remember that we found no hostname.
+	negativeCacheTime time.Duration
+
+	// Workers take IPs to look up from here.
+	requests chan net.IP
+
+	// Closed when we shut down.
+	shutdownChan <-chan struct{}
+
+	// How we look up a hostname. lookupHostname() except in tests.
+	lookupFunc func(context.Context, net.IP) string
+
+	// Protects the below.
+	mutex sync.Mutex
+
+	// IP (string form) to what we found.
+	cache map[string]resolverCacheEntry
+
+	// IP (string form) to the channels of those waiting on a lookup in
+	// progress.
+	pending map[string][]chan string
+
+	// When we last removed expired entries from the cache.
+	lastPrune time.Time
+}
+
+type resolverCacheEntry struct {
+	hostname string
+	expires  time.Time
+}
+
+// resolverQueueSize is how many lookups we hold waiting for a worker. Past
+// this we don't look up the hostname at all.
+const resolverQueueSize = 1024
+
+func newHostResolver(
+	timeout,
+	cacheTime,
+	negativeCacheTime time.Duration,
+	shutdownChan <-chan struct{},
+) *HostResolver {
+	return &HostResolver{
+		timeout:           timeout,
+		cacheTime:         cacheTime,
+		negativeCacheTime: negativeCacheTime,
+		requests:          make(chan net.IP, resolverQueueSize),
+		shutdownChan:      shutdownChan,
+		lookupFunc:        lookupHostname,
+		cache:             make(map[string]resolverCacheEntry),
+		pending:           make(map[string][]chan string),
+	}
+}
+
+// start starts the workers. They run until shutdown.
+func (r *HostResolver) start(workers int, wg *sync.WaitGroup) {
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go r.worker(wg)
+	}
+}
+
+// lookup starts looking up the IP's hostname. The channel receives what we
+// found, blank if nothing. It never blocks.
+//
+// If we're too busy to look it up, we say we found nothing right away rather
+// than hold up the client.
+func (r *HostResolver) lookup(ip net.IP) <-chan string {
+	ch := make(chan string, 1)
+	key := ip.String()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if entry, exists := r.cache[key]; exists && time.Now().Before(entry.expires) {
+		ch <- entry.hostname
+		return ch
+	}
+
+	if waiting, exists := r.pending[key]; exists {
+		r.pending[key] = append(waiting, ch)
+		return ch
+	}
+
+	select {
+	case r.requests <- ip:
+		r.pending[key] = []chan string{ch}
+	default:
+		dnsLog.Warnf("Too many lookups pending. Not looking up %s", key)
+		ch <- ""
+	}
+	return ch
+}
+
+func (r *HostResolver) worker(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		select {
+		case ip := <-r.requests:
+			ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+			hostname := r.lookupFunc(ctx, ip)
+			cancel()
+			if hostname == "" {
+				dnsLog.Debugf("No hostname found for %s", ip)
+			} else {
+				dnsLog.Debugf("Found hostname %s for %s", hostname, ip)
+			}
+			r.lookupDone(ip.String(), hostname)
+		case <-r.shutdownChan:
+			return
+		}
+	}
+}
+
+// lookupDone records what we found and tells everyone waiting.
+func (r *HostResolver) lookupDone(key, hostname string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+
+	cacheTime := r.cacheTime
+	if hostname == "" {
+		cacheTime = r.negativeCacheTime
+	}
+	if cacheTime > 0 {
+		r.cache[key] = resolverCacheEntry{
+			hostname: hostname,
+			expires:  now.Add(cacheTime),
+		}
+	}
+
+	for _, ch := range r.pending[key] {
+		ch <- hostname
+	}
+	delete(r.pending, key)
+}
+
+// prune removes expired entries from the cache. We do this at most once a
+// minute. The mutex must be held.
+func (r *HostResolver) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+
+	for key, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// SASL authentication. We don't authenticate clients ourselves. If services
+// which support SASL are linked, we relay a client's AUTHENTICATE exchange to
+// them in ENCAP SASL and they tell us how it went. This is what charybdis
+// does, so services such as Atheme work with it.
+//
+// Services tell us they support SASL with ENCAP MECHLIST. Clients may only
+// authenticate before they register.
+//
+// The relay looks like this (S is us, X is services):
+//
+// S -> X: ENCAP <services> SASL <client UID> * H <host> <IP>
+// S -> X: ENCAP <services> SASL <client UID> * S <mechanism> [certfp]
+// X -> S: ENCAP <server> SASL <agent UID> <client UID> C <data>
+// S -> X: ENCAP <services> SASL <client UID> <agent UID> C <data>
+// ...
+// X -> S: ENCAP <server> SVSLOGIN <client UID> * * * <account>
+// X -> S: ENCAP <server> SASL <agent UID> <client UID> D S
+
+// The longest AUTHENTICATE parameter a client may send.
+const maxSASLChunkLength = 400
+
+// saslServer finds the services server we relay SASL to. nil if there is
+// none.
+func (cb *Catbox) saslServer() *Server {
+	for _, server := range cb.Servers {
+		if server.SASLMechanisms != "" && cb.isServices(server) {
+			return server
+		}
+	}
+	return nil
+}
+
+// saslUID is the UID the client will have when it registers. We identify it
+// to services by this while it authenticates.
+func (c *LocalClient) saslUID() TS6UID {
+	id, err := makeTS6ID(c.ID)
+	if err != nil {
+		return TS6UID("")
+	}
+	return TS6UID(string(c.Catbox.Config.TS6SID) + string(id))
+}
+
+// saslClient finds the client still registering that has the UID.
+func (cb *Catbox) saslClient(uid TS6UID) *LocalClient {
+	for _, c := range cb.LocalClients {
+		if c.SASLInProgress && c.saslUID() == uid {
+			return c
+		}
+	}
+	return nil
+}
+
+// sendSASL sends an ENCAP SASL message about the client to services.
+func (c *LocalClient) sendSASL(server *Server, mode string, data ...string) {
+	agent := c.SASLAgent
+	if agent == "" {
+		agent = "*"
+	}
+
+	params := []string{server.Name, "SASL", string(c.saslUID()), agent, mode}
+	params = append(params, data...)
+
+	server.route().maybeQueueMessage(irc.Message{
+		Prefix:  string(c.Catbox.Config.TS6SID),
+		Command: "ENCAP",
+		Params:  params,
+	})
+}
+
+// AUTHENTICATE starts or continues a SASL exchange.
+//
+// Parameters: <mechanism|data|*>
+// * aborts the exchange.
+func (c *LocalClient) authenticateCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.messageFromServer("461", []string{"AUTHENTICATE", "Not enough parameters"})
+		return
+	}
+
+	if !c.hasCap("sasl") {
+		// 451 ERR_NOTREGISTERED
+		c.messageFromServer("451", []string{"You have not registered."})
+		return
+	}
+
+	if c.SASLAccount != "" {
+		// 907 ERR_SASLALREADY
+		c.messageFromServer("907", []string{"You have already authenticated using SASL"})
+		return
+	}
+
+	server := c.Catbox.saslServer()
+	if server == nil {
+		// 904 ERR_SASLFAIL
+		c.messageFromServer("904", []string{"SASL authentication failed"})
+		return
+	}
+
+	if m.Params[0] == "*" {
+		c.abortSASL()
+		// 906 ERR_SASLABORTED
+		c.messageFromServer("906", []string{"SASL authentication aborted"})
+		return
+	}
+
+	if len(m.Params[0]) > maxSASLChunkLength {
+		c.abortSASL()
+		// 905 ERR_SASLTOOLONG
+		c.messageFromServer("905", []string{"SASL message too long"})
+		return
+	}
+
+	if c.SASLInProgress {
+		c.sendSASL(server, "C", m.Params[0])
+		return
+	}
+
+	c.SASLInProgress = true
+	c.SASLAgent = ""
+
+	host := c.Conn.IP.String()
+	if len(c.Hostname) > 0 {
+		host = c.Hostname
+	}
+	ip := c.Conn.IP.String()
+	if ip[0] == ':' {
+		ip = "0" + ip
+	}
+	c.sendSASL(server, "H", host, ip)
+
+	mechanism := strings.ToUpper(m.Params[0])
+	if certFP := c.certFP(); certFP != "" {
+		c.sendSASL(server, "S", mechanism, certFP)
+	} else {
+		c.sendSASL(server, "S", mechanism)
+	}
+}
+
+// abortSASL tells services we're giving up on the client's exchange if one is
+// in progress.
+func (c *LocalClient) abortSASL() {
+	if !c.SASLInProgress {
+		return
+	}
+	c.SASLInProgress = false
+
+	if server := c.Catbox.saslServer(); server != nil {
+		c.sendSASL(server, "D", "A")
+	}
+	c.SASLAgent = ""
+}
+
+// saslReply handles services' side of an exchange. mode is C (data for the
+// client), D (done: S success, F failure, A aborted), or M (the mechanisms
+// they support).
+func (c *LocalClient) saslReply(agent, mode, data string) {
+	c.SASLAgent = agent
+
+	if mode == "C" {
+		c.maybeQueueMessage(irc.Message{
+			Command: "AUTHENTICATE",
+			Params:  []string{data},
+		})
+		return
+	}
+
+	if mode == "M" {
+		// 908 RPL_SASLMECHS
+		c.messageFromServer("908", []string{data,
+			"are available SASL mechanisms"})
+		return
+	}
+
+	if mode != "D" {
+		return
+	}
+
+	c.SASLInProgress = false
+	c.SASLAgent = ""
+
+	if data == "S" && c.SASLAccount != "" {
+		// 903 RPL_SASLSUCCESS
+		c.messageFromServer("903", []string{"SASL authentication successful"})
+		return
+	}
+
+	if data == "A" {
+		// 906 ERR_SASLABORTED
+		c.messageFromServer("906", []string{"SASL authentication aborted"})
+		return
+	}
+
+	// 904 ERR_SASLFAIL
+	c.messageFromServer("904", []string{"SASL authentication failed"})
+}
+
+// saslLoggedIn records the account services logged the client in to.
+func (c *LocalClient) saslLoggedIn(account string) {
+	c.SASLAccount = account
+
+	nick := "*"
+	if len(c.PreRegDisplayNick) > 0 {
+		nick = c.PreRegDisplayNick
+	}
+	user := "*"
+	if len(c.PreRegUser) > 0 {
+		user = c.PreRegUser
+	}
+	host := c.Conn.IP.String()
+	if len(c.Hostname) > 0 {
+		host = c.Hostname
+	}
+
+	// 900 RPL_LOGGEDIN
+	c.messageFromServer("900", []string{
+		fmt.Sprintf("%s!%s@%s", nick, user, host),
+		account,
+		fmt.Sprintf("You are now logged in as %s", account),
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+// userSendQueue decides how many messages we may queue to send to a user.
+// configName is the users config block they matched. It may be blank.
+func (cb *Catbox) userSendQueue(configName string) int {
+	if configName == "" {
+		return cb.Config.UserSendQueue
+	}
+
+	for _, userConfig := range cb.Config.UserConfigs {
+		if userConfig.Name == configName && userConfig.SendQueue > 0 {
+			return userConfig.SendQueue
+		}
+	}
+
+	return cb.Config.UserSendQueue
+}
+
+// serverSendQueue decides how many messages we may queue to send to a server
+// we link with. It depends on the server's connect class.
+func (cb *Catbox) serverSendQueue(name string) int {
+	if linkInfo, exists := cb.Config.Servers[name]; exists {
+		sendQueue, exists := cb.Config.ConnectClassSendQueues[linkInfo.Class]
+		if exists {
+			return sendQueue
+		}
+	}
+
+	return cb.Config.ServerSendQueue
+}
+
+// rehashSendQueues applies the send queue limits to local users and servers
+// again. Any whose queue is now over their limit will be disconnected.
+func (cb *Catbox) rehashSendQueues() {
+	for _, lu := range cb.LocalUsers {
+		lu.SendQueueLimit = cb.userSendQueue(lu.UserConfigName)
+	}
+
+	for _, ls := range cb.LocalServers {
+		ls.SendQueueLimit = cb.serverSendQueue(ls.Server.Name)
+	}
+}
@@ -35,6 +35,14 @@ type Server struct {
 
 	// We know what server it is linked to. The SID message tells us.
 	LinkedTo *Server
+
+	// Version, features, and limits of the server. Only catbox servers tell us
+	// this (ENCAP CATBOXINFO). nil if we don't know.
+	Info map[string]string
+
+	// SASL mechanisms the server supports. Only services tell us this (ENCAP
+	// MECHLIST). Blank if none.
+	SASLMechanisms string
 }
 
 func (s *Server) String() string {
@@ -45,6 +53,14 @@ func (s *Server) isLocal() bool {
 	return s.LocalServer != nil
 }
 
+// route returns the local server we send messages for this server through.
+func (s *Server) route() *LocalServer {
+	if s.isLocal() {
+		return s.LocalServer
+	}
+	return s.ClosestServer
+}
+
 // Turn our capabilities into a single space separated string.
 func (s *Server) capabsString() string {
 	str := ""
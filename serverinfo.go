@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Channel modes we support.
+const supportedChannelModes = "bCceIifjklnNoqst"
+
+// User modes we support.
+const supportedUserModes = "giowxyC"
+
+// How many RPL_ISUPPORT (005) tokens we send per message. ratbox sends at most
+// 12 so the message stays within the 15 parameter limit.
+const isupportTokensPerMessage = 12
+
+// catboxFeatures are features other catbox servers may want to know we have
+// before an administrator relies on them across the network. Add to this when
+// adding a feature that involves other servers.
+var catboxFeatures = []string{
+	"callerid",
+	"chghost",
+	"kick",
+	"list",
+	"realhost",
+	"remove",
+}
+
+// serverInfo describes us to other catbox servers. We send it with ENCAP
+// CATBOXINFO when we link. Other implementations ignore it.
+func (cb *Catbox) serverInfo() map[string]string {
+	return map[string]string{
+		"version":   cb.version(),
+		"chanmodes": supportedChannelModes,
+		"usermodes": supportedUserModes,
+		"features":  strings.Join(catboxFeatures, ","),
+		"nicklen":   fmt.Sprintf("%d", cb.Config.MaxNickLength),
+		"topiclen":  fmt.Sprintf("%d", cb.Config.MaxTopicLength),
+		"kicklen":   fmt.Sprintf("%d", cb.Config.MaxKickLength),
+		"chanlen":   fmt.Sprintf("%d", cb.Config.MaxChannelLength),
+		"awaylen":   fmt.Sprintf("%d", cb.Config.MaxAwayLength),
+	}
+}
+
+// encodeServerInfo turns server information into key=value pairs separated by
+// spaces. Keys are sorted so the result is stable.
+func encodeServerInfo(info map[string]string) string {
+	var keys []string
+	for k := range info {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+info[k])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// parseServerInfo parses what encodeServerInfo makes. We skip anything
+// malformed.
+func parseServerInfo(s string) map[string]string {
+	info := make(map[string]string)
+	for _, pair := range strings.Fields(s) {
+		idx := strings.Index(pair, "=")
+		if idx <= 0 {
+			continue
+		}
+		info[pair[:idx]] = pair[idx+1:]
+	}
+	return info
+}
+
+// Tell a server the information we know about each catbox server, including
+// us. We do this during burst.
+func (s *LocalServer) sendServerInfo() {
+	s.maybeQueueMessage(irc.Message{
+		Prefix:  string(s.Catbox.Config.TS6SID),
+		Command: "ENCAP",
+		Params: []string{"*", "CATBOXINFO",
+			encodeServerInfo(s.Catbox.serverInfo())},
+	})
+
+	for _, server := range sortServersByHopCount(s.Catbox.Servers) {
+		if server.LocalServer == s || server.Info == nil {
+			continue
+		}
+
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  string(server.SID),
+			Command: "ENCAP",
+			Params:  []string{"*", "CATBOXINFO", encodeServerInfo(server.Info)},
+		})
+	}
+}
+
+// The CATBOXINFO command comes only in ENCAP messages. It tells us about the
+// catbox server sending it: its version, features, and limits.
+//
+// Parameters: <key=value ...>
+func (s *LocalServer) catboxInfoCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"CATBOXINFO", "Not enough parameters"})
+		return
+	}
+
+	server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
+	if !exists {
+		return
+	}
+
+	server.Info = parseServerInfo(m.Params[0])
+}
+
+// SERVERINFO is a non standard command. It shows operators what we know about
+// each server's version, features, and limits so they can spot servers that
+// are out of date.
+//
+// We only know this for catbox servers.
+func (u *LocalUser) serverInfoCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	ourInfo := u.Catbox.serverInfo()
+
+	u.serverNotice(fmt.Sprintf("%s: %s", u.Catbox.Config.ServerName,
+		encodeServerInfo(ourInfo)))
+
+	var servers []*Server
+	for _, server := range u.Catbox.Servers {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+
+	for _, server := range servers {
+		if server.Info == nil {
+			u.serverNotice(fmt.Sprintf("%s: Unknown (not catbox?)", server.Name))
+			continue
+		}
+
+		differences := ""
+		if server.Info["version"] != ourInfo["version"] {
+			differences += " [different version]"
+		}
+		if server.Info["features"] != ourInfo["features"] {
+			differences += " [different features]"
+		}
+
+		u.serverNotice(fmt.Sprintf("%s: %s%s", server.Name,
+			encodeServerInfo(server.Info), differences))
+	}
+
+	u.serverNotice("End of SERVERINFO")
+}
+
+// isupportTokens returns the RPL_ISUPPORT (005) tokens describing what we
+// support. They depend on our configuration.
+func (cb *Catbox) isupportTokens() []string {
+	tokens := []string{
+		"CHANTYPES=#&",
+		// Lists, modes that always have a parameter, modes that have a parameter
+		// only when set, and modes that never have one.
+		"CHANMODES=beIq,k,fjl,CciNnst",
+		"PREFIX=(o)@",
+		"EXCEPTS",
+		"INVEX",
+		fmt.Sprintf("MAXLIST=beIq:%d", cb.Config.MaxChannelListEntries),
+		fmt.Sprintf("MODES=%d", ChanModesPerCommand),
+		fmt.Sprintf("NICKLEN=%d", cb.Config.MaxNickLength),
+		fmt.Sprintf("CHANNELLEN=%d", cb.Config.MaxChannelLength),
+		fmt.Sprintf("TOPICLEN=%d", cb.Config.MaxTopicLength),
+		fmt.Sprintf("KICKLEN=%d", cb.Config.MaxKickLength),
+		fmt.Sprintf("AWAYLEN=%d", cb.Config.MaxAwayLength),
+		// We don't map ~ to ^.
+		"CASEMAPPING=strict-rfc1459",
+		"CALLERID=g",
+		// LIST won't flood users off.
+		"SAFELIST",
+	}
+
+	targets := ""
+	if cb.Config.MaxTargets > 0 {
+		targets = fmt.Sprintf("%d", cb.Config.MaxTargets)
+		tokens = append(tokens, "MAXTARGETS="+targets)
+	}
+	if cb.Config.MaxChannels > 0 {
+		tokens = append(tokens, fmt.Sprintf("CHANLIMIT=#&:%d", cb.Config.MaxChannels))
+	}
+
+	whoisTargets := ""
+	if cb.Config.MaxWHOISTargets > 0 {
+		whoisTargets = fmt.Sprintf("%d", cb.Config.MaxWHOISTargets)
+	}
+	tokens = append(tokens, fmt.Sprintf("TARGMAX=PRIVMSG:%s,NOTICE:%s,WHOIS:%s",
+		targets, targets, whoisTargets))
+
+	if cb.Config.NetworkName != "" {
+		tokens = append(tokens, "NETWORK="+cb.Config.NetworkName)
+	}
+
+	if cb.Config.InvalidUTF8Action != "allow" {
+		tokens = append(tokens, "UTF8ONLY")
+	}
+
+	if cb.Config.ChannelHistoryLength > 0 {
+		tokens = append(tokens,
+			fmt.Sprintf("CHATHISTORY=%d", cb.Config.ChannelHistoryLength),
+			"MSGREFTYPES=timestamp")
+	}
+
+	return tokens
+}
+
+// sendISupport sends RPL_ISUPPORT (005) messages with the given tokens.
+func (u *LocalUser) sendISupport(tokens []string) {
+	for len(tokens) > 0 {
+		n := isupportTokensPerMessage
+		if n > len(tokens) {
+			n = len(tokens)
+		}
+
+		params := append([]string{}, tokens[:n]...)
+		params = append(params, "are supported by this server")
+
+		// 005 RPL_ISUPPORT
+		u.messageFromServer("005", params)
+
+		tokens = tokens[n:]
+	}
+}
+
+// isupportChanges compares RPL_ISUPPORT tokens from before and after a change.
+// It returns the tokens that are new or changed, and tokens that are gone in
+// the -TOKEN form.
+func isupportChanges(oldTokens, newTokens []string) []string {
+	tokenName := func(token string) string {
+		if idx := strings.Index(token, "="); idx != -1 {
+			return token[:idx]
+		}
+		return token
+	}
+
+	old := make(map[string]string)
+	for _, token := range oldTokens {
+		old[tokenName(token)] = token
+	}
+
+	var changes []string
+	current := make(map[string]struct{})
+	for _, token := range newTokens {
+		current[tokenName(token)] = struct{}{}
+		if old[tokenName(token)] != token {
+			changes = append(changes, token)
+		}
+	}
+
+	for _, token := range oldTokens {
+		if _, ok := current[tokenName(token)]; !ok {
+			changes = append(changes, "-"+tokenName(token))
+		}
+	}
+
+	return changes
+}
+
+// sendISupportChanges tells our users about RPL_ISUPPORT tokens that changed,
+// such as after a rehash.
+func (cb *Catbox) sendISupportChanges(oldTokens []string) {
+	changes := isupportChanges(oldTokens, cb.isupportTokens())
+	if len(changes) == 0 {
+		return
+	}
+
+	for _, u := range cb.LocalUsers {
+		u.sendISupport(changes)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// STARTTLS lets a client on a plaintext port upgrade its connection to TLS.
+//
+// The client's reader and writer goroutines use its connection, so we can't
+// swap it out from under them. This is how we do it:
+//
+// 1. The reader reads STARTTLS. It passes it on and waits to hear from the
+// server goroutine before reading again.
+// 2. The server goroutine decides whether to allow it. If so, it queues 670
+// followed by startTLSMarker. If not, it tells the reader to carry on.
+// 3. The writer writes 670. When it reaches startTLSMarker, it does the
+// handshake and tells the server goroutine how it went (StartTLSEvent). It
+// then waits to hear from the server goroutine.
+// 4. The server goroutine swaps in the TLS connection and tells the reader and
+// writer to carry on. Or it cuts the client off.
+
+// startTLSMarker is what we queue on a client's write channel to tell its
+// writer to do the handshake. We never send it.
+var startTLSMarker = irc.Message{Command: "STARTTLS"}
+
+// startTLSCommand handles STARTTLS from a client.
+//
+// Only clients still registering may use it. Whatever happens we must let the
+// client's reader carry on unless we're upgrading.
+func (cb *Catbox) startTLSCommand(c *LocalClient) {
+	if lu, exists := cb.LocalUsers[c.ID]; exists {
+		// 691 ERR_STARTTLS
+		lu.messageFromServer("691", []string{"STARTTLS failed (already registered)"})
+		c.finishStartTLS(true)
+		return
+	}
+
+	if _, exists := cb.LocalClients[c.ID]; !exists {
+		c.finishStartTLS(true)
+		return
+	}
+
+	if c.isTLS() || cb.TLSConfig == nil {
+		// 691 ERR_STARTTLS
+		c.messageFromServer("691", []string{"STARTTLS failed"})
+		c.finishStartTLS(true)
+		return
+	}
+
+	// 670 RPL_STARTTLS
+	c.messageFromServer("670", []string{"STARTTLS successful, proceed with TLS handshake"})
+	c.maybeQueueMessage(startTLSMarker)
+}
+
+// startTLSDone takes the connection the client's writer upgraded. If the
+// handshake failed we cut the client off.
+func (cb *Catbox) startTLSDone(c *LocalClient, conn *tls.Conn, err error) {
+	if _, exists := cb.LocalClients[c.ID]; !exists {
+		c.finishStartTLS(false)
+		return
+	}
+
+	if err != nil {
+		clientsLog.Infof("Client %s: STARTTLS: %s", c, err)
+		c.finishStartTLS(false)
+		c.quit(fmt.Sprintf("STARTTLS failed: %s", err))
+		return
+	}
+
+	c.Conn = c.Conn.withConn(conn)
+	c.finishStartTLS(true)
+
+	state := conn.ConnectionState()
+	c.authNotice(fmt.Sprintf("*** Connected with %s (%s)",
+		tlsVersionToString(state.Version),
+		cipherSuiteToString(state.CipherSuite)))
+}
+
+// finishStartTLS tells the client's reader and writer whether to carry on.
+//
+// We don't block. Each waits for at most one answer at a time, and the
+// channels have room for one.
+func (c *LocalClient) finishStartTLS(ok bool) {
+	select {
+	case c.StartTLSReadChan <- ok:
+	default:
+	}
+	select {
+	case c.StartTLSWriteChan <- ok:
+	default:
+	}
+}
+
+// waitForStartTLS waits for the server goroutine to say whether to carry on.
+// We give up if we're shutting down.
+func (c *LocalClient) waitForStartTLS(ch <-chan bool) bool {
+	select {
+	case ok := <-ch:
+		return ok
+	case <-c.Catbox.ShutdownChan:
+		return false
+	}
+}
+
+// handshakeTLS runs the server side of the TLS handshake on the client's
+// plaintext connection. The writer calls this while the reader waits.
+func (c *LocalClient) handshakeTLS() (*tls.Conn, error) {
+	// The client should have waited for 670, but if it sent some of the
+	// handshake already, it's in our read buffer.
+	conn := tls.Server(bufferedConn{Conn: c.Conn.conn, r: c.Conn.rw.Reader},
+		c.Catbox.TLSConfig)
+
+	if err := conn.SetDeadline(time.Now().Add(c.Conn.ioWait)); err != nil {
+		return nil, fmt.Errorf("error setting deadline: %s", err)
+	}
+
+	if err := conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("error clearing deadline: %s", err)
+	}
+
+	version := conn.ConnectionState().Version
+	if version != tls.VersionTLS12 && version != tls.VersionTLS13 {
+		return nil, fmt.Errorf("this server requires at least TLS 1.2, not %s",
+			tlsVersionToString(version))
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection we read through a buffer which may already
+// hold some of what the peer sent.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store keeps state across restarts. e.g., bans and NickServ accounts.
+//
+// Each kind of state has a name. Which state we keep, and under what name, is
+// set by the config (e.g., bans-file). By default the name is a file. If we
+// have a state database (state-db), it's a key in the database instead.
+type Store interface {
+	// Load decodes the state saved under the name into v. It returns false if
+	// there is none.
+	Load(name string, v interface{}) (bool, error)
+
+	// Save replaces the state saved under the name with v.
+	Save(name string, v interface{}) error
+
+	// Close finishes saving and releases the store.
+	Close() error
+}
+
+// newStore opens the store the config says to use.
+func newStore(c *Config) (Store, error) {
+	if c.StateDB == "" {
+		return fileStore{}, nil
+	}
+	return openStateDB(c.StateDB)
+}
+
+// fileStore keeps each kind of state in its own file as JSON. Names are
+// files.
+type fileStore struct{}
+
+// Load reads the file. If it doesn't exist, there is no state.
+func (fileStore) Load(name string, v interface{}) (bool, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Save replaces the file.
+func (fileStore) Save(name string, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(name, ".catbox-state", buf)
+}
+
+// Close does nothing. We write files as we save them.
+func (fileStore) Close() error {
+	return nil
+}
+
+// StateDB keeps each kind of state in a bbolt database in one file. The
+// state's name is its key.
+//
+// Writing to the database waits for the disk, so we don't do it in the
+// server's goroutine. Save records the state and a goroutine writes it.
+// Several saves made while that goroutine is writing go in one transaction.
+// We keep the latest state in memory so Load sees what we saved even before
+// it's written.
+type StateDB struct {
+	db *bolt.DB
+
+	// mutex protects the fields below. The server's goroutine and the writer
+	// use them.
+	mutex sync.Mutex
+
+	// Name to the state's JSON. This includes state we have yet to write.
+	entries map[string][]byte
+
+	// Names with state we have yet to write.
+	dirty map[string]struct{}
+
+	// Whether we closed the database.
+	closed bool
+
+	// We signal the writer on wakeChan when there is state to write. It has a
+	// buffer of one so we never wait on it. The writer closes doneChan when it
+	// exits.
+	wakeChan chan struct{}
+	doneChan chan struct{}
+}
+
+// The bucket holding the state.
+var stateDBBucket = []byte("state")
+
+// How long we wait for another process to release the database file.
+const stateDBOpenTimeout = time.Second
+
+// openStateDB opens the database in the file, creating it if necessary. It
+// starts a goroutine to write to it. Close stops it.
+func openStateDB(file string) (*StateDB, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: stateDBOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open state database: %s", err)
+	}
+
+	s := &StateDB{
+		db:       db,
+		entries:  map[string][]byte{},
+		dirty:    map[string]struct{}{},
+		wakeChan: make(chan struct{}, 1),
+		doneChan: make(chan struct{}),
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(stateDBBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			s.entries[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("unable to read state database: %s", err)
+	}
+
+	go s.writer()
+
+	return s, nil
+}
+
+// Load decodes the named state.
+func (s *StateDB) Load(name string, v interface{}) (bool, error) {
+	s.mutex.Lock()
+	buf, exists := s.entries[name]
+	s.mutex.Unlock()
+	if !exists {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Save replaces the named state. The writer writes it to the database soon
+// after.
+func (s *StateDB) Save(name string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("state database is closed")
+	}
+
+	s.entries[name] = buf
+	s.dirty[name] = struct{}{}
+
+	select {
+	case s.wakeChan <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Close writes any state we have yet to write and closes the database.
+func (s *StateDB) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.wakeChan)
+	s.mutex.Unlock()
+
+	<-s.doneChan
+
+	// If the last write failed, try once more.
+	writeErr := s.write()
+
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("unable to close state database: %s", err)
+	}
+	return writeErr
+}
+
+// writer writes state to the database each time Save signals it. It runs
+// until Close.
+func (s *StateDB) writer() {
+	defer close(s.doneChan)
+
+	for range s.wakeChan {
+		if err := s.write(); err != nil {
+			coreLog.Errorf("%s", err)
+		}
+	}
+}
+
+// write writes all state we have yet to write in one transaction. If that
+// fails, the state stays to be written next time.
+func (s *StateDB) write() error {
+	s.mutex.Lock()
+	entries := map[string][]byte{}
+	for name := range s.dirty {
+		entries[name] = s.entries[name]
+	}
+	s.dirty = map[string]struct{}{}
+	s.mutex.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateDBBucket)
+		for name, buf := range entries {
+			if err := bucket.Put([]byte(name), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+
+	// Try again next time. We'll write whatever is latest then.
+	s.mutex.Lock()
+	for name := range entries {
+		s.dirty[name] = struct{}{}
+	}
+	s.mutex.Unlock()
+
+	return fmt.Errorf("unable to write state database: %s", err)
+}
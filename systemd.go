@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdNotifier tells systemd about our state (see sd_notify(3)). It does
+// nothing unless systemd started us with a notify socket, e.g., with
+// Type=notify.
+//
+// Only the server goroutine uses it.
+type systemdNotifier struct {
+	conn *net.UnixConn
+
+	// How often to tell systemd we're alive. 0 if it doesn't watch us.
+	watchdogInterval time.Duration
+	lastWatchdog     time.Time
+
+	// The last status we sent. We send it again only when it changes.
+	lastStatus string
+}
+
+// newSystemdNotifier connects to systemd's notify socket. The parameters are
+// the environment variables NOTIFY_SOCKET, WATCHDOG_USEC, and WATCHDOG_PID.
+func newSystemdNotifier(socket, watchdogUSec,
+	watchdogPID string) *systemdNotifier {
+	n := &systemdNotifier{}
+	if socket == "" {
+		return n
+	}
+
+	// A leading @ means an abstract socket.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		coreLog.Warnf("Unable to connect to systemd notify socket: %s", err)
+		return n
+	}
+	n.conn = conn
+
+	if watchdogUSec == "" {
+		return n
+	}
+
+	// The watchdog may be for another process.
+	if watchdogPID != "" && watchdogPID != strconv.Itoa(os.Getpid()) {
+		return n
+	}
+
+	usec, err := strconv.ParseInt(watchdogUSec, 10, 64)
+	if err != nil || usec <= 0 {
+		coreLog.Warnf("Invalid systemd watchdog interval: %s", watchdogUSec)
+		return n
+	}
+
+	// systemd suggests notifying at half the interval.
+	n.watchdogInterval = time.Duration(usec) * time.Microsecond / 2
+	return n
+}
+
+func (n *systemdNotifier) notify(state string) {
+	if n.conn == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		coreLog.Warnf("Error notifying systemd: %s", err)
+	}
+}
+
+// ready tells systemd we finished starting up or reloading.
+func (n *systemdNotifier) ready(status string) {
+	n.lastStatus = status
+	n.notify(fmt.Sprintf("READY=1\nSTATUS=%s", status))
+}
+
+// reloading tells systemd we're reloading our config. We tell it when we're
+// done with ready().
+func (n *systemdNotifier) reloading() {
+	n.notify("RELOADING=1")
+}
+
+// stopping tells systemd we're shutting down.
+func (n *systemdNotifier) stopping() {
+	n.notify("STOPPING=1")
+}
+
+// status updates the status systemd shows (e.g., in systemctl status).
+func (n *systemdNotifier) status(status string) {
+	if status == n.lastStatus {
+		return
+	}
+	n.lastStatus = status
+	n.notify(fmt.Sprintf("STATUS=%s", status))
+}
+
+// watchdog tells systemd we're alive if it's time to. If we stop calling this,
+// systemd considers us hung.
+func (n *systemdNotifier) watchdog() {
+	if n.watchdogInterval == 0 ||
+		time.Since(n.lastWatchdog) < n.watchdogInterval {
+		return
+	}
+	n.lastWatchdog = time.Now()
+	n.notify("WATCHDOG=1")
+}
+
+// updateSystemd tells systemd we're alive and how we're doing. We do this
+// from the server goroutine when the alarm wakes us, so if we stop processing
+// events, systemd's watchdog notices.
+func (cb *Catbox) updateSystemd() {
+	cb.Systemd.watchdog()
+	cb.Systemd.status(cb.systemdStatus())
+}
+
+// systemdStatus describes our state for systemd.
+func (cb *Catbox) systemdStatus() string {
+	return fmt.Sprintf("%d users (%d local), %d servers", len(cb.Users),
+		len(cb.LocalUsers), len(cb.Servers)+1)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// IRCv3 message tags.
+//
+// The irc package doesn't know about tags. To send a tagged message, we queue
+// tagsMarker holding the encoded tags followed by the message. The client's
+// writer remembers the tags and puts them in front of the next message it
+// encodes.
+//
+// We only send tags. We don't accept them from clients (we don't offer
+// message-tags).
+
+// tagsMarker is what we queue on a client's write channel before a message to
+// give it tags. Its only parameter is the encoded tags. We never send it.
+var tagsMarker = irc.Message{Command: "@"}
+
+// MessageTag is a tag to send with a message.
+type MessageTag struct {
+	Key   string
+	Value string
+}
+
+// encodeTags builds the tags part of a message (without the leading @).
+func encodeTags(tags []MessageTag) string {
+	var parts []string
+	for _, tag := range tags {
+		if tag.Value == "" {
+			parts = append(parts, tag.Key)
+			continue
+		}
+		parts = append(parts, tag.Key+"="+escapeTagValue(tag.Value))
+	}
+	return strings.Join(parts, ";")
+}
+
+var tagValueEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
+
+// escapeTagValue escapes a tag value as IRCv3 requires.
+func escapeTagValue(s string) string {
+	return tagValueEscaper.Replace(s)
+}
+
+// tagCaps are the capabilities a client needs for us to send it each tag.
+// Clients that never negotiated CAP have none, so they get no tags.
+var tagCaps = map[string]string{
+	"batch": "batch",
+	"time":  "server-time",
+}
+
+// maybeQueueTaggedMessage queues a message with tags. We drop tags the client
+// didn't ask for. If there are none left, this is the same as
+// maybeQueueMessage().
+func (c *LocalClient) maybeQueueTaggedMessage(tags []MessageTag,
+	m irc.Message) {
+	var wanted []MessageTag
+	for _, tag := range tags {
+		if capName, exists := tagCaps[tag.Key]; exists && c.hasCap(capName) {
+			wanted = append(wanted, tag)
+		}
+	}
+	tags = wanted
+
+	if len(tags) > 0 {
+		c.maybeQueueMessage(irc.Message{
+			Command: tagsMarker.Command,
+			Params:  []string{encodeTags(tags)},
+		})
+	}
+	c.maybeQueueMessage(m)
+}
+
+// encodeMessage encodes a message to send, with tags if it has them.
+func encodeMessage(tags string, m irc.Message) (string, error) {
+	buf, err := m.Encode()
+	if tags == "" {
+		return buf, err
+	}
+	return "@" + tags + " " + buf, err
+}
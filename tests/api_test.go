@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test the admin API's read endpoints and actions.
+func TestAPI(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	listener, apiPort, err := getRandomPort()
+	require.NoError(t, err, "get random port")
+	require.NoError(t, listener.Close(), "close random port")
+
+	// The API listener needs a restart to take effect.
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("api-listen = 127.0.0.1:%d\napi-token = secret", apiPort)),
+		"write conf",
+	)
+	require.NoError(t, catbox.Command.Process.Signal(syscall.SIGUSR1), "SIGUSR1")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`catbox started$`)),
+		"catbox restarts",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	client1.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client1.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "JOIN" })
+
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	client2.send(irc.Message{Command: "NICK", Params: []string{"client2"}})
+	client2.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client2", "0", "*", "client2"},
+	})
+	client2.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+
+	api := func(method, path, token, body string, response interface{}) int {
+		req, err := http.NewRequest(method,
+			fmt.Sprintf("http://127.0.0.1:%d%s", apiPort, path),
+			bytes.NewBufferString(body))
+		require.NoError(t, err, "make request")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "make request")
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		if response != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(response),
+				"decode response")
+		}
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusUnauthorized,
+		api("GET", "/api/users", "", "", nil), "no token")
+	require.Equal(t, http.StatusUnauthorized,
+		api("GET", "/api/users", "wrong", "", nil), "wrong token")
+	require.Equal(t, http.StatusMethodNotAllowed,
+		api("GET", "/api/rehash", "secret", "", nil), "wrong method")
+
+	var users []map[string]interface{}
+	require.Equal(t, http.StatusOK,
+		api("GET", "/api/users", "secret", "", &users), "users")
+	require.Len(t, users, 2, "users")
+	require.Equal(t, "client1", users[0]["nick"], "user nick")
+	require.Equal(t, "irc.example.org", users[0]["server"], "user server")
+	require.Equal(t, []interface{}{"#test"}, users[0]["channels"],
+		"user channels")
+
+	var channels []map[string]interface{}
+	require.Equal(t, http.StatusOK,
+		api("GET", "/api/channels", "secret", "", &channels), "channels")
+	require.Len(t, channels, 1, "channels")
+	require.Equal(t, "#test", channels[0]["name"], "channel name")
+	require.Equal(t, []interface{}{"client1"}, channels[0]["members"],
+		"channel members")
+
+	var servers []map[string]interface{}
+	require.Equal(t, http.StatusOK,
+		api("GET", "/api/servers", "secret", "", &servers), "servers")
+	require.Len(t, servers, 1, "servers")
+	require.Equal(t, "irc.example.org", servers[0]["name"], "server name")
+
+	require.Equal(t, http.StatusBadRequest,
+		api("POST", "/api/kline", "secret", `{"mask": "bad", "reason": "x"}`,
+			nil), "bad mask")
+	require.Equal(t, http.StatusOK,
+		api("POST", "/api/kline", "secret",
+			`{"mask": "*client2@*", "reason": "go away"}`, nil), "kline")
+	client2.waitFor(func(m irc.Message) bool {
+		return m.Command == "ERROR" && m.Params[0] == "Connection closed: go away"
+	})
+
+	var bans []map[string]interface{}
+	require.Equal(t, http.StatusOK,
+		api("GET", "/api/bans", "secret", "", &bans), "bans")
+	require.Len(t, bans, 1, "bans")
+	require.Equal(t, "*client2@*", bans[0]["mask"], "ban mask")
+
+	require.Equal(t, http.StatusOK,
+		api("POST", "/api/unkline", "secret", `{"mask": "*client2@*"}`, nil),
+		"unkline")
+	require.Equal(t, http.StatusOK,
+		api("GET", "/api/bans", "secret", "", &bans), "bans")
+	require.Len(t, bans, 0, "bans")
+
+	require.Equal(t, http.StatusNotFound,
+		api("POST", "/api/kill", "secret", `{"nick": "nobody"}`, nil),
+		"kill unknown nick")
+	require.Equal(t, http.StatusOK,
+		api("POST", "/api/kill", "secret",
+			`{"nick": "client1", "reason": "bye"}`, nil), "kill")
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "ERROR" &&
+			m.Params[0] == "Killed (irc.example.org (bye))"
+	})
+
+	require.Equal(t, http.StatusOK,
+		api("POST", "/api/rehash", "secret", "", nil), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	require.Equal(t, http.StatusNotFound,
+		api("POST", "/api/squit", "secret", `{"server": "irc2.example.org"}`,
+			nil), "squit unknown server")
+}
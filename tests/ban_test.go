@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test sending and receiving BAN with a server that has the BAN capab.
+func TestBAN(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0,0,,,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan, sendChan, _, err := client.Start()
+	require.NoError(t, err, "start client")
+	defer client.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client.GetNick()),
+		"client gets welcome",
+	)
+
+	sendChan <- irc.Message{Command: "OPER", Params: []string{"oper", "testing"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: "381"},
+			"%s received 381", client.GetNick()),
+		"client becomes an operator",
+	)
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+
+	server.send(irc.Message{Command: "PASS", Params: []string{"testing", "TS", "6", "042"}})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP BAN"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	now := time.Now().Unix()
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", now)},
+	})
+	sync := func() {
+		server.send(irc.Message{
+			Prefix:  "042",
+			Command: "PING",
+			Params:  []string{"irc2.example.org", "001"},
+		})
+		server.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+	}
+	sync()
+
+	// A temporary K-Line goes out as BAN.
+	sendChan <- irc.Message{Command: "KLINE", Params: []string{"5", "*@192.0.2.1", "bad"}}
+	ban := server.waitFor(func(m irc.Message) bool { return m.Command == "BAN" })
+	require.Len(t, ban.Params, 8, "BAN parameters")
+	require.Equal(t, []string{"K", "*", "192.0.2.1"}, ban.Params[:3], "BAN mask")
+	require.Equal(t, []string{"300", "300"}, ban.Params[4:6], "BAN duration")
+	require.Equal(t, "bad", ban.Params[7], "BAN reason")
+	created, err := strconv.ParseInt(ban.Params[3], 10, 64)
+	require.NoError(t, err, "BAN creation TS")
+
+	banMessage := func(host string, created, duration int64, reason string) irc.Message {
+		return irc.Message{
+			Prefix:  "042",
+			Command: "BAN",
+			Params: []string{"K", "*", host, fmt.Sprintf("%d", created),
+				fmt.Sprintf("%d", duration), "3600", "*", reason},
+		}
+	}
+
+	// A ban set elsewhere.
+	server.send(banMessage("192.0.2.2", now, 3600, "worse"))
+	// Its removal, but older than it. We ignore it.
+	server.send(banMessage("192.0.2.2", now-10, 0, "worse"))
+	// A ban that already expired.
+	server.send(banMessage("192.0.2.3", now-100, 10, "expired"))
+	// Removing the one we set.
+	server.send(banMessage("192.0.2.1", created+1, 0, "bad"))
+	sync()
+
+	sendChan <- irc.Message{Command: "STATS", Params: []string{"K"}}
+	var hosts []string
+	for {
+		select {
+		case m := <-recvChan:
+			if m.Command == "216" {
+				hosts = append(hosts, m.Params[2])
+				continue
+			}
+			if m.Command != "219" {
+				continue
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for STATS K")
+		}
+		break
+	}
+	require.Equal(t, []string{"192.0.2.2"}, hosts, "K-Lines")
+}
+
+// Test we send our K-Lines when a server links.
+func TestBanBurst(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0,0,,,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan, sendChan, _, err := client.Start()
+	require.NoError(t, err, "start client")
+	defer client.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client.GetNick()),
+		"client gets welcome",
+	)
+
+	sendChan <- irc.Message{Command: "OPER", Params: []string{"oper", "testing"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: "381"},
+			"%s received 381", client.GetNick()),
+		"client becomes an operator",
+	)
+
+	sendChan <- irc.Message{Command: "KLINE", Params: []string{"*@192.0.2.1", "permanent"}}
+	sendChan <- irc.Message{Command: "KLINE", Params: []string{"5", "*@192.0.2.2", "temporary"}}
+	sendChan <- irc.Message{Command: "STATS", Params: []string{"K"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: "219"},
+			"%s received 219", client.GetNick()),
+		"client gets STATS K",
+	)
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+
+	server.send(irc.Message{Command: "PASS", Params: []string{"testing", "TS", "6", "042"}})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP KLN BAN"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "PING",
+		Params:  []string{"irc2.example.org", "001"},
+	})
+
+	var klines, bans []irc.Message
+	server.waitFor(func(m irc.Message) bool {
+		if m.Command == "KLINE" {
+			klines = append(klines, m)
+		}
+		if m.Command == "BAN" {
+			bans = append(bans, m)
+		}
+		return m.Command == "PONG"
+	})
+
+	require.Len(t, klines, 1, "KLINEs in burst")
+	require.Equal(t, []string{"*", "0", "*", "192.0.2.1", "permanent"},
+		klines[0].Params, "KLINE")
+
+	require.Len(t, bans, 1, "BANs in burst")
+	require.Equal(t, []string{"K", "*", "192.0.2.2"}, bans[0].Params[:3], "BAN")
+	require.Equal(t, "temporary", bans[0].Params[7], "BAN reason")
+}
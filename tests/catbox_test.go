@@ -73,7 +73,7 @@ func harnessCatbox(
 	// certain things we do in tests will not work well. For example, trying to
 	// reload the conf by sending a SIGHUP will kill the process.
 	startedRE := regexp.MustCompile(
-		`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} catbox started$`)
+		`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO core: catbox started$`)
 
 	if !waitForLog(logChan, startedRE) {
 		catbox.stop()
@@ -205,17 +205,26 @@ func writeConf(
 	sid,
 	extra string,
 ) error {
+	// Every server has an operator, oper, with password testing.
+	opersConf := filepath.Join(filepath.Dir(filename), "opers.conf")
+	if err := ioutil.WriteFile(opersConf, []byte("oper = testing\n"),
+		0644); err != nil {
+		return fmt.Errorf("error writing opers conf: %s: %s", opersConf, err)
+	}
+
 	// -1 because we pass in fd.
 	buf := fmt.Sprintf(`
 listen-port = %d
 server-name = %s
 ts6-sid = %s
 connect-attempt-time = 100ms
+opers-config = %s
 %s
 `,
 		-1,
 		serverName,
 		sid,
+		opersConf,
 		extra,
 	)
 
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we advertise and enforce the limit on how many channels a user may
+// be in, and that operators have no limit.
+func TestChannelLimit(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID, "max-channels = 2\n"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	client.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+
+	var tokens []string
+	for {
+		m := client.waitFor(func(m irc.Message) bool {
+			return m.Command == "005" || m.Command == "376" || m.Command == "422"
+		})
+		if m.Command != "005" {
+			break
+		}
+		tokens = append(tokens, m.Params[1:len(m.Params)-1]...)
+	}
+	require.Contains(t, tokens, "CHANLIMIT=#&:2", "ISUPPORT")
+
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#a"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#b"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#c"}})
+	m := client.waitFor(func(m irc.Message) bool { return m.Command == "405" })
+	require.Equal(t, "#c", m.Params[1], "third channel refused")
+
+	client.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#c"}})
+	m = client.waitFor(func(m irc.Message) bool {
+		return m.Command == "405" || m.Command == "JOIN"
+	})
+	require.Equal(t, "JOIN", m.Command, "operator has no limit")
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that a channel gets back its TS, topic, and modes after we restart.
+// Its modes apply to whoever makes it again.
+func TestChannelsFile(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	channelsFile := filepath.Join(catbox.ConfigDir, "channels.json")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("channels-file = %s\n", channelsFile)),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	registerRawClient(client1, "client1", "")
+
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client1.send(irc.Message{
+		Command: "TOPIC",
+		Params:  []string{"#test", "a topic to keep"},
+	})
+	client1.send(irc.Message{
+		Command: "MODE",
+		Params:  []string{"#test", "+kb", "secret", "bad!*@*"},
+	})
+	client1.send(irc.Message{Command: "MODE", Params: []string{"#test"}})
+	modes := client1.waitFor(func(m irc.Message) bool { return m.Command == "324" })
+	created := client1.waitFor(func(m irc.Message) bool { return m.Command == "329" })
+
+	// Make sure a new channel would have a different TS.
+	time.Sleep(time.Second)
+
+	require.NoError(t, catbox.Command.Process.Signal(syscall.SIGUSR1), "SIGUSR1")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`catbox started$`)),
+		"catbox restarts",
+	)
+
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	registerRawClient(client2, "client2", "")
+
+	// The key still applies to whoever makes the channel again.
+	client2.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "475" })
+
+	client2.send(irc.Message{
+		Command: "JOIN",
+		Params:  []string{"#test", "secret"},
+	})
+	topic := client2.waitFor(func(m irc.Message) bool { return m.Command == "332" })
+	require.Equal(t, "a topic to keep", topic.Params[2], "topic restored")
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	client2.send(irc.Message{Command: "MODE", Params: []string{"#test"}})
+	modes2 := client2.waitFor(func(m irc.Message) bool { return m.Command == "324" })
+	require.Equal(t, modes.Params[2:], modes2.Params[2:], "modes restored")
+	created2 := client2.waitFor(func(m irc.Message) bool {
+		return m.Command == "329"
+	})
+	require.Equal(t, created.Params[2], created2.Params[2], "TS restored")
+
+	client2.send(irc.Message{Command: "MODE", Params: []string{"#test", "b"}})
+	ban := client2.waitFor(func(m irc.Message) bool { return m.Command == "367" })
+	require.Equal(t, "bad!*@*", ban.Params[2], "ban restored")
+}
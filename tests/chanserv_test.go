@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test registering a channel with ChanServ, ChanServ keeping its topic and
+// moderation log, and ChanServ giving the founder ops when they join.
+func TestChanServ(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("nickserv-file = %s\nchanserv-file = %s",
+				filepath.Join(catbox.ConfigDir, "nickserv.json"),
+				filepath.Join(catbox.ConfigDir, "chanserv.json"))),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	sendChan1 <- irc.Message{Command: "NS", Params: []string{"REGISTER", "secret"}}
+	waitForNickServ(t, recvChan1, "You are now logged in as client1.")
+
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+			"%s received JOIN", client1.GetNick()),
+		"client joins",
+	)
+
+	sendChan1 <- irc.Message{Command: "CS", Params: []string{"REGISTER", "#test"}}
+	waitForChanServ(t, recvChan1, "#test is now registered to client1.")
+
+	sendChan1 <- irc.Message{Command: "TOPIC", Params: []string{"#test", "hello"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "TOPIC"},
+			"%s received TOPIC", client1.GetNick()),
+		"client sets topic",
+	)
+
+	// The channel goes away when they leave.
+	sendChan1 <- irc.Message{Command: "PART", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "PART"},
+			"%s received PART", client1.GetNick()),
+		"client parts",
+	)
+
+	// ChanServ sets the topic when the channel is created again.
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	topic := waitForMessage(t, recvChan2, irc.Message{Command: "332"},
+		"%s received 332", client2.GetNick())
+	require.NotNil(t, topic, "client 2 gets topic")
+	require.Equal(t, "hello", topic.Params[2], "topic")
+
+	// The founder gets ops on join.
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	for {
+		mode := waitForMessage(t, recvChan2, irc.Message{Command: "MODE"},
+			"%s received MODE", client2.GetNick())
+		require.NotNil(t, mode, "client 2 sees founder get ops")
+		if len(mode.Params) == 3 && mode.Params[2] == "client1" {
+			require.Equal(t, "+o", mode.Params[1], "mode")
+			require.Regexp(t, "^ChanServ!", mode.Prefix, "source")
+			break
+		}
+	}
+
+	// The moderation log survived the channel going away.
+	sendChan1 <- irc.Message{Command: "MODLOG", Params: []string{"#test"}}
+	for {
+		notice := waitForMessage(t, recvChan1, irc.Message{Command: "NOTICE"},
+			"%s received NOTICE", client1.GetNick())
+		require.NotNil(t, notice, "client 1 gets moderation log")
+		require.NotEqual(t, "#test: End of moderation log", notice.Params[1],
+			"moderation log has topic change")
+		if strings.HasSuffix(notice.Params[1], "TOPIC hello") {
+			break
+		}
+	}
+}
+
+// waitForChanServ waits for a notice from ChanServ with the text.
+func waitForChanServ(t *testing.T, ch <-chan irc.Message, text string) {
+	for {
+		notice := waitForMessage(t, ch, irc.Message{Command: "NOTICE"},
+			"received NOTICE")
+		require.NotNil(t, notice, "ChanServ notice: %s", text)
+		if notice.Prefix == "ChanServ!ChanServ@irc.example.org" &&
+			notice.Params[1] == text {
+			return
+		}
+	}
+}
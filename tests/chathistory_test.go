@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test clients with server-time getting history when they join, and clients
+// with draft/chathistory asking for it.
+func TestChatHistory(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID, "channel-history-length = 50\n"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	registerRawClient(client1, "client1", "")
+
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	for i := 1; i <= 3; i++ {
+		client1.send(irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{"#test", fmt.Sprintf("hello %d", i)},
+		})
+	}
+	client1.send(irc.Message{Command: "PING", Params: []string{"test"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+
+	// Clients with server-time get the latest messages when they join.
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	registerRawClient(client2, "client2", "batch server-time")
+
+	client2.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	texts := client2.readHistoryBatch("chathistory #test")
+	require.Equal(t, []string{"hello 1", "hello 2", "hello 3"}, texts,
+		"history played back")
+
+	// Clients with draft/chathistory ask for it.
+	client3 := dialRaw(t, catbox.Port)
+	defer client3.close()
+	registerRawClient(client3, "client3",
+		"batch server-time draft/chathistory")
+
+	client3.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client3.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	client3.send(irc.Message{
+		Command: "CHATHISTORY",
+		Params:  []string{"LATEST", "#test", "*", "2"},
+	})
+	texts = client3.readHistoryBatch("chathistory #test")
+	require.Equal(t, []string{"hello 2", "hello 3"}, texts, "latest history")
+
+	client3.send(irc.Message{
+		Command: "CHATHISTORY",
+		Params: []string{"BEFORE", "#test",
+			"timestamp=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"1"},
+	})
+	texts = client3.readHistoryBatch("chathistory #test")
+	require.Equal(t, []string{"hello 3"}, texts, "history before")
+
+	// Only members may see a channel's history.
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#other"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client3.send(irc.Message{
+		Command: "CHATHISTORY",
+		Params:  []string{"LATEST", "#other", "*", "10"},
+	})
+	fail := client3.waitFor(func(m irc.Message) bool { return m.Command == "FAIL" })
+	require.Equal(t, "INVALID_TARGET", fail.Params[1], "not a member")
+}
+
+// registerRawClient registers the client. If caps is set, it requests those
+// capabilities first.
+func registerRawClient(client *rawConn, nick, caps string) {
+	if caps != "" {
+		client.send(irc.Message{Command: "CAP", Params: []string{"REQ", caps}})
+		ack := client.waitFor(func(m irc.Message) bool { return m.Command == "CAP" })
+		require.Equal(client.t, "ACK", ack.Params[1], "caps acknowledged")
+		client.send(irc.Message{Command: "CAP", Params: []string{"END"}})
+	}
+	client.send(irc.Message{Command: "NICK", Params: []string{nick}})
+	client.send(irc.Message{
+		Command: "USER",
+		Params:  []string{nick, "0", "*", nick},
+	})
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+}
+
+// readHistoryBatch reads a batch of history and returns the messages' text.
+// Each message must have the batch and time tags.
+func (r *rawConn) readHistoryBatch(batch string) []string {
+	ref := ""
+	var texts []string
+	for {
+		require.NoError(r.t, r.conn.SetReadDeadline(time.Now().Add(10*time.Second)),
+			"set deadline")
+		line, err := r.rw.ReadString('\n')
+		require.NoError(r.t, err, "read from catbox")
+
+		tags := ""
+		if strings.HasPrefix(line, "@") {
+			idx := strings.Index(line, " ")
+			tags, line = line[1:idx], line[idx+1:]
+		}
+
+		m, err := irc.ParseMessage(line)
+		require.NoError(r.t, err, "parse message")
+
+		if m.Command == "BATCH" {
+			if ref == "" {
+				require.Equal(r.t, batch, strings.Join(m.Params[1:], " "),
+					"batch type")
+				ref = strings.TrimPrefix(m.Params[0], "+")
+				continue
+			}
+			require.Equal(r.t, "-"+ref, m.Params[0], "batch end")
+			return texts
+		}
+
+		if ref == "" || m.Command != "PRIVMSG" {
+			continue
+		}
+
+		require.Regexp(r.t,
+			`^batch=`+ref+`;time=\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z$`,
+			tags, "tags")
+		texts = append(texts, m.Params[1])
+	}
+}
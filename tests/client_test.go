@@ -110,8 +110,8 @@ func (c *Client) connect() error {
 		KeepAlive: 30 * time.Second,
 	}
 
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", c.serverHost,
-		c.serverPort))
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(c.serverHost,
+		fmt.Sprintf("%d", c.serverPort)))
 	if err != nil {
 		return fmt.Errorf("error dialing: %s", err)
 	}
@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that a nick collision with equal TSes saves both users (changes their
+// nicks to their UIDs) rather than killing them when the other server
+// supports SAVE.
+func TestCollisionSave(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan, _, _, err := client.Start()
+	require.NoError(t, err, "start client")
+	defer client.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client.GetNick()),
+		"client gets welcome",
+	)
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+
+	server.send(irc.Message{Command: "PASS", Params: []string{"testing", "TS", "6", "042"}})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP SAVE"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+
+	uidMessage := server.waitFor(func(m irc.Message) bool {
+		return m.Command == "UID" && m.Params[0] == client.GetNick()
+	})
+	uid := uidMessage.Params[7]
+	nickTS := uidMessage.Params[2]
+
+	// Introduce a different user with the same nick and TS.
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "UID",
+		Params: []string{"client1", "1", nickTS, "+i", "other", "other.example.org",
+			"0", "042AAAAAB", "Other"},
+	})
+
+	saved := map[string]string{}
+	for len(saved) < 2 {
+		save := server.waitFor(func(m irc.Message) bool { return m.Command == "SAVE" })
+		saved[save.Params[0]] = save.Params[1]
+	}
+	require.Equal(t, map[string]string{uid: nickTS, "042AAAAAB": nickTS}, saved,
+		"both users saved")
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: "043"},
+			"%s received 043", client.GetNick()),
+		"client hears about the collision",
+	)
+	nick := waitForMessage(t, recvChan, irc.Message{Command: "NICK"},
+		"%s received NICK", client.GetNick())
+	require.NotNil(t, nick, "client's nick changes")
+	require.Equal(t, []string{uid}, nick.Params, "new nick is UID")
+}
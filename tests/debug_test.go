@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we serve pprof and our state on the debug listener.
+func TestDebugListener(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	listener, debugPort, err := getRandomPort()
+	require.NoError(t, err, "get random port")
+	require.NoError(t, listener.Close(), "close random port")
+
+	// The debug listener needs a restart to take effect.
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("debug-listen = 127.0.0.1:%d", debugPort)),
+		"write conf",
+	)
+	require.NoError(t, catbox.Command.Process.Signal(syscall.SIGUSR1), "SIGUSR1")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan,
+			regexp.MustCompile(`Serving debug information on 127\.0\.0\.1:\d+$`)),
+		"catbox serves debug information",
+	)
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`catbox started$`)),
+		"catbox restarts",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	client.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "JOIN" })
+
+	baseURL := fmt.Sprintf("http://127.0.0.1:%d", debugPort)
+
+	resp, err := http.Get(baseURL + "/debug/state")
+	require.NoError(t, err, "get state")
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode, "state status")
+	var state map[string]int
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&state), "decode state")
+	require.Equal(t, 1, state["local_users"], "local users")
+	require.Equal(t, 1, state["channels"], "channels")
+	require.True(t, state["goroutines"] > 0, "goroutines")
+
+	resp2, err := http.Get(baseURL + "/debug/pprof/goroutine?debug=1")
+	require.NoError(t, err, "get goroutine profile")
+	defer func() {
+		_ = resp2.Body.Close()
+	}()
+	buf, err := ioutil.ReadAll(resp2.Body)
+	require.NoError(t, err, "read goroutine profile")
+	require.Equal(t, http.StatusOK, resp2.StatusCode, "profile status")
+	require.Contains(t, string(buf), "eventLoop", "profile shows event loop")
+}
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we log operator actions and kills to their own files.
+func TestEventLogFiles(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	operLog := filepath.Join(catbox.ConfigDir, "oper.log")
+	killLog := filepath.Join(catbox.ConfigDir, "kill.log")
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("oper-log-file = %s\nkill-log-file = %s", operLog, killLog)),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	client1.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client1.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	client2.send(irc.Message{Command: "NICK", Params: []string{"client2"}})
+	client2.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client2", "0", "*", "client2"},
+	})
+	client2.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+
+	client1.send(irc.Message{Command: "OPER", Params: []string{"oper", "wrong"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "464" })
+	client1.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	client1.send(irc.Message{
+		Command: "KILL",
+		Params:  []string{"client2", "go away"},
+	})
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "ERROR" })
+
+	requireLogLines(t, operLog, []string{
+		`INFO oper: Failed OPER attempt as oper by client1 \(~?client1@\S+\) \[\S+\]: password mismatch \(failure 1\)$`,
+		`INFO oper: client1 \(~?client1@\S+\) became an operator using oper block oper$`,
+		`INFO oper: client1 \(~?client1@\S+\) used KILL client2 go away$`,
+	})
+	requireLogLines(t, killLog, []string{
+		`INFO kill: client2 \(~?client2@\S+\) was killed by client1 \(go away\)$`,
+	})
+}
+
+// requireLogLines waits for a log file to hold lines matching the patterns,
+// in order.
+func requireLogLines(t *testing.T, file string, patterns []string) {
+	var lines []string
+	for i := 0; i < 50; i++ {
+		buf, err := ioutil.ReadFile(file)
+		require.NoError(t, err, "read log file")
+		lines = strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+		if len(lines) >= len(patterns) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	require.Len(t, lines, len(patterns), "log lines in %s", file)
+	for i, pattern := range patterns {
+		require.Regexp(t, regexp.MustCompile(pattern), lines[i], "log line")
+	}
+}
@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test an operator sending a GLOBOPS to an operator on another server.
+func TestGLOBOPS(t *testing.T) {
+	catbox1, err := harnessCatbox("irc1.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox1.stop()
+
+	catbox2, err := harnessCatbox("irc2.example.org", "002")
+	require.NoError(t, err, "harness catbox")
+	defer catbox2.stop()
+
+	err = catbox1.linkServer(catbox2)
+	require.NoError(t, err, "link catbox1 to catbox2")
+	err = catbox2.linkServer(catbox1)
+	require.NoError(t, err, "link catbox2 to catbox1")
+
+	// Wait until we link. See TestMODETS() about the retries.
+	linkRE := regexp.MustCompile(`Established link to irc2\.`)
+	var attempts int
+	for {
+		if waitForLog(catbox1.LogChan, linkRE) {
+			break
+		}
+		attempts++
+		if attempts >= 5 {
+			require.Fail(t, "failed to link")
+		}
+		require.NoError(t, catbox1.rehash(), "rehash catbox1")
+		require.NoError(t, catbox2.rehash(), "rehash catbox2")
+	}
+
+	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox2.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	sendChan1 <- irc.Message{Command: "OPER", Params: []string{"oper", "testing"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "381"},
+			"%s received 381", client1.GetNick()),
+		"client becomes an operator",
+	)
+	sendChan2 <- irc.Message{Command: "OPER", Params: []string{"oper", "testing"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: "381"},
+			"%s received 381", client2.GetNick()),
+		"client 2 becomes an operator",
+	)
+
+	sendChan1 <- irc.Message{Command: "GLOBOPS", Params: []string{"hi there"}}
+
+	want := "*** Global -- from " + client1.GetNick() + ": hi there"
+	for {
+		notice := waitForMessage(t, recvChan2, irc.Message{Command: "NOTICE"},
+			"%s received NOTICE", client2.GetNick())
+		require.NotNil(t, notice, "client 2 gets the GLOBOPS")
+		if len(notice.Params) == 2 && strings.HasPrefix(notice.Params[1], "*** Global") {
+			require.Equal(t, want, notice.Params[1], "GLOBOPS text")
+			break
+		}
+	}
+}
+
+// Test that GLOBOPS travels between servers in ENCAP, and that one from a
+// source we don't know doesn't break the link.
+func TestGLOBOPSENCAP(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	oper := dialRaw(t, catbox.Port)
+	defer oper.close()
+	registerRawClient(oper, "oper1", "")
+	oper.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	oper.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP TB"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "PING",
+		Params:  []string{"irc2.example.org", "001"},
+	})
+	server.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+
+	oper.send(irc.Message{Command: "GLOBOPS", Params: []string{"hi there"}})
+	m := server.waitFor(func(m irc.Message) bool {
+		return m.Command == "ENCAP" || m.Command == "GLOBOPS"
+	})
+	require.Equal(t, "ENCAP", m.Command, "server hears ENCAP")
+	require.Equal(t, []string{"*", "GLOBOPS", "hi there"}, m.Params,
+		"ENCAP parameters")
+
+	// A user who already quit.
+	server.send(irc.Message{
+		Prefix:  "042AAAAAA",
+		Command: "ENCAP",
+		Params:  []string{"*", "GLOBOPS", "from nowhere"},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"*", "GLOBOPS", "from irc2"},
+	})
+	m = oper.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" && len(m.Params) == 2 &&
+			strings.HasPrefix(m.Params[1], "*** Global") &&
+			!strings.Contains(m.Params[1], "hi there")
+	})
+	require.Equal(t, "*** Global -- from irc2.example.org: from irc2",
+		m.Params[1], "operator sees GLOBOPS from the server")
+
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "PING",
+		Params:  []string{"irc2.example.org", "001"},
+	})
+	server.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+}
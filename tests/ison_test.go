@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test ISON tells which nicks are present.
+func TestISON(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	client1 := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("Client2", "127.0.0.1", catbox.Port)
+	recvChan2, _, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	// Nicks may be in one parameter or several. We reply with the nick as the
+	// user has it.
+	sendChan1 <- irc.Message{
+		Command: "ISON",
+		Params:  []string{"client2", "nobody client1"},
+	}
+	messageIsEqual(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "303"},
+			"%s received 303", client1.GetNick()),
+		&irc.Message{
+			Prefix:  catbox.Name,
+			Command: "303",
+			Params:  []string{client1.GetNick(), "Client2 client1"},
+		},
+	)
+
+	sendChan1 <- irc.Message{Command: "ISON", Params: []string{"nobody"}}
+	messageIsEqual(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "303"},
+			"%s received 303", client1.GetNick()),
+		&irc.Message{
+			Prefix:  catbox.Name,
+			Command: "303",
+			Params:  []string{client1.GetNick(), ""},
+		},
+	)
+}
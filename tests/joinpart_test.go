@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that users who join and part too often may not join for a while, and
+// that operators hear about it.
+func TestJoinPartFlood(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			"join-part-count = 3\njoin-part-time = 1m\n"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	oper := dialRaw(t, catbox.Port)
+	defer oper.close()
+	registerRawClient(oper, "oper1", "")
+	oper.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	oper.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	registerRawClient(client, "client1", "")
+
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#a"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client.send(irc.Message{Command: "PART", Params: []string{"#a"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "PART" })
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#b"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#c,#d"}})
+	m := client.waitFor(func(m irc.Message) bool {
+		return m.Command == "263" || m.Command == "JOIN"
+	})
+	require.Equal(t, "263", m.Command, "join refused")
+
+	m = oper.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" &&
+			regexp.MustCompile(`join/part flooding$`).MatchString(m.Params[1])
+	})
+	require.Regexp(t,
+		`^\*\*\* Notice --- client1 \(~?client1@\S+\) is join/part flooding$`,
+		m.Params[1], "oper notice")
+
+	// They may still part.
+	client.send(irc.Message{Command: "PART", Params: []string{"#b"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "PART" })
+
+	// Operators are exempt.
+	for _, channel := range []string{"#a", "#b", "#c", "#d"} {
+		oper.send(irc.Message{Command: "JOIN", Params: []string{channel}})
+		oper.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	}
+}
+
+// Test that joins forwarded to another channel (+f) count towards join/part
+// flooding.
+func TestJoinPartFloodForward(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			"join-part-count = 3\njoin-part-time = 1m\n"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	op := dialRaw(t, catbox.Port)
+	defer op.close()
+	registerRawClient(op, "client1", "")
+	op.send(irc.Message{Command: "JOIN", Params: []string{"#test,#overflow"}})
+	for i := 0; i < 2; i++ {
+		op.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	}
+	op.send(irc.Message{
+		Command: "MODE",
+		Params:  []string{"#test", "+jf", "1:60", "#overflow"},
+	})
+	op.waitFor(func(m irc.Message) bool { return m.Command == "MODE" })
+
+	// Use up the throttle so later joins are forwarded.
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	registerRawClient(client2, "client2", "")
+	client2.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	client3 := dialRaw(t, catbox.Port)
+	defer client3.close()
+	registerRawClient(client3, "client3", "")
+	for i := 0; i < 2; i++ {
+		client3.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+		m := client3.waitFor(func(m irc.Message) bool { return m.Command == "JOIN" })
+		require.Equal(t, []string{"#overflow"}, m.Params, "join forwarded")
+		client3.send(irc.Message{Command: "PART", Params: []string{"#overflow"}})
+		client3.waitFor(func(m irc.Message) bool { return m.Command == "PART" })
+	}
+
+	client3.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	m := client3.waitFor(func(m irc.Message) bool {
+		return m.Command == "263" || m.Command == "470"
+	})
+	require.Equal(t, "263", m.Command, "join refused")
+}
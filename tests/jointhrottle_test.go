@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that a channel's join throttle (+j) sends users to its forward channel
+// (+f) once it refuses joins.
+func TestJoinThrottleForward(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	op := dialRaw(t, catbox.Port)
+	defer op.close()
+	registerRawClient(op, "client1", "")
+	op.send(irc.Message{Command: "JOIN", Params: []string{"#test,#overflow"}})
+	for i := 0; i < 2; i++ {
+		op.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	}
+	op.send(irc.Message{
+		Command: "MODE",
+		Params:  []string{"#test", "+jf", "1:60", "#overflow"},
+	})
+	m := op.waitFor(func(m irc.Message) bool { return m.Command == "MODE" })
+	require.Equal(t, []string{"#test", "+jf", "1:60", "#overflow"}, m.Params,
+		"modes set")
+
+	// The first join is fine.
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	registerRawClient(client2, "client2", "")
+	client2.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	m = client2.waitFor(func(m irc.Message) bool { return m.Command == "JOIN" })
+	require.Equal(t, []string{"#test"}, m.Params, "client2 joins")
+
+	// The next is forwarded.
+	client3 := dialRaw(t, catbox.Port)
+	defer client3.close()
+	registerRawClient(client3, "client3", "")
+	client3.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	m = client3.waitFor(func(m irc.Message) bool { return m.Command == "470" })
+	require.Equal(t, []string{"client3", "#test", "#overflow",
+		"Forwarding to another channel"}, m.Params, "client3 is forwarded")
+	m = client3.waitFor(func(m irc.Message) bool { return m.Command == "JOIN" })
+	require.Equal(t, []string{"#overflow"}, m.Params, "client3 joins forward")
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test a channel operator kicking a user on another server.
+func TestKICK(t *testing.T) {
+	catbox1, err := harnessCatbox("irc1.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox1.stop()
+
+	catbox2, err := harnessCatbox("irc2.example.org", "002")
+	require.NoError(t, err, "harness catbox")
+	defer catbox2.stop()
+
+	err = catbox1.linkServer(catbox2)
+	require.NoError(t, err, "link catbox1 to catbox2")
+	err = catbox2.linkServer(catbox1)
+	require.NoError(t, err, "link catbox2 to catbox1")
+
+	// Wait until we link. See TestMODETS() about the retries.
+	linkRE := regexp.MustCompile(`Established link to irc2\.`)
+	var attempts int
+	for {
+		if waitForLog(catbox1.LogChan, linkRE) {
+			break
+		}
+		attempts++
+		if attempts >= 5 {
+			require.Fail(t, "failed to link")
+		}
+		require.NoError(t, catbox1.rehash(), "rehash catbox1")
+		require.NoError(t, catbox2.rehash(), "rehash catbox2")
+	}
+
+	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox2.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	// client1 creates the channel and so has ops.
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+			"%s received JOIN #test", client1.GetNick()),
+		"client gets JOIN message",
+	)
+
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: "JOIN"},
+			"%s received JOIN #test", client2.GetNick()),
+		"client 2 gets JOIN message",
+	)
+
+	// Wait for client2's join to reach client1's server.
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+			"%s received JOIN #test from %s", client1.GetNick(), client2.GetNick()),
+		"client gets client 2's JOIN message",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "KICK",
+		Params:  []string{"#test", client2.GetNick(), "bye"},
+	}
+
+	kickMessage := waitForMessage(t, recvChan2, irc.Message{Command: "KICK"},
+		"%s received KICK", client2.GetNick())
+	require.NotNil(t, kickMessage, "client 2 gets KICK message")
+
+	// The prefix's host depends on whether we resolve 127.0.0.1, so only
+	// check the parameters.
+	require.Equal(
+		t,
+		[]string{"#test", client2.GetNick(), "bye"},
+		kickMessage.Params,
+		"KICK parameters",
+	)
+}
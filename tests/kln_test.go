@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test sending and receiving KLINE and UNKLINE outside of ENCAP with a server
+// that has the KLN and UNKLN capabs.
+func TestKLN(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0,0,,,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan, sendChan, _, err := client.Start()
+	require.NoError(t, err, "start client")
+	defer client.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client.GetNick()),
+		"client gets welcome",
+	)
+
+	sendChan <- irc.Message{Command: "OPER", Params: []string{"oper", "testing"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: "381"},
+			"%s received 381", client.GetNick()),
+		"client becomes an operator",
+	)
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+
+	server.send(irc.Message{Command: "PASS", Params: []string{"testing", "TS", "6", "042"}})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP KLN UNKLN"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	sync := func() {
+		server.send(irc.Message{
+			Prefix:  "042",
+			Command: "PING",
+			Params:  []string{"irc2.example.org", "001"},
+		})
+		server.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+	}
+	sync()
+
+	sendChan <- irc.Message{Command: "KLINE", Params: []string{"*@192.0.2.1", "bad"}}
+	kline := server.waitFor(func(m irc.Message) bool { return m.Command == "KLINE" })
+	require.Equal(t, []string{"*", "0", "*", "192.0.2.1", "bad"}, kline.Params,
+		"native KLINE")
+
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "KLINE",
+		Params:  []string{"*", "0", "*", "192.0.2.2", "worse"},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "UNKLINE",
+		Params:  []string{"*", "*", "192.0.2.1"},
+	})
+	sync()
+
+	sendChan <- irc.Message{Command: "STATS", Params: []string{"K"}}
+	var hosts []string
+	for {
+		select {
+		case m := <-recvChan:
+			if m.Command == "216" {
+				hosts = append(hosts, m.Params[2])
+				continue
+			}
+			if m.Command != "219" {
+				continue
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for STATS K")
+		}
+		break
+	}
+	require.Equal(t, []string{"192.0.2.2"}, hosts, "K-Lines")
+}
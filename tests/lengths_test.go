@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we advertise and enforce the configured length limits.
+func TestLengthLimits(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			"max-channel-length = 10\nmax-topic-length = 10\n"+
+				"max-kick-length = 8\nmax-away-length = 6\n"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	client1.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client1.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+
+	var tokens []string
+	for {
+		m := client1.waitFor(func(m irc.Message) bool {
+			return m.Command == "005" || m.Command == "376" || m.Command == "422"
+		})
+		if m.Command != "005" {
+			break
+		}
+		tokens = append(tokens, m.Params[1:len(m.Params)-1]...)
+	}
+	for _, token := range []string{"CHANNELLEN=10", "TOPICLEN=10", "KICKLEN=8",
+		"AWAYLEN=6"} {
+		require.Contains(t, tokens, token, "ISUPPORT")
+	}
+
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	registerRawClient(client2, "client2", "")
+
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#toolongname"}})
+	m := client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "479" || m.Command == "JOIN"
+	})
+	require.Equal(t, "479", m.Command, "channel name too long")
+
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#short"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client2.send(irc.Message{Command: "JOIN", Params: []string{"#short"}})
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	client1.send(irc.Message{
+		Command: "TOPIC",
+		Params:  []string{"#short", strings.Repeat("t", 20)},
+	})
+	m = client2.waitFor(func(m irc.Message) bool { return m.Command == "TOPIC" })
+	require.Equal(t, strings.Repeat("t", 10), m.Params[1], "topic truncated")
+
+	client2.send(irc.Message{
+		Command: "AWAY",
+		Params:  []string{"gone fishing"},
+	})
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "306" })
+	client1.send(irc.Message{Command: "WHOIS", Params: []string{"client2"}})
+	m = client1.waitFor(func(m irc.Message) bool { return m.Command == "301" })
+	require.Equal(t, "gone f", m.Params[2], "away message truncated")
+
+	client1.send(irc.Message{
+		Command: "KICK",
+		Params:  []string{"#short", "client2", "go away now"},
+	})
+	m = client2.waitFor(func(m irc.Message) bool { return m.Command == "KICK" })
+	require.Equal(t, "go away ", m.Params[2], "kick comment truncated")
+}
@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we send large LISTs in parts and that users may list all channels
+// only so often.
+func TestSafeList(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	// Operators are exempt from flood control, so they can create the channels
+	// quickly.
+	oper := dialRaw(t, catbox.Port)
+	defer oper.close()
+	registerRawClient(oper, "oper1", "")
+	oper.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	oper.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	const channels = 150
+	for i := 0; i < channels; i++ {
+		oper.send(irc.Message{
+			Command: "JOIN",
+			Params:  []string{fmt.Sprintf("#c%03d", i)},
+		})
+		// New channels are secret. Make them public.
+		oper.send(irc.Message{
+			Command: "MODE",
+			Params:  []string{fmt.Sprintf("#c%03d", i), "-s"},
+		})
+	}
+	oper.send(irc.Message{Command: "PING", Params: []string{"test"}})
+	oper.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	registerRawClient(client, "client1", "")
+
+	// We tell clients.
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == "005" && contains(m.Params, "SAFELIST")
+	})
+
+	client.send(irc.Message{Command: "LIST"})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "321" })
+	var names []string
+	for {
+		m := client.waitFor(func(m irc.Message) bool {
+			return m.Command == "322" || m.Command == "323"
+		})
+		if m.Command == "323" {
+			break
+		}
+		names = append(names, m.Params[1])
+	}
+	require.Len(t, names, channels, "all channels listed")
+	require.Equal(t, "#c000", names[0], "first channel")
+	require.Equal(t, "#c149", names[channels-1], "last channel")
+
+	// Listing everything again right away is refused.
+	client.send(irc.Message{Command: "LIST"})
+	m := client.waitFor(func(m irc.Message) bool {
+		return m.Command == "263" || m.Command == "321"
+	})
+	require.Equal(t, "263", m.Command, "LIST refused")
+	client.waitFor(func(m irc.Message) bool { return m.Command == "323" })
+
+	// Listing particular channels is fine.
+	client.send(irc.Message{Command: "LIST", Params: []string{"#c042"}})
+	m = client.waitFor(func(m irc.Message) bool {
+		return m.Command == "322" || m.Command == "263"
+	})
+	require.Equal(t, []string{"client1", "#c042", "1", ""}, m.Params, "LIST")
+}
+
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
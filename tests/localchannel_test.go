@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we never tell other servers about local (&) channels, and that we
+// ignore servers telling us about them.
+func TestLocalChannels(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	registerRawClient(client, "client1", "")
+	client.send(irc.Message{Command: "JOIN", Params: []string{"&local"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#global"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP TB"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "UID",
+		Params: []string{"client2", "1", "1", "+i", "~client2", "example.org",
+			"127.0.0.1", "042AAAAAA", "client2"},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "PING",
+		Params:  []string{"irc2.example.org", "001"},
+	})
+
+	// The burst has the global channel and not the local one.
+	var burst []irc.Message
+	server.waitFor(func(m irc.Message) bool {
+		burst = append(burst, m)
+		return m.Command == "PONG"
+	})
+	sawGlobal := false
+	for _, m := range burst {
+		require.NotContains(t, strings.Join(m.Params, " "), "&local",
+			"burst has local channel")
+		if m.Command == "SJOIN" && m.Params[1] == "#global" {
+			sawGlobal = true
+		}
+	}
+	require.True(t, sawGlobal, "burst has global channel")
+
+	// Nothing happening in the local channel reaches the server.
+	client.send(irc.Message{Command: "TOPIC", Params: []string{"&local", "hi"}})
+	client.send(irc.Message{Command: "MODE", Params: []string{"&local", "+m"}})
+	client.send(irc.Message{Command: "PRIVMSG", Params: []string{"&local", "hi"}})
+	client.send(irc.Message{Command: "PART", Params: []string{"&local"}})
+	client.send(irc.Message{Command: "JOIN", Params: []string{"&local"}})
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#after"}})
+	server.waitFor(func(m irc.Message) bool {
+		require.NotContains(t, strings.Join(m.Params, " "), "&local",
+			"server hears about local channel")
+		return m.Command == "SJOIN" && m.Params[1] == "#after"
+	})
+
+	// The server can't put its users in our local channel.
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "SJOIN",
+		Params: []string{fmt.Sprintf("%d", time.Now().Unix()), "&local", "+",
+			"042AAAAAA"},
+	})
+	m := server.waitFor(func(m irc.Message) bool { return m.Command == "403" })
+	require.Equal(t, "&local", m.Params[1], "SJOIN refused")
+
+	client.send(irc.Message{Command: "NAMES", Params: []string{"&local"}})
+	m = client.waitFor(func(m irc.Message) bool { return m.Command == "353" })
+	require.Equal(t, "@client1", m.Params[3], "only local member")
+}
@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that operators can change log levels at runtime.
+func TestLogLevel(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	client1.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client1.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+
+	client1.send(irc.Message{Command: "LOGLEVEL", Params: []string{"debug"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "481" })
+
+	client1.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	client1.send(irc.Message{Command: "LOGLEVEL"})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" && m.Params[len(m.Params)-1] ==
+			"*** Notice --- Log levels: clients=info core=info dns=info flood=info s2s=info"
+	})
+
+	client1.send(irc.Message{
+		Command: "LOGLEVEL",
+		Params:  []string{"clients", "debug"},
+	})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" && m.Params[len(m.Params)-1] ==
+			"*** Notice --- client1 set the log level of clients to debug."
+	})
+
+	// We now log a client's reader shutting down.
+	client2 := dialRaw(t, catbox.Port)
+	client2.close()
+	require.True(
+		t,
+		waitForLog(catbox.LogChan,
+			regexp.MustCompile(`DEBUG clients: Client \d+ \S+: Reader shutting down`)),
+		"catbox logs at debug",
+	)
+}
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we advertise and enforce the limit on channel list entries.
+func TestMaxChannelListEntries(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID, "max-channel-list-entries = 2\n"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	client.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+
+	var tokens []string
+	for {
+		m := client.waitFor(func(m irc.Message) bool {
+			return m.Command == "005" || m.Command == "376" || m.Command == "422"
+		})
+		if m.Command != "005" {
+			break
+		}
+		tokens = append(tokens, m.Params[1:len(m.Params)-1]...)
+	}
+	require.Contains(t, tokens, "MAXLIST=beIq:2", "ISUPPORT")
+
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	client.send(irc.Message{
+		Command: "MODE",
+		Params:  []string{"#test", "+beq", "a!*@*", "b!*@*", "c!*@*"},
+	})
+	m := client.waitFor(func(m irc.Message) bool { return m.Command == "478" })
+	require.Equal(t, "c!*@*", m.Params[2], "third entry refused")
+	m = client.waitFor(func(m irc.Message) bool { return m.Command == "MODE" })
+	require.Equal(t, []string{"#test", "+be", "a!*@*", "b!*@*"}, m.Params,
+		"first two entries added")
+}
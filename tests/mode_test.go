@@ -184,3 +184,101 @@ func TestMODETS(t *testing.T) {
 		},
 	)
 }
+
+// Test querying a channel's modes from on and off the channel.
+func TestMODEQuery(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	client1 := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+			"%s received JOIN #test", client1.GetNick()),
+		"client gets JOIN message",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "MODE",
+		Params:  []string{"#test", "-s+k", "secret"},
+	}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "MODE"},
+			"%s received MODE", client1.GetNick()),
+		"client gets MODE message",
+	)
+
+	// A member sees the key.
+	sendChan1 <- irc.Message{Command: "MODE", Params: []string{"#test"}}
+	messageIsEqual(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "324"},
+			"%s received 324", client1.GetNick()),
+		&irc.Message{
+			Prefix:  catbox.Name,
+			Command: "324",
+			Params:  []string{client1.GetNick(), "#test", "+nk", "secret"},
+		},
+	)
+
+	// Someone not on the channel sees the modes but not the key.
+	sendChan2 <- irc.Message{Command: "MODE", Params: []string{"#test"}}
+	messageIsEqual(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: "324"},
+			"%s received 324", client2.GetNick()),
+		&irc.Message{
+			Prefix:  catbox.Name,
+			Command: "324",
+			Params:  []string{client2.GetNick(), "#test", "+nk"},
+		},
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: "329"},
+			"%s received 329", client2.GetNick()),
+		"client 2 gets 329",
+	)
+
+	// Once the channel is secret, they can't see its modes.
+	sendChan1 <- irc.Message{Command: "MODE", Params: []string{"#test", "+s"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "MODE"},
+			"%s received MODE", client1.GetNick()),
+		"client gets MODE message",
+	)
+
+	sendChan2 <- irc.Message{Command: "MODE", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: "442"},
+			"%s received 442", client2.GetNick()),
+		"client 2 gets 442",
+	)
+}
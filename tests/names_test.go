@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that NAMES hides invisible members from users not on the channel.
+func TestNAMESInvisible(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	// Users are invisible by default.
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	registerRawClient(client1, "client1", "")
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client1.send(irc.Message{Command: "MODE", Params: []string{"#test", "-s"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "MODE" })
+
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	registerRawClient(client2, "client2", "")
+	client2.send(irc.Message{Command: "MODE", Params: []string{"client2", "-i"}})
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "MODE" })
+	client2.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client2.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	client3 := dialRaw(t, catbox.Port)
+	defer client3.close()
+	registerRawClient(client3, "client3", "")
+	client3.send(irc.Message{Command: "NAMES", Params: []string{"#test"}})
+	m := client3.waitFor(func(m irc.Message) bool {
+		return m.Command == "353" || m.Command == "366"
+	})
+	require.Equal(t, "353", m.Command, "visible member listed")
+	require.Equal(t, "client2", m.Params[3], "invisible member hidden")
+
+	// Members see everyone.
+	client2.send(irc.Message{Command: "NAMES", Params: []string{"#test"}})
+	m = client2.waitFor(func(m irc.Message) bool { return m.Command == "353" })
+	require.ElementsMatch(t, []string{"@client1", "client2"},
+		strings.Fields(m.Params[3]), "member sees everyone")
+}
@@ -0,0 +1,51 @@
+package tests
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test we tell clients about the network we're part of.
+func TestNetworkIdentity(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID, `network-name = ExampleNet
+network-description = An example network
+network-admin = Network staff <staff@example.org>`),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan,
+			regexp.MustCompile(`Rehashed configuration\. Changed: network\.`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" && m.Params[len(m.Params)-1] ==
+			"*** irc.example.org is part of ExampleNet: An example network"
+	})
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" && m.Params[len(m.Params)-1] ==
+			"*** Network admin: Network staff <staff@example.org>"
+	})
+	registerRawClient(client, "client1", "")
+
+	client.send(irc.Message{Command: "LUSERS"})
+	m := client.waitFor(func(m irc.Message) bool { return m.Command == "251" })
+	require.Equal(t,
+		"There are 1 users and 0 services on 1 servers of ExampleNet.",
+		m.Params[1], "LUSERS names network")
+}
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test registering a nick with NickServ, NickServ changing the nick of someone
+// who takes it without identifying, and identifying.
+func TestNickServ(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	nickServFile := filepath.Join(catbox.ConfigDir, "nickserv.json")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("nickserv-file = %s\nnickserv-grace-time = 1s",
+				nickServFile)),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"NickServ", "REGISTER secret"},
+	}
+	waitForNickServ(t, recvChan1, "You are now logged in as client1.")
+
+	// Free up the nick.
+	sendChan1 <- irc.Message{Command: "NICK", Params: []string{"client3"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "NICK"},
+			"%s received NICK", client1.GetNick()),
+		"client changes nick",
+	)
+
+	sendChan2 <- irc.Message{Command: "NICK", Params: []string{"client1"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: "NICK"},
+			"%s received NICK", client2.GetNick()),
+		"client 2 changes nick",
+	)
+
+	nick := waitForMessage(t, recvChan2, irc.Message{Command: "NICK"},
+		"%s received NICK", client2.GetNick())
+	require.NotNil(t, nick, "NickServ changes client 2's nick")
+	require.True(t, strings.HasPrefix(nick.Params[0], "Guest"), "guest nick")
+
+	sendChan2 <- irc.Message{Command: "NS", Params: []string{"IDENTIFY", "client1",
+		"secret"}}
+	waitForNickServ(t, recvChan2, "You are now logged in as client1.")
+}
+
+// waitForNickServ waits for a notice from NickServ with the text.
+func waitForNickServ(t *testing.T, ch <-chan irc.Message, text string) {
+	for {
+		notice := waitForMessage(t, ch, irc.Message{Command: "NOTICE"},
+			"received NOTICE")
+		require.NotNil(t, notice, "NickServ notice: %s", text)
+		if strings.HasPrefix(notice.Prefix, "NickServ!") &&
+			notice.Params[1] == text {
+			return
+		}
+	}
+}
+
+// Test that failing to identify makes the user wait before trying again.
+func TestNickServIdentifyFailures(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	nickServFile := filepath.Join(catbox.ConfigDir, "nickserv.json")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("nickserv-file = %s", nickServFile)),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	sendChan1 <- irc.Message{Command: "NS", Params: []string{"REGISTER",
+		"secret"}}
+	waitForNickServ(t, recvChan1, "You are now logged in as client1.")
+
+	for i := 0; i < 3; i++ {
+		sendChan2 <- irc.Message{Command: "NS", Params: []string{"IDENTIFY",
+			"client1", "wrong"}}
+		waitForNickServ(t, recvChan2, "Invalid password.")
+	}
+
+	// Even the right password has to wait.
+	sendChan2 <- irc.Message{Command: "NS", Params: []string{"IDENTIFY",
+		"client1", "secret"}}
+	waitForNickServ(t, recvChan2,
+		"Too many failed attempts. Please wait 5s and try again.")
+}
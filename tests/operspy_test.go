@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that operators can see secret channels with operspy, that other
+// operators hear about it, and that we log it.
+func TestOperspy(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	operLog := filepath.Join(catbox.ConfigDir, "oper.log")
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("oper-log-file = %s", operLog)),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	registerRawClient(client1, "client1", "")
+
+	// New channels are secret.
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#secret"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client1.send(irc.Message{
+		Command: "MODE",
+		Params:  []string{"#secret", "+kb", "key", "bad!*@*"},
+	})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "MODE" })
+
+	oper1 := dialRaw(t, catbox.Port)
+	defer oper1.close()
+	registerRawClient(oper1, "oper1", "")
+
+	// Only operators may use operspy.
+	oper1.send(irc.Message{Command: "LIST", Params: []string{"!"}})
+	oper1.waitFor(func(m irc.Message) bool { return m.Command == "481" })
+
+	oper1.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	oper1.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	oper2 := dialRaw(t, catbox.Port)
+	defer oper2.close()
+	registerRawClient(oper2, "oper2", "")
+	oper2.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	oper2.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	// Without operspy, the channel is hidden.
+	oper1.send(irc.Message{Command: "LIST"})
+	m := oper1.waitFor(func(m irc.Message) bool {
+		return m.Command == "322" || m.Command == "323"
+	})
+	require.Equal(t, "323", m.Command, "secret channel hidden")
+
+	oper1.send(irc.Message{Command: "LIST", Params: []string{"!"}})
+	m = oper1.waitFor(func(m irc.Message) bool { return m.Command == "322" })
+	require.Equal(t, "#secret", m.Params[1], "LIST shows secret channel")
+
+	oper1.send(irc.Message{Command: "NAMES", Params: []string{"!#secret"}})
+	m = oper1.waitFor(func(m irc.Message) bool { return m.Command == "353" })
+	require.Equal(t, []string{"oper1", "@", "#secret", "@client1"}, m.Params,
+		"NAMES")
+
+	oper1.send(irc.Message{Command: "WHO", Params: []string{"!#secret"}})
+	m = oper1.waitFor(func(m irc.Message) bool { return m.Command == "352" })
+	require.Equal(t, "client1", m.Params[5], "WHO")
+
+	oper1.send(irc.Message{Command: "MODE", Params: []string{"!#secret"}})
+	m = oper1.waitFor(func(m irc.Message) bool { return m.Command == "324" })
+	require.Equal(t, []string{"oper1", "#secret", "+nsk", "key"}, m.Params,
+		"MODE")
+
+	oper1.send(irc.Message{Command: "MODE", Params: []string{"!#secret", "b"}})
+	m = oper1.waitFor(func(m irc.Message) bool { return m.Command == "367" })
+	require.Equal(t, "bad!*@*", m.Params[2], "ban list")
+
+	// Other operators hear about each use.
+	for _, command := range []string{"LIST !", "NAMES !#secret", "WHO !#secret",
+		"MODE !#secret", "MODE !#secret b"} {
+		m = oper2.waitFor(func(m irc.Message) bool {
+			return m.Command == "NOTICE" &&
+				strings.Contains(m.Params[1], " OPERSPY ")
+		})
+		require.Regexp(t,
+			`^\*\*\* Notice --- OPERSPY oper1 \(~?oper1@\S+\) used `+
+				regexp.QuoteMeta(command)+`$`,
+			m.Params[1], "oper notice")
+	}
+
+	requireLogLines(t, operLog, []string{
+		`INFO oper: oper1 \(~?oper1@\S+\) became an operator using oper block oper$`,
+		`INFO oper: oper2 \(~?oper2@\S+\) became an operator using oper block oper$`,
+		`INFO oper: OPERSPY oper1 \(~?oper1@\S+\) used LIST !$`,
+		`INFO oper: OPERSPY oper1 \(~?oper1@\S+\) used NAMES !#secret$`,
+		`INFO oper: OPERSPY oper1 \(~?oper1@\S+\) used WHO !#secret$`,
+		`INFO oper: OPERSPY oper1 \(~?oper1@\S+\) used MODE !#secret$`,
+		`INFO oper: OPERSPY oper1 \(~?oper1@\S+\) used MODE !#secret b$`,
+	})
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test opening and closing a listener on rehash.
+func TestRehashListeners(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	listener, port, err := getRandomPort()
+	require.NoError(t, err, "get random port")
+	require.NoError(t, listener.Close(), "close random port")
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("listen-port-tor = %d", port)),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan,
+			regexp.MustCompile(`Rehashed configuration\. Changed: listeners\.`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, port)
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" &&
+			m.Params[len(m.Params)-1] == "*** Connected through Tor"
+	})
+	client.close()
+
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID, ""),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan,
+			regexp.MustCompile(`Rehashed configuration\. Changed: listeners\.`)),
+		"catbox rehashes",
+	)
+
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.Error(t, err, "connect to closed listener")
+
+	// The plaintext listener still works.
+	client = dialRaw(t, catbox.Port)
+	defer client.close()
+	client.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+}
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test a channel operator removing a user on another server. That server
+// hears a KICK from the operator rather than a PART from its own user.
+func TestREMOVERemoteUser(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	registerRawClient(client, "client1", "")
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP TB"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "UID",
+		Params: []string{"client2", "1", "1", "+i", "~client2", "example.org",
+			"127.0.0.1", "042AAAAAA", "client2"},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "SJOIN",
+		Params: []string{fmt.Sprintf("%d", time.Now().Unix()+60), "#test", "+",
+			"042AAAAAA"},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "PING",
+		Params:  []string{"irc2.example.org", "001"},
+	})
+	server.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+
+	client.send(irc.Message{
+		Command: "REMOVE",
+		Params:  []string{"#test", "client2", "bye"},
+	})
+
+	m := client.waitFor(func(m irc.Message) bool { return m.Command == "PART" })
+	require.Equal(t, []string{"#test", "requested by client1 (bye)"}, m.Params,
+		"local user sees PART")
+
+	m = server.waitFor(func(m irc.Message) bool {
+		return m.Command == "KICK" || m.Command == "PART"
+	})
+	require.Equal(t, "KICK", m.Command, "server hears KICK")
+	require.Regexp(t, "^001", m.Prefix, "KICK is from the operator")
+	require.Equal(t, []string{"#test", "042AAAAAA", "requested by client1 (bye)"},
+		m.Params, "KICK parameters")
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that users may not use nicks and channels the reserves config reserves,
+// and that rehashing reloads it.
+func TestReserves(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	reservesConf := filepath.Join(catbox.ConfigDir, "reserves.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("reserves-config = %s", reservesConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(reservesConf,
+			[]byte("services = *Serv,Reserved for services\nopers = #opers\n"), 0644),
+		"write reserves conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	client.send(irc.Message{Command: "NICK", Params: []string{"OperServ"}})
+	m := client.waitFor(func(m irc.Message) bool { return m.Command == "432" })
+	require.Equal(t, "Nickname is reserved: Reserved for services", m.Params[2],
+		"reserved nick at registration")
+	registerRawClient(client, "client1", "")
+
+	client.send(irc.Message{Command: "NICK", Params: []string{"hostserv"}})
+	m = client.waitFor(func(m irc.Message) bool { return m.Command == "432" })
+	require.Equal(t, "hostserv", m.Params[1], "reserved nick")
+
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#OPERS"}})
+	m = client.waitFor(func(m irc.Message) bool {
+		return m.Command == "479" || m.Command == "JOIN"
+	})
+	require.Equal(t, "479", m.Command, "reserved channel")
+	require.Equal(t, "Channel is reserved", m.Params[2], "reason")
+
+	require.NoError(
+		t,
+		ioutil.WriteFile(reservesConf, []byte("services = *Serv\n"), 0644),
+		"write reserves conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#opers"}})
+	m = client.waitFor(func(m irc.Message) bool {
+		return m.Command == "479" || m.Command == "JOIN"
+	})
+	require.Equal(t, "JOIN", m.Command, "channel no longer reserved")
+}
@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test an operator forcing a user on another server into and out of a channel.
+func TestSAJOINSAPART(t *testing.T) {
+	catbox1, err := harnessCatbox("irc1.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox1.stop()
+
+	catbox2, err := harnessCatbox("irc2.example.org", "002")
+	require.NoError(t, err, "harness catbox")
+	defer catbox2.stop()
+
+	err = catbox1.linkServer(catbox2)
+	require.NoError(t, err, "link catbox1 to catbox2")
+	err = catbox2.linkServer(catbox1)
+	require.NoError(t, err, "link catbox2 to catbox1")
+
+	// Wait until we link. See TestMODETS() about the retries.
+	linkRE := regexp.MustCompile(`Established link to irc2\.`)
+	var attempts int
+	for {
+		if waitForLog(catbox1.LogChan, linkRE) {
+			break
+		}
+		attempts++
+		if attempts >= 5 {
+			require.Fail(t, "failed to link")
+		}
+		require.NoError(t, catbox1.rehash(), "rehash catbox1")
+		require.NoError(t, catbox2.rehash(), "rehash catbox2")
+	}
+
+	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox2.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	// Make sure client1's server knows about client2 by seeing them join a
+	// channel.
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#lobby"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+			"%s received JOIN #lobby", client1.GetNick()),
+		"client gets JOIN message",
+	)
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#lobby"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+			"%s received JOIN #lobby from %s", client1.GetNick(), client2.GetNick()),
+		"client gets client 2's JOIN message",
+	)
+
+	sendChan1 <- irc.Message{Command: "OPER", Params: []string{"oper", "testing"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "381"},
+			"%s received 381", client1.GetNick()),
+		"client becomes an operator",
+	)
+
+	// Invite only so client2 could not join on their own.
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1,
+			irc.Message{Command: "JOIN", Params: []string{"#test"}},
+			"%s received JOIN #test", client1.GetNick()),
+		"client gets JOIN message",
+	)
+	sendChan1 <- irc.Message{Command: "MODE", Params: []string{"#test", "+i"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "MODE"},
+			"%s received MODE", client1.GetNick()),
+		"client gets MODE message",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "SAJOIN",
+		Params:  []string{client2.GetNick(), "#test"},
+	}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2,
+			irc.Message{Command: "JOIN", Params: []string{"#test"}},
+			"%s received JOIN #test", client2.GetNick()),
+		"client 2 joins the channel",
+	)
+
+	// Wait for client2's join to reach client1's server.
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1,
+			irc.Message{Command: "JOIN", Params: []string{"#test"}},
+			"%s received JOIN #test from %s", client1.GetNick(), client2.GetNick()),
+		"client gets client 2's JOIN message",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "SAPART",
+		Params:  []string{client2.GetNick(), "#test", "bye"},
+	}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2,
+			irc.Message{Command: "PART", Params: []string{"#test", "bye"}},
+			"%s received PART #test", client2.GetNick()),
+		"client 2 parts the channel",
+	)
+}
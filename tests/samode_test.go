@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test an operator changing the modes of a channel they have no status in and
+// of a user on another server.
+func TestSAMODE(t *testing.T) {
+	catbox1, err := harnessCatbox("irc1.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox1.stop()
+
+	catbox2, err := harnessCatbox("irc2.example.org", "002")
+	require.NoError(t, err, "harness catbox")
+	defer catbox2.stop()
+
+	err = catbox1.linkServer(catbox2)
+	require.NoError(t, err, "link catbox1 to catbox2")
+	err = catbox2.linkServer(catbox1)
+	require.NoError(t, err, "link catbox2 to catbox1")
+
+	// Wait until we link. See TestMODETS() about the retries.
+	linkRE := regexp.MustCompile(`Established link to irc2\.`)
+	var attempts int
+	for {
+		if waitForLog(catbox1.LogChan, linkRE) {
+			break
+		}
+		attempts++
+		if attempts >= 5 {
+			require.Fail(t, "failed to link")
+		}
+		require.NoError(t, catbox1.rehash(), "rehash catbox1")
+		require.NoError(t, catbox2.rehash(), "rehash catbox2")
+	}
+
+	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox2.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client1.GetNick()),
+		"client gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client2.GetNick()),
+		"client 2 gets welcome",
+	)
+
+	// client2 creates #test and so has ops in it. We know client1's server
+	// knows about the channel once client1 sees client2's later JOIN.
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2,
+			irc.Message{Command: "JOIN", Params: []string{"#test"}},
+			"%s received JOIN #test", client2.GetNick()),
+		"client 2 gets JOIN message",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan2, irc.Message{Command: "MODE"},
+			"%s received MODE #test", client2.GetNick()),
+		"client 2 gets the new channel's modes",
+	)
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#lobby"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+			"%s received JOIN #lobby", client1.GetNick()),
+		"client gets JOIN message",
+	)
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#lobby"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+			"%s received JOIN #lobby from %s", client1.GetNick(), client2.GetNick()),
+		"client gets client 2's JOIN message",
+	)
+
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1,
+			irc.Message{Command: "JOIN", Params: []string{"#test"}},
+			"%s received JOIN #test", client1.GetNick()),
+		"client gets JOIN message",
+	)
+
+	sendChan1 <- irc.Message{Command: "OPER", Params: []string{"oper", "testing"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan1, irc.Message{Command: "381"},
+			"%s received 381", client1.GetNick()),
+		"client becomes an operator",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "SAMODE",
+		Params:  []string{"#test", "+o", client1.GetNick()},
+	}
+	// client2 may see #lobby's modes first if they created it.
+	var mode *irc.Message
+	for {
+		mode = waitForMessage(t, recvChan2, irc.Message{Command: "MODE"},
+			"%s received MODE", client2.GetNick())
+		require.NotNil(t, mode, "client 2 sees the mode change")
+		if mode.Params[0] == "#test" {
+			break
+		}
+	}
+	require.Equal(t, []string{"#test", "+o", client1.GetNick()}, mode.Params,
+		"client 1 gets ops")
+
+	sendChan1 <- irc.Message{
+		Command: "SAMODE",
+		Params:  []string{client2.GetNick(), "+w"},
+	}
+	mode = waitForMessage(t, recvChan2, irc.Message{Command: "MODE"},
+		"%s received MODE +w", client2.GetNick())
+	require.NotNil(t, mode, "client 2's modes change")
+	require.Equal(t, []string{client2.GetNick(), "+w"}, mode.Params,
+		"client 2 gets +w")
+}
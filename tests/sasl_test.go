@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test relaying a client's SASL exchange to services.
+func TestSASL(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("services.example.org = 127.0.0.1,0,testing,0,1\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	services := dialRaw(t, catbox.Port)
+	defer services.close()
+
+	services.send(irc.Message{Command: "PASS", Params: []string{"testing", "TS", "6", "042"}})
+	services.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP"}})
+	services.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"services.example.org", "1", "Services"},
+	})
+	services.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	services.send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"*", "MECHLIST", "PLAIN"},
+	})
+	// We know catbox has our MECHLIST once it answers this.
+	services.send(irc.Message{
+		Prefix:  "042",
+		Command: "PING",
+		Params:  []string{"services.example.org", "001"},
+	})
+	services.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+
+	client.send(irc.Message{Command: "CAP", Params: []string{"LS"}})
+	ls := client.waitFor(func(m irc.Message) bool { return m.Command == "CAP" })
+	require.Contains(t, strings.Fields(ls.Params[2]), "sasl", "sasl offered")
+
+	client.send(irc.Message{Command: "CAP", Params: []string{"REQ", "sasl"}})
+	ack := client.waitFor(func(m irc.Message) bool { return m.Command == "CAP" })
+	require.Equal(t, "ACK", ack.Params[1], "sasl acknowledged")
+
+	client.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client.send(irc.Message{Command: "USER", Params: []string{"user", "0", "*", "Real"}})
+	client.send(irc.Message{Command: "AUTHENTICATE", Params: []string{"PLAIN"}})
+
+	start := services.waitFor(func(m irc.Message) bool {
+		return m.Command == "ENCAP" && m.Params[1] == "SASL" && m.Params[4] == "S"
+	})
+	require.Equal(t, "services.example.org", start.Params[0], "target")
+	require.Equal(t, "PLAIN", start.Params[5], "mechanism")
+	uid := start.Params[2]
+
+	services.send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"irc.example.org", "SASL", "042AAAAAA", uid, "C", "+"},
+	})
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == "AUTHENTICATE" && m.Params[0] == "+"
+	})
+
+	credentials := base64.StdEncoding.EncodeToString(
+		[]byte("horgh\x00horgh\x00secret"))
+	client.send(irc.Message{Command: "AUTHENTICATE", Params: []string{credentials}})
+
+	data := services.waitFor(func(m irc.Message) bool {
+		return m.Command == "ENCAP" && m.Params[1] == "SASL" && m.Params[4] == "C"
+	})
+	require.Equal(t, "042AAAAAA", data.Params[3], "agent")
+	require.Equal(t, credentials, data.Params[5], "data")
+
+	services.send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"irc.example.org", "SVSLOGIN", uid, "*", "*", "*", "horgh"},
+	})
+	services.send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"irc.example.org", "SASL", "042AAAAAA", uid, "D", "S"},
+	})
+
+	loggedIn := client.waitFor(func(m irc.Message) bool { return m.Command == "900" })
+	require.Equal(t, "horgh", loggedIn.Params[2], "account")
+	client.waitFor(func(m irc.Message) bool { return m.Command == "903" })
+
+	client.send(irc.Message{Command: "CAP", Params: []string{"END"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == irc.ReplyWelcome })
+
+	// The network hears about their account.
+	login := services.waitFor(func(m irc.Message) bool {
+		return m.Command == "ENCAP" && m.Params[1] == "LOGIN"
+	})
+	require.Equal(t, uid, login.Prefix, "source")
+	require.Equal(t, "horgh", login.Params[2], "account")
+}
+
+// rawConn is a connection to catbox we speak IRC on ourselves.
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func dialRaw(t *testing.T, port uint16) *rawConn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err, "connect")
+	return &rawConn{
+		t:    t,
+		conn: conn,
+		rw:   bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+	}
+}
+
+func (r *rawConn) send(m irc.Message) {
+	buf, err := m.Encode()
+	require.NoError(r.t, err, "encode message")
+	_, err = r.rw.WriteString(buf)
+	require.NoError(r.t, err, "write message")
+	require.NoError(r.t, r.rw.Flush(), "flush")
+}
+
+// waitFor reads messages until one matches.
+func (r *rawConn) waitFor(match func(irc.Message) bool) irc.Message {
+	for {
+		require.NoError(r.t, r.conn.SetReadDeadline(time.Now().Add(10*time.Second)),
+			"set deadline")
+		line, err := r.rw.ReadString('\n')
+		require.NoError(r.t, err, "read from catbox")
+		m, err := irc.ParseMessage(line)
+		require.NoError(r.t, err, "parse message")
+		if match(m) {
+			return m
+		}
+	}
+}
+
+func (r *rawConn) close() {
+	_ = r.conn.Close()
+}
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that send queue limits come from the classes and that STATS l shows
+// them.
+func TestSendQueues(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	classesConf := filepath.Join(catbox.ConfigDir, "connect-classes.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s\nconnect-classes-config = %s\n"+
+				"user-sendq = 500\n", serversConf, classesConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0,,,hubs,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(classesConf, []byte("hubs = 1m,20000\n"), 0644),
+		"write connect classes conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	oper := dialRaw(t, catbox.Port)
+	defer oper.close()
+	registerRawClient(oper, "oper1", "")
+	oper.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	oper.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	server.waitFor(func(m irc.Message) bool {
+		return m.Command == "UID" && m.Params[0] == "oper1"
+	})
+
+	oper.send(irc.Message{Command: "STATS", Params: []string{"l"}})
+	m := oper.waitFor(func(m irc.Message) bool { return m.Command == "211" })
+	require.Equal(t, "irc2.example.org", m.Params[1], "server")
+	require.Equal(t, "20000", m.Params[3], "server send queue limit")
+	oper.waitFor(func(m irc.Message) bool { return m.Command == "219" })
+
+	oper.send(irc.Message{Command: "STATS", Params: []string{"l", "oper1"}})
+	m = oper.waitFor(func(m irc.Message) bool { return m.Command == "211" })
+	require.Regexp(t, `^oper1\[~?oper1@\S+\]$`, m.Params[1], "user")
+	require.Equal(t, "500", m.Params[3], "user send queue limit")
+}
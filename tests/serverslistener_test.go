@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that only servers may register on the servers listener.
+func TestServersListener(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	listener, port, err := getRandomPort()
+	require.NoError(t, err, "get random port")
+	require.NoError(t, listener.Close(), "close random port")
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s\nlisten-host-servers = 127.0.0.1\nlisten-port-servers = %d",
+				serversConf, port)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan,
+			regexp.MustCompile(`Rehashed configuration\. Changed: listeners, servers\.`)),
+		"catbox rehashes",
+	)
+
+	// A user gets dropped.
+	client := dialRaw(t, port)
+	defer client.close()
+	client.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == "ERROR" &&
+			m.Params[0] == "Only servers may connect to this port"
+	})
+
+	// A server links.
+	server := dialRaw(t, port)
+	defer server.close()
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP TB"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "PING",
+		Params:  []string{"irc2.example.org", "001"},
+	})
+	server.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+
+	// Users still register on the main listener.
+	user := dialRaw(t, catbox.Port)
+	defer user.close()
+	registerRawClient(user, "client1", "")
+}
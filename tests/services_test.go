@@ -0,0 +1,216 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test services managing a user with SVSNICK and SVSJOIN, and logging them in
+// to an account with SU.
+func TestServices(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("services.example.org = 127.0.0.1,0,testing,0,1\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan, sendChan, _, err := client.Start()
+	require.NoError(t, err, "start client")
+	defer client.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client.GetNick()),
+		"client gets welcome",
+	)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", catbox.Port))
+	require.NoError(t, err, "connect services")
+	defer func() {
+		_ = conn.Close()
+	}()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	send := func(m irc.Message) {
+		buf, err := m.Encode()
+		require.NoError(t, err, "encode message")
+		_, err = rw.WriteString(buf)
+		require.NoError(t, err, "write message")
+		require.NoError(t, rw.Flush(), "flush")
+	}
+
+	send(irc.Message{Command: "PASS", Params: []string{"testing", "TS", "6", "042"}})
+	send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP"}})
+	send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"services.example.org", "1", "Services"},
+	})
+	send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+
+	// Find the client's UID in the burst.
+	uid := ""
+	for uid == "" {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)),
+			"set deadline")
+		line, err := rw.ReadString('\n')
+		require.NoError(t, err, "read from catbox")
+		m, err := irc.ParseMessage(line)
+		require.NoError(t, err, "parse message")
+		if m.Command == "UID" && m.Params[0] == client.GetNick() {
+			uid = m.Params[7]
+		}
+	}
+
+	send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"*", "SVSNICK", uid, "guest1"},
+	})
+	nick := waitForMessage(t, recvChan, irc.Message{Command: "NICK"},
+		"%s received NICK", client.GetNick())
+	require.NotNil(t, nick, "client's nick changes")
+	require.Equal(t, []string{"guest1"}, nick.Params, "new nick")
+
+	// We know we processed SU once we see the JOIN.
+	send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"*", "SU", uid, "horgh"},
+	})
+	send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"*", "SVSJOIN", uid, "#help"},
+	})
+	join := waitForMessage(t, recvChan, irc.Message{Command: "JOIN"},
+		"%s received JOIN", client.GetNick())
+	require.NotNil(t, join, "client joins")
+	require.Equal(t, []string{"#help"}, join.Params, "joined channel")
+
+	sendChan <- irc.Message{Command: "WHOIS", Params: []string{"guest1"}}
+	loggedIn := waitForMessage(t, recvChan, irc.Message{Command: "330"},
+		"%s received 330", client.GetNick())
+	require.NotNil(t, loggedIn, "WHOIS shows the account")
+	require.Equal(t, "horgh", loggedIn.Params[2], "account")
+}
+
+// Test that a server that is not services may not log in users other than its
+// own.
+func TestSUNotServices(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	registerRawClient(client, "client1", "account-notify")
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP TB"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	uid := server.waitFor(func(m irc.Message) bool {
+		return m.Command == "UID" && m.Params[0] == "client1"
+	}).Params[7]
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "UID",
+		Params: []string{"client2", "1", "1", "+i", "~client2", "example.org",
+			"127.0.0.1", "042AAAAAA", "client2"},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "SJOIN",
+		Params: []string{fmt.Sprintf("%d", time.Now().Unix()+60), "#test", "+",
+			"042AAAAAA"},
+	})
+
+	// It may not log in our user.
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "ENCAP",
+		Params:  []string{"*", "SU", uid, "horgh"},
+	})
+	// It may log in its own.
+	server.send(irc.Message{
+		Prefix:  "042AAAAAA",
+		Command: "ENCAP",
+		Params:  []string{"*", "LOGIN", "client2"},
+	})
+	m := client.waitFor(func(m irc.Message) bool { return m.Command == "ACCOUNT" })
+	require.Regexp(t, "^client2!", m.Prefix, "their user is logged in")
+	require.Equal(t, []string{"client2"}, m.Params, "account")
+
+	client.send(irc.Message{Command: "WHOIS", Params: []string{"client1"}})
+	m = client.waitFor(func(m irc.Message) bool {
+		return m.Command == "330" || m.Command == "318"
+	})
+	require.Equal(t, "318", m.Command, "our user is not logged in")
+}
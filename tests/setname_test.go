@@ -0,0 +1,42 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test changing real name with SETNAME. Clients with the setname capability
+// hear SETNAME and legacy clients see the user quit and rejoin.
+func TestSetName(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	capable := dialRaw(t, catbox.Port)
+	defer capable.close()
+	registerRawClient(capable, "client1", "setname")
+	capable.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	capable.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	legacy := dialRaw(t, catbox.Port)
+	defer legacy.close()
+	registerRawClient(legacy, "client2", "")
+	legacy.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	legacy.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	capable.send(irc.Message{Command: "SETNAME", Params: []string{"New Name"}})
+	m := capable.waitFor(func(m irc.Message) bool { return m.Command == "SETNAME" })
+	require.Equal(t, []string{"New Name"}, m.Params, "capable client hears SETNAME")
+
+	m = legacy.waitFor(func(m irc.Message) bool { return m.Command == "QUIT" })
+	require.Equal(t, []string{"Changing real name"}, m.Params,
+		"legacy client sees quit")
+	m = legacy.waitFor(func(m irc.Message) bool { return m.Command == "JOIN" })
+	require.Equal(t, []string{"#test"}, m.Params, "legacy client sees rejoin")
+
+	legacy.send(irc.Message{Command: "WHOIS", Params: []string{"client1"}})
+	m = legacy.waitFor(func(m irc.Message) bool { return m.Command == "311" })
+	require.Equal(t, "New Name", m.Params[5], "WHOIS shows new real name")
+}
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we tell clients why we're going away when we get SIGTERM.
+func TestShutdownSignal(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID, "shutdown-message = Bye for now"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	client.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+
+	require.NoError(t, catbox.Command.Process.Signal(syscall.SIGTERM), "SIGTERM")
+
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == "ERROR" && m.Params[0] == "Bye for now"
+	})
+
+	// Then it closes the connection.
+	require.NoError(t, client.conn.SetReadDeadline(time.Now().Add(10*time.Second)),
+		"set deadline")
+	_, err = ioutil.ReadAll(client.rw)
+	require.NoError(t, err, "read until catbox closes the connection")
+}
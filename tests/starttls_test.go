@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test STARTTLS when we have no certificate. We refuse it and the client may
+// carry on in plaintext.
+func TestSTARTTLSWithoutCertificate(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+
+	client.send(irc.Message{Command: "CAP", Params: []string{"LS", "302"}})
+	ls := client.waitFor(func(m irc.Message) bool { return m.Command == "CAP" })
+	require.NotContains(t, ls.Params[len(ls.Params)-1], "tls",
+		"tls capability offered")
+
+	client.send(irc.Message{Command: "STARTTLS"})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "691" })
+
+	client.send(irc.Message{Command: "CAP", Params: []string{"END"}})
+	client.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+	client.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+
+	// Once registered it's too late.
+	client.send(irc.Message{Command: "STARTTLS"})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "691" })
+
+	client.send(irc.Message{Command: "PING", Params: []string{"test"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+}
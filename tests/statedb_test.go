@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Test keeping NickServ accounts and channels in the state database across a
+// restart.
+func TestStateDB(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	// The state database needs a restart to take effect.
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	stateDB := filepath.Join(catbox.ConfigDir, "state.db")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID, fmt.Sprintf(
+			"state-db = %s\nnickserv-file = nickserv\nchannels-file = channels\n",
+			stateDB)),
+		"write conf",
+	)
+	require.NoError(t, catbox.Command.Process.Signal(syscall.SIGUSR1), "SIGUSR1")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`catbox started$`)),
+		"catbox restarts",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	registerRawClient(client1, "client1", "")
+
+	client1.send(irc.Message{
+		Command: "NS",
+		Params:  []string{"REGISTER", "secret"},
+	})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" &&
+			m.Params[1] == "You are now logged in as client1."
+	})
+
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+	client1.send(irc.Message{
+		Command: "TOPIC",
+		Params:  []string{"#test", "a topic to keep"},
+	})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "TOPIC" })
+
+	require.NoError(t, catbox.Command.Process.Signal(syscall.SIGUSR1), "SIGUSR1")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`catbox started$`)),
+		"catbox restarts",
+	)
+
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	registerRawClient(client2, "client2", "")
+
+	client2.send(irc.Message{
+		Command: "NS",
+		Params:  []string{"IDENTIFY", "client1", "secret"},
+	})
+	client2.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" &&
+			m.Params[1] == "You are now logged in as client1."
+	})
+
+	client2.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	topic := client2.waitFor(func(m irc.Message) bool {
+		return m.Command == "332"
+	})
+	require.Equal(t, "a topic to keep", topic.Params[2], "topic restored")
+
+	// Everything is in the one file.
+	require.NoError(t, catbox.Command.Process.Kill(), "kill catbox")
+	catbox.WaitGroup.Wait()
+	db, err := bolt.Open(stateDB, 0600, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err, "open state database")
+	defer func() {
+		_ = db.Close()
+	}()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("state"))
+		require.NotNil(t, bucket, "state bucket")
+		require.NotNil(t, bucket.Get([]byte("nickserv")), "accounts saved")
+		require.NotNil(t, bucket.Get([]byte("channels")), "channels saved")
+		return nil
+	}), "read state database")
+}
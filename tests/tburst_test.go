@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test sending and receiving TBURST with a server that has the TBURST capab.
+func TestTBURST(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0,0,,,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := NewClient("client1", "127.0.0.1", catbox.Port)
+	recvChan, sendChan, _, err := client.Start()
+	require.NoError(t, err, "start client")
+	defer client.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s", client.GetNick()),
+		"client gets welcome",
+	)
+
+	sendChan <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: "JOIN"},
+			"%s joins channel", client.GetNick()),
+		"client joins",
+	)
+	sendChan <- irc.Message{Command: "TOPIC", Params: []string{"#test", "ours"}}
+	require.NotNil(
+		t,
+		waitForMessage(t, recvChan, irc.Message{Command: "TOPIC"},
+			"%s sets topic", client.GetNick()),
+		"client sets topic",
+	)
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+
+	server.send(irc.Message{Command: "PASS", Params: []string{"testing", "TS", "6", "042"}})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP TB TBURST"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+
+	// We prefer TBURST to TB.
+	tburst := server.waitFor(func(m irc.Message) bool {
+		return m.Command == "TBURST" || m.Command == "TB"
+	})
+	require.Equal(t, "TBURST", tburst.Command, "topic burst command")
+	require.Len(t, tburst.Params, 5, "TBURST parameters")
+	require.Equal(t, "#test", tburst.Params[1], "TBURST channel")
+	require.Equal(t, "ours", tburst.Params[4], "TBURST topic")
+
+	topicTS, err := strconv.ParseInt(tburst.Params[2], 10, 64)
+	require.NoError(t, err, "TBURST topic TS")
+
+	sync := func() {
+		server.send(irc.Message{
+			Prefix:  "042",
+			Command: "PING",
+			Params:  []string{"irc2.example.org", "001"},
+		})
+		server.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+	}
+	sync()
+
+	tburstMessage := func(topicTS int64, topic string) irc.Message {
+		return irc.Message{
+			Prefix:  "042",
+			Command: "TBURST",
+			Params: []string{tburst.Params[0], "#test", fmt.Sprintf("%d", topicTS),
+				"someone!user@example.com", topic},
+		}
+	}
+
+	// Same channel TS and a newer topic. Theirs wins.
+	server.send(tburstMessage(topicTS+10, "theirs"))
+	topic := waitForMessage(t, recvChan, irc.Message{Command: "TOPIC"},
+		"%s sees topic change", client.GetNick())
+	require.NotNil(t, topic, "client sees topic change")
+	require.Equal(t, []string{"#test", "theirs"}, topic.Params, "new topic")
+
+	// An older topic loses.
+	server.send(tburstMessage(topicTS-10, "older"))
+	sync()
+
+	sendChan <- irc.Message{Command: "TOPIC", Params: []string{"#test"}}
+	reply := waitForMessage(t, recvChan, irc.Message{Command: "332"},
+		"%s gets topic", client.GetNick())
+	require.NotNil(t, reply, "client gets topic")
+	require.Equal(t, "theirs", reply.Params[2], "topic")
+}
@@ -0,0 +1,171 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test hiding the network's layout from users.
+func TestHiddenTopology(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf(`servers-config = %s
+network-name = ExampleNet
+hidden-server-name = *.example.org
+flatten-links = true
+hide-split-servers = true`, serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	registerRawClient(client, "client1", "")
+	client.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "366" })
+
+	// irc2 links to us, and irc3 is behind it.
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP TB"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "SID",
+		Params:  []string{"irc3.example.org", "2", "043", "Test"},
+	})
+	server.send(irc.Message{
+		Prefix:  "043",
+		Command: "SID",
+		Params:  []string{"irc1.example.org", "3", "044", "Test"},
+	})
+	server.send(irc.Message{
+		Prefix:  "043",
+		Command: "UID",
+		Params: []string{"client2", "2", "1", "+i", "~client2", "example.org",
+			"127.0.0.1", "043AAAAAA", "client2"},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "SJOIN",
+		Params: []string{fmt.Sprintf("%d", time.Now().Unix()+60), "#test", "+",
+			"043AAAAAA"},
+	})
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "PING",
+		Params:  []string{"irc2.example.org", "001"},
+	})
+	server.waitFor(func(m irc.Message) bool { return m.Command == "PONG" })
+
+	// WHOIS and WHO show the hidden name.
+	client.send(irc.Message{Command: "WHOIS", Params: []string{"client1"}})
+	m := client.waitFor(func(m irc.Message) bool { return m.Command == "312" })
+	require.Equal(t, []string{"client1", "client1", "*.example.org", "ExampleNet"},
+		m.Params, "WHOIS hides server")
+
+	client.send(irc.Message{Command: "WHO", Params: []string{"#test"}})
+	for i := 0; i < 2; i++ {
+		m = client.waitFor(func(m irc.Message) bool { return m.Command == "352" })
+		require.Equal(t, "*.example.org", m.Params[4], "WHO hides server")
+	}
+
+	// LINKS shows irc3 as linked to us.
+	client.send(irc.Message{Command: "LINKS"})
+	hopCounts := map[string]string{}
+	client.waitFor(func(m irc.Message) bool {
+		if m.Command == "364" {
+			hopCounts[m.Params[2]] = m.Params[3]
+		}
+		return m.Command == "365"
+	})
+	require.Equal(t, "1 ExampleNet", hopCounts["irc3.example.org"],
+		"LINKS flattened and hides descriptions")
+
+	// MAP lists every server under us by name rather than under its uplink.
+	client.send(irc.Message{Command: "MAP"})
+	var mapLines []string
+	client.waitFor(func(m irc.Message) bool {
+		if m.Command == "015" {
+			mapLines = append(mapLines, m.Params[1])
+		}
+		return m.Command == "017"
+	})
+	require.Len(t, mapLines, 4, "MAP lists every server")
+	for i, name := range []string{"irc.example.org[001]",
+		"  irc1.example.org[044]", "  irc2.example.org[042]",
+		"  irc3.example.org[043]"} {
+		require.True(t, strings.HasPrefix(mapLines[i], name+" "),
+			"MAP line %d is %s, wanted %s", i, mapLines[i], name)
+	}
+
+	// Numerics from other servers come from us.
+	client.send(irc.Message{
+		Command: "WHOIS",
+		Params:  []string{"client2", "client2"},
+	})
+	m = server.waitFor(func(m irc.Message) bool { return m.Command == "WHOIS" })
+	server.send(irc.Message{
+		Prefix:  "043",
+		Command: "318",
+		Params:  []string{m.Prefix, "client2", "End of /WHOIS list."},
+	})
+	m = client.waitFor(func(m irc.Message) bool { return m.Command == "318" })
+	require.Equal(t, "irc.example.org", m.Prefix, "numeric hides server")
+
+	// So do other messages from other servers.
+	server.send(irc.Message{
+		Prefix:  "043",
+		Command: "TMODE",
+		Params:  []string{"1", "#test", "+t"},
+	})
+	m = client.waitFor(func(m irc.Message) bool { return m.Command == "MODE" })
+	require.Equal(t, "irc.example.org", m.Prefix, "MODE hides server")
+	require.Equal(t, []string{"#test", "+t"}, m.Params, "MODE parameters")
+
+	// A netsplit doesn't name servers.
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "SQUIT",
+		Params:  []string{"043", "Bye"},
+	})
+	m = client.waitFor(func(m irc.Message) bool { return m.Command == "QUIT" })
+	require.Equal(t, []string{"*.net *.split"}, m.Params, "split hides servers")
+}
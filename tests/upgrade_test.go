@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that users and listeners survive an upgrade.
+func TestUpgrade(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	// Listen on a port from the config too, not only the one we pass in.
+	listener, torPort, err := getRandomPort()
+	require.NoError(t, err, "get random port")
+	require.NoError(t, listener.Close(), "close random port")
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("listen-port-tor = %d", torPort)),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	client1.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client1.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+	client1.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+	client1.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "JOIN" })
+	client1.send(irc.Message{Command: "MODE", Params: []string{"#test", "+t"}})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "MODE" && m.Params[0] == "#test" && m.Params[1] == "+t"
+	})
+
+	client1.send(irc.Message{Command: "UPGRADE"})
+	require.True(
+		t,
+		waitForLog(catbox.LogChan,
+			regexp.MustCompile(`Restored 1 users and 1 channels from upgrade`)),
+		"catbox restores state",
+	)
+
+	// Our connection stays open and we're still in our channel with ops.
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" &&
+			m.Params[len(m.Params)-1] == "*** Notice --- Server upgraded."
+	})
+	client1.send(irc.Message{Command: "MODE", Params: []string{"#test"}})
+	modes := client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "324"
+	})
+	require.Equal(t, "+nst", modes.Params[2], "channel modes")
+	client1.send(irc.Message{Command: "MODE", Params: []string{"#test", "-s"}})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "MODE" && m.Params[0] == "#test" && m.Params[1] == "-s"
+	})
+
+	// Others can connect and see us.
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	client2.send(irc.Message{Command: "NICK", Params: []string{"client2"}})
+	client2.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client2", "0", "*", "client2"},
+	})
+	client2.waitFor(func(m irc.Message) bool {
+		return m.Command == irc.ReplyWelcome
+	})
+	client2.send(irc.Message{Command: "JOIN", Params: []string{"#test"}})
+	client1.waitFor(func(m irc.Message) bool {
+		return m.Command == "JOIN" && m.SourceNick() == "client2"
+	})
+
+	// The listener from the config is still there.
+	client3 := dialRaw(t, torPort)
+	defer client3.close()
+	client3.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" &&
+			m.Params[len(m.Params)-1] == "*** Connected through Tor"
+	})
+}
+
+// Test that we don't lose what a user sends while we upgrade.
+func TestUpgradeKeepsInput(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	registerRawClient(client1, "client1", "")
+	client1.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	client1.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+
+	// Send part of a line along with UPGRADE so the old process reads it but
+	// can't process it.
+	_, err = client1.conn.Write([]byte("UPGRADE\r\nJOIN #aft"))
+	require.NoError(t, err, "write")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan,
+			regexp.MustCompile(`Restored 1 users and 0 channels from upgrade`)),
+		"catbox restores state",
+	)
+
+	// The new process gets the whole line.
+	_, err = client1.conn.Write([]byte("er\r\n"))
+	require.NoError(t, err, "write")
+	m := client1.waitFor(func(m irc.Message) bool { return m.Command == "JOIN" })
+	require.Equal(t, "#after", m.Params[0], "joined channel")
+}
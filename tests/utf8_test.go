@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that we advertise UTF8ONLY and sanitize or reject messages that are not
+// valid UTF-8.
+func TestInvalidUTF8(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID, "invalid-utf8-action = reject\n"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1 := dialRaw(t, catbox.Port)
+	defer client1.close()
+	client1.send(irc.Message{Command: "NICK", Params: []string{"client1"}})
+	client1.send(irc.Message{
+		Command: "USER",
+		Params:  []string{"client1", "0", "*", "client1"},
+	})
+
+	var tokens []string
+	for {
+		m := client1.waitFor(func(m irc.Message) bool {
+			return m.Command == "005" || m.Command == "376" || m.Command == "422"
+		})
+		if m.Command != "005" {
+			break
+		}
+		tokens = append(tokens, m.Params[1:len(m.Params)-1]...)
+	}
+	require.Contains(t, tokens, "UTF8ONLY", "ISUPPORT")
+
+	client2 := dialRaw(t, catbox.Port)
+	defer client2.close()
+	registerRawClient(client2, "client2", "")
+
+	client1.send(irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"client2", "caf\xe9"},
+	})
+	m := client1.waitFor(func(m irc.Message) bool { return m.Command == "FAIL" })
+	require.Equal(t, []string{"PRIVMSG", "INVALID_UTF8"}, m.Params[:2],
+		"message rejected")
+
+	client1.send(irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"client2", "café"},
+	})
+	m = client2.waitFor(func(m irc.Message) bool { return m.Command == "PRIVMSG" })
+	require.Equal(t, "café", m.Params[1], "valid message delivered")
+
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			"invalid-utf8-action = sanitize\n"),
+		"write conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client1.send(irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"client2", "caf\xe9\x07"},
+	})
+	m = client2.waitFor(func(m irc.Message) bool { return m.Command == "PRIVMSG" })
+	require.Equal(t, "caf�", m.Params[1], "message sanitized")
+}
@@ -0,0 +1,244 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that idle and signon times (317) make it across servers in WHOIS in
+// both directions, and WHOIS with a server target.
+func TestRemoteWHOISIdle(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	registerRawClient(client, "client1", "")
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+
+	uidMessage := server.waitFor(func(m irc.Message) bool {
+		return m.Command == "UID" && m.Params[0] == "client1"
+	})
+	uid := uidMessage.Params[7]
+
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "UID",
+		Params: []string{"remote1", "1", fmt.Sprintf("%d", time.Now().Unix()),
+			"+i", "remote", "remote.example.org", "0", "042AAAAAA", "Remote"},
+	})
+
+	// The other server asks about our user. We tell it their idle and signon
+	// times.
+	server.send(irc.Message{
+		Prefix:  "042AAAAAA",
+		Command: "WHOIS",
+		Params:  []string{uid, "client1"},
+	})
+	idle := server.waitFor(func(m irc.Message) bool { return m.Command == "317" })
+	require.Equal(t, "001", idle.Prefix, "source")
+	require.Equal(t, "042AAAAAA", idle.Params[0], "target")
+	require.Equal(t, "client1", idle.Params[1], "nick")
+	idleSeconds, err := strconv.Atoi(idle.Params[2])
+	require.NoError(t, err, "idle seconds")
+	require.True(t, idleSeconds >= 0 && idleSeconds < 60, "idle seconds")
+	signon, err := strconv.ParseInt(idle.Params[3], 10, 64)
+	require.NoError(t, err, "signon time")
+	require.InDelta(t, time.Now().Unix(), signon, 60, "signon time")
+
+	// Our user asks about theirs. We ask the user's server, and pass on its
+	// idle and signon times.
+	client.send(irc.Message{Command: "WHOIS", Params: []string{"remote1"}})
+	whois := server.waitFor(func(m irc.Message) bool { return m.Command == "WHOIS" })
+	require.Equal(t, uid, whois.Prefix, "source")
+	require.Equal(t, []string{"042AAAAAA", "remote1"}, whois.Params, "target")
+
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "317",
+		Params: []string{uid, "remote1", "42", "1500000000",
+			"seconds idle, signon time"},
+	})
+	idle = client.waitFor(func(m irc.Message) bool { return m.Command == "317" })
+	require.Equal(t, "irc2.example.org", idle.Prefix, "source")
+	require.Equal(t, []string{"client1", "remote1", "42", "1500000000",
+		"seconds idle, signon time"}, idle.Params, "idle reply")
+
+	// Asking a particular server sends the WHOIS to it.
+	client.send(irc.Message{
+		Command: "WHOIS",
+		Params:  []string{"irc2.example.org", "remote1"},
+	})
+	whois = server.waitFor(func(m irc.Message) bool { return m.Command == "WHOIS" })
+	require.Equal(t, []string{"042", "remote1"}, whois.Params, "server target")
+
+	client.send(irc.Message{
+		Command: "WHOIS",
+		Params:  []string{"remote1", "remote1"},
+	})
+	whois = server.waitFor(func(m irc.Message) bool { return m.Command == "WHOIS" })
+	require.Equal(t, []string{"042", "remote1"}, whois.Params, "nick target")
+
+	// When the other server asks us about our user by our SID, we answer.
+	server.send(irc.Message{
+		Prefix:  "042AAAAAA",
+		Command: "WHOIS",
+		Params:  []string{"001", "client1"},
+	})
+	idle = server.waitFor(func(m irc.Message) bool { return m.Command == "317" })
+	require.Equal(t, "client1", idle.Params[1], "nick")
+
+	client.send(irc.Message{
+		Command: "WHOIS",
+		Params:  []string{"irc3.example.org", "remote1"},
+	})
+	client.waitFor(func(m irc.Message) bool { return m.Command == "402" })
+}
+
+// Test that operators with +y hear when someone WHOISes them, whether from
+// our server or another.
+func TestWHOISNotice(t *testing.T) {
+	catbox, err := harnessCatbox("irc.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox.stop()
+
+	conf := filepath.Join(catbox.ConfigDir, "catbox.conf")
+	serversConf := filepath.Join(catbox.ConfigDir, "servers.conf")
+	require.NoError(
+		t,
+		writeConf(conf, catbox.Name, catbox.SID,
+			fmt.Sprintf("servers-config = %s", serversConf)),
+		"write conf",
+	)
+	require.NoError(
+		t,
+		ioutil.WriteFile(serversConf,
+			[]byte("irc2.example.org = 127.0.0.1,0,testing,0\n"), 0644),
+		"write servers conf",
+	)
+	require.NoError(t, catbox.rehash(), "rehash")
+	require.True(
+		t,
+		waitForLog(catbox.LogChan, regexp.MustCompile(`Rehashed configuration`)),
+		"catbox rehashes",
+	)
+
+	oper := dialRaw(t, catbox.Port)
+	defer oper.close()
+	registerRawClient(oper, "oper1", "")
+
+	// Only operators may set +y.
+	oper.send(irc.Message{Command: "MODE", Params: []string{"oper1", "+y"}})
+	oper.send(irc.Message{Command: "PING", Params: []string{"test"}})
+	m := oper.waitFor(func(m irc.Message) bool {
+		return (m.Command == "MODE" && m.Params[1] == "+y") || m.Command == "PONG"
+	})
+	require.Equal(t, "PONG", m.Command, "+y needs +o")
+
+	oper.send(irc.Message{Command: "OPER", Params: []string{"oper", "testing"}})
+	oper.waitFor(func(m irc.Message) bool { return m.Command == "381" })
+	oper.send(irc.Message{Command: "MODE", Params: []string{"oper1", "+y"}})
+	oper.waitFor(func(m irc.Message) bool {
+		return m.Command == "MODE" && m.Params[1] == "+y"
+	})
+
+	client := dialRaw(t, catbox.Port)
+	defer client.close()
+	registerRawClient(client, "client1", "")
+
+	client.send(irc.Message{Command: "WHOIS", Params: []string{"oper1"}})
+	notice := oper.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" && strings.HasSuffix(m.Params[1], "on you")
+	})
+	require.Regexp(t,
+		`^\*\*\* Notice --- client1 \(~?client1@\S+\) \[irc\.example\.org\] is doing a WHOIS on you$`,
+		notice.Params[1], "local notice")
+
+	server := dialRaw(t, catbox.Port)
+	defer server.close()
+
+	server.send(irc.Message{
+		Command: "PASS",
+		Params:  []string{"testing", "TS", "6", "042"},
+	})
+	server.send(irc.Message{Command: "CAPAB", Params: []string{"QS ENCAP"}})
+	server.send(irc.Message{
+		Command: "SERVER",
+		Params:  []string{"irc2.example.org", "1", "Test"},
+	})
+	server.send(irc.Message{
+		Command: "SVINFO",
+		Params:  []string{"6", "6", "0", fmt.Sprintf("%d", time.Now().Unix())},
+	})
+
+	uidMessage := server.waitFor(func(m irc.Message) bool {
+		return m.Command == "UID" && m.Params[0] == "oper1"
+	})
+	uid := uidMessage.Params[7]
+
+	server.send(irc.Message{
+		Prefix:  "042",
+		Command: "UID",
+		Params: []string{"remote1", "1", fmt.Sprintf("%d", time.Now().Unix()),
+			"+i", "remote", "remote.example.org", "0", "042AAAAAA", "Remote"},
+	})
+
+	server.send(irc.Message{
+		Prefix:  "042AAAAAA",
+		Command: "WHOIS",
+		Params:  []string{uid, "oper1"},
+	})
+	notice = oper.waitFor(func(m irc.Message) bool {
+		return m.Command == "NOTICE" && strings.HasSuffix(m.Params[1], "on you")
+	})
+	require.Equal(t,
+		"*** Notice --- remote1 (remote@remote.example.org) [irc2.example.org] is doing a WHOIS on you",
+		notice.Params[1], "remote notice")
+}
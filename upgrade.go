@@ -0,0 +1,744 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// upgradeState is what we hand the new process when we upgrade. See
+// upgrade().
+type upgradeState struct {
+	// Descriptors of our listeners. -1 if we don't have the listener.
+	ListenerFD    int
+	TLSListenerFD int
+	TorListenerFD int
+	// -1 too if the old process predates the servers listener.
+	ServersListenerFD int
+
+	// Where the listeners are. This can differ from the config file, e.g., if
+	// a rehash couldn't move a listener.
+	ListenHost    string
+	ListenPort    string
+	ListenPortTLS string
+	ListenHostTor string
+	ListenPortTor string
+	// Empty if the old process predates the servers listener.
+	ListenHostServers string
+	ListenPortServers string
+
+	NextClientID uint64
+
+	Users    []upgradeUser
+	Channels []upgradeChannel
+}
+
+// upgradeUser is a local user we hand over.
+type upgradeUser struct {
+	// Descriptor of their connection.
+	FD int
+
+	ID                  uint64
+	ClientHostname      string
+	Tor                 bool
+	ConnectionStartTime time.Time
+	Caps                []string
+
+	DisplayNick string
+	NickTS      int64
+	Modes       string
+	Username    string
+	Hostname    string
+	DisplayHost string
+	IP          string
+	UID         TS6UID
+	RealName    string
+	AwayMessage string
+	Account     string
+	CertFP      string
+	FloodExempt bool
+
+	LastMessageTime  time.Time
+	Accepts          []TS6UID
+	Vhost            string
+	NickServDeadline time.Time
+	UserConfigName   string
+
+	// What they sent that we didn't process. The new process reads this before
+	// anything else from their connection.
+	Unread []byte
+}
+
+// upgradeChannel is a channel we hand over. Its members are all users we hand
+// over.
+type upgradeChannel struct {
+	Name              string
+	TS                int64
+	Topic             string
+	TopicTS           int64
+	TopicSetter       string
+	Modes             string
+	Key               string
+	Limit             int
+	JoinThrottleCount int
+	JoinThrottleTime  int
+	Forward           string
+	Lists             map[string][]ChannelMask
+	Members           []TS6UID
+	Ops               []TS6UID
+	Invites           map[TS6UID]ChannelInvite
+	ModLog            []ModLogEntry
+}
+
+// tlsListener is a TLS listener. We keep the TCP listener under it so we can
+// hand its descriptor to a new process.
+type tlsListener struct {
+	net.Listener
+	tcp *net.TCPListener
+}
+
+// SyscallConn gives access to the TCP listener's descriptor.
+func (l tlsListener) SyscallConn() (syscall.RawConn, error) {
+	return l.tcp.SyscallConn()
+}
+
+// upgrade starts the binary on disk in place of this process without
+// dropping our listeners or plaintext users.
+//
+// We can't hand over TLS sessions, so TLS users must reconnect. We drop
+// servers and unregistered clients too. Servers relink to the new process and
+// burst.
+//
+// We pass descriptors for the listeners and users' connections to the new
+// process and write everything else it needs to know about them (including
+// their channels) to a file. We then shut down. main() starts the new process
+// once we finish.
+//
+// Each user's reader and writer use their connection, so we stop them before
+// we hand it over. This is how we do it:
+//
+// 1. We tell each user's reader to stop. It passes on what it read but didn't
+// process (ReaderStoppedEvent) and exits.
+// 2. Once every reader stopped, no more messages come in. We queue
+// upgradeMarker to each user. Their writer writes what's before it, tells us
+// (WriterStoppedEvent), and exits. It leaves the connection open.
+// 3. Once every writer stopped, we hand over the users along with what they
+// sent that we didn't process.
+//
+// If a user's reader or writer takes too long, we drop the user.
+func (cb *Catbox) upgrade(byUser *User) {
+	if cb.Upgrade != nil {
+		if byUser != nil {
+			byUser.LocalUser.serverNotice("Already upgrading.")
+		}
+		return
+	}
+
+	if byUser != nil {
+		cb.noticeOpers(fmt.Sprintf("%s issued upgrade.", byUser.DisplayNick))
+	} else {
+		cb.noticeOpers("Upgrading.")
+	}
+
+	// Start with the listeners. If we can't hand them over, we don't upgrade.
+	state := upgradeState{
+		ListenerFD:        -1,
+		TLSListenerFD:     -1,
+		TorListenerFD:     -1,
+		ListenHost:        cb.Config.ListenHost,
+		ListenPort:        cb.Config.ListenPort,
+		ListenPortTLS:     cb.Config.ListenPortTLS,
+		ListenHostTor:     cb.Config.ListenHostTor,
+		ListenPortTor:     cb.Config.ListenPortTor,
+		ServersListenerFD: -1,
+		ListenHostServers: cb.Config.ListenHostServers,
+		ListenPortServers: cb.Config.ListenPortServers,
+	}
+	var fds []int
+	for _, l := range []struct {
+		listener net.Listener
+		fd       *int
+	}{
+		{cb.Listener, &state.ListenerFD},
+		{cb.TLSListener, &state.TLSListenerFD},
+		{cb.TorListener, &state.TorListenerFD},
+		{cb.ServersListener, &state.ServersListenerFD},
+	} {
+		if l.listener == nil {
+			continue
+		}
+		fd, err := dupDescriptor(l.listener)
+		if err != nil {
+			cb.noticeOpers(fmt.Sprintf("Unable to upgrade: %s", err))
+			closeDescriptors(fds)
+			return
+		}
+		*l.fd = fd
+		fds = append(fds, fd)
+	}
+
+	// Once servers are gone, all users left are ours, and channels have only
+	// our users.
+	for _, server := range cb.LocalServers {
+		server.quit("Server upgrading")
+	}
+	for _, client := range cb.LocalClients {
+		client.quit("Server upgrading")
+	}
+	for _, lu := range cb.LocalUsers {
+		if lu.isTLS() {
+			lu.quit("Server upgrading", true)
+		}
+	}
+
+	cb.Upgrade = &upgradeProgress{
+		state:    state,
+		fds:      fds,
+		deadline: time.Now().Add(upgradeWaitTime),
+		reading:  map[uint64]*LocalUser{},
+		unread:   map[uint64][]byte{},
+	}
+	for _, lu := range cb.LocalUsers {
+		cb.Upgrade.reading[lu.ID] = lu
+		lu.Conn.stopReading()
+	}
+
+	cb.continueUpgrade()
+}
+
+// upgradeProgress is where we are in an upgrade. See upgrade().
+type upgradeProgress struct {
+	// The listeners we hand over.
+	state upgradeState
+	fds   []int
+
+	// When we give up on users whose readers or writers haven't stopped.
+	deadline time.Time
+
+	// Users whose readers or writers we're waiting on. writing is nil until
+	// every reader stopped.
+	reading map[uint64]*LocalUser
+	writing map[uint64]*LocalUser
+
+	// What each user sent that we read but didn't process.
+	unread map[uint64][]byte
+}
+
+// How long we wait for users' readers and writers to stop when upgrading.
+const upgradeWaitTime = 10 * time.Second
+
+// upgradeMarker is what we queue on a user's write channel to tell their
+// writer to stop as we're upgrading. We never send it.
+var upgradeMarker = irc.Message{Command: "UPGRADE"}
+
+// upgradeReaderStopped hears that a user's reader stopped.
+func (cb *Catbox) upgradeReaderStopped(c *LocalClient, unread []byte) {
+	if cb.Upgrade == nil {
+		return
+	}
+	if _, exists := cb.Upgrade.reading[c.ID]; !exists {
+		return
+	}
+	delete(cb.Upgrade.reading, c.ID)
+	cb.Upgrade.unread[c.ID] = unread
+	cb.continueUpgrade()
+}
+
+// upgradeWriterStopped hears that a user's writer stopped.
+func (cb *Catbox) upgradeWriterStopped(c *LocalClient) {
+	if cb.Upgrade == nil {
+		return
+	}
+	delete(cb.Upgrade.writing, c.ID)
+	cb.continueUpgrade()
+}
+
+// checkUpgrade drops users whose readers or writers are taking too long to
+// stop.
+func (cb *Catbox) checkUpgrade() {
+	if time.Now().Before(cb.Upgrade.deadline) {
+		return
+	}
+
+	for _, users := range []map[uint64]*LocalUser{cb.Upgrade.reading,
+		cb.Upgrade.writing} {
+		for id, lu := range users {
+			coreLog.Warnf("Gave up waiting to hand over user %s", lu)
+			delete(users, id)
+			lu.quit("Server upgrading", true)
+		}
+	}
+
+	cb.continueUpgrade()
+}
+
+// continueUpgrade moves on to the next step of the upgrade if we're not
+// waiting on anyone.
+func (cb *Catbox) continueUpgrade() {
+	// Users may quit while we wait.
+	for _, users := range []map[uint64]*LocalUser{cb.Upgrade.reading,
+		cb.Upgrade.writing} {
+		for id := range users {
+			if _, exists := cb.LocalUsers[id]; !exists {
+				delete(users, id)
+			}
+		}
+	}
+
+	if len(cb.Upgrade.reading) > 0 {
+		return
+	}
+
+	if cb.Upgrade.writing == nil {
+		cb.Upgrade.writing = map[uint64]*LocalUser{}
+		for _, lu := range cb.LocalUsers {
+			lu.serverNotice("Upgrading server. Please wait.")
+			// The notice may not fit in their queue.
+			if _, exists := cb.LocalUsers[lu.ID]; !exists {
+				continue
+			}
+			select {
+			case lu.WriteChan <- upgradeMarker:
+				cb.Upgrade.writing[lu.ID] = lu
+			default:
+				lu.quit("SendQ exceeded", true)
+			}
+		}
+	}
+
+	if len(cb.Upgrade.writing) > 0 {
+		return
+	}
+
+	cb.finishUpgrade()
+}
+
+// finishUpgrade hands over the users once their readers and writers stopped.
+func (cb *Catbox) finishUpgrade() {
+	state := cb.Upgrade.state
+	fds := cb.Upgrade.fds
+
+	var handedOver []*LocalUser
+	for _, lu := range cb.LocalUsers {
+		fd, err := dupDescriptor(lu.Conn.conn)
+		if err != nil {
+			coreLog.Warnf("Unable to hand over user %s: %s", lu, err)
+			lu.quit("Server upgrading", true)
+			continue
+		}
+		fds = append(fds, fd)
+
+		su := newUpgradeUser(lu, fd)
+		// Messages we queued for flood control come before the rest.
+		for _, m := range lu.MessageQueue {
+			buf, err := m.Encode()
+			if err != nil && err != irc.ErrTruncated {
+				continue
+			}
+			su.Unread = append(su.Unread, buf...)
+		}
+		su.Unread = append(su.Unread, cb.Upgrade.unread[lu.ID]...)
+
+		state.Users = append(state.Users, su)
+		handedOver = append(handedOver, lu)
+	}
+
+	for _, channel := range cb.Channels {
+		state.Channels = append(state.Channels, newUpgradeChannel(channel))
+	}
+
+	cb.NextClientIDLock.Lock()
+	state.NextClientID = cb.NextClientID
+	cb.NextClientIDLock.Unlock()
+
+	cb.Upgrade = nil
+
+	file, err := writeUpgradeState(state)
+	if err != nil {
+		// We already dropped servers and TLS users. Carry on as a restart.
+		cb.noticeOpers(fmt.Sprintf("Unable to upgrade, restarting: %s", err))
+		closeDescriptors(fds)
+		cb.Restart = true
+		cb.shutdown()
+		return
+	}
+
+	// Their writers left our copy of their connections open. The new process
+	// has its own.
+	for _, lu := range handedOver {
+		if err := lu.Conn.Close(); err != nil {
+			coreLog.Warnf("Error closing connection for user %s: %s", lu, err)
+		}
+		delete(cb.LocalUsers, lu.ID)
+	}
+
+	cb.Restart = true
+	cb.UpgradeFile = file
+	cb.shutdown()
+}
+
+// dupDescriptor duplicates the descriptor of a listener or connection. Unlike
+// ours, the duplicate stays open when we exec.
+func dupDescriptor(conn interface{}) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1, fmt.Errorf("unable to get descriptor for %T", conn)
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	// Hold the fork lock so no process we start gets the descriptor.
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+
+	newFD := -1
+	var dupErr error
+	if err := rc.Control(func(fd uintptr) {
+		newFD, dupErr = syscall.Dup(int(fd))
+	}); err != nil {
+		return -1, err
+	}
+	if dupErr != nil {
+		return -1, dupErr
+	}
+	return newFD, nil
+}
+
+func closeDescriptors(fds []int) {
+	for _, fd := range fds {
+		if err := syscall.Close(fd); err != nil {
+			coreLog.Warnf("Error closing descriptor %d: %s", fd, err)
+		}
+	}
+}
+
+func newUpgradeUser(lu *LocalUser, fd int) upgradeUser {
+	u := lu.User
+
+	var caps []string
+	for c := range lu.Caps {
+		caps = append(caps, c)
+	}
+
+	var accepts []TS6UID
+	for uid := range lu.Accepts {
+		accepts = append(accepts, uid)
+	}
+
+	return upgradeUser{
+		FD:                  fd,
+		ID:                  lu.ID,
+		ClientHostname:      lu.Hostname,
+		Tor:                 lu.Tor,
+		ConnectionStartTime: lu.ConnectionStartTime,
+		Caps:                caps,
+
+		DisplayNick: u.DisplayNick,
+		NickTS:      u.NickTS,
+		Modes:       u.modesString()[1:],
+		Username:    u.Username,
+		Hostname:    u.Hostname,
+		DisplayHost: u.DisplayHost,
+		IP:          u.IP,
+		UID:         u.UID,
+		RealName:    u.RealName,
+		AwayMessage: u.AwayMessage,
+		Account:     u.Account,
+		CertFP:      u.CertFP,
+		FloodExempt: u.FloodExempt,
+
+		LastMessageTime:  lu.LastMessageTime,
+		Accepts:          accepts,
+		Vhost:            lu.Vhost,
+		NickServDeadline: lu.NickServDeadline,
+		UserConfigName:   lu.UserConfigName,
+	}
+}
+
+func newUpgradeChannel(channel *Channel) upgradeChannel {
+	c := upgradeChannel{
+		Name:              channel.Name,
+		TS:                channel.TS,
+		Topic:             channel.Topic,
+		TopicTS:           channel.TopicTS,
+		TopicSetter:       channel.TopicSetter,
+		Key:               channel.Key,
+		Limit:             channel.Limit,
+		JoinThrottleCount: channel.JoinThrottleCount,
+		JoinThrottleTime:  channel.JoinThrottleTime,
+		Forward:           channel.Forward,
+		Lists:             map[string][]ChannelMask{},
+		Invites:           channel.Invites,
+		ModLog:            channel.ModLog,
+	}
+	for mode := range channel.Modes {
+		c.Modes += string(mode)
+	}
+	for mode, masks := range channel.Lists {
+		c.Lists[string(mode)] = masks
+	}
+	for uid := range channel.Members {
+		c.Members = append(c.Members, uid)
+	}
+	for uid := range channel.Ops {
+		c.Ops = append(c.Ops, uid)
+	}
+	return c
+}
+
+// writeUpgradeState writes the state to a file for the new process. Only we
+// can read it as it has information about users.
+func writeUpgradeState(state upgradeState) (string, error) {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return "", fmt.Errorf("error encoding state: %s", err)
+	}
+
+	f, err := ioutil.TempFile("", "catbox-upgrade-")
+	if err != nil {
+		return "", fmt.Errorf("error creating state file: %s", err)
+	}
+
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("error writing state file: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("error closing state file: %s", err)
+	}
+
+	return f.Name(), nil
+}
+
+// restoreUpgrade takes over the listeners and users the process we upgraded
+// from handed us. We remove the state file.
+func (cb *Catbox) restoreUpgrade(file string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading upgrade state: %s", err)
+	}
+
+	if err := os.Remove(file); err != nil {
+		coreLog.Warnf("Error removing upgrade state file: %s", err)
+	}
+
+	var state upgradeState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return fmt.Errorf("error decoding upgrade state: %s: %s", file, err)
+	}
+
+	// Our config reflects where we listen. A rehash moves the listeners if the
+	// config file says otherwise.
+	cb.Config.ListenHost = state.ListenHost
+	cb.Config.ListenPort = state.ListenPort
+	cb.Config.ListenPortTLS = state.ListenPortTLS
+	cb.Config.ListenHostTor = state.ListenHostTor
+	cb.Config.ListenPortTor = state.ListenPortTor
+
+	if state.ListenerFD != -1 {
+		ln, err := fileListener(state.ListenerFD)
+		if err != nil {
+			return fmt.Errorf("unable to listen: %s", err)
+		}
+		cb.Listener = ln
+	}
+
+	if state.TLSListenerFD != -1 {
+		if err := cb.setupTLS(cb.Config); err != nil {
+			return err
+		}
+		ln, err := fileListener(state.TLSListenerFD)
+		if err != nil {
+			return fmt.Errorf("unable to listen (TLS): %s", err)
+		}
+		tcpLN, ok := ln.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("unable to listen (TLS): not a TCP listener")
+		}
+		cb.TLSListener = tlsListener{
+			Listener: tls.NewListener(tcpLN, cb.TLSConfig),
+			tcp:      tcpLN,
+		}
+	}
+
+	if state.TorListenerFD != -1 {
+		ln, err := fileListener(state.TorListenerFD)
+		if err != nil {
+			return fmt.Errorf("unable to listen (Tor): %s", err)
+		}
+		cb.TorListener = ln
+	}
+
+	// If the old process predates the servers listener, we keep what the config
+	// file says.
+	if state.ListenPortServers != "" {
+		cb.Config.ListenHostServers = state.ListenHostServers
+		cb.Config.ListenPortServers = state.ListenPortServers
+
+		if state.ServersListenerFD != -1 {
+			ln, err := fileListener(state.ServersListenerFD)
+			if err != nil {
+				return fmt.Errorf("unable to listen (servers): %s", err)
+			}
+			cb.ServersListener = ln
+		}
+	}
+
+	cb.NextClientID = state.NextClientID
+
+	var users []*LocalUser
+	for _, su := range state.Users {
+		lu, err := cb.restoreUser(su)
+		if err != nil {
+			coreLog.Warnf("Unable to restore user %s: %s", su.DisplayNick, err)
+			continue
+		}
+		users = append(users, lu)
+	}
+
+	for _, sc := range state.Channels {
+		cb.restoreChannel(sc)
+	}
+
+	cb.updateCounters()
+	cb.recordUserCount()
+
+	for _, lu := range users {
+		cb.WG.Add(1)
+		go lu.writeLoop()
+		cb.WG.Add(1)
+		go lu.readLoop()
+
+		lu.serverNotice("Server upgraded.")
+	}
+
+	coreLog.Infof("Restored %d users and %d channels from upgrade", len(users),
+		len(cb.Channels))
+	return nil
+}
+
+// fileListener makes a listener from a descriptor we inherited.
+func fileListener(fd int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), "<listener>")
+	// FileListener duplicates the descriptor.
+	defer func() {
+		_ = f.Close()
+	}()
+	return net.FileListener(f)
+}
+
+func (cb *Catbox) restoreUser(su upgradeUser) (*LocalUser, error) {
+	f := os.NewFile(uintptr(su.FD), "<client>")
+	// FileConn duplicates the descriptor.
+	conn, err := net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewLocalClient(cb, su.ID, conn)
+	c.Conn.prependRead(su.Unread)
+	c.Hostname = su.ClientHostname
+	c.Tor = su.Tor
+	c.ConnectionStartTime = su.ConnectionStartTime
+	for _, capability := range su.Caps {
+		c.Caps[capability] = struct{}{}
+	}
+
+	lu := NewLocalUser(c)
+	lu.LastMessageTime = su.LastMessageTime
+	for _, uid := range su.Accepts {
+		lu.Accepts[uid] = struct{}{}
+	}
+	lu.Vhost = su.Vhost
+	lu.NickServDeadline = su.NickServDeadline
+	lu.UserConfigName = su.UserConfigName
+	lu.SendQueueLimit = cb.userSendQueue(lu.UserConfigName)
+
+	u := &User{
+		DisplayNick: su.DisplayNick,
+		NickTS:      su.NickTS,
+		Modes:       make(map[byte]struct{}),
+		Username:    su.Username,
+		Hostname:    su.Hostname,
+		DisplayHost: su.DisplayHost,
+		IP:          su.IP,
+		UID:         su.UID,
+		RealName:    su.RealName,
+		AwayMessage: su.AwayMessage,
+		Account:     su.Account,
+		CertFP:      su.CertFP,
+		Channels:    make(map[string]*Channel),
+		FloodExempt: su.FloodExempt,
+		LocalUser:   lu,
+	}
+	for i := 0; i < len(su.Modes); i++ {
+		u.Modes[su.Modes[i]] = struct{}{}
+	}
+	lu.User = u
+
+	cb.LocalUsers[lu.ID] = lu
+	cb.Nicks[canonicalizeNick(u.DisplayNick)] = u.UID
+	cb.Users[u.UID] = u
+	if u.isOperator() {
+		cb.Opers[u.UID] = u
+	}
+	return lu, nil
+}
+
+// restoreChannel recreates a channel. We leave out members we couldn't
+// restore.
+func (cb *Catbox) restoreChannel(sc upgradeChannel) {
+	channel := NewChannel(sc.Name, sc.TS)
+	channel.Topic = sc.Topic
+	channel.TopicTS = sc.TopicTS
+	channel.TopicSetter = sc.TopicSetter
+	for i := 0; i < len(sc.Modes); i++ {
+		channel.Modes[sc.Modes[i]] = struct{}{}
+	}
+	channel.Key = sc.Key
+	channel.Limit = sc.Limit
+	channel.JoinThrottleCount = sc.JoinThrottleCount
+	channel.JoinThrottleTime = sc.JoinThrottleTime
+	channel.Forward = sc.Forward
+	for mode, masks := range sc.Lists {
+		channel.Lists[mode[0]] = masks
+	}
+	for uid, invite := range sc.Invites {
+		channel.Invites[uid] = invite
+	}
+	channel.ModLog = sc.ModLog
+
+	for _, uid := range sc.Members {
+		u, exists := cb.Users[uid]
+		if !exists {
+			continue
+		}
+		channel.Members[uid] = struct{}{}
+		u.Channels[channel.Name] = channel
+	}
+	if len(channel.Members) == 0 {
+		return
+	}
+
+	for _, uid := range sc.Ops {
+		if u, exists := cb.Users[uid]; exists {
+			channel.Ops[uid] = u
+		}
+	}
+
+	cb.Channels[channel.Name] = channel
+}
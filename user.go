@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"net"
 )
 
 // User holds information about a user. It may be remote or local.
@@ -16,15 +16,20 @@ type User struct {
 	// The user's nick's TS. This changes on registration and NICK.
 	NickTS int64
 
-	// The user's modes. Currently +i, +o, +C supported.
+	// The user's modes. See isUserMode() for those we support.
 	Modes map[byte]struct{}
 
 	// The user's username.
 	Username string
 
-	// The user's hostname.
+	// The user's hostname. This is their real host (or spoof). We match bans
+	// and K-Lines against it.
 	Hostname string
 
+	// The hostname we show others. This differs from Hostname if the user is
+	// cloaked (+x).
+	DisplayHost string
+
 	// The user's IP. Not always a valid looking IP (e.g. may be 0 if a spoofed
 	// user sent to us from a different server).
 	IP string
@@ -39,6 +44,14 @@ type User struct {
 	// Away message. If blank, they're not away.
 	AwayMessage string
 
+	// The services account the user is logged in to. Blank if they are not
+	// logged in.
+	Account string
+
+	// The SHA-256 fingerprint (hex) of the TLS client certificate the user
+	// presented. Blank if they did not present one.
+	CertFP string
+
 	// Channel name (canonicalized) to Channel. The channels it is in.
 	Channels map[string]*Channel
 
@@ -64,7 +77,7 @@ func (u *User) String() string {
 }
 
 func (u *User) nickUhost() string {
-	return fmt.Sprintf("%s!%s@%s", u.DisplayNick, u.Username, u.Hostname)
+	return fmt.Sprintf("%s!%s@%s", u.DisplayNick, u.Username, u.DisplayHost)
 }
 
 func (u *User) isOperator() bool {
@@ -72,12 +85,31 @@ func (u *User) isOperator() bool {
 	return exists
 }
 
+func (u *User) isInvisible() bool {
+	_, exists := u.Modes['i']
+	return exists
+}
+
 // Is the user on the given channel?
 func (u *User) onChannel(channel *Channel) bool {
 	_, exists := u.Channels[channel.Name]
 	return exists
 }
 
+// isUserMode tells whether we support the user mode.
+//
+// C - See connections (CLICONN). Operators only
+// g - Caller ID. Only receive private messages from users you accept
+// i - Invisible
+// o - Operator
+// w - See WALLOPS
+// x - Cloak hostname
+// y - See who WHOISes you. Operators only
+func isUserMode(mode byte) bool {
+	return mode == 'C' || mode == 'g' || mode == 'i' || mode == 'o' ||
+		mode == 'w' || mode == 'x' || mode == 'y'
+}
+
 // Make a string of their user modes. + if no modes.
 func (u *User) modesString() string {
 	s := "+"
@@ -95,6 +127,17 @@ func (u *User) isRemote() bool {
 	return !u.isLocal()
 }
 
+// isTor tells whether the user is local and connected through Tor.
+func (u *User) isTor() bool {
+	return u.isLocal() && u.LocalUser.Tor
+}
+
+// seesRealHosts tells whether the user may see other users' real hosts and
+// IPs. Operators may, unless they connected through Tor.
+func (u *User) seesRealHosts() bool {
+	return u.isOperator() && !u.isTor()
+}
+
 // Is a user flood exempt?
 //
 // If they are an oper, they are.
@@ -108,21 +151,85 @@ func (u *User) isFloodExempt() bool {
 //
 // If there are no wildcards in the mask, then it must match our user@host.
 //
-// We support glob style (*) wildcards and ? to match any single char.
+// We support glob style (*) wildcards and ? to match any single char. The
+// masks must match all of the username and hostname.
 func (u *User) matchesMask(userMask, hostMask string) bool {
-	userRE, err := maskToRegex(userMask)
-	if err != nil {
-		log.Printf("matchesMask: %s", err)
+	return matchMask(userMask, u.Username) && matchMask(hostMask, u.Hostname)
+}
+
+// Determine if the user matches the user@host mask by their hostname or IP.
+// The host mask may be a CIDR.
+func (u *User) matchesUserHostMask(userMask, hostMask string) bool {
+	if !matchMask(userMask, u.Username) {
 		return false
 	}
-	if !userRE.MatchString(u.Username) {
-		return false
+	if matchMask(hostMask, u.Hostname) || matchMask(hostMask, u.IP) {
+		return true
 	}
 
-	hostRE, err := maskToRegex(hostMask)
+	_, network, err := net.ParseCIDR(hostMask)
 	if err != nil {
-		log.Printf("matchesMask: %s", err)
 		return false
 	}
-	return hostRE.MatchString(u.Hostname)
+	ip := net.ParseIP(u.IP)
+	return ip != nil && network.Contains(ip)
+}
+
+// Determine if the user matches a channel mask (e.g., a ban). Channel masks
+// look like nick!user@host.
+//
+// We check the user's displayed hostname, real hostname, and IP.
+//
+// Masks may also be extbans. See matchesExtban().
+func (u *User) matchesChannelMask(mask string) bool {
+	if isExtban(mask) {
+		return u.matchesExtban(mask)
+	}
+
+	if matchMask(mask, u.nickUhost()) {
+		return true
+	}
+	if u.Hostname != u.DisplayHost &&
+		matchMask(mask, fmt.Sprintf("%s!%s@%s", u.DisplayNick, u.Username,
+			u.Hostname)) {
+		return true
+	}
+	return matchMask(mask, fmt.Sprintf("%s!%s@%s", u.DisplayNick, u.Username,
+		u.IP))
+}
+
+// Determine if the user matches an extban. These match on something other than
+// nick!user@host. Like charybdis, we support:
+//
+// $a - Matches users logged in to an account.
+// $a:<account> - Matches users logged in to the account. May be a mask.
+// $z - Matches users connected with TLS.
+// $z:<fingerprint> - Matches users with the TLS client certificate
+// fingerprint. May be a mask.
+//
+// Any may be negated with ~. e.g., $~a matches users not logged in.
+func (u *User) matchesExtban(mask string) bool {
+	negate, typ, param := parseExtban(mask)
+
+	matched := false
+	switch typ {
+	case 'a':
+		if param == "" {
+			matched = u.Account != ""
+		} else {
+			matched = u.Account != "" && matchMask(param, u.Account)
+		}
+	case 'z':
+		if param == "" {
+			// We only know whether remote users use TLS if they have a certificate.
+			matched = u.CertFP != "" || (u.isLocal() && u.LocalUser.isTLS())
+		} else {
+			matched = u.CertFP != "" && matchMask(param, u.CertFP)
+		}
+	}
+
+	if negate {
+		return !matched
+	}
+	return matched
 }
@@ -2,21 +2,42 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
-// 50 from RFC
+// 50 from RFC. The config may set a shorter limit for channels our users
+// create (max-channel-length).
 const maxChannelLength = 50
 
-// Arbitrary. Something low enough we won't hit message limit.
+// Arbitrary. Something low enough we won't hit message limit. This is the
+// longest the config may set (max-topic-length).
 const maxTopicLength = 300
 
+// The longest hostname we let operators or the config give a user. This is
+// ratbox's HOSTLEN.
+const maxHostLength = 63
+
+// Arbitrary, like topic length. ratbox uses this for kick comments too.
+const maxKickLength = 300
+
+// Arbitrary, like topic length. This is the longest the config may set
+// (max-away-length).
+const maxAwayLength = 300
+
 // There is no limit defined in any RFC that I see. However, ratbox has username
 // length hardcoded to 10, and truncates at that.
 // It counts ~ in its length.
@@ -26,6 +47,37 @@ const maxUsernameLength = 10
 // This matches ratbox's.
 const maxRealNameLength = 50
 
+// Channel keys longer than this we truncate. This matches ratbox's.
+const maxChannelKeyLength = 23
+
+// Channel list masks (e.g., bans) longer than this we reject. Arbitrary.
+const maxChannelMaskLength = 100
+
+// The most users a user may have on their accept list (caller ID). This
+// matches ratbox's default.
+const maxAccepts = 20
+
+// How long we wait between telling a +g user that someone is trying to message
+// them. This matches ratbox's default.
+const callerIDNoticeTime = time.Minute
+
+// How long we wait between telling operators that a user is join/part
+// flooding.
+const joinPartNoticeTime = time.Minute
+
+// How many channels we send in reply to a LIST at once. We send more each
+// second until we're done.
+const listChunkSize = 100
+
+// How long users who are not operators must wait between listing all
+// channels.
+const listWaitTime = 30 * time.Second
+
+// Limits on join throttle (+j) parameters. We remember the time of each join
+// within the window, so we don't let the count be large. Arbitrary.
+const maxJoinThrottleCount = 100
+const maxJoinThrottleTime = 3600
+
 // ByHopCount is a sort type for sorting *Servers by their hop count
 type ByHopCount []*Server
 
@@ -63,6 +115,13 @@ func canonicalizeNick(n string) string {
 	return string(b)
 }
 
+// isLocalChannel decides whether a channel name is for a local channel. Local
+// channels start with &. They exist only on this server. We never tell other
+// servers about them.
+func isLocalChannel(name string) bool {
+	return len(name) > 0 && name[0] == '&'
+}
+
 // canonicalizeChannel converts the given channel to its canonical
 // representation (which must be unique).
 //
@@ -232,8 +291,8 @@ func isValidChannel(c string) bool {
 	// I accept only a-z or 0-9 as valid characters right now. RFC accepts more.
 	for i, char := range c {
 		if i == 0 {
-			// I only allow # channels right now.
-			if char == '#' {
+			// We allow # and & (local) channels.
+			if char == '#' || char == '&' {
 				continue
 			}
 			return false
@@ -263,6 +322,68 @@ func isValidHostname(s string) bool {
 	return matched
 }
 
+// cloakHost hides a host behind a hash of it keyed by key.
+//
+// For hostnames we keep all but the first label so people can still tell
+// roughly where a user connects from. e.g., dsl-1-2-3-4.example.com becomes
+// <hash>.example.com. IPs we hash entirely, e.g., <hash>.ip.
+//
+// IPv6 users usually have a /64 to themselves, so for IPv6 IPs we add a hash
+// of the /64, e.g., <hash>.<hash of /64>.ip. This way a ban on *.<hash of
+// /64>.ip covers all of their addresses.
+func cloakHost(key, host string) string {
+	hash := cloakHash(key, host)[:16]
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			prefix := &net.IPNet{IP: ip.Mask(ipv6PrefixMask), Mask: ipv6PrefixMask}
+			return hash[:8] + "." + cloakHash(key, prefix.String())[:16] + ".ip"
+		}
+		return hash + ".ip"
+	}
+
+	if idx := strings.Index(host, "."); idx != -1 {
+		return hash + host[idx:]
+	}
+	return hash
+}
+
+func cloakHash(key, s string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ipv6PrefixMask is the size of network we treat as one IPv6 user's.
+var ipv6PrefixMask = net.CIDRMask(64, 128)
+
+// ts6IP formats an IP for UID. TS6 says IPs starting with ":" (e.g., "::1")
+// get a "0" prepended ("0::1"), as we can't send a parameter starting with
+// ":" other than the last.
+func ts6IP(ip net.IP) string {
+	s := ip.String()
+	if s[0] == ':' {
+		return "0" + s
+	}
+	return s
+}
+
+// isValidTS6IP checks an IP from UID. It is either an IP formatted as ts6IP()
+// does or "0" if the IP is unknown (e.g., the user has a spoof).
+func isValidTS6IP(s string) bool {
+	if s == "0" {
+		return true
+	}
+	return s != "" && s[0] != ':' && net.ParseIP(s) != nil
+}
+
+// isValidVhost checks if a host looks acceptable to give a user as a vhost.
+// It must be a hostname that fits in the host field of TS6 messages.
+func isValidVhost(s string) bool {
+	return len(s) > 0 && len(s) <= maxHostLength && s[0] != '-' &&
+		isValidHostname(s)
+}
+
 // Check if a string is a valid user mask.
 // This is a pattern with * or ? glob style characters.
 // It matches the user portion of a user@host
@@ -278,15 +399,30 @@ func isValidUserMask(s string) bool {
 // This is a pattern with * or ? glob style characters.
 // It matches the host portion of a user@host
 //
+// It may also be a CIDR. We match those against the IP.
+//
 // TODO: Improve the host regex
 func isValidHostMask(s string) bool {
-	matched, err := regexp.MatchString("^[a-zA-Z0-9-.*?]+$", s)
+	if s == "" || s[0] == ':' {
+		return false
+	}
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+	// ":" so masks may match IPv6 IPs.
+	matched, err := regexp.MatchString("^[a-zA-Z0-9-.*?:]+$", s)
 	if err != nil {
 		return false
 	}
 	return matched
 }
 
+// isServerPrefix tells whether a message prefix is a server name rather than
+// a user. Server names have a '.' and nicks may not.
+func isServerPrefix(prefix string) bool {
+	return strings.Contains(prefix, ".") && !strings.Contains(prefix, "!")
+}
+
 func isNumericCommand(command string) bool {
 	for _, c := range command {
 		if c < 48 || c > 57 {
@@ -372,20 +508,276 @@ func makeTS6ID(id uint64) (TS6ID, error) {
 	return TS6ID(ts6id), nil
 }
 
-// Convert a mask to a regexp.
-// This quotes all regexp metachars, and then turns "*" into ".*", and "?"
-// into ".".
-func maskToRegex(mask string) (*regexp.Regexp, error) {
-	regex := regexp.QuoteMeta(mask)
+// matchMask checks whether the string matches the mask. The mask may contain
+// glob style wildcards: * to match any number of characters and ? to match any
+// single character.
+//
+// The mask must match the entire string. Matching is case insensitive.
+func matchMask(mask, s string) bool {
+	regex := regexp.QuoteMeta(strings.ToLower(mask))
 	regex = strings.Replace(regex, "\\*", ".*", -1)
 	regex = strings.Replace(regex, "\\?", ".", -1)
 
-	re, err := regexp.Compile(regex)
+	re, err := regexp.Compile("^" + regex + "$")
 	if err != nil {
-		return nil, err
+		return false
+	}
+
+	return re.MatchString(strings.ToLower(s))
+}
+
+// normalizeChannelMask turns a mask given for a channel list (e.g., a ban)
+// into its full nick!user@host form. e.g., "nick" becomes "nick!*@*", and
+// "*.example.com" becomes "*!*@*.example.com".
+//
+// Extbans (e.g., $a:account) we accept as they are if they are valid.
+//
+// Returns blank if the mask is not acceptable.
+func normalizeChannelMask(s string) string {
+	if len(s) == 0 || len(s) > maxChannelMaskLength || s[0] == ':' ||
+		strings.ContainsAny(s, " ,") {
+		return ""
+	}
+
+	if isExtban(s) {
+		_, typ, _ := parseExtban(s)
+		if typ != 'a' && typ != 'z' {
+			return ""
+		}
+		return s
+	}
+
+	nick, user, host := "", "", ""
+
+	bang := strings.Index(s, "!")
+	at := strings.LastIndex(s, "@")
+
+	if bang != -1 && at != -1 && at < bang {
+		return ""
+	}
+
+	if bang == -1 && at == -1 {
+		// A hostname looks like it has a . or a : in it. Otherwise treat it as a
+		// nick.
+		if strings.ContainsAny(s, ".:") {
+			host = s
+		} else {
+			nick = s
+		}
+	} else if bang == -1 {
+		user = s[:at]
+		host = s[at+1:]
+	} else if at == -1 {
+		nick = s[:bang]
+		user = s[bang+1:]
+	} else {
+		nick = s[:bang]
+		user = s[bang+1 : at]
+		host = s[at+1:]
+	}
+
+	if nick == "" {
+		nick = "*"
+	}
+	if user == "" {
+		user = "*"
+	}
+	if host == "" {
+		host = "*"
+	}
+
+	if strings.ContainsAny(nick+user+host, "!@") {
+		return ""
+	}
+
+	return nick + "!" + user + "@" + host
+}
+
+// cleanChannelKey makes a channel key acceptable. We truncate it if it is too
+// long, and strip characters that cannot appear in a key.
+//
+// Returns blank if there is nothing left.
+func cleanChannelKey(s string) string {
+	key := ""
+	for _, c := range s {
+		if c <= ' ' || c == ',' || c == ':' || c > '~' {
+			continue
+		}
+		key += string(c)
+		if len(key) == maxChannelKeyLength {
+			break
+		}
+	}
+	return key
+}
+
+// parseJoinThrottle parses a join throttle (+j) parameter. It looks like n:t
+// meaning at most n joins in t seconds.
+//
+// Returns false if it is not valid.
+func parseJoinThrottle(s string) (int, int, bool) {
+	idx := strings.Index(s, ":")
+	if idx == -1 {
+		return 0, 0, false
+	}
+
+	count, err := strconv.Atoi(s[:idx])
+	if err != nil || count <= 0 || count > maxJoinThrottleCount {
+		return 0, 0, false
+	}
+
+	seconds, err := strconv.Atoi(s[idx+1:])
+	if err != nil || seconds <= 0 || seconds > maxJoinThrottleTime {
+		return 0, 0, false
+	}
+
+	return count, seconds, true
+}
+
+// isValidForward checks a forward channel (+f) for the channel. Canonicalize
+// it first. A channel can't forward to itself.
+func isValidForward(channel *Channel, forward string) bool {
+	return isValidChannel(forward) && forward != channel.Name
+}
+
+// formatJoinThrottle makes a join throttle (+j) parameter.
+func formatJoinThrottle(count, seconds int) string {
+	return fmt.Sprintf("%d:%d", count, seconds)
+}
+
+// stripFormatting removes mIRC color and formatting codes from the text. We
+// leave CTCP delimiters alone.
+func stripFormatting(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+			// Bold, reset, monospace, reverse, italic, strikethrough, underline.
+		case '\x03':
+			// Color. \x03[fg[,bg]] where each color is up to 2 digits.
+			i += skipColorCode(s[i+1:], isDigit, 2)
+		case '\x04':
+			// Hex color. \x04[rrggbb[,rrggbb]].
+			i += skipColorCode(s[i+1:], isHexDigit, 6)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// isCleanText checks that text is valid UTF-8 and has no control characters
+// other than those for formatting and CTCP.
+func isCleanText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
 	}
+	for i := 0; i < len(s); i++ {
+		if isUnwantedControl(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanText makes text clean (see isCleanText). We replace invalid UTF-8 with
+// U+FFFD and remove unwanted control characters.
+func cleanText(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
 
-	return re, nil
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if !isUnwantedControl(s[i]) {
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// isUnwantedControl decides whether a byte is a control character we don't
+// want in text. We permit CTCP (\x01), formatting, and tab.
+func isUnwantedControl(c byte) bool {
+	switch c {
+	case '\x01', '\x02', '\x03', '\x04', '\t', '\x0f', '\x11', '\x16', '\x1d',
+		'\x1e', '\x1f':
+		return false
+	}
+	return c < 0x20 || c == 0x7f
+}
+
+// skipColorCode tells how many bytes of s are a color code's parameters:
+// [fg[,bg]], each at most width characters matching valid.
+func skipColorCode(s string, valid func(byte) bool, width int) int {
+	fg := 0
+	for fg < len(s) && fg < width && valid(s[fg]) {
+		fg++
+	}
+	if fg == 0 {
+		return 0
+	}
+
+	if fg+1 >= len(s) || s[fg] != ',' || !valid(s[fg+1]) {
+		return fg
+	}
+
+	bg := 0
+	for fg+1+bg < len(s) && bg < width && valid(s[fg+1+bg]) {
+		bg++
+	}
+	return fg + 1 + bg
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// isCTCP tells whether the message text is a CTCP.
+func isCTCP(s string) bool {
+	return len(s) > 0 && s[0] == '\x01'
+}
+
+// isCTCPAction tells whether the message text is a CTCP ACTION (/me).
+func isCTCPAction(s string) bool {
+	return strings.HasPrefix(strings.ToUpper(s), "\x01ACTION ") ||
+		strings.ToUpper(s) == "\x01ACTION\x01"
+}
+
+// isExtban tells whether the channel mask is an extban. Extbans start with $.
+func isExtban(mask string) bool {
+	return len(mask) > 0 && mask[0] == '$'
+}
+
+// parseExtban splits an extban into its parts. e.g., $~a:account gives negate
+// true, type a, and parameter account.
+//
+// Type is 0 if the extban is malformed.
+func parseExtban(mask string) (bool, byte, string) {
+	s := strings.TrimPrefix(mask, "$")
+
+	negate := false
+	if strings.HasPrefix(s, "~") {
+		negate = true
+		s = s[1:]
+	}
+
+	if len(s) == 0 {
+		return false, 0, ""
+	}
+
+	typ := s[0]
+	s = s[1:]
+
+	if len(s) == 0 {
+		return negate, typ, ""
+	}
+
+	if s[0] != ':' || len(s) == 1 {
+		return false, 0, ""
+	}
+
+	return negate, typ, s[1:]
 }
 
 var resolver = net.Resolver{
@@ -403,10 +795,9 @@ var resolver = net.Resolver{
 // then we say the client has that host.
 //
 // If none match, we return blank indicating no hostname found.
+//
+// The context bounds how long we take.
 func lookupHostname(ctx context.Context, ip net.IP) string {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-
 	names, err := resolver.LookupAddr(ctx, ip.String())
 	if err != nil {
 		return ""
@@ -550,13 +941,13 @@ func parseAndResolveUmodeChanges(modes string,
 	unknownModes := make(map[byte]struct{})
 
 	for mode := range requestSetModes {
-		if mode != 'i' && mode != 'o' && mode != 'C' {
+		if !isUserMode(mode) {
 			delete(requestSetModes, mode)
 			unknownModes[mode] = struct{}{}
 		}
 	}
 	for mode := range requestUnsetModes {
-		if mode != 'i' && mode != 'o' && mode != 'C' {
+		if !isUserMode(mode) {
 			delete(requestUnsetModes, mode)
 			unknownModes[mode] = struct{}{}
 		}
@@ -565,12 +956,11 @@ func parseAndResolveUmodeChanges(modes string,
 	// Unsetting certain modes triggers unsetting others. They're dependent.
 	for mode := range requestUnsetModes {
 		if mode == 'o' {
-			// Must be operator to have +C.
-			requestUnsetModes['C'] = struct{}{}
-			// Block any request to set it.
-			_, exists := requestSetModes['C']
-			if exists {
-				delete(requestSetModes, 'C')
+			// Must be operator to have +C or +y.
+			for _, operMode := range []byte{'C', 'y'} {
+				requestUnsetModes[operMode] = struct{}{}
+				// Block any request to set it.
+				delete(requestSetModes, operMode)
 			}
 		}
 	}
@@ -615,8 +1005,8 @@ func parseAndResolveUmodeChanges(modes string,
 			continue
 		}
 
-		// Must be +o to have +C.
-		if mode == 'C' {
+		// Must be +o to have +C or +y.
+		if mode == 'C' || mode == 'y' {
 			_, exists := currentModes['o']
 			if exists {
 				currentModes[mode] = struct{}{}
@@ -624,7 +1014,7 @@ func parseAndResolveUmodeChanges(modes string,
 			}
 		}
 
-		if mode == 'i' {
+		if mode == 'g' || mode == 'i' || mode == 'w' || mode == 'x' {
 			currentModes[mode] = struct{}{}
 			setModes[mode] = struct{}{}
 			continue
@@ -740,3 +1130,31 @@ func serverToMapLine(name string, sid TS6SID, localUsers, globalUsers,
 	// irc.example.com[000] ---------- | Users: n (100.0%)
 	return serverName + dashes + users
 }
+
+// writeFileAtomically writes buf to the file. We write to a temporary file
+// (named starting with prefix) and rename it so we never leave a partially
+// written file.
+func writeFileAtomically(file, prefix string, buf []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), prefix)
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %s", err)
+	}
+
+	if _, err := tmpFile.Write(buf); err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("unable to write temporary file: %s", err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("unable to close temporary file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), file); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("unable to rename temporary file: %s", err)
+	}
+
+	return nil
+}